@@ -0,0 +1,274 @@
+// Package acmeissuer obtains certificates from an ACME (RFC 8555) CA, e.g.
+// Let's Encrypt or an internal step-ca or Boulder, validating the names of
+// the requests with http-01 challenges, as a primary issuer or a fallback
+// to SCEP for the estates converging on one renewal agent.
+package acmeissuer
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// Solver answers the http-01 challenges, serving keyAuth at
+// /.well-known/acme-challenge/token of the names being validated.
+type Solver interface {
+	Present(ctx context.Context, token, keyAuth string) error
+	CleanUp(token string) error
+}
+
+// Config configures an Issuer.
+type Config struct {
+	// DirectoryURL is the URL of the directory of the CA, e.g.
+	// https://acme-v02.api.letsencrypt.org/directory.
+	DirectoryURL string
+
+	// AccountKey is the key of the account, registered on the first
+	// request, which must be kept for the renewals.
+	AccountKey crypto.Signer
+
+	// Email is the contact of the account, if not empty.
+	Email string
+
+	// EABKeyID and EABKey bind the account to an account of the CA,
+	// as required by commercial and some internal CAs.
+	EABKeyID string
+	EABKey   []byte
+
+	// Solver answers the http-01 challenges.
+	Solver Solver
+
+	// Client sends the requests, http.DefaultClient if nil.
+	Client *http.Client
+}
+
+// Issuer obtains certificates from an ACME CA.
+type Issuer struct {
+	config Config
+	client *acme.Client
+
+	mu         sync.Mutex
+	registered bool
+}
+
+// NewIssuer returns an Issuer of config.
+func NewIssuer(config Config) (*Issuer, error) {
+	if config.DirectoryURL == "" || config.AccountKey == nil || config.Solver == nil {
+		return nil, errors.New("acmeissuer: directory URL, account key and solver are required")
+	}
+	if config.Client == nil {
+		config.Client = http.DefaultClient
+	}
+	return &Issuer{
+		config: config,
+		client: &acme.Client{
+			Key:          config.AccountKey,
+			DirectoryURL: config.DirectoryURL,
+			HTTPClient:   config.Client,
+			UserAgent:    "scepclient",
+		},
+	}, nil
+}
+
+// Issue orders a certificate for the DNS names of the subject common name
+// and alternative names of csr, the DER encoding of a certificate request,
+// and returns it followed by its chain.
+func (i *Issuer) Issue(ctx context.Context, csr []byte) ([]*x509.Certificate, error) {
+	req, err := x509.ParseCertificateRequest(csr)
+	if err != nil {
+		return nil, fmt.Errorf("acmeissuer: %w", err)
+	}
+	names := req.DNSNames
+	if cn := req.Subject.CommonName; cn != "" && !contains(names, cn) {
+		names = append([]string{cn}, names...)
+	}
+	if len(names) == 0 {
+		return nil, errors.New("acmeissuer: the request has no DNS names")
+	}
+	if err := i.register(ctx); err != nil {
+		return nil, err
+	}
+
+	order, err := i.client.AuthorizeOrder(ctx, acme.DomainIDs(names...))
+	if err != nil {
+		return nil, fmt.Errorf("acmeissuer: ordering %s: %w", strings.Join(names, ", "), err)
+	}
+	for _, u := range order.AuthzURLs {
+		if err := i.authorize(ctx, u); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := i.client.WaitOrder(ctx, order.URI); err != nil {
+		return nil, fmt.Errorf("acmeissuer: waiting for the order: %w", err)
+	}
+	ders, _, err := i.client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, fmt.Errorf("acmeissuer: finalizing the order: %w", err)
+	}
+	certs := make([]*x509.Certificate, 0, len(ders))
+	for _, der := range ders {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, fmt.Errorf("acmeissuer: %w", err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("acmeissuer: the CA returned no certificate")
+	}
+	return certs, nil
+}
+
+// register registers the account, once, or finds it if it exists.
+func (i *Issuer) register(ctx context.Context) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.registered {
+		return nil
+	}
+	account := &acme.Account{}
+	if i.config.Email != "" {
+		account.Contact = []string{"mailto:" + i.config.Email}
+	}
+	if i.config.EABKeyID != "" {
+		account.ExternalAccountBinding = &acme.ExternalAccountBinding{KID: i.config.EABKeyID, Key: i.config.EABKey}
+	}
+	_, err := i.client.Register(ctx, account, acme.AcceptTOS)
+	if err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return fmt.Errorf("acmeissuer: registering the account: %w", err)
+	}
+	i.registered = true
+	return nil
+}
+
+// authorize answers the http-01 challenge of the authorization at u,
+// unless it is already valid.
+func (i *Issuer) authorize(ctx context.Context, u string) error {
+	authz, err := i.client.GetAuthorization(ctx, u)
+	if err != nil {
+		return fmt.Errorf("acmeissuer: %w", err)
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+	var chal *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == "http-01" {
+			chal = c
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("acmeissuer: no http-01 challenge for %s", authz.Identifier.Value)
+	}
+	keyAuth, err := i.client.HTTP01ChallengeResponse(chal.Token)
+	if err != nil {
+		return fmt.Errorf("acmeissuer: %w", err)
+	}
+	if err := i.config.Solver.Present(ctx, chal.Token, keyAuth); err != nil {
+		return fmt.Errorf("acmeissuer: presenting the challenge of %s: %w", authz.Identifier.Value, err)
+	}
+	defer i.config.Solver.CleanUp(chal.Token)
+	if _, err := i.client.Accept(ctx, chal); err != nil {
+		return fmt.Errorf("acmeissuer: accepting the challenge of %s: %w", authz.Identifier.Value, err)
+	}
+	if _, err := i.client.WaitAuthorization(ctx, authz.URI); err != nil {
+		return fmt.Errorf("acmeissuer: validating %s: %w", authz.Identifier.Value, err)
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// challengePath is the path of the http-01 challenges.
+const challengePath = "/.well-known/acme-challenge/"
+
+// Webroot answers the challenges with files in the
+// .well-known/acme-challenge directory of a web server's root.
+type Webroot string
+
+// Present writes the file of token.
+func (w Webroot) Present(ctx context.Context, token, keyAuth string) error {
+	dir := filepath.Join(string(w), filepath.FromSlash(challengePath))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, token), []byte(keyAuth), 0644)
+}
+
+// CleanUp removes the file of token.
+func (w Webroot) CleanUp(token string) error {
+	return os.Remove(filepath.Join(string(w), filepath.FromSlash(challengePath), token))
+}
+
+// Listener answers the challenges with an HTTP server of its own,
+// listening on Addr, e.g. :80, while challenges are presented.
+type Listener struct {
+	Addr string
+
+	mu       sync.Mutex
+	srv      *http.Server
+	keyAuths map[string]string
+}
+
+// Present starts the server, unless it is running, and serves
+// keyAuth for token.
+func (l *Listener) Present(ctx context.Context, token, keyAuth string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.srv == nil {
+		ln, err := net.Listen("tcp", l.Addr)
+		if err != nil {
+			return err
+		}
+		l.keyAuths = make(map[string]string)
+		l.srv = &http.Server{Handler: http.HandlerFunc(l.serve), ReadHeaderTimeout: 10 * time.Second}
+		go l.srv.Serve(ln)
+	}
+	l.keyAuths[token] = keyAuth
+	return nil
+}
+
+// CleanUp stops serving token, and stops the server
+// once there are no more challenges.
+func (l *Listener) CleanUp(token string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.keyAuths, token)
+	if len(l.keyAuths) > 0 || l.srv == nil {
+		return nil
+	}
+	err := l.srv.Close()
+	l.srv = nil
+	return err
+}
+
+func (l *Listener) serve(w http.ResponseWriter, r *http.Request) {
+	l.mu.Lock()
+	keyAuth, ok := l.keyAuths[strings.TrimPrefix(r.URL.Path, challengePath)]
+	l.mu.Unlock()
+	if !ok || !strings.HasPrefix(r.URL.Path, challengePath) {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(keyAuth))
+}
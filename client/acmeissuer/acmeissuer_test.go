@@ -0,0 +1,234 @@
+package acmeissuer
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"scepclient/scepserver/depot"
+)
+
+// fakeACME is an ACME CA of one order, validating its http-01
+// challenge with the key authorizations of solver.
+type fakeACME struct {
+	t          *testing.T
+	url        string
+	caCert     *x509.Certificate
+	caKey      *rsa.PrivateKey
+	solver     *mapSolver
+	thumbprint string
+
+	names     []string
+	validated map[string]bool
+	cert      []byte
+}
+
+type mapSolver map[string]string
+
+func (s mapSolver) Present(ctx context.Context, token, keyAuth string) error {
+	s[token] = keyAuth
+	return nil
+}
+
+func (s mapSolver) CleanUp(token string) error {
+	delete(s, token)
+	return nil
+}
+
+func (f *fakeACME) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Replay-Nonce", fmt.Sprint(time.Now().UnixNano()))
+	if r.URL.Path == "/directory" {
+		json.NewEncoder(w).Encode(map[string]string{
+			"newNonce":   f.url + "/nonce",
+			"newAccount": f.url + "/account",
+			"newOrder":   f.url + "/order",
+		})
+		return
+	}
+	if r.URL.Path == "/nonce" {
+		return
+	}
+	// the payload of the JWS, whose signature is not checked
+	var jws struct{ Payload string }
+	json.NewDecoder(r.Body).Decode(&jws)
+	payload, _ := base64.RawURLEncoding.DecodeString(jws.Payload)
+
+	w.Header().Set("Content-Type", "application/json")
+	order := func() map[string]interface{} {
+		status := "pending"
+		if len(f.validated) == len(f.names) {
+			status = "ready"
+		}
+		if f.cert != nil {
+			status = "valid"
+		}
+		var authzs []string
+		for _, name := range f.names {
+			authzs = append(authzs, f.url+"/authz/"+name)
+		}
+		return map[string]interface{}{
+			"status":         status,
+			"authorizations": authzs,
+			"finalize":       f.url + "/finalize",
+			"certificate":    f.url + "/cert",
+		}
+	}
+	switch path := r.URL.Path; {
+	case path == "/account":
+		w.Header().Set("Location", f.url+"/account/1")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"status":"valid"}`))
+	case path == "/order":
+		var req struct{ Identifiers []acme.AuthzID }
+		json.Unmarshal(payload, &req)
+		for _, id := range req.Identifiers {
+			f.names = append(f.names, id.Value)
+		}
+		w.Header().Set("Location", f.url+"/order/1")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(order())
+	case path == "/order/1":
+		json.NewEncoder(w).Encode(order())
+	case strings.HasPrefix(path, "/authz/"):
+		name := strings.TrimPrefix(path, "/authz/")
+		status := "pending"
+		if f.validated[name] {
+			status = "valid"
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":     status,
+			"identifier": map[string]string{"type": "dns", "value": name},
+			"challenges": []map[string]string{
+				{"type": "dns-01", "url": f.url + "/chal/dns/" + name, "token": "dns-" + name, "status": "pending"},
+				{"type": "http-01", "url": f.url + "/chal/" + name, "token": "token-" + name, "status": "pending"},
+			},
+		})
+	case strings.HasPrefix(path, "/chal/"):
+		name := strings.TrimPrefix(path, "/chal/")
+		token := "token-" + name
+		if (*f.solver)[token] == token+"."+f.thumbprint {
+			f.validated[name] = true
+		}
+		json.NewEncoder(w).Encode(map[string]string{"type": "http-01", "url": f.url + path, "token": token, "status": "processing"})
+	case path == "/finalize":
+		var req struct{ CSR string }
+		json.Unmarshal(payload, &req)
+		der, _ := base64.RawURLEncoding.DecodeString(req.CSR)
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil {
+			f.t.Error(err)
+			return
+		}
+		cert, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+			SerialNumber: big.NewInt(7),
+			Subject:      csr.Subject,
+			DNSNames:     f.names,
+			NotBefore:    time.Now().Add(-time.Minute),
+			NotAfter:     time.Now().Add(time.Hour),
+		}, f.caCert, csr.PublicKey, f.caKey)
+		if err != nil {
+			f.t.Error(err)
+			return
+		}
+		f.cert = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}),
+			pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: f.caCert.Raw})...)
+		json.NewEncoder(w).Encode(order())
+	case path == "/cert":
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(f.cert)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestIssue(t *testing.T) {
+	caCert, caKey, err := depot.GenerateCA(pkix.Name{CommonName: "ACME CA"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accountKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	thumbprint, err := acme.JWKThumbprint(accountKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	solver := make(mapSolver)
+	f := &fakeACME{t: t, caCert: caCert, caKey: caKey, solver: &solver, thumbprint: thumbprint, validated: make(map[string]bool)}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+	f.url = srv.URL
+
+	issuer, err := NewIssuer(Config{DirectoryURL: srv.URL + "/directory", AccountKey: accountKey, Solver: solver})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: "web.example.com"},
+		DNSNames: []string{"www.example.com"},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	certs, err := issuer.Issue(ctx, csr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 2 || !certs[1].Equal(caCert) {
+		t.Fatalf("expected the certificate and the CA certificate, got %d certificates", len(certs))
+	}
+	if got := strings.Join(certs[0].DNSNames, ","); got != "web.example.com,www.example.com" {
+		t.Errorf("expected the names of the subject and of the SANs, got %s", got)
+	}
+	if len(solver) != 0 {
+		t.Error("expected the challenges to be cleaned up")
+	}
+}
+
+func TestWebroot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acmeissuer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	w := Webroot(dir)
+	if err := w.Present(context.Background(), "tok", "tok.thumb"); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, ".well-known", "acme-challenge", "tok")
+	data, err := ioutil.ReadFile(path)
+	if err != nil || string(data) != "tok.thumb" {
+		t.Fatalf("expected the key authorization in %s, got %q, %v", path, data, err)
+	}
+	if err := w.CleanUp("tok"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("expected the challenge file to be removed")
+	}
+}
@@ -0,0 +1,300 @@
+// Package awssecret writes enrolled certificates, and optionally their
+// keys, to AWS Secrets Manager secrets or SSM Parameter Store parameters,
+// for EC2 and ECS fleets enrolling over SCEP and sharing their
+// certificates through AWS.
+//
+// It calls the JSON APIs of the services directly, signing the requests
+// with the credentials of the environment, the ECS task role or the EC2
+// instance profile.
+package awssecret
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	scepclient "scepclient/client"
+	"scepclient/client/bundle"
+	"scepclient/cloudauth"
+)
+
+// Config selects the AWS region, credentials and what is written.
+type Config struct {
+	// Region is the AWS region of the secrets and parameters.
+	Region string
+
+	// Credentials sign the requests, cloudauth.DefaultAWSCredentials if
+	// it is nil. Secrets need the secretsmanager:PutSecretValue,
+	// CreateSecret and TagResource permissions, parameters the
+	// ssm:PutParameter and AddTagsToResource permissions.
+	Credentials cloudauth.AWSCredentialsSource
+
+	// IncludeKey also writes the private key, which is left out by default.
+	IncludeKey bool
+
+	// KMSKeyID is the KMS key encrypting created secrets and the private
+	// key parameter, instead of the AWS managed key of the service.
+	KMSKeyID string
+
+	// Tags are added to the secrets and parameters, besides the
+	// scep:serial-number, scep:not-after and scep:renew-at tags
+	// describing the certificate for rotation.
+	Tags map[string]string
+
+	// SecretsManagerEndpoint and SSMEndpoint are the URLs of the APIs,
+	// https://secretsmanager.<Region>.amazonaws.com and
+	// https://ssm.<Region>.amazonaws.com by default.
+	SecretsManagerEndpoint string
+	SSMEndpoint            string
+
+	// Client sends the requests to AWS.
+	// http.DefaultClient is used if it is nil.
+	Client *http.Client
+}
+
+// Writer writes bundles to secrets and parameters.
+type Writer struct {
+	config Config
+}
+
+// NewWriter returns a Writer using config.
+func NewWriter(config Config) (*Writer, error) {
+	if config.Region == "" {
+		return nil, errors.New("awssecret: region is required")
+	}
+	if config.Client == nil {
+		config.Client = http.DefaultClient
+	}
+	if config.Credentials == nil {
+		config.Credentials = cloudauth.DefaultAWSCredentials(config.Client)
+	}
+	if config.SecretsManagerEndpoint == "" {
+		config.SecretsManagerEndpoint = "https://secretsmanager." + config.Region + ".amazonaws.com"
+	}
+	if config.SSMEndpoint == "" {
+		config.SSMEndpoint = "https://ssm." + config.Region + ".amazonaws.com"
+	}
+	return &Writer{config: config}, nil
+}
+
+// WriteSecret writes b as the new version of the secret secretID,
+// creating the secret if it does not exist. The secret string is a
+// JSON object with the fields certificate, ca_chain and private_key,
+// named like those of the Vault PKI engine, and the serial_number and
+// expiration, in Unix seconds, of the certificate.
+func (w *Writer) WriteSecret(ctx context.Context, secretID string, b bundle.Bundle) error {
+	crt, err := parseCertificate(b.Certificate)
+	if err != nil {
+		return err
+	}
+	data := map[string]interface{}{
+		"certificate":   string(b.Certificate),
+		"serial_number": crt.SerialNumber.Text(16),
+		"expiration":    crt.NotAfter.Unix(),
+	}
+	if len(b.CA) > 0 {
+		data["ca_chain"] = string(b.CA)
+	}
+	if w.config.IncludeKey {
+		data["private_key"] = string(b.Key)
+	}
+	value, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	tags := w.tags(crt)
+
+	err = w.call(ctx, "secretsmanager", "secretsmanager.PutSecretValue", map[string]interface{}{
+		"SecretId":     secretID,
+		"SecretString": string(value),
+	})
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.Type == "ResourceNotFoundException" {
+		create := map[string]interface{}{
+			"Name":         secretID,
+			"Description":  "Certificate of " + crt.Subject.CommonName + ", enrolled over SCEP",
+			"SecretString": string(value),
+			"Tags":         tags,
+		}
+		if w.config.KMSKeyID != "" {
+			create["KmsKeyId"] = w.config.KMSKeyID
+		}
+		return w.call(ctx, "secretsmanager", "secretsmanager.CreateSecret", create)
+	}
+	if err != nil {
+		return err
+	}
+	return w.call(ctx, "secretsmanager", "secretsmanager.TagResource", map[string]interface{}{
+		"SecretId": secretID,
+		"Tags":     tags,
+	})
+}
+
+// WriteParameters writes the certificate, the CA certificates and the
+// private key of b to the parameters certificate, ca_chain and
+// private_key under prefix, e.g. /scep/web/certificate, overwriting
+// their values. The private key is a SecureString parameter, the others
+// String parameters. The Intelligent-Tiering tier lets parameters
+// exceed the 4 KB of the standard tier, e.g. for long CA chains.
+func (w *Writer) WriteParameters(ctx context.Context, prefix string, b bundle.Bundle) error {
+	crt, err := parseCertificate(b.Certificate)
+	if err != nil {
+		return err
+	}
+	prefix = "/" + strings.Trim(prefix, "/")
+	type parameter struct {
+		name, value, typ string
+	}
+	params := []parameter{{"certificate", string(b.Certificate), "String"}}
+	if len(b.CA) > 0 {
+		params = append(params, parameter{"ca_chain", string(b.CA), "String"})
+	}
+	if w.config.IncludeKey {
+		params = append(params, parameter{"private_key", string(b.Key), "SecureString"})
+	}
+	tags := w.tags(crt)
+	for _, p := range params {
+		name := prefix + "/" + p.name
+		put := map[string]interface{}{
+			"Name":        name,
+			"Value":       p.value,
+			"Type":        p.typ,
+			"Overwrite":   true,
+			"Tier":        "Intelligent-Tiering",
+			"Description": "Enrolled over SCEP, serial number " + crt.SerialNumber.Text(16),
+		}
+		if p.typ == "SecureString" && w.config.KMSKeyID != "" {
+			put["KeyId"] = w.config.KMSKeyID
+		}
+		if err := w.call(ctx, "ssm", "AmazonSSM.PutParameter", put); err != nil {
+			return err
+		}
+		// tags cannot be set by PutParameter when overwriting
+		if err := w.call(ctx, "ssm", "AmazonSSM.AddTagsToResource", map[string]interface{}{
+			"ResourceType": "Parameter",
+			"ResourceId":   name,
+			"Tags":         tags,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type tag struct {
+	Key   string
+	Value string
+}
+
+// tags returns the tags of the resources holding crt.
+func (w *Writer) tags(crt *x509.Certificate) []tag {
+	tags := []tag{
+		{"scep:serial-number", crt.SerialNumber.Text(16)},
+		{"scep:not-after", crt.NotAfter.UTC().Format(time.RFC3339)},
+		{"scep:renew-at", scepclient.DefaultRenewalPolicy.RenewAt(crt).UTC().Format(time.RFC3339)},
+	}
+	keys := make([]string, 0, len(w.config.Tags))
+	for key := range w.config.Tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		tags = append(tags, tag{key, w.config.Tags[key]})
+	}
+	return tags
+}
+
+func parseCertificate(data []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("awssecret: no PEM encoded certificate")
+	}
+	crt, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("awssecret: %w", err)
+	}
+	return crt, nil
+}
+
+// APIError is an error response of an AWS API.
+type APIError struct {
+	// Action is the called action, e.g. secretsmanager.PutSecretValue.
+	Action string
+
+	// Status is the HTTP status of the response.
+	Status string
+
+	// Type is the exception type, e.g. ResourceNotFoundException.
+	Type string
+
+	Message string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("awssecret: %s failed with status %s: %s: %s", e.Action, e.Status, e.Type, e.Message)
+}
+
+// call calls target of the JSON API of service,
+// signing the request with AWS Signature Version 4.
+func (w *Writer) call(ctx context.Context, service, target string, in interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	endpoint := w.config.SecretsManagerEndpoint
+	if service == "ssm" {
+		endpoint = w.config.SSMEndpoint
+	}
+	creds, err := w.config.Credentials(ctx)
+	if err != nil {
+		return fmt.Errorf("awssecret: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", target)
+	cloudauth.SignV4(req, body, time.Now(), w.config.Region, service, creds)
+	resp, err := w.config.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("awssecret: %w", err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("awssecret: %w", err)
+	}
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	// the services send a Message or a message
+	var e struct {
+		Type       string `json:"__type"`
+		Message    string `json:"message"`
+		MessageAlt string `json:"Message"`
+	}
+	json.Unmarshal(data, &e)
+	apiErr := &APIError{Action: target, Status: resp.Status, Type: e.Type, Message: e.Message}
+	// the type may be qualified, as in com.amazonaws.ssm#ParameterNotFound
+	if i := strings.LastIndex(apiErr.Type, "#"); i >= 0 {
+		apiErr.Type = apiErr.Type[i+1:]
+	}
+	if apiErr.Message == "" {
+		apiErr.Message = e.MessageAlt
+	}
+	if apiErr.Type == "" && apiErr.Message == "" {
+		apiErr.Message = strings.TrimSpace(string(data))
+	}
+	return apiErr
+}
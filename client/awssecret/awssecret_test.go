@@ -0,0 +1,153 @@
+package awssecret
+
+import (
+	"context"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"scepclient/client/bundle"
+	"scepclient/cloudauth"
+	"scepclient/scepserver/depot"
+)
+
+// fakeAWS stores the secrets, parameters and tags of the requests.
+type fakeAWS struct {
+	secrets map[string]string
+	params  map[string]map[string]interface{}
+	tags    map[string][]interface{}
+}
+
+func (f *fakeAWS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"__type":"IncompleteSignature","message":"unsigned request"}`))
+		return
+	}
+	var in map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	switch r.Header.Get("X-Amz-Target") {
+	case "secretsmanager.PutSecretValue":
+		id := in["SecretId"].(string)
+		if _, ok := f.secrets[id]; !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"__type":"ResourceNotFoundException","Message":"Secrets Manager can't find the specified secret."}`))
+			return
+		}
+		f.secrets[id] = in["SecretString"].(string)
+	case "secretsmanager.CreateSecret":
+		f.secrets[in["Name"].(string)] = in["SecretString"].(string)
+		f.tags[in["Name"].(string)] = in["Tags"].([]interface{})
+	case "secretsmanager.TagResource":
+		f.tags[in["SecretId"].(string)] = in["Tags"].([]interface{})
+	case "AmazonSSM.PutParameter":
+		f.params[in["Name"].(string)] = in
+	case "AmazonSSM.AddTagsToResource":
+		f.tags[in["ResourceId"].(string)] = in["Tags"].([]interface{})
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"__type":"com.amazonaws#UnknownOperationException"}`))
+		return
+	}
+	w.Write([]byte(`{}`))
+}
+
+// tagValue returns the value of the tag key of tags.
+func tagValue(tags []interface{}, key string) interface{} {
+	for _, t := range tags {
+		if t := t.(map[string]interface{}); t["Key"] == key {
+			return t["Value"]
+		}
+	}
+	return nil
+}
+
+func TestWriter(t *testing.T) {
+	crt, _, err := depot.GenerateCA(pkix.Name{CommonName: "device"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: crt.Raw})
+	b := bundle.Bundle{Key: []byte("key"), Certificate: certPEM, CA: []byte("ca")}
+	aws := &fakeAWS{
+		secrets: make(map[string]string),
+		params:  make(map[string]map[string]interface{}),
+		tags:    make(map[string][]interface{}),
+	}
+	server := httptest.NewServer(aws)
+	defer server.Close()
+	ctx := context.Background()
+
+	w, err := NewWriter(Config{
+		Region:                 "eu-west-1",
+		Credentials:            cloudauth.StaticAWSCredentials(cloudauth.AWSCredentials{AccessKeyID: "AKID", SecretAccessKey: "secret"}),
+		Tags:                   map[string]string{"team": "web"},
+		SecretsManagerEndpoint: server.URL,
+		SSMEndpoint:            server.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		// the first write creates the secret, the second updates it
+		if err := w.WriteSecret(ctx, "scep/web", b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var data map[string]interface{}
+	if err := json.Unmarshal([]byte(aws.secrets["scep/web"]), &data); err != nil {
+		t.Fatal(err)
+	}
+	if data["certificate"] != string(certPEM) || data["ca_chain"] != "ca" || data["serial_number"] != crt.SerialNumber.Text(16) {
+		t.Errorf("expected the certificates in the secret, got %v", data)
+	}
+	if _, ok := data["private_key"]; ok {
+		t.Error("expected the private key to be left out by default")
+	}
+	tags := aws.tags["scep/web"]
+	if tagValue(tags, "team") != "web" || tagValue(tags, "scep:not-after") != crt.NotAfter.UTC().Format(time.RFC3339) {
+		t.Errorf("expected the configured and rotation tags, got %v", tags)
+	}
+
+	if err := w.WriteParameters(ctx, "/scep/web/", b); err != nil {
+		t.Fatal(err)
+	}
+	if p := aws.params["/scep/web/certificate"]; p["Value"] != string(certPEM) || p["Overwrite"] != true {
+		t.Errorf("expected the certificate parameter to be overwritten, got %v", p)
+	}
+	if _, ok := aws.params["/scep/web/private_key"]; ok {
+		t.Error("expected the private key to be left out by default")
+	}
+	if tagValue(aws.tags["/scep/web/ca_chain"], "scep:serial-number") != crt.SerialNumber.Text(16) {
+		t.Errorf("expected the parameters to be tagged, got %v", aws.tags)
+	}
+
+	w.config.IncludeKey = true
+	if err := w.WriteParameters(ctx, "scep/web", b); err != nil {
+		t.Fatal(err)
+	}
+	if p := aws.params["/scep/web/private_key"]; p["Value"] != "key" || p["Type"] != "SecureString" {
+		t.Errorf("expected the private key in a SecureString parameter, got %v", p)
+	}
+
+	w.config.Credentials = cloudauth.StaticAWSCredentials(cloudauth.AWSCredentials{AccessKeyID: "other", SecretAccessKey: "secret"})
+	var apiErr *APIError
+	if err := w.WriteSecret(ctx, "scep/web", b); !errors.As(err, &apiErr) || apiErr.Message != "unsigned request" {
+		t.Errorf("expected the error of the API, got %v", err)
+	}
+	if err := w.WriteSecret(ctx, "scep/web", bundle.Bundle{Certificate: []byte("garbage")}); err == nil {
+		t.Error("expected a malformed certificate to fail the write")
+	}
+	if _, err := NewWriter(Config{}); err == nil {
+		t.Error("expected the region to be required")
+	}
+}
@@ -0,0 +1,155 @@
+// Package azurekv imports enrolled certificates, with their keys, into
+// Azure Key Vault as Key Vault certificates, so that App Service,
+// Application Gateway and other Azure services bind certificates
+// issued over SCEP, and their renewals.
+//
+// It calls the Key Vault REST API directly, authenticating with the
+// managed identity of the instance or the client credentials of an
+// application.
+package azurekv
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"scepclient/client/bundle"
+	"scepclient/cloudauth"
+)
+
+const apiVersion = "7.4"
+
+// Config selects the vault and its authentication.
+type Config struct {
+	// VaultURL is the URL of the vault, https://<vault>.vault.azure.net.
+	VaultURL string
+
+	// Token authenticates the requests, for the resource
+	// https://vault.azure.net. It needs the certificates/import
+	// permission. If it is nil, the tokens of the managed identity of
+	// the instance are fetched from the instance metadata service.
+	Token cloudauth.TokenSource
+
+	// Tags are set on the imported certificate versions.
+	Tags map[string]string
+
+	// Client sends the requests to Key Vault.
+	// http.DefaultClient is used if it is nil.
+	Client *http.Client
+}
+
+// Writer imports bundles into a vault.
+type Writer struct {
+	config Config
+}
+
+// NewWriter returns a Writer using config.
+func NewWriter(config Config) (*Writer, error) {
+	if config.VaultURL == "" {
+		return nil, errors.New("azurekv: vault URL is required")
+	}
+	if config.Client == nil {
+		config.Client = http.DefaultClient
+	}
+	if config.Token == nil {
+		config.Token = cloudauth.AzureManagedIdentity(config.Client, "https://vault.azure.net", "")
+	}
+	return &Writer{config: config}, nil
+}
+
+// Import imports b as the new version of the certificate name, creating
+// the certificate if it does not exist. The key is marked exportable,
+// so that the secret of the certificate holds the key, certificate and
+// CA certificates in PEM, as services binding certificates expect.
+func (w *Writer) Import(ctx context.Context, name string, b bundle.Bundle) error {
+	key, err := pkcs8PEM(b.Key)
+	if err != nil {
+		return err
+	}
+	value := append(key, b.Certificate...)
+	value = append(value, b.CA...)
+	body := map[string]interface{}{
+		"value": string(value),
+		"policy": map[string]interface{}{
+			"key_props":    map[string]interface{}{"exportable": true},
+			"secret_props": map[string]interface{}{"contentType": "application/x-pem-file"},
+		},
+	}
+	if len(w.config.Tags) > 0 {
+		body["tags"] = w.config.Tags
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	token, err := w.config.Token(ctx)
+	if err != nil {
+		return fmt.Errorf("azurekv: %w", err)
+	}
+	u := strings.TrimSuffix(w.config.VaultURL, "/") + "/certificates/" + url.PathEscape(name) + "/import?api-version=" + apiVersion
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := w.config.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("azurekv: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	var e struct {
+		Error struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	respData, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if json.Unmarshal(respData, &e) != nil || e.Error.Message == "" {
+		return fmt.Errorf("azurekv: import %s failed with status %s", name, resp.Status)
+	}
+	return fmt.Errorf("azurekv: import %s failed with status %s: %s: %s", name, resp.Status, e.Error.Code, e.Error.Message)
+}
+
+// pkcs8PEM returns the PEM encoded private key keyPEM in PKCS #8,
+// the only encoding of keys that Key Vault imports from PEM.
+func pkcs8PEM(keyPEM []byte) ([]byte, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("azurekv: no PEM encoded private key")
+	}
+	var (
+		key interface{}
+		err error
+	)
+	switch block.Type {
+	case "PRIVATE KEY":
+		return pem.EncodeToMemory(block), nil
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("azurekv: unsupported private key type %s", block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("azurekv: %w", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("azurekv: %w", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
@@ -0,0 +1,74 @@
+package azurekv
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"scepclient/client/bundle"
+	"scepclient/cloudauth"
+)
+
+func TestWriter(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	var imported map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error":{"code":"Unauthorized","message":"AKV10000: Request is missing a Bearer or PoP token."}}`))
+			return
+		}
+		if r.URL.Path != "/certificates/web/import" || r.URL.Query().Get("api-version") != apiVersion {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		imported = nil
+		if err := json.NewDecoder(r.Body).Decode(&imported); err != nil {
+			t.Error(err)
+		}
+		w.Write([]byte(`{"id":"https://vault/certificates/web/1"}`))
+	}))
+	defer server.Close()
+
+	w, err := NewWriter(Config{VaultURL: server.URL, Token: cloudauth.StaticToken("token"), Tags: map[string]string{"team": "web"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := w.Import(ctx, "web", bundle.Bundle{Key: keyPEM, Certificate: []byte("cert\n"), CA: []byte("ca\n")}); err != nil {
+		t.Fatal(err)
+	}
+	value, _ := imported["value"].(string)
+	block, rest := pem.Decode([]byte(value))
+	if block == nil || block.Type != "PRIVATE KEY" || string(rest) != "cert\nca\n" {
+		t.Fatalf("expected the PKCS #8 key followed by the certificates, got %q", value)
+	}
+	if _, err := x509.ParsePKCS8PrivateKey(block.Bytes); err != nil {
+		t.Error(err)
+	}
+	if tags, _ := imported["tags"].(map[string]interface{}); tags["team"] != "web" {
+		t.Errorf("expected the tags, got %v", imported["tags"])
+	}
+
+	w.config.Token = cloudauth.StaticToken("expired")
+	if err := w.Import(ctx, "web", bundle.Bundle{Key: keyPEM}); err == nil || !strings.Contains(err.Error(), "AKV10000") {
+		t.Errorf("expected the error message of Key Vault, got %v", err)
+	}
+	if err := w.Import(ctx, "web", bundle.Bundle{Key: []byte("garbage")}); err == nil {
+		t.Error("expected a malformed key to fail the import")
+	}
+	if _, err := NewWriter(Config{}); err == nil {
+		t.Error("expected the vault URL to be required")
+	}
+}
@@ -0,0 +1,15 @@
+// Package bundle defines the key and certificates of an enrollment,
+// which the secret store writers of scepclient store.
+package bundle
+
+// Bundle holds the PEM encoded key and certificates of an enrollment.
+type Bundle struct {
+	// Key is the private key.
+	Key []byte
+
+	// Certificate is the issued certificate.
+	Certificate []byte
+
+	// CA holds the CA certificates returned by the SCEP server.
+	CA []byte
+}
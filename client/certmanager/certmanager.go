@@ -0,0 +1,188 @@
+// Package certmanager adapts scepclient to the signing step of a
+// cert-manager external issuer: it fulfills the CSR of a cert-manager
+// CertificateRequest by enrolling it with a SCEP server, bridging CAs
+// which only speak SCEP into Kubernetes.
+//
+// The package has no Kubernetes dependencies. An issuer controller,
+// built for example with cert-manager's issuer-lib, watches the
+// CertificateRequests of its issuer type and calls Issuer.Sign with
+// their spec.request. It sets status.certificate and status.ca from the
+// returned Certificate, requeues the request on ErrPending, and fails it
+// on a *scep.FailInfoError. Other errors are transient.
+//
+// The CSRs of cert-manager carry no challenge password, and the issuer
+// does not hold their keys, so the SCEP messages are signed with a
+// separate signer certificate. With the certificate and key of an
+// enrollment issued by the CA, servers like scepclient serve authorize
+// the requests like renewals. Otherwise the server must authorize them
+// in another way, e.g. by policy or an approval webhook.
+//
+// SCEP has no way to request a validity period, so the duration of the
+// CertificateRequest is up to the server.
+package certmanager
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/fullsailor/pkcs7"
+	scepclient "scepclient/client"
+	"scepclient/scep"
+)
+
+// ErrPending is returned by Issuer.Sign while the server has not
+// approved the request yet. Signing the same CSR again continues the
+// SCEP transaction, whose ID derives from the CSR public key.
+var ErrPending = errors.New("certmanager: certificate request pending approval by the CA")
+
+// Issuer signs the CSRs of cert-manager CertificateRequests with a SCEP
+// server. It is safe for concurrent use.
+type Issuer struct {
+	// Client sends the requests to the SCEP server.
+	Client scepclient.Client
+
+	// SignerCert and SignerKey sign the SCEP messages, see the package
+	// documentation. If they are nil, a self-signed certificate of a
+	// new key is used for every request.
+	SignerCert *x509.Certificate
+	SignerKey  *rsa.PrivateKey
+}
+
+// Certificate is the result of a CertificateRequest.
+type Certificate struct {
+	// Certificate is the PEM encoded issued certificate,
+	// for status.certificate.
+	Certificate []byte
+
+	// CA holds the PEM encoded CA certificates returned by
+	// GetCACert, without RA certificates, for status.ca.
+	CA []byte
+}
+
+// Sign enrolls the PEM encoded CSR csrPEM, the spec.request of a
+// CertificateRequest, and returns the issued certificate.
+func (i *Issuer) Sign(ctx context.Context, csrPEM []byte) (*Certificate, error) {
+	block, _ := pem.Decode(csrPEM)
+	if block == nil || (block.Type != "CERTIFICATE REQUEST" && block.Type != "NEW CERTIFICATE REQUEST") {
+		return nil, errors.New("certmanager: no PEM encoded certificate request")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("certmanager: parse certificate request: %w", err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("certmanager: certificate request signature: %w", err)
+	}
+
+	caCerts, err := i.caCerts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	signerCert, signerKey := i.SignerCert, i.SignerKey
+	if signerCert == nil || signerKey == nil {
+		if signerCert, signerKey, err = selfSigned(); err != nil {
+			return nil, err
+		}
+	}
+	tmpl := &scep.PKIMessage{
+		MessageType: scep.PKCSReq,
+		Recipients:  scepclient.Recipients(caCerts),
+		SignerKey:   signerKey,
+		SignerCert:  signerCert,
+	}
+	if i.Client.Supports("AES") || i.Client.Supports("SCEPStandard") {
+		tmpl.SCEPEncryptionAlgorithm = pkcs7.EncryptionAlgorithmAES128GCM
+	}
+	msg, err := scep.NewCSRRequest(csr, tmpl)
+	if err != nil {
+		return nil, fmt.Errorf("certmanager: creating pkiMessage: %w", err)
+	}
+
+	respBytes, err := i.Client.PKIOperation(ctx, msg.Raw)
+	if err != nil {
+		return nil, fmt.Errorf("certmanager: PKIOperation: %w", err)
+	}
+	resp, err := scep.ParsePKIMessage(respBytes)
+	if err != nil {
+		return nil, fmt.Errorf("certmanager: parsing pkiMessage response: %w", err)
+	}
+	switch resp.PKIStatus {
+	case scep.FAILURE:
+		return nil, &scep.FailInfoError{MessageType: scep.PKCSReq, FailInfo: resp.FailInfo, Text: resp.FailInfoText}
+	case scep.PENDING:
+		return nil, ErrPending
+	}
+	if err := resp.DecryptPKIEnvelope(signerCert, signerKey); err != nil {
+		return nil, fmt.Errorf("certmanager: decrypt pkiEnvelope: %w", err)
+	}
+
+	var ca bytes.Buffer
+	for _, crt := range caCerts {
+		if crt.IsCA {
+			pem.Encode(&ca, &pem.Block{Type: "CERTIFICATE", Bytes: crt.Raw})
+		}
+	}
+	return &Certificate{
+		Certificate: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: resp.CertRepMessage.Certificate.Raw}),
+		CA:          ca.Bytes(),
+	}, nil
+}
+
+// caCerts returns the certificates of GetCACert.
+func (i *Issuer) caCerts(ctx context.Context) ([]*x509.Certificate, error) {
+	data, num, err := i.Client.GetCACert(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("certmanager: GetCACert: %w", err)
+	}
+	var certs []*x509.Certificate
+	if num > 1 {
+		certs, err = scep.CACerts(data)
+	} else {
+		certs, err = x509.ParseCertificates(scep.TrimTrailingData(data))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("certmanager: GetCACert: %w", err)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("certmanager: GetCACert: no certificates returned")
+	}
+	return certs, nil
+}
+
+// selfSigned returns a self-signed signer certificate of a new key.
+func selfSigned() (*x509.Certificate, *rsa.PrivateKey, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "SCEP SIGNER"},
+		NotBefore:    now.Add(-time.Minute),
+		NotAfter:     now.Add(time.Hour),
+		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
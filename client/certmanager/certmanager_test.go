@@ -0,0 +1,77 @@
+package certmanager_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"testing"
+
+	"scepclient/client/certmanager"
+	"scepclient/client/scepclienttest"
+	"scepclient/scep"
+)
+
+func TestIssuerSign(t *testing.T) {
+	client, err := scepclienttest.New(
+		scepclienttest.WithStatuses(scep.PENDING, scep.SUCCESS, scep.FAILURE),
+		scepclienttest.WithFailInfo(scep.BadRequest),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: "app.example.com"},
+		DNSNames: []string{"app.example.com"},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
+	issuer := &certmanager.Issuer{Client: client}
+	ctx := context.Background()
+
+	if _, err := issuer.Sign(ctx, csrPEM); !errors.Is(err, certmanager.ErrPending) {
+		t.Fatalf("expected the request to be pending, got %v", err)
+	}
+	crt, err := issuer.Sign(ctx, csrPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(crt.Certificate)
+	if block == nil {
+		t.Fatalf("expected a PEM certificate, got %q", crt.Certificate)
+	}
+	issued, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if issued.Subject.CommonName != "app.example.com" || !issued.PublicKey.(*rsa.PublicKey).Equal(&key.PublicKey) {
+		t.Errorf("expected a certificate for the CSR, got %s", issued.Subject)
+	}
+	if block, _ = pem.Decode(crt.CA); block == nil {
+		t.Fatalf("expected the PEM CA certificate, got %q", crt.CA)
+	}
+	ca, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := issued.CheckSignatureFrom(ca); err != nil {
+		t.Errorf("expected the certificate to be issued by the CA: %v", err)
+	}
+
+	var failInfo *scep.FailInfoError
+	if _, err := issuer.Sign(ctx, csrPEM); !errors.As(err, &failInfo) || failInfo.FailInfo != scep.BadRequest {
+		t.Errorf("expected the request to fail with badRequest, got %v", err)
+	}
+	if _, err := issuer.Sign(ctx, []byte("not a CSR")); err == nil {
+		t.Error("expected a malformed CSR to fail")
+	}
+}
@@ -1,28 +1,119 @@
 package scepclient
 
 import (
-	"github.com/go-kit/kit/log"
-	"github.com/go-kit/kit/log/level"
+	"context"
+	"io"
+	"log/slog"
+	"time"
+
 	"scepclient/scepserver"
 )
 
-
-
-// Client is a SCEP Client
+// Client is a SCEP Client.
+//
+// A Client is safe for concurrent use by multiple goroutines, so parallel
+// enrollments can share one. It only keeps the server capabilities
+// between calls; keys, messages and transaction IDs belong to the caller.
 type Client interface {
 	scepserver.Service
 	Supports(cap string) bool
+
+	// GetCACertReader is like GetCACert, but streams the response
+	// body instead of buffering it.
+	GetCACertReader(ctx context.Context) (io.ReadCloser, int, error)
+
+	// Probe checks the endpoint with GetCACaps and GetCACert. See ProbeService.
+	Probe(ctx context.Context) (ProbeResult, error)
+}
+
+// Option configures a Client.
+type Option func(*config)
+
+type config struct {
+	httpOpts    []scepserver.HTTPOption
+	middlewares []scepserver.Middleware
+}
+
+// WithHTTPOptions configures the HTTP transport created by New.
+func WithHTTPOptions(opts ...scepserver.HTTPOption) Option {
+	return func(c *config) {
+		c.httpOpts = append(c.httpOpts, opts...)
+	}
+}
+
+// WithMiddleware wraps the transport with middlewares.
+// The first middleware is the outermost one.
+func WithMiddleware(mw ...scepserver.Middleware) Option {
+	return func(c *config) {
+		c.middlewares = append(c.middlewares, mw...)
+	}
+}
+
+// WithRetry retries requests failing with transient errors.
+func WithRetry(policy scepserver.RetryPolicy) Option {
+	return WithMiddleware(scepserver.RetryMiddleware(policy))
+}
+
+// WithRateLimit limits the rate of requests sent by the client.
+// See scepserver.RateLimitMiddleware.
+func WithRateLimit(limiter scepserver.Limiter, perOperation map[string]scepserver.Limiter) Option {
+	return WithMiddleware(scepserver.RateLimitMiddleware(limiter, perOperation))
+}
+
+// WithCircuitBreaker stops contacting a failing server for a while.
+// See scepserver.CircuitBreakerMiddleware.
+func WithCircuitBreaker(config scepserver.CircuitBreakerConfig) Option {
+	return WithMiddleware(scepserver.CircuitBreakerMiddleware(config))
+}
+
+// WithTimeouts sets deadlines for single requests, overall and per
+// operation. See scepserver.TimeoutMiddleware.
+func WithTimeouts(timeout time.Duration, perOperation map[string]time.Duration) Option {
+	return WithMiddleware(scepserver.TimeoutMiddleware(timeout, perOperation))
+}
+
+// WithCorrelationID sets the correlation ID of requests made without one
+// in their context. See scepserver.CorrelationMiddleware.
+func WithCorrelationID(id string) Option {
+	return WithMiddleware(scepserver.CorrelationMiddleware(id))
 }
 
 // New creates a SCEP Client.
 func New(
 	serverURL string,
-	logger log.Logger,
+	logger *slog.Logger,
+	opts ...Option,
 ) (Client, error) {
-	endpoints, err := scepserver.MakeClientEndpoints(serverURL)
+	conf := &config{}
+	for _, opt := range opts {
+		opt(conf)
+	}
+	transport, err := scepserver.NewHTTPTransport(serverURL, conf.httpOpts...)
 	if err != nil {
 		return nil, err
 	}
-	logger = level.Info(logger)
-	return endpoints, nil
+	if logger != nil {
+		logger = logger.With("url", serverURL)
+	}
+	return NewWithTransport(transport, logger, opts...)
+}
+
+// NewWithTransport creates a SCEP Client which sends
+// all requests over the provided transport.
+func NewWithTransport(
+	transport scepserver.Transport,
+	logger *slog.Logger,
+	opts ...Option,
+) (Client, error) {
+	conf := &config{}
+	for _, opt := range opts {
+		opt(conf)
+	}
+	if logger != nil {
+		transport = scepserver.LoggingMiddleware(logger)(transport)
+	}
+	for i := len(conf.middlewares) - 1; i >= 0; i-- {
+		transport = conf.middlewares[i](transport)
+	}
+	return client{scepserver.MakeTransportEndpoints(transport)}, nil
 }
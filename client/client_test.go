@@ -0,0 +1,173 @@
+package scepclient_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	scepclient "scepclient/client"
+	"scepclient/scep"
+	"scepclient/scepserver"
+	"scepclient/scepserver/scepservertest"
+)
+
+// TestConcurrentEnrollments enrolls many identities in parallel through
+// a single Client with all stateful middlewares. Run it with -race.
+func TestConcurrentEnrollments(t *testing.T) {
+	server, err := scepservertest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	ca := server.Service
+
+	var stats scepserver.ConnStats
+	client, err := scepclient.New(server.URL, slog.New(slog.NewTextHandler(io.Discard, nil)),
+		scepclient.WithCorrelationID(scepserver.NewCorrelationID()),
+		scepclient.WithRetry(scepserver.DefaultRetryPolicy),
+		scepclient.WithCircuitBreaker(scepserver.CircuitBreakerConfig{FailureThreshold: 5, OpenTimeout: time.Second}),
+		scepclient.WithRateLimit(scepserver.NewTokenBucket(1000, 10), nil),
+		scepclient.WithTimeouts(10*time.Second, nil),
+		scepclient.WithHTTPOptions(
+			scepserver.WithHeader("X-Test", "concurrent"),
+			scepserver.WithTrace(stats.Observe),
+			scepserver.WithHooks(scepserver.Hooks{
+				BeforeRequest: func(ctx context.Context, req scepserver.SCEPRequest, r *http.Request) error {
+					r.Header.Add("X-Test", req.Operation)
+					return nil
+				},
+			}),
+		),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 16
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	serials := make(chan string, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			cert, err := enroll(client, fmt.Sprintf("device-%d", i))
+			if err != nil {
+				errs <- fmt.Errorf("device-%d: %w", i, err)
+				return
+			}
+			if err := cert.CheckSignatureFrom(ca.CACert()); err != nil {
+				errs <- err
+				return
+			}
+			serials <- cert.SerialNumber.String()
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	close(serials)
+
+	for err := range errs {
+		t.Error(err)
+	}
+	seen := make(map[string]bool)
+	for serial := range serials {
+		if seen[serial] {
+			t.Errorf("serial %s issued twice", serial)
+		}
+		seen[serial] = true
+	}
+	if got := len(ca.Requests()); got != n {
+		t.Errorf("expected %d PKIOperation requests, got %d", n, got)
+	}
+	if stats.Snapshot().Requests < n {
+		t.Errorf("expected at least %d traced requests, got %+v", n, stats.Snapshot())
+	}
+}
+
+// enroll requests a certificate for a new key with the common name cn.
+func enroll(client scepclient.Client, cn string) (*x509.Certificate, error) {
+	ctx := context.Background()
+	if !client.Supports("POSTPKIOperation") {
+		return nil, fmt.Errorf("expected POSTPKIOperation to be supported")
+	}
+	caCertDER, _, err := client.GetCACert(ctx)
+	if err != nil {
+		return nil, err
+	}
+	caCert, err := x509.ParseCertificate(caCertDER)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		return nil, err
+	}
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: cn},
+	}, key)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil {
+		return nil, err
+	}
+	signerDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}, &x509.Certificate{Subject: pkix.Name{CommonName: cn}}, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := x509.ParseCertificate(signerDER)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := scep.NewCSRRequest(csr, &scep.PKIMessage{
+		MessageType: scep.PKCSReq,
+		Recipients:  []*x509.Certificate{caCert},
+		SignerKey:   key,
+		SignerCert:  signer,
+	})
+	if err != nil {
+		return nil, err
+	}
+	ctx = scepserver.WithTransactionID(ctx, string(msg.TransactionID))
+	respBytes, err := client.PKIOperation(ctx, msg.Raw)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := scep.ParsePKIMessage(respBytes)
+	if err != nil {
+		return nil, err
+	}
+	if resp.PKIStatus != scep.SUCCESS {
+		return nil, fmt.Errorf("unexpected pkiStatus %s", resp.PKIStatus)
+	}
+	if resp.TransactionID != msg.TransactionID {
+		return nil, fmt.Errorf("response for transaction %s, expected %s", resp.TransactionID, msg.TransactionID)
+	}
+	if err := resp.DecryptPKIEnvelope(signer, key); err != nil {
+		return nil, err
+	}
+	cert := resp.CertRepMessage.Certificate
+	if cert.Subject.CommonName != cn {
+		return nil, fmt.Errorf("certificate issued for %s", cert.Subject.CommonName)
+	}
+	return cert, nil
+}
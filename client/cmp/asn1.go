@@ -0,0 +1,194 @@
+package cmp
+
+import (
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"time"
+)
+
+// The ASN.1 structures of RFC 4210 (CMP) and RFC 4211 (CRMF).
+
+var (
+	oidPasswordBasedMAC = asn1.ObjectIdentifier{1, 2, 840, 113533, 7, 66, 13}
+	oidSHA1             = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidSHA256           = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA384           = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSHA512           = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+	oidHMACWithSHA1     = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 8, 1, 2}
+	oidHMACWithSHA1Alt  = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA256   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidHMACWithSHA384   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 10}
+	oidHMACWithSHA512   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}
+
+	oidSHA1WithRSA     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 5}
+	oidSHA256WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}
+	oidSHA384WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 12}
+	oidSHA512WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 13}
+	oidECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	oidECDSAWithSHA384 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 3}
+	oidECDSAWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 4}
+
+	oidRegCtrlOldCertID = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 5, 1, 5}
+	oidImplicitConfirm  = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 4, 13}
+)
+
+// The tags of the PKIBody choices.
+const (
+	bodyIR       = 0
+	bodyIP       = 1
+	bodyCR       = 2
+	bodyCP       = 3
+	bodyKUR      = 7
+	bodyKUP      = 8
+	bodyPKIConf  = 19
+	bodyError    = 23
+	bodyCertConf = 24
+	bodyPollReq  = 25
+	bodyPollRep  = 26
+)
+
+// pvno of CMPv2.
+const cmp2000 = 2
+
+// The values of PKIStatus, the others of which grant the certificate.
+const (
+	statusRejection = 2
+	statusWaiting   = 3
+)
+
+var statusNames = []string{"accepted", "grantedWithMods", "rejection", "waiting", "revocationWarning", "revocationNotification", "keyUpdateWarning"}
+
+// failInfoNames are the names of the bits of PKIFailureInfo.
+var failInfoNames = []string{
+	"badAlg", "badMessageCheck", "badRequest", "badTime", "badCertId",
+	"badDataFormat", "wrongAuthority", "incorrectData", "missingTimeStamp", "badPOP",
+	"certRevoked", "certConfirmed", "wrongIntegrity", "badRecipientNonce", "timeNotAvailable",
+	"unacceptedPolicy", "unacceptedExtension", "addInfoNotAvailable", "badSenderNonce", "badCertTemplate",
+	"signerNotTrusted", "transactionIdInUse", "unsupportedVersion", "notAuthorized", "systemUnavail",
+	"systemFailure", "duplicateCertReq",
+}
+
+type pkiMessage struct {
+	Header     asn1.RawValue
+	Body       asn1.RawValue
+	Protection asn1.BitString  `asn1:"explicit,optional,tag:0"`
+	ExtraCerts []asn1.RawValue `asn1:"explicit,optional,tag:1"`
+}
+
+type protectedPart struct {
+	Header asn1.RawValue
+	Body   asn1.RawValue
+}
+
+type pkiHeader struct {
+	PVNO          int
+	Sender        asn1.RawValue
+	Recipient     asn1.RawValue
+	MessageTime   time.Time                `asn1:"generalized,explicit,optional,tag:0"`
+	ProtectionAlg pkix.AlgorithmIdentifier `asn1:"explicit,optional,tag:1"`
+	SenderKID     []byte                   `asn1:"explicit,optional,tag:2"`
+	RecipKID      []byte                   `asn1:"explicit,optional,tag:3"`
+	TransactionID []byte                   `asn1:"explicit,optional,tag:4"`
+	SenderNonce   []byte                   `asn1:"explicit,optional,tag:5"`
+	RecipNonce    []byte                   `asn1:"explicit,optional,tag:6"`
+	FreeText      asn1.RawValue            `asn1:"explicit,optional,tag:7"`
+	GeneralInfo   []infoTypeAndValue       `asn1:"explicit,optional,tag:8"`
+}
+
+type infoTypeAndValue struct {
+	Type  asn1.ObjectIdentifier
+	Value asn1.RawValue `asn1:"optional"`
+}
+
+type pbmParameter struct {
+	Salt           []byte
+	OWF            pkix.AlgorithmIdentifier
+	IterationCount int
+	MAC            pkix.AlgorithmIdentifier
+}
+
+type certReqMsg struct {
+	CertReq asn1.RawValue
+	POPO    asn1.RawValue `asn1:"optional"`
+}
+
+type certRequest struct {
+	CertReqID    int
+	CertTemplate asn1.RawValue
+	Controls     []attributeTypeAndValue `asn1:"optional"`
+}
+
+type attributeTypeAndValue struct {
+	Type  asn1.ObjectIdentifier
+	Value asn1.RawValue
+}
+
+type popoSigningKey struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Signature asn1.BitString
+}
+
+type certID struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type certRepMessage struct {
+	CAPubs   []asn1.RawValue `asn1:"explicit,optional,tag:1"`
+	Response []certResponse
+}
+
+type certResponse struct {
+	CertReqID        int
+	Status           pkiStatusInfo
+	CertifiedKeyPair certifiedKeyPair `asn1:"optional"`
+}
+
+type certifiedKeyPair struct {
+	// a certificate [0], or an encrypted certificate [1]
+	CertOrEncCert asn1.RawValue
+}
+
+type pkiStatusInfo struct {
+	Status       int
+	StatusString []string       `asn1:"optional"`
+	FailInfo     asn1.BitString `asn1:"optional"`
+}
+
+type errorMsgContent struct {
+	Status       pkiStatusInfo
+	ErrorCode    int      `asn1:"optional"`
+	ErrorDetails []string `asn1:"optional"`
+}
+
+type certStatus struct {
+	CertHash  []byte
+	CertReqID int
+}
+
+type pollReq struct {
+	CertReqID int
+}
+
+type pollRep struct {
+	CertReqID  int
+	CheckAfter int
+	Reason     []string `asn1:"optional"`
+}
+
+// tagged returns the DER encoding der retagged with the context
+// specific tag, as the IMPLICIT tagging of CRMF does.
+func tagged(tag int, der []byte) (asn1.RawValue, error) {
+	var v asn1.RawValue
+	if _, err := asn1.Unmarshal(der, &v); err != nil {
+		return asn1.RawValue{}, err
+	}
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: tag, IsCompound: v.IsCompound, Bytes: v.Bytes}, nil
+}
+
+// explicit wraps the DER encoding der in the context specific tag,
+// e.g. a Name in the directoryName [4] of a GeneralName.
+func explicit(tag int, der []byte) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: tag, IsCompound: true, Bytes: der}
+}
@@ -0,0 +1,708 @@
+// Package cmp implements a client of the Certificate Management Protocol
+// (CMPv2, RFC 4210) over HTTP (RFC 6712), enrolling with initialization
+// (ir), certification (cr) and key update (kur) requests, as required by
+// industrial and other CAs not supporting SCEP.
+//
+// Messages are protected either with a MAC of a secret shared with the CA
+// and identified by a reference value, as issued for an initial enrollment,
+// or with a signature of an existing key and certificate, e.g. of a vendor
+// issued device certificate or of the certificate being updated.
+package cmp
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// MessageType is the type of a certificate request.
+type MessageType int
+
+// The types of certificate requests.
+const (
+	// IR requests the first certificate of an end entity.
+	IR MessageType = bodyIR
+	// CR requests a further certificate of an end entity.
+	CR MessageType = bodyCR
+	// KUR updates an existing certificate, usually with a new key.
+	KUR MessageType = bodyKUR
+)
+
+func (t MessageType) String() string {
+	switch t {
+	case IR:
+		return "ir"
+	case CR:
+		return "cr"
+	case KUR:
+		return "kur"
+	}
+	return fmt.Sprintf("MessageType(%d)", int(t))
+}
+
+// ParseMessageType parses ir, cr or kur.
+func ParseMessageType(s string) (MessageType, error) {
+	for _, t := range []MessageType{IR, CR, KUR} {
+		if strings.EqualFold(s, t.String()) {
+			return t, nil
+		}
+	}
+	return 0, fmt.Errorf("cmp: unknown message type %q, expected ir, cr or kur", s)
+}
+
+// pbmIterations is the iteration count of the MACs of requests,
+// and maxPBMIterations the largest one accepted in responses.
+const (
+	pbmIterations    = 10000
+	maxPBMIterations = 100000
+)
+
+// Config configures a Client.
+type Config struct {
+	// URL is the URL of the CMP server, e.g.
+	// http://ca.example.com/ejbca/publicweb/cmp/alias.
+	URL string
+
+	// Recipient is the name of the CA, the NULL-DN by default.
+	Recipient pkix.Name
+
+	// Reference and Secret protect the requests with a password-based
+	// MAC, with the reference value identifying the secret to the CA.
+	Reference string
+	Secret    []byte
+
+	// Signer and Certificate protect the requests with a signature,
+	// if there is no Secret, sending Certificate and its intermediate
+	// certificates Chain to the CA.
+	Signer      crypto.Signer
+	Certificate *x509.Certificate
+	Chain       []*x509.Certificate
+
+	// Trusted are the CA certificates verifying the signatures of the
+	// responses, which are signed by one of them, or by a certificate of
+	// the extraCerts of the response issued by one of them. Responses
+	// protected with a MAC are verified with Secret instead.
+	Trusted []*x509.Certificate
+
+	// Client sends the requests, http.DefaultClient if nil.
+	Client *http.Client
+}
+
+// Client enrolls with a CMP server.
+type Client struct {
+	config Config
+}
+
+// NewClient returns a Client of config.
+func NewClient(config Config) (*Client, error) {
+	if config.URL == "" {
+		return nil, errors.New("cmp: URL is required")
+	}
+	if len(config.Secret) == 0 && (config.Signer == nil || config.Certificate == nil) {
+		return nil, errors.New("cmp: a secret, or a signer and its certificate, are required to protect the requests")
+	}
+	if config.Client == nil {
+		config.Client = http.DefaultClient
+	}
+	return &Client{config: config}, nil
+}
+
+// Request is a certificate request.
+type Request struct {
+	Type MessageType
+
+	// CSR is the template of the certificate: its subject, public key
+	// and extensions. Its attributes, e.g. a challenge password, are
+	// not sent.
+	CSR *x509.CertificateRequest
+
+	// Key is the private key of CSR, proving its possession.
+	Key crypto.Signer
+
+	// OldCert is the certificate updated by a KUR request.
+	OldCert *x509.Certificate
+}
+
+// Response is the result of a successful request.
+type Response struct {
+	Certificate *x509.Certificate
+
+	// CACerts are the CA certificates of the response,
+	// to be trusted (caPubs) or intermediate (extraCerts).
+	CACerts []*x509.Certificate
+}
+
+// StatusError is the rejection of a request, or an error message of the CA.
+type StatusError struct {
+	Status   int
+	FailInfo []string
+	Text     string
+}
+
+func (e *StatusError) Error() string {
+	status := fmt.Sprintf("status %d", e.Status)
+	if e.Status >= 0 && e.Status < len(statusNames) {
+		status = statusNames[e.Status]
+	}
+	msg := "cmp: " + status
+	if len(e.FailInfo) > 0 {
+		msg += " (" + strings.Join(e.FailInfo, ", ") + ")"
+	}
+	if e.Text != "" {
+		msg += ": " + e.Text
+	}
+	return msg
+}
+
+// transaction is the state of the messages of a request.
+type transaction struct {
+	id          []byte
+	recipNonce  []byte
+	senderNonce []byte
+	sender      []byte
+	implicit    bool
+}
+
+// Enroll sends req, polls the CA while the request is waiting, and
+// confirms the certificate it is granted.
+func (c *Client) Enroll(ctx context.Context, req Request) (*Response, error) {
+	if req.CSR == nil || req.Key == nil {
+		return nil, errors.New("cmp: the CSR and its key are required")
+	}
+	if req.Type == KUR && req.OldCert == nil {
+		return nil, errors.New("cmp: a key update requires the old certificate")
+	}
+	body, err := certReqMessages(req)
+	if err != nil {
+		return nil, err
+	}
+	tx := &transaction{id: make([]byte, 16), sender: req.CSR.RawSubject}
+	if _, err := rand.Read(tx.id); err != nil {
+		return nil, err
+	}
+	if c.config.Signer != nil && len(c.config.Secret) == 0 {
+		tx.sender = c.config.Certificate.RawSubject
+	}
+
+	// ip, cp and kup follow the tags of their requests
+	respTag := int(req.Type) + 1
+	resp, err := c.exchange(ctx, tx, explicit(int(req.Type), body), respTag)
+	if err != nil {
+		return nil, err
+	}
+	for polled := false; ; polled = true {
+		var rep certRepMessage
+		if _, err := asn1.Unmarshal(resp.Bytes, &rep); err != nil {
+			return nil, fmt.Errorf("cmp: parsing the response: %w", err)
+		}
+		if len(rep.Response) != 1 {
+			return nil, fmt.Errorf("cmp: %d certificate responses for 1 request", len(rep.Response))
+		}
+		r := rep.Response[0]
+		switch r.Status.Status {
+		case statusRejection:
+			return nil, statusError(r.Status)
+		case statusWaiting:
+			if polled {
+				return nil, errors.New("cmp: the CA answered a poll with a waiting response")
+			}
+			if resp, err = c.pollUntilGranted(ctx, tx, respTag); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		return c.accept(ctx, tx, rep, r)
+	}
+}
+
+// pollUntilGranted polls the CA for the certificate of a waiting request,
+// at the intervals the CA asks for, returning its final response.
+func (c *Client) pollUntilGranted(ctx context.Context, tx *transaction, respTag int) (asn1.RawValue, error) {
+	body, err := asn1.Marshal([]pollReq{{CertReqID: 0}})
+	if err != nil {
+		return asn1.RawValue{}, err
+	}
+	checkAfter := 0
+	for {
+		if checkAfter < 1 {
+			checkAfter = 1
+		}
+		t := time.NewTimer(time.Duration(checkAfter) * time.Second)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return asn1.RawValue{}, ctx.Err()
+		case <-t.C:
+		}
+		resp, err := c.exchange(ctx, tx, explicit(bodyPollReq, body), respTag, bodyPollRep)
+		if err != nil {
+			return asn1.RawValue{}, err
+		}
+		if resp.Tag == respTag {
+			return resp, nil
+		}
+		var reps []pollRep
+		if _, err := asn1.Unmarshal(resp.Bytes, &reps); err != nil {
+			return asn1.RawValue{}, fmt.Errorf("cmp: parsing the poll response: %w", err)
+		}
+		if len(reps) != 1 {
+			return asn1.RawValue{}, fmt.Errorf("cmp: %d poll responses for 1 request", len(reps))
+		}
+		checkAfter = reps[0].CheckAfter
+	}
+}
+
+// accept parses the certificate granted by rep and confirms it,
+// unless the CA does not expect a confirmation.
+func (c *Client) accept(ctx context.Context, tx *transaction, rep certRepMessage, r certResponse) (*Response, error) {
+	raw := r.CertifiedKeyPair.CertOrEncCert
+	if raw.Class != asn1.ClassContextSpecific || raw.Tag != 0 {
+		return nil, errors.New("cmp: the response has no certificate, or an encrypted one")
+	}
+	cert, err := x509.ParseCertificate(raw.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("cmp: parsing the certificate: %w", err)
+	}
+	resp := &Response{Certificate: cert}
+	for _, raw := range rep.CAPubs {
+		ca, err := x509.ParseCertificate(raw.FullBytes)
+		if err != nil {
+			return nil, fmt.Errorf("cmp: parsing caPubs: %w", err)
+		}
+		resp.CACerts = append(resp.CACerts, ca)
+	}
+
+	if tx.implicit {
+		return resp, nil
+	}
+	h, err := certHash(cert)
+	if err != nil {
+		return nil, err
+	}
+	h.Write(cert.Raw)
+	body, err := asn1.Marshal([]certStatus{{CertHash: h.Sum(nil), CertReqID: r.CertReqID}})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.exchange(ctx, tx, explicit(bodyCertConf, body), bodyPKIConf); err != nil {
+		return nil, fmt.Errorf("confirming the certificate: %w", err)
+	}
+	return resp, nil
+}
+
+// exchange sends the body of a message of the transaction, and returns
+// the body of the response, which must be of one of the tags want.
+func (c *Client) exchange(ctx context.Context, tx *transaction, body asn1.RawValue, want ...int) (asn1.RawValue, error) {
+	tx.senderNonce = make([]byte, 16)
+	if _, err := rand.Read(tx.senderNonce); err != nil {
+		return asn1.RawValue{}, err
+	}
+	msg, err := c.marshal(tx, body)
+	if err != nil {
+		return asn1.RawValue{}, err
+	}
+	data, err := c.post(ctx, msg)
+	if err != nil {
+		return asn1.RawValue{}, err
+	}
+	var resp pkiMessage
+	if rest, err := asn1.Unmarshal(data, &resp); err != nil {
+		return asn1.RawValue{}, fmt.Errorf("cmp: parsing the response: %w", err)
+	} else if len(rest) > 0 {
+		return asn1.RawValue{}, errors.New("cmp: trailing data after the response")
+	}
+	var header pkiHeader
+	if _, err := asn1.Unmarshal(resp.Header.FullBytes, &header); err != nil {
+		return asn1.RawValue{}, fmt.Errorf("cmp: parsing the response header: %w", err)
+	}
+	if resp.Body.Class != asn1.ClassContextSpecific {
+		return asn1.RawValue{}, errors.New("cmp: malformed response body")
+	}
+	if err := c.verify(resp, header); err != nil {
+		// an error message explains the failure better, e.g. of a wrong
+		// secret, even if it cannot be verified
+		if resp.Body.Tag == bodyError {
+			return asn1.RawValue{}, fmt.Errorf("%w, in an error message (%v)", errorMessage(resp.Body), err)
+		}
+		return asn1.RawValue{}, err
+	}
+	if !bytes.Equal(header.TransactionID, tx.id) {
+		return asn1.RawValue{}, errors.New("cmp: the response is of another transaction")
+	}
+	if !bytes.Equal(header.RecipNonce, tx.senderNonce) {
+		return asn1.RawValue{}, errors.New("cmp: the response does not echo the nonce of the request")
+	}
+	tx.recipNonce = header.SenderNonce
+	for _, info := range header.GeneralInfo {
+		if info.Type.Equal(oidImplicitConfirm) {
+			tx.implicit = true
+		}
+	}
+	if resp.Body.Tag == bodyError {
+		return asn1.RawValue{}, errorMessage(resp.Body)
+	}
+	for _, tag := range want {
+		if resp.Body.Tag == tag {
+			return resp.Body, nil
+		}
+	}
+	return asn1.RawValue{}, fmt.Errorf("cmp: unexpected response body [%d]", resp.Body.Tag)
+}
+
+// marshal returns the protected message of body.
+func (c *Client) marshal(tx *transaction, body asn1.RawValue) ([]byte, error) {
+	recipient, err := asn1.Marshal(c.config.Recipient.ToRDNSequence())
+	if err != nil {
+		return nil, err
+	}
+	header := pkiHeader{
+		PVNO:          cmp2000,
+		Sender:        explicit(4, tx.sender),
+		Recipient:     explicit(4, recipient),
+		MessageTime:   time.Now().UTC().Truncate(time.Second),
+		TransactionID: tx.id,
+		SenderNonce:   tx.senderNonce,
+		RecipNonce:    tx.recipNonce,
+	}
+	var protect func(data []byte) ([]byte, error)
+	if len(c.config.Secret) > 0 {
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		params := pbmParameter{
+			Salt:           salt,
+			OWF:            pkix.AlgorithmIdentifier{Algorithm: oidSHA256},
+			IterationCount: pbmIterations,
+			MAC:            pkix.AlgorithmIdentifier{Algorithm: oidHMACWithSHA256},
+		}
+		der, err := asn1.Marshal(params)
+		if err != nil {
+			return nil, err
+		}
+		header.ProtectionAlg = pkix.AlgorithmIdentifier{Algorithm: oidPasswordBasedMAC, Parameters: asn1.RawValue{FullBytes: der}}
+		header.SenderKID = []byte(c.config.Reference)
+		protect = func(data []byte) ([]byte, error) {
+			return pbmMAC(c.config.Secret, params, data)
+		}
+	} else {
+		alg, hash, err := signatureAlgorithm(c.config.Signer)
+		if err != nil {
+			return nil, err
+		}
+		header.ProtectionAlg = alg
+		header.SenderKID = c.config.Certificate.SubjectKeyId
+		protect = func(data []byte) ([]byte, error) {
+			return sign(c.config.Signer, hash, data)
+		}
+	}
+	headerDER, err := asn1.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	msg := pkiMessage{Header: asn1.RawValue{FullBytes: headerDER}, Body: body}
+	part, err := asn1.Marshal(protectedPart{Header: msg.Header, Body: body})
+	if err != nil {
+		return nil, err
+	}
+	protection, err := protect(part)
+	if err != nil {
+		return nil, err
+	}
+	msg.Protection = asn1.BitString{Bytes: protection, BitLength: 8 * len(protection)}
+	if len(c.config.Secret) == 0 {
+		for _, cert := range append([]*x509.Certificate{c.config.Certificate}, c.config.Chain...) {
+			msg.ExtraCerts = append(msg.ExtraCerts, asn1.RawValue{FullBytes: cert.Raw})
+		}
+	}
+	return asn1.Marshal(msg)
+}
+
+// verify checks the protection of resp.
+func (c *Client) verify(resp pkiMessage, header pkiHeader) error {
+	if len(resp.Protection.Bytes) == 0 {
+		return errors.New("cmp: the response is not protected")
+	}
+	part, err := asn1.Marshal(protectedPart{Header: resp.Header, Body: resp.Body})
+	if err != nil {
+		return err
+	}
+	if header.ProtectionAlg.Algorithm.Equal(oidPasswordBasedMAC) {
+		if len(c.config.Secret) == 0 {
+			return errors.New("cmp: the response is protected with a MAC, but there is no secret")
+		}
+		var params pbmParameter
+		if _, err := asn1.Unmarshal(header.ProtectionAlg.Parameters.FullBytes, &params); err != nil {
+			return fmt.Errorf("cmp: parsing the MAC parameters: %w", err)
+		}
+		mac, err := pbmMAC(c.config.Secret, params, part)
+		if err != nil {
+			return err
+		}
+		if !hmac.Equal(mac, resp.Protection.Bytes) {
+			return errors.New("cmp: the MAC of the response is invalid")
+		}
+		return nil
+	}
+
+	if len(c.config.Trusted) == 0 {
+		return errors.New("cmp: the response is signed, but there are no trusted CA certificates")
+	}
+	certs := make([]*x509.Certificate, 0, len(resp.ExtraCerts))
+	for _, raw := range resp.ExtraCerts {
+		cert, err := x509.ParseCertificate(raw.FullBytes)
+		if err != nil {
+			return fmt.Errorf("cmp: parsing extraCerts: %w", err)
+		}
+		certs = append(certs, cert)
+	}
+	// the signer is identified by its key identifier, or
+	// comes first in extraCerts, or is the only trusted one
+	var signer *x509.Certificate
+	for _, cert := range append(certs, c.config.Trusted...) {
+		if len(header.SenderKID) > 0 && bytes.Equal(cert.SubjectKeyId, header.SenderKID) {
+			signer = cert
+			break
+		}
+	}
+	switch {
+	case signer != nil:
+	case len(certs) > 0:
+		signer = certs[0]
+	case len(c.config.Trusted) == 1:
+		signer = c.config.Trusted[0]
+	default:
+		return errors.New("cmp: the signer of the response is unknown")
+	}
+	roots, intermediates := x509.NewCertPool(), x509.NewCertPool()
+	for _, cert := range c.config.Trusted {
+		roots.AddCert(cert)
+	}
+	for _, cert := range certs {
+		intermediates.AddCert(cert)
+	}
+	if _, err := signer.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}); err != nil {
+		return fmt.Errorf("cmp: verifying the signer of the response: %w", err)
+	}
+	alg, ok := signatureAlgorithms[header.ProtectionAlg.Algorithm.String()]
+	if !ok {
+		return fmt.Errorf("cmp: unsupported protection algorithm %s", header.ProtectionAlg.Algorithm)
+	}
+	if err := signer.CheckSignature(alg, part, resp.Protection.Bytes); err != nil {
+		return fmt.Errorf("cmp: verifying the signature of the response: %w", err)
+	}
+	return nil
+}
+
+func (c *Client) post(ctx context.Context, msg []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.config.URL, bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/pkixcmp")
+	resp, err := c.config.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	// error messages may come with an error status
+	if resp.Header.Get("Content-Type") != "application/pkixcmp" && resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("cmp: %s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	return data, nil
+}
+
+// certReqMessages returns the CertReqMessages of req, with
+// the proof of possession signed with req.Key.
+func certReqMessages(req Request) ([]byte, error) {
+	var spki asn1.RawValue
+	if _, err := asn1.Unmarshal(req.CSR.RawSubjectPublicKeyInfo, &spki); err != nil {
+		return nil, err
+	}
+	template := []asn1.RawValue{
+		explicit(5, req.CSR.RawSubject),
+		{Class: asn1.ClassContextSpecific, Tag: 6, IsCompound: true, Bytes: spki.Bytes},
+	}
+	if len(req.CSR.Extensions) > 0 {
+		der, err := asn1.Marshal(req.CSR.Extensions)
+		if err != nil {
+			return nil, err
+		}
+		exts, err := tagged(9, der)
+		if err != nil {
+			return nil, err
+		}
+		template = append(template, exts)
+	}
+	templateDER, err := asn1.Marshal(template)
+	if err != nil {
+		return nil, err
+	}
+	cr := certRequest{CertReqID: 0, CertTemplate: asn1.RawValue{FullBytes: templateDER}}
+	if req.Type == KUR {
+		id, err := asn1.Marshal(certID{Issuer: explicit(4, req.OldCert.RawIssuer), SerialNumber: req.OldCert.SerialNumber})
+		if err != nil {
+			return nil, err
+		}
+		cr.Controls = []attributeTypeAndValue{{Type: oidRegCtrlOldCertID, Value: asn1.RawValue{FullBytes: id}}}
+	}
+	crDER, err := asn1.Marshal(cr)
+	if err != nil {
+		return nil, err
+	}
+
+	alg, hash, err := signatureAlgorithm(req.Key)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := sign(req.Key, hash, crDER)
+	if err != nil {
+		return nil, err
+	}
+	popoDER, err := asn1.Marshal(popoSigningKey{Algorithm: alg, Signature: asn1.BitString{Bytes: sig, BitLength: 8 * len(sig)}})
+	if err != nil {
+		return nil, err
+	}
+	popo, err := tagged(1, popoDER)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal([]certReqMsg{{CertReq: asn1.RawValue{FullBytes: crDER}, POPO: popo}})
+}
+
+// pbmMAC returns the password-based MAC of data of RFC 4211 section 4.4.
+func pbmMAC(secret []byte, params pbmParameter, data []byte) ([]byte, error) {
+	if params.IterationCount < 1 || params.IterationCount > maxPBMIterations {
+		return nil, fmt.Errorf("cmp: MAC iteration count %d out of range", params.IterationCount)
+	}
+	owf, ok := hashes[params.OWF.Algorithm.String()]
+	if !ok {
+		return nil, fmt.Errorf("cmp: unsupported one-way function %s", params.OWF.Algorithm)
+	}
+	mac, ok := hmacHashes[params.MAC.Algorithm.String()]
+	if !ok {
+		return nil, fmt.Errorf("cmp: unsupported MAC algorithm %s", params.MAC.Algorithm)
+	}
+	h := owf()
+	h.Write(secret)
+	h.Write(params.Salt)
+	key := h.Sum(nil)
+	for i := 1; i < params.IterationCount; i++ {
+		h.Reset()
+		h.Write(key)
+		key = h.Sum(key[:0])
+	}
+	m := hmac.New(mac, key)
+	m.Write(data)
+	return m.Sum(nil), nil
+}
+
+var hashes = map[string]func() hash.Hash{
+	oidSHA1.String():   sha1.New,
+	oidSHA256.String(): sha256.New,
+	oidSHA384.String(): sha512.New384,
+	oidSHA512.String(): sha512.New,
+}
+
+var hmacHashes = map[string]func() hash.Hash{
+	oidHMACWithSHA1.String():    sha1.New,
+	oidHMACWithSHA1Alt.String(): sha1.New,
+	oidHMACWithSHA256.String():  sha256.New,
+	oidHMACWithSHA384.String():  sha512.New384,
+	oidHMACWithSHA512.String():  sha512.New,
+}
+
+var signatureAlgorithms = map[string]x509.SignatureAlgorithm{
+	oidSHA1WithRSA.String():     x509.SHA1WithRSA,
+	oidSHA256WithRSA.String():   x509.SHA256WithRSA,
+	oidSHA384WithRSA.String():   x509.SHA384WithRSA,
+	oidSHA512WithRSA.String():   x509.SHA512WithRSA,
+	oidECDSAWithSHA256.String(): x509.ECDSAWithSHA256,
+	oidECDSAWithSHA384.String(): x509.ECDSAWithSHA384,
+	oidECDSAWithSHA512.String(): x509.ECDSAWithSHA512,
+}
+
+// signatureAlgorithm returns the SHA-256 signature algorithm of key.
+func signatureAlgorithm(key crypto.Signer) (pkix.AlgorithmIdentifier, crypto.Hash, error) {
+	switch key.Public().(type) {
+	case *rsa.PublicKey:
+		return pkix.AlgorithmIdentifier{Algorithm: oidSHA256WithRSA, Parameters: asn1.NullRawValue}, crypto.SHA256, nil
+	case *ecdsa.PublicKey:
+		return pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA256}, crypto.SHA256, nil
+	}
+	return pkix.AlgorithmIdentifier{}, 0, fmt.Errorf("cmp: unsupported key type %T", key.Public())
+}
+
+func sign(key crypto.Signer, hash crypto.Hash, data []byte) ([]byte, error) {
+	h := hash.New()
+	h.Write(data)
+	return key.Sign(rand.Reader, h.Sum(nil), hash)
+}
+
+// certHash returns the hash of the signature algorithm of cert, with
+// which the certificate is confirmed.
+func certHash(cert *x509.Certificate) (hash.Hash, error) {
+	switch cert.SignatureAlgorithm {
+	case x509.SHA1WithRSA, x509.ECDSAWithSHA1:
+		return sha1.New(), nil
+	case x509.SHA256WithRSA, x509.SHA256WithRSAPSS, x509.ECDSAWithSHA256:
+		return sha256.New(), nil
+	case x509.SHA384WithRSA, x509.SHA384WithRSAPSS, x509.ECDSAWithSHA384:
+		return sha512.New384(), nil
+	case x509.SHA512WithRSA, x509.SHA512WithRSAPSS, x509.ECDSAWithSHA512:
+		return sha512.New(), nil
+	}
+	return nil, fmt.Errorf("cmp: unsupported certificate signature algorithm %s", cert.SignatureAlgorithm)
+}
+
+func statusError(info pkiStatusInfo) *StatusError {
+	err := &StatusError{Status: info.Status, Text: strings.Join(info.StatusString, "; ")}
+	for i, name := range failInfoNames {
+		if info.FailInfo.At(i) == 1 {
+			err.FailInfo = append(err.FailInfo, name)
+		}
+	}
+	return err
+}
+
+// errorMessage returns the error of an error message body.
+func errorMessage(body asn1.RawValue) error {
+	var content errorMsgContent
+	if _, err := asn1.Unmarshal(body.Bytes, &content); err != nil {
+		return fmt.Errorf("cmp: parsing the error message: %w", err)
+	}
+	err := statusError(content.Status)
+	if len(content.ErrorDetails) > 0 {
+		if err.Text != "" {
+			err.Text += "; "
+		}
+		err.Text += strings.Join(content.ErrorDetails, "; ")
+	}
+	return err
+}
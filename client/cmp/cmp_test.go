@@ -0,0 +1,347 @@
+package cmp
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"scepclient/scepserver/depot"
+)
+
+// fakeCA answers the requests of a Client, issuing certificates for the
+// subject and public key of their templates.
+type fakeCA struct {
+	t      *testing.T
+	secret []byte
+	cert   *x509.Certificate
+	key    *rsa.PrivateKey
+
+	// sign protects the responses with the key of the CA,
+	// instead of a MAC of the secret
+	sign bool
+	// waiting answers a request, and the first poll, with waiting
+	waiting bool
+	reject  bool
+	// respSecret, if not nil, replaces the secret of the MACs of the responses
+	respSecret []byte
+
+	polls     int
+	issued    *x509.Certificate
+	confirmed bool
+	oldCertID *certID
+}
+
+func (ca *fakeCA) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Content-Type") != "application/pkixcmp" {
+		http.Error(w, "bad content type", http.StatusUnsupportedMediaType)
+		return
+	}
+	data, _ := ioutil.ReadAll(r.Body)
+	var msg pkiMessage
+	if _, err := asn1.Unmarshal(data, &msg); err != nil {
+		ca.t.Fatal(err)
+	}
+	var header pkiHeader
+	if _, err := asn1.Unmarshal(msg.Header.FullBytes, &header); err != nil {
+		ca.t.Fatal(err)
+	}
+	part, _ := asn1.Marshal(protectedPart{Header: msg.Header, Body: msg.Body})
+	if header.ProtectionAlg.Algorithm.Equal(oidPasswordBasedMAC) {
+		var params pbmParameter
+		asn1.Unmarshal(header.ProtectionAlg.Parameters.FullBytes, &params)
+		mac, err := pbmMAC(ca.secret, params, part)
+		if err != nil || string(mac) != string(msg.Protection.Bytes) || string(header.SenderKID) != "ref" {
+			ca.t.Fatal("invalid MAC of the request")
+		}
+	} else {
+		signer, err := x509.ParseCertificate(msg.ExtraCerts[0].FullBytes)
+		if err != nil {
+			ca.t.Fatal(err)
+		}
+		if err := signer.CheckSignature(x509.SHA256WithRSA, part, msg.Protection.Bytes); err != nil {
+			ca.t.Fatal(err)
+		}
+	}
+
+	var status int
+	var body asn1.RawValue
+	switch msg.Body.Tag {
+	case bodyIR, bodyKUR:
+		var reqs []certReqMsg
+		if _, err := asn1.Unmarshal(msg.Body.Bytes, &reqs); err != nil {
+			ca.t.Fatal(err)
+		}
+		ca.issue(reqs[0])
+		status = 0
+		if ca.reject {
+			status = statusRejection
+		} else if ca.waiting {
+			status = statusWaiting
+		}
+		body = ca.certRep(msg.Body.Tag+1, status)
+	case bodyPollReq:
+		ca.polls++
+		if ca.polls == 1 {
+			der, _ := asn1.Marshal([]pollRep{{CheckAfter: 1}})
+			body = explicit(bodyPollRep, der)
+		} else {
+			body = ca.certRep(bodyIP, 0)
+		}
+	case bodyCertConf:
+		var statuses []certStatus
+		if _, err := asn1.Unmarshal(msg.Body.Bytes, &statuses); err != nil {
+			ca.t.Fatal(err)
+		}
+		hash := sha256.Sum256(ca.issued.Raw)
+		ca.confirmed = string(statuses[0].CertHash) == string(hash[:])
+		body = explicit(bodyPKIConf, asn1.NullBytes)
+	default:
+		ca.t.Fatalf("unexpected request body [%d]", msg.Body.Tag)
+	}
+	w.Header().Set("Content-Type", "application/pkixcmp")
+	w.Write(ca.respond(header, body))
+}
+
+// issue issues the certificate of the template of req,
+// after checking its proof of possession.
+func (ca *fakeCA) issue(req certReqMsg) {
+	var cr certRequest
+	if _, err := asn1.Unmarshal(req.CertReq.FullBytes, &cr); err != nil {
+		ca.t.Fatal(err)
+	}
+	var template []asn1.RawValue
+	if _, err := asn1.Unmarshal(cr.CertTemplate.FullBytes, &template); err != nil {
+		ca.t.Fatal(err)
+	}
+	var subject pkix.RDNSequence
+	var spki []byte
+	for _, field := range template {
+		switch field.Tag {
+		case 5:
+			asn1.Unmarshal(field.Bytes, &subject)
+		case 6:
+			spki, _ = asn1.Marshal(asn1.RawValue{Tag: asn1.TagSequence, IsCompound: true, Bytes: field.Bytes})
+		}
+	}
+	pub, err := x509.ParsePKIXPublicKey(spki)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	var popo popoSigningKey
+	if _, err := asn1.Unmarshal(append([]byte{0x30}, req.POPO.FullBytes[1:]...), &popo); err != nil {
+		ca.t.Fatal(err)
+	}
+	digest := sha256.Sum256(req.CertReq.FullBytes)
+	if err := rsa.VerifyPKCS1v15(pub.(*rsa.PublicKey), crypto.SHA256, digest[:], popo.Signature.Bytes); err != nil {
+		ca.t.Fatal("invalid proof of possession")
+	}
+	for _, ctrl := range cr.Controls {
+		if ctrl.Type.Equal(oidRegCtrlOldCertID) {
+			ca.oldCertID = new(certID)
+			asn1.Unmarshal(ctrl.Value.FullBytes, ca.oldCertID)
+		}
+	}
+	var name pkix.Name
+	name.FillFromRDNSequence(&subject)
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      name,
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+	}, ca.cert, pub, ca.key)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	ca.issued, _ = x509.ParseCertificate(der)
+}
+
+func (ca *fakeCA) certRep(tag, status int) asn1.RawValue {
+	r := certResponse{Status: pkiStatusInfo{Status: status}}
+	if status == statusRejection {
+		r.Status.StatusString = []string{"not allowed"}
+		r.Status.FailInfo = asn1.BitString{Bytes: []byte{0x00, 0x40}, BitLength: 10}
+	}
+	if status == 0 {
+		r.CertifiedKeyPair.CertOrEncCert = explicit(0, ca.issued.Raw)
+	}
+	der, err := asn1.Marshal(certRepMessage{
+		CAPubs:   []asn1.RawValue{{FullBytes: ca.cert.Raw}},
+		Response: []certResponse{r},
+	})
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	return explicit(tag, der)
+}
+
+// respond returns the protected response of body to a request of header.
+func (ca *fakeCA) respond(req pkiHeader, body asn1.RawValue) []byte {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	header := pkiHeader{
+		PVNO:          cmp2000,
+		Sender:        explicit(4, ca.cert.RawSubject),
+		Recipient:     req.Sender,
+		TransactionID: req.TransactionID,
+		SenderNonce:   nonce,
+		RecipNonce:    req.SenderNonce,
+	}
+	params := pbmParameter{
+		Salt:           []byte("salt"),
+		OWF:            pkix.AlgorithmIdentifier{Algorithm: oidSHA1},
+		IterationCount: 1024,
+		MAC:            pkix.AlgorithmIdentifier{Algorithm: oidHMACWithSHA1},
+	}
+	if ca.sign {
+		header.ProtectionAlg = pkix.AlgorithmIdentifier{Algorithm: oidSHA256WithRSA, Parameters: asn1.NullRawValue}
+	} else {
+		der, _ := asn1.Marshal(params)
+		header.ProtectionAlg = pkix.AlgorithmIdentifier{Algorithm: oidPasswordBasedMAC, Parameters: asn1.RawValue{FullBytes: der}}
+	}
+	headerDER, err := asn1.Marshal(header)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	msg := pkiMessage{Header: asn1.RawValue{FullBytes: headerDER}, Body: body}
+	part, _ := asn1.Marshal(protectedPart{Header: msg.Header, Body: body})
+	var protection []byte
+	if ca.sign {
+		// without extraCerts, like the mock server of OpenSSL
+		protection, _ = sign(ca.key, crypto.SHA256, part)
+	} else {
+		secret := ca.secret
+		if ca.respSecret != nil {
+			secret = ca.respSecret
+		}
+		protection, _ = pbmMAC(secret, params, part)
+	}
+	msg.Protection = asn1.BitString{Bytes: protection, BitLength: 8 * len(protection)}
+	der, err := asn1.Marshal(msg)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	return der
+}
+
+func newCSR(t *testing.T, cn string) (*x509.CertificateRequest, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: cn},
+		DNSNames: []string{cn + ".example.com"},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return csr, key
+}
+
+func TestEnroll(t *testing.T) {
+	caCert, caKey, err := depot.GenerateCA(pkix.Name{CommonName: "CMP CA"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &fakeCA{t: t, secret: []byte("s3cret"), cert: caCert, key: caKey, waiting: true}
+	srv := httptest.NewServer(ca)
+	defer srv.Close()
+
+	c, err := NewClient(Config{URL: srv.URL, Reference: "ref", Secret: []byte("s3cret")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, key := newCSR(t, "device")
+	resp, err := c.Enroll(context.Background(), Request{Type: IR, CSR: csr, Key: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Certificate.Subject.CommonName != "device" {
+		t.Errorf("expected the certificate of device, got %s", resp.Certificate.Subject)
+	}
+	if ca.polls != 2 {
+		t.Errorf("expected 2 polls, got %d", ca.polls)
+	}
+	if !ca.confirmed {
+		t.Error("expected the certificate to be confirmed")
+	}
+	if len(resp.CACerts) != 1 || !resp.CACerts[0].Equal(caCert) {
+		t.Error("expected caPubs to hold the CA certificate")
+	}
+
+	// a key update, signed with the old certificate and verified with the CA
+	old := resp.Certificate
+	ca.waiting, ca.sign, ca.confirmed = false, true, false
+	c, err = NewClient(Config{URL: srv.URL, Signer: key, Certificate: old, Trusted: []*x509.Certificate{caCert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, newKey := newCSR(t, "device")
+	if _, err := c.Enroll(context.Background(), Request{Type: KUR, CSR: csr, Key: newKey, OldCert: old}); err != nil {
+		t.Fatal(err)
+	}
+	if ca.oldCertID == nil || ca.oldCertID.SerialNumber.Cmp(old.SerialNumber) != 0 {
+		t.Error("expected the oldCertID control of the old certificate")
+	}
+	if !ca.confirmed {
+		t.Error("expected the certificate to be confirmed")
+	}
+
+	// a signed response not chaining to the roots
+	other, _, err := depot.GenerateCA(pkix.Name{CommonName: "other CA"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, _ = NewClient(Config{URL: srv.URL, Signer: key, Certificate: old, Trusted: []*x509.Certificate{other}})
+	if _, err := c.Enroll(context.Background(), Request{Type: KUR, CSR: csr, Key: newKey, OldCert: old}); err == nil {
+		t.Error("expected an untrusted response to fail")
+	}
+
+	// a MAC of another secret
+	ca.sign = false
+	c, _ = NewClient(Config{URL: srv.URL, Reference: "ref", Secret: []byte("s3cret")})
+	ca.respSecret = []byte("other")
+	if _, err := c.Enroll(context.Background(), Request{Type: IR, CSR: csr, Key: newKey}); err == nil {
+		t.Error("expected an invalid MAC to fail")
+	}
+}
+
+func TestEnrollRejected(t *testing.T) {
+	caCert, caKey, err := depot.GenerateCA(pkix.Name{CommonName: "CMP CA"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &fakeCA{t: t, secret: []byte("s3cret"), cert: caCert, key: caKey, reject: true}
+	srv := httptest.NewServer(ca)
+	defer srv.Close()
+
+	c, err := NewClient(Config{URL: srv.URL, Reference: "ref", Secret: []byte("s3cret")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, key := newCSR(t, "device")
+	_, err = c.Enroll(context.Background(), Request{Type: IR, CSR: csr, Key: key})
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) {
+		t.Fatalf("expected a StatusError, got %v", err)
+	}
+	if want := "cmp: rejection (badPOP): not allowed"; err.Error() != want {
+		t.Errorf("expected %q, got %q", want, err)
+	}
+}
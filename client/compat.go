@@ -0,0 +1,117 @@
+package scepclient
+
+import (
+	"crypto/x509"
+	"fmt"
+	"strings"
+
+	"scepclient/scepserver"
+)
+
+// JamfCompat adapts the client to the SCEP proxy of Jamf Pro, which
+// enrolls devices with a CA behind it:
+//
+//   - it advertises the capabilities of the CA, POSTPKIOperation among
+//     them, but only forwards GET requests, so PKIOperation is sent
+//     with GET;
+//   - it decodes the message of GET requests as standard base64;
+//   - it rejects requests without an Accept header, which Go clients
+//     do not send, and compressed responses are not requested.
+//
+// The challenge passwords of its dynamic challenges are checked
+// with JamfChallenge.
+func JamfCompat() Option {
+	return func(c *config) {
+		c.httpOpts = append(c.httpOpts,
+			scepserver.WithStandardBase64(),
+			scepserver.WithHeader("Accept", "*/*"),
+			scepserver.WithCompression(false),
+		)
+		c.middlewares = append(c.middlewares, scepserver.GETOnlyMiddleware())
+	}
+}
+
+// JamfChallenge returns challenge, as copied from Jamf Pro or returned
+// by its API, without the surrounding whitespace and quotes. The proxy
+// only accepts challenge passwords encoded as PrintableString, so other
+// characters are rejected before the request is sent.
+func JamfChallenge(challenge string) (string, error) {
+	challenge = strings.Trim(strings.TrimSpace(challenge), `"`)
+	for _, r := range challenge {
+		if !isPrintable(r) {
+			return "", fmt.Errorf("scepclient: the Jamf Pro proxy rejects the character %q of the challenge password", r)
+		}
+	}
+	return challenge, nil
+}
+
+// isPrintable reports whether r is in the PrintableString character set.
+func isPrintable(r rune) bool {
+	switch {
+	case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9':
+		return true
+	}
+	return strings.ContainsRune(" '()+,-./:=?", r)
+}
+
+// EJBCACompat adapts the client to the SCEP servlet of EJBCA, which
+// decodes the message of GET requests as standard base64. Use it with
+// EJBCAURL and IssuingCARecipients.
+func EJBCACompat() Option {
+	return WithHTTPOptions(scepserver.WithStandardBase64())
+}
+
+// ejbcaPath is the path of the SCEP aliases of EJBCA.
+const ejbcaPath = "/ejbca/publicweb/apply/scep"
+
+// EJBCAURL completes serverURL with the path of the SCEP alias of EJBCA,
+// /ejbca/publicweb/apply/scep/alias/pkiclient.exe: a URL without path
+// gets the whole path, and a URL of the aliases or of an alias gets the
+// rest of it. Other URLs are returned unchanged. The default alias of
+// EJBCA, scep, is used if alias is empty.
+func EJBCAURL(serverURL, alias string) (string, error) {
+	u, err := scepserver.ParseServerURL(serverURL)
+	if err != nil {
+		return "", err
+	}
+	if alias == "" {
+		alias = "scep"
+	}
+	path := strings.TrimSuffix(u.Path, "/")
+	switch {
+	case path == "":
+		path = ejbcaPath + "/" + alias + "/pkiclient.exe"
+	case strings.HasSuffix(path, ejbcaPath):
+		path += "/" + alias + "/pkiclient.exe"
+	case strings.Contains(path, ejbcaPath+"/") && !strings.HasSuffix(path, "/pkiclient.exe"):
+		path += "/pkiclient.exe"
+	default:
+		return serverURL, nil
+	}
+	u.Path, u.RawPath = path, ""
+	return u.String(), nil
+}
+
+// IssuingCARecipients returns the certificate to encrypt PKIOperation
+// messages to, out of the certificates returned by GetCACert by servers
+// such as EJBCA. With an RA, it is the RA certificate, as chosen by
+// Recipients. Without, these servers return the chain of their CA, in
+// no particular order, and decrypt with the CA which issued none of
+// the others.
+func IssuingCARecipients(certs []*x509.Certificate) []*x509.Certificate {
+	for _, crt := range certs {
+		if !crt.IsCA {
+			return Recipients(certs)
+		}
+	}
+	for _, crt := range certs {
+		issuer := false
+		for _, other := range certs {
+			issuer = issuer || (other != crt && other.CheckSignatureFrom(crt) == nil)
+		}
+		if !issuer {
+			return []*x509.Certificate{crt}
+		}
+	}
+	return Recipients(certs)
+}
@@ -0,0 +1,256 @@
+package scepclient_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	scepclient "scepclient/client"
+	"scepclient/crypto/x509util"
+	"scepclient/scep"
+	"scepclient/scepserver"
+	"scepclient/scepserver/depot"
+	"scepclient/scepserver/scepservertest"
+)
+
+// jamfProxy imitates the SCEP proxy of Jamf Pro in front of next: it
+// only forwards GET requests with an Accept header, and decodes their
+// message as standard base64.
+func jamfProxy(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if r.Header.Get("Accept") == "" {
+			http.Error(w, "not acceptable", http.StatusNotAcceptable)
+			return
+		}
+		if msg := r.URL.Query().Get("message"); msg != "" {
+			if _, err := base64.StdEncoding.DecodeString(msg); err != nil {
+				http.Error(w, "bad message", http.StatusBadRequest)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func TestJamfCompat(t *testing.T) {
+	svc, err := scepservertest.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(jamfProxy(scepserver.NewHTTPHandler(svc)))
+	defer srv.Close()
+
+	client, err := scepclient.New(srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := enroll(client, "device"); err == nil {
+		t.Error("expected the proxy to reject the default requests")
+	}
+
+	client, err = scepclient.New(srv.URL, nil, scepclient.JamfCompat())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := enroll(client, "device"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJamfChallenge(t *testing.T) {
+	for _, tt := range []struct {
+		in, want string
+		ok       bool
+	}{
+		{"  A1b2-C3d4\n", "A1b2-C3d4", true},
+		{`"quoted+secret"`, "quoted+secret", true},
+		{"pass*word", "", false},
+		{"pässword", "", false},
+	} {
+		got, err := scepclient.JamfChallenge(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("JamfChallenge(%q) = %q, %v", tt.in, got, err)
+		}
+	}
+}
+
+func TestEJBCAURL(t *testing.T) {
+	for _, tt := range []struct{ url, alias, want string }{
+		{"https://ejbca.example.com", "", "https://ejbca.example.com/ejbca/publicweb/apply/scep/scep/pkiclient.exe"},
+		{"ejbca.example.com:8080/", "devices", "http://ejbca.example.com:8080/ejbca/publicweb/apply/scep/devices/pkiclient.exe"},
+		{"https://ejbca.example.com/ejbca/publicweb/apply/scep/", "devices", "https://ejbca.example.com/ejbca/publicweb/apply/scep/devices/pkiclient.exe"},
+		{"https://ejbca.example.com/ejbca/publicweb/apply/scep/devices", "", "https://ejbca.example.com/ejbca/publicweb/apply/scep/devices/pkiclient.exe"},
+		{"https://ejbca.example.com/ejbca/publicweb/apply/scep/devices/pkiclient.exe", "", "https://ejbca.example.com/ejbca/publicweb/apply/scep/devices/pkiclient.exe"},
+		{"https://proxy.example.com/scep", "devices", "https://proxy.example.com/scep"},
+	} {
+		got, err := scepclient.EJBCAURL(tt.url, tt.alias)
+		if err != nil || got != tt.want {
+			t.Errorf("EJBCAURL(%q, %q) = %q, %v, expected %q", tt.url, tt.alias, got, err, tt.want)
+		}
+	}
+}
+
+func TestIssuingCARecipients(t *testing.T) {
+	root, rootKey, err := depot.GenerateCA(pkix.Name{CommonName: "root"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issue := func(cn string, isCA bool) *x509.Certificate {
+		key, err := rsa.GenerateKey(rand.Reader, 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+			SerialNumber:          big.NewInt(time.Now().UnixNano()),
+			Subject:               pkix.Name{CommonName: cn},
+			NotBefore:             time.Now(),
+			NotAfter:              time.Now().Add(time.Hour),
+			IsCA:                  isCA,
+			BasicConstraintsValid: true,
+			KeyUsage:              x509.KeyUsageDigitalSignature,
+		}, root, &key.PublicKey, rootKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+	sub, ra := issue("sub", true), issue("ra", false)
+
+	// the chain of a sub CA, root first
+	if got := scepclient.IssuingCARecipients([]*x509.Certificate{root, sub}); len(got) != 1 || got[0] != sub {
+		t.Errorf("expected the sub CA, got %v", got)
+	}
+	if got := scepclient.IssuingCARecipients([]*x509.Certificate{root}); len(got) != 1 || got[0] != root {
+		t.Errorf("expected the root CA, got %v", got)
+	}
+	if got := scepclient.IssuingCARecipients([]*x509.Certificate{root, ra}); len(got) != 1 || got[0] != ra {
+		t.Errorf("expected the RA, got %v", got)
+	}
+}
+
+// TestEJBCAIntegration enrolls with an EJBCA server, e.g. the community
+// container, started with
+//
+//	docker run -p 8080:8080 -e TLSSETUPENABLED=simple keyfactor/ejbca-ce
+//
+// with a SCEP alias in CA mode, and an end entity whose username is the
+// common name of the request and whose enrollment code is its challenge
+// password. It is skipped unless SCEPCLIENT_EJBCA_URL is set, e.g. to
+// http://localhost:8080, with SCEPCLIENT_EJBCA_ALIAS, and the username and
+// enrollment code in SCEPCLIENT_EJBCA_USERNAME and SCEPCLIENT_EJBCA_PASSWORD.
+func TestEJBCAIntegration(t *testing.T) {
+	serverURL := os.Getenv("SCEPCLIENT_EJBCA_URL")
+	if serverURL == "" {
+		t.Skip("SCEPCLIENT_EJBCA_URL is not set")
+	}
+	serverURL, err := scepclient.EJBCAURL(serverURL, os.Getenv("SCEPCLIENT_EJBCA_ALIAS"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := scepclient.New(serverURL, nil, scepclient.EJBCACompat())
+	if err != nil {
+		t.Fatal(err)
+	}
+	enrollWithChallenge(t, client, os.Getenv("SCEPCLIENT_EJBCA_USERNAME"), os.Getenv("SCEPCLIENT_EJBCA_PASSWORD"))
+}
+
+// enrollWithChallenge enrolls a new key for the common name cn with the
+// challenge password challenge, encrypting the request to the issuing CA.
+func enrollWithChallenge(t *testing.T, client scepclient.Client, cn, challenge string) {
+	t.Helper()
+	ctx := context.Background()
+	data, num, err := client.GetCACert(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a CA without chain is sent as a certificate
+	certs, err := x509.ParseCertificates(data)
+	if num > 1 {
+		certs, err = scep.CACerts(data)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, signer, key := newPKCSReq(t, scepclient.IssuingCARecipients(certs), cn, challenge)
+	respBytes, err := client.PKIOperation(ctx, msg.Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := scep.ParsePKIMessage(respBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.PKIStatus != scep.SUCCESS {
+		t.Fatalf("unexpected pkiStatus %s, failInfo %s", resp.PKIStatus, resp.FailInfo)
+	}
+	if err := resp.DecryptPKIEnvelope(signer, key); err != nil {
+		t.Fatal(err)
+	}
+	for _, ca := range certs {
+		if resp.CertRepMessage.Certificate.CheckSignatureFrom(ca) == nil {
+			return
+		}
+	}
+	t.Error("expected the certificate to be issued by a CA of GetCACert")
+}
+
+// newPKCSReq returns a PKCSReq of a new key for the common name cn
+// with the challenge password challenge, and its signer and key.
+func newPKCSReq(t *testing.T, recipients []*x509.Certificate, cn, challenge string) (*scep.PKIMessage, *x509.Certificate, *rsa.PrivateKey) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrDER, err := x509util.CreateCertificateRequest(rand.Reader, &x509util.CertificateRequest{
+		CertificateRequest: x509.CertificateRequest{Subject: pkix.Name{CommonName: cn}},
+		ChallengePassword:  challenge,
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signerDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}, &x509.Certificate{Subject: pkix.Name{CommonName: cn}}, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := x509.ParseCertificate(signerDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := scep.NewCSRRequest(csr, &scep.PKIMessage{
+		MessageType: scep.PKCSReq,
+		Recipients:  recipients,
+		SignerKey:   key,
+		SignerCert:  signer,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg, signer, key
+}
@@ -0,0 +1,362 @@
+// Package dockersecret publishes enrolled keys and certificates as
+// Docker Swarm secrets, so that services of a swarm mount certificates
+// issued over SCEP, and their renewals, like any other secret.
+//
+// Swarm secrets cannot be changed, so every renewal creates new
+// secrets, named after a hash of their content, and rotates the
+// services referencing the previous ones to them, as
+// docker service update --secret-rm --secret-add would. It talks to
+// the Docker Engine API of a manager node directly, without the Docker
+// client libraries.
+package dockersecret
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	scepclient "scepclient/client"
+	"scepclient/client/bundle"
+)
+
+// apiVersion is the version of the Docker Engine API requested,
+// that of Docker 20.10.
+const apiVersion = "v1.41"
+
+// The labels of the secrets written, finding the previous versions of
+// a secret and the part of the bundle they hold.
+const (
+	labelSecret = "scep.secret"
+	labelPart   = "scep.part"
+)
+
+// validName matches the names of secrets accepted by Docker.
+var validName = regexp.MustCompile(`^[a-zA-Z0-9]+(?:[a-zA-Z0-9-_.]*[a-zA-Z0-9])?$`)
+
+// Config selects the Docker Engine and the labels of the secrets.
+type Config struct {
+	// Endpoint is the URL of the Docker Engine API of a manager node.
+	// FromEnv sets it, and Client, from the environment of the docker
+	// command.
+	Endpoint string
+
+	// Client sends the requests to the Docker Engine.
+	// http.DefaultClient is used if it is nil.
+	Client *http.Client
+
+	// Labels are set on the secrets created.
+	Labels map[string]string
+
+	// RemoveSuperseded removes the previous versions of the secrets
+	// once no service references them anymore, so that the keys
+	// replaced by a renewal do not linger in the swarm.
+	RemoveSuperseded bool
+}
+
+// FromEnv returns the Config of the Docker Engine selected by
+// $DOCKER_HOST, a unix:// socket, /var/run/docker.sock by default, or
+// a tcp:// address, with TLS if $DOCKER_TLS_VERIFY is set, using the
+// ca.pem, cert.pem and key.pem of $DOCKER_CERT_PATH, ~/.docker by
+// default.
+func FromEnv() (Config, error) {
+	host := os.Getenv("DOCKER_HOST")
+	if host == "" {
+		host = "unix:///var/run/docker.sock"
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	config := Config{Client: &http.Client{Transport: transport}}
+	switch {
+	case strings.HasPrefix(host, "unix://"):
+		socket := strings.TrimPrefix(host, "unix://")
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		}
+		// the host is not used with the socket
+		config.Endpoint = "http://docker"
+	case strings.HasPrefix(host, "tcp://"):
+		config.Endpoint = "http://" + strings.TrimPrefix(host, "tcp://")
+		if os.Getenv("DOCKER_TLS_VERIFY") == "" {
+			break
+		}
+		dir := os.Getenv("DOCKER_CERT_PATH")
+		if dir == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return Config{}, fmt.Errorf("dockersecret: %w", err)
+			}
+			dir = filepath.Join(home, ".docker")
+		}
+		caPEM, err := ioutil.ReadFile(filepath.Join(dir, "ca.pem"))
+		if err != nil {
+			return Config{}, fmt.Errorf("dockersecret: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return Config{}, errors.New("dockersecret: no certificates in ca.pem of $DOCKER_CERT_PATH")
+		}
+		pair, err := tls.LoadX509KeyPair(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+		if err != nil {
+			return Config{}, fmt.Errorf("dockersecret: %w", err)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{pair}}
+		config.Endpoint = "https://" + strings.TrimPrefix(host, "tcp://")
+	default:
+		return Config{}, fmt.Errorf("dockersecret: unsupported DOCKER_HOST %q, expected unix:// or tcp://", host)
+	}
+	return config, nil
+}
+
+// Rotation is the result of a Write.
+type Rotation struct {
+	// Secrets are the names of the secrets of the bundle, by part:
+	// key, crt and, with CA certificates, ca.
+	Secrets map[string]string
+
+	// Services are the names of the services updated to them.
+	Services []string
+
+	// Removed are the names of the superseded secrets removed.
+	Removed []string
+}
+
+// Writer creates secrets and rotates the services of a swarm.
+type Writer struct {
+	config Config
+}
+
+// NewWriter returns a Writer using config.
+func NewWriter(config Config) (*Writer, error) {
+	if config.Endpoint == "" {
+		return nil, errors.New("dockersecret: the endpoint of the Docker Engine is required")
+	}
+	if config.Client == nil {
+		config.Client = http.DefaultClient
+	}
+	return &Writer{config: config}, nil
+}
+
+// Write creates the secrets <name>-key-<hash>, <name>-crt-<hash> and,
+// if b has CA certificates, <name>-ca-<hash> of b, labelled
+// scep.secret=<name> and scep.part with the part of b they hold, unless
+// they exist. The services referencing other secrets of a part of name
+// are then updated to reference the new secret at the same target,
+// starting a rolling update of their tasks. Services are not given
+// the secrets of name by Write: their first versions are found with
+// docker secret ls --filter label=scep.secret=<name>.
+func (w *Writer) Write(ctx context.Context, name string, b bundle.Bundle) (*Rotation, error) {
+	if !validName.MatchString(name) || len(name) > 47 {
+		return nil, fmt.Errorf("dockersecret: invalid secret name %q", name)
+	}
+	labels := make(map[string]string)
+	for k, v := range w.config.Labels {
+		labels[k] = v
+	}
+	labels[labelSecret] = name
+	if block, _ := pem.Decode(b.Certificate); block != nil {
+		if crt, err := x509.ParseCertificate(block.Bytes); err == nil {
+			labels["scep.serial-number"] = crt.SerialNumber.Text(16)
+			labels["scep.not-after"] = crt.NotAfter.UTC().Format(time.RFC3339)
+			labels["scep.renew-at"] = scepclient.DefaultRenewalPolicy.RenewAt(crt).UTC().Format(time.RFC3339)
+		}
+	}
+
+	rotation := &Rotation{Secrets: make(map[string]string)}
+	ids := make(map[string]string) // ID of the new secret by part
+	for _, part := range []struct {
+		name string
+		data []byte
+	}{{"key", b.Key}, {"crt", b.Certificate}, {"ca", b.CA}} {
+		if len(part.data) == 0 {
+			continue
+		}
+		sum := sha256.Sum256(part.data)
+		secretName := name + "-" + part.name + "-" + hex.EncodeToString(sum[:6])
+		id, err := w.createSecret(ctx, secretName, part.name, labels, part.data)
+		if err != nil {
+			return rotation, err
+		}
+		rotation.Secrets[part.name] = secretName
+		ids[part.name] = id
+	}
+
+	// the other secrets of the parts written are superseded
+	var secrets []struct {
+		ID   string
+		Spec struct {
+			Name   string
+			Labels map[string]string
+		}
+	}
+	filters, _ := json.Marshal(map[string][]string{"label": {labelSecret + "=" + name}})
+	if err := w.call(ctx, http.MethodGet, "/secrets?filters="+url.QueryEscape(string(filters)), nil, &secrets); err != nil {
+		return rotation, err
+	}
+	superseded := make(map[string]string) // part by ID
+	for _, s := range secrets {
+		part := s.Spec.Labels[labelPart]
+		if id, ok := ids[part]; ok && id != s.ID {
+			superseded[s.ID] = part
+		}
+	}
+
+	// the specs are kept as maps, to update them without
+	// dropping the fields of newer versions of the API
+	var services []struct {
+		ID      string
+		Version struct{ Index uint64 }
+		Spec    map[string]interface{}
+	}
+	if err := w.call(ctx, http.MethodGet, "/services", nil, &services); err != nil {
+		return rotation, err
+	}
+	referenced := make(map[string]bool)
+	for _, service := range services {
+		changed := false
+		for _, ref := range secretReferences(service.Spec) {
+			id, _ := ref["SecretID"].(string)
+			if part, ok := superseded[id]; ok {
+				ref["SecretID"], ref["SecretName"] = ids[part], rotation.Secrets[part]
+				changed = true
+			}
+			id, _ = ref["SecretID"].(string)
+			referenced[id] = true
+		}
+		if !changed {
+			continue
+		}
+		serviceName, _ := service.Spec["Name"].(string)
+		// the version of the service makes concurrent
+		// updates fail rather than overwrite each other
+		path := fmt.Sprintf("/services/%s/update?version=%d", url.PathEscape(service.ID), service.Version.Index)
+		if err := w.call(ctx, http.MethodPost, path, service.Spec, nil); err != nil {
+			return rotation, fmt.Errorf("updating service %s: %w", serviceName, err)
+		}
+		rotation.Services = append(rotation.Services, serviceName)
+	}
+	sort.Strings(rotation.Services)
+
+	if !w.config.RemoveSuperseded {
+		return rotation, nil
+	}
+	for _, s := range secrets {
+		if _, ok := superseded[s.ID]; !ok || referenced[s.ID] {
+			continue
+		}
+		if err := w.call(ctx, http.MethodDelete, "/secrets/"+url.PathEscape(s.ID), nil, nil); err != nil {
+			return rotation, err
+		}
+		rotation.Removed = append(rotation.Removed, s.Spec.Name)
+	}
+	sort.Strings(rotation.Removed)
+	return rotation, nil
+}
+
+// createSecret creates the secret name holding part, or returns the ID
+// of the existing secret name, which holds the same data since its name
+// has the hash of the data.
+func (w *Writer) createSecret(ctx context.Context, name, part string, labels map[string]string, data []byte) (string, error) {
+	secretLabels := map[string]string{labelPart: part}
+	for k, v := range labels {
+		if k != labelPart {
+			secretLabels[k] = v
+		}
+	}
+	var created struct{ ID string }
+	err := w.call(ctx, http.MethodPost, "/secrets/create", map[string]interface{}{
+		"Name":   name,
+		"Labels": secretLabels,
+		"Data":   data,
+	}, &created)
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusConflict {
+		err = w.call(ctx, http.MethodGet, "/secrets/"+url.PathEscape(name), nil, &created)
+	}
+	return created.ID, err
+}
+
+// secretReferences returns the secret references of the containers of
+// the tasks of the service spec.
+func secretReferences(spec map[string]interface{}) []map[string]interface{} {
+	template, _ := spec["TaskTemplate"].(map[string]interface{})
+	container, _ := template["ContainerSpec"].(map[string]interface{})
+	secrets, _ := container["Secrets"].([]interface{})
+	var refs []map[string]interface{}
+	for _, s := range secrets {
+		if ref, ok := s.(map[string]interface{}); ok {
+			refs = append(refs, ref)
+		}
+	}
+	return refs
+}
+
+// APIError is an error response of the Docker Engine API.
+type APIError struct {
+	// Code is the HTTP status code of the error.
+	Code    int
+	Message string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("dockersecret: %d %s", e.Code, e.Message)
+}
+
+// call sends in as JSON body, unless it is nil, to the API
+// path, and decodes the response into out, unless it is nil.
+func (w *Writer) call(ctx context.Context, method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(w.config.Endpoint, "/")+"/"+apiVersion+path, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := w.config.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("dockersecret: %w", err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 16<<20))
+	if err != nil {
+		return fmt.Errorf("dockersecret: %w", err)
+	}
+	if resp.StatusCode/100 != 2 {
+		e := APIError{Code: resp.StatusCode}
+		var msg struct{ Message string }
+		if json.Unmarshal(data, &msg) != nil || msg.Message == "" {
+			msg.Message = strings.TrimSpace(string(data))
+		}
+		e.Message = msg.Message
+		return &e
+	}
+	if out == nil || len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
@@ -0,0 +1,330 @@
+package dockersecret
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"scepclient/client/bundle"
+)
+
+type fakeSecret struct {
+	ID   string
+	Spec struct {
+		Name   string
+		Labels map[string]string
+		Data   []byte
+	}
+}
+
+type fakeService struct {
+	ID      string
+	Version struct{ Index uint64 }
+	Spec    map[string]interface{}
+}
+
+// fakeEngine stores the secrets and services of the requests
+// to the Docker Engine API.
+type fakeEngine struct {
+	mu       sync.Mutex
+	secrets  map[string]*fakeSecret
+	services map[string]*fakeService
+	updates  int
+	nextID   int
+}
+
+func (f *fakeEngine) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fail := func(code int, msg string) {
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(map[string]string{"message": msg})
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/"+apiVersion)
+	switch {
+	case r.Method == http.MethodPost && path == "/secrets/create":
+		var s fakeSecret
+		if err := json.NewDecoder(r.Body).Decode(&s.Spec); err != nil {
+			fail(http.StatusBadRequest, err.Error())
+			return
+		}
+		for _, other := range f.secrets {
+			if other.Spec.Name == s.Spec.Name {
+				fail(http.StatusConflict, "rpc error: code = AlreadyExists desc = secret "+s.Spec.Name+" already exists")
+				return
+			}
+		}
+		f.nextID++
+		s.ID = "s" + strconv.Itoa(f.nextID)
+		f.secrets[s.ID] = &s
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{"ID": s.ID})
+	case r.Method == http.MethodGet && path == "/secrets":
+		var filters map[string][]string
+		if err := json.Unmarshal([]byte(r.URL.Query().Get("filters")), &filters); err != nil || len(filters["label"]) != 1 {
+			fail(http.StatusBadRequest, "invalid filters")
+			return
+		}
+		k, v, _ := strings.Cut(filters["label"][0], "=")
+		list := []*fakeSecret{}
+		for _, s := range f.secrets {
+			if s.Spec.Labels[k] == v {
+				list = append(list, s)
+			}
+		}
+		json.NewEncoder(w).Encode(list)
+	case strings.HasPrefix(path, "/secrets/"):
+		ref := strings.TrimPrefix(path, "/secrets/")
+		for id, s := range f.secrets {
+			if id != ref && s.Spec.Name != ref {
+				continue
+			}
+			if r.Method == http.MethodDelete {
+				delete(f.secrets, id)
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			json.NewEncoder(w).Encode(s)
+			return
+		}
+		fail(http.StatusNotFound, "secret "+ref+" not found")
+	case r.Method == http.MethodGet && path == "/services":
+		list := []*fakeService{}
+		for _, s := range f.services {
+			list = append(list, s)
+		}
+		json.NewEncoder(w).Encode(list)
+	case r.Method == http.MethodPost && strings.HasSuffix(path, "/update"):
+		s, ok := f.services[strings.TrimSuffix(strings.TrimPrefix(path, "/services/"), "/update")]
+		if !ok {
+			fail(http.StatusNotFound, "service not found")
+			return
+		}
+		if r.URL.Query().Get("version") != strconv.FormatUint(s.Version.Index, 10) {
+			fail(http.StatusInternalServerError, "rpc error: code = Unknown desc = update out of sequence")
+			return
+		}
+		s.Spec = nil
+		if err := json.NewDecoder(r.Body).Decode(&s.Spec); err != nil {
+			fail(http.StatusBadRequest, err.Error())
+			return
+		}
+		s.Version.Index++
+		f.updates++
+		json.NewEncoder(w).Encode(map[string]interface{}{})
+	default:
+		fail(http.StatusNotFound, "page not found")
+	}
+}
+
+// addSecret adds a secret of the part of the bundle name.
+func (f *fakeEngine) addSecret(id, name, secret, part string) {
+	s := &fakeSecret{ID: id}
+	s.Spec.Name = name
+	s.Spec.Labels = map[string]string{labelSecret: secret, labelPart: part}
+	f.secrets[id] = s
+}
+
+// addService adds a service referencing secrets, by ID and target.
+func (f *fakeEngine) addService(id string, secrets map[string]string) {
+	var refs []interface{}
+	for secret, target := range secrets {
+		refs = append(refs, map[string]interface{}{
+			"File":       map[string]interface{}{"Name": target, "UID": "0", "GID": "0", "Mode": 292},
+			"SecretID":   secret,
+			"SecretName": f.secrets[secret].Spec.Name,
+		})
+	}
+	s := &fakeService{ID: id}
+	s.Version.Index = 10
+	s.Spec = map[string]interface{}{
+		"Name":   id,
+		"Labels": map[string]interface{}{"com.docker.stack.namespace": "shop"},
+		"TaskTemplate": map[string]interface{}{
+			"ContainerSpec": map[string]interface{}{"Image": "nginx:1.25", "Secrets": refs},
+		},
+	}
+	f.services[id] = s
+}
+
+// references returns the targets of the secrets referenced by the
+// service id, by secret name.
+func (f *fakeEngine) references(id string) map[string]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	targets := make(map[string]string)
+	for _, ref := range secretReferences(f.services[id].Spec) {
+		if f.secrets[ref["SecretID"].(string)] == nil {
+			return nil
+		}
+		targets[ref["SecretName"].(string)] = ref["File"].(map[string]interface{})["Name"].(string)
+	}
+	return targets
+}
+
+func testBundle(t *testing.T) bundle.Bundle {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(0xabc),
+		Subject:      pkix.Name{CommonName: "web"},
+		NotBefore:    time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC),
+		NotAfter:     time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bundle.Bundle{
+		Key:         pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+		Certificate: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		CA:          pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+}
+
+func TestWrite(t *testing.T) {
+	engine := &fakeEngine{secrets: make(map[string]*fakeSecret), services: make(map[string]*fakeService)}
+	engine.addSecret("k0", "web-key-1", "web", "key")
+	engine.addSecret("c0", "web-crt-1", "web", "crt")
+	engine.addSecret("o0", "db-password", "", "")
+	engine.addService("web", map[string]string{"k0": "tls.key", "c0": "tls.crt", "o0": "password"})
+	engine.addService("db", map[string]string{"o0": "password"})
+
+	// the engine listens on a socket, as with the docker.sock of a node
+	socket := filepath.Join(t.TempDir(), "docker.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: engine}
+	go srv.Serve(ln)
+	defer srv.Close()
+	t.Setenv("DOCKER_HOST", "unix://"+socket)
+	config, err := FromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Labels = map[string]string{"team": "shop", labelSecret: "ignored"}
+	config.RemoveSuperseded = true
+	w, err := NewWriter(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	b := testBundle(t)
+	rotation, err := w.Write(ctx, "web", b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rotation.Secrets) != 3 {
+		t.Fatalf("expected the secrets of the key, certificate and CA, got %v", rotation.Secrets)
+	}
+	for part, name := range rotation.Secrets {
+		if !strings.HasPrefix(name, "web-"+part+"-") || len(name) != len("web-"+part+"-")+12 {
+			t.Errorf("unexpected name %s of the %s secret", name, part)
+		}
+	}
+	if !reflect.DeepEqual(rotation.Services, []string{"web"}) || !reflect.DeepEqual(rotation.Removed, []string{"web-crt-1", "web-key-1"}) {
+		t.Errorf("expected web to be rotated, got %+v", rotation)
+	}
+	want := map[string]string{rotation.Secrets["key"]: "tls.key", rotation.Secrets["crt"]: "tls.crt", "db-password": "password"}
+	if got := engine.references("web"); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected the service to reference %v, got %v", want, got)
+	}
+	if got := engine.references("db"); !reflect.DeepEqual(got, map[string]string{"db-password": "password"}) {
+		t.Errorf("expected the other service to be kept, got %v", got)
+	}
+	if engine.services["web"].Spec["TaskTemplate"].(map[string]interface{})["ContainerSpec"].(map[string]interface{})["Image"] != "nginx:1.25" {
+		t.Error("expected the rest of the spec to be kept")
+	}
+	for _, s := range engine.secrets {
+		if s.Spec.Name != rotation.Secrets["key"] {
+			continue
+		}
+		if string(s.Spec.Data) != string(b.Key) {
+			t.Error("expected the key in the key secret")
+		}
+		labels := map[string]string{
+			labelSecret: "web", labelPart: "key", "team": "shop",
+			"scep.serial-number": "abc", "scep.not-after": "2027-01-01T00:00:00Z", "scep.renew-at": "2026-09-01T08:00:00Z",
+		}
+		if !reflect.DeepEqual(s.Spec.Labels, labels) {
+			t.Errorf("expected the labels %v, got %v", labels, s.Spec.Labels)
+		}
+	}
+
+	// writing the same bundle again changes nothing
+	again, err := w.Write(ctx, "web", b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(again.Secrets, rotation.Secrets) || len(again.Services) != 0 || len(again.Removed) != 0 || engine.updates != 1 {
+		t.Errorf("expected the existing secrets to be kept, got %+v", again)
+	}
+
+	// the new bundle supersedes the secrets of the previous one
+	next := testBundle(t)
+	next.CA = nil
+	rotation, err = w.Write(ctx, "web", next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rotation.Secrets) != 2 || len(rotation.Removed) != 2 || engine.updates != 2 {
+		t.Errorf("expected the key and certificate to be rotated, got %+v", rotation)
+	}
+	if _, err := w.Write(ctx, "web/tls", next); err == nil {
+		t.Error("expected an invalid name to fail")
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	for _, tt := range []struct {
+		host, endpoint string
+	}{
+		{"", "http://docker"},
+		{"tcp://10.0.0.1:2375", "http://10.0.0.1:2375"},
+		{"ssh://manager", ""},
+	} {
+		t.Setenv("DOCKER_HOST", tt.host)
+		t.Setenv("DOCKER_TLS_VERIFY", "")
+		config, err := FromEnv()
+		if tt.endpoint == "" {
+			if err == nil {
+				t.Errorf("%s: expected an error", tt.host)
+			}
+			continue
+		}
+		if err != nil || config.Endpoint != tt.endpoint {
+			t.Errorf("%s: expected %s, got %s, %v", tt.host, tt.endpoint, config.Endpoint, err)
+		}
+	}
+	t.Setenv("DOCKER_HOST", "tcp://10.0.0.1:2376")
+	t.Setenv("DOCKER_TLS_VERIFY", "1")
+	t.Setenv("DOCKER_CERT_PATH", t.TempDir())
+	if _, err := FromEnv(); err == nil {
+		t.Error("expected missing TLS files to fail")
+	}
+}
@@ -0,0 +1,163 @@
+// Package dot1x generates the configurations of the 802.1X supplicants of
+// Linux, wpa_supplicant and NetworkManager, authenticating with EAP-TLS
+// with the key and certificate files of an enrollment.
+package dot1x
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Config configures the network of the supplicant.
+type Config struct {
+	// Identity is the EAP identity, usually the subject common name
+	// or a user principal name of the certificate.
+	Identity string
+
+	// SSID is the SSID of the wireless network;
+	// the network is wired if it is empty.
+	SSID string
+
+	// CACert, ClientCert and PrivateKey are the absolute paths of the
+	// PEM encoded CA certificates verifying the authentication server,
+	// the client certificate and its unencrypted key.
+	CACert     string
+	ClientCert string
+	PrivateKey string
+
+	// DomainSuffixMatch, if not empty, is the domain the name
+	// of the authentication server's certificate must be in.
+	DomainSuffixMatch string
+
+	// Name is the name of the NetworkManager connection, "802.1X" by
+	// default, and Interface the interface it is bound to, if any.
+	Name      string
+	Interface string
+}
+
+func (c Config) validate() error {
+	if c.Identity == "" || c.ClientCert == "" || c.PrivateKey == "" {
+		return errors.New("dot1x: identity, client certificate and private key are required")
+	}
+	for _, s := range []string{c.Identity, c.SSID, c.CACert, c.ClientCert, c.PrivateKey, c.DomainSuffixMatch, c.Name, c.Interface} {
+		if strings.ContainsAny(s, "\"\r\n") {
+			return fmt.Errorf("dot1x: %q contains a quote or a line break", s)
+		}
+	}
+	return nil
+}
+
+// WPASupplicant returns a wpa_supplicant configuration with the network
+// of c. A wired network is authenticated with the wired driver, e.g.
+// wpa_supplicant -D wired -i eth0 -c 8021x.conf.
+func WPASupplicant(c Config) ([]byte, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if c.SSID == "" {
+		// no scanning, and no EAPOL-Key frames, on a wired port
+		buf.WriteString("ap_scan=0\n")
+	}
+	buf.WriteString("network={\n")
+	if c.SSID != "" {
+		fmt.Fprintf(&buf, "\tssid=%s\n", ssid(c.SSID))
+		buf.WriteString("\tkey_mgmt=WPA-EAP\n")
+	} else {
+		buf.WriteString("\tkey_mgmt=IEEE8021X\n")
+		buf.WriteString("\teapol_flags=0\n")
+	}
+	buf.WriteString("\teap=TLS\n")
+	fmt.Fprintf(&buf, "\tidentity=\"%s\"\n", c.Identity)
+	if c.CACert != "" {
+		fmt.Fprintf(&buf, "\tca_cert=\"%s\"\n", c.CACert)
+	}
+	if c.DomainSuffixMatch != "" {
+		fmt.Fprintf(&buf, "\tdomain_suffix_match=\"%s\"\n", c.DomainSuffixMatch)
+	}
+	fmt.Fprintf(&buf, "\tclient_cert=\"%s\"\n", c.ClientCert)
+	fmt.Fprintf(&buf, "\tprivate_key=\"%s\"\n", c.PrivateKey)
+	buf.WriteString("}\n")
+	return buf.Bytes(), nil
+}
+
+// NetworkManager returns a NetworkManager connection profile, in the
+// keyfile format of /etc/NetworkManager/system-connections, which
+// NetworkManager only loads from files of mode 0600 owned by root. The
+// UUID of the connection is derived from its name, so that a regenerated
+// profile replaces the connection.
+func NetworkManager(c Config) ([]byte, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	name := c.Name
+	if name == "" {
+		name = "802.1X"
+	}
+	var buf bytes.Buffer
+	buf.WriteString("[connection]\n")
+	fmt.Fprintf(&buf, "id=%s\n", keyfileValue(name))
+	fmt.Fprintf(&buf, "uuid=%s\n", nameUUID(name))
+	if c.SSID != "" {
+		buf.WriteString("type=wifi\n")
+	} else {
+		buf.WriteString("type=ethernet\n")
+	}
+	if c.Interface != "" {
+		fmt.Fprintf(&buf, "interface-name=%s\n", keyfileValue(c.Interface))
+	}
+	if c.SSID != "" {
+		buf.WriteString("\n[wifi]\n")
+		buf.WriteString("mode=infrastructure\n")
+		fmt.Fprintf(&buf, "ssid=%s\n", keyfileValue(c.SSID))
+		buf.WriteString("\n[wifi-security]\n")
+		buf.WriteString("key-mgmt=wpa-eap\n")
+	}
+	buf.WriteString("\n[802-1x]\n")
+	buf.WriteString("eap=tls;\n")
+	fmt.Fprintf(&buf, "identity=%s\n", keyfileValue(c.Identity))
+	if c.CACert != "" {
+		fmt.Fprintf(&buf, "ca-cert=%s\n", keyfileValue(c.CACert))
+	}
+	if c.DomainSuffixMatch != "" {
+		fmt.Fprintf(&buf, "domain-suffix-match=%s\n", keyfileValue(c.DomainSuffixMatch))
+	}
+	fmt.Fprintf(&buf, "client-cert=%s\n", keyfileValue(c.ClientCert))
+	fmt.Fprintf(&buf, "private-key=%s\n", keyfileValue(c.PrivateKey))
+	// the key is not encrypted, so there is no password to ask for
+	buf.WriteString("private-key-password-flags=4\n")
+	buf.WriteString("\n[ipv4]\nmethod=auto\n")
+	buf.WriteString("\n[ipv6]\nmethod=auto\n")
+	return buf.Bytes(), nil
+}
+
+// ssid returns s quoted, or hex encoded if it is not printable ASCII.
+func ssid(s string) string {
+	for _, r := range s {
+		if r > unicode.MaxASCII || !unicode.IsPrint(r) {
+			return fmt.Sprintf("%x", s)
+		}
+	}
+	return `"` + s + `"`
+}
+
+// keyfileValue escapes s as a string value of a keyfile.
+func keyfileValue(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	if strings.HasPrefix(s, " ") {
+		s = `\s` + s[1:]
+	}
+	return s
+}
+
+// nameUUID returns a version 5 UUID of name, in a namespace of its own.
+func nameUUID(name string) string {
+	h := sha1.Sum([]byte("scepclient 802.1X connection " + name))
+	h[6] = h[6]&0x0f | 0x50
+	h[8] = h[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", h[0:4], h[4:6], h[6:8], h[8:10], h[10:16])
+}
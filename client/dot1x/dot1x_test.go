@@ -0,0 +1,110 @@
+package dot1x
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWPASupplicant(t *testing.T) {
+	c := Config{
+		Identity:          "device-1",
+		CACert:            "/etc/scep/ca.pem",
+		ClientCert:        "/etc/scep/client.pem",
+		PrivateKey:        "/etc/scep/key.pem",
+		DomainSuffixMatch: "radius.example.com",
+	}
+	conf, err := WPASupplicant(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"ap_scan=0\nnetwork={\n",
+		"\tkey_mgmt=IEEE8021X\n",
+		"\teap=TLS\n",
+		"\tidentity=\"device-1\"\n",
+		"\tca_cert=\"/etc/scep/ca.pem\"\n",
+		"\tdomain_suffix_match=\"radius.example.com\"\n",
+		"\tprivate_key=\"/etc/scep/key.pem\"\n",
+	} {
+		if !strings.Contains(string(conf), want) {
+			t.Errorf("expected %q in\n%s", want, conf)
+		}
+	}
+
+	c.SSID = "corp"
+	if conf, err = WPASupplicant(c); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"\tssid=\"corp\"\n", "\tkey_mgmt=WPA-EAP\n"} {
+		if !strings.Contains(string(conf), want) {
+			t.Errorf("expected %q in\n%s", want, conf)
+		}
+	}
+	if strings.Contains(string(conf), "ap_scan") {
+		t.Errorf("expected a wireless network to scan\n%s", conf)
+	}
+
+	c.SSID = "café"
+	if conf, err = WPASupplicant(c); err != nil {
+		t.Fatal(err)
+	}
+	if want := "\tssid=636166c3a9\n"; !strings.Contains(string(conf), want) {
+		t.Errorf("expected %q in\n%s", want, conf)
+	}
+
+	c.Identity = "device\"1"
+	if _, err := WPASupplicant(c); err == nil {
+		t.Error("expected a quote to fail")
+	}
+}
+
+func TestNetworkManager(t *testing.T) {
+	c := Config{
+		Identity:   "device-1",
+		SSID:       "corp",
+		CACert:     "/etc/scep/ca.pem",
+		ClientCert: `/etc/scep\client.pem`,
+		PrivateKey: "/etc/scep/key.pem",
+		Name:       "corp wifi",
+		Interface:  "wlan0",
+	}
+	conf, err := NetworkManager(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"[connection]\nid=corp wifi\n",
+		"type=wifi\ninterface-name=wlan0\n",
+		"[wifi]\nmode=infrastructure\nssid=corp\n",
+		"[wifi-security]\nkey-mgmt=wpa-eap\n",
+		"[802-1x]\neap=tls;\nidentity=device-1\nca-cert=/etc/scep/ca.pem\n",
+		"client-cert=/etc/scep\\\\client.pem\n",
+		"private-key-password-flags=4\n",
+	} {
+		if !strings.Contains(string(conf), want) {
+			t.Errorf("expected %q in\n%s", want, conf)
+		}
+	}
+
+	// a regenerated profile keeps the UUID of the connection
+	again, err := NetworkManager(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(again) != string(conf) {
+		t.Error("expected the same profile")
+	}
+
+	c.SSID, c.Name = "", ""
+	if conf, err = NetworkManager(c); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"id=802.1X\n", "type=ethernet\n"} {
+		if !strings.Contains(string(conf), want) {
+			t.Errorf("expected %q in\n%s", want, conf)
+		}
+	}
+	if strings.Contains(string(conf), "[wifi") {
+		t.Errorf("expected a wired connection\n%s", conf)
+	}
+}
@@ -0,0 +1,228 @@
+// Package gcpsecret publishes enrolled keys and certificates as
+// versions of Google Cloud Secret Manager secrets, so that workloads
+// on Google Cloud mount certificates issued over SCEP, and their
+// renewals, like any other secret.
+//
+// It calls the Secret Manager REST API directly, authenticating with
+// the service account of the instance.
+package gcpsecret
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"scepclient/client/bundle"
+	"scepclient/cloudauth"
+)
+
+// Config selects the project and authentication.
+type Config struct {
+	// Project is the project ID of the secrets, unless they are
+	// given by their resource names, projects/<project>/secrets/<name>.
+	Project string
+
+	// Token authenticates the requests. It needs the
+	// secretmanager.versions.add, list and disable permissions, and
+	// secretmanager.secrets.create to create missing secrets, as in
+	// the Secret Manager Admin role. If it is nil, the tokens of the
+	// service account of the instance are fetched from the metadata
+	// server.
+	Token cloudauth.TokenSource
+
+	// Labels are set on the secrets created.
+	Labels map[string]string
+
+	// DisableSuperseded disables the other enabled versions of a
+	// secret once a new version is added, so that the certificates
+	// replaced by a renewal can no longer be accessed.
+	DisableSuperseded bool
+
+	// Endpoint is the URL of the Secret Manager API,
+	// https://secretmanager.googleapis.com by default.
+	Endpoint string
+
+	// Client sends the requests to Secret Manager.
+	// http.DefaultClient is used if it is nil.
+	Client *http.Client
+}
+
+// Writer adds bundles to secrets.
+type Writer struct {
+	config Config
+}
+
+// NewWriter returns a Writer using config.
+func NewWriter(config Config) (*Writer, error) {
+	if config.Endpoint == "" {
+		config.Endpoint = "https://secretmanager.googleapis.com"
+	}
+	if config.Client == nil {
+		config.Client = http.DefaultClient
+	}
+	if config.Token == nil {
+		config.Token = cloudauth.GCPMetadataToken(config.Client)
+	}
+	return &Writer{config: config}, nil
+}
+
+// Write adds b as a new version of the secret name, creating the
+// secret with automatic replication if it does not exist. The payload
+// of the version is the key followed by the certificate and the CA
+// certificates, in PEM. It returns the resource name of the version.
+func (w *Writer) Write(ctx context.Context, name string, b bundle.Bundle) (string, error) {
+	secret, err := w.secretName(name)
+	if err != nil {
+		return "", err
+	}
+	payload := append(append(append([]byte{}, b.Key...), b.Certificate...), b.CA...)
+	crc := crc32.Checksum(payload, crc32.MakeTable(crc32.Castagnoli))
+	add := map[string]interface{}{
+		"payload": map[string]interface{}{
+			"data":       payload,
+			"dataCrc32c": strconv.FormatUint(uint64(crc), 10),
+		},
+	}
+	var version struct {
+		Name string `json:"name"`
+	}
+	err = w.call(ctx, http.MethodPost, secret+":addVersion", add, &version)
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+		project, id := secret[:strings.LastIndex(secret, "/secrets/")], secret[strings.LastIndex(secret, "/")+1:]
+		create := map[string]interface{}{
+			"replication": map[string]interface{}{"automatic": map[string]interface{}{}},
+		}
+		if len(w.config.Labels) > 0 {
+			create["labels"] = w.config.Labels
+		}
+		if err := w.call(ctx, http.MethodPost, project+"/secrets?secretId="+url.QueryEscape(id), create, nil); err != nil {
+			return "", err
+		}
+		err = w.call(ctx, http.MethodPost, secret+":addVersion", add, &version)
+	}
+	if err != nil {
+		return "", err
+	}
+	if w.config.DisableSuperseded {
+		if err := w.disableOthers(ctx, secret, version.Name); err != nil {
+			return version.Name, err
+		}
+	}
+	return version.Name, nil
+}
+
+// disableOthers disables the enabled versions of secret but current.
+func (w *Writer) disableOthers(ctx context.Context, secret, current string) error {
+	var page struct {
+		Versions []struct {
+			Name string `json:"name"`
+		} `json:"versions"`
+		NextPageToken string `json:"nextPageToken"`
+	}
+	for {
+		path := secret + "/versions?filter=" + url.QueryEscape("state:ENABLED")
+		if page.NextPageToken != "" {
+			path += "&pageToken=" + url.QueryEscape(page.NextPageToken)
+		}
+		page.Versions, page.NextPageToken = nil, ""
+		if err := w.call(ctx, http.MethodGet, path, nil, &page); err != nil {
+			return err
+		}
+		for _, v := range page.Versions {
+			if v.Name == current {
+				continue
+			}
+			if err := w.call(ctx, http.MethodPost, v.Name+":disable", map[string]interface{}{}, nil); err != nil {
+				return err
+			}
+		}
+		if page.NextPageToken == "" {
+			return nil
+		}
+	}
+}
+
+// secretName returns the resource name of the secret name.
+func (w *Writer) secretName(name string) (string, error) {
+	if strings.HasPrefix(name, "projects/") {
+		if parts := strings.Split(name, "/"); len(parts) != 4 || parts[2] != "secrets" || parts[1] == "" || parts[3] == "" {
+			return "", fmt.Errorf("gcpsecret: invalid secret name %q", name)
+		}
+		return name, nil
+	}
+	if w.config.Project == "" {
+		return "", fmt.Errorf("gcpsecret: project of secret %s is required", name)
+	}
+	return "projects/" + w.config.Project + "/secrets/" + name, nil
+}
+
+// APIError is an error response of the Secret Manager API.
+type APIError struct {
+	// Code is the HTTP status code, and Status the
+	// gRPC status, e.g. NOT_FOUND, of the error.
+	Code    int
+	Status  string
+	Message string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("gcpsecret: %d %s: %s", e.Code, e.Status, e.Message)
+}
+
+// call sends in as JSON body, unless it is nil, to the API
+// path, and decodes the response into out, unless it is nil.
+func (w *Writer) call(ctx context.Context, method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	token, err := w.config.Token(ctx)
+	if err != nil {
+		return fmt.Errorf("gcpsecret: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(w.config.Endpoint, "/")+"/v1/"+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := w.config.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("gcpsecret: %w", err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("gcpsecret: %w", err)
+	}
+	if resp.StatusCode/100 != 2 {
+		var e struct {
+			Error APIError `json:"error"`
+		}
+		if json.Unmarshal(data, &e) != nil || e.Error.Message == "" {
+			e.Error.Message = strings.TrimSpace(string(data))
+		}
+		e.Error.Code = resp.StatusCode
+		return &e.Error
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
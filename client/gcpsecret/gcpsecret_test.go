@@ -0,0 +1,142 @@
+package gcpsecret
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"scepclient/client/bundle"
+	"scepclient/cloudauth"
+)
+
+// fakeSecretManager stores the payloads and states of the
+// versions of the secrets of the requests.
+type fakeSecretManager struct {
+	secrets map[string][]string
+	enabled map[string]bool
+	labels  map[string]interface{}
+}
+
+func (f *fakeSecretManager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"error":{"code":401,"message":"Request had invalid authentication credentials.","status":"UNAUTHENTICATED"}}`))
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/v1/")
+	var in map[string]interface{}
+	if r.Method == http.MethodPost {
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	notFound := func() {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error":{"code":404,"message":"Secret [` + path + `] not found or has no versions.","status":"NOT_FOUND"}}`))
+	}
+	switch {
+	case strings.HasSuffix(path, ":addVersion"):
+		secret := strings.TrimSuffix(path, ":addVersion")
+		if _, ok := f.secrets[secret]; !ok {
+			notFound()
+			return
+		}
+		payload := in["payload"].(map[string]interface{})
+		f.secrets[secret] = append(f.secrets[secret], payload["data"].(string))
+		name := fmt.Sprintf("%s/versions/%d", secret, len(f.secrets[secret]))
+		f.enabled[name] = true
+		json.NewEncoder(w).Encode(map[string]string{"name": name, "state": "ENABLED"})
+	case strings.HasSuffix(path, ":disable"):
+		f.enabled[strings.TrimSuffix(path, ":disable")] = false
+		w.Write([]byte(`{}`))
+	case strings.HasSuffix(path, "/secrets"):
+		secret := path + "/" + r.URL.Query().Get("secretId")
+		f.secrets[secret] = []string{}
+		f.labels = in["labels"].(map[string]interface{})
+		w.Write([]byte(`{}`))
+	case strings.HasSuffix(path, "/versions"):
+		if r.URL.Query().Get("filter") != "state:ENABLED" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		// one version per page, to check the paging
+		var names []string
+		for name, enabled := range f.enabled {
+			if enabled && strings.HasPrefix(name, path) && name > r.URL.Query().Get("pageToken") {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		var versions []map[string]string
+		next := ""
+		if len(names) > 0 {
+			versions = append(versions, map[string]string{"name": names[0]})
+		}
+		if len(names) > 1 {
+			next = names[0]
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"versions": versions, "nextPageToken": next})
+	default:
+		notFound()
+	}
+}
+
+func TestWriter(t *testing.T) {
+	sm := &fakeSecretManager{secrets: make(map[string][]string), enabled: make(map[string]bool)}
+	server := httptest.NewServer(sm)
+	defer server.Close()
+	w, err := NewWriter(Config{
+		Project:           "p",
+		Token:             cloudauth.StaticToken("token"),
+		Labels:            map[string]string{"team": "web"},
+		DisableSuperseded: true,
+		Endpoint:          server.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	const secret = "projects/p/secrets/web"
+	for i := 1; i <= 3; i++ {
+		name, err := w.Write(ctx, "web", bundle.Bundle{Key: []byte("key\n"), Certificate: []byte("cert\n"), CA: []byte("ca\n")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("%s/versions/%d", secret, i); name != want {
+			t.Errorf("expected version %s, got %s", want, name)
+		}
+	}
+	if sm.labels["team"] != "web" {
+		t.Errorf("expected the labels on the created secret, got %v", sm.labels)
+	}
+	// "a2V5CmNlcnQKY2EK" is "key\ncert\nca\n"
+	if versions := sm.secrets[secret]; len(versions) != 3 || versions[2] != "a2V5CmNlcnQKY2EK" {
+		t.Errorf("expected the PEM bundle in every version, got %v", versions)
+	}
+	for i := 1; i <= 3; i++ {
+		name := fmt.Sprintf("%s/versions/%d", secret, i)
+		if sm.enabled[name] != (i == 3) {
+			t.Errorf("expected only the latest version to be enabled, got %v", sm.enabled)
+		}
+	}
+
+	if _, err := w.Write(ctx, "projects/other/secrets/web", bundle.Bundle{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := sm.secrets["projects/other/secrets/web"]; !ok {
+		t.Error("expected the secret to be created in the project of its resource name")
+	}
+	if _, err := w.Write(ctx, "projects/p/web", bundle.Bundle{}); err == nil {
+		t.Error("expected an invalid resource name to fail the write")
+	}
+	w.config.Token = cloudauth.StaticToken("expired")
+	if _, err := w.Write(ctx, "web", bundle.Bundle{}); err == nil || !strings.Contains(err.Error(), "UNAUTHENTICATED") {
+		t.Errorf("expected the error of the API, got %v", err)
+	}
+}
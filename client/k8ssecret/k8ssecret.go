@@ -0,0 +1,214 @@
+// Package k8ssecret writes enrolled certificates into Kubernetes Secrets
+// of type kubernetes.io/tls, so that workloads in the cluster pick up
+// certificates issued over SCEP, and their renewals, like those of
+// cert-manager.
+//
+// It talks to the API server over its REST API, without the Kubernetes
+// client libraries. The service account of the pod needs get, create
+// and update permissions on the secrets.
+package k8ssecret
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// serviceAccountDir holds the credentials mounted into pods.
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// secretType is the type of Secrets holding TLS certificates.
+const secretType = "kubernetes.io/tls"
+
+// TLS holds the PEM encoded data of a kubernetes.io/tls Secret.
+type TLS struct {
+	// Key is the private key, stored as tls.key.
+	Key []byte
+
+	// Certificate is the certificate, stored as tls.crt.
+	Certificate []byte
+
+	// CA holds the CA certificates, stored as ca.crt if it is not empty.
+	CA []byte
+}
+
+// Writer creates and updates Secrets with an API server.
+type Writer struct {
+	// Server is the URL of the API server.
+	Server string
+
+	// Token is the bearer token authenticating the requests. If it is
+	// empty, the token is read from TokenFile before every request,
+	// since service account tokens are rotated.
+	Token     string
+	TokenFile string
+
+	// Client sends the requests, http.DefaultClient if it is nil.
+	Client *http.Client
+}
+
+// InCluster returns a Writer authenticating as the service account of
+// the pod it runs in, and the namespace of the pod.
+func InCluster() (*Writer, string, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, "", errors.New("k8ssecret: not running in a Kubernetes cluster")
+	}
+	caPEM, err := ioutil.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, "", fmt.Errorf("k8ssecret: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, "", errors.New("k8ssecret: no certificates in the cluster CA file")
+	}
+	namespace, err := ioutil.ReadFile(serviceAccountDir + "/namespace")
+	if err != nil {
+		return nil, "", fmt.Errorf("k8ssecret: %w", err)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	w := &Writer{
+		Server:    "https://" + net.JoinHostPort(host, port),
+		TokenFile: serviceAccountDir + "/token",
+		Client:    &http.Client{Transport: transport},
+	}
+	return w, strings.TrimSpace(string(namespace)), nil
+}
+
+// Write creates the Secret name in namespace with data, or updates the
+// keys of data in the existing Secret, keeping its other keys, labels
+// and annotations. It fails if the Secret is not of type
+// kubernetes.io/tls.
+func (w *Writer) Write(ctx context.Context, namespace, name string, data TLS) error {
+	secret, err := w.get(ctx, namespace, name)
+	if err != nil {
+		return err
+	}
+	if secret == nil {
+		secret = map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "Secret",
+			"metadata":   map[string]interface{}{"name": name, "namespace": namespace},
+			"type":       secretType,
+		}
+	} else if typ, _ := secret["type"].(string); typ != secretType {
+		return fmt.Errorf("k8ssecret: secret %s/%s is of type %s, not %s", namespace, name, typ, secretType)
+	}
+	values, _ := secret["data"].(map[string]interface{})
+	if values == nil {
+		values = make(map[string]interface{})
+	}
+	values["tls.key"] = base64.StdEncoding.EncodeToString(data.Key)
+	values["tls.crt"] = base64.StdEncoding.EncodeToString(data.Certificate)
+	if len(data.CA) > 0 {
+		values["ca.crt"] = base64.StdEncoding.EncodeToString(data.CA)
+	}
+	secret["data"] = values
+
+	body, err := json.Marshal(secret)
+	if err != nil {
+		return err
+	}
+	// the resourceVersion of the existing secret makes
+	// concurrent updates fail rather than overwrite each other
+	method, path := http.MethodPut, secretPath(namespace, name)
+	if _, ok := secret["metadata"].(map[string]interface{})["resourceVersion"]; !ok {
+		method, path = http.MethodPost, secretPath(namespace, "")
+	}
+	resp, err := w.do(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return apiError(resp, method, namespace, name)
+	}
+	return nil
+}
+
+// get returns the Secret name in namespace, or nil if it does not exist.
+func (w *Writer) get(ctx context.Context, namespace, name string) (map[string]interface{}, error) {
+	resp, err := w.do(ctx, http.MethodGet, secretPath(namespace, name), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, apiError(resp, http.MethodGet, namespace, name)
+	}
+	var secret map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return nil, fmt.Errorf("k8ssecret: decode secret %s/%s: %w", namespace, name, err)
+	}
+	if _, ok := secret["metadata"].(map[string]interface{}); !ok {
+		return nil, fmt.Errorf("k8ssecret: secret %s/%s without metadata", namespace, name)
+	}
+	return secret, nil
+}
+
+func (w *Writer) do(ctx context.Context, method, path string, body []byte) (*http.Response, error) {
+	token := w.Token
+	if token == "" && w.TokenFile != "" {
+		data, err := ioutil.ReadFile(w.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("k8ssecret: %w", err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(w.Server, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	client := w.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return client.Do(req)
+}
+
+// secretPath returns the API path of the Secret name in namespace,
+// or of the Secrets of namespace if name is empty.
+func secretPath(namespace, name string) string {
+	path := "/api/v1/namespaces/" + url.PathEscape(namespace) + "/secrets"
+	if name != "" {
+		path += "/" + url.PathEscape(name)
+	}
+	return path
+}
+
+// apiError returns the error of an unexpected response, with the
+// message of the Status object the API server answers with.
+func apiError(resp *http.Response, method, namespace, name string) error {
+	var status struct {
+		Message string `json:"message"`
+	}
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if json.Unmarshal(data, &status) != nil || status.Message == "" {
+		status.Message = strings.TrimSpace(string(data))
+	}
+	return fmt.Errorf("k8ssecret: %s secret %s/%s: %s: %s", method, namespace, name, resp.Status, status.Message)
+}
@@ -0,0 +1,106 @@
+package k8ssecret
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeAPIServer stores the secrets of the requests, by path.
+type fakeAPIServer struct {
+	mtx     sync.Mutex
+	secrets map[string]map[string]interface{}
+	version int
+}
+
+func (s *fakeAPIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer t0ken" {
+		http.Error(w, `{"message":"Unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	var secret map[string]interface{}
+	if r.Method != http.MethodGet {
+		if err := json.NewDecoder(r.Body).Decode(&secret); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	path := r.URL.Path
+	switch r.Method {
+	case http.MethodGet:
+		if secret = s.secrets[path]; secret == nil {
+			http.Error(w, `{"message":"secrets not found"}`, http.StatusNotFound)
+			return
+		}
+	case http.MethodPost:
+		path += "/" + secret["metadata"].(map[string]interface{})["name"].(string)
+		if s.secrets[path] != nil {
+			http.Error(w, `{"message":"already exists"}`, http.StatusConflict)
+			return
+		}
+	case http.MethodPut:
+		old := s.secrets[path]
+		if old == nil || old["metadata"].(map[string]interface{})["resourceVersion"] != secret["metadata"].(map[string]interface{})["resourceVersion"] {
+			http.Error(w, `{"message":"the object has been modified"}`, http.StatusConflict)
+			return
+		}
+	}
+	if r.Method != http.MethodGet {
+		s.version++
+		secret["metadata"].(map[string]interface{})["resourceVersion"] = strings.Repeat("1", s.version)
+		s.secrets[path] = secret
+	}
+	json.NewEncoder(w).Encode(secret)
+}
+
+func TestWriter(t *testing.T) {
+	api := &fakeAPIServer{secrets: make(map[string]map[string]interface{})}
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+	w := &Writer{Server: srv.URL, Token: "t0ken"}
+	ctx := context.Background()
+	const path = "/api/v1/namespaces/apps/secrets/web-tls"
+
+	if err := w.Write(ctx, "apps", "web-tls", TLS{Key: []byte("key"), Certificate: []byte("cert"), CA: []byte("ca")}); err != nil {
+		t.Fatal(err)
+	}
+	secret := api.secrets[path]
+	if secret == nil || secret["type"] != "kubernetes.io/tls" {
+		t.Fatalf("expected a TLS secret to be created, got %v", secret)
+	}
+	// keys added by others, e.g. for a keystore, are kept on renewal
+	secret["data"].(map[string]interface{})["keystore.p12"] = "cDEy"
+
+	if err := w.Write(ctx, "apps", "web-tls", TLS{Key: []byte("new key"), Certificate: []byte("new cert")}); err != nil {
+		t.Fatal(err)
+	}
+	data := api.secrets[path]["data"].(map[string]interface{})
+	for key, want := range map[string]string{
+		"tls.key":      "bmV3IGtleQ==",
+		"tls.crt":      "bmV3IGNlcnQ=",
+		"ca.crt":       "Y2E=",
+		"keystore.p12": "cDEy",
+	} {
+		if data[key] != want {
+			t.Errorf("expected %s to be %s, got %v", key, want, data[key])
+		}
+	}
+
+	api.secrets["/api/v1/namespaces/apps/secrets/opaque"] = map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "opaque", "resourceVersion": "1"},
+		"type":     "Opaque",
+	}
+	if err := w.Write(ctx, "apps", "opaque", TLS{}); err == nil || !strings.Contains(err.Error(), "Opaque") {
+		t.Errorf("expected a secret of another type not to be overwritten, got %v", err)
+	}
+	w.Token = "wrong"
+	if err := w.Write(ctx, "apps", "web-tls", TLS{}); err == nil || !strings.Contains(err.Error(), "Unauthorized") {
+		t.Errorf("expected the message of the API server, got %v", err)
+	}
+}
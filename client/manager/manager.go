@@ -0,0 +1,372 @@
+// Package manager keeps identities, keys with their certificates
+// enrolled with a SCEP server, through their lifecycle, so that
+// provisioning services, such as Terraform providers or custom daemons,
+// can embed what the scepclient command does without running it.
+//
+// An identity is created once with CreateIdentity, which generates its
+// key and CSR. EnsureEnrolled enrolls it unless it has a valid
+// certificate, and RenewIfNeeded renews the certificate once it is due,
+// signing the request with it, as the command does. The identities are
+// kept in a Store, e.g. a FileStore with the files of the command.
+package manager
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/fullsailor/pkcs7"
+	scepclient "scepclient/client"
+	"scepclient/clock"
+	"scepclient/crypto/x509util"
+	"scepclient/scep"
+)
+
+// Errors of the Manager and its Store.
+var (
+	// ErrNotFound is returned for identities missing from the Store.
+	ErrNotFound = errors.New("manager: identity not found")
+
+	// ErrExists is returned by CreateIdentity for existing identities.
+	ErrExists = errors.New("manager: identity exists")
+
+	// ErrPending is returned while the server has not approved the
+	// request of an identity, if the Manager does not poll. Calling
+	// the method again continues the SCEP transaction, whose ID
+	// derives from the key.
+	ErrPending = errors.New("manager: certificate request pending approval by the CA")
+)
+
+// Identity is a key, the CSR requesting its certificates, and the
+// certificate last issued for it.
+type Identity struct {
+	Name string
+	Key  *rsa.PrivateKey
+	CSR  *x509.CertificateRequest
+
+	// Certificate is nil until the identity is enrolled.
+	Certificate *x509.Certificate
+
+	// CACerts are the certificates returned by GetCACert
+	// at the last enrollment.
+	CACerts []*x509.Certificate
+}
+
+// Template describes the certificates requested for an identity.
+type Template struct {
+	Subject        pkix.Name
+	DNSNames       []string
+	EmailAddresses []string
+	IPAddresses    []net.IP
+	URIs           []*url.URL
+
+	// ChallengePassword authorizes the requests, if the server
+	// requires one.
+	ChallengePassword string
+
+	// KeySize is the size of the RSA key, 2048 if zero.
+	KeySize int
+}
+
+// Store keeps identities. Implementations must be safe for concurrent
+// use; the Manager does not update an identity concurrently.
+type Store interface {
+	// Load returns the identity name, or ErrNotFound.
+	Load(ctx context.Context, name string) (*Identity, error)
+
+	// Save creates or replaces the identity.
+	Save(ctx context.Context, id *Identity) error
+}
+
+// Manager enrolls and renews the identities of a Store with a SCEP
+// server. It is safe for concurrent use, and must not be copied.
+type Manager struct {
+	// Client sends the requests to the SCEP server.
+	Client scepclient.Client
+
+	Store Store
+
+	// RenewalPolicy decides when certificates are renewed.
+	// scepclient.DefaultRenewalPolicy is used if it is zero.
+	RenewalPolicy scepclient.RenewalPolicy
+
+	// PollPolicy polls requests answered with PENDING. If its
+	// Interval is zero, ErrPending is returned instead.
+	PollPolicy scepclient.PollPolicy
+
+	// Recipients selects the recipients of the requests among the
+	// certificates of GetCACert. scepclient.Recipients is used if
+	// it is nil.
+	Recipients func(certs []*x509.Certificate) []*x509.Certificate
+
+	// Clock tells the time for the validity of certificates.
+	// The system clock is used if it is nil.
+	Clock clock.Clock
+
+	locks sync.Map // of identity names to *sync.Mutex
+}
+
+// State is the state of the certificate of an identity.
+type State string
+
+// The states of identities.
+const (
+	// StateNew identities have no certificate yet.
+	StateNew State = "new"
+
+	// StateValid certificates are not due for renewal yet.
+	StateValid State = "valid"
+
+	// StateDue certificates are due for renewal.
+	StateDue State = "due"
+
+	// StateExpired certificates are out of their validity period,
+	// or not of the key of the identity.
+	StateExpired State = "expired"
+)
+
+// Status is the status of an identity.
+type Status struct {
+	Name  string
+	State State
+
+	// Serial, NotAfter and RenewAt describe the certificate
+	// of enrolled identities.
+	Serial   *big.Int
+	NotAfter time.Time
+	RenewAt  time.Time
+}
+
+// CreateIdentity generates the key and CSR of the new identity name,
+// and saves it without certificate.
+func (m *Manager) CreateIdentity(ctx context.Context, name string, tmpl Template) (*Identity, error) {
+	defer m.lock(name)()
+	if _, err := m.Store.Load(ctx, name); err == nil {
+		return nil, fmt.Errorf("%w: %s", ErrExists, name)
+	} else if !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	size := tmpl.KeySize
+	if size == 0 {
+		size = 2048
+	}
+	key, err := rsa.GenerateKey(rand.Reader, size)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509util.CreateCertificateRequest(rand.Reader, &x509util.CertificateRequest{
+		CertificateRequest: x509.CertificateRequest{
+			Subject:        tmpl.Subject,
+			DNSNames:       tmpl.DNSNames,
+			EmailAddresses: tmpl.EmailAddresses,
+			IPAddresses:    tmpl.IPAddresses,
+			URIs:           tmpl.URIs,
+		},
+		ChallengePassword: tmpl.ChallengePassword,
+	}, key)
+	if err != nil {
+		return nil, fmt.Errorf("manager: creating the CSR: %w", err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return nil, err
+	}
+	id := &Identity{Name: name, Key: key, CSR: csr}
+	if err := m.Store.Save(ctx, id); err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+// EnsureEnrolled enrolls the identity name unless its certificate is
+// valid, and returns it.
+func (m *Manager) EnsureEnrolled(ctx context.Context, name string) (*Identity, error) {
+	defer m.lock(name)()
+	id, err := m.Store.Load(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if id.Certificate != nil && m.valid(id) {
+		return id, nil
+	}
+	return id, m.enroll(ctx, id)
+}
+
+// RenewIfNeeded enrolls the identity name if its certificate is due for
+// renewal or invalid, and returns it, and whether it was enrolled.
+func (m *Manager) RenewIfNeeded(ctx context.Context, name string) (*Identity, bool, error) {
+	defer m.lock(name)()
+	id, err := m.Store.Load(ctx, name)
+	if err != nil {
+		return nil, false, err
+	}
+	if id.Certificate != nil && m.valid(id) && !m.renewalPolicy().Due(id.Certificate) {
+		return id, false, nil
+	}
+	if err := m.enroll(ctx, id); err != nil {
+		return id, false, err
+	}
+	return id, true, nil
+}
+
+// Status returns the status of the identity name.
+func (m *Manager) Status(ctx context.Context, name string) (Status, error) {
+	id, err := m.Store.Load(ctx, name)
+	if err != nil {
+		return Status{}, err
+	}
+	st := Status{Name: name, State: StateNew}
+	if cert := id.Certificate; cert != nil {
+		policy := m.renewalPolicy()
+		st.Serial, st.NotAfter, st.RenewAt = cert.SerialNumber, cert.NotAfter, policy.RenewAt(cert)
+		switch {
+		case !m.valid(id):
+			st.State = StateExpired
+		case policy.Due(cert):
+			st.State = StateDue
+		default:
+			st.State = StateValid
+		}
+	}
+	return st, nil
+}
+
+// lock locks the identity name, and returns the unlock function.
+func (m *Manager) lock(name string) func() {
+	mu, _ := m.locks.LoadOrStore(name, new(sync.Mutex))
+	mu.(*sync.Mutex).Lock()
+	return mu.(*sync.Mutex).Unlock
+}
+
+func (m *Manager) renewalPolicy() scepclient.RenewalPolicy {
+	policy := m.RenewalPolicy
+	if policy.Before == 0 && policy.Fraction == 0 {
+		policy = scepclient.DefaultRenewalPolicy
+	}
+	if policy.Clock == nil {
+		policy.Clock = m.Clock
+	}
+	return policy
+}
+
+// valid reports whether the certificate of id is within its validity
+// period, and of the key of id.
+func (m *Manager) valid(id *Identity) bool {
+	pub, ok := id.Certificate.PublicKey.(*rsa.PublicKey)
+	return ok && pub.Equal(&id.Key.PublicKey) && scepclient.CheckValidity(id.Certificate, m.Clock) == nil
+}
+
+// enroll requests a certificate for id, signed with its valid
+// certificate or else a self-signed one, and saves it.
+func (m *Manager) enroll(ctx context.Context, id *Identity) error {
+	caCerts, err := m.caCerts(ctx)
+	if err != nil {
+		return err
+	}
+	signerCert := id.Certificate
+	if signerCert == nil || !m.valid(id) {
+		if signerCert, err = selfSigned(id.Key, id.CSR.Subject, clock.Or(m.Clock).Now()); err != nil {
+			return err
+		}
+	}
+	recipients := m.Recipients
+	if recipients == nil {
+		recipients = scepclient.Recipients
+	}
+	tmpl := &scep.PKIMessage{
+		MessageType: scep.PKCSReq,
+		Recipients:  recipients(caCerts),
+		SignerKey:   id.Key,
+		SignerCert:  signerCert,
+	}
+	if m.Client.Supports("AES") || m.Client.Supports("SCEPStandard") {
+		tmpl.SCEPEncryptionAlgorithm = pkcs7.EncryptionAlgorithmAES128GCM
+	}
+	msg, err := scep.NewCSRRequest(id.CSR, tmpl)
+	if err != nil {
+		return fmt.Errorf("manager: creating pkiMessage: %w", err)
+	}
+
+	var pendingSince time.Time
+	for polls := 0; ; polls++ {
+		respBytes, err := m.Client.PKIOperation(ctx, msg.Raw)
+		if err != nil {
+			return fmt.Errorf("manager: PKIOperation: %w", err)
+		}
+		resp, err := scep.ParsePKIMessage(respBytes)
+		if err != nil {
+			return fmt.Errorf("manager: parsing pkiMessage response: %w", err)
+		}
+		switch resp.PKIStatus {
+		case scep.FAILURE:
+			return &scep.FailInfoError{MessageType: scep.PKCSReq, FailInfo: resp.FailInfo, Text: resp.FailInfoText}
+		case scep.PENDING:
+			if m.PollPolicy.Interval == 0 {
+				return ErrPending
+			}
+			if polls == 0 {
+				pendingSince = clock.Or(m.PollPolicy.Clock).Now()
+			}
+			if err := m.PollPolicy.Wait(ctx, pendingSince, polls); err != nil {
+				return fmt.Errorf("manager: transaction %s: %w", msg.TransactionID, err)
+			}
+			continue
+		}
+		if err := resp.DecryptPKIEnvelope(signerCert, id.Key); err != nil {
+			return fmt.Errorf("manager: decrypt pkiEnvelope: %w", err)
+		}
+		id.Certificate, id.CACerts = resp.CertRepMessage.Certificate, caCerts
+		return m.Store.Save(ctx, id)
+	}
+}
+
+// caCerts returns the certificates of GetCACert.
+func (m *Manager) caCerts(ctx context.Context) ([]*x509.Certificate, error) {
+	data, num, err := m.Client.GetCACert(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("manager: GetCACert: %w", err)
+	}
+	var certs []*x509.Certificate
+	if num > 1 {
+		certs, err = scep.CACerts(data)
+	} else {
+		certs, err = x509.ParseCertificates(scep.TrimTrailingData(data))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("manager: GetCACert: %w", err)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("manager: GetCACert: no certificates returned")
+	}
+	return certs, nil
+}
+
+// selfSigned returns a self-signed certificate of key, signing the
+// initial request of an identity.
+func selfSigned(key *rsa.PrivateKey, subject pkix.Name, now time.Time) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      subject,
+		NotBefore:    now.Add(-time.Minute),
+		NotAfter:     now.Add(time.Hour),
+		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
@@ -0,0 +1,116 @@
+package manager
+
+import (
+	"context"
+	"crypto/x509/pkix"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"scepclient/client/scepclienttest"
+	"scepclient/clock"
+	"scepclient/scep"
+)
+
+func TestManager(t *testing.T) {
+	client, err := scepclienttest.New(scepclienttest.WithStatuses(scep.PENDING))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := clock.NewFake(time.Now())
+	dir := t.TempDir()
+	m := &Manager{Client: client, Store: FileStore{Dir: dir}, Clock: fake}
+	ctx := context.Background()
+
+	tmpl := Template{Subject: pkix.Name{CommonName: "web"}, DNSNames: []string{"web.example.com"}, ChallengePassword: "secret"}
+	if _, err := m.CreateIdentity(ctx, "web", tmpl); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.CreateIdentity(ctx, "web", tmpl); !errors.Is(err, ErrExists) {
+		t.Fatalf("expected ErrExists, got %v", err)
+	}
+	if st, err := m.Status(ctx, "web"); err != nil || st.State != StateNew {
+		t.Fatalf("expected a new identity, got %+v, %v", st, err)
+	}
+
+	if _, err := m.EnsureEnrolled(ctx, "web"); !errors.Is(err, ErrPending) {
+		t.Fatalf("expected ErrPending, got %v", err)
+	}
+	id, err := m.EnsureEnrolled(ctx, "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := id.Certificate
+	if cert == nil || cert.Subject.CommonName != "web" || len(id.CACerts) == 0 {
+		t.Fatalf("expected the certificate of web and the CA, got %+v", id)
+	}
+	requests := client.Requests()
+	if len(requests) != 2 || requests[0].TransactionID != requests[1].TransactionID || requests[1].CSRReqMessage.ChallengePassword != "secret" {
+		t.Fatalf("expected the pending transaction to be resent with the challenge, got %d requests", len(requests))
+	}
+	if _, err := m.EnsureEnrolled(ctx, "web"); err != nil || len(client.Requests()) != 2 {
+		t.Fatalf("expected the enrolled identity to be kept, got %d requests, %v", len(client.Requests()), err)
+	}
+	if _, renewed, err := m.RenewIfNeeded(ctx, "web"); err != nil || renewed {
+		t.Fatalf("expected no renewal before it is due, got %v, %v", renewed, err)
+	}
+	if st, err := m.Status(ctx, "web"); err != nil || st.State != StateValid || st.Serial.Cmp(cert.SerialNumber) != 0 {
+		t.Fatalf("expected a valid certificate, got %+v, %v", st, err)
+	}
+
+	fake.Set(cert.NotBefore.Add(cert.NotAfter.Sub(cert.NotBefore) * 3 / 4))
+	if st, err := m.Status(ctx, "web"); err != nil || st.State != StateDue {
+		t.Fatalf("expected the certificate to be due, got %+v, %v", st, err)
+	}
+	id, renewed, err := m.RenewIfNeeded(ctx, "web")
+	if err != nil || !renewed {
+		t.Fatalf("expected a renewal, got %v, %v", renewed, err)
+	}
+	if id.Certificate.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+		t.Error("expected a new certificate")
+	}
+
+	// the files are those of the scepclient command
+	loaded, err := FileStore{Dir: dir}.Load(ctx, "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.Certificate.Equal(id.Certificate) || !loaded.Key.Equal(id.Key) || len(loaded.CACerts) != len(id.CACerts) {
+		t.Errorf("expected the saved identity, got %+v", loaded)
+	}
+	if fi, err := os.Stat(filepath.Join(dir, "web", "key.pem")); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("expected key.pem readable by its owner only, got %v, %v", fi.Mode(), err)
+	}
+
+	fake.Set(id.Certificate.NotAfter.Add(time.Hour))
+	if st, err := m.Status(ctx, "web"); err != nil || st.State != StateExpired {
+		t.Fatalf("expected the certificate to have expired, got %+v, %v", st, err)
+	}
+	if _, err := m.Status(ctx, "db"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	if _, err := (FileStore{Dir: dir}).Load(ctx, "../web"); err == nil {
+		t.Error("expected a path as name to fail")
+	}
+}
+
+func TestManagerFailure(t *testing.T) {
+	client, err := scepclienttest.New(scepclienttest.WithStatuses(scep.FAILURE), scepclienttest.WithFailInfo(scep.BadRequest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Manager{Client: client, Store: &MemoryStore{}}
+	ctx := context.Background()
+	if _, err := m.CreateIdentity(ctx, "web", Template{Subject: pkix.Name{CommonName: "web"}}); err != nil {
+		t.Fatal(err)
+	}
+	var failInfo *scep.FailInfoError
+	if _, _, err := m.RenewIfNeeded(ctx, "web"); !errors.As(err, &failInfo) || failInfo.FailInfo != scep.BadRequest {
+		t.Fatalf("expected badRequest, got %v", err)
+	}
+	if id, renewed, err := m.RenewIfNeeded(ctx, "web"); err != nil || !renewed || id.Certificate == nil {
+		t.Fatalf("expected an enrollment, got %v, %v", renewed, err)
+	}
+}
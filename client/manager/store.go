@@ -0,0 +1,197 @@
+package manager
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// MemoryStore keeps identities in memory, e.g. for tests or
+// daemons keeping them in another way.
+type MemoryStore struct {
+	mu         sync.Mutex
+	identities map[string]Identity
+}
+
+// Load implements Store.
+func (s *MemoryStore) Load(ctx context.Context, name string) (*Identity, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id, ok := s.identities[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	return &id, nil
+}
+
+// Save implements Store.
+func (s *MemoryStore) Save(ctx context.Context, id *Identity) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.identities == nil {
+		s.identities = make(map[string]Identity)
+	}
+	s.identities[id.Name] = *id
+	return nil
+}
+
+// FileStore keeps every identity in a directory named after it, in the
+// PEM files of the scepclient command: key.pem, readable by its owner
+// only, csr.pem, cert.pem and ca.pem.
+type FileStore struct {
+	Dir string
+}
+
+// Load implements Store.
+func (s FileStore) Load(ctx context.Context, name string) (*Identity, error) {
+	dir, err := s.dir(name)
+	if err != nil {
+		return nil, err
+	}
+	keyData, err := ioutil.ReadFile(filepath.Join(dir, "key.pem"))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, name)
+	} else if err != nil {
+		return nil, err
+	}
+	id := &Identity{Name: name}
+	if block, _ := pem.Decode(keyData); block == nil || block.Type != "RSA PRIVATE KEY" {
+		return nil, fmt.Errorf("manager: %s: no RSA PRIVATE KEY in key.pem", name)
+	} else if id.Key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+		return nil, fmt.Errorf("manager: %s: key.pem: %w", name, err)
+	}
+	blocks, err := readPEM(filepath.Join(dir, "csr.pem"), "CERTIFICATE REQUEST")
+	if err != nil {
+		return nil, fmt.Errorf("manager: %s: csr.pem: %w", name, err)
+	}
+	if id.CSR, err = x509.ParseCertificateRequest(blocks[0]); err != nil {
+		return nil, fmt.Errorf("manager: %s: csr.pem: %w", name, err)
+	}
+	certs, err := readCertificates(filepath.Join(dir, "cert.pem"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("manager: %s: cert.pem: %w", name, err)
+	}
+	if len(certs) > 0 {
+		id.Certificate = certs[0]
+	}
+	id.CACerts, err = readCertificates(filepath.Join(dir, "ca.pem"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("manager: %s: ca.pem: %w", name, err)
+	}
+	return id, nil
+}
+
+// Save implements Store. The key is written first, so that a crash
+// leaves no certificate with another key.
+func (s FileStore) Save(ctx context.Context, id *Identity) error {
+	dir, err := s.dir(id.Name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	write := func(file string, data []byte, perm os.FileMode) error {
+		if err := writeFile(filepath.Join(dir, file), data, perm); err != nil {
+			return fmt.Errorf("manager: %s: %w", id.Name, err)
+		}
+		return nil
+	}
+	if err := write("key.pem", pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(id.Key)}), 0600); err != nil {
+		return err
+	}
+	if err := write("csr.pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: id.CSR.Raw}), 0644); err != nil {
+		return err
+	}
+	if id.Certificate != nil {
+		if err := write("cert.pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: id.Certificate.Raw}), 0644); err != nil {
+			return err
+		}
+	}
+	if len(id.CACerts) > 0 {
+		var ca bytes.Buffer
+		for _, cert := range id.CACerts {
+			pem.Encode(&ca, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+		}
+		if err := write("ca.pem", ca.Bytes(), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dir returns the directory of the identity name.
+func (s FileStore) dir(name string) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return "", fmt.Errorf("manager: invalid identity name %q", name)
+	}
+	return filepath.Join(s.Dir, name), nil
+}
+
+// readPEM returns the DER bytes of the PEM blocks of typ in path.
+func readPEM(path, typ string) ([][]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var blocks [][]byte
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != typ {
+			return nil, fmt.Errorf("unexpected %s", block.Type)
+		}
+		blocks = append(blocks, block.Bytes)
+	}
+	if len(blocks) == 0 {
+		return nil, errors.New("no " + typ)
+	}
+	return blocks, nil
+}
+
+// readCertificates returns the certificates in path.
+func readCertificates(path string) ([]*x509.Certificate, error) {
+	blocks, err := readPEM(path, "CERTIFICATE")
+	if err != nil {
+		return nil, err
+	}
+	certs := make([]*x509.Certificate, len(blocks))
+	for i, der := range blocks {
+		if certs[i], err = x509.ParseCertificate(der); err != nil {
+			return nil, err
+		}
+	}
+	return certs, nil
+}
+
+// writeFile replaces path atomically with data.
+func writeFile(path string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,282 @@
+// Package mobileconfig generates Apple configuration profiles with a SCEP
+// payload, which make iOS, iPadOS and macOS devices enroll with a SCEP
+// server themselves, e.g. when distributed by an MDM or installed by hand.
+package mobileconfig
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/fullsailor/pkcs7"
+)
+
+// Key usages of the SCEP payload, which may be combined.
+const (
+	KeyUsageSigning    = 1
+	KeyUsageEncryption = 4
+)
+
+// SCEP configures the SCEP payload.
+type SCEP struct {
+	// URL is the URL of the SCEP server.
+	URL string
+
+	// Name is the name of the CA instance, e.g. the CA-IDENT of GetCACert.
+	Name string
+
+	// Subject is the subject of the requested certificate, as comma
+	// separated attributes, e.g. "O=Acme,CN=$DEVICE_SERIAL_NUMBER"; the
+	// variables are expanded by an MDM distributing the profile.
+	Subject string
+
+	// Challenge is the challenge password, if any.
+	Challenge string
+
+	// CAFingerprint is the fingerprint of the CA certificate,
+	// which the device checks the certificates of GetCACert against.
+	CAFingerprint []byte
+
+	// KeySize is the size of the RSA key of the device, 2048 by default,
+	// and KeyUsage its usage, signing and encryption by default.
+	KeySize  int
+	KeyUsage int
+
+	// KeyIsExtractable lets the key be exported from the keychain,
+	// and AllowAllAppsAccess lets all apps use it.
+	KeyIsExtractable   bool
+	AllowAllAppsAccess bool
+
+	// DNSNames, EmailAddresses and URIs are the subject
+	// alternative names of the requested certificate.
+	DNSNames       []string
+	EmailAddresses []string
+	URIs           []string
+
+	// Retries and RetryDelay, in seconds, set the polls of requests
+	// answered with PENDING, if they are not zero.
+	Retries    int
+	RetryDelay int
+}
+
+// Profile is a configuration profile with a SCEP payload.
+type Profile struct {
+	// Identifier is the reverse-DNS identifier of the profile, e.g.
+	// com.example.scep, which replaces an installed profile of the same
+	// identifier. The SCEP payload is identified by Identifier + ".scep".
+	Identifier string
+
+	DisplayName  string
+	Organization string
+	Description  string
+
+	SCEP SCEP
+}
+
+// Marshal returns the unsigned profile, as an XML property list.
+func (p Profile) Marshal() ([]byte, error) {
+	if p.Identifier == "" || p.SCEP.URL == "" {
+		return nil, errors.New("mobileconfig: identifier and SCEP URL are required")
+	}
+	subject, err := parseSubject(p.SCEP.Subject)
+	if err != nil {
+		return nil, err
+	}
+	keySize, keyUsage := p.SCEP.KeySize, p.SCEP.KeyUsage
+	if keySize == 0 {
+		keySize = 2048
+	}
+	if keyUsage == 0 {
+		keyUsage = KeyUsageSigning | KeyUsageEncryption
+	}
+	content := map[string]interface{}{
+		"URL":                p.SCEP.URL,
+		"Subject":            subject,
+		"Key Type":           "RSA",
+		"Keysize":            keySize,
+		"Key Usage":          keyUsage,
+		"KeyIsExtractable":   p.SCEP.KeyIsExtractable,
+		"AllowAllAppsAccess": p.SCEP.AllowAllAppsAccess,
+	}
+	if p.SCEP.Name != "" {
+		content["Name"] = p.SCEP.Name
+	}
+	if p.SCEP.Challenge != "" {
+		content["Challenge"] = p.SCEP.Challenge
+	}
+	if len(p.SCEP.CAFingerprint) > 0 {
+		content["CAFingerprint"] = p.SCEP.CAFingerprint
+	}
+	san := make(map[string]interface{})
+	for key, names := range map[string][]string{
+		"dNSName":                   p.SCEP.DNSNames,
+		"rfc822Name":                p.SCEP.EmailAddresses,
+		"uniformResourceIdentifier": p.SCEP.URIs,
+	} {
+		// a string, or an array of strings for several names
+		switch len(names) {
+		case 0:
+		case 1:
+			san[key] = names[0]
+		default:
+			values := make([]interface{}, len(names))
+			for i, name := range names {
+				values[i] = name
+			}
+			san[key] = values
+		}
+	}
+	if len(san) > 0 {
+		content["SubjectAltName"] = san
+	}
+	if p.SCEP.Retries > 0 {
+		content["Retries"] = p.SCEP.Retries
+	}
+	if p.SCEP.RetryDelay > 0 {
+		content["RetryDelay"] = p.SCEP.RetryDelay
+	}
+
+	profileUUID, err := newUUID()
+	if err != nil {
+		return nil, err
+	}
+	payloadUUID, err := newUUID()
+	if err != nil {
+		return nil, err
+	}
+	displayName := p.DisplayName
+	if displayName == "" {
+		displayName = "SCEP enrollment"
+	}
+	profile := map[string]interface{}{
+		"PayloadType":        "Configuration",
+		"PayloadVersion":     1,
+		"PayloadIdentifier":  p.Identifier,
+		"PayloadUUID":        profileUUID,
+		"PayloadDisplayName": displayName,
+		"PayloadContent": []interface{}{map[string]interface{}{
+			"PayloadType":        "com.apple.security.scep",
+			"PayloadVersion":     1,
+			"PayloadIdentifier":  p.Identifier + ".scep",
+			"PayloadUUID":        payloadUUID,
+			"PayloadDisplayName": displayName,
+			"PayloadContent":     content,
+		}},
+	}
+	if p.Organization != "" {
+		profile["PayloadOrganization"] = p.Organization
+	}
+	if p.Description != "" {
+		profile["PayloadDescription"] = p.Description
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	buf.WriteString(`<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">` + "\n")
+	buf.WriteString(`<plist version="1.0">` + "\n")
+	if err := writeValue(&buf, profile, 0); err != nil {
+		return nil, err
+	}
+	buf.WriteString("</plist>\n")
+	return buf.Bytes(), nil
+}
+
+// Sign returns profile signed with key and its certificate cert, with
+// the intermediate certificates chain, which devices show as verified
+// if they trust the issuer of cert.
+func Sign(profile []byte, cert *x509.Certificate, key crypto.PrivateKey, chain []*x509.Certificate) ([]byte, error) {
+	signedData, err := pkcs7.NewSignedData(profile)
+	if err != nil {
+		return nil, fmt.Errorf("mobileconfig: %w", err)
+	}
+	if err := signedData.AddSigner(cert, key, pkcs7.SignerInfoConfig{}); err != nil {
+		return nil, fmt.Errorf("mobileconfig: sign profile: %w", err)
+	}
+	for _, c := range chain {
+		signedData.AddCertificate(c)
+	}
+	return signedData.Finish()
+}
+
+// parseSubject parses the comma separated attributes of s into the
+// subject of the SCEP payload, an array of RDNs of one attribute each,
+// the type and value of which are an array.
+func parseSubject(s string) ([]interface{}, error) {
+	var subject []interface{}
+	for _, attr := range strings.Split(s, ",") {
+		if attr = strings.TrimSpace(attr); attr == "" {
+			continue
+		}
+		typ, value, ok := strings.Cut(attr, "=")
+		if !ok || strings.TrimSpace(typ) == "" {
+			return nil, fmt.Errorf("mobileconfig: subject attribute %q is not of the form type=value", attr)
+		}
+		subject = append(subject, []interface{}{[]interface{}{strings.TrimSpace(typ), strings.TrimSpace(value)}})
+	}
+	if len(subject) == 0 {
+		return nil, errors.New("mobileconfig: subject is required")
+	}
+	return subject, nil
+}
+
+// writeValue writes v as a property list element, indented by depth tabs.
+func writeValue(buf *bytes.Buffer, v interface{}, depth int) error {
+	indent := strings.Repeat("\t", depth)
+	switch v := v.(type) {
+	case string:
+		buf.WriteString(indent + "<string>")
+		xml.EscapeText(buf, []byte(v))
+		buf.WriteString("</string>\n")
+	case int:
+		fmt.Fprintf(buf, "%s<integer>%d</integer>\n", indent, v)
+	case bool:
+		fmt.Fprintf(buf, "%s<%t/>\n", indent, v)
+	case []byte:
+		fmt.Fprintf(buf, "%s<data>%s</data>\n", indent, base64.StdEncoding.EncodeToString(v))
+	case []interface{}:
+		buf.WriteString(indent + "<array>\n")
+		for _, e := range v {
+			if err := writeValue(buf, e, depth+1); err != nil {
+				return err
+			}
+		}
+		buf.WriteString(indent + "</array>\n")
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		buf.WriteString(indent + "<dict>\n")
+		for _, key := range keys {
+			buf.WriteString(indent + "\t<key>")
+			xml.EscapeText(buf, []byte(key))
+			buf.WriteString("</key>\n")
+			if err := writeValue(buf, v[key], depth+1); err != nil {
+				return err
+			}
+		}
+		buf.WriteString(indent + "</dict>\n")
+	default:
+		return fmt.Errorf("mobileconfig: unsupported property list type %T", v)
+	}
+	return nil
+}
+
+// newUUID returns a random version 4 UUID.
+func newUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%X-%X-%X-%X-%X", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
@@ -0,0 +1,213 @@
+package mobileconfig
+
+import (
+	"bytes"
+	"crypto/x509/pkix"
+	"encoding/xml"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fullsailor/pkcs7"
+	"scepclient/scepserver/depot"
+)
+
+func TestProfile(t *testing.T) {
+	p := Profile{
+		Identifier:   "com.example.scep",
+		Organization: "Acme & Co",
+		SCEP: SCEP{
+			URL:           "https://scep.example.com/scep",
+			Subject:       "O=Acme, CN=$DEVICE_SERIAL_NUMBER",
+			Challenge:     "secret",
+			CAFingerprint: []byte{0xca, 0xfe},
+			DNSNames:      []string{"a.example.com", "b.example.com"},
+			URIs:          []string{"urn:device"},
+		},
+	}
+	profile, err := p.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the property list is well-formed XML
+	d := xml.NewDecoder(bytes.NewReader(profile))
+	for {
+		if _, err := d.Token(); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("%v in\n%s", err, profile)
+		}
+	}
+	for _, want := range []string{
+		"<key>PayloadType</key>\n\t\t\t<string>com.apple.security.scep</string>",
+		"<key>PayloadIdentifier</key>\n\t\t\t<string>com.example.scep.scep</string>",
+		"<string>Acme &amp; Co</string>",
+		"<key>Subject</key>\n\t\t\t\t<array>\n\t\t\t\t\t<array>\n\t\t\t\t\t\t<array>\n\t\t\t\t\t\t\t<string>O</string>\n\t\t\t\t\t\t\t<string>Acme</string>",
+		"<string>$DEVICE_SERIAL_NUMBER</string>",
+		"<key>CAFingerprint</key>\n\t\t\t\t<data>yv4=</data>",
+		"<key>Keysize</key>\n\t\t\t\t<integer>2048</integer>",
+		"<key>Key Usage</key>\n\t\t\t\t<integer>5</integer>",
+		"<key>dNSName</key>\n\t\t\t\t\t<array>",
+		"<key>uniformResourceIdentifier</key>\n\t\t\t\t\t<string>urn:device</string>",
+		"<key>KeyIsExtractable</key>\n\t\t\t\t<false/>",
+	} {
+		if !strings.Contains(string(profile), want) {
+			t.Errorf("expected %q in\n%s", want, profile)
+		}
+	}
+
+	crt, key, err := depot.GenerateCA(pkix.Name{CommonName: "profile signer"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := Sign(profile, crt, key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p7, err := pkcs7.Parse(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p7.Verify(); err != nil {
+		t.Error(err)
+	}
+	if !bytes.Equal(p7.Content, profile) {
+		t.Error("expected the signed data to hold the profile")
+	}
+
+	p.SCEP.Subject = "CN"
+	if _, err := p.Marshal(); err == nil {
+		t.Error("expected a malformed subject to fail")
+	}
+}
+
+// enrollmentProfile is an enrollment profile as served by MicroMDM,
+// with the MDM payload before the SCEP payload.
+const enrollmentProfile = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>PayloadContent</key>
+	<array>
+		<dict>
+			<key>AccessRights</key>
+			<integer>8191</integer>
+			<key>CheckOutWhenRemoved</key>
+			<true/>
+			<key>PayloadType</key>
+			<string>com.apple.mdm</string>
+			<key>ServerURL</key>
+			<string>https://mdm.example.com/mdm/connect</string>
+		</dict>
+		<dict>
+			<key>PayloadContent</key>
+			<dict>
+				<key>CAFingerprint</key>
+				<data>
+				yv66
+				vg==
+				</data>
+				<key>Challenge</key>
+				<string>micromdm</string>
+				<key>Key Type</key>
+				<string>RSA</string>
+				<key>Key Usage</key>
+				<integer>5</integer>
+				<key>Keysize</key>
+				<integer>2048</integer>
+				<key>Subject</key>
+				<array>
+					<array>
+						<array>
+							<string>O</string>
+							<string>MicroMDM</string>
+						</array>
+					</array>
+					<array>
+						<array>
+							<string>CN</string>
+							<string>MicroMDM Identity (%ComputerName%)</string>
+						</array>
+					</array>
+				</array>
+				<key>URL</key>
+				<string>https://mdm.example.com/scep</string>
+			</dict>
+			<key>PayloadIdentifier</key>
+			<string>com.github.micromdm.scep</string>
+			<key>PayloadType</key>
+			<string>com.apple.security.scep</string>
+		</dict>
+	</array>
+	<key>PayloadDisplayName</key>
+	<string>Enrollment Profile</string>
+	<key>PayloadIdentifier</key>
+	<string>com.github.micromdm.micromdm.enroll</string>
+	<key>PayloadType</key>
+	<string>Configuration</string>
+</dict>
+</plist>
+`
+
+func TestParse(t *testing.T) {
+	p, err := Parse([]byte(enrollmentProfile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Identifier != "com.github.micromdm.micromdm.enroll" || p.DisplayName != "Enrollment Profile" {
+		t.Errorf("unexpected profile %+v", p)
+	}
+	s := p.SCEP
+	if s.URL != "https://mdm.example.com/scep" || s.Challenge != "micromdm" || s.KeySize != 2048 || s.KeyUsage != 5 {
+		t.Errorf("unexpected SCEP payload %+v", s)
+	}
+	if want := "O=MicroMDM,CN=MicroMDM Identity (%ComputerName%)"; s.Subject != want {
+		t.Errorf("expected the subject %q, got %q", want, s.Subject)
+	}
+	if !bytes.Equal(s.CAFingerprint, []byte{0xca, 0xfe, 0xba, 0xbe}) {
+		t.Errorf("unexpected CA fingerprint %x", s.CAFingerprint)
+	}
+
+	// the profiles of Marshal and Sign parse back
+	want := Profile{
+		Identifier:  "com.example.scep",
+		DisplayName: "SCEP enrollment",
+		SCEP: SCEP{
+			URL:        "https://scep.example.com/scep",
+			Subject:    "CN=$DEVICE_SERIAL_NUMBER",
+			KeySize:    4096,
+			KeyUsage:   KeyUsageSigning,
+			DNSNames:   []string{"a.example.com"},
+			URIs:       []string{"urn:a", "urn:b"},
+			Retries:    3,
+			RetryDelay: 10,
+		},
+	}
+	profile, err := want.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	crt, key, err := depot.GenerateCA(pkix.Name{CommonName: "profile signer"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := Sign(profile, crt, key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range [][]byte{profile, signed} {
+		got, err := Parse(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("expected %+v, got %+v", want, got)
+		}
+	}
+
+	if _, err := Parse([]byte(strings.Replace(enrollmentProfile, "com.apple.security.scep", "com.apple.security.pkcs12", 1))); err == nil {
+		t.Error("expected a profile without a SCEP payload to fail")
+	}
+}
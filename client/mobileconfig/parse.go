@@ -0,0 +1,226 @@
+package mobileconfig
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/fullsailor/pkcs7"
+)
+
+// Parse returns the profile of data, e.g. an enrollment profile of
+// MicroMDM or NanoMDM, with the first SCEP payload among its payloads.
+// Signed profiles are accepted, but their signature is not verified.
+func Parse(data []byte) (Profile, error) {
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("<")) {
+		p7, err := pkcs7.Parse(data)
+		if err != nil {
+			return Profile{}, fmt.Errorf("mobileconfig: neither a property list nor a signed profile: %w", err)
+		}
+		data = p7.Content
+	}
+	v, err := decodePlist(data)
+	if err != nil {
+		return Profile{}, err
+	}
+	root, ok := v.(map[string]interface{})
+	if !ok {
+		return Profile{}, errors.New("mobileconfig: the profile is not a dictionary")
+	}
+	p := Profile{
+		Identifier:   stringValue(root["PayloadIdentifier"]),
+		DisplayName:  stringValue(root["PayloadDisplayName"]),
+		Organization: stringValue(root["PayloadOrganization"]),
+		Description:  stringValue(root["PayloadDescription"]),
+	}
+	payloads, _ := root["PayloadContent"].([]interface{})
+	for _, payload := range payloads {
+		payload, _ := payload.(map[string]interface{})
+		if stringValue(payload["PayloadType"]) != "com.apple.security.scep" {
+			continue
+		}
+		content, ok := payload["PayloadContent"].(map[string]interface{})
+		if !ok {
+			return Profile{}, errors.New("mobileconfig: the SCEP payload has no content")
+		}
+		p.SCEP, err = parseSCEP(content)
+		return p, err
+	}
+	return Profile{}, errors.New("mobileconfig: the profile has no SCEP payload")
+}
+
+// parseSCEP returns the SCEP configuration of content,
+// the content of a SCEP payload.
+func parseSCEP(content map[string]interface{}) (SCEP, error) {
+	s := SCEP{
+		URL:                stringValue(content["URL"]),
+		Name:               stringValue(content["Name"]),
+		Challenge:          stringValue(content["Challenge"]),
+		KeySize:            intValue(content["Keysize"]),
+		KeyUsage:           intValue(content["Key Usage"]),
+		KeyIsExtractable:   content["KeyIsExtractable"] == true,
+		AllowAllAppsAccess: content["AllowAllAppsAccess"] == true,
+		Retries:            intValue(content["Retries"]),
+		RetryDelay:         intValue(content["RetryDelay"]),
+	}
+	if s.URL == "" {
+		return SCEP{}, errors.New("mobileconfig: the SCEP payload has no URL")
+	}
+	if typ := stringValue(content["Key Type"]); typ != "" && typ != "RSA" {
+		return SCEP{}, fmt.Errorf("mobileconfig: unsupported key type %s", typ)
+	}
+	s.CAFingerprint, _ = content["CAFingerprint"].([]byte)
+
+	// an array of RDNs, arrays of attributes, arrays of a type and value
+	var attrs []string
+	rdns, _ := content["Subject"].([]interface{})
+	for _, rdn := range rdns {
+		rdn, _ := rdn.([]interface{})
+		for _, attr := range rdn {
+			attr, _ := attr.([]interface{})
+			if len(attr) != 2 {
+				return SCEP{}, errors.New("mobileconfig: subject attributes must be arrays of a type and value")
+			}
+			attrs = append(attrs, stringValue(attr[0])+"="+stringValue(attr[1]))
+		}
+	}
+	s.Subject = strings.Join(attrs, ",")
+
+	san, _ := content["SubjectAltName"].(map[string]interface{})
+	s.DNSNames = stringsValue(san["dNSName"])
+	s.EmailAddresses = stringsValue(san["rfc822Name"])
+	s.URIs = stringsValue(san["uniformResourceIdentifier"])
+	return s, nil
+}
+
+func stringValue(v interface{}) string {
+	s, _ := v.(string)
+	return s
+}
+
+func intValue(v interface{}) int {
+	i, _ := v.(int)
+	return i
+}
+
+// stringsValue returns the string or array of strings v.
+func stringsValue(v interface{}) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var s []string
+		for _, e := range v {
+			s = append(s, stringValue(e))
+		}
+		return s
+	}
+	return nil
+}
+
+// decodePlist decodes the XML property list data into strings, ints,
+// bools, []byte, []interface{} and map[string]interface{}; reals and
+// dates are decoded as their strings.
+func decodePlist(data []byte) (interface{}, error) {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return nil, fmt.Errorf("mobileconfig: %w", err)
+		}
+		if start, ok := tok.(xml.StartElement); ok && start.Name.Local != "plist" {
+			return decodeValue(d, start)
+		}
+	}
+}
+
+func decodeValue(d *xml.Decoder, start xml.StartElement) (interface{}, error) {
+	switch start.Name.Local {
+	case "dict":
+		dict := make(map[string]interface{})
+		var key string
+		for {
+			tok, err := nextElement(d)
+			if err != nil {
+				return nil, err
+			}
+			if tok == nil {
+				return dict, nil
+			}
+			if tok.Name.Local == "key" {
+				if err := d.DecodeElement(&key, tok); err != nil {
+					return nil, fmt.Errorf("mobileconfig: %w", err)
+				}
+				continue
+			}
+			if dict[key], err = decodeValue(d, *tok); err != nil {
+				return nil, err
+			}
+		}
+	case "array":
+		array := []interface{}{}
+		for {
+			tok, err := nextElement(d)
+			if err != nil {
+				return nil, err
+			}
+			if tok == nil {
+				return array, nil
+			}
+			v, err := decodeValue(d, *tok)
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, v)
+		}
+	case "true", "false":
+		return start.Name.Local == "true", d.Skip()
+	}
+	var text string
+	if err := d.DecodeElement(&text, &start); err != nil {
+		return nil, fmt.Errorf("mobileconfig: %w", err)
+	}
+	switch start.Name.Local {
+	case "integer":
+		i, err := strconv.Atoi(strings.TrimSpace(text))
+		if err != nil {
+			return nil, fmt.Errorf("mobileconfig: %w", err)
+		}
+		return i, nil
+	case "data":
+		// the base64 is usually wrapped and indented
+		b, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(text), ""))
+		if err != nil {
+			return nil, fmt.Errorf("mobileconfig: %w", err)
+		}
+		return b, nil
+	case "string", "real", "date":
+		return text, nil
+	}
+	return nil, fmt.Errorf("mobileconfig: unsupported property list element %s", start.Name.Local)
+}
+
+// nextElement returns the next start element of d,
+// or nil at the end of the enclosing element.
+func nextElement(d *xml.Decoder) (*xml.StartElement, error) {
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return nil, errors.New("mobileconfig: unexpected end of the property list")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("mobileconfig: %w", err)
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			return &tok, nil
+		case xml.EndElement:
+			return nil, nil
+		}
+	}
+}
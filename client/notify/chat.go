@@ -0,0 +1,113 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Slack posts events to a Slack incoming webhook,
+// https://hooks.slack.com/services/...
+type Slack struct {
+	URL string
+
+	// Client sends the requests.
+	// http.DefaultClient is used if it is nil.
+	Client *http.Client
+}
+
+// Notify implements Notifier.
+func (s *Slack) Notify(ctx context.Context, e Event) error {
+	// &, < and > are the control characters of Slack's mrkdwn
+	escape := strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace
+	text := fmt.Sprintf("%s *%s*: %s", chatIcons[e.Kind], escape(e.Identity), e.Kind)
+	if c := e.Certificate; c != nil {
+		text += fmt.Sprintf("\n>subject: %s\n>issuer: %s\n>expires: %s",
+			escape(c.Subject.String()), escape(c.Issuer.String()), c.NotAfter.UTC().Format(time.RFC3339))
+	}
+	if e.Err != nil {
+		text += "\n```" + escape(e.Err.Error()) + "```"
+	}
+	body, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return err
+	}
+	if err := postJSON(ctx, s.Client, s.URL, nil, body); err != nil {
+		return fmt.Errorf("notify: Slack: %w", err)
+	}
+	return nil
+}
+
+// Teams posts events as Adaptive Cards to a Microsoft Teams incoming
+// webhook, of a Workflows app or of an Office 365 connector.
+type Teams struct {
+	URL string
+
+	// Client sends the requests.
+	// http.DefaultClient is used if it is nil.
+	Client *http.Client
+}
+
+// Notify implements Notifier.
+func (t *Teams) Notify(ctx context.Context, e Event) error {
+	type fact struct {
+		Title string `json:"title"`
+		Value string `json:"value"`
+	}
+	facts := []fact{}
+	if c := e.Certificate; c != nil {
+		facts = append(facts,
+			fact{"Subject", c.Subject.String()},
+			fact{"Issuer", c.Issuer.String()},
+			fact{"Expires", c.NotAfter.UTC().Format(time.RFC3339)},
+		)
+	}
+	if e.Err != nil {
+		facts = append(facts, fact{"Error", e.Err.Error()})
+	}
+	color := "good"
+	if e.Kind == RenewalFailed || e.Kind == ExpiryCritical {
+		color = "attention"
+	}
+	card := map[string]interface{}{
+		"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+		"type":    "AdaptiveCard",
+		"version": "1.4",
+		"body": []interface{}{
+			map[string]interface{}{
+				"type":   "TextBlock",
+				"text":   chatIcons[e.Kind] + " " + e.Identity + ": " + e.Kind.String(),
+				"weight": "bolder",
+				"color":  color,
+				"wrap":   true,
+			},
+			map[string]interface{}{"type": "FactSet", "facts": facts},
+		},
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"type": "message",
+		"attachments": []interface{}{map[string]interface{}{
+			"contentType": "application/vnd.microsoft.card.adaptive",
+			"content":     card,
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	if err := postJSON(ctx, t.Client, t.URL, nil, body); err != nil {
+		return fmt.Errorf("notify: Teams: %w", err)
+	}
+	return nil
+}
+
+// chatIcons mark the kinds of events in chat messages.
+var chatIcons = map[Kind]string{
+	RenewalFailed:  "\u274c",       // cross mark
+	ExpiryCritical: "\u26a0\ufe0f", // warning sign
+	Recovered:      "\u2705",       // check mark
+	Enrolled:       "\U0001f510",   // closed lock with key
+	CARollover:     "\U0001f504",   // anticlockwise arrows
+}
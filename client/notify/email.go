@@ -0,0 +1,51 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"mime"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Email sends events as plain text emails over SMTP, with STARTTLS if
+// the server offers it.
+type Email struct {
+	// Addr is the address of the SMTP server, host:port.
+	Addr string
+
+	// Auth authenticates with the server, if set, e.g. smtp.PlainAuth,
+	// which the server must offer over TLS.
+	Auth smtp.Auth
+
+	From string
+	To   []string
+}
+
+// Notify implements Notifier. The context is not used, as net/smtp
+// does not take one.
+func (m *Email) Notify(ctx context.Context, e Event) error {
+	var msg bytes.Buffer
+	header := func(name, value string) {
+		fmt.Fprintf(&msg, "%s: %s\r\n", name, value)
+	}
+	header("From", m.From)
+	header("To", strings.Join(m.To, ", "))
+	header("Subject", mime.QEncoding.Encode("utf-8", "[scepclient] "+e.Identity+": "+e.Kind.String()))
+	header("Date", e.Time.Format(time.RFC1123Z))
+	header("MIME-Version", "1.0")
+	header("Content-Type", "text/plain; charset=utf-8")
+	msg.WriteString("\r\n")
+	msg.WriteString(e.Message() + "\r\n")
+	if c := e.Certificate; c != nil {
+		fmt.Fprintf(&msg, "\r\nSubject: %s\r\nIssuer: %s\r\nSerial: %s\r\nValid: %s to %s\r\n",
+			c.Subject, c.Issuer, c.SerialNumber.Text(16),
+			c.NotBefore.UTC().Format(time.RFC3339), c.NotAfter.UTC().Format(time.RFC3339))
+	}
+	if err := smtp.SendMail(m.Addr, m.Auth, m.From, m.To, msg.Bytes()); err != nil {
+		return fmt.Errorf("notify: email: %w", err)
+	}
+	return nil
+}
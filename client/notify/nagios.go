@@ -0,0 +1,48 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// NagiosPassive writes events as the results of a passive service
+// check to the external command file of Nagios, or of Icinga or
+// Naemon: CRITICAL for RenewalFailed and ExpiryCritical, OK for
+// Recovered.
+type NagiosPassive struct {
+	// CommandFile is the external command file, a named pipe,
+	// e.g. /var/lib/nagios4/rw/nagios.cmd.
+	CommandFile string
+
+	// Host and Service name the service of the check.
+	Host, Service string
+}
+
+// The return codes of Nagios plugins.
+const (
+	nagiosOK       = 0
+	nagiosCritical = 2
+)
+
+// Notify implements Notifier.
+func (n *NagiosPassive) Notify(ctx context.Context, e Event) error {
+	code := nagiosCritical
+	if e.Kind == Recovered {
+		code = nagiosOK
+	}
+	// the fields are separated by semicolons and the command by a newline
+	output := strings.NewReplacer(";", ",", "\n", " ", "\r", " ").Replace(e.Message())
+	line := fmt.Sprintf("[%d] PROCESS_SERVICE_CHECK_RESULT;%s;%s;%d;%s\n", e.Time.Unix(), n.Host, n.Service, code, output)
+	// the pipe must exist, Nagios creates it
+	f, err := os.OpenFile(n.CommandFile, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return fmt.Errorf("notify: Nagios command file: %w", err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(line); err != nil {
+		return fmt.Errorf("notify: Nagios command file: %w", err)
+	}
+	return nil
+}
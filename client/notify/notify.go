@@ -0,0 +1,221 @@
+// Package notify alerts on the state of the certificates kept enrolled
+// by a daemon: enrollments, renewals failing for good, certificates
+// about to expire, rollovers of the CA, and their recovery, through the
+// alerting of the site, such as SNMP traps, the passive checks of
+// Nagios, webhooks, email, or Slack and Microsoft Teams channels.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Kind is the kind of an Event.
+type Kind int
+
+// The kinds of events.
+const (
+	// RenewalFailed is sent when a renewal fails for good: the server
+	// denied it, or it failed too many times in a row.
+	RenewalFailed Kind = iota + 1
+
+	// ExpiryCritical is sent when the certificate crosses the critical
+	// threshold of its remaining validity without being renewed.
+	ExpiryCritical
+
+	// Recovered is sent when a certificate is renewed after
+	// RenewalFailed or ExpiryCritical.
+	Recovered
+
+	// Enrolled is sent when a certificate is enrolled or renewed.
+	Enrolled
+
+	// CARollover is sent when a certificate is renewed by another CA
+	// key than the certificate it replaces.
+	CARollover
+)
+
+// kindNames are the names of the kinds in JSON and in lists of kinds.
+var kindNames = map[Kind]string{
+	RenewalFailed:  "renewal_failed",
+	ExpiryCritical: "expiry_critical",
+	Recovered:      "recovered",
+	Enrolled:       "enrolled",
+	CARollover:     "ca_rollover",
+}
+
+func (k Kind) String() string {
+	if name, ok := kindNames[k]; ok {
+		return strings.ReplaceAll(name, "_", " ")
+	}
+	return fmt.Sprintf("Kind(%d)", int(k))
+}
+
+// MarshalText returns the name of k, e.g. renewal_failed.
+func (k Kind) MarshalText() ([]byte, error) {
+	name, ok := kindNames[k]
+	if !ok {
+		return nil, fmt.Errorf("notify: unknown kind %d", int(k))
+	}
+	return []byte(name), nil
+}
+
+// ParseKinds parses a comma separated list of the names of kinds, e.g.
+// enrolled,renewal_failed.
+func ParseKinds(s string) ([]Kind, error) {
+	var kinds []Kind
+	for _, name := range strings.Split(s, ",") {
+		found := false
+		for k, n := range kindNames {
+			if n == strings.TrimSpace(name) {
+				kinds, found = append(kinds, k), true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("notify: unknown event %q, expected enrolled, renewal_failed, expiry_critical, ca_rollover or recovered", name)
+		}
+	}
+	return kinds, nil
+}
+
+// Event is a change of the state of the certificate of an identity.
+type Event struct {
+	Kind     Kind
+	Time     time.Time
+	Identity string
+
+	// Certificate is the current certificate, if there is one.
+	Certificate *x509.Certificate
+
+	// Err is the error of the last renewal of RenewalFailed events.
+	Err error
+}
+
+// Message returns a one line description of e.
+func (e Event) Message() string {
+	msg := e.Identity + ": " + e.Kind.String()
+	if e.Kind == CARollover && e.Certificate != nil {
+		msg += ", issued by " + e.Certificate.Issuer.String()
+	}
+	if e.Certificate != nil {
+		msg += ", the certificate expires on " + e.Certificate.NotAfter.UTC().Format(time.RFC3339)
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+// Notifier sends events. Implementations must be safe for concurrent use.
+type Notifier interface {
+	Notify(ctx context.Context, e Event) error
+}
+
+// NotifierFunc adapts a function to the Notifier interface.
+type NotifierFunc func(ctx context.Context, e Event) error
+
+// Notify calls f.
+func (f NotifierFunc) Notify(ctx context.Context, e Event) error {
+	return f(ctx, e)
+}
+
+// Multi sends events with all notifiers, and returns their errors.
+func Multi(notifiers ...Notifier) Notifier {
+	return NotifierFunc(func(ctx context.Context, e Event) error {
+		var errs []error
+		for _, n := range notifiers {
+			if err := n.Notify(ctx, e); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		return errors.Join(errs...)
+	})
+}
+
+// Filter sends the events of the kinds with n, and drops the others.
+func Filter(n Notifier, kinds ...Kind) Notifier {
+	return NotifierFunc(func(ctx context.Context, e Event) error {
+		for _, k := range kinds {
+			if e.Kind == k {
+				return n.Notify(ctx, e)
+			}
+		}
+		return nil
+	})
+}
+
+// Monitor turns the outcomes of the renewals of an identity into
+// events, sending each once until the certificate is renewed.
+type Monitor struct {
+	Notifier Notifier
+	Identity string
+
+	// Failures is the number of failed renewals in a row after which
+	// RenewalFailed is sent; denied renewals are sent at once.
+	Failures int
+
+	// Critical is the remaining validity under which ExpiryCritical is
+	// sent, none if zero.
+	Critical time.Duration
+
+	failures int
+	sent     map[Kind]bool
+}
+
+// Check sends ExpiryCritical once cert, the current certificate, has
+// less than Critical left.
+func (m *Monitor) Check(ctx context.Context, cert *x509.Certificate) error {
+	if m.Critical <= 0 || cert == nil || time.Until(cert.NotAfter) > m.Critical {
+		return nil
+	}
+	return m.send(ctx, Event{Kind: ExpiryCritical, Certificate: cert})
+}
+
+// Renewed records the enrollment of cert, replacing previous, nil for
+// the first enrollment. It sends Enrolled, CARollover if the CA key
+// changed, and Recovered if an alert was sent since the last renewal.
+func (m *Monitor) Renewed(ctx context.Context, previous, cert *x509.Certificate) error {
+	m.failures = 0
+	kinds := []Kind{Enrolled}
+	if previous != nil && (!bytes.Equal(previous.RawIssuer, cert.RawIssuer) || !bytes.Equal(previous.AuthorityKeyId, cert.AuthorityKeyId)) {
+		kinds = append(kinds, CARollover)
+	}
+	if len(m.sent) > 0 {
+		kinds = append(kinds, Recovered)
+	}
+	m.sent = nil
+	var errs []error
+	for _, k := range kinds {
+		if err := m.Notifier.Notify(ctx, Event{Kind: k, Time: time.Now(), Identity: m.Identity, Certificate: cert}); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Failed records a failed renewal with the current certificate cert,
+// nil if there is none. denied tells whether the server denied it.
+func (m *Monitor) Failed(ctx context.Context, cert *x509.Certificate, err error, denied bool) error {
+	m.failures++
+	if !denied && m.failures < m.Failures {
+		return nil
+	}
+	return m.send(ctx, Event{Kind: RenewalFailed, Certificate: cert, Err: err})
+}
+
+func (m *Monitor) send(ctx context.Context, e Event) error {
+	if m.sent[e.Kind] {
+		return nil
+	}
+	if m.sent == nil {
+		m.sent = make(map[Kind]bool)
+	}
+	m.sent[e.Kind] = true
+	e.Time, e.Identity = time.Now(), m.Identity
+	return m.Notifier.Notify(ctx, e)
+}
@@ -0,0 +1,311 @@
+package notify
+
+import (
+	"bufio"
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"scepclient/scepserver/webhook"
+)
+
+func TestMonitor(t *testing.T) {
+	var sent []Kind
+	m := &Monitor{
+		Notifier: NotifierFunc(func(ctx context.Context, e Event) error {
+			if e.Identity != "web" {
+				t.Errorf("unexpected identity %q", e.Identity)
+			}
+			sent = append(sent, e.Kind)
+			return nil
+		}),
+		Identity: "web",
+		Failures: 2,
+		Critical: 24 * time.Hour,
+	}
+	ctx := context.Background()
+	cert := &x509.Certificate{NotAfter: time.Now().Add(time.Hour), AuthorityKeyId: []byte{1}}
+	m.Failed(ctx, cert, errors.New("timeout"), false)
+	if len(sent) != 0 {
+		t.Fatalf("expected no event after the first failure, got %v", sent)
+	}
+	m.Failed(ctx, cert, errors.New("timeout"), false)
+	m.Check(ctx, cert)
+	m.Failed(ctx, cert, errors.New("timeout"), false)
+	m.Check(ctx, cert)
+	renewed := &x509.Certificate{NotAfter: time.Now().Add(90 * 24 * time.Hour), AuthorityKeyId: []byte{2}}
+	m.Renewed(ctx, cert, renewed)
+	m.Failed(ctx, renewed, errors.New("badRequest"), true)
+	m.Renewed(ctx, renewed, renewed)
+	want := []Kind{RenewalFailed, ExpiryCritical, Enrolled, CARollover, Recovered, RenewalFailed, Enrolled, Recovered}
+	if len(sent) != len(want) {
+		t.Fatalf("expected %v, got %v", want, sent)
+	}
+	for i := range want {
+		if sent[i] != want[i] {
+			t.Fatalf("expected %v, got %v", want, sent)
+		}
+	}
+}
+
+func TestSNMPTrap(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	trap := NewSNMPTrap(conn.LocalAddr().String(), "")
+	cert := &x509.Certificate{NotAfter: time.Now().Add(time.Hour)}
+	if err := trap.Notify(context.Background(), Event{Kind: ExpiryCritical, Identity: "web", Certificate: cert}); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 1500)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg struct {
+		Version   int
+		Community []byte
+		PDU       asn1.RawValue
+	}
+	if _, err := asn1.Unmarshal(buf[:n], &msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Version != 1 || string(msg.Community) != "public" || msg.PDU.Class != asn1.ClassContextSpecific || msg.PDU.Tag != 7 {
+		t.Fatalf("unexpected message %+v", msg)
+	}
+	var pdu struct {
+		RequestID   int
+		ErrorStatus int
+		ErrorIndex  int
+		VarBinds    []struct {
+			Name  asn1.ObjectIdentifier
+			Value asn1.RawValue
+		}
+	}
+	// decode the implicitly tagged PDU as a SEQUENCE
+	if _, err := asn1.Unmarshal(append([]byte{0x30}, msg.PDU.FullBytes[1:]...), &pdu); err != nil {
+		t.Fatal(err)
+	}
+	if len(pdu.VarBinds) != 6 {
+		t.Fatalf("expected 6 variables, got %d", len(pdu.VarBinds))
+	}
+	var trapOID asn1.ObjectIdentifier
+	if _, err := asn1.Unmarshal(pdu.VarBinds[1].Value.FullBytes, &trapOID); err != nil {
+		t.Fatal(err)
+	}
+	if trapOID.String() != DefaultTrapOID+".0.2" {
+		t.Errorf("unexpected trap OID %s", trapOID)
+	}
+	if got := string(pdu.VarBinds[2].Value.Bytes); got != "web" {
+		t.Errorf("unexpected identity %q", got)
+	}
+	var seconds int
+	if _, err := asn1.Unmarshal(pdu.VarBinds[5].Value.FullBytes, &seconds); err != nil || seconds < 3500 || seconds > 3600 {
+		t.Errorf("unexpected seconds until expiry %d, %v", seconds, err)
+	}
+}
+
+func TestNagiosPassive(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nagios.cmd")
+	if err := os.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	n := &NagiosPassive{CommandFile: path, Host: "web01", Service: "SCEP certificate"}
+	ctx := context.Background()
+	if err := n.Notify(ctx, Event{Kind: RenewalFailed, Time: time.Unix(1700000000, 0), Identity: "web", Err: errors.New("a; b")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Notify(ctx, Event{Kind: Recovered, Time: time.Unix(1700000060, 0), Identity: "web"}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "[1700000000] PROCESS_SERVICE_CHECK_RESULT;web01;SCEP certificate;2;web: renewal failed: a, b\n" +
+		"[1700000060] PROCESS_SERVICE_CHECK_RESULT;web01;SCEP certificate;0;web: recovered\n"
+	if string(data) != want {
+		t.Errorf("expected\n%s\ngot\n%s", want, data)
+	}
+	if err := (&NagiosPassive{CommandFile: filepath.Join(t.TempDir(), "missing")}).Notify(ctx, Event{}); err == nil || !strings.Contains(err.Error(), "Nagios") {
+		t.Errorf("expected the missing command file to fail, got %v", err)
+	}
+}
+
+func TestParseKinds(t *testing.T) {
+	kinds, err := ParseKinds("enrolled, ca_rollover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kinds) != 2 || kinds[0] != Enrolled || kinds[1] != CARollover {
+		t.Errorf("unexpected kinds %v", kinds)
+	}
+	if _, err := ParseKinds("enrolled,renewed"); err == nil {
+		t.Error("expected an unknown event to fail")
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	secret := []byte("s3cret")
+	var payload map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if got, want := r.Header.Get(webhook.SignatureHeader), webhook.Sign(secret, body); got != want {
+			t.Errorf("expected signature %q, got %q", want, got)
+		}
+		if err := json.Unmarshal(body, &payload); err != nil {
+			t.Error(err)
+		}
+		if payload["event"] == "recovered" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	w := &Webhook{URL: srv.URL, Secret: secret}
+	cert := &x509.Certificate{
+		Subject:      pkix.Name{CommonName: "web.example.com"},
+		Issuer:       pkix.Name{CommonName: "Example CA 2"},
+		SerialNumber: big.NewInt(0xabc),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	ctx := context.Background()
+	if err := w.Notify(ctx, Event{Kind: CARollover, Time: time.Now(), Identity: "web", Certificate: cert}); err != nil {
+		t.Fatal(err)
+	}
+	if payload["event"] != "ca_rollover" || payload["identity"] != "web" {
+		t.Errorf("unexpected payload %v", payload)
+	}
+	c, _ := payload["certificate"].(map[string]interface{})
+	if c["issuer"] != "CN=Example CA 2" || c["serial"] != "abc" {
+		t.Errorf("unexpected certificate %v", c)
+	}
+	if err := w.Notify(ctx, Event{Kind: Recovered, Time: time.Now(), Identity: "web"}); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("expected the status to fail, got %v", err)
+	}
+}
+
+func TestEmail(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	// a minimal SMTP server taking one message
+	msgc := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		text := textproto.NewConn(conn)
+		text.PrintfLine("220 localhost")
+		for {
+			line, err := text.ReadLine()
+			if err != nil {
+				return
+			}
+			switch cmd := strings.ToUpper(strings.Fields(line)[0]); cmd {
+			case "EHLO", "HELO", "MAIL", "RCPT":
+				text.PrintfLine("250 OK")
+			case "DATA":
+				text.PrintfLine("354 go ahead")
+				data, _ := io.ReadAll(bufio.NewReader(text.DotReader()))
+				msgc <- string(data)
+				text.PrintfLine("250 OK")
+			case "QUIT":
+				text.PrintfLine("221 bye")
+				return
+			default:
+				text.PrintfLine("502 %s not implemented", cmd)
+			}
+		}
+	}()
+
+	m := &Email{Addr: ln.Addr().String(), From: "scep@example.com", To: []string{"pki@example.com"}}
+	cert := &x509.Certificate{SerialNumber: big.NewInt(1), NotAfter: time.Now().Add(time.Hour)}
+	if err := m.Notify(context.Background(), Event{Kind: RenewalFailed, Time: time.Now(), Identity: "web", Certificate: cert, Err: errors.New("badRequest")}); err != nil {
+		t.Fatal(err)
+	}
+	msg := <-msgc
+	for _, want := range []string{"Subject: [scepclient] web: renewal failed\n", "To: pki@example.com\n", "web: renewal failed, the certificate expires on "} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("expected %q in\n%s", want, msg)
+		}
+	}
+}
+
+func TestChat(t *testing.T) {
+	var body []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "R&D"}, NotAfter: time.Now().Add(time.Hour)}
+	e := Event{Kind: RenewalFailed, Time: time.Now(), Identity: "web", Certificate: cert, Err: errors.New("badRequest")}
+
+	if err := (&Slack{URL: srv.URL}).Notify(ctx, e); err != nil {
+		t.Fatal(err)
+	}
+	var slack struct{ Text string }
+	if err := json.Unmarshal(body, &slack); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"*web*: renewal failed", ">subject: CN=R&amp;D", "```badRequest```"} {
+		if !strings.Contains(slack.Text, want) {
+			t.Errorf("expected %q in %q", want, slack.Text)
+		}
+	}
+
+	if err := (&Teams{URL: srv.URL}).Notify(ctx, e); err != nil {
+		t.Fatal(err)
+	}
+	var teams struct {
+		Type        string
+		Attachments []struct {
+			ContentType string
+			Content     struct {
+				Type string
+				Body []struct {
+					Type  string
+					Text  string
+					Color string
+					Facts []struct{ Title, Value string }
+				}
+			}
+		}
+	}
+	if err := json.Unmarshal(body, &teams); err != nil {
+		t.Fatal(err)
+	}
+	if teams.Type != "message" || len(teams.Attachments) != 1 || teams.Attachments[0].ContentType != "application/vnd.microsoft.card.adaptive" {
+		t.Fatalf("unexpected message %s", body)
+	}
+	card := teams.Attachments[0].Content
+	if card.Type != "AdaptiveCard" || len(card.Body) != 2 || card.Body[0].Color != "attention" || !strings.HasSuffix(card.Body[0].Text, "web: renewal failed") {
+		t.Fatalf("unexpected card %s", body)
+	}
+	if facts := card.Body[1].Facts; len(facts) != 4 || facts[0].Value != "CN=R&D" || facts[3].Value != "badRequest" {
+		t.Errorf("unexpected facts %+v", facts)
+	}
+}
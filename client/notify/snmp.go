@@ -0,0 +1,162 @@
+package notify
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/asn1"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultTrapOID is the OID under which SNMPTrap sends its traps and
+// variables, in the playground arc of the Net-SNMP enterprise meant for
+// local use. Sites with their own MIB set theirs.
+const DefaultTrapOID = "1.3.6.1.4.1.8072.9999.9999.7"
+
+// The OIDs of SNMPv2-MIB in every trap.
+var (
+	oidSysUpTime   = asn1.ObjectIdentifier{1, 3, 6, 1, 2, 1, 1, 3, 0}
+	oidSnmpTrapOID = asn1.ObjectIdentifier{1, 3, 6, 1, 6, 3, 1, 1, 4, 1, 0}
+)
+
+// SNMPTrap sends events as SNMPv2c traps over UDP. The trap of an event
+// is the OID base.0.kind, e.g. base.0.1 for RenewalFailed, and it has the
+// variables base.1.1, the identity, base.1.2, the message of the event,
+// base.1.3, the expiry of the certificate as an RFC 3339 date, and
+// base.1.4, the seconds until expiry.
+type SNMPTrap struct {
+	// Addr is the address of the trap receiver, host:162 by default.
+	Addr      string
+	Community string
+
+	// OID is the base of the OIDs, DefaultTrapOID if empty.
+	OID string
+
+	start time.Time
+}
+
+// NewSNMPTrap returns the notifier of the trap receiver at addr, with
+// the community, public if empty.
+func NewSNMPTrap(addr, community string) *SNMPTrap {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "162")
+	}
+	if community == "" {
+		community = "public"
+	}
+	return &SNMPTrap{Addr: addr, Community: community, start: time.Now()}
+}
+
+// Notify implements Notifier.
+func (t *SNMPTrap) Notify(ctx context.Context, e Event) error {
+	msg, err := t.trap(e)
+	if err != nil {
+		return err
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", t.Addr)
+	if err != nil {
+		return fmt.Errorf("notify: SNMP trap: %w", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write(msg); err != nil {
+		return fmt.Errorf("notify: SNMP trap: %w", err)
+	}
+	return nil
+}
+
+// varBind is a variable binding of SNMP.
+type varBind struct {
+	Name  asn1.ObjectIdentifier
+	Value interface{}
+}
+
+// trap encodes the SNMPv2c trap of e.
+func (t *SNMPTrap) trap(e Event) ([]byte, error) {
+	base := t.OID
+	if base == "" {
+		base = DefaultTrapOID
+	}
+	oid, err := parseOID(base)
+	if err != nil {
+		return nil, fmt.Errorf("notify: SNMP trap OID %q: %w", base, err)
+	}
+	sub := func(arcs ...int) asn1.ObjectIdentifier {
+		return append(append(asn1.ObjectIdentifier{}, oid...), arcs...)
+	}
+
+	// sysUpTime is in hundredths of a second, as TimeTicks
+	uptime := asn1.RawValue{Class: asn1.ClassApplication, Tag: 3, Bytes: uint32Bytes(uint32(time.Since(t.start) / (10 * time.Millisecond)))}
+	binds := []varBind{
+		{oidSysUpTime, uptime},
+		{oidSnmpTrapOID, sub(0, int(e.Kind))},
+		{sub(1, 1), []byte(e.Identity)},
+		{sub(1, 2), []byte(e.Message())},
+	}
+	if e.Certificate != nil {
+		binds = append(binds,
+			varBind{sub(1, 3), []byte(e.Certificate.NotAfter.UTC().Format(time.RFC3339))},
+			varBind{sub(1, 4), int64(time.Until(e.Certificate.NotAfter).Seconds())},
+		)
+	}
+	var encoded []asn1.RawValue
+	for _, b := range binds {
+		der, err := asn1.Marshal(b)
+		if err != nil {
+			return nil, fmt.Errorf("notify: SNMP trap: %w", err)
+		}
+		encoded = append(encoded, asn1.RawValue{FullBytes: der})
+	}
+
+	var id [4]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	pdu, err := asn1.Marshal(struct {
+		RequestID   int32
+		ErrorStatus int
+		ErrorIndex  int
+		VarBinds    []asn1.RawValue
+	}{int32(binary.BigEndian.Uint32(id[:]) >> 1), 0, 0, encoded})
+	if err != nil {
+		return nil, fmt.Errorf("notify: SNMP trap: %w", err)
+	}
+	// SNMPv2-Trap-PDU is [7] IMPLICIT SEQUENCE
+	pdu[0] = 0xa7
+	return asn1.Marshal(struct {
+		Version   int
+		Community []byte
+		PDU       asn1.RawValue
+	}{1, []byte(t.Community), asn1.RawValue{FullBytes: pdu}})
+}
+
+func parseOID(s string) (asn1.ObjectIdentifier, error) {
+	var oid asn1.ObjectIdentifier
+	for _, arc := range strings.Split(strings.TrimPrefix(s, "."), ".") {
+		n, err := strconv.Atoi(arc)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid arc %q", arc)
+		}
+		oid = append(oid, n)
+	}
+	if len(oid) < 2 {
+		return nil, fmt.Errorf("too few arcs")
+	}
+	return oid, nil
+}
+
+// uint32Bytes returns the minimal content octets of the unsigned n.
+func uint32Bytes(n uint32) []byte {
+	b := []byte{byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)}
+	for len(b) > 1 && b[0] == 0 && b[1] < 0x80 {
+		b = b[1:]
+	}
+	if b[0] >= 0x80 {
+		b = append([]byte{0}, b...)
+	}
+	return b
+}
@@ -0,0 +1,104 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"scepclient/scepserver/webhook"
+)
+
+// WebhookPayload is the JSON body posted by Webhook.
+type WebhookPayload struct {
+	Event    Kind      `json:"event"`
+	Time     time.Time `json:"time"`
+	Identity string    `json:"identity"`
+	Message  string    `json:"message"`
+	Error    string    `json:"error,omitempty"`
+
+	// Certificate describes the current certificate, if there is one.
+	Certificate *WebhookCertificate `json:"certificate,omitempty"`
+}
+
+// WebhookCertificate describes a certificate in a WebhookPayload.
+type WebhookCertificate struct {
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	Serial    string    `json:"serial"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+}
+
+// Webhook posts events as JSON, see WebhookPayload.
+type Webhook struct {
+	URL string
+
+	// Secret, if set, signs the requests in the header X-SCEP-Signature,
+	// as the approval webhook of the server does.
+	Secret []byte
+
+	// Client sends the requests.
+	// http.DefaultClient is used if it is nil.
+	Client *http.Client
+}
+
+// Notify implements Notifier. Responses other than 2xx fail.
+func (w *Webhook) Notify(ctx context.Context, e Event) error {
+	payload := WebhookPayload{Event: e.Kind, Time: e.Time, Identity: e.Identity, Message: e.Message()}
+	if e.Err != nil {
+		payload.Error = e.Err.Error()
+	}
+	if c := e.Certificate; c != nil {
+		payload.Certificate = &WebhookCertificate{
+			Subject:   c.Subject.String(),
+			Issuer:    c.Issuer.String(),
+			Serial:    c.SerialNumber.Text(16),
+			NotBefore: c.NotBefore,
+			NotAfter:  c.NotAfter,
+		}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	header := make(http.Header)
+	if len(w.Secret) > 0 {
+		header.Set(webhook.SignatureHeader, webhook.Sign(w.Secret, body))
+	}
+	if err := postJSON(ctx, w.Client, w.URL, header, body); err != nil {
+		return fmt.Errorf("notify: webhook: %w", err)
+	}
+	return nil
+}
+
+// postJSON posts body to url with client, http.DefaultClient if nil,
+// and fails on responses other than 2xx.
+func postJSON(ctx context.Context, client *http.Client, url string, header http.Header, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode/100 != 2 {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package scepclient
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"scepclient/clock"
+)
+
+// ErrPollTimeout is returned by PollPolicy.Wait once a request
+// has been pending for longer than the policy allows.
+var ErrPollTimeout = errors.New("scepclient: request still pending")
+
+// PollPolicy configures how often a PENDING request is polled,
+// while it waits for manual approval by the CA.
+type PollPolicy struct {
+	// Interval is the delay before the first poll. It doubles with
+	// every poll, up to MaxInterval. If MaxInterval is zero or less
+	// than Interval, the interval is fixed.
+	Interval    time.Duration
+	MaxInterval time.Duration
+
+	// MaxWait is the total time to poll before giving up.
+	// Zero polls forever.
+	MaxWait time.Duration
+
+	// Clock is used to wait between polls.
+	// The system clock is used if it is nil.
+	Clock clock.Clock
+}
+
+// DefaultPollPolicy polls every 30 seconds, without giving up.
+var DefaultPollPolicy = PollPolicy{Interval: 30 * time.Second}
+
+// Delay returns the delay before the given poll, counted from zero.
+func (p PollPolicy) Delay(poll int) time.Duration {
+	if p.MaxInterval <= p.Interval {
+		return p.Interval
+	}
+	d := p.Interval << uint(poll)
+	if d <= 0 || d > p.MaxInterval {
+		d = p.MaxInterval
+	}
+	return d
+}
+
+// Wait sleeps before the given poll of a request which first
+// became pending at start. It fails with ErrPollTimeout if the
+// poll would happen later than MaxWait after start, and with
+// ctx.Err() if ctx is done first.
+func (p PollPolicy) Wait(ctx context.Context, start time.Time, poll int) error {
+	c := clock.Or(p.Clock)
+	d := p.Delay(poll)
+	if p.MaxWait > 0 && c.Now().Add(d).Sub(start) > p.MaxWait {
+		return ErrPollTimeout
+	}
+	return c.Sleep(ctx, d)
+}
@@ -0,0 +1,88 @@
+package scepclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"scepclient/scep"
+	"scepclient/scepserver"
+)
+
+// ProbeResult describes a SCEP endpoint, to validate
+// a SCEP configuration before enrolling.
+type ProbeResult struct {
+	// Reachable is true if the server answered, even with an error.
+	Reachable bool
+
+	// Latency is the duration of the GetCACaps request.
+	Latency time.Duration
+
+	Capabilities []string
+
+	// CACerts are the certificates returned by GetCACert, and
+	// CAFingerprints their hex encoded SHA-256 fingerprints.
+	CACerts        []*x509.Certificate
+	CAFingerprints []string
+}
+
+// ProbeService probes svc with GetCACaps and GetCACert. It returns
+// what was learned about the endpoint even if a request failed, along
+// with the error.
+func ProbeService(ctx context.Context, svc scepserver.Service) (ProbeResult, error) {
+	var result ProbeResult
+
+	start := time.Now()
+	caps, err := svc.GetCACaps(ctx)
+	result.Latency = time.Since(start)
+	result.Reachable = err == nil || isHTTPError(err)
+	if err != nil {
+		return result, err
+	}
+	for _, line := range strings.Split(string(caps), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			result.Capabilities = append(result.Capabilities, line)
+		}
+	}
+
+	data, num, err := svc.GetCACert(ctx)
+	if err != nil {
+		return result, err
+	}
+	if num > 1 {
+		err = scep.ReadCACerts(bytes.NewReader(data), func(cert *x509.Certificate) error {
+			result.CACerts = append(result.CACerts, cert)
+			return nil
+		})
+	} else {
+		result.CACerts, err = x509.ParseCertificates(data)
+	}
+	if err != nil {
+		return result, err
+	}
+	for _, cert := range result.CACerts {
+		sum := sha256.Sum256(cert.Raw)
+		result.CAFingerprints = append(result.CAFingerprints, hex.EncodeToString(sum[:]))
+	}
+	return result, nil
+}
+
+func isHTTPError(err error) bool {
+	var httpErr *scepserver.HTTPError
+	return errors.As(err, &httpErr)
+}
+
+// client adds the methods of Client which
+// scepserver.Endpoints does not implement.
+type client struct {
+	*scepserver.Endpoints
+}
+
+func (c client) Probe(ctx context.Context) (ProbeResult, error) {
+	return ProbeService(ctx, c)
+}
@@ -0,0 +1,118 @@
+package scepclient
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"scepclient/scepserver"
+)
+
+// ServerProfile describes the quirks of a hosted SCEP gateway, so that
+// it can be used by name rather than by reverse engineering its URLs.
+type ServerProfile struct {
+	// Path completes the server URLs without path, and {id} in it is
+	// replaced by the ID of the tenant or SCEP profile on the gateway.
+	Path string
+
+	// DefaultID replaces {id} in Path if no ID is given.
+	DefaultID string
+
+	// APIKeyHeader is the header of the API key of the gateway, if it
+	// authenticates the requests with one on top of the challenge.
+	APIKeyHeader string
+
+	// Retries is the number of retries of the requests failing with
+	// transient errors, for gateways which are slow to start.
+	Retries int
+
+	// IssuingCARecipient encrypts the requests to the issuing CA of the
+	// chain returned by GetCACert, see IssuingCARecipients.
+	IssuingCARecipient bool
+
+	// StandardBase64 encodes the message of GET requests in standard
+	// base64, see scepserver.WithStandardBase64.
+	StandardBase64 bool
+
+	// StickyFailures is set for gateways which answer every request of
+	// a transaction, identified by the public key, with the first
+	// answer: after a FAILURE, requesting again needs a new key.
+	StickyFailures bool
+}
+
+// ServerProfiles are the profiles of the known hosted SCEP gateways.
+var ServerProfiles = map[string]ServerProfile{
+	// SCEPman runs in an Azure App Service, which answers with 503
+	// while it starts; its endpoint for other MDMs than Intune is
+	// the one of static challenges.
+	"scepman": {
+		Path:    "/static",
+		Retries: 5,
+	},
+	// Sectigo Certificate Manager serves every SCEP profile of a
+	// customer at its own path, and its chains start with the root.
+	"sectigo": {
+		Path:               "/scep/{id}",
+		IssuingCARecipient: true,
+	},
+	// step-ca serves every SCEP provisioner at its name, over HTTPS
+	// with its own root, see StepCARoot.
+	"stepca": {
+		Path:               "/scep/{id}",
+		IssuingCARecipient: true,
+	},
+	// OpenXPKI serves every SCEP endpoint at its name, generic by
+	// default, and binds the transaction ID of the key to the
+	// workflow of its first request, approved or not.
+	"openxpki": {
+		Path:           "/scep/{id}",
+		DefaultID:      "generic",
+		StandardBase64: true,
+		StickyFailures: true,
+	},
+	// DigiCert Trust Lifecycle Manager serves the SCEP profiles at the
+	// API of DigiCert ONE, which authenticates with an API key.
+	"digicert": {
+		Path:         "/mpki/api/v1/scep/{id}",
+		APIKeyHeader: "X-API-Key",
+	},
+}
+
+// ServerProfileNames returns the sorted names of ServerProfiles.
+func ServerProfileNames() []string {
+	names := make([]string, 0, len(ServerProfiles))
+	for name := range ServerProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// URL completes serverURL with the path of p and the ID of the tenant
+// or SCEP profile id. URLs with a path are returned unchanged.
+func (p ServerProfile) URL(serverURL, id string) (string, error) {
+	u, err := scepserver.ParseServerURL(serverURL)
+	if err != nil {
+		return "", err
+	}
+	if strings.Trim(u.Path, "/") != "" || p.Path == "" {
+		return serverURL, nil
+	}
+	if id == "" {
+		id = p.DefaultID
+	}
+	if strings.Contains(p.Path, "{id}") && id == "" {
+		return "", fmt.Errorf("scepclient: the URL of the gateway needs the ID of its profile")
+	}
+	u.Path, u.RawPath = strings.ReplaceAll(p.Path, "{id}", id), ""
+	return u.String(), nil
+}
+
+// Options returns the options of the client adapting it to p.
+func (p ServerProfile) Options() []Option {
+	var opts []Option
+	if p.StandardBase64 {
+		opts = append(opts, WithHTTPOptions(scepserver.WithStandardBase64()))
+	}
+	return opts
+}
@@ -0,0 +1,143 @@
+package scepclient_test
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	scepclient "scepclient/client"
+	"scepclient/scep"
+	"scepclient/scepserver"
+	"scepclient/scepserver/scepservertest"
+)
+
+func TestServerProfileURL(t *testing.T) {
+	for _, tt := range []struct {
+		profile, url, id, want string
+	}{
+		{"scepman", "https://scepman.example.azurewebsites.net", "", "https://scepman.example.azurewebsites.net/static"},
+		{"scepman", "https://scepman.example.com/certsrv/mscep/mscep.dll", "", "https://scepman.example.com/certsrv/mscep/mscep.dll"},
+		{"sectigo", "https://scep.example.com/", "acme-wifi", "https://scep.example.com/scep/acme-wifi"},
+		{"digicert", "one.digicert.com", "IOT-1234", "http://one.digicert.com/mpki/api/v1/scep/IOT-1234"},
+		{"openxpki", "https://pki.example.com", "", "https://pki.example.com/scep/generic"},
+		{"openxpki", "https://pki.example.com", "devices", "https://pki.example.com/scep/devices"},
+	} {
+		got, err := scepclient.ServerProfiles[tt.profile].URL(tt.url, tt.id)
+		if err != nil || got != tt.want {
+			t.Errorf("%s: URL(%q, %q) = %q, %v, expected %q", tt.profile, tt.url, tt.id, got, err, tt.want)
+		}
+	}
+	if _, err := scepclient.ServerProfiles["digicert"].URL("https://one.digicert.com", ""); err == nil {
+		t.Error("expected a URL without the ID of the profile to fail")
+	}
+	if names := scepclient.ServerProfileNames(); len(names) != 5 || names[0] != "digicert" {
+		t.Errorf("unexpected profile names %v", names)
+	}
+}
+
+// openXPKI imitates the SCEP endpoint of OpenXPKI in front of next: it
+// decodes the message of GET requests as standard base64, and answers
+// the requests of a transaction which failed with the same failure.
+func openXPKI(next http.Handler) http.Handler {
+	var mtx sync.Mutex
+	failures := make(map[scep.TransactionID][]byte)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("operation") != "PKIOperation" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		data, err := base64.StdEncoding.DecodeString(r.URL.Query().Get("message"))
+		if err != nil {
+			http.Error(w, "bad message", http.StatusBadRequest)
+			return
+		}
+		msg, err := scep.ParsePKIMessage(data)
+		if err != nil {
+			http.Error(w, "bad message", http.StatusBadRequest)
+			return
+		}
+		mtx.Lock()
+		failure, ok := failures[msg.TransactionID]
+		mtx.Unlock()
+		if ok {
+			w.Header().Set("Content-Type", "application/x-pki-message")
+			w.Write(failure)
+			return
+		}
+		rec := httptest.NewRecorder()
+		next.ServeHTTP(rec, r)
+		if resp, err := scep.ParsePKIMessage(rec.Body.Bytes()); err == nil && resp.PKIStatus == scep.FAILURE {
+			mtx.Lock()
+			failures[msg.TransactionID] = rec.Body.Bytes()
+			mtx.Unlock()
+		}
+		for k, v := range rec.Header() {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(rec.Code)
+		w.Write(rec.Body.Bytes())
+	})
+}
+
+func TestOpenXPKIProfile(t *testing.T) {
+	svc, err := scepservertest.New(
+		scepservertest.WithCapabilities("SHA-256", "AES"),
+		scepservertest.WithStatuses(scep.PENDING, scep.SUCCESS, scep.FAILURE),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(openXPKI(scepserver.NewHTTPHandler(svc)))
+	defer srv.Close()
+
+	profile := scepclient.ServerProfiles["openxpki"]
+	client, err := scepclient.New(srv.URL, nil, profile.Options()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	status := func(msg *scep.PKIMessage) scep.PKIStatus {
+		t.Helper()
+		data, err := client.PKIOperation(ctx, msg.Raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := scep.ParsePKIMessage(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.PKIStatus
+	}
+	recipients := []*x509.Certificate{svc.CACert()}
+
+	// a pending request is approved by resending it in its transaction
+	msg, _, _ := newPKCSReq(t, recipients, "device", "secret")
+	if got := status(msg); got != scep.PENDING {
+		t.Fatalf("expected PENDING, got %s", got)
+	}
+	if got := status(msg); got != scep.SUCCESS {
+		t.Fatalf("expected SUCCESS, got %s", got)
+	}
+	if reqs := svc.Requests(); len(reqs) != 2 || reqs[0].TransactionID != reqs[1].TransactionID {
+		t.Error("expected the requests to share their transaction ID")
+	}
+
+	// a failed transaction fails for good, a new key starts another
+	msg, _, _ = newPKCSReq(t, recipients, "device", "secret")
+	for i := 0; i < 2; i++ {
+		if got := status(msg); got != scep.FAILURE {
+			t.Fatalf("expected FAILURE, got %s", got)
+		}
+	}
+	if len(svc.Requests()) != 3 {
+		t.Error("expected the failure to be answered by the endpoint")
+	}
+	msg, _, _ = newPKCSReq(t, recipients, "device", "secret")
+	if got := status(msg); got != scep.SUCCESS {
+		t.Fatalf("expected SUCCESS, got %s", got)
+	}
+}
@@ -0,0 +1,56 @@
+package scepclient
+
+import (
+	"crypto/md5"
+	"crypto/x509"
+	"fmt"
+	"strings"
+)
+
+// Recipients returns the certificate to encrypt PKIOperation messages
+// to, out of the certificates returned by GetCACert. Servers with an RA,
+// such as NDES, send its certificates along with the CA: the RA
+// encryption certificate is preferred, then any RA certificate. Other
+// servers list the certificate they decrypt with first, followed by
+// its chain if they serve one.
+func Recipients(certs []*x509.Certificate) []*x509.Certificate {
+	var ra *x509.Certificate
+	for _, crt := range certs {
+		if crt.IsCA {
+			continue
+		}
+		if crt.KeyUsage&x509.KeyUsageKeyEncipherment != 0 {
+			return []*x509.Certificate{crt}
+		}
+		if ra == nil {
+			ra = crt
+		}
+	}
+	if ra != nil {
+		return []*x509.Certificate{ra}
+	}
+	if len(certs) == 0 {
+		return nil
+	}
+	return certs[:1]
+}
+
+// FingerprintRecipients returns the certificates to encrypt PKIOperation
+// messages to, out of the certificates returned by GetCACert, for the
+// MD5 fingerprint of one of them, in hex, spaces ignored. NDES lists
+// its CA after its RA encryption certificate: given the fingerprint of
+// the CA, the RA certificate before it and the rest of the list are
+// returned. Given the fingerprint of the first certificate, all are.
+func FingerprintRecipients(fingerprint string, certs []*x509.Certificate) ([]*x509.Certificate, error) {
+	fingerprint = strings.ToLower(strings.ReplaceAll(fingerprint, " ", ""))
+	for i, cert := range certs {
+		if fmt.Sprintf("%x", md5.Sum(cert.Raw)) != fingerprint {
+			continue
+		}
+		if i == 0 {
+			return certs, nil
+		}
+		return certs[i-1:], nil
+	}
+	return nil, fmt.Errorf("could not find cert for md5 %s", fingerprint)
+}
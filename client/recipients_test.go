@@ -0,0 +1,126 @@
+package scepclient_test
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	scepclient "scepclient/client"
+	"scepclient/scep"
+	"scepclient/scepserver/depot"
+)
+
+func TestRecipients(t *testing.T) {
+	cert := func(name string, isCA bool, usage x509.KeyUsage) *x509.Certificate {
+		return &x509.Certificate{Subject: pkix.Name{CommonName: name}, IsCA: isCA, KeyUsage: usage}
+	}
+	ca := cert("CA", true, x509.KeyUsageCertSign)
+	raSign := cert("RA signature", false, x509.KeyUsageDigitalSignature)
+	raEnc := cert("RA encryption", false, x509.KeyUsageKeyEncipherment)
+	issuing := cert("issuing CA", true, x509.KeyUsageCertSign)
+
+	tests := []struct {
+		name  string
+		certs []*x509.Certificate
+		want  string
+	}{
+		{"CA only", []*x509.Certificate{ca}, "CA"},
+		{"NDES", []*x509.Certificate{ca, raSign, raEnc}, "RA encryption"},
+		{"single RA", []*x509.Certificate{ca, raSign}, "RA signature"},
+		{"CA chain", []*x509.Certificate{issuing, ca}, "issuing CA"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := scepclient.Recipients(tt.certs)
+			if len(got) != 1 || got[0].Subject.CommonName != tt.want {
+				t.Errorf("expected %s, got %v", tt.want, got)
+			}
+		})
+	}
+	if got := scepclient.Recipients(nil); got != nil {
+		t.Errorf("expected no recipients, got %v", got)
+	}
+}
+
+// ndesCerts returns the certificates of GetCACert of NDES: its RA
+// signature and encryption certificates, issued by the CA, and the CA.
+// The key of the RA encryption certificate is returned too.
+func ndesCerts(t *testing.T) (sign, enc, ca *x509.Certificate, encKey *rsa.PrivateKey) {
+	t.Helper()
+	ca, caKey, err := depot.GenerateCA(pkix.Name{CommonName: "CA"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issue := func(cn string, usage x509.KeyUsage) (*x509.Certificate, *rsa.PrivateKey) {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+			SerialNumber: big.NewInt(time.Now().UnixNano()),
+			Subject:      pkix.Name{CommonName: cn},
+			NotBefore:    time.Now(),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     usage,
+		}, ca, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert, key
+	}
+	sign, _ = issue("NDES-MSCEP-RA signature", x509.KeyUsageDigitalSignature)
+	enc, encKey = issue("NDES-MSCEP-RA encryption", x509.KeyUsageKeyEncipherment|x509.KeyUsageDataEncipherment)
+	return sign, enc, ca, encKey
+}
+
+func TestRecipientsNDES(t *testing.T) {
+	sign, enc, ca, encKey := ndesCerts(t)
+	// NDES lists the RA certificates before the CA, other servers after
+	for _, certs := range [][]*x509.Certificate{{sign, enc, ca}, {ca, sign, enc}, {enc, sign, ca}} {
+		got := scepclient.Recipients(certs)
+		if len(got) != 1 || got[0] != enc {
+			t.Fatalf("expected the RA encryption certificate, got %v", got)
+		}
+		// the RA decrypts the requests encrypted to it
+		msg, _, _ := newPKCSReq(t, got, "device", "secret")
+		parsed, err := scep.ParsePKIMessage(msg.Raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := parsed.DecryptPKIEnvelope(enc, encKey); err != nil {
+			t.Errorf("expected the RA to decrypt the request, got %v", err)
+		}
+	}
+}
+
+func TestFingerprintRecipients(t *testing.T) {
+	sign, enc, ca, _ := ndesCerts(t)
+	certs := []*x509.Certificate{sign, enc, ca}
+	fingerprint := func(cert *x509.Certificate) string {
+		return fmt.Sprintf("% X", md5.Sum(cert.Raw))
+	}
+
+	got, err := scepclient.FingerprintRecipients(fingerprint(ca), certs)
+	if err != nil || len(got) != 2 || got[0] != enc || got[1] != ca {
+		t.Errorf("expected the RA encryption certificate and the CA, got %v, %v", got, err)
+	}
+	// the first certificate has none before it
+	got, err = scepclient.FingerprintRecipients(strings.ToLower(fingerprint(sign)), certs)
+	if err != nil || len(got) != 3 {
+		t.Errorf("expected all certificates, got %v, %v", got, err)
+	}
+	if _, err := scepclient.FingerprintRecipients("00", certs); err == nil {
+		t.Error("expected an unknown fingerprint to fail")
+	}
+}
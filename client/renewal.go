@@ -0,0 +1,71 @@
+package scepclient
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"time"
+
+	"scepclient/clock"
+)
+
+// Errors returned by CheckValidity.
+var (
+	ErrNotYetValid = errors.New("scepclient: certificate is not yet valid")
+	ErrExpired     = errors.New("scepclient: certificate has expired")
+)
+
+// CheckValidity checks that the current time of c, or of the
+// system clock if c is nil, lies within the validity period of cert.
+func CheckValidity(cert *x509.Certificate, c clock.Clock) error {
+	now := clock.Or(c).Now()
+	if now.Before(cert.NotBefore) {
+		return fmt.Errorf("%w: valid from %s", ErrNotYetValid, cert.NotBefore.UTC().Format(time.RFC3339))
+	}
+	if now.After(cert.NotAfter) {
+		return fmt.Errorf("%w: expired on %s", ErrExpired, cert.NotAfter.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// RenewalPolicy decides when a certificate is due for renewal.
+// If both Before and Fraction are set, the earlier time applies.
+type RenewalPolicy struct {
+	// Before renews certificates this long before they expire.
+	Before time.Duration
+
+	// Fraction renews certificates once this fraction of
+	// their validity period has elapsed, for example 2/3.
+	Fraction float64
+
+	// Clock tells the current time for Due.
+	// The system clock is used if it is nil.
+	Clock clock.Clock
+}
+
+// DefaultRenewalPolicy renews certificates after two thirds of
+// their validity period.
+var DefaultRenewalPolicy = RenewalPolicy{Fraction: 2.0 / 3}
+
+// RenewAt returns the time at which cert is due for renewal.
+// Without Before and Fraction, it is the expiry of cert.
+func (p RenewalPolicy) RenewAt(cert *x509.Certificate) time.Time {
+	at := cert.NotAfter
+	if p.Before > 0 {
+		if t := cert.NotAfter.Add(-p.Before); t.Before(at) {
+			at = t
+		}
+	}
+	if p.Fraction > 0 {
+		lifetime := cert.NotAfter.Sub(cert.NotBefore)
+		if t := cert.NotBefore.Add(time.Duration(float64(lifetime) * p.Fraction)); t.Before(at) {
+			at = t
+		}
+	}
+	return at
+}
+
+// Due reports whether cert is due for renewal.
+func (p RenewalPolicy) Due(cert *x509.Certificate) bool {
+	return !clock.Or(p.Clock).Now().Before(p.RenewAt(cert))
+}
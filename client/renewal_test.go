@@ -0,0 +1,98 @@
+package scepclient_test
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"testing"
+	"time"
+
+	scepclient "scepclient/client"
+	"scepclient/clock"
+)
+
+func TestRenewalPolicy(t *testing.T) {
+	notBefore := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	cert := &x509.Certificate{NotBefore: notBefore, NotAfter: notBefore.Add(90 * 24 * time.Hour)}
+	clk := clock.NewFake(notBefore)
+
+	tests := []struct {
+		name   string
+		policy scepclient.RenewalPolicy
+		want   time.Time
+	}{
+		{"at expiry", scepclient.RenewalPolicy{}, cert.NotAfter},
+		{"before expiry", scepclient.RenewalPolicy{Before: 30 * 24 * time.Hour}, notBefore.Add(60 * 24 * time.Hour)},
+		{"fraction", scepclient.RenewalPolicy{Fraction: 0.5}, notBefore.Add(45 * 24 * time.Hour)},
+		{"earlier of both", scepclient.RenewalPolicy{Before: 10 * 24 * time.Hour, Fraction: 0.5}, notBefore.Add(45 * 24 * time.Hour)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.policy.Clock = clk
+			if got := tt.policy.RenewAt(cert); !got.Equal(tt.want) {
+				t.Errorf("expected renewal at %s, got %s", tt.want, got)
+			}
+			clk.Set(tt.want.Add(-time.Second))
+			if tt.policy.Due(cert) {
+				t.Error("expected renewal not to be due yet")
+			}
+			clk.Set(tt.want)
+			if !tt.policy.Due(cert) {
+				t.Error("expected renewal to be due")
+			}
+		})
+	}
+}
+
+func TestCheckValidity(t *testing.T) {
+	notBefore := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	cert := &x509.Certificate{NotBefore: notBefore, NotAfter: notBefore.Add(24 * time.Hour)}
+
+	clk := clock.NewFake(notBefore.Add(-time.Minute))
+	if err := scepclient.CheckValidity(cert, clk); !errors.Is(err, scepclient.ErrNotYetValid) {
+		t.Errorf("expected ErrNotYetValid, got %v", err)
+	}
+	clk.Advance(time.Hour)
+	if err := scepclient.CheckValidity(cert, clk); err != nil {
+		t.Errorf("expected valid certificate, got %v", err)
+	}
+	clk.Advance(24 * time.Hour)
+	if err := scepclient.CheckValidity(cert, clk); !errors.Is(err, scepclient.ErrExpired) {
+		t.Errorf("expected ErrExpired, got %v", err)
+	}
+}
+
+func TestPollPolicy(t *testing.T) {
+	clk := clock.NewAutoFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	policy := scepclient.PollPolicy{
+		Interval:    time.Minute,
+		MaxInterval: 10 * time.Minute,
+		MaxWait:     time.Hour,
+		Clock:       clk,
+	}
+
+	start := clk.Now()
+	var delays []time.Duration
+	var err error
+	for poll := 0; err == nil; poll++ {
+		before := clk.Now()
+		if err = policy.Wait(context.Background(), start, poll); err == nil {
+			delays = append(delays, clk.Now().Sub(before))
+		}
+	}
+	if !errors.Is(err, scepclient.ErrPollTimeout) {
+		t.Fatalf("expected ErrPollTimeout, got %v", err)
+	}
+	want := []time.Duration{1, 2, 4, 8, 10, 10, 10, 10}
+	if len(delays) != len(want) {
+		t.Fatalf("expected %d polls, got %v", len(want), delays)
+	}
+	for i := range want {
+		if delays[i] != want[i]*time.Minute {
+			t.Fatalf("expected delays %v minutes, got %v", want, delays)
+		}
+	}
+	if waited := clk.Now().Sub(start); waited > policy.MaxWait {
+		t.Errorf("waited %s, longer than MaxWait", waited)
+	}
+}
@@ -0,0 +1,107 @@
+// Package scepclienttest provides a scripted fake SCEP client, so that
+// applications embedding package scepclient can be unit tested without
+// a live CA.
+package scepclienttest
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"io"
+	"io/ioutil"
+
+	scepclient "scepclient/client"
+	"scepclient/scep"
+	"scepclient/scepserver/scepservertest"
+)
+
+var _ scepclient.Client = (*Client)(nil)
+
+// Client is a fake scepclient.Client backed by an ephemeral CA.
+// PKIOperation requests are answered with the scripted pkiStatus
+// sequence, and issued certificates are signed by the CA.
+// It is safe for concurrent use.
+//
+// It calls a scepservertest.Service directly. To test the HTTP
+// transport as well, use a scepservertest.Server instead.
+type Client struct {
+	*scepservertest.Service
+	opts []scepservertest.Option
+}
+
+// Option configures the fake Client.
+type Option func(*Client)
+
+// WithCA uses the provided CA certificate and key instead of generating them.
+func WithCA(cert *x509.Certificate, key *rsa.PrivateKey) Option {
+	return func(c *Client) {
+		c.opts = append(c.opts, scepservertest.WithCA(cert, key))
+	}
+}
+
+// WithCapabilities sets the capabilities returned by GetCACaps.
+func WithCapabilities(caps ...string) Option {
+	return func(c *Client) {
+		c.opts = append(c.opts, scepservertest.WithCapabilities(caps...))
+	}
+}
+
+// WithStatuses scripts the pkiStatus of the responses to successive
+// PKIOperation requests. Once the script is exhausted, every request
+// succeeds.
+func WithStatuses(statuses ...scep.PKIStatus) Option {
+	return func(c *Client) {
+		c.opts = append(c.opts, scepservertest.WithStatuses(statuses...))
+	}
+}
+
+// WithFailInfo sets the failInfo returned with a FAILURE pkiStatus.
+// BadRequest is used by default.
+func WithFailInfo(info scep.FailInfo) Option {
+	return func(c *Client) {
+		c.opts = append(c.opts, scepservertest.WithFailInfo(info))
+	}
+}
+
+// New creates a fake Client. Unless WithCA is used, a new
+// CA certificate and key are generated.
+func New(opts ...Option) (*Client, error) {
+	c := &Client{}
+	for _, opt := range opts {
+		opt(c)
+	}
+	svc, err := scepservertest.New(c.opts...)
+	if err != nil {
+		return nil, err
+	}
+	c.Service = svc
+	return c, nil
+}
+
+// NewCA generates a self-signed CA certificate and key,
+// suitable for signing CertRep messages.
+func NewCA() (*x509.Certificate, *rsa.PrivateKey, error) {
+	return scepservertest.NewCA()
+}
+
+// Supports reports whether cap is one of the configured capabilities.
+func (c *Client) Supports(cap string) bool {
+	caps, _ := c.GetCACaps(context.Background())
+	return bytes.Contains(caps, []byte(cap))
+}
+
+// GetCACertReader returns a reader for the DER encoded
+// certificate of the fake CA.
+func (c *Client) GetCACertReader(ctx context.Context) (io.ReadCloser, int, error) {
+	data, num, err := c.GetCACert(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), num, nil
+}
+
+// Probe probes the fake CA, which is always reachable.
+func (c *Client) Probe(ctx context.Context) (scepclient.ProbeResult, error) {
+	return scepclient.ProbeService(ctx, c)
+}
@@ -0,0 +1,124 @@
+package scepclienttest_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"scepclient/client/scepclienttest"
+	"scepclient/scep"
+)
+
+func TestPKIOperationScriptedStatuses(t *testing.T) {
+	client, err := scepclienttest.New(
+		scepclienttest.WithStatuses(scep.PENDING, scep.FAILURE),
+		scepclienttest.WithFailInfo(scep.BadTime),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := selfSigned(t, key)
+	csr := newCSR(t, key)
+
+	want := []scep.PKIStatus{scep.PENDING, scep.FAILURE, scep.SUCCESS}
+	for i, status := range want {
+		msg, err := scep.NewCSRRequest(csr, &scep.PKIMessage{
+			MessageType: scep.PKCSReq,
+			Recipients:  []*x509.Certificate{client.CACert()},
+			SignerKey:   key,
+			SignerCert:  signer,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		respBytes, err := client.PKIOperation(context.Background(), msg.Raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := scep.ParsePKIMessage(respBytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.PKIStatus != status {
+			t.Fatalf("request %d: expected pkiStatus %s, got %s", i, status, resp.PKIStatus)
+		}
+		switch status {
+		case scep.FAILURE:
+			if resp.FailInfo != scep.BadTime {
+				t.Errorf("expected failInfo %s, got %s", scep.BadTime, resp.FailInfo)
+			}
+		case scep.SUCCESS:
+			if err := resp.DecryptPKIEnvelope(signer, key); err != nil {
+				t.Fatal(err)
+			}
+			cert := resp.CertRepMessage.Certificate
+			if cert.Subject.CommonName != "scepclienttest" {
+				t.Errorf("unexpected subject %s", cert.Subject)
+			}
+			if err := cert.CheckSignatureFrom(client.CACert()); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+	if n := len(client.Requests()); n != len(want) {
+		t.Errorf("expected %d recorded requests, got %d", len(want), n)
+	}
+}
+
+func newCSR(t *testing.T, key *rsa.PrivateKey) *x509.CertificateRequest {
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: "scepclienttest"},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return csr
+}
+
+func selfSigned(t *testing.T, key *rsa.PrivateKey) *x509.Certificate {
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "SCEP SIGNER"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestProbe(t *testing.T) {
+	client, err := scepclienttest.New(scepclienttest.WithCapabilities("POSTPKIOperation", "SHA-256"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := client.Probe(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Reachable || len(result.Capabilities) != 2 {
+		t.Errorf("unexpected result %+v", result)
+	}
+	if len(result.CACerts) != 1 || !result.CACerts[0].Equal(client.CACert()) || len(result.CAFingerprints) != 1 {
+		t.Errorf("expected the CA certificate and its fingerprint, got %+v", result)
+	}
+}
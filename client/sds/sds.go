@@ -0,0 +1,450 @@
+// Package sds serves certificates to Envoy over its Secret Discovery
+// Service, so that Envoy proxies and Istio gateways pick up certificates
+// issued over SCEP, and their renewals, without watching files.
+//
+// It implements the StreamSecrets and FetchSecrets methods of the gRPC
+// service envoy.service.secret.v3.SecretDiscoveryService on the HTTP/2
+// server of net/http, encoding the few messages it needs with protowire,
+// without the gRPC and Envoy libraries. Envoy connects to it without
+// TLS, over a Unix socket or TCP, as a cluster with HTTP/2 enabled:
+//
+//	clusters:
+//	- name: sds
+//	  typed_extension_protocol_options:
+//	    envoy.extensions.upstreams.http.v3.HttpProtocolOptions:
+//	      "@type": type.googleapis.com/envoy.extensions.upstreams.http.v3.HttpProtocolOptions
+//	      explicit_http_config: {http2_protocol_options: {}}
+//	  load_assignment:
+//	    cluster_name: sds
+//	    endpoints:
+//	    - lb_endpoints:
+//	      - endpoint: {address: {pipe: {path: /run/scepclient/sds.sock}}}
+//
+// and refers to the secrets by name in sds_config of its TLS contexts,
+// with an api_config_source of api_type GRPC and a grpc_service of the
+// envoy_grpc cluster_name sds.
+package sds
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// SecretType is the type URL of the secrets served.
+const SecretType = "type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.Secret"
+
+// The paths of the methods of the SecretDiscoveryService.
+const (
+	streamPath = "/envoy.service.secret.v3.SecretDiscoveryService/StreamSecrets"
+	fetchPath  = "/envoy.service.secret.v3.SecretDiscoveryService/FetchSecrets"
+)
+
+// maxMessageSize limits the size of the requests, as does gRPC.
+const maxMessageSize = 4 << 20
+
+// The gRPC status codes answered with.
+const (
+	codeOK              = 0
+	codeInvalidArgument = 3
+	codeNotFound        = 5
+	codeUnimplemented   = 12
+	codeInternal        = 13
+)
+
+// Server serves secrets over SDS, pushing their changes to the streams
+// of Envoy. It is safe for concurrent use.
+type Server struct {
+	// Logger logs the streams and the secrets rejected by Envoy.
+	// slog.Default() is used if it is nil.
+	Logger *slog.Logger
+
+	mu      sync.Mutex
+	secrets map[string]secret
+	version int // of the last change
+	nonce   int
+	changed chan struct{} // closed on the next change
+}
+
+// secret is an encoded Secret message, and the version of the server
+// at which it last changed.
+type secret struct {
+	data    []byte
+	version int
+}
+
+// SetCertificate serves the PEM encoded certificate chain and key as
+// the TLS certificate secret name, and pushes it to the streams
+// subscribed to it.
+func (s *Server) SetCertificate(name string, chain, key []byte) {
+	var tls []byte
+	tls = protowire.AppendTag(tls, 1, protowire.BytesType) // certificate_chain
+	tls = protowire.AppendBytes(tls, dataSource(chain))
+	tls = protowire.AppendTag(tls, 2, protowire.BytesType) // private_key
+	tls = protowire.AppendBytes(tls, dataSource(key))
+	s.set(name, 2, tls) // tls_certificate
+}
+
+// SetValidationContext serves the PEM encoded CA certificates ca as the
+// validation context secret name, verifying peers, and pushes it to the
+// streams subscribed to it.
+func (s *Server) SetValidationContext(name string, ca []byte) {
+	var validation []byte
+	validation = protowire.AppendTag(validation, 1, protowire.BytesType) // trusted_ca
+	validation = protowire.AppendBytes(validation, dataSource(ca))
+	s.set(name, 4, validation) // validation_context
+}
+
+// set sets the secret name to a Secret with the message value as the
+// field num.
+func (s *Server) set(name string, num protowire.Number, value []byte) {
+	var data []byte
+	data = protowire.AppendTag(data, 1, protowire.BytesType) // name
+	data = protowire.AppendString(data, name)
+	data = protowire.AppendTag(data, num, protowire.BytesType)
+	data = protowire.AppendBytes(data, value)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.secrets == nil {
+		s.secrets = make(map[string]secret)
+	}
+	// unchanged secrets, as the CA certificates of most renewals,
+	// are not pushed again
+	if bytes.Equal(s.secrets[name].data, data) {
+		return
+	}
+	s.version++
+	s.secrets[name] = secret{data: data, version: s.version}
+	if s.changed != nil {
+		close(s.changed)
+		s.changed = nil
+	}
+}
+
+// dataSource returns a DataSource of the inline bytes data.
+func dataSource(data []byte) []byte {
+	var b []byte
+	b = protowire.AppendTag(b, 2, protowire.BytesType) // inline_bytes
+	return protowire.AppendBytes(b, data)
+}
+
+// Serve serves SDS over HTTP/2 without TLS on ln until ctx is done.
+func (s *Server) Serve(ctx context.Context, ln net.Listener) error {
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	srv := &http.Server{Handler: s, Protocols: &protocols, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// ServeHTTP answers the gRPC requests of the SecretDiscoveryService.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.ProtoMajor != 2 || r.Header.Get("Content-Type") != "application/grpc" && r.Header.Get("Content-Type") != "application/grpc+proto" {
+		http.Error(w, "sds: expected a gRPC request", http.StatusUnsupportedMediaType)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+
+	var err error
+	switch r.URL.Path {
+	case streamPath:
+		err = s.stream(r.Context(), w, r.Body)
+	case fetchPath:
+		err = s.fetch(w, r.Body)
+	default:
+		err = &statusError{codeUnimplemented, "unknown method " + r.URL.Path}
+	}
+	code, msg := codeOK, ""
+	var st *statusError
+	switch {
+	case errors.As(err, &st):
+		code, msg = st.code, st.msg
+	case err != nil && r.Context().Err() == nil:
+		code, msg = codeInternal, err.Error()
+	}
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+	if msg != "" {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", msg)
+	}
+}
+
+// statusError is an error answered with its gRPC status.
+type statusError struct {
+	code int
+	msg  string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("sds: gRPC status %d: %s", e.code, e.msg)
+}
+
+// stream answers the DiscoveryRequests of a StreamSecrets call read
+// from body, and pushes the changes of the secrets subscribed to.
+func (s *Server) stream(ctx context.Context, w http.ResponseWriter, body io.Reader) error {
+	logger := s.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	requests := make(chan *discoveryRequest)
+	errc := make(chan error, 1)
+	go func() {
+		for {
+			req, err := readRequest(body)
+			if err != nil {
+				errc <- err
+				return
+			}
+			select {
+			case requests <- req:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var (
+		names      []string
+		subscribed bool
+		sent       = -1 // version of the secrets sent last
+	)
+	for {
+		s.mu.Lock()
+		if s.changed == nil {
+			s.changed = make(chan struct{})
+		}
+		changed := s.changed
+		s.mu.Unlock()
+
+		if subscribed {
+			resp, version, ok := s.response(names)
+			if ok && version != sent {
+				if err := writeMessage(w, resp); err != nil {
+					return err
+				}
+				sent = version
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-errc:
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		case <-changed:
+		case req := <-requests:
+			if req.typeURL != SecretType {
+				return &statusError{codeInvalidArgument, "unexpected type " + req.typeURL}
+			}
+			if req.errorDetail != "" {
+				logger.Error("envoy rejected the secrets.", "node", req.node, "version", req.versionInfo, "err", req.errorDetail)
+			}
+			// a new subscription is answered, an ACK or NACK is not
+			if !subscribed || !equal(names, req.resourceNames) {
+				logger.Info("envoy subscribed to the secrets.", "node", req.node, "names", req.resourceNames)
+				names, subscribed, sent = req.resourceNames, true, -1
+			}
+		}
+	}
+}
+
+// fetch answers the DiscoveryRequest of a FetchSecrets call read from
+// body.
+func (s *Server) fetch(w http.ResponseWriter, body io.Reader) error {
+	req, err := readRequest(body)
+	if err != nil {
+		return err
+	}
+	if req.typeURL != SecretType {
+		return &statusError{codeInvalidArgument, "unexpected type " + req.typeURL}
+	}
+	resp, _, ok := s.response(req.resourceNames)
+	if !ok {
+		return &statusError{codeNotFound, "no secret to serve yet"}
+	}
+	return writeMessage(w, resp)
+}
+
+// response returns the DiscoveryResponse with the secrets of names, or
+// all secrets without names, and its version, the last change of the
+// secrets, unless there is none to serve yet.
+func (s *Server) response(names []string) ([]byte, int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(names) == 0 {
+		for name := range s.secrets {
+			names = append(names, name)
+		}
+	}
+	var resp []byte
+	version := 0
+	for _, name := range names {
+		secret, ok := s.secrets[name]
+		if !ok {
+			continue
+		}
+		if secret.version > version {
+			version = secret.version
+		}
+		// the resources are Any messages
+		var resource []byte
+		resource = protowire.AppendTag(resource, 1, protowire.BytesType) // type_url
+		resource = protowire.AppendString(resource, SecretType)
+		resource = protowire.AppendTag(resource, 2, protowire.BytesType) // value
+		resource = protowire.AppendBytes(resource, secret.data)
+		resp = protowire.AppendTag(resp, 2, protowire.BytesType) // resources
+		resp = protowire.AppendBytes(resp, resource)
+	}
+	if version == 0 {
+		return nil, 0, false
+	}
+	s.nonce++
+	resp = protowire.AppendTag(resp, 1, protowire.BytesType) // version_info
+	resp = protowire.AppendString(resp, strconv.Itoa(version))
+	resp = protowire.AppendTag(resp, 4, protowire.BytesType) // type_url
+	resp = protowire.AppendString(resp, SecretType)
+	resp = protowire.AppendTag(resp, 5, protowire.BytesType) // nonce
+	resp = protowire.AppendString(resp, strconv.Itoa(s.nonce))
+	return resp, version, true
+}
+
+// discoveryRequest holds the fields of a DiscoveryRequest used by
+// the server.
+type discoveryRequest struct {
+	versionInfo   string
+	node          string
+	resourceNames []string
+	typeURL       string
+	responseNonce string
+
+	// errorDetail is the message of the error_detail of a NACK.
+	errorDetail string
+}
+
+// readRequest reads a DiscoveryRequest in a gRPC message from r.
+func readRequest(r io.Reader) (*discoveryRequest, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, &statusError{codeInvalidArgument, "truncated message"}
+		}
+		return nil, err
+	}
+	if prefix[0] != 0 {
+		return nil, &statusError{codeUnimplemented, "compressed messages are not supported"}
+	}
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if size > maxMessageSize {
+		return nil, &statusError{codeInvalidArgument, "message too large"}
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, &statusError{codeInvalidArgument, "truncated message"}
+	}
+	req := &discoveryRequest{}
+	err := decodeFields(data, func(num protowire.Number, value []byte) error {
+		switch num {
+		case 1:
+			req.versionInfo = string(value)
+		case 2: // node
+			return decodeFields(value, func(num protowire.Number, value []byte) error {
+				if num == 1 { // id
+					req.node = string(value)
+				}
+				return nil
+			})
+		case 3:
+			req.resourceNames = append(req.resourceNames, string(value))
+		case 4:
+			req.typeURL = string(value)
+		case 5:
+			req.responseNonce = string(value)
+		case 6: // error_detail, a google.rpc.Status
+			return decodeFields(value, func(num protowire.Number, value []byte) error {
+				if num == 2 { // message
+					req.errorDetail = string(value)
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, &statusError{codeInvalidArgument, "invalid DiscoveryRequest: " + err.Error()}
+	}
+	return req, nil
+}
+
+// decodeFields calls f with the number and value of the length
+// delimited fields of the message data, skipping the others.
+func decodeFields(data []byte, f func(num protowire.Number, value []byte) error) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+		if typ != protowire.BytesType {
+			n = protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			data = data[n:]
+			continue
+		}
+		value, n := protowire.ConsumeBytes(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+		if err := f(num, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeMessage writes msg as a gRPC message to w, and flushes it.
+func writeMessage(w http.ResponseWriter, msg []byte) error {
+	var prefix [5]byte
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(msg)))
+	if _, err := w.Write(append(prefix[:], msg...)); err != nil {
+		return err
+	}
+	w.(http.Flusher).Flush()
+	return nil
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,217 @@
+package sds
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// request encodes a DiscoveryRequest in a gRPC message.
+func request(names []string, typeURL, version, nonce, errorDetail string) []byte {
+	var req []byte
+	req = protowire.AppendTag(req, 1, protowire.BytesType)
+	req = protowire.AppendString(req, version)
+	var node []byte
+	node = protowire.AppendTag(node, 1, protowire.BytesType)
+	node = protowire.AppendString(node, "gateway-1")
+	req = protowire.AppendTag(req, 2, protowire.BytesType)
+	req = protowire.AppendBytes(req, node)
+	for _, name := range names {
+		req = protowire.AppendTag(req, 3, protowire.BytesType)
+		req = protowire.AppendString(req, name)
+	}
+	req = protowire.AppendTag(req, 4, protowire.BytesType)
+	req = protowire.AppendString(req, typeURL)
+	req = protowire.AppendTag(req, 5, protowire.BytesType)
+	req = protowire.AppendString(req, nonce)
+	if errorDetail != "" {
+		var status []byte
+		status = protowire.AppendTag(status, 1, protowire.VarintType)
+		status = protowire.AppendVarint(status, 3)
+		status = protowire.AppendTag(status, 2, protowire.BytesType)
+		status = protowire.AppendString(status, errorDetail)
+		req = protowire.AppendTag(req, 6, protowire.BytesType)
+		req = protowire.AppendBytes(req, status)
+	}
+	msg := make([]byte, 5, 5+len(req))
+	binary.BigEndian.PutUint32(msg[1:], uint32(len(req)))
+	return append(msg, req...)
+}
+
+// response is a decoded DiscoveryResponse, with the inline bytes of
+// the secrets by name and field.
+type response struct {
+	version, typeURL, nonce string
+	secrets                 map[string]map[string][]byte
+}
+
+func readResponse(t *testing.T, r io.Reader) *response {
+	t.Helper()
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, binary.BigEndian.Uint32(prefix[1:]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		t.Fatal(err)
+	}
+	resp := &response{secrets: make(map[string]map[string][]byte)}
+	// inline returns the inline_bytes of the DataSource field num of msg
+	inline := func(msg []byte, num protowire.Number) []byte {
+		var value []byte
+		decodeFields(msg, func(n protowire.Number, source []byte) error {
+			if n == num {
+				decodeFields(source, func(n protowire.Number, v []byte) error {
+					if n == 2 {
+						value = v
+					}
+					return nil
+				})
+			}
+			return nil
+		})
+		return value
+	}
+	err := decodeFields(data, func(num protowire.Number, value []byte) error {
+		switch num {
+		case 1:
+			resp.version = string(value)
+		case 4:
+			resp.typeURL = string(value)
+		case 5:
+			resp.nonce = string(value)
+		case 2: // an Any of a Secret
+			var typeURL, name string
+			fields := make(map[string][]byte)
+			err := decodeFields(value, func(num protowire.Number, value []byte) error {
+				if num == 1 {
+					typeURL = string(value)
+					return nil
+				}
+				return decodeFields(value, func(num protowire.Number, value []byte) error {
+					switch num {
+					case 1:
+						name = string(value)
+					case 2:
+						fields["certificate_chain"] = inline(value, 1)
+						fields["private_key"] = inline(value, 2)
+					case 4:
+						fields["trusted_ca"] = inline(value, 1)
+					}
+					return nil
+				})
+			})
+			if typeURL != SecretType {
+				t.Errorf("expected a resource of type %s, got %s", SecretType, typeURL)
+			}
+			resp.secrets[name] = fields
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// call starts a gRPC call of method with body.
+func call(t *testing.T, client *http.Client, addr, method string, body io.Reader) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, "http://"+addr+"/envoy.service.secret.v3.SecretDiscoveryService/"+method, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/grpc" {
+		t.Fatalf("expected a gRPC response, got %s", resp.Status)
+	}
+	return resp
+}
+
+func TestServer(t *testing.T) {
+	srv := &Server{}
+	srv.SetValidationContext("ROOTCA", []byte("ca"))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go srv.Serve(ctx, ln)
+
+	// Envoy speaks HTTP/2 without TLS to the cluster of the SDS server
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: &protocols}, Timeout: 10 * time.Second}
+	addr := ln.Addr().String()
+
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	stream := call(t, client, addr, "StreamSecrets", pr)
+	defer stream.Body.Close()
+	if _, err := pw.Write(request([]string{"default", "ROOTCA"}, SecretType, "", "", "")); err != nil {
+		t.Fatal(err)
+	}
+	// only the validation context is known yet
+	resp := readResponse(t, stream.Body)
+	if resp.typeURL != SecretType || len(resp.secrets) != 1 || string(resp.secrets["ROOTCA"]["trusted_ca"]) != "ca" {
+		t.Fatalf("expected the validation context, got %+v", resp)
+	}
+	pw.Write(request([]string{"default", "ROOTCA"}, SecretType, resp.version, resp.nonce, ""))
+
+	// the certificate is pushed once set
+	srv.SetCertificate("default", []byte("cert"), []byte("key"))
+	next := readResponse(t, stream.Body)
+	if next.version == resp.version || next.nonce == resp.nonce || len(next.secrets) != 2 {
+		t.Fatalf("expected a new version with both secrets, got %+v", next)
+	}
+	if got := next.secrets["default"]; string(got["certificate_chain"]) != "cert" || string(got["private_key"]) != "key" {
+		t.Errorf("expected the certificate and key, got %q", got)
+	}
+	// a NACK is logged, and the secrets are not sent again until they change
+	pw.Write(request([]string{"default", "ROOTCA"}, SecretType, resp.version, next.nonce, "failed to load the certificate"))
+	srv.SetValidationContext("ROOTCA", []byte("ca"))
+	srv.SetCertificate("other", []byte("cert 2"), []byte("key 2"))
+	srv.SetCertificate("default", []byte("cert 2"), []byte("key 2"))
+	renewed := readResponse(t, stream.Body)
+	if string(renewed.secrets["default"]["certificate_chain"]) != "cert 2" || renewed.secrets["other"] != nil {
+		t.Errorf("expected the renewed certificate, got %+v", renewed)
+	}
+	pw.Close()
+	io.Copy(io.Discard, stream.Body)
+	if status := stream.Trailer.Get("Grpc-Status"); status != "0" {
+		t.Errorf("expected the stream to end with OK, got %q", status)
+	}
+
+	fetch := call(t, client, addr, "FetchSecrets", bytes.NewReader(request([]string{"other"}, SecretType, "", "", "")))
+	resp = readResponse(t, fetch.Body)
+	io.Copy(io.Discard, fetch.Body)
+	fetch.Body.Close()
+	if string(resp.secrets["other"]["private_key"]) != "key 2" || len(resp.secrets) != 1 || fetch.Trailer.Get("Grpc-Status") != "0" {
+		t.Errorf("expected the secret other, got %+v", resp)
+	}
+	for _, body := range [][]byte{
+		request([]string{"missing"}, SecretType, "", "", ""),
+		request(nil, "type.googleapis.com/envoy.config.cluster.v3.Cluster", "", "", ""),
+	} {
+		fetch := call(t, client, addr, "FetchSecrets", bytes.NewReader(body))
+		io.Copy(io.Discard, fetch.Body)
+		fetch.Body.Close()
+		if status := fetch.Trailer.Get("Grpc-Status"); status != "5" && status != "3" {
+			t.Errorf("expected NOT_FOUND or INVALID_ARGUMENT, got %q", status)
+		}
+	}
+}
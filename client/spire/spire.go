@@ -0,0 +1,173 @@
+// Package spire adapts scepclient to the UpstreamAuthority plugins of
+// SPIRE: a SPIRE server minting its X.509 CA through such a plugin has
+// it issued by a CA which only speaks SCEP, chaining the SVIDs of its
+// trust domain to the PKI of that CA.
+//
+// The package has no SPIRE dependencies. A plugin, built with the
+// spire-plugin-sdk, implements MintX509CAAndSubscribe by calling
+// UpstreamAuthority.MintX509CA with the CSR of the request, and sending
+// the X509CAChain and UpstreamX509Roots of the returned Mint. A new
+// root of the SCEP CA, after its rollover, is picked up with the next
+// X.509 CA that SPIRE mints. PublishJWTKeyAndSubscribe is left
+// unimplemented, as SCEP has no way to publish JWT keys.
+//
+// SCEP requests carry RSA keys, so SPIRE must be configured with a
+// ca_key_type of rsa-2048 or rsa-4096. The SCEP server must issue CA
+// certificates for its CSRs, which ask for one with their basic
+// constraints, e.g. with a dedicated certificate template of NDES. The
+// SCEP messages are signed as by the certmanager package, whose
+// documentation describes how servers authorize them. SCEP has no way
+// to request a validity period, so the preferred TTL of SPIRE is up to
+// the server.
+package spire
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"time"
+
+	scepclient "scepclient/client"
+	"scepclient/client/certmanager"
+	"scepclient/clock"
+)
+
+// ErrPending is returned by UpstreamAuthority.MintX509CA while the
+// server has not approved the request yet, unless it polls. Minting
+// the same CSR again continues the SCEP transaction.
+var ErrPending = errors.New("spire: certificate request pending approval by the CA")
+
+// UpstreamAuthority mints the X.509 CAs of a SPIRE server with a SCEP
+// server. It is safe for concurrent use.
+type UpstreamAuthority struct {
+	// Issuer enrolls the CSRs of SPIRE. Its SignerCert and SignerKey
+	// sign the SCEP messages.
+	Issuer certmanager.Issuer
+
+	// PollPolicy polls requests answered with PENDING, while SPIRE
+	// waits for the X.509 CA. If its Interval is zero, ErrPending is
+	// returned instead.
+	PollPolicy scepclient.PollPolicy
+}
+
+// Mint is the result of MintX509CA, as in the MintX509CAResponse of
+// an UpstreamAuthority plugin.
+type Mint struct {
+	// X509CAChain is the issued CA certificate, followed by the
+	// intermediate CA certificates up to, but not including, the root.
+	X509CAChain []*x509.Certificate
+
+	// UpstreamX509Roots holds the root CA certificate of the chain,
+	// among the certificates of GetCACert. Other self-signed
+	// certificates of GetCACert, such as those of a registration
+	// authority, are left out, as SPIRE would trust what they sign.
+	UpstreamX509Roots []*x509.Certificate
+}
+
+// MintX509CA enrolls the DER encoded CSR csr of SPIRE, and returns the
+// issued CA certificate with its chain. It fails if the server issues
+// a certificate which is not a CA, or which does not chain to a root
+// of GetCACert.
+func (u *UpstreamAuthority) MintX509CA(ctx context.Context, csr []byte) (*Mint, error) {
+	req, err := x509.ParseCertificateRequest(csr)
+	if err != nil {
+		return nil, fmt.Errorf("spire: parse certificate request: %w", err)
+	}
+	if _, ok := req.PublicKey.(*rsa.PublicKey); !ok {
+		return nil, errors.New("spire: the certificate request has no RSA key, set the ca_key_type of SPIRE to rsa-2048 or rsa-4096")
+	}
+	csrPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr})
+	var (
+		issued       *certmanager.Certificate
+		pendingSince time.Time
+	)
+	for polls := 0; ; polls++ {
+		issued, err = u.Issuer.Sign(ctx, csrPEM)
+		if !errors.Is(err, certmanager.ErrPending) {
+			break
+		}
+		if u.PollPolicy.Interval == 0 {
+			return nil, ErrPending
+		}
+		if polls == 0 {
+			pendingSince = clock.Or(u.PollPolicy.Clock).Now()
+		}
+		if err := u.PollPolicy.Wait(ctx, pendingSince, polls); err != nil {
+			return nil, err
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	crts, err := parseCertificates(issued.Certificate)
+	if err != nil {
+		return nil, fmt.Errorf("spire: parse issued certificate: %w", err)
+	}
+	if len(crts) == 0 {
+		return nil, errors.New("spire: no certificate issued")
+	}
+	ca := crts[0]
+	if !ca.BasicConstraintsValid || !ca.IsCA {
+		return nil, fmt.Errorf("spire: the SCEP server issued %s, which is not a CA certificate", ca.Subject)
+	}
+	if pub, ok := ca.PublicKey.(interface{ Equal(crypto.PublicKey) bool }); !ok || !pub.Equal(req.PublicKey) {
+		return nil, fmt.Errorf("spire: the SCEP server issued %s for another key", ca.Subject)
+	}
+	caCerts, err := parseCertificates(issued.CA)
+	if err != nil {
+		return nil, fmt.Errorf("spire: parse CA certificates: %w", err)
+	}
+	chain, root, err := buildChain(ca, caCerts)
+	if err != nil {
+		return nil, err
+	}
+	return &Mint{X509CAChain: chain, UpstreamX509Roots: []*x509.Certificate{root}}, nil
+}
+
+// buildChain returns crt followed by the certificates among certs
+// issuing it, up to the root, and the root.
+func buildChain(crt *x509.Certificate, certs []*x509.Certificate) ([]*x509.Certificate, *x509.Certificate, error) {
+	chain := []*x509.Certificate{crt}
+	// a chain longer than certs has a loop
+	for len(chain) <= len(certs) {
+		last := chain[len(chain)-1]
+		var parent *x509.Certificate
+		for _, c := range certs {
+			if bytes.Equal(last.RawIssuer, c.RawSubject) && last.CheckSignatureFrom(c) == nil {
+				parent = c
+				break
+			}
+		}
+		if parent == nil {
+			return nil, nil, fmt.Errorf("spire: no CA certificate of GetCACert issued %s", last.Subject)
+		}
+		if bytes.Equal(parent.RawIssuer, parent.RawSubject) && parent.CheckSignatureFrom(parent) == nil {
+			return chain, parent, nil
+		}
+		chain = append(chain, parent)
+	}
+	return nil, nil, fmt.Errorf("spire: no root CA certificate of GetCACert issued %s", crt.Subject)
+}
+
+// parseCertificates parses the PEM encoded certificates of data.
+func parseCertificates(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return certs, nil
+		}
+		crt, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, crt)
+	}
+}
@@ -0,0 +1,183 @@
+package spire_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"math/big"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	scepclient "scepclient/client"
+	"scepclient/client/certmanager"
+	"scepclient/client/scepclienttest"
+	"scepclient/client/spire"
+	"scepclient/scep"
+	"scepclient/scepserver"
+	"scepclient/scepserver/depot/file"
+)
+
+// signerFunc adapts a function to scepserver.Signer.
+type signerFunc func(ctx context.Context, csr *x509.CertificateRequest) (*x509.Certificate, error)
+
+func (f signerFunc) Sign(ctx context.Context, csr *x509.CertificateRequest) (*x509.Certificate, error) {
+	return f(ctx, csr)
+}
+
+func newCA(t *testing.T, cn string, parent *x509.Certificate, parentKey crypto.Signer) (*x509.Certificate, crypto.Signer) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, key.Public(), parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crt, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return crt, key
+}
+
+// newCSR returns a CSR of SPIRE for the X.509 CA of example.org.
+func newCSR(t *testing.T) ([]byte, *rsa.PublicKey) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	constraints, err := asn1.Marshal(struct{ IsCA bool }{true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:         pkix.Name{Country: []string{"US"}, Organization: []string{"SPIFFE"}},
+		URIs:            []*url.URL{{Scheme: "spiffe", Host: "example.org"}},
+		ExtraExtensions: []pkix.Extension{{Id: asn1.ObjectIdentifier{2, 5, 29, 19}, Critical: true, Value: constraints}},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der, &key.PublicKey
+}
+
+func TestMintX509CA(t *testing.T) {
+	depot, err := file.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := depot.CreateCA(nil, pkix.Name{CommonName: "RA"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	root, rootKey := newCA(t, "root CA", nil, nil)
+	issuing, issuingKey := newCA(t, "issuing CA", root, rootKey)
+	// a CA template for the CSRs of SPIRE
+	signer := signerFunc(func(ctx context.Context, csr *x509.CertificateRequest) (*x509.Certificate, error) {
+		tmpl := &x509.Certificate{
+			SerialNumber:          big.NewInt(42),
+			Subject:               csr.Subject,
+			URIs:                  csr.URIs,
+			NotBefore:             time.Now(),
+			NotAfter:              time.Now().Add(time.Hour),
+			KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, issuing, csr.PublicKey, issuingKey)
+		if err != nil {
+			return nil, err
+		}
+		return x509.ParseCertificate(der)
+	})
+	svc, err := scepserver.NewService(depot,
+		scepserver.WithIssuer([]*x509.Certificate{issuing, root}, issuingKey),
+		scepserver.WithSigner(signer),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(scepserver.NewHTTPHandler(svc))
+	defer server.Close()
+	client, err := scepclient.New(server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	csr, pub := newCSR(t)
+	ua := &spire.UpstreamAuthority{Issuer: certmanager.Issuer{Client: client}}
+	mint, err := ua.MintX509CA(context.Background(), csr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mint.X509CAChain) != 2 || !mint.X509CAChain[1].Equal(issuing) {
+		t.Fatalf("expected the X.509 CA and the issuing CA, got %d certificates", len(mint.X509CAChain))
+	}
+	ca := mint.X509CAChain[0]
+	if !ca.IsCA || !ca.PublicKey.(*rsa.PublicKey).Equal(pub) || len(ca.URIs) != 1 || ca.URIs[0].String() != "spiffe://example.org" {
+		t.Errorf("expected the X.509 CA of example.org, got %s %v", ca.Subject, ca.URIs)
+	}
+	// the self-signed RA certificate is no root of SPIRE
+	if len(mint.UpstreamX509Roots) != 1 || !mint.UpstreamX509Roots[0].Equal(root) {
+		t.Errorf("expected the root CA as the only upstream root, got %d certificates", len(mint.UpstreamX509Roots))
+	}
+}
+
+func TestMintX509CAPending(t *testing.T) {
+	client, err := scepclienttest.New(scepclienttest.WithStatuses(scep.PENDING, scep.PENDING, scep.SUCCESS))
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, _ := newCSR(t)
+	ua := &spire.UpstreamAuthority{Issuer: certmanager.Issuer{Client: client}}
+	ctx := context.Background()
+	if _, err := ua.MintX509CA(ctx, csr); !errors.Is(err, spire.ErrPending) {
+		t.Fatalf("expected the request to be pending, got %v", err)
+	}
+
+	// the fake CA issues a client certificate, which is no CA
+	ua.PollPolicy = scepclient.PollPolicy{Interval: time.Millisecond}
+	if _, err := ua.MintX509CA(ctx, csr); err == nil || !strings.Contains(err.Error(), "not a CA certificate") {
+		t.Fatalf("expected the certificate to be rejected, got %v", err)
+	}
+	if n := len(client.Requests()); n != 3 {
+		t.Errorf("expected the pending request to be polled, got %d requests", n)
+	}
+	if _, err := ua.MintX509CA(ctx, []byte("csr")); err == nil {
+		t.Error("expected an invalid CSR to fail")
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecCSR, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ua.MintX509CA(ctx, ecCSR); err == nil || !strings.Contains(err.Error(), "ca_key_type") {
+		t.Errorf("expected the EC key to be rejected, got %v", err)
+	}
+}
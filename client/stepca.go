@@ -0,0 +1,64 @@
+package scepclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"scepclient/scepserver"
+)
+
+// StepCARoot returns the root certificate of the step-ca server at
+// serverURL, authenticated by its SHA-256 fingerprint, as printed by
+// step-ca on init and by step certificate fingerprint. Like step ca
+// bootstrap, it trusts the server only for the certificate matching
+// the fingerprint, which then verifies the SCEP requests with
+// scepserver.WithRootCAs.
+func StepCARoot(ctx context.Context, serverURL, fingerprint string) (*x509.Certificate, error) {
+	sum, err := hex.DecodeString(strings.NewReplacer(":", "", " ", "").Replace(fingerprint))
+	if err != nil || len(sum) != sha256.Size {
+		return nil, errors.New("scepclient: the step-ca fingerprint must be a hex SHA-256 digest")
+	}
+	u, err := scepserver.ParseServerURL(serverURL)
+	if err != nil {
+		return nil, err
+	}
+	u.Path, u.RawPath, u.RawQuery = "/root/"+hex.EncodeToString(sum), "", ""
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	resp, err := (&http.Client{Transport: transport}).Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("scepclient: fetching the step-ca root: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("scepclient: fetching the step-ca root: %s", resp.Status)
+	}
+	var body struct {
+		CA string `json:"ca"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("scepclient: decoding the step-ca root: %w", err)
+	}
+	block, _ := pem.Decode([]byte(body.CA))
+	if block == nil {
+		return nil, errors.New("scepclient: the step-ca root is not PEM encoded")
+	}
+	if got := sha256.Sum256(block.Bytes); !bytes.Equal(got[:], sum) {
+		return nil, fmt.Errorf("scepclient: the step-ca root has the fingerprint %x", got)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
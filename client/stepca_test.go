@@ -0,0 +1,90 @@
+package scepclient_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	scepclient "scepclient/client"
+	"scepclient/scepserver"
+	"scepclient/scepserver/depot"
+)
+
+func TestStepCARoot(t *testing.T) {
+	root, _, err := depot.GenerateCA(pkix.Name{CommonName: "step root"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(root.Raw)
+	fingerprint := hex.EncodeToString(sum[:])
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/root/"+fingerprint {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"ca": string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: root.Raw})),
+		})
+	}))
+	defer srv.Close()
+
+	got, err := scepclient.StepCARoot(context.Background(), srv.URL+"/scep/devices", fingerprint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Equal(root) {
+		t.Error("expected the root of the fingerprint")
+	}
+	other := sha256.Sum256([]byte("other"))
+	if _, err := scepclient.StepCARoot(context.Background(), srv.URL, hex.EncodeToString(other[:])); err == nil {
+		t.Error("expected a root of another fingerprint to fail")
+	}
+	if _, err := scepclient.StepCARoot(context.Background(), srv.URL, "abcd"); err == nil {
+		t.Error("expected a short fingerprint to fail")
+	}
+}
+
+// TestStepCAIntegration enrolls with a step-ca server, e.g. a local
+// step-ca binary or the smallstep/step-ca container, started with
+//
+//	docker run -p 9000:9000 -e DOCKER_STEPCA_INIT_NAME=test -e DOCKER_STEPCA_INIT_DNS_NAMES=localhost smallstep/step-ca
+//
+// with a SCEP provisioner, added with
+//
+//	step ca provisioner add scep --type SCEP --challenge secret
+//
+// and an RSA intermediate or decrypter. It is skipped unless
+// SCEPCLIENT_STEPCA_URL is set, e.g. to https://localhost:9000, with the
+// root fingerprint step-ca printed on init in SCEPCLIENT_STEPCA_FINGERPRINT,
+// and the provisioner and its challenge in SCEPCLIENT_STEPCA_PROVISIONER
+// and SCEPCLIENT_STEPCA_CHALLENGE.
+func TestStepCAIntegration(t *testing.T) {
+	serverURL := os.Getenv("SCEPCLIENT_STEPCA_URL")
+	if serverURL == "" {
+		t.Skip("SCEPCLIENT_STEPCA_URL is not set")
+	}
+	root, err := scepclient.StepCARoot(context.Background(), serverURL, os.Getenv("SCEPCLIENT_STEPCA_FINGERPRINT"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverURL, err = scepclient.ServerProfiles["stepca"].URL(serverURL, os.Getenv("SCEPCLIENT_STEPCA_PROVISIONER"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	client, err := scepclient.New(serverURL, nil, scepclient.WithHTTPOptions(scepserver.WithRootCAs(roots)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	enrollWithChallenge(t, client, "scepclient-test", os.Getenv("SCEPCLIENT_STEPCA_CHALLENGE"))
+}
@@ -0,0 +1,180 @@
+// Package vaultkv writes enrolled keys and certificates to the KV
+// secrets engine of HashiCorp Vault, for teams distributing their
+// secrets with Vault rather than files.
+package vaultkv
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"scepclient/client/bundle"
+)
+
+// Config selects the Vault server, its authentication and KV engine.
+type Config struct {
+	// Address is the URL of the Vault server, e.g. https://vault:8200.
+	Address string
+
+	// Token authenticates to Vault. If it is empty, the Writer logs in
+	// with the AppRole RoleID and SecretID before every write. Either
+	// needs the create and update capabilities on the written paths.
+	Token string
+
+	// RoleID and SecretID are the AppRole credentials, and AppRoleMount
+	// the path of the AppRole auth method, "approle" by default.
+	RoleID       string
+	SecretID     string
+	AppRoleMount string
+
+	// Namespace is the Vault Enterprise namespace, if any.
+	Namespace string
+
+	// Mount is the path of the KV secrets engine, "secret" by default,
+	// and KVVersion its version, 1 or 2 by default.
+	Mount     string
+	KVVersion int
+
+	// Client sends the requests to Vault.
+	// http.DefaultClient is used if it is nil.
+	Client *http.Client
+}
+
+// Writer writes bundles to KV paths.
+type Writer struct {
+	config Config
+}
+
+// NewWriter returns a Writer using config.
+func NewWriter(config Config) (*Writer, error) {
+	if config.Address == "" {
+		return nil, errors.New("vaultkv: address is required")
+	}
+	if config.Token == "" && (config.RoleID == "" || config.SecretID == "") {
+		return nil, errors.New("vaultkv: a token or AppRole role and secret ID are required")
+	}
+	if config.AppRoleMount == "" {
+		config.AppRoleMount = "approle"
+	}
+	if config.Mount == "" {
+		config.Mount = "secret"
+	}
+	switch config.KVVersion {
+	case 0:
+		config.KVVersion = 2
+	case 1, 2:
+	default:
+		return nil, fmt.Errorf("vaultkv: unknown KV version %d", config.KVVersion)
+	}
+	if config.Client == nil {
+		config.Client = http.DefaultClient
+	}
+	return &Writer{config: config}, nil
+}
+
+// Write writes b to the secret at path, as its new version in KV
+// version 2. The secret has the fields private_key, certificate and
+// ca_chain, named like those of the Vault PKI engine, and the
+// serial_number and expiration, in Unix seconds, of the certificate.
+func (w *Writer) Write(ctx context.Context, path string, b bundle.Bundle) error {
+	block, _ := pem.Decode(b.Certificate)
+	if block == nil {
+		return errors.New("vaultkv: no PEM encoded certificate")
+	}
+	crt, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("vaultkv: %w", err)
+	}
+	data := map[string]interface{}{
+		"private_key":   string(b.Key),
+		"certificate":   string(b.Certificate),
+		"serial_number": crt.SerialNumber.Text(16),
+		"expiration":    crt.NotAfter.Unix(),
+	}
+	if len(b.CA) > 0 {
+		data["ca_chain"] = string(b.CA)
+	}
+
+	token := w.config.Token
+	if token == "" {
+		if token, err = w.login(ctx); err != nil {
+			return err
+		}
+	}
+	mount, path := strings.Trim(w.config.Mount, "/"), strings.Trim(path, "/")
+	var body interface{} = data
+	endpoint := mount + "/" + path
+	if w.config.KVVersion == 2 {
+		body, endpoint = map[string]interface{}{"data": data}, mount+"/data/"+path
+	}
+	_, err = w.do(ctx, endpoint, token, body)
+	return err
+}
+
+// login logs in with the AppRole credentials, and returns the token.
+func (w *Writer) login(ctx context.Context) (string, error) {
+	resp, err := w.do(ctx, "auth/"+strings.Trim(w.config.AppRoleMount, "/")+"/login", "", map[string]string{
+		"role_id":   w.config.RoleID,
+		"secret_id": w.config.SecretID,
+	})
+	if err != nil {
+		return "", err
+	}
+	if resp.Auth.ClientToken == "" {
+		return "", errors.New("vaultkv: AppRole login returned no token")
+	}
+	return resp.Auth.ClientToken, nil
+}
+
+type response struct {
+	Auth struct {
+		ClientToken string `json:"client_token"`
+	} `json:"auth"`
+	Errors []string `json:"errors"`
+}
+
+// do POSTs body to the API path with token, if it is not empty.
+func (w *Writer) do(ctx context.Context, path, token string, body interface{}) (*response, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	endpoint := strings.TrimSuffix(w.config.Address, "/") + "/v1/" + path
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if w.config.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", w.config.Namespace)
+	}
+	httpResp, err := w.config.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("vaultkv: %w", err)
+	}
+	defer httpResp.Body.Close()
+	respData, err := ioutil.ReadAll(io.LimitReader(httpResp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("vaultkv: %w", err)
+	}
+	var resp response
+	jsonErr := json.Unmarshal(respData, &resp)
+	if httpResp.StatusCode/100 != 2 {
+		if jsonErr == nil && len(resp.Errors) > 0 {
+			return nil, fmt.Errorf("vaultkv: %s failed with status %s: %s", path, httpResp.Status, strings.Join(resp.Errors, "; "))
+		}
+		return nil, fmt.Errorf("vaultkv: %s failed with status %s", path, httpResp.Status)
+	}
+	return &resp, nil
+}
@@ -0,0 +1,90 @@
+package vaultkv
+
+import (
+	"context"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"scepclient/client/bundle"
+	"scepclient/scepserver/depot"
+)
+
+func TestWriter(t *testing.T) {
+	crt, _, err := depot.GenerateCA(pkix.Name{CommonName: "device"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: crt.Raw})
+	written := make(map[string]map[string]interface{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+			return
+		}
+		if r.URL.Path == "/v1/auth/approle/login" {
+			if body["role_id"] != "role" || body["secret_id"] != "secret" {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"errors":["invalid role or secret ID"]}`))
+				return
+			}
+			w.Write([]byte(`{"auth":{"client_token":"token"}}`))
+			return
+		}
+		if r.Header.Get("X-Vault-Token") != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+		written[r.URL.Path] = body
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+	b := bundle.Bundle{Key: []byte("key"), Certificate: certPEM, CA: []byte("ca")}
+	ctx := context.Background()
+
+	w, err := NewWriter(Config{Address: server.URL, RoleID: "role", SecretID: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(ctx, "/scep/web", b); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := written["/v1/secret/data/scep/web"]["data"].(map[string]interface{})
+	if data["private_key"] != "key" || data["certificate"] != string(certPEM) || data["ca_chain"] != "ca" {
+		t.Errorf("expected the bundle in the KV version 2 secret, got %v", written)
+	}
+	if data["serial_number"] != crt.SerialNumber.Text(16) || data["expiration"] != float64(crt.NotAfter.Unix()) {
+		t.Errorf("expected the serial number and expiration of the certificate, got %v", data)
+	}
+
+	w, err = NewWriter(Config{Address: server.URL, Token: "token", Mount: "kv", KVVersion: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(ctx, "scep/web", b); err != nil {
+		t.Fatal(err)
+	}
+	if data := written["/v1/kv/scep/web"]; data["private_key"] != "key" {
+		t.Errorf("expected the bundle in the KV version 1 secret, got %v", written)
+	}
+
+	w, err = NewWriter(Config{Address: server.URL, RoleID: "role", SecretID: "wrong"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(ctx, "scep/web", b); err == nil {
+		t.Error("expected a failed login to fail the write")
+	}
+	if _, err := NewWriter(Config{Address: server.URL}); err == nil {
+		t.Error("expected credentials to be required")
+	}
+	if err := w.Write(ctx, "scep/web", bundle.Bundle{Certificate: []byte("garbage")}); err == nil {
+		t.Error("expected a malformed certificate to fail the write")
+	}
+}
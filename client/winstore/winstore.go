@@ -0,0 +1,221 @@
+// Package winstore reads certificates and their keys from the
+// certificate stores of Windows, to adopt certificates enrolled by
+// other means, such as the autoenrollment of Active Directory, and
+// renew them over SCEP.
+//
+// It runs PowerShell rather than calling CryptoAPI, so that it builds
+// on every platform. Only RSA keys which are marked exportable can be
+// read.
+package winstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// The certificate template extensions of Microsoft: version 1 holds the
+// name of the template, version 2 its OID and version.
+var (
+	oidTemplateName = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 20, 2}
+	oidTemplate     = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 21, 7}
+)
+
+// Certificate is a certificate of a store with a private key.
+type Certificate struct {
+	// Thumbprint is the SHA-1 hash of the certificate in upper case
+	// hex, as shown by Windows.
+	Thumbprint string
+
+	Certificate *x509.Certificate
+
+	// Template and TemplateOID are the name and OID of the certificate
+	// template it was issued from, if any. The name of version 2
+	// templates is the one resolved by Windows.
+	Template    string
+	TemplateOID string
+}
+
+// listScript lists the certificates with a private key of the store
+// $env:SCEP_STORE, e.g. LocalMachine\My, as JSON.
+const listScript = `$ErrorActionPreference = 'Stop'
+$certs = @(Get-ChildItem -Path ('Cert:\' + $env:SCEP_STORE) | Where-Object { $_.HasPrivateKey } | ForEach-Object {
+  $template = $_.Extensions | Where-Object { $_.Oid.Value -eq '1.3.6.1.4.1.311.21.7' } | Select-Object -First 1
+  [pscustomobject]@{
+    Thumbprint = $_.Thumbprint
+    Raw = [Convert]::ToBase64String($_.RawData)
+    Template = $(if ($template) { $template.Format($false) } else { '' })
+  }
+})
+ConvertTo-Json -InputObject $certs -Compress
+`
+
+// exportScript exports the RSA key of the certificate $env:SCEP_THUMBPRINT
+// of the store $env:SCEP_STORE as JSON, which only works for keys
+// marked exportable.
+const exportScript = `$ErrorActionPreference = 'Stop'
+$cert = Get-Item -Path ('Cert:\' + $env:SCEP_STORE + '\' + $env:SCEP_THUMBPRINT)
+$rsa = [System.Security.Cryptography.X509Certificates.RSACertificateExtensions]::GetRSAPrivateKey($cert)
+if ($rsa -eq $null) { throw 'the certificate has no RSA private key' }
+$p = $rsa.ExportParameters($true)
+$b64 = { param($b) [Convert]::ToBase64String($b) }
+ConvertTo-Json -Compress -InputObject ([pscustomobject]@{
+  N = & $b64 $p.Modulus; E = & $b64 $p.Exponent; D = & $b64 $p.D
+  P = & $b64 $p.P; Q = & $b64 $p.Q
+})
+`
+
+// timeout bounds the run time of PowerShell.
+const timeout = 2 * time.Minute
+
+// powershell runs script with the environment env, and returns its
+// standard output. Tests replace it.
+var powershell = func(ctx context.Context, script string, env ...string) ([]byte, error) {
+	if runtime.GOOS != "windows" {
+		return nil, errors.New("winstore: the certificate stores are only read on Windows")
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "powershell.exe", "-NoProfile", "-NonInteractive", "-ExecutionPolicy", "Bypass", "-Command", script)
+	cmd.Env = append(os.Environ(), env...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("winstore: powershell: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// List returns the certificates with a private key of store, such as
+// LocalMachine\My or CurrentUser\My.
+func List(ctx context.Context, store string) ([]Certificate, error) {
+	out, err := powershell(ctx, listScript, "SCEP_STORE="+store)
+	if err != nil {
+		return nil, err
+	}
+	var listed []struct {
+		Thumbprint, Raw, Template string
+	}
+	if err := json.Unmarshal(out, &listed); err != nil {
+		return nil, fmt.Errorf("winstore: decoding the certificates of %s: %w", store, err)
+	}
+	certs := make([]Certificate, 0, len(listed))
+	for _, l := range listed {
+		der, err := base64.StdEncoding.DecodeString(l.Raw)
+		if err != nil {
+			return nil, fmt.Errorf("winstore: certificate %s: %w", l.Thumbprint, err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, fmt.Errorf("winstore: certificate %s: %w", l.Thumbprint, err)
+		}
+		c := Certificate{Thumbprint: strings.ToUpper(l.Thumbprint), Certificate: cert}
+		c.Template, c.TemplateOID = template(cert, l.Template)
+		certs = append(certs, c)
+	}
+	return certs, nil
+}
+
+// templateFormat matches the name resolved by Windows in the formatted
+// version 2 template extension, Template=name(OID), ...
+var templateFormat = regexp.MustCompile(`^Template=(.+)\(([0-9.]+)\)`)
+
+// template returns the name and OID of the template of cert, with the
+// formatted version 2 extension naming it.
+func template(cert *x509.Certificate, formatted string) (name, oid string) {
+	for _, ext := range cert.Extensions {
+		switch {
+		case ext.Id.Equal(oidTemplateName):
+			var bmp asn1.RawValue
+			if _, err := asn1.Unmarshal(ext.Value, &bmp); err == nil && bmp.Tag == 30 && len(bmp.Bytes)%2 == 0 {
+				u := make([]uint16, len(bmp.Bytes)/2)
+				for i := range u {
+					u[i] = uint16(bmp.Bytes[2*i])<<8 | uint16(bmp.Bytes[2*i+1])
+				}
+				name = string(utf16.Decode(u))
+			}
+		case ext.Id.Equal(oidTemplate):
+			var v2 struct {
+				ID    asn1.ObjectIdentifier
+				Major int `asn1:"optional"`
+				Minor int `asn1:"optional"`
+			}
+			if _, err := asn1.Unmarshal(ext.Value, &v2); err == nil {
+				oid = v2.ID.String()
+			}
+		}
+	}
+	if m := templateFormat.FindStringSubmatch(formatted); m != nil && m[2] == oid && name == "" {
+		name = m[1]
+	}
+	return name, oid
+}
+
+// Find returns the certificate of certs with the thumbprint, or else
+// the one issued last from template, a name or OID.
+func Find(certs []Certificate, thumbprint, template string) (Certificate, error) {
+	thumbprint = strings.ToUpper(strings.NewReplacer(" ", "", ":", "").Replace(thumbprint))
+	var found *Certificate
+	for i, c := range certs {
+		switch {
+		case thumbprint != "":
+			if c.Thumbprint == thumbprint {
+				return c, nil
+			}
+		case template != "" && (strings.EqualFold(c.Template, template) || c.TemplateOID == template):
+			if found == nil || c.Certificate.NotBefore.After(found.Certificate.NotBefore) {
+				found = &certs[i]
+			}
+		}
+	}
+	switch {
+	case found != nil:
+		return *found, nil
+	case thumbprint != "":
+		return Certificate{}, fmt.Errorf("winstore: no certificate with a private key has the thumbprint %s", thumbprint)
+	case template != "":
+		return Certificate{}, fmt.Errorf("winstore: no certificate with a private key was issued from the template %s", template)
+	}
+	return Certificate{}, errors.New("winstore: a thumbprint or template is needed")
+}
+
+// ExportKey returns the private key of the certificate of store with
+// the thumbprint. The key must be an RSA key marked exportable.
+func ExportKey(ctx context.Context, store, thumbprint string) (*rsa.PrivateKey, error) {
+	out, err := powershell(ctx, exportScript, "SCEP_STORE="+store, "SCEP_THUMBPRINT="+thumbprint)
+	if err != nil {
+		return nil, fmt.Errorf("%w; only keys marked exportable can be adopted", err)
+	}
+	var params struct{ N, E, D, P, Q []byte }
+	if err := json.Unmarshal(out, &params); err != nil {
+		return nil, fmt.Errorf("winstore: decoding the key of %s: %w", thumbprint, err)
+	}
+	key := &rsa.PrivateKey{
+		PublicKey: rsa.PublicKey{
+			N: new(big.Int).SetBytes(params.N),
+			E: int(new(big.Int).SetBytes(params.E).Int64()),
+		},
+		D:      new(big.Int).SetBytes(params.D),
+		Primes: []*big.Int{new(big.Int).SetBytes(params.P), new(big.Int).SetBytes(params.Q)},
+	}
+	if err := key.Validate(); err != nil {
+		return nil, fmt.Errorf("winstore: the key of %s: %w", thumbprint, err)
+	}
+	key.Precompute()
+	return key, nil
+}
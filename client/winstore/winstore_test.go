@@ -0,0 +1,93 @@
+package winstore
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStore(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issue := func(notBefore time.Time, ext pkix.Extension) string {
+		der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+			SerialNumber:    big.NewInt(notBefore.Unix()),
+			Subject:         pkix.Name{CommonName: "web"},
+			NotBefore:       notBefore,
+			NotAfter:        notBefore.Add(time.Hour),
+			ExtraExtensions: []pkix.Extension{ext},
+		}, &x509.Certificate{Subject: pkix.Name{CommonName: "ca"}}, &key.PublicKey, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.StdEncoding.EncodeToString(der)
+	}
+	// the version 1 name is a BMPString
+	v1, _ := asn1.Marshal(asn1.RawValue{Tag: 30, Bytes: []byte{0, 'M', 0, 'a', 0, 'c', 0, 'h', 0, 'i', 0, 'n', 0, 'e'}})
+	v2, _ := asn1.Marshal(struct {
+		ID           asn1.ObjectIdentifier
+		Major, Minor int
+	}{asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 21, 8, 1, 2}, 100, 4})
+	now := time.Now()
+	listed := []map[string]string{
+		{"Thumbprint": "aa11", "Raw": issue(now.Add(-2*time.Hour), pkix.Extension{Id: oidTemplate, Value: v2}),
+			"Template": "Template=WebServer2(1.3.6.1.4.1.311.21.8.1.2), Major Version Number=100, Minor Version Number=4"},
+		{"Thumbprint": "BB22", "Raw": issue(now.Add(-time.Hour), pkix.Extension{Id: oidTemplate, Value: v2}),
+			"Template": "Template=WebServer2(1.3.6.1.4.1.311.21.8.1.2), Major Version Number=100, Minor Version Number=4"},
+		{"Thumbprint": "CC33", "Raw": issue(now, pkix.Extension{Id: oidTemplateName, Value: v1}), "Template": ""},
+	}
+	defer func(run func(context.Context, string, ...string) ([]byte, error)) { powershell = run }(powershell)
+	powershell = func(ctx context.Context, script string, env ...string) ([]byte, error) {
+		if script == exportScript {
+			return json.Marshal(map[string][]byte{
+				"N": key.N.Bytes(), "E": big.NewInt(int64(key.E)).Bytes(), "D": key.D.Bytes(),
+				"P": key.Primes[0].Bytes(), "Q": key.Primes[1].Bytes(),
+			})
+		}
+		if env[0] != `SCEP_STORE=LocalMachine\My` {
+			t.Errorf("unexpected environment %v", env)
+		}
+		return json.Marshal(listed)
+	}
+
+	certs, err := List(context.Background(), `LocalMachine\My`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 3 || certs[0].Thumbprint != "AA11" || certs[2].Template != "Machine" {
+		t.Fatalf("unexpected certificates %+v", certs)
+	}
+	for _, tt := range []struct{ thumbprint, template, want string }{
+		{"cc 33", "", "CC33"},
+		{"", "webserver2", "BB22"},
+		{"", "1.3.6.1.4.1.311.21.8.1.2", "BB22"},
+		{"", "Machine", "CC33"},
+	} {
+		c, err := Find(certs, tt.thumbprint, tt.template)
+		if err != nil || c.Thumbprint != tt.want {
+			t.Errorf("Find(%q, %q) = %s, %v, expected %s", tt.thumbprint, tt.template, c.Thumbprint, err, tt.want)
+		}
+	}
+	if _, err := Find(certs, "", "User"); err == nil || !strings.Contains(err.Error(), "User") {
+		t.Errorf("expected no certificate of the template User, got %v", err)
+	}
+
+	exported, err := ExportKey(context.Background(), `LocalMachine\My`, "CC33")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exported.Equal(key) {
+		t.Error("expected the exported key to be the key of the certificate")
+	}
+}
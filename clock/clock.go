@@ -0,0 +1,143 @@
+// Package clock abstracts the passing of time, so that tests and
+// simulation tools can control it instead of waiting for it.
+package clock
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock tells the current time and waits.
+type Clock interface {
+	Now() time.Time
+
+	// Sleep waits for d, returning ctx.Err() if ctx is done first.
+	Sleep(ctx context.Context, d time.Duration) error
+}
+
+// System is the real clock.
+var System Clock = system{}
+
+type system struct{}
+
+func (system) Now() time.Time { return time.Now() }
+
+func (system) Sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Or returns c, or System if c is nil.
+func Or(c Clock) Clock {
+	if c == nil {
+		return System
+	}
+	return c
+}
+
+// Fake is a Clock which only moves when it is told to.
+// It is safe for concurrent use.
+type Fake struct {
+	mtx         sync.Mutex
+	now         time.Time
+	autoAdvance bool
+	sleepers    []*sleeper
+}
+
+type sleeper struct {
+	until time.Time
+	done  chan struct{}
+}
+
+// NewFake returns a Fake clock set to now. Sleep blocks until
+// Advance or Set moves the clock past the end of the sleep.
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now}
+}
+
+// NewAutoFake returns a Fake clock set to now, which advances by the
+// requested duration whenever Sleep is called, so that code waiting
+// for hours finishes instantly.
+func NewAutoFake(now time.Time) *Fake {
+	return &Fake{now: now, autoAdvance: true}
+}
+
+// Now returns the time of the fake clock.
+func (f *Fake) Now() time.Time {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.now
+}
+
+// Sleep waits until the clock has advanced by d.
+func (f *Fake) Sleep(ctx context.Context, d time.Duration) error {
+	f.mtx.Lock()
+	if f.autoAdvance {
+		f.setLocked(f.now.Add(d))
+		f.mtx.Unlock()
+		return ctx.Err()
+	}
+	if d <= 0 {
+		f.mtx.Unlock()
+		return ctx.Err()
+	}
+	s := &sleeper{until: f.now.Add(d), done: make(chan struct{})}
+	f.sleepers = append(f.sleepers, s)
+	f.mtx.Unlock()
+
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		f.mtx.Lock()
+		for i, other := range f.sleepers {
+			if other == s {
+				f.sleepers = append(f.sleepers[:i], f.sleepers[i+1:]...)
+				break
+			}
+		}
+		f.mtx.Unlock()
+		return ctx.Err()
+	}
+}
+
+// Advance moves the clock forward by d, waking the sleepers it passes.
+func (f *Fake) Advance(d time.Duration) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.setLocked(f.now.Add(d))
+}
+
+// Set moves the clock to t, waking the sleepers it passes.
+func (f *Fake) Set(t time.Time) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.setLocked(t)
+}
+
+func (f *Fake) setLocked(t time.Time) {
+	f.now = t
+	sort.Slice(f.sleepers, func(i, j int) bool {
+		return f.sleepers[i].until.Before(f.sleepers[j].until)
+	})
+	for len(f.sleepers) > 0 && !f.sleepers[0].until.After(t) {
+		close(f.sleepers[0].done)
+		f.sleepers = f.sleepers[1:]
+	}
+}
+
+// Sleepers returns the number of goroutines blocked in Sleep,
+// so that tests can wait for them before advancing the clock.
+func (f *Fake) Sleepers() int {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return len(f.sleepers)
+}
@@ -0,0 +1,63 @@
+package clock
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestFake(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clk := NewFake(start)
+
+	done := make(chan error)
+	go func() {
+		done <- clk.Sleep(context.Background(), time.Hour)
+	}()
+	for clk.Sleepers() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	clk.Advance(30 * time.Minute)
+	select {
+	case <-done:
+		t.Fatal("expected Sleep to block until the clock passed its end")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	clk.Advance(30 * time.Minute)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if got := clk.Now(); !got.Equal(start.Add(time.Hour)) {
+		t.Errorf("expected %s, got %s", start.Add(time.Hour), got)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		done <- clk.Sleep(ctx, time.Hour)
+	}()
+	for clk.Sleepers() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if n := clk.Sleepers(); n != 0 {
+		t.Errorf("expected canceled sleeper to be removed, got %d", n)
+	}
+}
+
+func TestAutoFake(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clk := NewAutoFake(start)
+	for i := 0; i < 48; i++ {
+		if err := clk.Sleep(context.Background(), time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := clk.Now(); !got.Equal(start.Add(48 * time.Hour)) {
+		t.Errorf("expected %s, got %s", start.Add(48*time.Hour), got)
+	}
+}
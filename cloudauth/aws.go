@@ -0,0 +1,267 @@
+// Package cloudauth authenticates requests to the APIs of cloud
+// providers with the credentials of the environment, such as those of
+// the instance or container, without the SDKs of the providers. It also
+// reads the values set for the instance in its metadata service.
+package cloudauth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// ecsCredentialsURL serves the credentials of the task role to
+	// ECS tasks, at the path in AWS_CONTAINER_CREDENTIALS_RELATIVE_URI.
+	ecsCredentialsURL = "http://169.254.170.2"
+
+	// ec2MetadataURL is the instance metadata service of EC2.
+	ec2MetadataURL = "http://169.254.169.254"
+)
+
+// maxResponseSize limits the responses read from metadata endpoints.
+const maxResponseSize = 1 << 20
+
+// AWSCredentials are the credentials of an AWS principal.
+type AWSCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+
+	// SessionToken and Expiration are only set for temporary credentials.
+	SessionToken string
+	Expiration   time.Time
+}
+
+// AWSCredentialsSource returns the credentials to sign a request with.
+type AWSCredentialsSource func(ctx context.Context) (AWSCredentials, error)
+
+// StaticAWSCredentials returns an AWSCredentialsSource returning creds.
+func StaticAWSCredentials(creds AWSCredentials) AWSCredentialsSource {
+	return func(ctx context.Context) (AWSCredentials, error) {
+		return creds, nil
+	}
+}
+
+// DefaultAWSCredentials returns the credentials in AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN if they are set, and
+// otherwise those of the ECS task role or EKS pod identity, or of the
+// EC2 instance profile, like the AWS SDKs. The temporary credentials
+// of roles are cached until shortly before they expire. client fetches
+// them, http.DefaultClient if it is nil.
+func DefaultAWSCredentials(client *http.Client) AWSCredentialsSource {
+	id, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if id != "" && secret != "" {
+		return StaticAWSCredentials(AWSCredentials{
+			AccessKeyID:     id,
+			SecretAccessKey: secret,
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		})
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	p := &roleCredentials{client: client, ecsURL: ecsCredentialsURL, ec2URL: ec2MetadataURL}
+	return p.Credentials
+}
+
+// roleCredentials fetches the temporary credentials of
+// the role of a container or instance.
+type roleCredentials struct {
+	client *http.Client
+	ecsURL string
+	ec2URL string
+
+	mtx   sync.Mutex
+	creds AWSCredentials
+}
+
+func (p *roleCredentials) Credentials(ctx context.Context) (AWSCredentials, error) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.creds.AccessKeyID != "" && time.Now().Before(p.creds.Expiration.Add(-5*time.Minute)) {
+		return p.creds, nil
+	}
+	var (
+		creds AWSCredentials
+		err   error
+	)
+	if uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); uri != "" {
+		creds, err = p.container(ctx, p.ecsURL+uri)
+	} else if uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI"); uri != "" {
+		creds, err = p.container(ctx, uri)
+	} else {
+		creds, err = p.instance(ctx)
+	}
+	if err != nil {
+		return AWSCredentials{}, fmt.Errorf("cloudauth: get AWS credentials: %w", err)
+	}
+	p.creds = creds
+	return creds, nil
+}
+
+// container fetches the credentials of the container credentials
+// endpoint url, with the authorization token of the environment if any.
+func (p *roleCredentials) container(ctx context.Context, url string) (AWSCredentials, error) {
+	header := make(http.Header)
+	token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")
+	if path := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"); path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return AWSCredentials{}, err
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	if token != "" {
+		header.Set("Authorization", token)
+	}
+	data, err := p.get(ctx, http.MethodGet, url, header)
+	if err != nil {
+		return AWSCredentials{}, err
+	}
+	return parseRoleCredentials(data)
+}
+
+// instance fetches the credentials of the instance profile
+// with version 2 of the EC2 instance metadata service.
+func (p *roleCredentials) instance(ctx context.Context) (AWSCredentials, error) {
+	token, err := p.get(ctx, http.MethodPut, p.ec2URL+"/latest/api/token", http.Header{
+		"X-Aws-Ec2-Metadata-Token-Ttl-Seconds": {"21600"},
+	})
+	if err != nil {
+		return AWSCredentials{}, err
+	}
+	header := http.Header{"X-Aws-Ec2-Metadata-Token": {string(token)}}
+	const path = "/latest/meta-data/iam/security-credentials/"
+	roles, err := p.get(ctx, http.MethodGet, p.ec2URL+path, header)
+	if err != nil {
+		return AWSCredentials{}, err
+	}
+	role := strings.TrimSpace(strings.SplitN(string(roles), "\n", 2)[0])
+	if role == "" {
+		return AWSCredentials{}, errors.New("no instance profile")
+	}
+	data, err := p.get(ctx, http.MethodGet, p.ec2URL+path+role, header)
+	if err != nil {
+		return AWSCredentials{}, err
+	}
+	return parseRoleCredentials(data)
+}
+
+func (p *roleCredentials) get(ctx context.Context, method, url string, header http.Header) ([]byte, error) {
+	return fetchMetadata(ctx, p.client, method, url, header)
+}
+
+// fetchMetadata sends a request without body to a metadata endpoint,
+// and returns the body of a 2xx response.
+func fetchMetadata(ctx context.Context, client *http.Client, method, url string, header http.Header) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = header
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("%s %s: %s", method, url, resp.Status)
+	}
+	return data, nil
+}
+
+// parseRoleCredentials parses the credentials sent by the
+// container credentials endpoints and instance metadata service.
+func parseRoleCredentials(data []byte) (AWSCredentials, error) {
+	var resp struct {
+		AccessKeyID     string `json:"AccessKeyId"`
+		SecretAccessKey string
+		Token           string
+		Expiration      time.Time
+	}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return AWSCredentials{}, err
+	}
+	if resp.AccessKeyID == "" || resp.SecretAccessKey == "" {
+		return AWSCredentials{}, errors.New("no credentials in the response")
+	}
+	return AWSCredentials{
+		AccessKeyID:     resp.AccessKeyID,
+		SecretAccessKey: resp.SecretAccessKey,
+		SessionToken:    resp.Token,
+		Expiration:      resp.Expiration,
+	}, nil
+}
+
+// SignV4 adds the AWS Signature Version 4 authorization for service in
+// region to req, which has body, with creds, including their session
+// token if they are temporary.
+func SignV4(req *http.Request, body []byte, now time.Time, region, service string, creds AWSCredentials) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(req.Header.Get(name))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	bodyHash := sha256.Sum256(body)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(bodyHash[:]),
+	}, "\n")
+
+	scope := amzDate[:8] + "/" + region + "/" + service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + creds.SecretAccessKey)
+	for _, part := range strings.Split(scope, "/") {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+creds.AccessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
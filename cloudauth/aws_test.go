@@ -0,0 +1,90 @@
+package cloudauth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSignV4(t *testing.T) {
+	// the get-vanilla example of the AWS Signature Version 4 test suite
+	req, err := http.NewRequest(http.MethodGet, "https://example.amazonaws.com/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	SignV4(req, nil, now, "us-east-1", "service", AWSCredentials{
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+	})
+	want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+		"SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+	if got := req.Header.Get("Authorization"); got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+}
+
+func TestDefaultAWSCredentials(t *testing.T) {
+	for _, name := range []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_CONTAINER_CREDENTIALS_RELATIVE_URI", "AWS_CONTAINER_CREDENTIALS_FULL_URI", "AWS_CONTAINER_AUTHORIZATION_TOKEN", "AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"} {
+		t.Setenv(name, "")
+	}
+	expiration := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	var fetches int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		switch r.Method + " " + r.URL.Path {
+		case "GET /v2/credentials/task":
+			if r.Header.Get("Authorization") != "" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(`{"AccessKeyId":"ECS","SecretAccessKey":"s","Token":"t","Expiration":"` + expiration + `"}`))
+		case "PUT /latest/api/token":
+			w.Write([]byte("imds-token"))
+		case "GET /latest/meta-data/iam/security-credentials/":
+			w.Write([]byte("web\n"))
+		case "GET /latest/meta-data/iam/security-credentials/web":
+			if r.Header.Get("X-Aws-Ec2-Metadata-Token") != "imds-token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(`{"Code":"Success","AccessKeyId":"EC2","SecretAccessKey":"s","Token":"t","Expiration":"` + expiration + `"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	ctx := context.Background()
+
+	p := &roleCredentials{client: server.Client(), ecsURL: server.URL, ec2URL: server.URL}
+	creds, err := p.Credentials(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.AccessKeyID != "EC2" || creds.SessionToken != "t" {
+		t.Errorf("expected the credentials of the instance profile, got %+v", creds)
+	}
+	fetched := fetches
+	if _, err := p.Credentials(ctx); err != nil || fetches != fetched {
+		t.Errorf("expected the credentials to be cached, got %d fetches, %v", fetches-fetched, err)
+	}
+
+	t.Setenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI", "/v2/credentials/task")
+	p = &roleCredentials{client: server.Client(), ecsURL: server.URL, ec2URL: server.URL}
+	if creds, err = p.Credentials(ctx); err != nil || creds.AccessKeyID != "ECS" {
+		t.Errorf("expected the credentials of the task role, got %+v, %v", creds, err)
+	}
+	t.Setenv("AWS_CONTAINER_AUTHORIZATION_TOKEN", "wrong")
+	p = &roleCredentials{client: server.Client(), ecsURL: server.URL, ec2URL: server.URL}
+	if _, err = p.Credentials(ctx); err == nil {
+		t.Error("expected a rejected container credentials request to fail")
+	}
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "ENV")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "s")
+	if creds, err = DefaultAWSCredentials(nil)(ctx); err != nil || creds.AccessKeyID != "ENV" {
+		t.Errorf("expected the credentials of the environment, got %+v, %v", creds, err)
+	}
+}
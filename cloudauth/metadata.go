@@ -0,0 +1,76 @@
+package cloudauth
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	// gcpMetadataHost is the metadata server of Compute Engine.
+	gcpMetadataHost = "http://metadata.google.internal"
+
+	// azureMetadataHost is the instance metadata service of Azure.
+	azureMetadataHost = "http://169.254.169.254"
+)
+
+// InstanceMetadata fetches a value set for the instance from the
+// metadata service of its cloud, as selected by source:
+//
+//	aws:<tag>        the instance tag, with tags in instance metadata allowed
+//	gcp:<attribute>  the custom metadata attribute of the instance
+//	azure            the user data of the virtual machine
+//
+// None of them is the user data read by cloud-init. client fetches
+// it, http.DefaultClient if it is nil.
+func InstanceMetadata(ctx context.Context, client *http.Client, source string) ([]byte, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	m := &metadataService{client: client, ec2URL: ec2MetadataURL, gcpURL: gcpMetadataHost, azureURL: azureMetadataHost}
+	return m.get(ctx, source)
+}
+
+// metadataService fetches values from the metadata services at
+// their URLs, replaced by tests.
+type metadataService struct {
+	client                   *http.Client
+	ec2URL, gcpURL, azureURL string
+}
+
+func (m *metadataService) get(ctx context.Context, source string) ([]byte, error) {
+	provider, name := source, ""
+	if i := strings.IndexByte(source, ':'); i >= 0 {
+		provider, name = source[:i], source[i+1:]
+	}
+	switch {
+	case provider == "aws" && name != "":
+		// version 2 of the instance metadata service
+		token, err := fetchMetadata(ctx, m.client, http.MethodPut, m.ec2URL+"/latest/api/token", http.Header{
+			"X-Aws-Ec2-Metadata-Token-Ttl-Seconds": {"300"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		return fetchMetadata(ctx, m.client, http.MethodGet, m.ec2URL+"/latest/meta-data/tags/instance/"+url.PathEscape(name), http.Header{
+			"X-Aws-Ec2-Metadata-Token": {string(token)},
+		})
+	case provider == "gcp" && name != "":
+		return fetchMetadata(ctx, m.client, http.MethodGet, m.gcpURL+"/computeMetadata/v1/instance/attributes/"+url.PathEscape(name), http.Header{
+			"Metadata-Flavor": {"Google"},
+		})
+	case provider == "azure" && name == "":
+		data, err := fetchMetadata(ctx, m.client, http.MethodGet, m.azureURL+"/metadata/instance/compute/userData?api-version=2021-01-01&format=text", http.Header{
+			"Metadata": {"true"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		return base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	default:
+		return nil, fmt.Errorf("cloudauth: unknown instance metadata %q, expected aws:<tag>, gcp:<attribute> or azure", source)
+	}
+}
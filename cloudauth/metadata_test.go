@@ -0,0 +1,53 @@
+package cloudauth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestInstanceMetadata(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + r.URL.Path {
+		case "PUT /latest/api/token":
+			w.Write([]byte("imds-token"))
+		case "GET /latest/meta-data/tags/instance/scep-config":
+			if r.Header.Get("X-Aws-Ec2-Metadata-Token") != "imds-token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte("aws"))
+		case "GET /computeMetadata/v1/instance/attributes/scep-config":
+			if r.Header.Get("Metadata-Flavor") != "Google" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			w.Write([]byte("gcp"))
+		case "GET /metadata/instance/compute/userData":
+			if r.Header.Get("Metadata") != "true" || r.FormValue("format") != "text" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.Write([]byte("YXp1cmU=\n"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	m := &metadataService{client: server.Client(), ec2URL: server.URL, gcpURL: server.URL, azureURL: server.URL}
+	ctx := context.Background()
+
+	for source, want := range map[string]string{"aws:scep-config": "aws", "gcp:scep-config": "gcp", "azure": "azure"} {
+		if got, err := m.get(ctx, source); err != nil || string(got) != want {
+			t.Errorf("%s: expected %q, got %q, %v", source, want, got, err)
+		}
+	}
+	if _, err := m.get(ctx, "gcp:missing"); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("expected a missing attribute to fail, got %v", err)
+	}
+	if _, err := m.get(ctx, "aws"); err == nil || !strings.Contains(err.Error(), "unknown instance metadata") {
+		t.Errorf("expected aws without tag to fail, got %v", err)
+	}
+}
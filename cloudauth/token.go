@@ -0,0 +1,173 @@
+package cloudauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// azureMetadataURL returns tokens of the managed identity of the instance.
+	azureMetadataURL = "http://169.254.169.254/metadata/identity/oauth2/token?api-version=2018-02-01"
+
+	// azureAuthorityHost issues tokens for the applications of a
+	// tenant of the Azure public cloud, unless AZURE_AUTHORITY_HOST
+	// selects another, as it does for the Azure SDKs.
+	azureAuthorityHost = "https://login.microsoftonline.com"
+
+	// gcpMetadataURL returns tokens of the service account of the instance.
+	gcpMetadataURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+)
+
+// TokenSource returns an OAuth 2.0 access token
+// for Google Cloud or Azure.
+type TokenSource func(ctx context.Context) (string, error)
+
+// StaticToken returns a TokenSource returning token, which
+// the caller must replace before it expires.
+func StaticToken(token string) TokenSource {
+	return func(ctx context.Context) (string, error) {
+		return token, nil
+	}
+}
+
+// AzureManagedIdentity returns a TokenSource fetching tokens for
+// resource, e.g. https://vault.azure.net, of the managed identity of
+// the instance from the instance metadata service. clientID selects
+// one of several user-assigned identities, and may be empty.
+func AzureManagedIdentity(client *http.Client, resource, clientID string) TokenSource {
+	u := azureMetadataURL + "&resource=" + url.QueryEscape(resource)
+	if clientID != "" {
+		u += "&client_id=" + url.QueryEscape(clientID)
+	}
+	t := &cachedToken{
+		client: client,
+		newRequest: func(ctx context.Context) (*http.Request, error) {
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+			if err != nil {
+				return nil, err
+			}
+			req.Header.Set("Metadata", "true")
+			return req, nil
+		},
+	}
+	return t.Token
+}
+
+// AzureClientCredentials returns a TokenSource fetching tokens for
+// scope, e.g. https://vault.azure.net/.default, of the application
+// clientID of tenantID, with the client credentials grant.
+func AzureClientCredentials(client *http.Client, tenantID, clientID, clientSecret, scope string) TokenSource {
+	host := os.Getenv("AZURE_AUTHORITY_HOST")
+	if host == "" {
+		host = azureAuthorityHost
+	}
+	u := strings.TrimSuffix(host, "/") + "/" + url.PathEscape(tenantID) + "/oauth2/v2.0/token"
+	form := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {clientID},
+		"client_secret": {clientSecret},
+		"scope":         {scope},
+	}.Encode()
+	t := &cachedToken{
+		client: client,
+		newRequest: func(ctx context.Context) (*http.Request, error) {
+			req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, strings.NewReader(form))
+			if err != nil {
+				return nil, err
+			}
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			return req, nil
+		},
+	}
+	return t.Token
+}
+
+// GCPMetadataToken returns a TokenSource fetching tokens of the
+// service account of the instance from the metadata server.
+func GCPMetadataToken(client *http.Client) TokenSource {
+	t := &cachedToken{
+		client: client,
+		newRequest: func(ctx context.Context) (*http.Request, error) {
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, gcpMetadataURL, nil)
+			if err != nil {
+				return nil, err
+			}
+			req.Header.Set("Metadata-Flavor", "Google")
+			return req, nil
+		},
+	}
+	return t.Token
+}
+
+// cachedToken fetches access tokens with the requests of newRequest,
+// and caches them until shortly before they expire.
+type cachedToken struct {
+	client     *http.Client
+	newRequest func(ctx context.Context) (*http.Request, error)
+
+	mtx    sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+func (t *cachedToken) Token(ctx context.Context) (string, error) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if t.token != "" && time.Now().Before(t.expiry) {
+		return t.token, nil
+	}
+	req, err := t.newRequest(ctx)
+	if err != nil {
+		return "", err
+	}
+	client := t.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("cloudauth: get access token: %w", err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return "", fmt.Errorf("cloudauth: get access token: %w", err)
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		// the Azure instance metadata service sends the lifetime as a string
+		ExpiresIn json.RawMessage `json:"expires_in"`
+
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	jsonErr := json.Unmarshal(data, &token)
+	if resp.StatusCode/100 != 2 {
+		message := strings.TrimSpace(string(data))
+		if jsonErr == nil && token.Error != "" {
+			message = token.Error + ": " + token.ErrorDescription
+		}
+		return "", fmt.Errorf("cloudauth: get access token: %s: %s", resp.Status, message)
+	}
+	if jsonErr != nil {
+		return "", fmt.Errorf("cloudauth: get access token: %w", jsonErr)
+	}
+	if token.AccessToken == "" {
+		return "", errors.New("cloudauth: no access token in the response")
+	}
+	seconds, _ := strconv.Atoi(strings.Trim(string(token.ExpiresIn), `"`))
+	t.token = token.AccessToken
+	t.expiry = time.Now().Add(time.Duration(seconds)*time.Second - time.Minute)
+	return t.token, nil
+}
@@ -0,0 +1,43 @@
+package cloudauth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAzureClientCredentials(t *testing.T) {
+	var fetches int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		if r.URL.Path != "/tenant/oauth2/v2.0/token" || r.FormValue("grant_type") != "client_credentials" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.FormValue("client_id") != "app" || r.FormValue("client_secret") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error":"invalid_client","error_description":"AADSTS7000215: Invalid client secret provided."}`))
+			return
+		}
+		w.Write([]byte(`{"token_type":"Bearer","expires_in":3599,"access_token":"token"}`))
+	}))
+	defer server.Close()
+	t.Setenv("AZURE_AUTHORITY_HOST", server.URL)
+	ctx := context.Background()
+
+	token := AzureClientCredentials(nil, "tenant", "app", "secret", "https://vault.azure.net/.default")
+	for i := 0; i < 2; i++ {
+		if got, err := token(ctx); err != nil || got != "token" {
+			t.Fatalf("expected the access token, got %q, %v", got, err)
+		}
+	}
+	if fetches != 1 {
+		t.Errorf("expected the token to be cached, got %d fetches", fetches)
+	}
+	token = AzureClientCredentials(nil, "tenant", "app", "wrong", "https://vault.azure.net/.default")
+	if _, err := token(ctx); err == nil || !strings.Contains(err.Error(), "AADSTS7000215") {
+		t.Errorf("expected the error of the token endpoint, got %v", err)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"strings"
+
+	"scepclient/client/acmeissuer"
+)
+
+const ecPrivateKeyPEMBlockType = "EC PRIVATE KEY"
+
+// acmeCfg configures enrollment with an ACME CA, instead of the
+// SCEP or CMP server or when enrolling with it fails.
+type acmeCfg struct {
+	directory string
+	issuer    *acmeissuer.Issuer
+
+	// primary enrolls with the ACME CA only,
+	// instead of falling back to it.
+	primary bool
+
+	// dnsNames are requested with the -cn.
+	dnsNames []string
+}
+
+// newACMECfg returns the configuration of the ACME flags, loading or
+// creating the account key and answering the challenges with files in
+// webroot, or else with a server listening on listen.
+func newACMECfg(directory, mode, accountKeyPath, email, eabKID, eabHMACFile, listen, webroot, dnsNames string) (*acmeCfg, error) {
+	cfg := &acmeCfg{directory: directory, dnsNames: splitList(dnsNames)}
+	switch mode {
+	case "primary":
+		cfg.primary = true
+	case "fallback":
+	default:
+		return nil, fmt.Errorf("unknown ACME mode %q, must be primary or fallback", mode)
+	}
+	accountKey, err := loadOrMakeECKey(accountKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("ACME account key: %w", err)
+	}
+	config := acmeissuer.Config{
+		DirectoryURL: directory,
+		AccountKey:   accountKey,
+		Email:        email,
+		EABKeyID:     eabKID,
+		Solver:       &acmeissuer.Listener{Addr: listen},
+	}
+	if webroot != "" {
+		config.Solver = acmeissuer.Webroot(webroot)
+	}
+	if eabKID != "" {
+		hmac, err := readSecret(eabHMACFile, "SCEPCLIENT_ACME_EAB_HMAC")
+		if err != nil {
+			return nil, err
+		}
+		// the CAs hand out the keys in base64url, with or without padding
+		if config.EABKey, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(hmac, "=")); err != nil {
+			return nil, fmt.Errorf("ACME EAB HMAC key: %w", err)
+		}
+	}
+	if cfg.issuer, err = acmeissuer.NewIssuer(config); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// runWithACME enrolls with the ACME CA of cfg.acme, if it is primary,
+// or else with the SCEP or CMP server, then with the ACME CA if it fails.
+func runWithACME(cfg runCfg) error {
+	if cfg.acme.primary {
+		return runACME(cfg)
+	}
+	acme := cfg.acme
+	cfg.acme = nil
+	err := run(cfg)
+	if err == nil {
+		return nil
+	}
+	newLogger(cfg.debug, cfg.logfmt).Warn("enrollment failed, falling back to ACME.", "err", err, "directory", acme.directory)
+	cfg.acme = acme
+	if acmeErr := runACME(cfg); acmeErr != nil {
+		return fmt.Errorf("%v, then ACME: %w", err, acmeErr)
+	}
+	return nil
+}
+
+// runACME enrolls the key of cfg with the ACME CA of cfg.acme, for the
+// -cn and the ACME DNS names, and writes the certificate to the same
+// certificate file and outputs as SCEP.
+func runACME(cfg runCfg) error {
+	ctx := context.Background()
+	logger := newLogger(cfg.debug, cfg.logfmt)
+	slog.SetDefault(logger)
+
+	key, err := loadOrMakeKey(cfg.keyPath, cfg.keyBits)
+	if err != nil {
+		return err
+	}
+	// the CSR file of SCEP has no DNS names, and a challenge
+	// password the ACME CAs do not need to see
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:            pkix.Name{CommonName: cfg.cn},
+		DNSNames:           cfg.acme.dnsNames,
+		SignatureAlgorithm: x509.SHA256WithRSA,
+	}, key)
+	if err != nil {
+		return err
+	}
+
+	logger.Info("ordering the certificate.", "directory", cfg.acme.directory)
+	certs, err := cfg.acme.issuer.Issue(ctx, csr)
+	if err != nil {
+		return err
+	}
+	logger.Info("ACME CA returned a certificate.", "serial", certs[0].SerialNumber)
+	return writeCertificate(ctx, cfg, logger, key, certs[0], certs[1:])
+}
+
+// loadOrMakeECKey loads the P-256 key at path,
+// or creates it if there is none.
+func loadOrMakeECKey(path string) (*ecdsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil || block.Type != ecPrivateKeyPEMBlockType {
+			return nil, fmt.Errorf("%s: expected an %s", path, ecPrivateKeyPEMBlockType)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if err := pem.Encode(file, &pem.Block{Type: ecPrivateKeyPEMBlockType, Bytes: der}); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"scepclient/scepserver"
+)
+
+// admin lists, searches and revokes the certificates issued by serve,
+// and lists its pending transactions, with the API of -admin-path.
+func admin(args []string) error {
+	fs := flag.NewFlagSet("scepclient admin", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: scepclient admin [flags] list|revoke|pending")
+		fs.PrintDefaults()
+	}
+	var (
+		flURL   = fs.String("url", "http://localhost:8080/admin/", "URL of the -admin-path of serve")
+		flToken = fs.String("token", os.Getenv("SCEPSERVER_ADMIN_TOKEN"), "bearer token of the admin API, the -admin-token of serve")
+		flJSON  = fs.Bool("json", false, "print the JSON responses of the admin API")
+
+		// list filters
+		flCN            = fs.String("cn", "", "list the certificates whose common name matches this pattern, e.g. 'device-*'")
+		flStatus        = fs.String("status", "", "list the valid, expired or revoked certificates")
+		flIssuedAfter   = fs.String("issued-after", "", "list the certificates issued after this RFC 3339 time")
+		flIssuedBefore  = fs.String("issued-before", "", "list the certificates issued before this RFC 3339 time")
+		flExpiresAfter  = fs.String("expires-after", "", "list the certificates expiring after this RFC 3339 time")
+		flExpiresBefore = fs.String("expires-before", "", "list the certificates expiring before this RFC 3339 time")
+
+		flSerial = fs.String("serial", "", "serial number of the certificate to list or revoke, in hex")
+		flReason = fs.String("reason", "unspecified", "revocation reason, e.g. keyCompromise or superseded")
+	)
+	// flags may follow the command
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	command := fs.Arg(0)
+	if fs.NArg() > 0 {
+		if err := fs.Parse(fs.Args()[1:]); err != nil {
+			return err
+		}
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments %q", fs.Args())
+	}
+	base, err := url.Parse(*flURL)
+	if err != nil {
+		return fmt.Errorf("invalid -url: %w", err)
+	}
+	if !strings.HasSuffix(base.Path, "/") {
+		base.Path += "/"
+	}
+	client := &adminClient{base: base, token: *flToken}
+
+	switch command {
+	case "list":
+		q := make(url.Values)
+		for name, value := range map[string]string{
+			"cn":             *flCN,
+			"serial":         *flSerial,
+			"status":         *flStatus,
+			"issued_after":   *flIssuedAfter,
+			"issued_before":  *flIssuedBefore,
+			"expires_after":  *flExpiresAfter,
+			"expires_before": *flExpiresBefore,
+		} {
+			if value != "" {
+				q.Set(name, value)
+			}
+		}
+		body, err := client.do(http.MethodGet, "certificates?"+q.Encode(), nil)
+		if err != nil || *flJSON {
+			os.Stdout.Write(body)
+			return err
+		}
+		var certs []scepserver.AdminCertificate
+		if err := json.Unmarshal(body, &certs); err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "SERIAL\tSTATUS\tNOT AFTER\tSUBJECT")
+		for _, crt := range certs {
+			status := crt.Status
+			if crt.RevocationReason != "" {
+				status += " (" + crt.RevocationReason + ")"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", crt.Serial, status, crt.NotAfter.Format(time.RFC3339), crt.Subject)
+		}
+		return tw.Flush()
+	case "revoke":
+		if *flSerial == "" {
+			return errors.New("revoke requires a -serial")
+		}
+		form := url.Values{"reason": {*flReason}}
+		if _, err := client.do(http.MethodPost, "certificates/"+url.PathEscape(*flSerial)+"/revoke", form); err != nil {
+			return err
+		}
+		fmt.Printf("revoked certificate %s (%s)\n", *flSerial, *flReason)
+		return nil
+	case "pending":
+		body, err := client.do(http.MethodGet, "pending", nil)
+		if err != nil || *flJSON {
+			os.Stdout.Write(body)
+			return err
+		}
+		var pending []scepserver.PendingTransaction
+		if err := json.Unmarshal(body, &pending); err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "TRANSACTION\tATTEMPTS\tFIRST SEEN\tLAST SEEN\tREQUESTER\tSUBJECT\tREASON")
+		for _, tx := range pending {
+			fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\t%s\t%s\n", tx.TransactionID, tx.Attempts,
+				tx.FirstSeen.Format(time.RFC3339), tx.LastSeen.Format(time.RFC3339), tx.Requester, tx.Subject, tx.Reason)
+		}
+		return tw.Flush()
+	case "":
+		fs.Usage()
+		return errors.New("missing command")
+	default:
+		return fmt.Errorf("unknown command %q, expected list, revoke or pending", command)
+	}
+}
+
+// adminClient sends requests to the admin API of serve at base.
+type adminClient struct {
+	base  *url.URL
+	token string
+}
+
+// do sends a request to ref, relative to the base URL, with form as
+// form encoded body unless it is nil, and returns the response body.
+// Error responses fail with their message.
+func (c *adminClient) do(method, ref string, form url.Values) ([]byte, error) {
+	u, err := c.base.Parse(ref)
+	if err != nil {
+		return nil, err
+	}
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 64<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("%s %s: %s: %s", method, u.Redacted(), resp.Status, strings.TrimSpace(string(data)))
+	}
+	return data, nil
+}
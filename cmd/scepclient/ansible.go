@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	scepclient "scepclient/client"
+)
+
+// ansibleResult is the result of the Ansible module mode, in the JSON
+// printed by modules: changed, failed and msg, and the artifacts.
+type ansibleResult struct {
+	Changed     bool       `json:"changed"`
+	Failed      bool       `json:"failed"`
+	Msg         string     `json:"msg"`
+	Certificate string     `json:"certificate"`
+	PrivateKey  string     `json:"private_key"`
+	CSR         string     `json:"csr"`
+	DeployCert  string     `json:"deploy_cert,omitempty"`
+	DeployKey   string     `json:"deploy_key,omitempty"`
+	Dot1xConfig string     `json:"dot1x_config,omitempty"`
+	Serial      string     `json:"serial,omitempty"`
+	NotAfter    *time.Time `json:"not_after,omitempty"`
+	RenewAt     *time.Time `json:"renew_at,omitempty"`
+
+	// Stderr is the output of a failed enrollment.
+	Stderr string `json:"stderr,omitempty"`
+}
+
+// ansible runs the client as an Ansible module, with the flags of the
+// command line args and the arguments of the module in the JSON file
+// argsFile, if set, as Ansible passes them to WANT_JSON modules. It
+// enrolls only if the key and certificate are missing, do not match,
+// or are due for renewal, unless in check mode, with the flags of the
+// command line and of the arguments in a child process whose output is
+// kept from stdout, which has the ansibleResult. It returns the exit
+// code.
+func ansible(args []string, argsFile string) int {
+	var result ansibleResult
+	exit := func(err error) int {
+		code := 0
+		if err != nil {
+			result.Failed, result.Msg, code = true, err.Error(), 1
+		}
+		data, _ := json.Marshal(result)
+		fmt.Println(string(data))
+		return code
+	}
+
+	// the ansible flag and the arguments file are left out of the child
+	var childArgs []string
+	for _, arg := range args {
+		switch arg {
+		case "-ansible", "--ansible", "-ansible=true", "--ansible=true":
+		default:
+			childArgs = append(childArgs, arg)
+		}
+	}
+	var checkMode bool
+	if argsFile != "" {
+		data, err := ioutil.ReadFile(argsFile)
+		if err != nil {
+			return exit(err)
+		}
+		var moduleArgs map[string]interface{}
+		if err := json.Unmarshal(data, &moduleArgs); err != nil {
+			return exit(fmt.Errorf("arguments of the module: %w", err))
+		}
+		checkMode = moduleArgs["_ansible_check_mode"] == true
+		for name := range moduleArgs {
+			if strings.HasPrefix(name, "_ansible") || name == "ansible" {
+				delete(moduleArgs, name)
+			}
+		}
+		moduleFlags, err := jsonFlags(moduleArgs)
+		if err != nil {
+			return exit(fmt.Errorf("arguments of the module: %w", err))
+		}
+		// set them here too, to check them and to read the paths
+		for _, f := range moduleFlags {
+			name, value, _ := strings.Cut(strings.TrimPrefix(f, "-"), "=")
+			if err := flag.Set(name, value); err != nil {
+				return exit(fmt.Errorf("argument %s: %w", name, err))
+			}
+		}
+		childArgs = append(childArgs, moduleFlags...)
+	}
+	if flag.Lookup("sidecar").Value.String() == "true" {
+		return exit(fmt.Errorf("-ansible enrolls once, without -sidecar"))
+	}
+	result.PrivateKey = flag.Lookup("private-key").Value.String()
+	if result.PrivateKey == "" {
+		return exit(fmt.Errorf("private-key is required"))
+	}
+	// the paths of the main command
+	dir := filepath.Dir(result.PrivateKey)
+	result.Certificate = flag.Lookup("certificate").Value.String()
+	if result.Certificate == "" {
+		result.Certificate = dir + "/client.pem"
+	}
+	result.CSR = dir + "/csr.pem"
+	result.DeployCert = flag.Lookup("deploy-cert").Value.String()
+	result.DeployKey = flag.Lookup("deploy-key").Value.String()
+	result.Dot1xConfig = flag.Lookup("dot1x-config").Value.String()
+
+	describe := func(cert *x509.Certificate) {
+		renewAt := scepclient.DefaultRenewalPolicy.RenewAt(cert)
+		result.Serial, result.NotAfter, result.RenewAt = cert.SerialNumber.Text(16), &cert.NotAfter, &renewAt
+	}
+	if cert, err := loadKeyPair(result.Certificate, result.PrivateKey); err == nil && !scepclient.DefaultRenewalPolicy.Due(cert) {
+		describe(cert)
+		result.Msg = "the certificate is valid, and due for renewal at " + result.RenewAt.UTC().Format(time.RFC3339)
+		return exit(nil)
+	}
+	result.Changed = true
+	if checkMode {
+		result.Msg = "the certificate would be enrolled"
+		return exit(nil)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return exit(err)
+	}
+	var out bytes.Buffer
+	cmd := exec.Command(exe, childArgs...)
+	cmd.Stdout, cmd.Stderr = &out, &out
+	if err := cmd.Run(); err != nil {
+		result.Changed, result.Stderr = false, out.String()
+		// the client prints the error last
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		return exit(fmt.Errorf("enrollment: %w: %s", err, lines[len(lines)-1]))
+	}
+	cert, err := loadKeyPair(result.Certificate, result.PrivateKey)
+	if err != nil {
+		return exit(err)
+	}
+	describe(cert)
+	result.Msg = "enrolled the certificate, valid until " + cert.NotAfter.UTC().Format(time.RFC3339)
+	return exit(nil)
+}
+
+// loadKeyPair returns the certificate of certPath if it is the
+// certificate of the key of keyPath.
+func loadKeyPair(certPath, keyPath string) (*x509.Certificate, error) {
+	pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(pair.Certificate[0])
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"scepclient/scepserver"
+)
+
+// openAuditor returns the auditor writing the audit events in format,
+// json, cef or leef, to the file logPath, - for standard output, and to
+// the syslog daemon syslogAddr, see openSyslog. The auditor is nil if
+// both are empty. Close the returned files once done.
+func openAuditor(format, logPath, syslogAddr string) (scepserver.Auditor, []io.Closer, error) {
+	newAuditor := map[string]func(w io.Writer) scepserver.Auditor{
+		"json": scepserver.NewJSONAuditor,
+		"cef":  func(w io.Writer) scepserver.Auditor { return scepserver.NewCEFAuditor(w, version) },
+		"leef": func(w io.Writer) scepserver.Auditor { return scepserver.NewLEEFAuditor(w, version) },
+	}[format]
+	if newAuditor == nil {
+		return nil, nil, fmt.Errorf("unknown -audit-format %q, expected json, cef or leef", format)
+	}
+	var (
+		auditors []scepserver.Auditor
+		closers  []io.Closer
+	)
+	if logPath != "" {
+		var w io.Writer = os.Stdout
+		if logPath != "-" {
+			f, err := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+			if err != nil {
+				return nil, nil, err
+			}
+			closers = append(closers, f)
+			w = f
+		}
+		auditors = append(auditors, newAuditor(w))
+	}
+	if syslogAddr != "" {
+		w, err := openSyslog(syslogAddr)
+		if err != nil {
+			for _, c := range closers {
+				c.Close()
+			}
+			return nil, nil, fmt.Errorf("-audit-syslog: %w", err)
+		}
+		closers = append(closers, w)
+		auditors = append(auditors, newAuditor(w))
+	}
+	switch len(auditors) {
+	case 0:
+		return nil, nil, nil
+	case 1:
+		return auditors[0], closers, nil
+	}
+	return scepserver.MultiAuditor(auditors...), closers, nil
+}
+
+// openSyslog connects to the syslog daemon at addr: local for the
+// daemon of the host, udp://host:port or tcp://host:port, or host:port
+// for UDP.
+func openSyslog(addr string) (io.WriteCloser, error) {
+	if addr == "local" {
+		return scepserver.NewSyslogWriter("", "", "scepclient")
+	}
+	network := "udp"
+	if strings.Contains(addr, "://") {
+		u, err := url.Parse(addr)
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme != "udp" && u.Scheme != "tcp" {
+			return nil, fmt.Errorf("unsupported syslog network %q, expected udp or tcp", u.Scheme)
+		}
+		network, addr = u.Scheme, u.Host
+	}
+	return scepserver.NewSyslogWriter(network, addr, "scepclient")
+}
+
+// recordAudit records ev with the outcome, logging the failures, which
+// do not fail the enrollment.
+func recordAudit(ctx context.Context, auditor scepserver.Auditor, ev *scepserver.AuditEvent, outcome scepserver.AuditOutcome, logger *slog.Logger) {
+	ev.Time, ev.Outcome = time.Now(), outcome
+	if err := auditor.Audit(ctx, ev); err != nil {
+		logger.Error("recording the audit event.", "err", err)
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	scepclient "scepclient/client"
+	"scepclient/cloudauth"
+)
+
+// bootstrapStatus is the status printed by bootstrap, as one line of
+// JSON, for cloud-init, Ignition or the provisioning tooling.
+type bootstrapStatus struct {
+	// Status is enrolled, valid if the certificate was not due for
+	// renewal, or failed.
+	Status      string     `json:"status"`
+	Certificate string     `json:"certificate,omitempty"`
+	PrivateKey  string     `json:"private_key,omitempty"`
+	Serial      string     `json:"serial,omitempty"`
+	NotAfter    *time.Time `json:"not_after,omitempty"`
+	Timer       string     `json:"timer,omitempty"`
+	Error       string     `json:"error,omitempty"`
+}
+
+// The exit codes of bootstrap.
+const (
+	bootstrapOK     = 0
+	bootstrapFailed = 1
+	bootstrapConfig = 2
+)
+
+// bootstrap enrolls once at the first boot of a machine, e.g. from the
+// runcmd of cloud-init or a unit written by Ignition: it reads the
+// flags of the enrollment from a JSON config, enrolls unless the
+// certificate is valid and not due for renewal, and installs a systemd
+// timer running it again to renew the certificate. It prints a
+// bootstrapStatus and returns the exit code.
+func bootstrap(args []string) int {
+	fs := flag.NewFlagSet("scepclient bootstrap", flag.ExitOnError)
+	var (
+		flConfig     = fs.String("config", "/etc/scepclient/bootstrap.json", `JSON object of the flags of the enrollment, e.g. {"server-url": "https://scep.example.com/scep", "private-key": "/etc/scep/key.pem", "certificate": "/etc/scep/cert.pem", "cn": "${HOSTNAME}"}: a file, - for stdin, an http or https URL, or instance metadata: aws:<tag>, gcp:<attribute>, or azure for the user data of the VM`)
+		flSaveConfig = fs.String("save-config", "/etc/scepclient/bootstrap.json", "file receiving the config, readable by its owner only, which the timer renews with")
+		flTimer      = fs.String("timer", "scepclient-renew", "name of the systemd service and timer renewing the certificate, none for no timer")
+		flUnitDir    = fs.String("unit-dir", "/etc/systemd/system", "directory receiving the units of -timer")
+		flCalendar   = fs.String("on-calendar", "daily", "OnCalendar of -timer, when it checks whether the certificate is due for renewal")
+		flSystemctl  = fs.Bool("systemctl", true, "enable and start -timer with systemctl")
+		flStatusFile = fs.String("status-file", "", "also write the JSON status to this file")
+	)
+	if err := fs.Parse(args); err != nil {
+		return bootstrapConfig
+	}
+	var status bootstrapStatus
+	exit := func(code int, err error) int {
+		if err != nil {
+			status.Status, status.Error = "failed", err.Error()
+		}
+		data, _ := json.Marshal(status)
+		data = append(data, '\n')
+		os.Stdout.Write(data)
+		if *flStatusFile != "" {
+			if err := ioutil.WriteFile(*flStatusFile, data, 0644); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+		}
+		return code
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	config, err := readBootstrapConfig(ctx, *flConfig)
+	cancel()
+	if err != nil {
+		return exit(bootstrapConfig, fmt.Errorf("reading -config: %w", err))
+	}
+	clientArgs, err := bootstrapArgs(config, &status)
+	if err != nil {
+		return exit(bootstrapConfig, fmt.Errorf("-config: %w", err))
+	}
+	configPath := *flConfig
+	if *flSaveConfig != "" && filepath.Clean(*flSaveConfig) != filepath.Clean(*flConfig) {
+		if err := os.MkdirAll(filepath.Dir(*flSaveConfig), 0700); err != nil {
+			return exit(bootstrapConfig, err)
+		}
+		if err := ioutil.WriteFile(*flSaveConfig, config, 0600); err != nil {
+			return exit(bootstrapConfig, err)
+		}
+		configPath = *flSaveConfig
+	}
+
+	// the timer is installed first, retrying a failed enrollment
+	exe, err := os.Executable()
+	if err != nil {
+		return exit(bootstrapFailed, err)
+	}
+	if *flTimer != "none" && *flTimer != "" {
+		if _, err := os.Stat(configPath); err != nil {
+			return exit(bootstrapConfig, errors.New("-timer requires -save-config unless -config is a file"))
+		}
+		if err := installTimer(*flTimer, *flUnitDir, *flCalendar, exe, configPath, *flSystemctl); err != nil {
+			return exit(bootstrapFailed, fmt.Errorf("installing -timer: %w", err))
+		}
+		status.Timer = *flTimer + ".timer"
+	}
+
+	status.Status = "valid"
+	cert, err := loadPEMCertFromFile(status.Certificate)
+	if err != nil || scepclient.DefaultRenewalPolicy.Due(cert) {
+		// the output of the client goes to stderr, stdout has the status
+		cmd := exec.Command(exe, clientArgs...)
+		cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+		if err := cmd.Run(); err != nil {
+			return exit(bootstrapFailed, fmt.Errorf("enrollment: %w", err))
+		}
+		status.Status = "enrolled"
+		if cert, err = loadPEMCertFromFile(status.Certificate); err != nil {
+			return exit(bootstrapFailed, err)
+		}
+	}
+	status.Serial = cert.SerialNumber.Text(16)
+	status.NotAfter = &cert.NotAfter
+	return exit(bootstrapOK, nil)
+}
+
+// readBootstrapConfig reads the config of bootstrap from source.
+func readBootstrapConfig(ctx context.Context, source string) ([]byte, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	switch {
+	case source == "-":
+		return ioutil.ReadAll(os.Stdin)
+	case strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://"):
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("GET %s: %s", source, resp.Status)
+		}
+		return ioutil.ReadAll(resp.Body)
+	case strings.HasPrefix(source, "aws:") || strings.HasPrefix(source, "gcp:") || source == "azure":
+		return cloudauth.InstanceMetadata(ctx, client, source)
+	default:
+		return ioutil.ReadFile(source)
+	}
+}
+
+// bootstrapArgs turns the JSON object of config into the flags of the
+// client, and records the paths of the key and certificate in status.
+func bootstrapArgs(config []byte, status *bootstrapStatus) ([]string, error) {
+	var flags map[string]interface{}
+	if err := json.Unmarshal(config, &flags); err != nil {
+		return nil, err
+	}
+	args, err := jsonFlags(flags)
+	if err != nil {
+		return nil, err
+	}
+	if flagValue(args, "sidecar") != "" {
+		return nil, errors.New("sidecar: bootstrap enrolls once, and renews with its timer")
+	}
+	status.Certificate, status.PrivateKey = flagValue(args, "certificate"), flagValue(args, "private-key")
+	if status.Certificate == "" || status.PrivateKey == "" {
+		return nil, errors.New("certificate and private-key are required")
+	}
+	return args, nil
+}
+
+// jsonFlags turns a JSON object of the names and values of flags into
+// flags, -name=value, in the order of their names. Lists are repeated
+// flags, null values are left out, and ${HOSTNAME} is replaced by the
+// hostname, so that machines can share a config.
+func jsonFlags(flags map[string]interface{}) ([]string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(flags))
+	for name := range flags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var args []string
+	for _, name := range names {
+		var values []string
+		switch v := flags[name].(type) {
+		case nil:
+			continue
+		case string:
+			values = []string{v}
+		case bool:
+			values = []string{strconv.FormatBool(v)}
+		case float64:
+			values = []string{strconv.FormatFloat(v, 'f', -1, 64)}
+		case []interface{}:
+			for _, e := range v {
+				s, ok := e.(string)
+				if !ok {
+					return nil, fmt.Errorf("%s: expected a list of strings", name)
+				}
+				values = append(values, s)
+			}
+		default:
+			return nil, fmt.Errorf("%s: expected a string, number, boolean or list of strings", name)
+		}
+		for _, value := range values {
+			args = append(args, "-"+strings.TrimLeft(name, "-")+"="+strings.ReplaceAll(value, "${HOSTNAME}", hostname))
+		}
+	}
+	return args, nil
+}
+
+// flagValue returns the value of the last flag name of args,
+// as written by jsonFlags.
+func flagValue(args []string, name string) string {
+	var value string
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "-"+name+"=") {
+			value = strings.TrimPrefix(arg, "-"+name+"=")
+		}
+	}
+	return value
+}
+
+// installTimer writes the systemd service and timer name, running
+// bootstrap with config on calendar, and enables the timer with
+// systemctl if enable is set.
+func installTimer(name, dir, calendar, exe, config string, enable bool) error {
+	service := fmt.Sprintf(`[Unit]
+Description=Renew the certificate enrolled by scepclient bootstrap
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+Type=oneshot
+ExecStart=%s bootstrap %s -save-config= -timer=none
+`, systemdQuote(exe), systemdQuote("-config="+config))
+	timer := fmt.Sprintf(`[Unit]
+Description=Renew the certificate enrolled by scepclient bootstrap
+
+[Timer]
+OnCalendar=%s
+RandomizedDelaySec=1h
+Persistent=true
+
+[Install]
+WantedBy=timers.target
+`, calendar)
+	if err := ioutil.WriteFile(filepath.Join(dir, name+".service"), []byte(service), 0644); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, name+".timer"), []byte(timer), 0644); err != nil {
+		return err
+	}
+	if !enable {
+		return nil
+	}
+	for _, args := range [][]string{{"daemon-reload"}, {"enable", "--now", name + ".timer"}} {
+		if out, err := exec.Command("systemctl", args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("systemctl %s: %w: %s", strings.Join(args, " "), err, bytes.TrimSpace(out))
+		}
+	}
+	return nil
+}
+
+// systemdQuote quotes s as a word of a command line of a unit file.
+func systemdQuote(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t\"'\\%$;") {
+		return s
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "%", "%%", "$", "$$").Replace(s) + `"`
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	"scepclient/client/cmp"
+	"scepclient/scepserver/depot"
+)
+
+// cmpCfg configures enrollment with a CMP server instead of SCEP.
+type cmpCfg struct {
+	url string
+
+	// reference and secret protect the requests with a MAC
+	reference string
+	secret    string
+
+	// caCerts verify the signed responses, and
+	// the first of them is the recipient.
+	caCerts []*x509.Certificate
+
+	// signerCert and signerKey sign the requests if there is no
+	// secret, e.g. a device certificate issued by its vendor.
+	signerCert  *x509.Certificate
+	signerChain []*x509.Certificate
+	signerKey   *rsa.PrivateKey
+
+	// message is ir, cr or kur, ir or kur if empty
+	// depending on whether there is a certificate.
+	message string
+}
+
+// newCMPCfg returns the configuration of the CMP flags, reading
+// the secret and the certificates and key of their files.
+func newCMPCfg(url, reference, secretFile, caCertFile, signerCertFile, signerKeyFile, message string) (*cmpCfg, error) {
+	cfg := &cmpCfg{url: url, reference: reference, message: message}
+	if message != "" {
+		if _, err := cmp.ParseMessageType(message); err != nil {
+			return nil, err
+		}
+	}
+	secret, err := readSecret(secretFile, "SCEPCLIENT_CMP_SECRET")
+	if err != nil {
+		return nil, err
+	}
+	cfg.secret = secret
+	if caCertFile != "" {
+		data, err := ioutil.ReadFile(caCertFile)
+		if err != nil {
+			return nil, err
+		}
+		if cfg.caCerts, err = depot.DecodeCertificates(data); err != nil {
+			return nil, fmt.Errorf("%s: %w", caCertFile, err)
+		}
+	}
+	if signerCertFile != "" {
+		data, err := ioutil.ReadFile(signerCertFile)
+		if err != nil {
+			return nil, err
+		}
+		certs, err := depot.DecodeCertificates(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", signerCertFile, err)
+		}
+		cfg.signerCert, cfg.signerChain = certs[0], certs[1:]
+		if cfg.signerKey, err = loadKeyFromFile(signerKeyFile); err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
+
+// runCMP enrolls the key and CSR of cfg with the CMP server of cfg.cmp.
+// Without a secret or a signer certificate, the requests are signed with
+// the existing key and certificate, updating the certificate.
+func runCMP(cfg runCfg) error {
+	ctx := context.Background()
+	logger := newLogger(cfg.debug, cfg.logfmt)
+	slog.SetDefault(logger)
+
+	key, err := loadOrMakeKey(cfg.keyPath, cfg.keyBits)
+	if err != nil {
+		return err
+	}
+	csr, err := loadOrMakeCSR(cfg.csrPath, &csrOptions{
+		cn:       cfg.cn,
+		org:      cfg.org,
+		country:  strings.ToUpper(cfg.country),
+		ou:       cfg.ou,
+		locality: cfg.locality,
+		province: cfg.province,
+		key:      key,
+		sigAlgo:  x509.SHA256WithRSA,
+	})
+	if err != nil {
+		return err
+	}
+	cert, err := loadPEMCertFromFile(cfg.certPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	req := cmp.Request{Type: cmp.IR, CSR: csr, Key: key, OldCert: cert}
+	if cert != nil {
+		req.Type = cmp.KUR
+	}
+	if cfg.cmp.message != "" {
+		if req.Type, err = cmp.ParseMessageType(cfg.cmp.message); err != nil {
+			return err
+		}
+	}
+
+	config := cmp.Config{
+		URL:       cfg.cmp.url,
+		Reference: cfg.cmp.reference,
+		Secret:    []byte(cfg.cmp.secret),
+		Client:    &http.Client{Transport: http.DefaultTransport.(*http.Transport).Clone()},
+	}
+	switch {
+	case cfg.cmp.secret != "":
+	case cfg.cmp.signerCert != nil:
+		config.Signer, config.Certificate, config.Chain = cfg.cmp.signerKey, cfg.cmp.signerCert, cfg.cmp.signerChain
+	case cert != nil:
+		config.Signer, config.Certificate = key, cert
+	default:
+		return errors.New("CMP requests need -cmp-secret-file, or -cmp-signer-cert, or a certificate to update")
+	}
+	if len(cfg.cmp.caCerts) > 0 {
+		config.Recipient = cfg.cmp.caCerts[0].Subject
+		config.Trusted = cfg.cmp.caCerts
+	}
+	if cfg.tlsCert != "" {
+		tlsCert, err := tls.LoadX509KeyPair(cfg.tlsCert, cfg.tlsKey)
+		if err != nil {
+			return fmt.Errorf("load TLS client certificate: %w", err)
+		}
+		transport := config.Client.Transport.(*http.Transport)
+		transport.TLSClientConfig = &tls.Config{Certificates: []tls.Certificate{tlsCert}}
+	}
+	c, err := cmp.NewClient(config)
+	if err != nil {
+		return err
+	}
+
+	logger.Info("sending CMP request.", "message", req.Type, "url", cfg.cmp.url)
+	resp, err := c.Enroll(ctx, req)
+	if err != nil {
+		return fmt.Errorf("CMP %s: %w", req.Type, err)
+	}
+	logger.Info("server returned a certificate.", "serial", resp.Certificate.SerialNumber)
+	return writeCertificate(ctx, cfg, logger, key, resp.Certificate, append(resp.CACerts, cfg.cmp.caCerts...))
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"scepclient/client/bundle"
+)
+
+// deployTarget is a web server or proxy reading the key and
+// certificate from files, reloaded after they are replaced.
+type deployTarget struct {
+	// configTest checks the configuration, and so
+	// the new files, before the server is reloaded.
+	configTest []string
+
+	// service is the systemd unit of the server.
+	service string
+
+	// signal reloads the server whose PID is in pidFile.
+	signal  string
+	pidFile string
+
+	// combined servers read the key and certificates from one file.
+	combined bool
+}
+
+// deployTargets are the servers with built-in deploy targets.
+var deployTargets = map[string]deployTarget{
+	"nginx": {
+		configTest: []string{"nginx", "-t"},
+		service:    "nginx",
+		signal:     "HUP",
+		pidFile:    "/run/nginx.pid",
+	},
+	// a graceful restart, letting open connections finish
+	"apache": {
+		configTest: []string{"apachectl", "-t"},
+		service:    "apache2",
+		signal:     "USR1",
+		pidFile:    "/run/apache2/apache2.pid",
+	},
+	// the signal reloads the master process of the master-worker mode
+	"haproxy": {
+		configTest: []string{"haproxy", "-c", "-f", "/etc/haproxy/haproxy.cfg"},
+		service:    "haproxy",
+		signal:     "USR2",
+		pidFile:    "/run/haproxy.pid",
+		combined:   true,
+	},
+}
+
+// deployCmdTimeout bounds the run time of the commands
+// testing the configuration and reloading the server.
+const deployCmdTimeout = time.Minute
+
+// deployCfg configures a deploy target.
+type deployCfg struct {
+	target string
+
+	// certPath receives the certificate followed by the CA
+	// certificates, and keyPath the key. HAProxy reads all
+	// of them from certPath.
+	certPath string
+	keyPath  string
+
+	// reload is systemctl or signal.
+	reload string
+
+	// service and pidFile override those of the target.
+	service string
+	pidFile string
+}
+
+// deployOutput replaces the files of the server of cfg.target and reloads
+// it, restoring the previous files if the configuration test or the
+// reload fails.
+func deployOutput(cfg deployCfg) (certOutput, error) {
+	target, ok := deployTargets[cfg.target]
+	if !ok {
+		return certOutput{}, fmt.Errorf("unknown deploy target %q, expected nginx, apache or haproxy", cfg.target)
+	}
+	if cfg.certPath == "" || (cfg.keyPath == "" && !target.combined) {
+		return certOutput{}, fmt.Errorf("the %s deploy target needs the paths of its certificate and key files", cfg.target)
+	}
+	if cfg.service != "" {
+		target.service = cfg.service
+	}
+	if cfg.pidFile != "" {
+		target.pidFile = cfg.pidFile
+	}
+	var reload func(ctx context.Context) error
+	switch cfg.reload {
+	case "systemctl":
+		reload = func(ctx context.Context) error {
+			return runDeployCmd(ctx, "systemctl", "reload", target.service)
+		}
+	case "signal":
+		reload = func(ctx context.Context) error {
+			pid, err := ioutil.ReadFile(target.pidFile)
+			if err != nil {
+				return err
+			}
+			return runDeployCmd(ctx, "kill", "-s", target.signal, strings.TrimSpace(string(pid)))
+		}
+	default:
+		return certOutput{}, fmt.Errorf("unknown reload method %q, expected systemctl or signal", cfg.reload)
+	}
+	return certOutput{
+		name: cfg.target + " " + cfg.certPath,
+		write: func(ctx context.Context, b bundle.Bundle) error {
+			// a key not matching its certificate would break the server
+			chain := append(append([]byte{}, b.Certificate...), b.CA...)
+			if _, err := tls.X509KeyPair(chain, b.Key); err != nil {
+				return fmt.Errorf("validating the key pair: %w", err)
+			}
+			files := []deployFile{{path: cfg.certPath, data: chain, perm: 0644}}
+			if target.combined {
+				files[0].data, files[0].perm = append(chain, b.Key...), 0600
+			} else {
+				files = append(files, deployFile{path: cfg.keyPath, data: b.Key, perm: 0600})
+			}
+			return deployFiles(ctx, files, func(ctx context.Context) error {
+				if err := runDeployCmd(ctx, target.configTest[0], target.configTest[1:]...); err != nil {
+					return err
+				}
+				return reload(ctx)
+			})
+		},
+	}, nil
+}
+
+// deployFile is a file replaced by a deployment.
+type deployFile struct {
+	path string
+	data []byte
+	perm os.FileMode
+
+	// previous is the data the file had, nil if it did not exist
+	previous []byte
+}
+
+// deployFiles replaces files and calls apply, restoring the previous
+// files if apply fails, or if some of the files cannot be replaced.
+func deployFiles(ctx context.Context, files []deployFile, apply func(ctx context.Context) error) error {
+	for i := range files {
+		f := &files[i]
+		data, err := ioutil.ReadFile(f.path)
+		switch {
+		case err == nil:
+			f.previous = data
+			// keep the mode of the existing file, e.g. one readable by the server's group
+			if fi, err := os.Stat(f.path); err == nil {
+				f.perm = fi.Mode().Perm()
+			}
+		case !os.IsNotExist(err):
+			return err
+		}
+	}
+	restore := func() error {
+		var errs []error
+		for _, f := range files {
+			if f.previous == nil {
+				if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+					errs = append(errs, err)
+				}
+				continue
+			}
+			errs = append(errs, replaceFile(f.path, f.previous, f.perm))
+		}
+		return errors.Join(errs...)
+	}
+	for _, f := range files {
+		if err := replaceFile(f.path, f.data, f.perm); err != nil {
+			if rerr := restore(); rerr != nil {
+				return fmt.Errorf("%w, and restoring the previous files: %v", err, rerr)
+			}
+			return err
+		}
+	}
+	if err := apply(ctx); err != nil {
+		if rerr := restore(); rerr != nil {
+			return fmt.Errorf("%w, and restoring the previous files: %v", err, rerr)
+		}
+		return fmt.Errorf("%w, restored the previous files", err)
+	}
+	return nil
+}
+
+// replaceFile writes data to a temporary file renamed to path,
+// so that the server never reads a partially written file.
+func replaceFile(path string, data []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	// the data must be on disk before the rename is
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	// OpenFile applies the umask, and keeps the mode of an existing file
+	if err := os.Chmod(tmp, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func runDeployCmd(ctx context.Context, name string, args ...string) error {
+	ctx, cancel := context.WithTimeout(ctx, deployCmdTimeout)
+	defer cancel()
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdout, cmd.Stderr = &out, &out
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s %s: %w: %s", name, strings.Join(args, " "), err, strings.TrimSpace(out.String()))
+	}
+	return nil
+}
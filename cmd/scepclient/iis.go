@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"scepclient/client/bundle"
+	"scepclient/crypto/pkcs12"
+)
+
+// iisBindScript installs the PKCS #12 file into the certificate store of
+// the machine, and binds the certificate to the HTTPS bindings on the
+// port of the site. It takes its parameters from the environment,
+// which needs no quoting.
+const iisBindScript = `$ErrorActionPreference = 'Stop'
+Import-Module WebAdministration
+$password = ConvertTo-SecureString -String $env:SCEP_PFX_PASSWORD -AsPlainText -Force
+Import-PfxCertificate -FilePath $env:SCEP_PFX_FILE -CertStoreLocation Cert:\LocalMachine\My -Password $password | Out-Null
+$bindings = @(Get-WebBinding -Name $env:SCEP_IIS_SITE -Protocol https -Port $env:SCEP_IIS_PORT)
+if ($bindings.Count -eq 0) { throw "site $env:SCEP_IIS_SITE has no https binding on port $env:SCEP_IIS_PORT" }
+foreach ($binding in $bindings) { $binding.AddSslCertificate($env:SCEP_THUMBPRINT, 'My') }
+`
+
+// iisBindTimeout bounds the run time of PowerShell.
+const iisBindTimeout = 2 * time.Minute
+
+// iisOutput installs the certificate, with its key, into the
+// LocalMachine\My store and rebinds the HTTPS bindings on port of the
+// IIS site to it, with PowerShell and its WebAdministration module.
+// The CA certificates are not installed, as the store of trusted roots
+// is usually managed with group policy.
+func iisOutput(site string, port int) (certOutput, error) {
+	if runtime.GOOS != "windows" {
+		return certOutput{}, errors.New("IIS bindings are only updated on Windows")
+	}
+	return certOutput{
+		name: "IIS site " + site + " port " + strconv.Itoa(port),
+		write: func(ctx context.Context, b bundle.Bundle) error {
+			return bindIIS(ctx, site, port, b.Key, b.Certificate)
+		},
+	}, nil
+}
+
+func bindIIS(ctx context.Context, site string, port int, keyPEM, certPEM []byte) error {
+	keyBlock, _ := pem.Decode(keyPEM)
+	certBlock, _ := pem.Decode(certPEM)
+	if keyBlock == nil || certBlock == nil {
+		return errors.New("no PEM encoded key or certificate")
+	}
+	key, err := x509.ParsePKCS1PrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return err
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return err
+	}
+	// the file only lives until it is imported, so a random password will do
+	secret := make([]byte, 16)
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+	password := hex.EncodeToString(secret)
+	pfx, err := pkcs12.Encode(key, cert, nil, password)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp("", "scepclient-*.pfx")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(pfx); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, iisBindTimeout)
+	defer cancel()
+	thumbprint := sha1.Sum(cert.Raw)
+	cmd := exec.CommandContext(ctx, "powershell.exe", "-NoProfile", "-NonInteractive", "-ExecutionPolicy", "Bypass", "-Command", iisBindScript)
+	cmd.Env = append(os.Environ(),
+		"SCEP_PFX_FILE="+f.Name(),
+		"SCEP_PFX_PASSWORD="+password,
+		"SCEP_IIS_SITE="+site,
+		"SCEP_IIS_PORT="+strconv.Itoa(port),
+		"SCEP_THUMBPRINT="+strings.ToUpper(hex.EncodeToString(thumbprint[:])),
+	)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("powershell: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
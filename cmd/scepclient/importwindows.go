@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"scepclient/client/winstore"
+	"scepclient/crypto/x509util"
+)
+
+// importWindows adopts a certificate of a Windows store, and its key,
+// e.g. one enrolled with the autoenrollment of Active Directory: it
+// writes them, with a CSR of the same subject and SANs, to the files
+// which the client then renews over SCEP.
+func importWindows(args []string) error {
+	fs := flag.NewFlagSet("scepclient import-windows", flag.ExitOnError)
+	var (
+		flStore      = fs.String("store", `LocalMachine\My`, `certificate store to read the certificate from, e.g. CurrentUser\My`)
+		flThumbprint = fs.String("thumbprint", "", "SHA-1 thumbprint of the certificate, as shown by Windows")
+		flTemplate   = fs.String("template", "", "adopt the certificate issued last from this certificate template, a name or OID, instead of -thumbprint")
+		flKeyPath    = fs.String("private-key", "", "file receiving the key, the -private-key of the renewals")
+		flCertPath   = fs.String("certificate", "", "file receiving the certificate, the -certificate of the renewals, client.pem next to -private-key by default")
+		flChallenge  = fs.String("challenge", "", "challenge password of the CSR of the renewals, if the server needs one")
+		flForce      = fs.Bool("force", false, "replace the key, certificate and CSR files if they exist")
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *flKeyPath == "" {
+		return errors.New("-private-key is required")
+	}
+	if (*flThumbprint == "") == (*flTemplate == "") {
+		return errors.New("either -thumbprint or -template is required")
+	}
+	dir := filepath.Dir(*flKeyPath)
+	if *flCertPath == "" {
+		*flCertPath = dir + "/client.pem"
+	}
+	// the paths of the main command
+	csrPath := dir + "/csr.pem"
+
+	ctx := context.Background()
+	certs, err := winstore.List(ctx, *flStore)
+	if err != nil {
+		return err
+	}
+	found, err := winstore.Find(certs, *flThumbprint, *flTemplate)
+	if err != nil {
+		return err
+	}
+	cert := found.Certificate
+	if _, ok := cert.PublicKey.(*rsa.PublicKey); !ok {
+		return fmt.Errorf("certificate %s has a %s key, only RSA keys are renewed", found.Thumbprint, cert.PublicKeyAlgorithm)
+	}
+	key, err := winstore.ExportKey(ctx, *flStore, found.Thumbprint)
+	if err != nil {
+		return err
+	}
+	if !key.PublicKey.Equal(cert.PublicKey) {
+		return fmt.Errorf("the key of certificate %s does not match it", found.Thumbprint)
+	}
+
+	// renewals keep the subject and SANs of the adopted certificate
+	csrDER, err := x509util.CreateCertificateRequest(rand.Reader, &x509util.CertificateRequest{
+		CertificateRequest: x509.CertificateRequest{
+			Subject:        cert.Subject,
+			DNSNames:       cert.DNSNames,
+			EmailAddresses: cert.EmailAddresses,
+			IPAddresses:    cert.IPAddresses,
+			URIs:           cert.URIs,
+		},
+		ChallengePassword: *flChallenge,
+	}, key)
+	if err != nil {
+		return err
+	}
+
+	files := []struct {
+		path string
+		perm os.FileMode
+		data []byte
+	}{
+		{*flKeyPath, 0600, pem.EncodeToMemory(&pem.Block{Type: rsaPrivateKeyPEMBlockType, Bytes: x509.MarshalPKCS1PrivateKey(key)})},
+		{*flCertPath, 0666, pemCert(cert.Raw)},
+		{csrPath, 0666, pemCSR(csrDER)},
+	}
+	for _, file := range files {
+		if _, err := os.Stat(file.path); err == nil && !*flForce {
+			return fmt.Errorf("%s exists, use -force to replace it", file.path)
+		}
+	}
+	for _, file := range files {
+		if err := ioutil.WriteFile(file.path, file.data, file.perm); err != nil {
+			return err
+		}
+	}
+
+	template := found.Template
+	if template == "" {
+		template = found.TemplateOID
+	}
+	fmt.Printf("adopted certificate %s of %s, %s, expiring on %s\n", found.Thumbprint, *flStore, cert.Subject, cert.NotAfter.Format("2006-01-02"))
+	if template != "" {
+		fmt.Printf("remove the autoenrollment permission of template %s for this machine or user, so that Windows does not renew it too\n", template)
+	}
+	fmt.Printf("renew it over SCEP with: scepclient -server-url <url> -private-key %s -certificate %s -sidecar\n", *flKeyPath, *flCertPath)
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"scepclient/client/mobileconfig"
+)
+
+// subjectFlags are the flags of the subject attributes of the CSR.
+var subjectFlags = map[string]string{
+	"CN": "cn", "2.5.4.3": "cn",
+	"O": "organization", "2.5.4.10": "organization",
+	"OU": "ou", "2.5.4.11": "ou",
+	"L": "locality", "2.5.4.7": "locality",
+	"ST": "province", "2.5.4.8": "province",
+	"C": "country", "2.5.4.6": "country",
+}
+
+// mdmVariable matches the variables of MDM profiles, $NAME of Apple
+// MDMs and NanoMDM, or %NAME% of MicroMDM and others.
+var mdmVariable = regexp.MustCompile(`\$[A-Za-z_][A-Za-z0-9_]*|%[A-Za-z_][A-Za-z0-9_]*%`)
+
+// applyMDMProfile sets the flags of the SCEP payload of the profile at
+// path, e.g. an enrollment profile of MicroMDM or NanoMDM, unless they
+// are set on the command line. The variables of the subject, which the
+// MDM expands for every device, are read from the environment.
+func applyMDMProfile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	profile, err := mobileconfig.Parse(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	payload := profile.SCEP
+
+	values := map[string]string{
+		"server-url": payload.URL,
+		"challenge":  payload.Challenge,
+	}
+	if payload.KeySize != 0 {
+		values["keySize"] = strconv.Itoa(payload.KeySize)
+	}
+	// only MD5 fingerprints select the recipient of NDES
+	if len(payload.CAFingerprint) == 16 {
+		values["ca-fingerprint"] = hex.EncodeToString(payload.CAFingerprint)
+	}
+	// the subject is the one of the payload, without the default
+	// attributes of the flags the payload does not have
+	for _, name := range subjectFlags {
+		values[name] = ""
+	}
+	for _, attr := range strings.Split(payload.Subject, ",") {
+		if attr == "" {
+			continue
+		}
+		typ, value, _ := strings.Cut(attr, "=")
+		name, ok := subjectFlags[strings.ToUpper(typ)]
+		if !ok {
+			return fmt.Errorf("%s: unsupported subject attribute %s", path, typ)
+		}
+		values[name] = mdmVariable.ReplaceAllStringFunc(value, func(v string) string {
+			if env, ok := os.LookupEnv(strings.Trim(v, "$%")); ok {
+				return env
+			}
+			return v
+		})
+	}
+
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for name, value := range values {
+		if set[name] {
+			continue
+		}
+		if err := flag.Set(name, value); err != nil {
+			return fmt.Errorf("%s: -%s: %w", path, name, err)
+		}
+	}
+	return nil
+}
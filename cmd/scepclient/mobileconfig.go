@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+
+	"scepclient/client/mobileconfig"
+	"scepclient/scepserver/depot"
+)
+
+// mobileConfig writes an Apple configuration profile making
+// iOS and macOS devices enroll with a SCEP server.
+func mobileConfig(args []string) error {
+	fs := flag.NewFlagSet("scepclient mobileconfig", flag.ExitOnError)
+	var (
+		flServerURL     = fs.String("server-url", "", "URL of the SCEP server the devices enroll with")
+		flCAFingerprint = fs.String("ca-fingerprint", "", "hex SHA-256 fingerprint of the CA certificate, as printed by -probe, which the devices check GetCACert against")
+		flCAName        = fs.String("ca-name", "", "name of the CA instance, sent by the devices with GetCACert")
+		flSubject       = fs.String("subject", "CN=$DEVICE_SERIAL_NUMBER", "comma separated subject attributes of the requested certificates, with the variables of the MDM distributing the profile")
+		flChallenge     = fs.String("challenge", "", "challenge password of the requests")
+		flKeySize       = fs.Int("key-size", 2048, "size of the RSA keys of the devices, 1024, 2048 or 4096")
+		flKeyUsage      = fs.String("key-usage", "signing,encryption", "comma separated usages of the keys of the devices, signing and encryption")
+		flExtractable   = fs.Bool("key-extractable", false, "let the keys be exported from the keychains of the devices")
+		flAllowAllApps  = fs.Bool("allow-all-apps", false, "let all apps of the devices use the keys")
+		flDNSNames      = fs.String("dns", "", "comma separated DNS names of the requested certificates")
+		flEmails        = fs.String("email", "", "comma separated email addresses of the requested certificates")
+		flURIs          = fs.String("uri", "", "comma separated URIs of the requested certificates")
+		flRetries       = fs.Int("retries", 0, "polls of requests answered with PENDING, 3 by default of the devices")
+		flRetryDelay    = fs.Int("retry-delay", 0, "seconds between the polls of requests answered with PENDING, 10 by default of the devices")
+		flIdentifier    = fs.String("identifier", "", "reverse-DNS identifier of the profile, replacing installed profiles of the same identifier, e.g. com.example.scep, derived from -server-url by default")
+		flDisplayName   = fs.String("display-name", "SCEP enrollment", "name of the profile shown on the devices")
+		flOrganization  = fs.String("organization", "", "organization shown on the devices")
+		flDescription   = fs.String("description", "", "description of the profile shown on the devices")
+		flSignCert      = fs.String("sign-cert", "", "sign the profile with this certificate, followed by its intermediate certificates, in PEM")
+		flSignKey       = fs.String("sign-key", "", "RSA key of -sign-cert, in PEM")
+		flOut           = fs.String("out", "-", "file receiving the profile, - for stdout")
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	u, err := url.Parse(*flServerURL)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("invalid -server-url %q", *flServerURL)
+	}
+	fingerprint, err := hex.DecodeString(strings.NewReplacer(":", "", " ", "").Replace(*flCAFingerprint))
+	if err != nil {
+		return fmt.Errorf("invalid -ca-fingerprint: %w", err)
+	}
+	var keyUsage int
+	for _, usage := range splitList(*flKeyUsage) {
+		switch usage {
+		case "signing":
+			keyUsage |= mobileconfig.KeyUsageSigning
+		case "encryption":
+			keyUsage |= mobileconfig.KeyUsageEncryption
+		default:
+			return fmt.Errorf("unknown -key-usage %q, expected signing or encryption", usage)
+		}
+	}
+	identifier := *flIdentifier
+	if identifier == "" {
+		// scep.example.com becomes com.example.scep
+		labels := strings.Split(u.Hostname(), ".")
+		for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+			labels[i], labels[j] = labels[j], labels[i]
+		}
+		identifier = strings.Join(labels, ".")
+	}
+
+	profile, err := mobileconfig.Profile{
+		Identifier:   identifier,
+		DisplayName:  *flDisplayName,
+		Organization: *flOrganization,
+		Description:  *flDescription,
+		SCEP: mobileconfig.SCEP{
+			URL:                *flServerURL,
+			Name:               *flCAName,
+			Subject:            *flSubject,
+			Challenge:          *flChallenge,
+			CAFingerprint:      fingerprint,
+			KeySize:            *flKeySize,
+			KeyUsage:           keyUsage,
+			KeyIsExtractable:   *flExtractable,
+			AllowAllAppsAccess: *flAllowAllApps,
+			DNSNames:           splitList(*flDNSNames),
+			EmailAddresses:     splitList(*flEmails),
+			URIs:               splitList(*flURIs),
+			Retries:            *flRetries,
+			RetryDelay:         *flRetryDelay,
+		},
+	}.Marshal()
+	if err != nil {
+		return err
+	}
+	if *flSignCert != "" || *flSignKey != "" {
+		data, err := ioutil.ReadFile(*flSignCert)
+		if err != nil {
+			return err
+		}
+		certs, err := depot.DecodeCertificates(data)
+		if err != nil {
+			return err
+		}
+		key, err := loadKeyFromFile(*flSignKey)
+		if err != nil {
+			return err
+		}
+		if profile, err = mobileconfig.Sign(profile, certs[0], key, certs[1:]); err != nil {
+			return err
+		}
+	}
+	if *flOut == "-" {
+		_, err = os.Stdout.Write(profile)
+		return err
+	}
+	return ioutil.WriteFile(*flOut, profile, 0644)
+}
+
+// splitList returns the trimmed, non-empty elements of the comma separated list s.
+func splitList(s string) []string {
+	var list []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			list = append(list, e)
+		}
+	}
+	return list
+}
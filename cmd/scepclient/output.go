@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"scepclient/client/awssecret"
+	"scepclient/client/azurekv"
+	"scepclient/client/bundle"
+	"scepclient/client/dockersecret"
+	"scepclient/client/dot1x"
+	"scepclient/client/gcpsecret"
+	"scepclient/client/k8ssecret"
+	"scepclient/client/vaultkv"
+)
+
+// certOutput receives the key, certificate and CA certificates of every
+// enrollment, besides the certificate file.
+type certOutput struct {
+	name  string
+	write func(ctx context.Context, b bundle.Bundle) error
+}
+
+// k8sSecretOutput writes to the kubernetes.io/tls Secret name, in the
+// namespace of the pod unless it is given as namespace/name.
+func k8sSecretOutput(name string) (certOutput, error) {
+	// fail before enrolling outside of a cluster
+	w, namespace, err := k8ssecret.InCluster()
+	if err != nil {
+		return certOutput{}, err
+	}
+	if i := strings.Index(name, "/"); i >= 0 {
+		namespace, name = name[:i], name[i+1:]
+	}
+	return certOutput{
+		name: "Kubernetes secret " + namespace + "/" + name,
+		write: func(ctx context.Context, b bundle.Bundle) error {
+			return w.Write(ctx, namespace, name, k8ssecret.TLS(b))
+		},
+	}, nil
+}
+
+// vaultKVOutput writes to path of the Vault KV secrets engine of config.
+func vaultKVOutput(path string, config vaultkv.Config) (certOutput, error) {
+	w, err := vaultkv.NewWriter(config)
+	if err != nil {
+		return certOutput{}, err
+	}
+	return certOutput{
+		name: "Vault " + path,
+		write: func(ctx context.Context, b bundle.Bundle) error {
+			return w.Write(ctx, path, b)
+		},
+	}, nil
+}
+
+// awsOutputs write to the AWS Secrets Manager secret secretID and the
+// SSM parameters under ssmPrefix, if they are not empty.
+func awsOutputs(secretID, ssmPrefix string, config awssecret.Config) ([]certOutput, error) {
+	w, err := awssecret.NewWriter(config)
+	if err != nil {
+		return nil, err
+	}
+	var outs []certOutput
+	if secretID != "" {
+		outs = append(outs, certOutput{
+			name: "AWS secret " + secretID,
+			write: func(ctx context.Context, b bundle.Bundle) error {
+				return w.WriteSecret(ctx, secretID, b)
+			},
+		})
+	}
+	if ssmPrefix != "" {
+		outs = append(outs, certOutput{
+			name: "SSM parameters " + ssmPrefix,
+			write: func(ctx context.Context, b bundle.Bundle) error {
+				return w.WriteParameters(ctx, ssmPrefix, b)
+			},
+		})
+	}
+	return outs, nil
+}
+
+// azureKVOutput imports into the certificate name of the
+// Azure Key Vault of config.
+func azureKVOutput(name string, config azurekv.Config) (certOutput, error) {
+	w, err := azurekv.NewWriter(config)
+	if err != nil {
+		return certOutput{}, err
+	}
+	return certOutput{
+		name: "Azure Key Vault certificate " + name,
+		write: func(ctx context.Context, b bundle.Bundle) error {
+			return w.Import(ctx, name, b)
+		},
+	}, nil
+}
+
+// gcpSecretOutput adds versions to the Secret Manager secret name.
+func gcpSecretOutput(name string, config gcpsecret.Config) (certOutput, error) {
+	w, err := gcpsecret.NewWriter(config)
+	if err != nil {
+		return certOutput{}, err
+	}
+	return certOutput{
+		name: "Secret Manager secret " + name,
+		write: func(ctx context.Context, b bundle.Bundle) error {
+			_, err := w.Write(ctx, name, b)
+			return err
+		},
+	}, nil
+}
+
+// dockerSecretOutput creates the Docker secrets of name, and rotates
+// the services referencing their previous versions to them.
+func dockerSecretOutput(name string, config dockersecret.Config, logger *slog.Logger) (certOutput, error) {
+	w, err := dockersecret.NewWriter(config)
+	if err != nil {
+		return certOutput{}, err
+	}
+	return certOutput{
+		name: "Docker secret " + name,
+		write: func(ctx context.Context, b bundle.Bundle) error {
+			rotation, err := w.Write(ctx, name, b)
+			if rotation != nil && len(rotation.Secrets) > 0 {
+				logger.Info("rotated the Docker secrets.", "secrets", rotation.Secrets, "services", rotation.Services, "removed", rotation.Removed)
+			}
+			return err
+		},
+	}, nil
+}
+
+// dot1xOutput writes the 802.1X supplicant configuration of config to
+// path, in format wpa_supplicant or networkmanager. Unless writeCA is
+// false, the CA certificates of the SCEP server are written to
+// config.CACert, to verify the authentication server.
+func dot1xOutput(path, format string, writeCA bool, config dot1x.Config) (certOutput, error) {
+	var generate func(dot1x.Config) ([]byte, error)
+	switch format {
+	case "wpa_supplicant":
+		generate = dot1x.WPASupplicant
+	case "networkmanager":
+		generate = dot1x.NetworkManager
+	default:
+		return certOutput{}, fmt.Errorf("unknown 802.1X format %q, expected wpa_supplicant or networkmanager", format)
+	}
+	// fail before enrolling
+	if _, err := generate(config); err != nil {
+		return certOutput{}, err
+	}
+	return certOutput{
+		name: "802.1X configuration " + path,
+		write: func(ctx context.Context, b bundle.Bundle) error {
+			if writeCA {
+				if len(b.CA) == 0 {
+					return errors.New("the SCEP server returned no CA certificate to verify the authentication server with")
+				}
+				if err := replaceFile(config.CACert, b.CA, 0644); err != nil {
+					return err
+				}
+			}
+			conf, err := generate(config)
+			if err != nil {
+				return err
+			}
+			// it is only loaded by NetworkManager if no one else can read it
+			return replaceFile(path, conf, 0600)
+		},
+	}, nil
+}
+
+// awsRegion returns the region of the AWS environment variables.
+func awsRegion() string {
+	if region := os.Getenv("AWS_REGION"); region != "" {
+		return region
+	}
+	return os.Getenv("AWS_DEFAULT_REGION")
+}
+
+// parseTags parses comma separated key=value pairs.
+func parseTags(s string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		i := strings.Index(pair, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("tag %q is not of the form key=value", pair)
+		}
+		tags[pair[:i]] = pair[i+1:]
+	}
+	return tags, nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"scepclient/scepserver"
+	"scepclient/scepserver/depot/bolt"
+	"scepclient/scepserver/depot/file"
+	sqldepot "scepclient/scepserver/depot/sql"
+)
+
+// revoke marks a certificate issued by serve as revoked in its depot,
+// listing it in the CRL served with -crl-path. Unlike admin, it works
+// while serve is stopped, but is not recorded in the audit log.
+func revoke(args []string) error {
+	fs := flag.NewFlagSet("scepclient revoke", flag.ExitOnError)
+	var (
+		flDepot   = fs.String("depot", "depot", "directory, bolt database file or SQL data source name of the depot holding the issued certificates")
+		flBackend = fs.String("depot-backend", "file", "depot storage: file, bolt, postgres or mysql, as for serve")
+		flSerial  = fs.String("serial", "", "serial number of the certificate to revoke, in hex")
+		flReason  = fs.String("reason", "unspecified", "revocation reason, e.g. keyCompromise or superseded")
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	serial, ok := new(big.Int).SetString(strings.TrimPrefix(strings.ReplaceAll(*flSerial, ":", ""), "0x"), 16)
+	if !ok {
+		return fmt.Errorf("invalid -serial %q, expected a hex serial number", *flSerial)
+	}
+	reason, ok := scepserver.RevocationReasons[*flReason]
+	if !ok {
+		return fmt.Errorf("unknown -reason %q", *flReason)
+	}
+
+	var revocations scepserver.Revocations
+	switch *flBackend {
+	case "file":
+		// the index is locked, serve may keep issuing certificates
+		fileDepot, err := file.New(*flDepot)
+		if err != nil {
+			return err
+		}
+		revocations = fileDepot
+	case "bolt":
+		// bolt locks the database file, stop serve before revoking
+		boltDepot, err := bolt.Open(*flDepot)
+		if err != nil {
+			return err
+		}
+		defer boltDepot.Close()
+		revocations = boltDepot
+	case "postgres", "mysql":
+		sqlDepot, err := sqldepot.Open(*flBackend, *flDepot)
+		if err != nil {
+			return err
+		}
+		defer sqlDepot.Close()
+		revocations = sqlDepot
+	default:
+		return fmt.Errorf("unknown -depot-backend %q", *flBackend)
+	}
+	if err := revocations.Revoke(serial, reason, time.Now()); err != nil {
+		return err
+	}
+	fmt.Printf("revoked certificate %x (%s)\n", serial, *flReason)
+	return nil
+}
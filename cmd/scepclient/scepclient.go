@@ -2,24 +2,47 @@ package main
 
 import (
 	"context"
-	"crypto/md5"
+	"crypto/rsa"
+	"crypto/tls"
 	"crypto/x509"
+	"encoding/pem"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
-	stdlog "log"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/smtp"
 	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/fullsailor/pkcs7"
-	"github.com/go-kit/kit/log"
-	"github.com/go-kit/kit/log/level"
-	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 	"scepclient/client"
+	"scepclient/client/awssecret"
+	"scepclient/client/azurekv"
+	"scepclient/client/bundle"
+	"scepclient/client/dockersecret"
+	"scepclient/client/dot1x"
+	"scepclient/client/gcpsecret"
+	"scepclient/client/notify"
+	"scepclient/client/sds"
+	"scepclient/client/vaultkv"
+	"scepclient/clock"
+	"scepclient/cloudauth"
 	"scepclient/scep"
+	"scepclient/scepserver"
+	"scepclient/scepserver/har"
+	"scepclient/scepserver/kerberos"
+	"scepclient/scepserver/metrics"
+	"scepclient/scepserver/ntlm"
 )
 
 // version info
@@ -46,33 +69,235 @@ type runCfg struct {
 	caMD5        string
 	debug        bool
 	logfmt       string
+	retries      int
+	rateLimit    float64
+	userAgent    string
+	headers      headerFlags
+	authUser     string
+	authPassword string
+	ntlm         bool
+	kerberos     kerberos.Config
+	tlsCert      string
+	tlsKey       string
+	tlsSCEPCert  bool
+	http2        bool
+	idleConns    int
+	idleTimeout  time.Duration
+	keepAlive    time.Duration
+	redirect     scepserver.RedirectPolicy
+	strictCT     bool
+	metricsFile  string
+	auditor      scepserver.Auditor
+	timeouts     map[string]time.Duration
+	resolve      resolveFlags
+	dnsServer    string
+	network      string
+	fallback     time.Duration
+	correlateID  string
+	requestIDHdr string
+	harFile      string
+	tlsMin       uint16
+	tlsMax       uint16
+	tlsCiphers   []uint16
+	compression  bool
+	pathRewrite  bool
+	compat       string
+	stepCAPin    string
+	discover     bool
+	probe        bool
+	poll         scepclient.PollPolicy
+	preflight    scepserver.CSRVerifier
+	outputs      []certOutput
+	cmp          *cmpCfg
+	acme         *acmeCfg
 }
 
-func run(cfg runCfg) error {
+func run(cfg runCfg) (err error) {
+	if cfg.acme != nil {
+		return runWithACME(cfg)
+	}
+	if cfg.cmp != nil {
+		return runCMP(cfg)
+	}
 	println("scepclient - run - Entrypoint")
 	ctx := context.Background()
-	var logger log.Logger
-	{
-		if strings.ToLower(cfg.logfmt) == "json" {
-			logger = log.NewJSONLogger(os.Stderr)
-		} else {
-			logger = log.NewLogfmtLogger(os.Stderr)
+	logger := newLogger(cfg.debug, cfg.logfmt)
+	slog.SetDefault(logger)
+
+	println("scepclient - run - Starting scepclient with serverURL")
+	var httpOpts []scepserver.HTTPOption
+	if cfg.harFile != "" {
+		// record the exchanges as sent, after authentication
+		// and other round trippers, which are added later
+		rec := new(har.Recorder)
+		// custom headers carry API keys and other credentials
+		for _, h := range cfg.headers {
+			rec.Redact(h.key)
 		}
-		stdlog.SetOutput(log.NewStdlibAdapter(logger))
-		logger = log.With(logger, "ts", log.DefaultTimestampUTC)
-		if !cfg.debug {
-			logger = level.NewFilter(logger, level.AllowInfo())
+		httpOpts = append(httpOpts, scepserver.WithRoundTripper(rec.Wrap))
+		defer func() {
+			if err := rec.WriteFile(cfg.harFile); err != nil {
+				logger.Error("writing HAR file", "err", err)
+			}
+		}()
+	}
+	httpOpts = append(httpOpts,
+		scepserver.WithUserAgent(cfg.userAgent),
+		scepserver.WithHTTP2(cfg.http2),
+		scepserver.WithIdleConnections(cfg.idleConns, cfg.idleTimeout),
+		scepserver.WithKeepAlive(cfg.keepAlive),
+		scepserver.WithRedirectPolicy(cfg.redirect),
+		scepserver.WithStrictContentType(cfg.strictCT),
+		scepserver.WithNetwork(cfg.network),
+		scepserver.WithFallbackDelay(cfg.fallback),
+		scepserver.WithTLSVersions(cfg.tlsMin, cfg.tlsMax),
+		scepserver.WithCompression(cfg.compression),
+	)
+	if !cfg.pathRewrite {
+		httpOpts = append(httpOpts, scepserver.WithoutPathRewrite())
+	}
+	if len(cfg.tlsCiphers) > 0 {
+		httpOpts = append(httpOpts, scepserver.WithCipherSuites(cfg.tlsCiphers...))
+	}
+	if cfg.debug {
+		httpOpts = append(httpOpts, scepserver.WithTrace(func(info scepserver.TraceInfo) {
+			logger.Debug("scep connection",
+				"operation", info.Operation,
+				"reused", info.Reused,
+				"dns", info.DNSLookup,
+				"connect", info.Connect,
+				"tls", info.TLSHandshake,
+				"first_byte", info.FirstByte,
+			)
+		}))
+	}
+	if cfg.requestIDHdr != "" {
+		httpOpts = append(httpOpts, scepserver.WithRequestIDHeader(cfg.requestIDHdr))
+	}
+	for _, r := range cfg.resolve {
+		httpOpts = append(httpOpts, scepserver.WithResolve(r.hostport, r.addr))
+	}
+	if cfg.dnsServer != "" {
+		httpOpts = append(httpOpts, scepserver.WithResolver(dnsResolver(cfg.dnsServer)))
+	}
+	for _, h := range cfg.headers {
+		httpOpts = append(httpOpts, scepserver.WithHeader(h.key, h.value))
+	}
+	switch {
+	case cfg.authUser != "" && cfg.ntlm:
+		httpOpts = append(httpOpts, ntlm.Options(cfg.authUser, cfg.authPassword)...)
+	case cfg.authUser != "":
+		httpOpts = append(httpOpts, scepserver.WithBasicAuth(cfg.authUser, cfg.authPassword))
+	}
+	if cfg.kerberos.Keytab != "" || cfg.kerberos.CCache != "" {
+		krbOpts, err := kerberos.Options(cfg.kerberos)
+		if err != nil {
+			return err
 		}
+		httpOpts = append(httpOpts, krbOpts...)
+	}
+	if cfg.stepCAPin != "" {
+		root, err := scepclient.StepCARoot(ctx, cfg.serverURL, cfg.stepCAPin)
+		if err != nil {
+			return err
+		}
+		roots := x509.NewCertPool()
+		roots.AddCert(root)
+		httpOpts = append(httpOpts, scepserver.WithRootCAs(roots))
+	}
+	if cfg.tlsCert != "" {
+		tlsCert, err := tls.LoadX509KeyPair(cfg.tlsCert, cfg.tlsKey)
+		if err != nil {
+			return fmt.Errorf("load TLS client certificate: %w", err)
+		}
+		httpOpts = append(httpOpts, scepserver.WithClientCertificate(tlsCert))
+	} else if cfg.tlsSCEPCert {
+		// renewal: authenticate with the certificate issued by a previous
+		// enrollment. There is none yet on the first enrollment.
+		tlsCert, err := tls.LoadX509KeyPair(cfg.certPath, cfg.keyPath)
+		switch {
+		case err == nil:
+			httpOpts = append(httpOpts, scepserver.WithClientCertificate(tlsCert))
+		case !os.IsNotExist(err):
+			return fmt.Errorf("load SCEP certificate for TLS: %w", err)
+		}
+	}
+	if cfg.discover {
+		u, _, err := scepserver.Discover(ctx, cfg.serverURL, httpOpts...)
+		if err != nil {
+			return err
+		}
+		// there is no configuration file to record it in, so print
+		// the endpoint for use as -server-url in later runs
+		fmt.Printf("discovered SCEP endpoint: %s\n", u)
+		cfg.serverURL = u.String()
+		httpOpts = append(httpOpts, scepserver.WithoutPathRewrite())
 	}
-	lginfo := level.Info(logger)
 
-	println("scepclient - run - Starting scepclient with serverURL")
-	client, err := scepclient.New(cfg.serverURL, logger)
+	correlationID := cfg.correlateID
+	if correlationID == "" {
+		correlationID = scepserver.NewCorrelationID()
+	}
+	clientOpts := []scepclient.Option{
+		scepclient.WithHTTPOptions(httpOpts...),
+		scepclient.WithCorrelationID(correlationID),
+	}
+	if cfg.retries > 0 {
+		policy := scepserver.DefaultRetryPolicy
+		policy.MaxAttempts = cfg.retries + 1
+		clientOpts = append(clientOpts, scepclient.WithRetry(policy))
+	}
+	if cfg.rateLimit > 0 {
+		limiter := scepserver.NewTokenBucket(cfg.rateLimit, 1)
+		clientOpts = append(clientOpts, scepclient.WithRateLimit(limiter, nil))
+	}
+	clientOpts = append(clientOpts, scepclient.WithTimeouts(0, cfg.timeouts))
+	switch cfg.compat {
+	case "jamf":
+		clientOpts = append(clientOpts, scepclient.JamfCompat())
+	case "ejbca":
+		clientOpts = append(clientOpts, scepclient.EJBCACompat())
+	default:
+		clientOpts = append(clientOpts, scepclient.ServerProfiles[cfg.compat].Options()...)
+	}
+	var scepMetrics *metrics.Metrics
+	if cfg.metricsFile != "" {
+		reg := prometheus.NewRegistry()
+		m, err := metrics.New(reg)
+		if err != nil {
+			return err
+		}
+		scepMetrics = m
+		clientOpts = append(clientOpts,
+			scepclient.WithMiddleware(scepMetrics.Middleware()),
+			scepclient.WithHTTPOptions(scepserver.WithTrace(scepMetrics.ObserveTrace)),
+		)
+		// one-shot runs export their metrics with the node_exporter textfile collector
+		defer func() {
+			if err := prometheus.WriteToTextfile(cfg.metricsFile, reg); err != nil {
+				logger.Error("writing metrics", "err", err)
+			}
+		}()
+	}
+	client, err := scepclient.New(cfg.serverURL, logger, clientOpts...)
 	if err != nil {
 		return err
 	}
+	// the client logs the correlation ID from the request context
+	logger = logger.With("correlation_id", correlationID)
+	ctx = scepserver.WithCorrelationID(ctx, correlationID)
 	println("scepclient - run - Started scepclient with serverURL")
 
+	if cfg.probe {
+		result, err := client.Probe(ctx)
+		fmt.Printf("reachable: %v\nlatency: %s\ncapabilities: %s\n",
+			result.Reachable, result.Latency, strings.Join(result.Capabilities, ", "))
+		for i, cert := range result.CACerts {
+			fmt.Printf("CA certificate: %s\n  SHA-256: %s\n", cert.Subject, result.CAFingerprints[i])
+		}
+		return err
+	}
+
 	sigAlgo := x509.SHA1WithRSA
 	if client.Supports("SHA-256") || client.Supports("SCEPStandard") {
 		println("scepclient - run - Client supports SHA-256")
@@ -131,29 +356,35 @@ func run(cfg runCfg) error {
 	println(cert)
 
 	println("scepclient - run - client.GetCACert")
-	resp, certNum, err := client.GetCACert(ctx)
+	body, certNum, err := client.GetCACertReader(ctx)
 	if err != nil {
 		println("scepclient - run - client.GetCACert - ERROR")
 		return err
 	}
+	defer body.Close()
 	var certs []*x509.Certificate
 	{
 		if certNum > 1 {
 			println("scepclient - run - client.GetCACert - more than one Certificate returned")
-			certs, err = scep.CACerts(resp)
-			println("scepclient - run - client.GetCACert - certs: ")
-			println(certs)
-			certs, err = x509.ParseCertificates(certs[1].Raw)
-			println(certs)
+			err = scep.ReadCACerts(body, func(cert *x509.Certificate) error {
+				certs = append(certs, cert)
+				return nil
+			})
 			if err != nil {
 				return err
 			}
-			if len(certs) < 1 {
+			println("scepclient - run - client.GetCACert - certs: ")
+			println(certs)
+			if len(certs) == 0 {
 				return fmt.Errorf("scepclient - run - client.GetCACert - no certificates returned")
 			}
 		} else {
 			println("scepclient - run - client.GetCACert - exactly one Certificate returned")
-			certs, err = x509.ParseCertificates(resp)
+			resp, err := ioutil.ReadAll(body)
+			if err != nil {
+				return err
+			}
+			certs, err = x509.ParseCertificates(scep.TrimTrailingData(resp))
 			if err != nil {
 				return err
 			}
@@ -179,6 +410,14 @@ func run(cfg runCfg) error {
 		if cert != nil {
 			println("scepclient - run - defining msgType - cert is not nil - msgType = scep.RenewalReq")
 			msgType = scep.PKCSReq
+			if err := scepclient.CheckValidity(cert, nil); err != nil {
+				logger.Warn("renewing an invalid certificate.", "err", err)
+			} else if renewAt := scepclient.DefaultRenewalPolicy.RenewAt(cert); !scepclient.DefaultRenewalPolicy.Due(cert) {
+				logger.Info("renewing before the renewal window.", "renew_at", renewAt)
+			}
+			if scepMetrics != nil {
+				scepMetrics.Renewal(cert)
+			}
 		} else {
 			println("scepclient - run - defining msgType - cert is nil - msgType = scep.PKCSReq")
 			msgType = scep.PKCSReq
@@ -186,10 +425,13 @@ func run(cfg runCfg) error {
 	}
 
 	var recipients []*x509.Certificate
-	if cfg.caMD5 == "" {
-		recipients = certs
-	} else {
-		r, err := findRecipients(cfg.caMD5, certs)
+	switch {
+	case cfg.caMD5 == "" && (cfg.compat == "ejbca" || scepclient.ServerProfiles[cfg.compat].IssuingCARecipient):
+		recipients = scepclient.IssuingCARecipients(certs)
+	case cfg.caMD5 == "":
+		recipients = scepclient.Recipients(certs)
+	default:
+		r, err := scepclient.FingerprintRecipients(cfg.caMD5, certs)
 		if err != nil {
 			return err
 		}
@@ -201,6 +443,17 @@ func run(cfg runCfg) error {
 		algo = pkcs7.EncryptionAlgorithmAES128GCM
 	}
 
+	if cfg.preflight != nil {
+		// fail early rather than with a FAILURE response
+		reason, err := cfg.preflight.VerifyCSR(ctx, csr, cfg.challenge)
+		if err != nil {
+			return fmt.Errorf("preflight: %w", err)
+		}
+		if reason != "" {
+			return fmt.Errorf("preflight rejected the request: %s", reason)
+		}
+	}
+
 	tmpl := &scep.PKIMessage{
 		MessageType:             msgType,
 		Recipients:              recipients,
@@ -217,43 +470,109 @@ func run(cfg runCfg) error {
 
 	msg, err := scep.NewCSRRequest(csr, tmpl, scep.WithLogger(logger))
 	if err != nil {
-		return errors.Wrap(err, "creating csr pkiMessage")
+		return fmt.Errorf("creating csr pkiMessage: %w", err)
 	}
+	ctx = scepserver.WithTransactionID(ctx, string(msg.TransactionID))
 
 	var respMsg *scep.PKIMessage
+	auditPending := func() {}
+	if cfg.auditor != nil {
+		ev := scepserver.AuditEvent{
+			TransactionID: string(msg.TransactionID),
+			MessageType:   msgType.String(),
+			Signer:        signerCert.Subject.String(),
+			Renewal:       cert != nil,
+			Subject:       csr.Subject.String(),
+			DNSNames:      csr.DNSNames,
+			Key:           "RSA " + strconv.Itoa(key.N.BitLen()),
+		}
+		auditPending = func() {
+			pending := ev
+			recordAudit(ctx, cfg.auditor, &pending, scepserver.AuditPending, logger)
+		}
+		// record the outcome of the request once it is known
+		defer func() {
+			var failInfo *scep.FailInfoError
+			switch {
+			case err == nil:
+				ev.Serial = respMsg.CertRepMessage.Certificate.SerialNumber.Text(16)
+				recordAudit(ctx, cfg.auditor, &ev, scepserver.AuditIssued, logger)
+			case errors.As(err, &failInfo):
+				ev.FailInfo = failInfo.FailInfo.String()
+				recordAudit(ctx, cfg.auditor, &ev, scepserver.AuditDenied, logger)
+			default:
+				ev.Reason = err.Error()
+				recordAudit(ctx, cfg.auditor, &ev, scepserver.AuditFailed, logger)
+			}
+		}()
+	}
 
+	var (
+		pendingSince time.Time
+		polls        int
+		maintenance  = scepserver.DefaultRetryPolicy
+		maintained   time.Duration
+	)
 	for {
 		// loop in case we get a PENDING response which requires
 		// a manual approval.
 
 		respBytes, err := client.PKIOperation(ctx, msg.Raw)
+		if d, ok := maintenance.MaintenanceWait(err, maintained); ok {
+			// the CA is in maintenance, which is not a failure; the
+			// request has the same transaction ID when sent again
+			logger.Info("server unavailable, trying again.", "retry_after", d, "transaction_id", msg.TransactionID)
+			// ctx is not canceled by signals outside of this wait
+			waitCtx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+			err := clock.Or(maintenance.Clock).Sleep(waitCtx, d)
+			stop()
+			if err != nil {
+				return fmt.Errorf("PKIOperation for %s: %w", msgType, err)
+			}
+			maintained += d
+			continue
+		}
 		if err != nil {
-			return errors.Wrapf(err, "PKIOperation for %s", msgType)
+			return fmt.Errorf("PKIOperation for %s: %w", msgType, err)
 		}
 
 		respMsg, err = scep.ParsePKIMessage(respBytes, scep.WithLogger(logger))
 		if err != nil {
-			return errors.Wrapf(err, "parsing pkiMessage response %s", msgType)
+			return fmt.Errorf("parsing pkiMessage response %s: %w", msgType, err)
 		}
 
 		switch respMsg.PKIStatus {
 		case scep.FAILURE:
-			return errors.Errorf("%s request failed, failInfo: %s", msgType, respMsg.FailInfo)
+			err := &scep.FailInfoError{MessageType: msgType, FailInfo: respMsg.FailInfo, Text: respMsg.FailInfoText}
+			if scepclient.ServerProfiles[cfg.compat].StickyFailures {
+				// the transaction ID is derived from the key
+				return fmt.Errorf("%w; the server answers the requests of this key with this failure, remove %s and %s to request a certificate for a new key", err, cfg.keyPath, cfg.csrPath)
+			}
+			return err
 		case scep.PENDING:
-			lginfo.Log("pkiStatus", "PENDING", "msg", "sleeping for 30 seconds, then trying again.")
-			time.Sleep(30 * time.Second)
+			if scepMetrics != nil {
+				scepMetrics.PendingPoll()
+			}
+			if polls == 0 {
+				pendingSince = time.Now()
+				auditPending()
+			}
+			logger.Info("waiting, then trying again.", "pkiStatus", "PENDING", "delay", cfg.poll.Delay(polls), "transaction_id", msg.TransactionID)
+			if err := cfg.poll.Wait(ctx, pendingSince, polls); err != nil {
+				return fmt.Errorf("PKIOperation for %s, transaction %s: %w", msgType, msg.TransactionID, err)
+			}
+			polls++
 			continue
 		}
-		lginfo.Log("pkiStatus", "SUCCESS", "msg", "server returned a certificate.")
+		logger.Info("server returned a certificate.", "pkiStatus", "SUCCESS", "transaction_id", msg.TransactionID)
 		break // on scep.SUCCESS
 	}
 
 	if err := respMsg.DecryptPKIEnvelope(signerCert, key); err != nil {
-		return errors.Wrapf(err, "decrypt pkiEnvelope, msgType: %s, status %s", msgType, respMsg.PKIStatus)
+		return fmt.Errorf("decrypt pkiEnvelope, msgType: %s, status %s: %w", msgType, respMsg.PKIStatus, err)
 	}
 
-	respCert := respMsg.CertRepMessage.Certificate
-	if err := ioutil.WriteFile(cfg.certPath, pemCert(respCert.Raw), 0666); err != nil {
+	if err := writeCertificate(ctx, cfg, logger, key, respMsg.CertRepMessage.Certificate, certs); err != nil {
 		return err
 	}
 
@@ -267,19 +586,163 @@ func run(cfg runCfg) error {
 	return nil
 }
 
-// Determine the correct recipient based on the fingerprint.
-// In case of NDES that is the last certificate in the chain, not the RA cert.
-// Return a full chain starting with the cert that matches the fingerprint.
-func findRecipients(fingerprint string, certs []*x509.Certificate) ([]*x509.Certificate, error) {
-	fingerprint = strings.Join(strings.Split(fingerprint, " "), "")
-	fingerprint = strings.ToLower(fingerprint)
-	for i, cert := range certs {
-		sum := fmt.Sprintf("%x", md5.Sum(cert.Raw))
-		if sum == fingerprint {
-			return certs[i-1:], nil
+// writeCertificate writes cert to the certificate file, and with key
+// and the CA certificates among certs to the outputs.
+func writeCertificate(ctx context.Context, cfg runCfg, logger *slog.Logger, key *rsa.PrivateKey, cert *x509.Certificate, certs []*x509.Certificate) error {
+	if err := ioutil.WriteFile(cfg.certPath, pemCert(cert.Raw), 0666); err != nil {
+		return err
+	}
+	if len(cfg.outputs) == 0 {
+		return nil
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: rsaPrivateKeyPEMBlockType, Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	var caPEM []byte
+	for i, crt := range certs {
+		if !crt.IsCA {
+			continue
+		}
+		dup := false
+		for _, prev := range certs[:i] {
+			dup = dup || prev.Equal(crt)
+		}
+		if !dup {
+			caPEM = append(caPEM, pemCert(crt.Raw)...)
+		}
+	}
+	for _, out := range cfg.outputs {
+		if err := out.write(ctx, bundle.Bundle{Key: keyPEM, Certificate: pemCert(cert.Raw), CA: caPEM}); err != nil {
+			return fmt.Errorf("writing the certificate to %s: %w", out.name, err)
+		}
+		logger.Info("wrote the certificate.", "output", out.name)
+	}
+	return nil
+}
+
+// newLogger returns the logger of the client, logging to
+// standard error in logfmt, json or text by default.
+func newLogger(debug bool, logfmt string) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: slog.LevelInfo}
+	if debug {
+		opts.Level = slog.LevelDebug
+	}
+	if strings.ToLower(logfmt) == "json" {
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts))
+	}
+	return slog.New(slog.NewTextHandler(os.Stderr, opts))
+}
+
+// readSecret returns the trimmed contents of path if set,
+// or else the value of the environment variable env.
+func readSecret(path, env string) (string, error) {
+	if path == "" {
+		return os.Getenv(env), nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// headerFlags collects repeated -header "Name: value" flags.
+type headerFlags []struct{ key, value string }
+
+func (h *headerFlags) String() string {
+	var s []string
+	for _, hdr := range *h {
+		s = append(s, hdr.key+": "+hdr.value)
+	}
+	return strings.Join(s, ", ")
+}
+
+func (h *headerFlags) Set(value string) error {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+		return fmt.Errorf("header must be in the form \"Name: value\", got %q", value)
+	}
+	*h = append(*h, struct{ key, value string }{
+		strings.TrimSpace(parts[0]),
+		strings.TrimSpace(parts[1]),
+	})
+	return nil
+}
+
+// resolveFlags collects repeated -resolve "host:port:addr" flags.
+type resolveFlags []struct{ hostport, addr string }
+
+func (r *resolveFlags) String() string {
+	var s []string
+	for _, res := range *r {
+		s = append(s, res.hostport+":"+res.addr)
+	}
+	return strings.Join(s, ", ")
+}
+
+func (r *resolveFlags) Set(value string) error {
+	host, rest, ok := strings.Cut(value, ":")
+	port, addr, ok2 := strings.Cut(rest, ":")
+	if !ok || !ok2 || host == "" || port == "" || addr == "" {
+		return fmt.Errorf("invalid resolve %q, expected host:port:addr", value)
+	}
+	// allow IPv6 addresses in brackets, like curl
+	addr = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+	*r = append(*r, struct{ hostport, addr string }{net.JoinHostPort(host, port), addr})
+	return nil
+}
+
+// dnsResolver returns a resolver querying the DNS server at addr.
+func dnsResolver(addr string) *net.Resolver {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "53")
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// parseTLSVersion parses a TLS version such as "1.2". An empty
+// version is zero, which selects the default of crypto/tls.
+func parseTLSVersion(version string) (uint16, error) {
+	if version == "" {
+		return 0, nil
+	}
+	v, ok := tlsVersions[version]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version %q, expected 1.0, 1.1, 1.2 or 1.3", version)
+	}
+	return v, nil
+}
+
+// parseCipherSuites parses a comma separated list of
+// cipher suite names, such as TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256.
+func parseCipherSuites(names string) ([]uint16, error) {
+	if names == "" {
+		return nil, nil
+	}
+	known := make(map[string]uint16)
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		known[suite.Name] = suite.ID
+	}
+	var ids []uint16
+	for _, name := range strings.Split(names, ",") {
+		id, ok := known[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
 		}
+		ids = append(ids, id)
 	}
-	return nil, errors.Errorf("could not find cert for md5 %s", fingerprint)
+	return ids, nil
 }
 
 func validateFlags(keyPath, serverURL string) error {
@@ -297,10 +760,59 @@ func validateFlags(keyPath, serverURL string) error {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		if err := serve(os.Args[2:]); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "revoke" {
+		if err := revoke(os.Args[2:]); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "admin" {
+		if err := admin(os.Args[2:]); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "import-windows" {
+		if err := importWindows(os.Args[2:]); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "bootstrap" {
+		os.Exit(bootstrap(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "mobileconfig" {
+		if err := mobileConfig(os.Args[2:]); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	var (
 		flVersion           = flag.Bool("version", false, "prints version information")
 		flServerURL         = flag.String("server-url", "", "SCEP server url")
+		flMDMProfile        = flag.String("mdm-profile", "", "read the server URL, challenge, key size and subject from the SCEP payload of this configuration profile, e.g. an enrollment profile of MicroMDM or NanoMDM, unless set by their flags; the $NAME and %NAME% variables of the subject are read from the environment")
+		flProbe             = flag.Bool("probe", false, "check the SCEP endpoint, print its capabilities and CA certificates, and exit")
+		flDiscover          = flag.Bool("discover", false, "probe the well-known SCEP paths on the -server-url host and use the first one answering GetCACaps")
+		flPathRewrite       = flag.Bool("path-rewrite", true, "complete a -server-url without path to /cgi-bin/pkiclient.exe, and an NDES /certsrv/mscep to mscep.dll")
+		flServerProfile     = flag.String("server-profile", "", "adapt the requests to the quirks of a server: jamf, for the SCEP proxy of Jamf Pro (GET-only PKIOperation, standard base64 messages, Accept header, PrintableString challenge passwords); ejbca, for EJBCA (alias path completed, standard base64 messages, issuing CA of the chain as recipient); scepman, sectigo or digicert, for these hosted gateways, stepca, for the SCEP provisioners of step-ca, and openxpki, for the SCEP endpoints of OpenXPKI, completing a -server-url without path")
+		flServerProfileID   = flag.String("server-profile-id", "", "ID of the tenant or SCEP profile on the gateway of -server-profile sectigo or digicert, or name of the SCEP provisioner of -server-profile stepca or endpoint of -server-profile openxpki, in the path of its URL")
+		flStepCAFingerprint = flag.String("stepca-fingerprint", "", "SHA-256 fingerprint of the root of a step-ca server, which is fetched from it and verifies its HTTPS certificate, as step ca bootstrap does")
+		flServerAPIKeyFile  = flag.String("server-api-key-file", "", "file containing the API key of the gateway of -server-profile digicert, read from $SCEPCLIENT_SERVER_API_KEY by default")
+		flEJBCAAlias        = flag.String("ejbca-alias", "", "SCEP alias of -server-profile ejbca, completing a -server-url without the alias path; scep, the default alias of EJBCA, if empty")
 		flChallengePassword = flag.String("challenge", "", "enforce a challenge password")
+		flPreflight         = flag.String("preflight-command", "", "check the CSR and challenge password with this command before sending them, as the -verify-command of serve does")
 		flPKeyPath          = flag.String("private-key", "", "private key path, if there is no key, scepclient will create one")
 		flCertPath          = flag.String("certificate", "", "certificate path, if there is no key, scepclient will create one")
 		flKeySize           = flag.Int("keySize", 2048, "rsa key size")
@@ -313,11 +825,189 @@ func main() {
 
 		// in case of multiple certificate authorities, we need to figure out who the recipient of the encrypted
 		// data is.
-		flCAFingerprint = flag.String("ca-fingerprint", "", "md5 fingerprint of CA certificate for NDES server.")
+		flCAFingerprint = flag.String("ca-fingerprint", "", "md5 fingerprint of the CA certificate of an NDES server, encrypting requests to the RA certificate listed before it by GetCACert, and the rest of the list")
+
+		flRetries   = flag.Int("retries", 0, "retry requests failing with transient errors up to this many times (PKIOperation is never retried)")
+		flRateLimit = flag.Float64("rate-limit", 0, "maximum number of requests per second sent to the server, 0 for no limit")
+
+		flUserAgent = flag.String("user-agent", "scepclient/"+version, "User-Agent header sent to the server")
+
+		// HTTP Basic authentication for RA front-ends protecting the SCEP path.
+		// Defaults are read from the SCEPCLIENT_AUTH_USER and SCEPCLIENT_AUTH_PASSWORD environment variables.
+		flAuthUser         = flag.String("auth-user", os.Getenv("SCEPCLIENT_AUTH_USER"), "username for HTTP Basic authentication")
+		flAuthPasswordFile = flag.String("auth-password-file", "", "file containing the password for HTTP Basic authentication")
+		flNTLM             = flag.Bool("ntlm", false, "use the -auth-user credentials for NTLM authentication, e.g. for NDES behind Windows Integrated Authentication")
+
+		// Kerberos (SPNEGO) authentication, with either a keytab or a credentials cache.
+		flKrb5Conf  = flag.String("krb5-conf", "/etc/krb5.conf", "path of krb5.conf for Kerberos authentication")
+		flKrbKeytab = flag.String("krb-keytab", "", "keytab for Kerberos authentication as -krb-user@-krb-realm")
+		flKrbUser   = flag.String("krb-user", "", "Kerberos username for keytab authentication")
+		flKrbRealm  = flag.String("krb-realm", "", "Kerberos realm for keytab authentication")
+		flKrbCCache = flag.String("krb-ccache", "", "Kerberos credentials cache, e.g. obtained with kinit")
+		flKrbSPN    = flag.String("krb-spn", "", "service principal of the SCEP server, defaults to HTTP/<server host>")
+
+		// client certificate for HTTPS endpoints requiring mutual TLS
+		flTLSCert     = flag.String("tls-cert", "", "client certificate presented to the HTTPS server")
+		flTLSKey      = flag.String("tls-key", "", "private key of the -tls-cert client certificate")
+		flTLSSCEPCert = flag.Bool("tls-scep-cert", false, "present the previously issued -certificate as TLS client certificate, e.g. for renewals")
+
+		// connection reuse
+		flHTTP2       = flag.Bool("http2", true, "use HTTP/2 with HTTPS servers supporting it")
+		flCompression = flag.Bool("compression", true, "request gzip or deflate compressed responses")
+		flIdleConns   = flag.Int("idle-conns", 2, "maximum number of idle connections kept open to the server")
+		flIdleTimeout = flag.Duration("idle-timeout", 90*time.Second, "how long idle connections are kept open, 0 for no limit")
+		flKeepAlive   = flag.Duration("keep-alive", 30*time.Second, "interval of TCP keep-alive probes, negative to disable")
+
+		// redirects, e.g. from /cgi-bin/pkiclient.exe to a vendor-specific path
+		flMaxRedirects     = flag.Int("max-redirects", 10, "maximum number of redirects followed per request, 0 to follow none")
+		flRedirectSameHost = flag.Bool("redirect-same-host", false, "only follow redirects to the host of -server-url")
+		flRedirectPOST     = flag.Bool("redirect-post", true, "follow 307 and 308 redirects of POST requests, resending the message")
+
+		flStrictCT = flag.Bool("strict-content-type", false, "reject responses whose Content-Type does not match the operation, such as HTML error pages")
+
+		flMetricsFile = flag.String("metrics-textfile", "", "write Prometheus metrics to this file on exit, for the node_exporter textfile collector")
+
+		// security audit events of the enrollments and renewals, e.g. for a SIEM
+		flAuditLog    = flag.String("audit-log", "", "append an audit event for every enrollment and renewal to this file, one per line; - for standard output")
+		flAuditFormat = flag.String("audit-format", "json", "format of the audit events of -audit-log and -audit-syslog: json, cef for ArcSight or leef for QRadar")
+		flAuditSyslog = flag.String("audit-syslog", "", "also send the audit events to this syslog daemon: local, udp://host:514, tcp://host:514 or host:514 for UDP")
+
+		// per-operation timeouts, 0 for none
+		flCapsTimeout   = flag.Duration("caps-timeout", 30*time.Second, "timeout of GetCACaps requests")
+		flCACertTimeout = flag.Duration("cacert-timeout", 30*time.Second, "timeout of GetCACert requests")
+		flPKITimeout    = flag.Duration("pkioperation-timeout", 2*time.Minute, "timeout of PKIOperation requests")
+
+		flDNSServer = flag.String("dns-server", "", "DNS server used to look up the SCEP server, instead of the system resolver")
+
+		flIPv4          = flag.Bool("ipv4", false, "only connect to the server over IPv4")
+		flIPv6          = flag.Bool("ipv6", false, "only connect to the server over IPv6")
+		flFallbackDelay = flag.Duration("fallback-delay", 300*time.Millisecond, "delay before falling back to the other IP version on dual-stack hosts, negative to disable")
+
+		flCorrelationID = flag.String("correlation-id", "", "ID correlating the log lines and requests of this enrollment, random by default")
+		flRequestIDHdr  = flag.String("request-id-header", "", "send the correlation ID to the server in this header, e.g. X-Request-ID")
+
+		flHARFile = flag.String("har", "", "record all HTTP exchanges, with credentials and -header values redacted, to this HAR file for bug reports")
+
+		flTLSMin     = flag.String("tls-min-version", "", "minimum TLS version: 1.0, 1.1, 1.2 or 1.3")
+		flTLSMax     = flag.String("tls-max-version", "", "maximum TLS version: 1.0, 1.1, 1.2 or 1.3")
+		flTLSCiphers = flag.String("tls-ciphers", "", "comma separated TLS 1.0-1.2 cipher suites, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256")
+
+		// polling of PENDING requests awaiting manual approval
+		flPollInterval    = flag.Duration("poll-interval", 30*time.Second, "delay before polling a PENDING request")
+		flPollMaxInterval = flag.Duration("poll-max-interval", 0, "double the poll delay up to this interval, 0 for a fixed -poll-interval")
+		flPollTimeout     = flag.Duration("poll-timeout", 0, "give up on a PENDING request after this long, 0 to poll forever")
+
+		// outputs, besides the files, receiving the key, certificate and CA certificates
+		flK8sSecret      = flag.String("k8s-secret", "", "also write the key, certificate and CA certificates to this kubernetes.io/tls Secret, as name in the namespace of the pod or namespace/name, using the service account of the pod")
+		flVaultKVPath    = flag.String("vault-kv-path", "", "also write the key, certificate and CA certificates to this path of the Vault KV secrets engine, authenticating with the token in $VAULT_TOKEN or -vault-role-id")
+		flVaultAddr      = flag.String("vault-addr", os.Getenv("VAULT_ADDR"), "address of the Vault server of -vault-kv-path")
+		flVaultNS        = flag.String("vault-namespace", os.Getenv("VAULT_NAMESPACE"), "Vault Enterprise namespace")
+		flVaultKVMount   = flag.String("vault-kv-mount", "secret", "path of the Vault KV secrets engine")
+		flVaultKVVersion = flag.Int("vault-kv-version", 2, "version of the Vault KV secrets engine, 1 or 2")
+		flVaultRoleID    = flag.String("vault-role-id", "", "log in to Vault with this AppRole role ID, instead of the token in $VAULT_TOKEN")
+		flVaultSecretID  = flag.String("vault-secret-id-file", "", "file containing the AppRole secret ID, read from $VAULT_SECRET_ID by default")
+		flAWSSecretID    = flag.String("aws-secret-id", "", "also write the certificate and CA certificates to this AWS Secrets Manager secret, created if it does not exist, with the credentials of the environment, ECS task or EC2 instance")
+		flAWSSSMPrefix   = flag.String("aws-ssm-prefix", "", "also write the certificate and CA certificates to the SSM parameters certificate and ca_chain under this path, e.g. /scep/web")
+		flAWSRegion      = flag.String("aws-region", awsRegion(), "AWS region of -aws-secret-id and -aws-ssm-prefix, $AWS_REGION by default")
+		flAWSIncludeKey  = flag.Bool("aws-include-key", false, "also write the private key to -aws-secret-id, and to the SecureString parameter private_key of -aws-ssm-prefix")
+		flAWSKMSKey      = flag.String("aws-kms-key", "", "KMS key encrypting created secrets and the private key parameter, instead of the AWS managed key")
+		flAWSTags        = flag.String("aws-tags", "", "comma separated key=value tags of the AWS secret and parameters, besides the scep:serial-number, scep:not-after and scep:renew-at tags")
+		flAzureKVCert    = flag.String("azure-kv-cert", "", "also import the key, certificate and CA certificates into this Azure Key Vault certificate, as a new version, with the managed identity of the instance or -azure-client-id")
+		flAzureVaultURL  = flag.String("azure-vault-url", "", "URL of the Azure Key Vault of -azure-kv-cert, https://<vault>.vault.azure.net")
+		flAzureTenantID  = flag.String("azure-tenant-id", os.Getenv("AZURE_TENANT_ID"), "tenant of -azure-client-id, to authenticate with its client secret")
+		flAzureClientID  = flag.String("azure-client-id", os.Getenv("AZURE_CLIENT_ID"), "application authenticating with the client secret of -azure-client-secret-file, or user-assigned managed identity without one")
+		flAzureSecret    = flag.String("azure-client-secret-file", "", "file containing the client secret of -azure-client-id, read from $AZURE_CLIENT_SECRET by default")
+		flAzureTags      = flag.String("azure-tags", "", "comma separated key=value tags of the imported Key Vault certificate versions")
+		flGCPSecret      = flag.String("gcp-secret", "", "also add the key, certificate and CA certificates, in PEM, as a new version of this Google Cloud Secret Manager secret, name or projects/<project>/secrets/<name>, created if it does not exist, with the service account of the instance or the token in $GOOGLE_OAUTH_ACCESS_TOKEN")
+		flGCPProject     = flag.String("gcp-project", os.Getenv("GOOGLE_CLOUD_PROJECT"), "project of -gcp-secret")
+		flGCPLabels      = flag.String("gcp-labels", "", "comma separated key=value labels of the secret created for -gcp-secret")
+		flGCPDisable     = flag.Bool("gcp-disable-superseded", true, "disable the older versions of -gcp-secret once the new version is added")
+		flDockerSecret   = flag.String("docker-secret", "", "also create the key, certificate and CA certificates as the Docker Swarm secrets <name>-key-<hash>, <name>-crt-<hash> and <name>-ca-<hash>, and update the services referencing their previous versions, with the Docker Engine of $DOCKER_HOST, a manager node")
+		flDockerLabels   = flag.String("docker-labels", "", "comma separated key=value labels of the secrets created for -docker-secret")
+		flDockerRemove   = flag.Bool("docker-remove-superseded", true, "remove the previous versions of -docker-secret once no service references them")
+		flIISSite        = flag.String("iis-site", "", "on Windows, also install the key and certificate into the LocalMachine\\My store, and bind the certificate to the HTTPS bindings on -iis-port of this IIS site")
+		flIISPort        = flag.Int("iis-port", 443, "port of the HTTPS bindings of -iis-site")
+		flDeploy         = flag.String("deploy", "", "also deploy the key and certificate to a server, nginx, apache or haproxy: replace -deploy-cert and -deploy-key, test the configuration and reload the server, restoring the previous files if either fails")
+		flDeployCert     = flag.String("deploy-cert", "", "certificate file of -deploy, receiving the certificate and CA certificates, and for haproxy the key")
+		flDeployKey      = flag.String("deploy-key", "", "key file of -deploy, unused for haproxy")
+		flDeployReload   = flag.String("deploy-reload", "systemctl", "reload the server of -deploy with systemctl or a signal to the process in -deploy-pid-file")
+		flDeployService  = flag.String("deploy-service", "", "systemd unit of -deploy, nginx, apache2 or haproxy by default, e.g. httpd for Apache on Red Hat")
+		flDeployPIDFile  = flag.String("deploy-pid-file", "", "PID file of -deploy, /run/nginx.pid, /run/apache2/apache2.pid or /run/haproxy.pid by default")
+		flDot1xConfig    = flag.String("dot1x-config", "", "also write a wpa_supplicant or NetworkManager configuration to this file, authenticating with EAP-TLS with the key and certificate files")
+		flDot1xFormat    = flag.String("dot1x-format", "wpa_supplicant", "format of -dot1x-config, wpa_supplicant or networkmanager")
+		flDot1xIdentity  = flag.String("dot1x-identity", "", "EAP identity of -dot1x-config, -cn by default")
+		flDot1xSSID      = flag.String("dot1x-ssid", "", "SSID of the wireless network of -dot1x-config, a wired network if empty")
+		flDot1xCA        = flag.String("dot1x-ca", "", "CA certificates verifying the authentication server, e.g. of a RADIUS server issued by another CA; by default the CA certificates of the SCEP server, written to ca.pem next to -private-key")
+		flDot1xDomain    = flag.String("dot1x-domain", "", "domain the name of the authentication server's certificate must be in")
+		flDot1xName      = flag.String("dot1x-connection", "802.1X", "name of the NetworkManager connection")
+		flDot1xIface     = flag.String("dot1x-interface", "", "interface of the NetworkManager connection")
+
+		// enrollment with a CMP server instead of SCEP
+		flCMPURL        = flag.String("cmp-url", "", "enroll with this CMP (RFC 4210) server instead of the SCEP -server-url, e.g. http://ca.example.com/ejbca/publicweb/cmp/alias")
+		flCMPReference  = flag.String("cmp-reference", "", "reference value identifying -cmp-secret-file to the CA")
+		flCMPSecretFile = flag.String("cmp-secret-file", "", "file containing the secret shared with the CA, protecting the CMP requests with a MAC, read from $SCEPCLIENT_CMP_SECRET by default")
+		flCMPCACert     = flag.String("cmp-ca-cert", "", "CA certificates trusted to sign the CMP responses, in PEM; the first one is the recipient of the requests")
+		flCMPSignerCert = flag.String("cmp-signer-cert", "", "without a secret, sign the CMP requests with this certificate, followed by its intermediate certificates, e.g. a device certificate of its vendor; by default the existing -certificate")
+		flCMPSignerKey  = flag.String("cmp-signer-key", "", "RSA key of -cmp-signer-cert")
+		flCMPMessage    = flag.String("cmp-message", "", "CMP request, ir, cr or kur; ir, or kur updating an existing -certificate, by default")
+
+		// ACME, e.g. to converge estates of SCEP and ACME CAs on one renewal agent
+		flACMEDirectory   = flag.String("acme-directory", "", "directory URL of an ACME (RFC 8555) CA, enrolling the -cn and -acme-dns names with it, e.g. https://acme-v02.api.letsencrypt.org/directory")
+		flACMEMode        = flag.String("acme-mode", "fallback", "primary: enroll with -acme-directory only; fallback: enroll with it when the SCEP or CMP enrollment fails")
+		flACMEAccountKey  = flag.String("acme-account-key", "", "ECDSA key of the ACME account, created if there is none; acme-account.pem next to -private-key by default")
+		flACMEEmail       = flag.String("acme-email", "", "contact email of the ACME account")
+		flACMEEABKID      = flag.String("acme-eab-kid", "", "key ID of the external account binding required by some ACME CAs")
+		flACMEEABHMACFile = flag.String("acme-eab-hmac-file", "", "file containing the base64url HMAC key of -acme-eab-kid, read from $SCEPCLIENT_ACME_EAB_HMAC by default")
+		flACMEDNS         = flag.String("acme-dns", "", "comma separated DNS names requested with the -cn from the ACME CA")
+		flACMEListen      = flag.String("acme-http-listen", ":80", "address answering the http-01 challenges of the ACME CA")
+		flACMEWebroot     = flag.String("acme-webroot", "", "answer the http-01 challenges with files in the .well-known/acme-challenge directory of this web server root, instead of -acme-http-listen")
+
+		// sidecar mode, e.g. in a pod sharing the key and certificate on an emptyDir volume
+		flSidecar       = flag.Bool("sidecar", false, "keep running: enroll at startup unless the certificate is valid, and renew it when it is due, until SIGTERM")
+		flCheckInterval = flag.Duration("renew-check-interval", time.Hour, "in -sidecar mode, interval of the renewal checks and of the retries of failed enrollments")
+		flReloadPID     = flag.Int("reload-pid", 0, "in -sidecar mode, send SIGHUP to this process after every enrollment, e.g. with a process namespace shared in the pod")
+		flReloadURL     = flag.String("reload-url", "", "in -sidecar mode, POST to this URL after every enrollment, e.g. http://localhost:8080/-/reload")
+		flMetricsListen = flag.String("metrics-listen", "", "in -sidecar mode, serve Prometheus metrics of the certificate at /metrics on this address, e.g. :9436: seconds until expiry, time of the last renewal and last pkiStatus")
+		flMetricsID     = flag.String("metrics-identity", "", "in -sidecar mode, the identity label of the metrics, the certificate path by default")
+
+		// Envoy SDS server of the sidecar mode, e.g. for Envoy or an Istio gateway in the pod
+		flSDSListen = flag.String("sds-listen", "", "in -sidecar mode, serve the key and certificate and the CA certificates to Envoy over its Secret Discovery Service on this address, unix:///path or host:port, pushing every renewal")
+		flSDSName   = flag.String("sds-secret", "default", "name of the SDS secret of the key and certificate, followed by the CA certificates")
+		flSDSCAName = flag.String("sds-ca-secret", "ROOTCA", "name of the SDS secret of the CA certificates, a validation context")
+		flSDSCAFile = flag.String("sds-ca-file", "", "file keeping the CA certificates served by -sds-listen across restarts, ca.pem next to the key by default")
+
+		// alerts of the sidecar mode, for SNMP or Nagios based monitoring
+		flAlertSNMP      = flag.String("alert-snmp", "", "in -sidecar mode, send SNMPv2c traps to this receiver, host or host:port, when renewals fail for good or the certificate nears its expiry, and when it recovers")
+		flAlertCommunity = flag.String("alert-snmp-community", "public", "community of the traps of -alert-snmp")
+		flAlertOID       = flag.String("alert-snmp-oid", notify.DefaultTrapOID, "base OID of the traps and variables of -alert-snmp: base.0.1 renewal failed, base.0.2 expiry critical, base.0.3 recovered")
+		flAlertNagios    = flag.String("alert-nagios-cmd", "", "in -sidecar mode, write the same alerts as passive check results to this Nagios external command file, e.g. /var/lib/nagios4/rw/nagios.cmd")
+		flAlertHost      = flag.String("alert-nagios-host", "", "host of the passive checks of -alert-nagios-cmd, the hostname by default")
+		flAlertService   = flag.String("alert-nagios-service", "SCEP certificate", "service of the passive checks of -alert-nagios-cmd")
+		flAlertFailures  = flag.Int("alert-failures", 3, "failed renewals in a row after which an alert is sent; renewals denied by the server are sent at once")
+		flAlertExpiry    = flag.Duration("alert-expiry", 72*time.Hour, "remaining validity of the certificate under which an alert is sent")
+
+		// notifications of the sidecar mode, by webhook or email
+		flNotifyWebhook = flag.String("notify-webhook", "", "in -sidecar mode, POST the events of -notify-events as JSON to this URL")
+		flNotifySecret  = flag.String("notify-webhook-secret-file", "", "file containing the secret signing the requests of -notify-webhook in the X-SCEP-Signature header, read from $SCEPCLIENT_NOTIFY_WEBHOOK_SECRET by default")
+		flNotifySMTP    = flag.String("notify-smtp", "", "in -sidecar mode, email the events of -notify-events through this SMTP server, host:port")
+		flNotifyFrom    = flag.String("notify-email-from", "", "sender of the emails of -notify-smtp")
+		flNotifyTo      = flag.String("notify-email-to", "", "comma separated recipients of the emails of -notify-smtp")
+		flNotifyUser    = flag.String("notify-smtp-user", "", "username authenticating with -notify-smtp, with the password of -notify-smtp-password-file")
+		flNotifyPass    = flag.String("notify-smtp-password-file", "", "file containing the password of -notify-smtp-user, read from $SCEPCLIENT_NOTIFY_SMTP_PASSWORD by default")
+		flNotifySlack   = flag.String("notify-slack", "", "in -sidecar mode, post the events of -notify-events to this Slack incoming webhook URL")
+		flNotifyTeams   = flag.String("notify-teams", "", "in -sidecar mode, post the events of -notify-events as Adaptive Cards to this Microsoft Teams incoming webhook URL")
+		flNotifyEvents  = flag.String("notify-events", "enrolled,renewal_failed,expiry_critical,ca_rollover,recovered", "comma separated events sent by -notify-webhook, -notify-smtp, -notify-slack and -notify-teams")
+
+		// Ansible module mode, e.g. wrapped in a WANT_JSON script of a role
+		flAnsible = flag.Bool("ansible", false, "run as an Ansible module: enroll only if the key and certificate are missing, do not match or are due for renewal, and print the JSON result of modules, with changed, failed, msg and the paths of the artifacts; the arguments of the module, flags by name, are read from the JSON file given as argument, as Ansible passes them")
 
 		flDebugLogging = flag.Bool("debug", false, "enable debug logging")
 		flLogJSON      = flag.Bool("log-json", false, "use JSON for log output")
 	)
+	var headers headerFlags
+	var resolve resolveFlags
+	flag.Var(&resolve, "resolve", "connect to addr for host:port, as \"host:port:addr\" (repeatable)")
+	flag.Var(&headers, "header", "extra HTTP header sent with every request, as \"Name: value\" (repeatable)")
 	flag.Parse()
 
 	// print version information
@@ -326,8 +1016,99 @@ func main() {
 		fmt.Printf("git revision - %v\n", gitHash)
 		os.Exit(0)
 	}
+	if *flAnsible {
+		if flag.NArg() > 1 {
+			fmt.Println("-ansible takes one arguments file")
+			os.Exit(1)
+		}
+		os.Exit(ansible(os.Args[1:len(os.Args)-flag.NArg()], flag.Arg(0)))
+	}
+
+	if *flMDMProfile != "" {
+		if err := applyMDMProfile(*flMDMProfile); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	serverURL := *flServerURL
+	if *flCMPURL != "" {
+		serverURL = *flCMPURL
+	}
+	if *flACMEDirectory != "" && *flACMEMode == "primary" {
+		serverURL = *flACMEDirectory
+	}
+	if err := validateFlags(*flPKeyPath, serverURL); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	network := "tcp"
+	switch {
+	case *flIPv4 && *flIPv6:
+		fmt.Println("-ipv4 and -ipv6 are mutually exclusive")
+		os.Exit(1)
+	case *flIPv4:
+		network = "tcp4"
+	case *flIPv6:
+		network = "tcp6"
+	}
+
+	tlsMin, err := parseTLSVersion(*flTLSMin)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	tlsMax, err := parseTLSVersion(*flTLSMax)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	tlsCiphers, err := parseCipherSuites(*flTLSCiphers)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	switch *flServerProfile {
+	case "":
+	case "jamf":
+		if *flChallengePassword, err = scepclient.JamfChallenge(*flChallengePassword); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	case "ejbca":
+		if *flServerURL, err = scepclient.EJBCAURL(*flServerURL, *flEJBCAAlias); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	default:
+		profile, ok := scepclient.ServerProfiles[*flServerProfile]
+		if !ok {
+			fmt.Printf("unknown -server-profile %q, expected jamf, ejbca, %s\n", *flServerProfile, strings.Join(scepclient.ServerProfileNames(), ", "))
+			os.Exit(1)
+		}
+		if *flServerURL, err = profile.URL(*flServerURL, *flServerProfileID); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if profile.APIKeyHeader != "" {
+			apiKey, err := readSecret(*flServerAPIKeyFile, "SCEPCLIENT_SERVER_API_KEY")
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			if apiKey != "" {
+				headers = append(headers, struct{ key, value string }{profile.APIKeyHeader, apiKey})
+			}
+		}
+		if *flRetries == 0 {
+			*flRetries = profile.Retries
+		}
+	}
 
-	if err := validateFlags(*flPKeyPath, *flServerURL); err != nil {
+	authPassword, err := readSecret(*flAuthPasswordFile, "SCEPCLIENT_AUTH_PASSWORD")
+	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
@@ -361,9 +1142,342 @@ func main() {
 		caMD5:        *flCAFingerprint,
 		debug:        *flDebugLogging,
 		logfmt:       logfmt,
+		retries:      *flRetries,
+		rateLimit:    *flRateLimit,
+		userAgent:    *flUserAgent,
+		headers:      headers,
+		authUser:     *flAuthUser,
+		authPassword: authPassword,
+		ntlm:         *flNTLM,
+		kerberos: kerberos.Config{
+			Krb5Conf: *flKrb5Conf,
+			Keytab:   *flKrbKeytab,
+			Username: *flKrbUser,
+			Realm:    *flKrbRealm,
+			CCache:   *flKrbCCache,
+			SPN:      *flKrbSPN,
+		},
+		tlsCert:     *flTLSCert,
+		tlsKey:      *flTLSKey,
+		tlsSCEPCert: *flTLSSCEPCert,
+		http2:       *flHTTP2,
+		idleConns:   *flIdleConns,
+		idleTimeout: *flIdleTimeout,
+		keepAlive:   *flKeepAlive,
+		redirect: scepserver.RedirectPolicy{
+			MaxRedirects: *flMaxRedirects,
+			SameHost:     *flRedirectSameHost,
+			PreservePOST: *flRedirectPOST,
+		},
+		strictCT:    *flStrictCT,
+		metricsFile: *flMetricsFile,
+		timeouts: map[string]time.Duration{
+			"GetCACaps":    *flCapsTimeout,
+			"GetCACert":    *flCACertTimeout,
+			"PKIOperation": *flPKITimeout,
+		},
+		resolve:      resolve,
+		dnsServer:    *flDNSServer,
+		network:      network,
+		fallback:     *flFallbackDelay,
+		correlateID:  *flCorrelationID,
+		requestIDHdr: *flRequestIDHdr,
+		harFile:      *flHARFile,
+		tlsMin:       tlsMin,
+		tlsMax:       tlsMax,
+		tlsCiphers:   tlsCiphers,
+		compression:  *flCompression,
+		pathRewrite:  *flPathRewrite,
+		compat:       *flServerProfile,
+		stepCAPin:    *flStepCAFingerprint,
+		discover:     *flDiscover,
+		probe:        *flProbe,
+		poll: scepclient.PollPolicy{
+			Interval:    *flPollInterval,
+			MaxInterval: *flPollMaxInterval,
+			MaxWait:     *flPollTimeout,
+		},
+	}
+	if *flK8sSecret != "" {
+		out, err := k8sSecretOutput(*flK8sSecret)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		cfg.outputs = append(cfg.outputs, out)
+	}
+	if *flVaultKVPath != "" {
+		secretID, err := readSecret(*flVaultSecretID, "VAULT_SECRET_ID")
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		out, err := vaultKVOutput(*flVaultKVPath, vaultkv.Config{
+			Address:   *flVaultAddr,
+			Token:     os.Getenv("VAULT_TOKEN"),
+			RoleID:    *flVaultRoleID,
+			SecretID:  secretID,
+			Namespace: *flVaultNS,
+			Mount:     *flVaultKVMount,
+			KVVersion: *flVaultKVVersion,
+		})
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		cfg.outputs = append(cfg.outputs, out)
+	}
+	if *flAWSSecretID != "" || *flAWSSSMPrefix != "" {
+		tags, err := parseTags(*flAWSTags)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		outs, err := awsOutputs(*flAWSSecretID, *flAWSSSMPrefix, awssecret.Config{
+			Region:     *flAWSRegion,
+			IncludeKey: *flAWSIncludeKey,
+			KMSKeyID:   *flAWSKMSKey,
+			Tags:       tags,
+		})
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		cfg.outputs = append(cfg.outputs, outs...)
+	}
+	if *flAzureKVCert != "" {
+		tags, err := parseTags(*flAzureTags)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		secret, err := readSecret(*flAzureSecret, "AZURE_CLIENT_SECRET")
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		config := azurekv.Config{VaultURL: *flAzureVaultURL, Tags: tags}
+		if secret != "" {
+			config.Token = cloudauth.AzureClientCredentials(nil, *flAzureTenantID, *flAzureClientID, secret, "https://vault.azure.net/.default")
+		} else {
+			config.Token = cloudauth.AzureManagedIdentity(nil, "https://vault.azure.net", *flAzureClientID)
+		}
+		out, err := azureKVOutput(*flAzureKVCert, config)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		cfg.outputs = append(cfg.outputs, out)
+	}
+	if *flGCPSecret != "" {
+		labels, err := parseTags(*flGCPLabels)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		config := gcpsecret.Config{Project: *flGCPProject, Labels: labels, DisableSuperseded: *flGCPDisable}
+		if token := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"); token != "" {
+			config.Token = cloudauth.StaticToken(token)
+		}
+		out, err := gcpSecretOutput(*flGCPSecret, config)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		cfg.outputs = append(cfg.outputs, out)
+	}
+	if *flDockerSecret != "" {
+		labels, err := parseTags(*flDockerLabels)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		config, err := dockersecret.FromEnv()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		config.Labels, config.RemoveSuperseded = labels, *flDockerRemove
+		out, err := dockerSecretOutput(*flDockerSecret, config, newLogger(cfg.debug, cfg.logfmt))
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		cfg.outputs = append(cfg.outputs, out)
+	}
+	if *flIISSite != "" {
+		out, err := iisOutput(*flIISSite, *flIISPort)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		cfg.outputs = append(cfg.outputs, out)
+	}
+	if *flDeploy != "" {
+		out, err := deployOutput(deployCfg{
+			target:   *flDeploy,
+			certPath: *flDeployCert,
+			keyPath:  *flDeployKey,
+			reload:   *flDeployReload,
+			service:  *flDeployService,
+			pidFile:  *flDeployPIDFile,
+		})
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		cfg.outputs = append(cfg.outputs, out)
+	}
+	if *flDot1xConfig != "" {
+		config := dot1x.Config{
+			Identity:          *flDot1xIdentity,
+			SSID:              *flDot1xSSID,
+			CACert:            *flDot1xCA,
+			ClientCert:        cfg.certPath,
+			PrivateKey:        cfg.keyPath,
+			DomainSuffixMatch: *flDot1xDomain,
+			Name:              *flDot1xName,
+			Interface:         *flDot1xIface,
+		}
+		if config.Identity == "" {
+			config.Identity = cfg.cn
+		}
+		writeCA := config.CACert == ""
+		if writeCA {
+			config.CACert = filepath.Join(dir, "ca.pem")
+		}
+		// the supplicant does not run in the working directory
+		for _, path := range []*string{&config.CACert, &config.ClientCert, &config.PrivateKey} {
+			if *path, err = filepath.Abs(*path); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		}
+		out, err := dot1xOutput(*flDot1xConfig, *flDot1xFormat, writeCA, config)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		cfg.outputs = append(cfg.outputs, out)
+	}
+	var sdsConfig *sdsCfg
+	if *flSDSListen != "" {
+		if !*flSidecar {
+			fmt.Println("-sds-listen requires -sidecar")
+			os.Exit(1)
+		}
+		sdsConfig = &sdsCfg{
+			addr:   *flSDSListen,
+			name:   *flSDSName,
+			caName: *flSDSCAName,
+			caFile: *flSDSCAFile,
+			server: &sds.Server{Logger: newLogger(cfg.debug, cfg.logfmt)},
+		}
+		if sdsConfig.caFile == "" {
+			sdsConfig.caFile = filepath.Join(dir, "ca.pem")
+		}
+		cfg.outputs = append(cfg.outputs, sdsOutput(sdsConfig))
+	}
+	// the audit log and syslog connection stay open until exit
+	if cfg.auditor, _, err = openAuditor(*flAuditFormat, *flAuditLog, *flAuditSyslog); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if *flCMPURL != "" {
+		cmpConfig, err := newCMPCfg(*flCMPURL, *flCMPReference, *flCMPSecretFile, *flCMPCACert, *flCMPSignerCert, *flCMPSignerKey, *flCMPMessage)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		cfg.cmp = cmpConfig
+	}
+	if *flACMEDirectory != "" {
+		if *flACMEAccountKey == "" {
+			*flACMEAccountKey = filepath.Join(dir, "acme-account.pem")
+		}
+		acmeConfig, err := newACMECfg(*flACMEDirectory, *flACMEMode, *flACMEAccountKey, *flACMEEmail, *flACMEEABKID, *flACMEEABHMACFile, *flACMEListen, *flACMEWebroot, *flACMEDNS)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		cfg.acme = acmeConfig
+	}
+	if args := strings.Fields(*flPreflight); len(args) > 0 {
+		cfg.preflight = &scepserver.CommandVerifier{Path: args[0], Args: args[1:], Timeout: *flPKITimeout}
+	}
+
+	var notifiers []notify.Notifier
+	if *flAlertSNMP != "" {
+		trap := notify.NewSNMPTrap(*flAlertSNMP, *flAlertCommunity)
+		trap.OID = *flAlertOID
+		notifiers = append(notifiers, notify.Filter(trap, notify.RenewalFailed, notify.ExpiryCritical, notify.Recovered))
+	}
+	if *flAlertNagios != "" {
+		host := *flAlertHost
+		if host == "" {
+			host, _ = os.Hostname()
+		}
+		nagios := &notify.NagiosPassive{CommandFile: *flAlertNagios, Host: host, Service: *flAlertService}
+		notifiers = append(notifiers, notify.Filter(nagios, notify.RenewalFailed, notify.ExpiryCritical, notify.Recovered))
+	}
+	events, err := notify.ParseKinds(*flNotifyEvents)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if *flNotifyWebhook != "" {
+		secret, err := readSecret(*flNotifySecret, "SCEPCLIENT_NOTIFY_WEBHOOK_SECRET")
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		hook := &notify.Webhook{URL: *flNotifyWebhook, Secret: []byte(secret), Client: &http.Client{Timeout: 30 * time.Second}}
+		notifiers = append(notifiers, notify.Filter(hook, events...))
+	}
+	if *flNotifySMTP != "" {
+		if *flNotifyFrom == "" || *flNotifyTo == "" {
+			fmt.Println("-notify-smtp requires -notify-email-from and -notify-email-to")
+			os.Exit(1)
+		}
+		email := &notify.Email{Addr: *flNotifySMTP, From: *flNotifyFrom, To: strings.Split(*flNotifyTo, ",")}
+		if *flNotifyUser != "" {
+			password, err := readSecret(*flNotifyPass, "SCEPCLIENT_NOTIFY_SMTP_PASSWORD")
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			host, _, _ := net.SplitHostPort(*flNotifySMTP)
+			email.Auth = smtp.PlainAuth("", *flNotifyUser, password, host)
+		}
+		notifiers = append(notifiers, notify.Filter(email, events...))
+	}
+	if *flNotifySlack != "" {
+		slack := &notify.Slack{URL: *flNotifySlack, Client: &http.Client{Timeout: 30 * time.Second}}
+		notifiers = append(notifiers, notify.Filter(slack, events...))
+	}
+	if *flNotifyTeams != "" {
+		teams := &notify.Teams{URL: *flNotifyTeams, Client: &http.Client{Timeout: 30 * time.Second}}
+		notifiers = append(notifiers, notify.Filter(teams, events...))
+	}
+	var alerts *notify.Monitor
+	if len(notifiers) > 0 {
+		alerts = &notify.Monitor{Notifier: notify.Multi(notifiers...), Failures: *flAlertFailures, Critical: *flAlertExpiry}
 	}
 
-	if err := run(cfg); err != nil {
+	if *flSidecar {
+		err = sidecar(cfg, sidecarCfg{
+			checkInterval: *flCheckInterval,
+			reloadPID:     *flReloadPID,
+			reloadURL:     *flReloadURL,
+			metricsAddr:   *flMetricsListen,
+			identity:      *flMetricsID,
+			alerts:        alerts,
+			sds:           sdsConfig,
+		}, newLogger(cfg.debug, cfg.logfmt))
+	} else {
+		err = run(cfg)
+	}
+	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
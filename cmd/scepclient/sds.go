@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"strings"
+
+	"scepclient/client/bundle"
+	"scepclient/client/sds"
+)
+
+// sdsCfg configures the Envoy SDS server of the sidecar mode.
+type sdsCfg struct {
+	// addr is the address of the server, a Unix socket as
+	// unix:///path or a TCP host:port.
+	addr string
+
+	// name and caName are the names of the secrets of the
+	// certificate and of the CA certificates.
+	name   string
+	caName string
+
+	// caFile keeps the CA certificates, which the certificate file
+	// does not hold, to serve them again after a restart.
+	caFile string
+
+	server *sds.Server
+}
+
+// sdsOutput sets the certificate, followed by the CA certificates, and
+// the CA certificates of every enrollment on the secrets of sc.
+func sdsOutput(sc *sdsCfg) certOutput {
+	return certOutput{
+		name: "Envoy SDS " + sc.name,
+		write: func(ctx context.Context, b bundle.Bundle) error {
+			if len(b.CA) > 0 {
+				if err := replaceFile(sc.caFile, b.CA, 0644); err != nil {
+					return err
+				}
+				sc.server.SetValidationContext(sc.caName, b.CA)
+			}
+			sc.server.SetCertificate(sc.name, slices.Concat(b.Certificate, b.CA), b.Key)
+			return nil
+		},
+	}
+}
+
+// serveSDS serves the secrets of sc, with the key, certificate and CA
+// certificates already on disk, until ctx is done. It does nothing
+// without sc.
+func serveSDS(ctx context.Context, sc *sdsCfg, keyPath, certPath string, logger *slog.Logger) error {
+	if sc == nil {
+		return nil
+	}
+	ca, err := os.ReadFile(sc.caFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(ca) > 0 {
+		sc.server.SetValidationContext(sc.caName, ca)
+	}
+	// the certificate is served once enrolled if it is missing
+	cert, err := os.ReadFile(certPath)
+	if err == nil {
+		var key []byte
+		if key, err = os.ReadFile(keyPath); err == nil {
+			sc.server.SetCertificate(sc.name, slices.Concat(cert, ca), key)
+		}
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	network, addr := "tcp", sc.addr
+	if path, ok := strings.CutPrefix(sc.addr, "unix://"); ok {
+		network, addr = "unix", path
+		// the socket of the previous run
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		return fmt.Errorf("listening for SDS: %w", err)
+	}
+
+	go func() {
+		if err := sc.server.Serve(ctx, ln); err != nil {
+			logger.Error("serving SDS.", "err", err)
+		}
+	}()
+	return nil
+}
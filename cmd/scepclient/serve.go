@@ -0,0 +1,761 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509/pkix"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"scepclient/client"
+	"scepclient/scepserver"
+	"scepclient/scepserver/depot"
+	"scepclient/scepserver/depot/bolt"
+	"scepclient/scepserver/depot/file"
+	sqldepot "scepclient/scepserver/depot/sql"
+	"scepclient/scepserver/kms"
+	"scepclient/scepserver/metrics"
+	"scepclient/scepserver/policy"
+	"scepclient/scepserver/profile"
+	"scepclient/scepserver/upstream"
+	"scepclient/scepserver/vault"
+	"scepclient/scepserver/webhook"
+)
+
+// serve runs a SCEP server signing requests with the CA of a depot,
+// for testing scepclient and devices without a real CA.
+func serve(args []string) error {
+	fs := flag.NewFlagSet("scepclient serve", flag.ExitOnError)
+	var (
+		flListen    = fs.String("listen", ":8080", "address to listen on")
+		flDepot     = fs.String("depot", "depot", "directory, bolt database file or SQL data source name of the depot holding the CA and the issued certificates")
+		flBackend   = fs.String("depot-backend", "file", "depot storage: file for a directory of PEM files, bolt for a single database file, postgres or mysql for a database shared by several instances")
+		flTxLocks   = fs.Bool("lock-transactions", true, "lock SCEP transactions in file, postgres and mysql depots, so that instances sharing the depot issue one certificate for a request resent to several of them")
+		flCAPass    = fs.String("capass", "", "password of the CA key")
+		flChallenge = fs.String("challenge", "", "static challenge password shared by all clients, none if empty; prefer -challenge-endpoint")
+		flChFile    = fs.String("challenge-file", "", "file holding the static challenge password, reloaded on SIGHUP; instead of -challenge")
+		flMode      = fs.String("challenge-mode", "", "challenge passwords required for enrollment: none, static for -challenge or -challenge-file, dynamic for one-time passwords of -challenge-endpoint, or command for -verify-command; by default, the ones configured")
+
+		// external verification of the requests, e.g. of challenge passwords of another system
+		flVerifyCmd     = fs.String("verify-command", "", "authorize requests with this command, receiving the CSR on stdin and the challenge password in $SCEP_CHALLENGE_PASSWORD, and exiting with 0 to allow or 1 to deny; arguments are separated by spaces")
+		flVerifyTimeout = fs.Duration("verify-timeout", 10*time.Second, "timeout of -verify-command")
+
+		// HTTPS, with certificate files reloaded when they change, or a certificate
+		// issued by the depot CA at startup
+		flTLSCert  = fs.String("tls-cert", "", "serve HTTPS with the certificate of this PEM file, reloaded when it changes")
+		flTLSKey   = fs.String("tls-key", "", "PEM file with the key of -tls-cert, reloaded when it changes")
+		flTLSAuto  = fs.Bool("tls-auto", false, "serve HTTPS with a certificate issued by the depot CA at startup, for -tls-hosts")
+		flTLSHosts = fs.String("tls-hosts", "", "comma-separated DNS names and IP addresses of the -tls-auto certificate; the host name and localhost by default")
+
+		// one-time challenge passwords, minted by an authenticated endpoint
+		flOneTime        = fs.String("challenge-endpoint", "", "serve one-time challenge passwords on this path, e.g. /challenge, and require them for enrollment")
+		flChallengeToken = fs.String("challenge-token", os.Getenv("SCEPSERVER_CHALLENGE_TOKEN"), "bearer token authenticating requests to -challenge-endpoint")
+		flChallengeTTL   = fs.Duration("challenge-ttl", time.Hour, "expiry of one-time challenge passwords, 0 for none")
+
+		// garbage collection of the depot
+		flSweepInterval = fs.Duration("sweep-interval", 0, "prune expired certificates and challenge passwords from the depot at this interval, 0 to keep them")
+		flCertRetention = fs.Duration("cert-retention", 90*24*time.Hour, "time expired certificates are kept before -sweep-interval prunes them")
+
+		// scheduled CA rollover, announced with GetNextCACert
+		flNextCA           = fs.String("next-ca", "", "PEM file with the certificate chain of the successor CA, served by GetNextCACert until -next-ca-activation")
+		flNextCAKey        = fs.String("next-ca-key", "", "PEM file with the key of the successor CA, encrypted with -capass if it is encrypted")
+		flNextCAActivation = fs.String("next-ca-activation", "", "time the successor CA takes over signing, in RFC 3339 format, e.g. 2027-01-01T00:00:00Z")
+
+		flCAChain  = fs.String("ca-chain", "", "PEM file of certificates served by GetCACert after those of the depot, such as the issuing CA and root of -vault-addr")
+		flCrtValid = fs.Int("crtvalid", 365, "validity of issued certificates, in days")
+		flSerials  = fs.String("serials", "sequential", "serial numbers of issued certificates: sequential from the depot, random 159-bit numbers, or site for sequential numbers prefixed with -serial-site")
+		flSite     = fs.Uint("serial-site", 0, "site prefix of -serials site, distinct for every instance with its own depot")
+		flInitCA   = fs.Bool("init-ca", false, "create a self-signed CA in -depot if it has none")
+		flCACN     = fs.String("ca-cn", "scepclient CA", "common name of the CA created by -init-ca")
+
+		// Vault PKI secrets engine issuing the certificates, in place of the depot CA key,
+		// which then only serves as RA certificate
+		flVaultAddr  = fs.String("vault-addr", os.Getenv("VAULT_ADDR"), "sign certificates with the Vault server at this address, authenticating with the token in $VAULT_TOKEN")
+		flVaultMount = fs.String("vault-mount", "pki", "path of the Vault PKI secrets engine")
+		flVaultRole  = fs.String("vault-role", "", "Vault PKI role signing the certificates")
+		flVaultNS    = fs.String("vault-namespace", os.Getenv("VAULT_NAMESPACE"), "Vault Enterprise namespace")
+
+		// cloud KMS key issuing the certificates and CRLs, in place of the depot CA key,
+		// which then only signs and decrypts SCEP messages
+		flKMSKey  = fs.String("kms-key", "", "issue certificates and CRLs with this cloud KMS key: awskms:<key ARN>, gcpkms:<key version> or azurekv:<key URL>, see scepserver/kms")
+		flKMSCert = fs.String("kms-cert", "", "PEM file with the certificate chain of -kms-key, served by GetCACert after the depot CA")
+
+		// registration authority mode, forwarding approved requests to an upstream CA
+		// and signing them upstream with the depot CA key as RA key
+		flUpstreamSCEP  = fs.String("upstream-scep", "", "forward approved requests to the SCEP server at this URL, which must authorize requests signed with the depot CA certificate")
+		flUpstreamREST  = fs.String("upstream-rest", "", "forward approved requests to this URL of a CA REST API, see scepserver/upstream")
+		flUpstreamToken = fs.String("upstream-token", os.Getenv("SCEPSERVER_UPSTREAM_TOKEN"), "bearer token authenticating requests to -upstream-rest")
+
+		// renewals signed with a certificate issued by the CA
+		flRenewalWindow   = fs.Duration("renewal-window", 0, "allow renewals only this long before the signing certificate expires, e.g. 720h; 0 for any time")
+		flRenewalIdentity = fs.Bool("renewal-same-identity", false, "require renewals to request the subject and SANs of the signing certificate")
+
+		// certificate revocation lists of the certificates revoked with scepclient revoke or admin
+		flCRLPath     = fs.String("crl-path", "", "serve the CRL of the CA on this path, e.g. /crl")
+		flCRLURL      = fs.String("crl-url", "", "CRL distribution point added to issued certificates, e.g. http://scep.example.com/crl")
+		flCRLValidity = fs.Duration("crl-validity", 24*time.Hour, "validity of the CRLs, after which clients fetch a new one")
+
+		// administration of the issued certificates, see scepclient admin
+		flAdminPath  = fs.String("admin-path", "", "serve the admin API listing and revoking the issued certificates under this path, e.g. /admin/")
+		flAdminToken = fs.String("admin-token", os.Getenv("SCEPSERVER_ADMIN_TOKEN"), "bearer token authenticating requests to -admin-path")
+
+		// EST (RFC 7030) enrollment alongside SCEP, with the same depot, policy and challenge
+		flEST = fs.Bool("est", false, "also serve EST cacerts, simpleenroll and simplereenroll under /.well-known/est/, with the challenge password as HTTP basic auth password")
+
+		flPolicy   = fs.String("policy", "", "JSON file restricting the keys, subjects and SANs of issued certificates and the requester IPs, see scepserver/policy")
+		flProfiles = fs.String("profiles", "", "JSON file of issuance profiles, with the validity, usages and SANs of certificates selected by challenge or CSR, see scepserver/profile")
+
+		// external approval of certificate requests
+		flWebhook        = fs.String("approval-webhook", "", "POST every certificate request to this URL and issue it only if it answers allow; it may also answer deny or pending")
+		flWebhookSecret  = fs.String("approval-webhook-secret", os.Getenv("SCEPSERVER_WEBHOOK_SECRET"), "sign the webhook requests with this HMAC-SHA256 secret, in the X-SCEP-Signature header")
+		flWebhookTimeout = fs.Duration("approval-webhook-timeout", 10*time.Second, "timeout of the webhook requests")
+
+		// compliance audit log of issuances, denials and failures
+		flAuditLog    = fs.String("audit-log", "", "append an audit event for every certificate request to this file, one per line; - for standard output")
+		flAuditFormat = fs.String("audit-format", "json", "format of the audit events of -audit-log and -audit-syslog: json, cef for ArcSight or leef for QRadar")
+		flAuditSyslog = fs.String("audit-syslog", "", "also send the audit events to this syslog daemon: local, udp://host:514, tcp://host:514 or host:514 for UDP")
+		flAuditDB     = fs.Bool("audit-db", false, "record the audit events in the scep_audit table of a postgres or mysql depot")
+
+		// abuse protection
+		flRate          = fs.Float64("rate-limit", 0, "maximum requests per second over all clients, 0 for no limit")
+		flRateBurst     = fs.Int("rate-burst", 20, "requests allowed at once over all clients before -rate-limit applies")
+		flIPRate        = fs.Float64("ip-rate-limit", 0, "maximum requests per second of a single client IP, 0 for no limit")
+		flIPRateBurst   = fs.Int("ip-rate-burst", 5, "requests allowed at once from a single client IP before -ip-rate-limit applies")
+		flClientIPHdr   = fs.String("client-ip-header", "", "take the client IP from this header set by a trusted reverse proxy, e.g. X-Forwarded-For")
+		flMaxPKIOpSize  = fs.Int64("max-pkioperation-size", 64<<10, "maximum size of PKIOperation messages, in bytes")
+		flReadTimeout   = fs.Duration("read-timeout", 30*time.Second, "time allowed to read a whole request, guarding against slow clients")
+		flWriteTimeout  = fs.Duration("write-timeout", time.Minute, "time allowed to process a request and write its response")
+		flIdleTimeout   = fs.Duration("idle-timeout", 2*time.Minute, "time keep-alive connections may stay idle")
+		flMaxHeaderSize = fs.Int("max-header-size", 64<<10, "maximum size of request headers, including GET messages, in bytes")
+
+		// graceful shutdown on SIGTERM, draining the requests in flight
+		flShutdownDelay   = fs.Duration("shutdown-delay", 0, "keep serving this long after SIGTERM, failing health checks, so that load balancers stop sending requests")
+		flShutdownTimeout = fs.Duration("shutdown-timeout", 30*time.Second, "time allowed to finish the requests in flight on SIGTERM before closing their connections")
+
+		// monitoring, exempt from the rate limits
+		flMetricsPath = fs.String("metrics-path", "/metrics", "serve Prometheus metrics on this path, none if empty")
+		flHealthPath  = fs.String("health-path", "/healthz", "serve health checks on this path, failing while the CA certificate is not valid or the depot is unreachable; none if empty")
+
+		flDebug      = fs.Bool("debug", false, "enable debug logging")
+		flLogJSON    = fs.Bool("log-json", false, "use JSON for log output")
+		flAccessLog  = fs.Bool("access-log", false, "log every request with its operation, status and duration, and PKIOperation requests with their transaction ID and attempt number")
+		flAccessFile = fs.String("access-log-file", "", "append the access log to this file instead, as JSON lines whatever -log-json, for log pipelines; - for standard output")
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	opts := &slog.HandlerOptions{Level: slog.LevelInfo}
+	if *flDebug {
+		opts.Level = slog.LevelDebug
+	}
+	var logger *slog.Logger
+	if *flLogJSON {
+		logger = slog.New(slog.NewJSONHandler(os.Stderr, opts))
+	} else {
+		logger = slog.New(slog.NewTextHandler(os.Stderr, opts))
+	}
+
+	if *flChallenge != "" && *flChFile != "" {
+		return errors.New("use only one of -challenge and -challenge-file")
+	}
+	static := *flChallenge
+	if *flChFile != "" {
+		static = *flChFile
+	}
+	mode, err := challengeMode(*flMode, static, *flOneTime, *flVerifyCmd)
+	if err != nil {
+		return err
+	}
+	// configuration reloaded on SIGHUP, by name
+	reloaders := map[string]scepserver.Reloader{}
+	if mode == "none" && *flWebhook == "" {
+		logger.Warn("issuing certificates to any client, without a challenge password")
+	}
+
+	var (
+		auditors      []scepserver.Auditor
+		reg           *prometheus.Registry
+		serverMetrics *metrics.ServerMetrics
+	)
+	if *flMetricsPath != "" {
+		reg = prometheus.NewRegistry()
+		reg.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+		m, err := metrics.NewServer(reg)
+		if err != nil {
+			return err
+		}
+		serverMetrics = m
+		auditors = append(auditors, serverMetrics)
+	}
+	auditor, closers, err := openAuditor(*flAuditFormat, *flAuditLog, *flAuditSyslog)
+	if err != nil {
+		return err
+	}
+	for _, c := range closers {
+		defer c.Close()
+	}
+	if auditor != nil {
+		auditors = append(auditors, auditor)
+	}
+	if *flAuditDB && *flBackend != "postgres" && *flBackend != "mysql" {
+		return errors.New("-audit-db requires a postgres or mysql -depot-backend")
+	}
+
+	var depot interface {
+		scepserver.Depot
+		CreateCA(pass []byte, subject pkix.Name, validity time.Duration) error
+	}
+	switch *flBackend {
+	case "file":
+		fileDepot, err := file.New(*flDepot)
+		if err != nil {
+			return err
+		}
+		depot = fileDepot
+	case "bolt":
+		boltDepot, err := bolt.Open(*flDepot, bolt.WithChallengeTTL(*flChallengeTTL))
+		if err != nil {
+			return err
+		}
+		defer boltDepot.Close()
+		depot = boltDepot
+	case "postgres", "mysql":
+		sqlDepot, err := sqldepot.Open(*flBackend, *flDepot, sqldepot.WithChallengeTTL(*flChallengeTTL))
+		if err != nil {
+			return err
+		}
+		defer sqlDepot.Close()
+		depot = sqlDepot
+		if *flAuditDB {
+			auditors = append(auditors, sqlDepot)
+		}
+	default:
+		return fmt.Errorf("unknown -depot-backend %q", *flBackend)
+	}
+	if *flInitCA {
+		subject := pkix.Name{CommonName: *flCACN}
+		if err := depot.CreateCA([]byte(*flCAPass), subject, 10*365*24*time.Hour); err != nil {
+			return err
+		}
+	}
+	var svcDepot scepserver.Depot = depot
+	if serverMetrics != nil {
+		svcDepot = serverMetrics.Depot(depot)
+	}
+	svcOpts := []scepserver.ServiceOption{
+		scepserver.WithCAPassword([]byte(*flCAPass)),
+		scepserver.WithChallengePassword(*flChallenge),
+		scepserver.WithCertificateValidity(time.Duration(*flCrtValid) * 24 * time.Hour),
+		scepserver.WithServiceLogger(logger),
+		scepserver.WithRenewalPolicy(scepserver.RenewalPolicy{
+			Window:       *flRenewalWindow,
+			SameIdentity: *flRenewalIdentity,
+		}),
+		scepserver.WithCRLValidity(*flCRLValidity),
+	}
+	if locker, ok := depot.(scepserver.TransactionLocker); ok && *flTxLocks {
+		svcOpts = append(svcOpts, scepserver.WithTransactionLocker(locker))
+	}
+	switch *flSerials {
+	case "sequential":
+	case "random":
+		svcOpts = append(svcOpts, scepserver.WithSerials(scepserver.RandomSerials()))
+	case "site":
+		if *flSite == 0 || *flSite > math.MaxUint32 {
+			return errors.New("-serials site requires a -serial-site between 1 and 4294967295")
+		}
+		svcOpts = append(svcOpts, scepserver.WithSerials(scepserver.PrefixSerials(uint32(*flSite), svcDepot)))
+	default:
+		return fmt.Errorf("unknown -serials %q", *flSerials)
+	}
+	if *flCRLURL != "" {
+		svcOpts = append(svcOpts, scepserver.WithCRLDistributionPoint(*flCRLURL))
+	}
+	if *flCAChain != "" {
+		opt, err := caChain(*flCAChain)
+		if err != nil {
+			return err
+		}
+		svcOpts = append(svcOpts, opt)
+	}
+	if *flNextCA != "" {
+		opt, err := nextCA(*flNextCA, *flNextCAKey, *flNextCAActivation, []byte(*flCAPass))
+		if err != nil {
+			return err
+		}
+		svcOpts = append(svcOpts, opt)
+	}
+	sweep := scepserver.SweepConfig{
+		CertificateRetention: *flCertRetention,
+		Interval:             *flSweepInterval,
+		Logger:               logger,
+	}
+	sweep.Certificates, _ = depot.(scepserver.CertificatePruner)
+	var admin scepserver.AdminConfig
+	if *flAdminPath != "" {
+		if *flAdminToken == "" {
+			return errors.New("-admin-path requires an -admin-token")
+		}
+		admin.Token = *flAdminToken
+		admin.Certificates, _ = depot.(scepserver.CertificateLister)
+		admin.Revocations, _ = depot.(scepserver.Revocations)
+		// clients poll pending requests every few minutes,
+		// forget those which gave up
+		admin.Pending = scepserver.NewPendingTransactions(24*time.Hour, nil)
+		auditors = append(auditors, admin.Pending)
+	}
+	var challenges scepserver.ChallengeStore
+	if *flOneTime != "" {
+		if *flChallengeToken == "" {
+			return errors.New("-challenge-endpoint requires a -challenge-token")
+		}
+		var ok bool
+		if challenges, ok = depot.(scepserver.ChallengeStore); !ok {
+			// the file depot does not store challenges,
+			// they are lost on restart
+			challenges = scepserver.NewChallengeStore(*flChallengeTTL, nil)
+		}
+		sweep.Challenges, _ = challenges.(scepserver.ChallengePruner)
+		if serverMetrics != nil {
+			challenges = serverMetrics.ChallengeStore(challenges)
+		}
+		svcOpts = append(svcOpts, scepserver.WithChallengeStore(challenges))
+	}
+	if *flVerifyCmd != "" {
+		args := strings.Fields(*flVerifyCmd)
+		svcOpts = append(svcOpts, scepserver.WithCSRVerifier(&scepserver.CommandVerifier{
+			Path:    args[0],
+			Args:    args[1:],
+			Timeout: *flVerifyTimeout,
+		}))
+	}
+	signers := 0
+	for _, addr := range []string{*flVaultAddr, *flUpstreamSCEP, *flUpstreamREST, *flKMSKey} {
+		if addr != "" {
+			signers++
+		}
+	}
+	if signers > 1 {
+		return errors.New("use only one of -vault-addr, -upstream-scep, -upstream-rest and -kms-key")
+	}
+	if *flKMSKey != "" {
+		opt, err := kmsIssuer(*flKMSKey, *flKMSCert)
+		if err != nil {
+			return err
+		}
+		svcOpts = append(svcOpts, opt)
+	}
+	if *flUpstreamSCEP != "" {
+		raCerts, raKey, err := depot.CA([]byte(*flCAPass))
+		if err != nil {
+			return err
+		}
+		client, err := scepclient.New(*flUpstreamSCEP, logger.With("component", "upstream"))
+		if err != nil {
+			return err
+		}
+		signer, err := upstream.NewSCEPSigner(upstream.SCEPConfig{Client: client, Cert: raCerts[0], Key: raKey})
+		if err != nil {
+			return err
+		}
+		svcOpts = append(svcOpts, scepserver.WithSigner(signer))
+	}
+	if *flUpstreamREST != "" {
+		signer, err := upstream.NewRESTSigner(upstream.RESTConfig{
+			URL:    *flUpstreamREST,
+			Token:  *flUpstreamToken,
+			Client: &http.Client{Timeout: time.Minute},
+		})
+		if err != nil {
+			return err
+		}
+		svcOpts = append(svcOpts, scepserver.WithSigner(signer))
+	}
+	if *flVaultAddr != "" {
+		signer, err := vault.NewSigner(vault.Config{
+			Address:   *flVaultAddr,
+			Token:     os.Getenv("VAULT_TOKEN"),
+			Namespace: *flVaultNS,
+			Mount:     *flVaultMount,
+			Role:      *flVaultRole,
+			TTL:       time.Duration(*flCrtValid) * 24 * time.Hour,
+		})
+		if err != nil {
+			return err
+		}
+		svcOpts = append(svcOpts, scepserver.WithSigner(signer))
+	}
+	if *flChFile != "" {
+		v, err := scepserver.NewReloadingVerifier(func() (scepserver.CSRVerifier, error) {
+			return challengeFile(*flChFile)
+		})
+		if err != nil {
+			return err
+		}
+		reloaders["challenge"] = v
+		svcOpts = append(svcOpts, scepserver.WithCSRVerifier(v))
+	}
+	if *flPolicy != "" {
+		p, err := scepserver.NewReloadingPolicy(func() (scepserver.Policy, error) {
+			return policy.Load(*flPolicy)
+		})
+		if err != nil {
+			return err
+		}
+		reloaders["policy"] = p
+		svcOpts = append(svcOpts, scepserver.WithPolicy(p))
+	}
+	if *flProfiles != "" {
+		p, err := scepserver.NewReloadingProfiles(func() (scepserver.ProfileSelector, error) {
+			return profile.Load(*flProfiles)
+		})
+		if err != nil {
+			return err
+		}
+		reloaders["profiles"] = p
+		svcOpts = append(svcOpts, scepserver.WithProfiles(p))
+	}
+	if *flWebhook != "" {
+		approver, err := webhook.New(webhook.Config{
+			URL:    *flWebhook,
+			Secret: []byte(*flWebhookSecret),
+			Client: &http.Client{Timeout: *flWebhookTimeout},
+		})
+		if err != nil {
+			return err
+		}
+		svcOpts = append(svcOpts, scepserver.WithApprover(approver))
+	}
+	if len(auditors) > 0 {
+		admin.Auditor = scepserver.MultiAuditor(auditors...)
+		svcOpts = append(svcOpts, scepserver.WithAuditor(admin.Auditor))
+	}
+	svc, err := scepserver.NewService(svcDepot, svcOpts...)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/", scepserver.NewHTTPHandler(svc))
+	if challenges != nil {
+		mux.Handle(*flOneTime, scepserver.NewChallengeHandler(challenges, *flChallengeToken))
+	}
+	if *flCRLPath != "" {
+		mux.Handle(*flCRLPath, scepserver.NewCRLHandler(svc.(scepserver.CRLSigner)))
+	}
+	if *flEST {
+		mux.Handle("/.well-known/est/", scepserver.NewESTHandler(svc.(scepserver.ESTService)))
+	}
+	if *flAdminPath != "" {
+		mux.Handle(*flAdminPath, scepserver.NewAdminHandler(admin))
+	}
+	var handler http.Handler = mux
+	switch {
+	case *flAccessFile != "":
+		w := os.Stdout
+		if *flAccessFile != "-" {
+			f, err := os.OpenFile(*flAccessFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w = f
+		}
+		handler = scepserver.LogHandler(handler, slog.New(slog.NewJSONHandler(w, nil)))
+	case *flAccessLog:
+		handler = scepserver.LogHandler(handler, logger)
+	}
+	handler = scepserver.LimitHandler(handler, scepserver.HandlerLimits{
+		Rate:           *flRate,
+		Burst:          *flRateBurst,
+		PerIPRate:      *flIPRate,
+		PerIPBurst:     *flIPRateBurst,
+		ClientIPHeader: *flClientIPHdr,
+		MaxPayload:     map[string]int64{"PKIOperation": *flMaxPKIOpSize},
+	})
+	// set on SIGTERM, failing the health checks during -shutdown-delay
+	var draining atomic.Bool
+	if *flMetricsPath != "" || *flHealthPath != "" {
+		// monitoring must not be throttled by clients using up the rate limits
+		root := http.NewServeMux()
+		root.Handle("/", handler)
+		if *flMetricsPath != "" {
+			root.Handle(*flMetricsPath, promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+		}
+		if *flHealthPath != "" {
+			root.Handle(*flHealthPath, scepserver.NewHealthHandler(scepserver.HealthCheckerFunc(func(ctx context.Context) error {
+				if draining.Load() {
+					return errors.New("shutting down")
+				}
+				return svc.(scepserver.HealthChecker).Health(ctx)
+			})))
+		}
+		handler = root
+	}
+	srv := &http.Server{
+		Addr:              *flListen,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       *flReadTimeout,
+		WriteTimeout:      *flWriteTimeout,
+		IdleTimeout:       *flIdleTimeout,
+		MaxHeaderBytes:    *flMaxHeaderSize,
+	}
+	var tlsReloader scepserver.Reloader
+	if srv.TLSConfig, tlsReloader, err = serverTLS(*flTLSCert, *flTLSKey, *flTLSAuto, *flTLSHosts, svcDepot, []byte(*flCAPass), logger); err != nil {
+		return err
+	}
+	if tlsReloader != nil {
+		reloaders["TLS certificate"] = tlsReloader
+	}
+	if srv.TLSConfig != nil && *flEST {
+		// EST clients reenroll with their certificate
+		srv.TLSConfig.ClientAuth = tls.RequestClientCert
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *flSweepInterval > 0 {
+		go scepserver.RunSweeper(ctx, sweep)
+	}
+	go reloadOnHangup(ctx, reloaders, logger)
+	errc := make(chan error, 1)
+	go func() {
+		logger.Info("serving SCEP", "addr", *flListen, "depot", *flDepot, "tls", srv.TLSConfig != nil)
+		if srv.TLSConfig != nil {
+			errc <- srv.ListenAndServeTLS("", "")
+			return
+		}
+		errc <- srv.ListenAndServe()
+	}()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	draining.Store(true)
+	if *flShutdownDelay > 0 {
+		logger.Info("draining before shutdown", "delay", *flShutdownDelay)
+		time.Sleep(*flShutdownDelay)
+	}
+	logger.Info("shutting down", "timeout", *flShutdownTimeout)
+	srv.SetKeepAlivesEnabled(false)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), *flShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		logger.Warn("closing the connections of unfinished requests", "err", err)
+		srv.Close()
+	}
+	if err := <-errc; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// serverTLS returns the TLS configuration for the certificate files
+// certFile and keyFile, with their reloader, or for a certificate
+// issued by the CA of d if auto is set, or nil to serve plain HTTP.
+func serverTLS(certFile, keyFile string, auto bool, hosts string, d scepserver.Depot, pass []byte, logger *slog.Logger) (*tls.Config, scepserver.Reloader, error) {
+	switch {
+	case auto && certFile != "":
+		return nil, nil, errors.New("use only one of -tls-auto and -tls-cert")
+	case certFile != "":
+		if keyFile == "" {
+			return nil, nil, errors.New("-tls-cert requires -tls-key")
+		}
+		reloader, err := scepserver.NewCertificateReloader(certFile, keyFile, logger)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &tls.Config{GetCertificate: reloader.GetCertificate}, reloader, nil
+	case auto:
+		var names []string
+		if hosts != "" {
+			names = strings.Split(hosts, ",")
+		} else {
+			if hostname, err := os.Hostname(); err == nil {
+				names = append(names, hostname)
+			}
+			names = append(names, "localhost", "127.0.0.1", "::1")
+		}
+		certs, key, err := d.CA(pass)
+		if err != nil {
+			return nil, nil, err
+		}
+		cert, err := scepserver.NewServerCertificate(certs[0], key, names, 365*24*time.Hour)
+		if err != nil {
+			return nil, nil, err
+		}
+		logger.Info("issued TLS server certificate", "hosts", names, "not_after", cert.Leaf.NotAfter)
+		return &tls.Config{Certificates: []tls.Certificate{*cert}}, nil, nil
+	default:
+		return nil, nil, nil
+	}
+}
+
+// reloadOnHangup reloads the configuration of reloaders on SIGHUP until
+// ctx is done. Configuration failing to reload is kept unchanged.
+func reloadOnHangup(ctx context.Context, reloaders map[string]scepserver.Reloader, logger *slog.Logger) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		}
+		if len(reloaders) == 0 {
+			logger.Info("nothing to reload on SIGHUP")
+			continue
+		}
+		for name, r := range reloaders {
+			if err := r.Reload(); err != nil {
+				logger.Error("failed to reload, keeping the current "+name, "err", err)
+				continue
+			}
+			logger.Info("reloaded the " + name)
+		}
+	}
+}
+
+// challengeFile returns the verifier of the static challenge password
+// in the file path, ignoring surrounding white space.
+func challengeFile(path string) (scepserver.CSRVerifier, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pw := strings.TrimSpace(string(data))
+	if pw == "" {
+		return nil, fmt.Errorf("no challenge password in %s", path)
+	}
+	return scepserver.StaticChallenge(pw), nil
+}
+
+// challengeMode checks the challenge passwords and verification
+// command configured for mode, and returns the mode, inferred from them
+// if it is empty.
+func challengeMode(mode, static, endpoint, command string) (string, error) {
+	switch mode {
+	case "":
+		switch {
+		case endpoint != "":
+			return "dynamic", nil
+		case static != "":
+			return "static", nil
+		case command != "":
+			return "command", nil
+		}
+		return "none", nil
+	case "none":
+		if static != "" || endpoint != "" || command != "" {
+			return "", errors.New("-challenge-mode none conflicts with -challenge, -challenge-endpoint and -verify-command")
+		}
+	case "static":
+		if static == "" {
+			return "", errors.New("-challenge-mode static requires a -challenge or -challenge-file")
+		}
+		if endpoint != "" || command != "" {
+			return "", errors.New("-challenge-mode static conflicts with -challenge-endpoint and -verify-command")
+		}
+	case "dynamic":
+		if endpoint == "" {
+			return "", errors.New("-challenge-mode dynamic requires a -challenge-endpoint")
+		}
+		if static != "" || command != "" {
+			return "", errors.New("-challenge-mode dynamic conflicts with -challenge and -verify-command")
+		}
+	case "command":
+		if command == "" {
+			return "", errors.New("-challenge-mode command requires a -verify-command")
+		}
+		if static != "" || endpoint != "" {
+			return "", errors.New("-challenge-mode command conflicts with -challenge and -challenge-endpoint")
+		}
+	default:
+		return "", fmt.Errorf("unknown -challenge-mode %q", mode)
+	}
+	return mode, nil
+}
+
+// caChain loads the certificates served after those of the depot
+// from the PEM file path.
+func caChain(path string) (scepserver.ServiceOption, error) {
+	chainPEM, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	chain, err := depot.DecodeCertificates(chainPEM)
+	if err != nil {
+		return nil, fmt.Errorf("parse -ca-chain: %w", err)
+	}
+	return scepserver.WithCAChain(chain), nil
+}
+
+// kmsIssuer opens the cloud KMS key keyURI, and loads
+// its certificate chain from the PEM file certPath.
+func kmsIssuer(keyURI, certPath string) (scepserver.ServiceOption, error) {
+	if certPath == "" {
+		return nil, errors.New("-kms-key requires -kms-cert")
+	}
+	certPEM, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		return nil, err
+	}
+	certs, err := depot.DecodeCertificates(certPEM)
+	if err != nil {
+		return nil, fmt.Errorf("parse -kms-cert: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	key, err := kms.Open(ctx, keyURI, &http.Client{Timeout: time.Minute})
+	if err != nil {
+		return nil, err
+	}
+	return scepserver.WithIssuer(certs, key), nil
+}
+
+// nextCA loads the successor CA from the PEM files certPath and keyPath.
+func nextCA(certPath, keyPath, activation string, pass []byte) (scepserver.ServiceOption, error) {
+	if keyPath == "" || activation == "" {
+		return nil, errors.New("-next-ca requires -next-ca-key and -next-ca-activation")
+	}
+	at, err := time.Parse(time.RFC3339, activation)
+	if err != nil {
+		return nil, fmt.Errorf("parse -next-ca-activation: %w", err)
+	}
+	certPEM, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		return nil, err
+	}
+	certs, err := depot.DecodeCertificates(certPEM)
+	if err != nil {
+		return nil, fmt.Errorf("parse next CA certificate: %w", err)
+	}
+	keyPEM, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	key, err := depot.DecodeKey(keyPEM, pass)
+	if err != nil {
+		return nil, fmt.Errorf("parse next CA key: %w", err)
+	}
+	return scepserver.WithNextCA(certs, key, at), nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	scepclient "scepclient/client"
+	"scepclient/client/notify"
+	"scepclient/scep"
+	"scepclient/scepserver/metrics"
+)
+
+// sidecarCfg configures the sidecar mode, which keeps the certificate
+// of a runCfg enrolled, for example on a volume shared with the
+// containers of a pod.
+type sidecarCfg struct {
+	// checkInterval is the time between checks of the
+	// certificate, and between retries of failed enrollments.
+	checkInterval time.Duration
+
+	// reloadPID and reloadURL, if set, are sent SIGHUP
+	// and POSTed to after every enrollment.
+	reloadPID int
+	reloadURL string
+
+	// metricsAddr, if set, is the address serving the metrics of
+	// the certificate, labeled with identity, at /metrics.
+	metricsAddr string
+	identity    string
+
+	// alerts, if set, alerts on failed renewals and certificates
+	// about to expire.
+	alerts *notify.Monitor
+
+	// sds, if set, serves the certificate to Envoy.
+	sds *sdsCfg
+}
+
+// sidecar enrolls with cfg at once, unless the certificate is not due
+// for renewal, then renews it when it is due, until SIGTERM.
+func sidecar(cfg runCfg, sc sidecarCfg, logger *slog.Logger) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if sc.identity == "" {
+		sc.identity = cfg.certPath
+	}
+	identities, err := serveIdentityMetrics(ctx, sc.metricsAddr, logger)
+	if err != nil {
+		return err
+	}
+	if err := serveSDS(ctx, sc.sds, cfg.keyPath, cfg.certPath, logger); err != nil {
+		return err
+	}
+	alert := func(err error) {
+		if err != nil {
+			logger.Error("sending the alert.", "err", err)
+		}
+	}
+	if sc.alerts != nil {
+		sc.alerts.Identity = sc.identity
+	}
+	for {
+		cert, err := loadPEMCertFromFile(cfg.certPath)
+		if err == nil && identities != nil {
+			identities.Certificate(sc.identity, cert)
+		}
+		if err == nil && sc.alerts != nil {
+			alert(sc.alerts.Check(ctx, cert))
+		}
+		switch {
+		case err == nil && !scepclient.DefaultRenewalPolicy.Due(cert):
+			logger.Debug("certificate not due for renewal.", "renew_at", scepclient.DefaultRenewalPolicy.RenewAt(cert))
+		case err != nil && !os.IsNotExist(err):
+			logger.Error("reading the certificate, trying again.", "err", err, "delay", sc.checkInterval)
+		default:
+			err := run(cfg)
+			renewed, loadErr := loadPEMCertFromFile(cfg.certPath)
+			if identities != nil {
+				identities.Status(sc.identity, pkiStatus(err))
+				if loadErr == nil {
+					identities.Certificate(sc.identity, renewed)
+				}
+			}
+			if sc.alerts != nil {
+				if err != nil {
+					var failInfo *scep.FailInfoError
+					alert(sc.alerts.Failed(ctx, cert, err, errors.As(err, &failInfo)))
+				} else if loadErr == nil {
+					alert(sc.alerts.Renewed(ctx, cert, renewed))
+				}
+			}
+			if err != nil {
+				logger.Error("enrollment failed, trying again.", "err", err, "delay", sc.checkInterval)
+				break
+			}
+			logger.Info("enrolled the certificate.", "certificate", cfg.certPath)
+			if err := reloadTarget(ctx, sc); err != nil {
+				logger.Error("reloading the certificate user.", "err", err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(sc.checkInterval):
+		}
+	}
+}
+
+// serveIdentityMetrics serves the metrics of the identities at
+// addr/metrics until ctx is done. It returns nil without addr.
+func serveIdentityMetrics(ctx context.Context, addr string, logger *slog.Logger) (*metrics.Identities, error) {
+	if addr == "" {
+		return nil, nil
+	}
+	reg := prometheus.NewRegistry()
+	identities, err := metrics.NewIdentities(reg, nil)
+	if err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("serving metrics.", "err", err)
+		}
+	}()
+	return identities, nil
+}
+
+// pkiStatus returns the pkiStatus of the enrollment ending with err,
+// as labeled by the metrics, or error if the server sent none.
+func pkiStatus(err error) string {
+	var failInfo *scep.FailInfoError
+	switch {
+	case err == nil:
+		return "SUCCESS"
+	case errors.As(err, &failInfo):
+		return "FAILURE"
+	case errors.Is(err, scepclient.ErrPollTimeout):
+		return "PENDING"
+	}
+	return "error"
+}
+
+// reloadTarget tells the user of the certificate to reload it.
+func reloadTarget(ctx context.Context, sc sidecarCfg) error {
+	if sc.reloadPID > 0 {
+		// FindProcess always succeeds on Unix, and Signal fails on Windows
+		p, err := os.FindProcess(sc.reloadPID)
+		if err == nil {
+			err = p.Signal(syscall.SIGHUP)
+		}
+		if err != nil {
+			return fmt.Errorf("SIGHUP to process %d: %w", sc.reloadPID, err)
+		}
+	}
+	if sc.reloadURL != "" {
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, sc.reloadURL, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("POST %s: %s", sc.reloadURL, resp.Status)
+		}
+	}
+	return nil
+}
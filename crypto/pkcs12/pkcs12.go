@@ -0,0 +1,241 @@
+// Package pkcs12 encodes keys and certificates as PKCS #12 (PFX) files,
+// as imported into the certificate stores of Windows and Java key stores.
+//
+// The key is encrypted with pbeWithSHAAnd3-KeyTripleDES-CBC and the file
+// authenticated with an HMAC-SHA1, the algorithms every version of
+// Windows imports. golang.org/x/crypto/pkcs12 decodes such files.
+package pkcs12
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"unicode/utf16"
+)
+
+// iterations is the iteration count of the key derivations.
+const iterations = 2048
+
+var (
+	oidData                       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidCertBag                    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+	oidPKCS8ShroudedKeyBag        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 2}
+	oidX509Certificate            = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 22, 1}
+	oidLocalKeyID                 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 21}
+	oidPBEWithSHAAnd3KeyTripleDES = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 3}
+	oidSHA1                       = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+)
+
+type pfx struct {
+	Version  int
+	AuthSafe contentInfo
+	MacData  macData
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     []byte `asn1:"explicit,tag:0"`
+}
+
+type macData struct {
+	Mac        digestInfo
+	MacSalt    []byte
+	Iterations int
+}
+
+type digestInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Digest    []byte
+}
+
+type safeBag struct {
+	ID asn1.ObjectIdentifier
+	// Value is explicitly tagged with [0], which encoding/asn1
+	// does not add to RawValues with FullBytes
+	Value      asn1.RawValue
+	Attributes []attribute `asn1:"set,optional"`
+}
+
+type attribute struct {
+	ID     asn1.ObjectIdentifier
+	Values []asn1.RawValue `asn1:"set"`
+}
+
+type certBag struct {
+	ID   asn1.ObjectIdentifier
+	Data []byte `asn1:"explicit,tag:0"`
+}
+
+type pbeParams struct {
+	Salt       []byte
+	Iterations int
+}
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+// Encode returns the PKCS #12 file of key and cert, followed by the
+// CA certificates ca, protected with password.
+func Encode(key crypto.PrivateKey, cert *x509.Certificate, ca []*x509.Certificate, password string) ([]byte, error) {
+	if cert == nil {
+		return nil, errors.New("pkcs12: certificate is required")
+	}
+	bmpPassword := bmpString(password)
+	// the key bag and the bag of its certificate share a local key ID
+	localKeyID := sha1.Sum(cert.Raw)
+	localKeyIDValue, err := asn1.Marshal(localKeyID[:])
+	if err != nil {
+		return nil, err
+	}
+	attributes := []attribute{{
+		ID:     oidLocalKeyID,
+		Values: []asn1.RawValue{{FullBytes: localKeyIDValue}},
+	}}
+
+	var certBags []safeBag
+	for i, c := range append([]*x509.Certificate{cert}, ca...) {
+		bag, err := asn1.Marshal(certBag{ID: oidX509Certificate, Data: c.Raw})
+		if err != nil {
+			return nil, err
+		}
+		sb := safeBag{ID: oidCertBag, Value: explicit(bag)}
+		if i == 0 {
+			sb.Attributes = attributes
+		}
+		certBags = append(certBags, sb)
+	}
+
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	salt, err := randomBytes(8)
+	if err != nil {
+		return nil, err
+	}
+	block, err := des.NewTripleDESCipher(pbkdf(bmpPassword, salt, 1, iterations, 24))
+	if err != nil {
+		return nil, err
+	}
+	padded := pad(pkcs8, block.BlockSize())
+	cipher.NewCBCEncrypter(block, pbkdf(bmpPassword, salt, 2, iterations, 8)).CryptBlocks(padded, padded)
+	params, err := asn1.Marshal(pbeParams{Salt: salt, Iterations: iterations})
+	if err != nil {
+		return nil, err
+	}
+	keyBag, err := asn1.Marshal(encryptedPrivateKeyInfo{
+		Algorithm:     pkix.AlgorithmIdentifier{Algorithm: oidPBEWithSHAAnd3KeyTripleDES, Parameters: asn1.RawValue{FullBytes: params}},
+		EncryptedData: padded,
+	})
+	if err != nil {
+		return nil, err
+	}
+	keyBags := []safeBag{{ID: oidPKCS8ShroudedKeyBag, Value: explicit(keyBag), Attributes: attributes}}
+
+	var authSafe []contentInfo
+	for _, bags := range [][]safeBag{certBags, keyBags} {
+		contents, err := asn1.Marshal(bags)
+		if err != nil {
+			return nil, err
+		}
+		authSafe = append(authSafe, contentInfo{ContentType: oidData, Content: contents})
+	}
+	authSafeData, err := asn1.Marshal(authSafe)
+	if err != nil {
+		return nil, err
+	}
+
+	macSalt, err := randomBytes(8)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha1.New, pbkdf(bmpPassword, macSalt, 3, iterations, 20))
+	mac.Write(authSafeData)
+	return asn1.Marshal(pfx{
+		Version:  3,
+		AuthSafe: contentInfo{ContentType: oidData, Content: authSafeData},
+		MacData: macData{
+			Mac: digestInfo{
+				Algorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA1, Parameters: asn1.NullRawValue},
+				Digest:    mac.Sum(nil),
+			},
+			MacSalt:    macSalt,
+			Iterations: iterations,
+		},
+	})
+}
+
+// explicit returns the DER encoding der explicitly tagged with [0].
+func explicit(der []byte) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: der}
+}
+
+// bmpString returns s in UTF-16BE with a terminating NUL,
+// the encoding of passwords of the key derivation.
+func bmpString(s string) []byte {
+	var b []byte
+	for _, r := range utf16.Encode([]rune(s)) {
+		b = append(b, byte(r>>8), byte(r))
+	}
+	return append(b, 0, 0)
+}
+
+// pbkdf derives size bytes for id, 1 for keys, 2 for IVs and 3 for MAC
+// keys, from password and salt with the SHA-1 based key derivation of
+// RFC 7292, appendix B.2, with n iterations.
+func pbkdf(password, salt []byte, id byte, n, size int) []byte {
+	const v = 64
+	fill := func(b []byte) []byte {
+		if len(b) == 0 {
+			return nil
+		}
+		out := make([]byte, v*((len(b)+v-1)/v))
+		for i := range out {
+			out[i] = b[i%len(b)]
+		}
+		return out
+	}
+	d := bytes.Repeat([]byte{id}, v)
+	in := append(fill(salt), fill(password)...)
+
+	var out []byte
+	for len(out) < size {
+		a := sha1.Sum(append(d, in...))
+		for i := 1; i < n; i++ {
+			a = sha1.Sum(a[:])
+		}
+		out = append(out, a[:]...)
+		b := fill(a[:])
+		// I_j = (I_j + B + 1) mod 2^(8v)
+		for j := 0; j < len(in); j += v {
+			carry := 1
+			for k := v - 1; k >= 0; k-- {
+				x := int(in[j+k]) + int(b[k]) + carry
+				in[j+k], carry = byte(x), x>>8
+			}
+		}
+	}
+	return out[:size]
+}
+
+// pad appends the PKCS #7 padding to b.
+func pad(b []byte, blockSize int) []byte {
+	n := blockSize - len(b)%blockSize
+	return append(append([]byte{}, b...), bytes.Repeat([]byte{byte(n)}, n)...)
+}
+
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	return b, err
+}
@@ -0,0 +1,108 @@
+package pkcs12
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"math/big"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/pkcs12"
+)
+
+func TestPBKDF(t *testing.T) {
+	// the test vectors of the key derivation of BouncyCastle
+	salt := []byte{0x0a, 0x58, 0xcf, 0x64, 0x53, 0x0d, 0x82, 0x3f}
+	for _, tt := range []struct {
+		id   byte
+		size int
+		want string
+	}{
+		{1, 24, "8aaae6297b6cb04642ab5b077851284eb7128f1a2a7fbca3"},
+		{2, 8, "79993dfe048d3b76"},
+	} {
+		if got := hex.EncodeToString(pbkdf(bmpString("smeg"), salt, tt.id, 1, tt.size)); got != tt.want {
+			t.Errorf("expected %s for ID %d, got %s", tt.want, tt.id, got)
+		}
+	}
+}
+
+func newCertificate(t *testing.T, key crypto.Signer, template, parent *x509.Certificate, signer crypto.Signer) *x509.Certificate {
+	t.Helper()
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestEncode(t *testing.T) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ca"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	ca := newCertificate(t, caKey, caTemplate, caTemplate, caKey)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := newCertificate(t, key, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "device"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}, ca, caKey)
+
+	pfx, err := Encode(key, cert, nil, "pässword")
+	if err != nil {
+		t.Fatal(err)
+	}
+	decodedKey, decodedCert, err := pkcs12.Decode(pfx, "pässword")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !key.Equal(decodedKey) || !cert.Equal(decodedCert) {
+		t.Error("expected the key and certificate to round trip")
+	}
+	if _, _, err := pkcs12.Decode(pfx, "wrong"); err == nil {
+		t.Error("expected a wrong password to fail the decoding")
+	}
+
+	pfx, err = Encode(caKey, ca, []*x509.Certificate{cert}, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks, err := pkcs12.ToPEM(pfx, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var types []string
+	for _, b := range blocks {
+		types = append(types, b.Type)
+	}
+	if len(blocks) != 3 || !bytes.Equal(blocks[0].Bytes, ca.Raw) || !bytes.Equal(blocks[1].Bytes, cert.Raw) {
+		t.Errorf("expected the certificate, its chain and the key, got %v", types)
+	}
+	if blocks[2].Headers["localKeyId"] == "" || blocks[2].Headers["localKeyId"] != blocks[0].Headers["localKeyId"] {
+		t.Error("expected the key and its certificate to share a local key ID")
+	}
+}
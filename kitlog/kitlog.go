@@ -0,0 +1,91 @@
+// Package kitlog adapts go-kit loggers to log/slog, for applications
+// which still pass a go-kit log.Logger to the SCEP client.
+package kitlog
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// NewLogger returns a slog.Logger which writes to a go-kit logger.
+func NewLogger(logger log.Logger) *slog.Logger {
+	return slog.New(NewHandler(logger))
+}
+
+// Handler is a slog.Handler which writes records to a go-kit logger.
+// Levels are mapped to go-kit level values, so filters created with
+// level.NewFilter keep working.
+type Handler struct {
+	logger log.Logger
+	prefix string
+}
+
+// NewHandler creates a Handler for logger.
+func NewHandler(logger log.Logger) *Handler {
+	return &Handler{logger: logger}
+}
+
+// Enabled always reports true, level filtering is left to the go-kit logger.
+func (h *Handler) Enabled(context.Context, slog.Level) bool {
+	return true
+}
+
+// Handle converts the record to key-value pairs and logs them.
+func (h *Handler) Handle(_ context.Context, r slog.Record) error {
+	keyvals := []interface{}{"level", levelValue(r.Level), "msg", r.Message}
+	r.Attrs(func(a slog.Attr) bool {
+		keyvals = appendAttr(keyvals, h.prefix, a)
+		return true
+	})
+	return h.logger.Log(keyvals...)
+}
+
+// WithAttrs returns a Handler which includes attrs in every record.
+func (h *Handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	var keyvals []interface{}
+	for _, a := range attrs {
+		keyvals = appendAttr(keyvals, h.prefix, a)
+	}
+	return &Handler{logger: log.With(h.logger, keyvals...), prefix: h.prefix}
+}
+
+// WithGroup returns a Handler which prefixes all keys with name.
+func (h *Handler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	return &Handler{logger: h.logger, prefix: h.prefix + name + "."}
+}
+
+func appendAttr(keyvals []interface{}, prefix string, a slog.Attr) []interface{} {
+	v := a.Value.Resolve()
+	if v.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix = prefix + a.Key + "."
+		}
+		for _, ga := range v.Group() {
+			keyvals = appendAttr(keyvals, prefix, ga)
+		}
+		return keyvals
+	}
+	if a.Key == "" {
+		return keyvals
+	}
+	return append(keyvals, prefix+a.Key, v.Any())
+}
+
+func levelValue(l slog.Level) level.Value {
+	switch {
+	case l >= slog.LevelError:
+		return level.ErrorValue()
+	case l >= slog.LevelWarn:
+		return level.WarnValue()
+	case l >= slog.LevelInfo:
+		return level.InfoValue()
+	default:
+		return level.DebugValue()
+	}
+}
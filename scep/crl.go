@@ -0,0 +1,175 @@
+package scep
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"math/big"
+
+	"github.com/fullsailor/pkcs7"
+)
+
+// GetCRLMessage is a GetCRL request, asking for the CRL of the CA
+// which issued the certificate it identifies.
+type GetCRLMessage struct {
+	// RawIssuer is the DER encoded issuer name of the certificate.
+	RawIssuer []byte
+
+	SerialNumber *big.Int
+}
+
+// issuerAndSerial is the IssuerAndSerialNumber ASN.1 structure
+// of PKCS #7, the content of GetCRL and GetCert requests.
+type issuerAndSerial struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+func parseGetCRL(data []byte) (*GetCRLMessage, error) {
+	var ias issuerAndSerial
+	rest, err := asn1.Unmarshal(data, &ias)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, errors.New("scep: trailing data after GetCRL issuerAndSerialNumber")
+	}
+	return &GetCRLMessage{RawIssuer: ias.Issuer.FullBytes, SerialNumber: ias.SerialNumber}, nil
+}
+
+// NewGetCRLRequest creates a GetCRL request for the CRL of the issuer
+// of crt, signed with the SignerCert and SignerKey of tmpl and encrypted
+// for its Recipients.
+func NewGetCRLRequest(crt *x509.Certificate, tmpl *PKIMessage, opts ...Option) (*PKIMessage, error) {
+	conf := &config{logger: nopLogger}
+	for _, opt := range opts {
+		opt(conf)
+	}
+	content, err := asn1.Marshal(issuerAndSerial{
+		Issuer:       asn1.RawValue{FullBytes: crt.RawIssuer},
+		SerialNumber: crt.SerialNumber,
+	})
+	if err != nil {
+		return nil, err
+	}
+	e7, err := pkcs7.Encrypt(content, tmpl.Recipients)
+	if err != nil {
+		return nil, err
+	}
+	signedData, err := pkcs7.NewSignedData(e7)
+	if err != nil {
+		return nil, err
+	}
+	tID, err := newTransactionID(tmpl.SignerCert.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	sn, err := newNonce()
+	if err != nil {
+		return nil, err
+	}
+	conf.logger.Debug("creating SCEP GetCRL request",
+		"transaction_id", tID,
+		"serial", crt.SerialNumber.Text(16),
+	)
+	config := pkcs7.SignerInfoConfig{
+		ExtraSignedAttributes: []pkcs7.Attribute{
+			{Type: oidSCEPtransactionID, Value: tID},
+			{Type: oidSCEPmessageType, Value: GetCRL},
+			{Type: oidSCEPsenderNonce, Value: sn},
+		},
+	}
+	if err := signedData.AddSigner(tmpl.SignerCert, tmpl.SignerKey, config); err != nil {
+		return nil, err
+	}
+	raw, err := signedData.Finish()
+	if err != nil {
+		return nil, err
+	}
+	return &PKIMessage{
+		Raw:           raw,
+		MessageType:   GetCRL,
+		TransactionID: tID,
+		SenderNonce:   sn,
+		GetCRLMessage: &GetCRLMessage{RawIssuer: crt.RawIssuer, SerialNumber: crt.SerialNumber},
+		logger:        conf.logger,
+	}, nil
+}
+
+// SuccessCRL answers a GetCRL request with a SUCCESS CertRep holding
+// the DER encoded crl, signed with crtAuth and keyAuth.
+func (msg *PKIMessage) SuccessCRL(crtAuth *x509.Certificate, keyAuth *rsa.PrivateKey, crl []byte) (*PKIMessage, error) {
+	deg, err := DegenerateCRL(crl)
+	if err != nil {
+		return nil, err
+	}
+	return msg.success(crtAuth, keyAuth, deg, nil)
+}
+
+// degenerateSignedData is a SignedData without content and signers,
+// carrying CRLs, which the pkcs7 package can't create.
+type degenerateSignedData struct {
+	Version          int
+	DigestAlgorithms []asn1.RawValue `asn1:"set"`
+	ContentInfo      struct{ ContentType asn1.ObjectIdentifier }
+	CRLs             asn1.RawValue
+	SignerInfos      []asn1.RawValue `asn1:"set"`
+}
+
+var oidData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+
+// DegenerateCRL creates a degenerate certificates-only PKCS #7
+// SignedData holding the DER encoded crl, as GetCRL responses do.
+func DegenerateCRL(crl []byte) ([]byte, error) {
+	sd := degenerateSignedData{
+		Version:          1,
+		DigestAlgorithms: []asn1.RawValue{},
+		CRLs:             asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 1, IsCompound: true, Bytes: crl},
+		SignerInfos:      []asn1.RawValue{},
+	}
+	sd.ContentInfo.ContentType = oidData
+	content, err := asn1.Marshal(sd)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(struct {
+		ContentType asn1.ObjectIdentifier
+		Content     asn1.RawValue
+	}{
+		ContentType: oidSignedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: content},
+	})
+}
+
+// parseDegenerateCRL returns the first CRL of a degenerate SignedData.
+func parseDegenerateCRL(data []byte) (*x509.RevocationList, error) {
+	var ci struct {
+		ContentType asn1.ObjectIdentifier
+		Content     asn1.RawValue `asn1:"tag:0"`
+	}
+	if _, err := asn1.Unmarshal(data, &ci); err != nil {
+		return nil, err
+	}
+	if !ci.ContentType.Equal(oidSignedData) {
+		return nil, errors.New("scep: content type is not signedData")
+	}
+	var sd struct {
+		Version          int
+		DigestAlgorithms asn1.RawValue
+		ContentInfo      asn1.RawValue
+		Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+		CRLs             asn1.RawValue `asn1:"optional,tag:1"`
+	}
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		return nil, err
+	}
+	if len(sd.CRLs.Bytes) == 0 {
+		return nil, errors.New("scep: no CRL")
+	}
+	var crl asn1.RawValue
+	if _, err := asn1.Unmarshal(sd.CRLs.Bytes, &crl); err != nil {
+		return nil, err
+	}
+	return x509.ParseRevocationList(crl.FullBytes)
+}
@@ -0,0 +1,101 @@
+package scep
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+
+	"github.com/fullsailor/pkcs7"
+)
+
+// CertPollMessage is a CertPoll (GetCertInitial) request,
+// polling the certificate of a transaction answered with PENDING.
+// PENDING.
+type CertPollMessage struct {
+	// RawIssuer is the DER encoded name of the CA, and RawSubject
+	// the DER encoded subject of the CSR of the transaction.
+	RawIssuer  []byte
+	RawSubject []byte
+}
+
+// issuerAndSubject is the IssuerAndSubject ASN.1 structure of RFC 8894,
+// the content of CertPoll requests.
+type issuerAndSubject struct {
+	Issuer  asn1.RawValue
+	Subject asn1.RawValue
+}
+
+func parseCertPoll(data []byte) (*CertPollMessage, error) {
+	var ias issuerAndSubject
+	rest, err := asn1.Unmarshal(data, &ias)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, errors.New("scep: trailing data after CertPoll issuerAndSubject")
+	}
+	return &CertPollMessage{RawIssuer: ias.Issuer.FullBytes, RawSubject: ias.Subject.FullBytes}, nil
+}
+
+// NewCertPollRequest creates a CertPoll request for the certificate of
+// the transaction of csr, in the transaction of the PKCSReq or
+// RenewalReq created for csr with NewCSRRequest. It is signed with the
+// SignerCert and SignerKey of tmpl and encrypted for its Recipients,
+// the first of which names the CA.
+func NewCertPollRequest(csr *x509.CertificateRequest, tmpl *PKIMessage, opts ...Option) (*PKIMessage, error) {
+	conf := &config{logger: nopLogger}
+	for _, opt := range opts {
+		opt(conf)
+	}
+	if len(tmpl.Recipients) == 0 {
+		return nil, errors.New("scep: CertPoll request without recipient")
+	}
+	content, err := asn1.Marshal(issuerAndSubject{
+		Issuer:  asn1.RawValue{FullBytes: tmpl.Recipients[0].RawSubject},
+		Subject: asn1.RawValue{FullBytes: csr.RawSubject},
+	})
+	if err != nil {
+		return nil, err
+	}
+	e7, err := pkcs7.Encrypt(content, tmpl.Recipients)
+	if err != nil {
+		return nil, err
+	}
+	signedData, err := pkcs7.NewSignedData(e7)
+	if err != nil {
+		return nil, err
+	}
+	tID, err := newTransactionID(csr.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	sn, err := newNonce()
+	if err != nil {
+		return nil, err
+	}
+	conf.logger.Debug("creating SCEP CertPoll request",
+		"transaction_id", tID,
+	)
+	config := pkcs7.SignerInfoConfig{
+		ExtraSignedAttributes: []pkcs7.Attribute{
+			{Type: oidSCEPtransactionID, Value: tID},
+			{Type: oidSCEPmessageType, Value: CertPoll},
+			{Type: oidSCEPsenderNonce, Value: sn},
+		},
+	}
+	if err := signedData.AddSigner(tmpl.SignerCert, tmpl.SignerKey, config); err != nil {
+		return nil, err
+	}
+	raw, err := signedData.Finish()
+	if err != nil {
+		return nil, err
+	}
+	return &PKIMessage{
+		Raw:             raw,
+		MessageType:     CertPoll,
+		TransactionID:   tID,
+		SenderNonce:     sn,
+		CertPollMessage: &CertPollMessage{RawIssuer: tmpl.Recipients[0].RawSubject, RawSubject: csr.RawSubject},
+		logger:          conf.logger,
+	}, nil
+}
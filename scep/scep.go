@@ -12,12 +12,13 @@ import (
 	"crypto/x509"
 	"encoding/asn1"
 	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
 	"math/big"
 
 	"github.com/fullsailor/pkcs7"
-	"github.com/go-kit/kit/log"
-	"github.com/go-kit/kit/log/level"
-	"github.com/pkg/errors"
 
 	"scepclient/crypto/x509util"
 )
@@ -80,6 +81,19 @@ const (
 	PENDING           = "3"
 )
 
+func (status PKIStatus) String() string {
+	switch status {
+	case SUCCESS:
+		return "SUCCESS (0)"
+	case FAILURE:
+		return "FAILURE (2)"
+	case PENDING:
+		return "PENDING (3)"
+	default:
+		return "unknown (" + string(status) + ")"
+	}
+}
+
 // FailInfo is a SCEP failInfo attribute
 //
 // The FailInfo attribute MUST contain one of the following failure
@@ -108,8 +122,27 @@ func (info FailInfo) String() string {
 	case BadCertID:
 		return "badCertID (4)"
 	default:
-		panic("scep: unknown failInfo type" + info)
+		// servers may send any failInfo
+		return fmt.Sprintf("unknown failInfo %q", string(info))
+	}
+}
+
+// FailInfoError is returned when the server rejected a request
+// with pkiStatus FAILURE.
+type FailInfoError struct {
+	MessageType MessageType
+	FailInfo    FailInfo
+
+	// Text is the failInfoText sent by the server, if any.
+	Text string
+}
+
+func (e *FailInfoError) Error() string {
+	msg := "scep: " + e.MessageType.String() + " request failed, failInfo: " + e.FailInfo.String()
+	if e.Text != "" {
+		msg += ": " + e.Text
 	}
+	return msg
 }
 
 // SenderNonce is a random 16 byte number.
@@ -135,10 +168,11 @@ var (
 	oidSCEPsenderNonce    = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 5}
 	oidSCEPrecipientNonce = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 6}
 	oidSCEPtransactionID  = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 7}
+	oidSCEPfailInfoText   = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 24, 1}
 )
 
 // WithLogger adds option logging to the SCEP operations.
-func WithLogger(logger log.Logger) Option {
+func WithLogger(logger *slog.Logger) Option {
 	return func(c *config) {
 		c.logger = logger
 	}
@@ -148,7 +182,18 @@ func WithLogger(logger log.Logger) Option {
 type Option func(*config)
 
 type config struct {
-	logger log.Logger
+	logger *slog.Logger
+}
+
+// nopLogger discards all records and is used when no logger was configured.
+var nopLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// log returns the logger of the message, or nopLogger if it has none.
+func (msg *PKIMessage) log() *slog.Logger {
+	if msg.logger == nil {
+		return nopLogger
+	}
+	return msg.logger
 }
 
 // PKIMessage defines the possible SCEP message types
@@ -158,6 +203,8 @@ type PKIMessage struct {
 	SenderNonce
 	*CertRepMessage
 	*CSRReqMessage
+	*GetCRLMessage
+	*CertPollMessage
 
 	// DER Encoded PKIMessage
 	Raw []byte
@@ -177,7 +224,7 @@ type PKIMessage struct {
 
 	SCEPEncryptionAlgorithm int
 
-	logger log.Logger
+	logger *slog.Logger
 }
 
 // CertRepMessage is a type of PKIMessage
@@ -186,8 +233,15 @@ type CertRepMessage struct {
 	RecipientNonce
 	FailInfo
 
+	// FailInfoText is the optional human readable
+	// explanation of a FAILURE (RFC 8894).
+	FailInfoText string
+
 	Certificate *x509.Certificate
 
+	// CRL is the CRL answering a GetCRL request.
+	CRL *x509.RevocationList
+
 	degenerate []byte
 }
 
@@ -205,8 +259,9 @@ type CSRReqMessage struct {
 }
 
 // ParsePKIMessage unmarshals a PKCS#7 signed data into a PKI message struct
-func ParsePKIMessage(data []byte, opts ...Option) (*PKIMessage, error) {
-	conf := &config{logger: log.NewNopLogger()}
+func ParsePKIMessage(data []byte, opts ...Option) (_ *PKIMessage, err error) {
+	defer recoverMalformed(&err)
+	conf := &config{logger: nopLogger}
 	for _, opt := range opts {
 		opt(conf)
 	}
@@ -235,13 +290,11 @@ func ParsePKIMessage(data []byte, opts ...Option) (*PKIMessage, error) {
 		logger:        conf.logger,
 	}
 
-	// log relevant key-values when parsing a pkiMessage.
-	logKeyVals := []interface{}{
-		"msg", "parsed scep pkiMessage",
+	// log relevant attributes when parsing a pkiMessage.
+	msg.log().Debug("parsed scep pkiMessage",
 		"scep_message_type", msgType,
 		"transaction_id", tID,
-	}
-	level.Debug(msg.logger).Log(logKeyVals...)
+	)
 
 	if err := msg.parseMessageType(); err != nil {
 		return nil, err
@@ -280,14 +333,19 @@ func (msg *PKIMessage) parseMessageType() error {
 				return errors.New("scep pkiStatus FAILURE must have a failInfo attribute")
 			}
 			cr.FailInfo = fi
+			// failInfoText is optional
+			var text string
+			if err := msg.p7.UnmarshalSignedAttribute(oidSCEPfailInfoText, &text); err == nil {
+				cr.FailInfoText = text
+			}
 		case PENDING:
 			break
 		default:
-			return errors.Errorf("unknown scep pkiStatus %s", status)
+			return fmt.Errorf("unknown scep pkiStatus %s", status)
 		}
 		msg.CertRepMessage = cr
 		return nil
-	case PKCSReq, UpdateReq, RenewalReq:
+	case PKCSReq, UpdateReq, RenewalReq, GetCRL, CertPoll:
 		var sn SenderNonce
 		if err := msg.p7.UnmarshalSignedAttribute(oidSCEPsenderNonce, &sn); err != nil {
 			return err
@@ -297,7 +355,7 @@ func (msg *PKIMessage) parseMessageType() error {
 		}
 		msg.SenderNonce = sn
 		return nil
-	case GetCRL, GetCert, CertPoll:
+	case GetCert:
 		return errNotImplemented
 	default:
 		return errUnknownMessageType
@@ -312,8 +370,24 @@ const (
 	EncryptionAlgorithmAES256CBC
 )
 
+// Verify checks the signature of the message, and returns the
+// certificate it was signed with. It does not check whether the
+// certificate itself is trusted.
+func (msg *PKIMessage) Verify() (_ *x509.Certificate, err error) {
+	defer recoverMalformed(&err)
+	if err := msg.p7.Verify(); err != nil {
+		return nil, err
+	}
+	signer := msg.p7.GetOnlySigner()
+	if signer == nil {
+		return nil, errors.New("scep: PKIMessage does not have exactly one signer")
+	}
+	return signer, nil
+}
+
 // DecryptPKIEnvelope decrypts the pkcs envelopedData inside the SCEP PKIMessage
-func (msg *PKIMessage) DecryptPKIEnvelope(cert *x509.Certificate, key *rsa.PrivateKey) error {
+func (msg *PKIMessage) DecryptPKIEnvelope(cert *x509.Certificate, key *rsa.PrivateKey) (err error) {
+	defer recoverMalformed(&err)
 	p7, err := pkcs7.Parse(msg.p7.Content)
 	if err != nil {
 		return err
@@ -329,20 +403,39 @@ func (msg *PKIMessage) DecryptPKIEnvelope(cert *x509.Certificate, key *rsa.Priva
 	}
 	msg.SCEPEncryptionAlgorithm = algo
 
-	logKeyVals := []interface{}{
-		"msg", "decrypt pkiEnvelope",
+	logAttrs := []interface{}{
 		"encryption_algorithm", algo,
+		"transaction_id", msg.TransactionID,
 	}
-	defer func() { level.Debug(msg.logger).Log(logKeyVals...) }()
+	defer func() { msg.log().Debug("decrypt pkiEnvelope", logAttrs...) }()
 
 	switch msg.MessageType {
 	case CertRep:
-		certs, err := CACerts(msg.pkiEnvelope)
+		// the issued certificate is the first one, the chain
+		// which may follow is only counted.
+		var numCerts int
+		err := ReadCACerts(bytes.NewReader(msg.pkiEnvelope), func(cert *x509.Certificate) error {
+			if numCerts == 0 {
+				msg.CertRepMessage.Certificate = cert
+			}
+			numCerts++
+			return nil
+		})
+		if err != nil || numCerts == 0 {
+			// GetCRL responses hold a CRL instead
+			if crl, crlErr := parseDegenerateCRL(msg.pkiEnvelope); crlErr == nil {
+				msg.CertRepMessage.CRL = crl
+				logAttrs = append(logAttrs, "crl_number", crl.Number)
+				return nil
+			}
+		}
 		if err != nil {
 			return err
 		}
-		msg.CertRepMessage.Certificate = certs[0]
-		logKeyVals = append(logKeyVals, "ca_certs", len(certs))
+		if numCerts == 0 {
+			return errors.New("scep: CertRep pkiEnvelope contains no certificate")
+		}
+		logAttrs = append(logAttrs, "ca_certs", numCerts)
 		return nil
 	case PKCSReq, UpdateReq, RenewalReq:
 		csr, err := x509.ParseCertificateRequest(msg.pkiEnvelope)
@@ -352,16 +445,22 @@ func (msg *PKIMessage) DecryptPKIEnvelope(cert *x509.Certificate, key *rsa.Priva
 		// check for challengePassword
 		cp, err := x509util.ParseChallengePassword(msg.pkiEnvelope)
 		if err != nil {
-			return errors.Wrap(err, "scep: parse challenge password in pkiEnvelope")
+			return fmt.Errorf("scep: parse challenge password in pkiEnvelope: %w", err)
 		}
 		msg.CSRReqMessage = &CSRReqMessage{
 			RawDecrypted:      msg.pkiEnvelope,
 			CSR:               csr,
 			ChallengePassword: cp,
 		}
-		logKeyVals = append(logKeyVals, "has_challenge", cp != "")
+		logAttrs = append(logAttrs, "has_challenge", cp != "")
 		return nil
-	case GetCRL, GetCert, CertPoll:
+	case GetCRL:
+		msg.GetCRLMessage, err = parseGetCRL(msg.pkiEnvelope)
+		return err
+	case CertPoll:
+		msg.CertPollMessage, err = parseCertPoll(msg.pkiEnvelope)
+		return err
+	case GetCert:
 		return errNotImplemented
 	default:
 		return errUnknownMessageType
@@ -369,6 +468,13 @@ func (msg *PKIMessage) DecryptPKIEnvelope(cert *x509.Certificate, key *rsa.Priva
 }
 
 func (msg *PKIMessage) Fail(crtAuth *x509.Certificate, keyAuth *rsa.PrivateKey, info FailInfo) (*PKIMessage, error) {
+	return msg.FailWithText(crtAuth, keyAuth, info, "")
+}
+
+// FailWithText returns a FAILURE CertRep like Fail, explaining the
+// failure to the client with the failInfoText attribute unless text
+// is empty.
+func (msg *PKIMessage) FailWithText(crtAuth *x509.Certificate, keyAuth *rsa.PrivateKey, info FailInfo, text string) (*PKIMessage, error) {
 	config := pkcs7.SignerInfoConfig{
 		ExtraSignedAttributes: []pkcs7.Attribute{
 			pkcs7.Attribute{
@@ -394,6 +500,13 @@ func (msg *PKIMessage) Fail(crtAuth *x509.Certificate, keyAuth *rsa.PrivateKey,
 		},
 	}
 
+	if text != "" {
+		config.ExtraSignedAttributes = append(config.ExtraSignedAttributes, pkcs7.Attribute{
+			Type:  oidSCEPfailInfoText,
+			Value: asn1.RawValue{Tag: asn1.TagUTF8String, Bytes: []byte(text)},
+		})
+	}
+
 	sd, err := pkcs7.NewSignedData(nil)
 	if err != nil {
 		return nil, err
@@ -411,7 +524,8 @@ func (msg *PKIMessage) Fail(crtAuth *x509.Certificate, keyAuth *rsa.PrivateKey,
 
 	cr := &CertRepMessage{
 		PKIStatus:      FAILURE,
-		FailInfo:       BadRequest,
+		FailInfo:       info,
+		FailInfoText:   text,
 		RecipientNonce: RecipientNonce(msg.SenderNonce),
 	}
 
@@ -427,6 +541,61 @@ func (msg *PKIMessage) Fail(crtAuth *x509.Certificate, keyAuth *rsa.PrivateKey,
 
 }
 
+// Pending creates a CertRep message with pkiStatus PENDING, telling the
+// client to poll again later because the request awaits manual approval.
+func (msg *PKIMessage) Pending(crtAuth *x509.Certificate, keyAuth *rsa.PrivateKey) (*PKIMessage, error) {
+	config := pkcs7.SignerInfoConfig{
+		ExtraSignedAttributes: []pkcs7.Attribute{
+			pkcs7.Attribute{
+				Type:  oidSCEPtransactionID,
+				Value: msg.TransactionID,
+			},
+			pkcs7.Attribute{
+				Type:  oidSCEPpkiStatus,
+				Value: PENDING,
+			},
+			pkcs7.Attribute{
+				Type:  oidSCEPmessageType,
+				Value: CertRep,
+			},
+			pkcs7.Attribute{
+				Type:  oidSCEPrecipientNonce,
+				Value: msg.SenderNonce,
+			},
+		},
+	}
+
+	sd, err := pkcs7.NewSignedData(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// sign the attributes
+	if err := sd.AddSigner(crtAuth, keyAuth, config); err != nil {
+		return nil, err
+	}
+
+	certRepBytes, err := sd.Finish()
+	if err != nil {
+		return nil, err
+	}
+
+	cr := &CertRepMessage{
+		PKIStatus:      PENDING,
+		RecipientNonce: RecipientNonce(msg.SenderNonce),
+	}
+
+	// create a CertRep message from the original
+	crepMsg := &PKIMessage{
+		Raw:            certRepBytes,
+		TransactionID:  msg.TransactionID,
+		MessageType:    CertRep,
+		CertRepMessage: cr,
+	}
+
+	return crepMsg, nil
+}
+
 // SignCSR creates an x509.Certificate based on a template and Cert Authority credentials
 // returns a new PKIMessage with CertRep data
 func (msg *PKIMessage) SignCSR(crtAuth *x509.Certificate, keyAuth *rsa.PrivateKey, template *x509.Certificate) (*PKIMessage, error) {
@@ -446,13 +615,25 @@ func (msg *PKIMessage) SignCSR(crtAuth *x509.Certificate, keyAuth *rsa.PrivateKe
 	if err != nil {
 		return nil, err
 	}
+	return msg.Success(crtAuth, keyAuth, crt)
+}
 
+// Success returns a new PKIMessage with a SUCCESS CertRep carrying crt,
+// which was issued for the request elsewhere, for example by an
+// external CA. The response is signed with the RA credentials
+// crtAuth and keyAuth.
+func (msg *PKIMessage) Success(crtAuth *x509.Certificate, keyAuth *rsa.PrivateKey, crt *x509.Certificate) (*PKIMessage, error) {
 	// create a degenerate cert structure
 	deg, err := DegenerateCertificates([]*x509.Certificate{crt})
 	if err != nil {
 		return nil, err
 	}
+	return msg.success(crtAuth, keyAuth, deg, crt)
+}
 
+// success creates a SUCCESS CertRep of the degenerate SignedData deg,
+// which holds crt, if it is not nil.
+func (msg *PKIMessage) success(crtAuth *x509.Certificate, keyAuth *rsa.PrivateKey, deg []byte, crt *x509.Certificate) (*PKIMessage, error) {
 	// encrypt degenerate data using the original messages recipients
 	e7, err := pkcs7.Encrypt(deg, msg.p7.Certificates)
 	if err != nil {
@@ -488,7 +669,9 @@ func (msg *PKIMessage) SignCSR(crtAuth *x509.Certificate, keyAuth *rsa.PrivateKe
 	// add the certificate into the signed data type
 	// this cert must be added before the signedData because the recipient will expect it
 	// as the first certificate in the array
-	signedData.AddCertificate(crt)
+	if crt != nil {
+		signedData.AddCertificate(crt)
+	}
 	// sign the attributes
 	if err := signedData.AddSigner(crtAuth, keyAuth, config); err != nil {
 		return nil, err
@@ -531,21 +714,77 @@ func DegenerateCertificates(certs []*x509.Certificate) ([]byte, error) {
 }
 
 // CACerts extract CA Certificate or chain from pkcs7 degenerate signed data
-func CACerts(data []byte) ([]*x509.Certificate, error) {
+func CACerts(data []byte) (_ []*x509.Certificate, err error) {
+	defer recoverMalformed(&err)
 	println("scep - CACerts - ENTRYPOINT")
 	p7, err := pkcs7.Parse(data)
-	println("scep - CACerts - p7: ")
-	println(p7.Certificates[0])
 	if err != nil {
 		println("scep - CACerts - ERROR")
 		return nil, err
 	}
+	println("scep - CACerts - p7: ")
+	if len(p7.Certificates) > 0 {
+		println(p7.Certificates[0])
+	}
 	return p7.Certificates, nil
 }
 
+// NextCACertificates creates a GetNextCACert response: a SignedData,
+// signed by the current CA certificate crtAuth and key keyAuth, whose
+// content is the degenerate certificates-only SignedData of the next
+// CA certificate chain (RFC 8894, section 4.7).
+func NextCACertificates(next []*x509.Certificate, crtAuth *x509.Certificate, keyAuth *rsa.PrivateKey) ([]byte, error) {
+	deg, err := DegenerateCertificates(next)
+	if err != nil {
+		return nil, err
+	}
+	sd, err := pkcs7.NewSignedData(deg)
+	if err != nil {
+		return nil, err
+	}
+	if err := sd.AddSigner(crtAuth, keyAuth, pkcs7.SignerInfoConfig{}); err != nil {
+		return nil, err
+	}
+	return sd.Finish()
+}
+
+// NextCACerts verifies that a GetNextCACert response is signed by the
+// current CA certificate ca, and returns the next CA certificate chain
+// it holds.
+func NextCACerts(data []byte, ca *x509.Certificate) (_ []*x509.Certificate, err error) {
+	defer recoverMalformed(&err)
+	p7, err := pkcs7.Parse(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := p7.Verify(); err != nil {
+		return nil, err
+	}
+	if signer := p7.GetOnlySigner(); signer == nil || !signer.Equal(ca) {
+		return nil, errors.New("scep: next CA certificates are not signed by the current CA")
+	}
+	next, err := pkcs7.Parse(p7.Content)
+	if err != nil {
+		return nil, err
+	}
+	if len(next.Certificates) == 0 {
+		return nil, errors.New("scep: no next CA certificate")
+	}
+	return next.Certificates, nil
+}
+
+// recoverMalformed turns a panic of the pkcs7 package, which does not
+// validate all of its input, into an error. Use it deferred in functions
+// parsing messages received from the network.
+func recoverMalformed(err *error) {
+	if r := recover(); r != nil {
+		*err = fmt.Errorf("scep: malformed PKCS#7 data: %v", r)
+	}
+}
+
 // NewCSRRequest creates a scep PKI PKCSReq/UpdateReq message
 func NewCSRRequest(csr *x509.CertificateRequest, tmpl *PKIMessage, opts ...Option) (*PKIMessage, error) {
-	conf := &config{logger: log.NewNopLogger()}
+	conf := &config{logger: nopLogger}
 	for _, opt := range opts {
 		opt(conf)
 	}
@@ -572,8 +811,7 @@ func NewCSRRequest(csr *x509.CertificateRequest, tmpl *PKIMessage, opts ...Optio
 		return nil, err
 	}
 
-	level.Debug(conf.logger).Log(
-		"msg", "creating SCEP CSR request",
+	conf.logger.Debug("creating SCEP CSR request",
 		"transaction_id", tID,
 		"encryption_algorithm", tmpl.SCEPEncryptionAlgorithm,
 		"signer_cn", tmpl.SignerCert.Subject.CommonName,
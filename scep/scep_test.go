@@ -1,6 +1,7 @@
 package scep_test
 
 import (
+	"bytes"
 	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
@@ -15,7 +16,7 @@ import (
 	"testing"
 	"time"
 
-	"github.com/micromdm/scep/scep"
+	"scepclient/scep"
 )
 
 func testParsePKIMessage(t *testing.T, data []byte) *scep.PKIMessage {
@@ -154,7 +155,7 @@ func newCSR(priv *rsa.PrivateKey, email, country, cname string) ([]byte, error)
 	return x509.CreateCertificateRequest(rand.Reader, template, priv)
 }
 
-func loadTestFile(t *testing.T, path string) []byte {
+func loadTestFile(t testing.TB, path string) []byte {
 	data, err := ioutil.ReadFile(path)
 	if err != nil {
 		t.Fatal(err)
@@ -162,7 +163,7 @@ func loadTestFile(t *testing.T, path string) []byte {
 	return data
 }
 
-func loadCACredentials(t *testing.T) (*x509.Certificate, *rsa.PrivateKey) {
+func loadCACredentials(t testing.TB) (*x509.Certificate, *rsa.PrivateKey) {
 	cert, err := loadCertFromFile("testdata/testca/ca.crt")
 	if err != nil {
 		t.Fatal(err)
@@ -174,7 +175,7 @@ func loadCACredentials(t *testing.T) (*x509.Certificate, *rsa.PrivateKey) {
 	return cert, key
 }
 
-func loadClientCredentials(t *testing.T) (*x509.Certificate, *rsa.PrivateKey) {
+func loadClientCredentials(t testing.TB) (*x509.Certificate, *rsa.PrivateKey) {
 	cert, err := loadCertFromFile("testdata/testclient/client.pem")
 	if err != nil {
 		t.Fatal(err)
@@ -264,3 +265,209 @@ func GenerateSubjectKeyID(pub crypto.PublicKey) ([]byte, error) {
 
 	return hash[:], nil
 }
+
+func TestReadCACerts(t *testing.T) {
+	cacert, _ := loadCACredentials(t)
+	clientcert, _ := loadClientCredentials(t)
+	deg, err := scep.DegenerateCertificates([]*x509.Certificate{clientcert, cacert, clientcert})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := scep.CACerts(deg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []*x509.Certificate
+	err = scep.ReadCACerts(bytes.NewReader(deg), func(cert *x509.Certificate) error {
+		got = append(got, cert)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d certificates, got %d", len(want), len(got))
+	}
+	for i := range want {
+		if !got[i].Equal(want[i]) {
+			t.Errorf("certificate %d differs", i)
+		}
+	}
+}
+
+func TestNextCACertificates(t *testing.T) {
+	cacert, cakey := loadCACredentials(t)
+	clientcert, _ := loadClientCredentials(t)
+	data, err := scep.NextCACertificates([]*x509.Certificate{clientcert}, cacert, cakey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, err := scep.NextCACerts(data, cacert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(next) != 1 || !next[0].Equal(clientcert) {
+		t.Errorf("expected the next CA certificate, got %d certificates", len(next))
+	}
+	if _, err := scep.NextCACerts(data, clientcert); err == nil {
+		t.Error("expected an error for a response not signed by the current CA")
+	}
+}
+
+func TestGetCRL(t *testing.T) {
+	cacert, cakey := loadCACredentials(t)
+	clientcert, clientkey := loadClientCredentials(t)
+	req, err := scep.NewGetCRLRequest(clientcert, &scep.PKIMessage{
+		Recipients: []*x509.Certificate{cacert},
+		SignerKey:  clientkey,
+		SignerCert: clientcert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := testParsePKIMessage(t, req.Raw)
+	if err := msg.DecryptPKIEnvelope(cacert, cakey); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(msg.GetCRLMessage.RawIssuer, clientcert.RawIssuer) ||
+		msg.GetCRLMessage.SerialNumber.Cmp(clientcert.SerialNumber) != 0 {
+		t.Errorf("expected the issuer and serial number of the client certificate, got %+v", msg.GetCRLMessage)
+	}
+
+	// the test CA lacks the cRLSign key usage
+	issuer := *cacert
+	issuer.KeyUsage |= x509.KeyUsageCRLSign
+	crl, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:     big.NewInt(7),
+		ThisUpdate: time.Now(),
+		NextUpdate: time.Now().Add(time.Hour),
+		RevokedCertificateEntries: []x509.RevocationListEntry{
+			{SerialNumber: clientcert.SerialNumber, RevocationTime: time.Now()},
+		},
+	}, &issuer, cakey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certRep, err := msg.SuccessCRL(cacert, cakey, crl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := testParsePKIMessage(t, certRep.Raw)
+	if err := resp.DecryptPKIEnvelope(clientcert, clientkey); err != nil {
+		t.Fatal(err)
+	}
+	if resp.CRL == nil || resp.CRL.Number.Int64() != 7 || len(resp.CRL.RevokedCertificateEntries) != 1 {
+		t.Fatalf("expected the CRL in the response, got %+v", resp.CRL)
+	}
+	if err := resp.CRL.CheckSignatureFrom(&issuer); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCertPoll(t *testing.T) {
+	cacert, cakey := loadCACredentials(t)
+	clientcert, clientkey := loadClientCredentials(t)
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: clientcert.Subject,
+	}, clientkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &scep.PKIMessage{
+		MessageType: scep.PKCSReq,
+		Recipients:  []*x509.Certificate{cacert},
+		SignerKey:   clientkey,
+		SignerCert:  clientcert,
+	}
+	pkcsReq, err := scep.NewCSRRequest(csr, tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := scep.NewCertPollRequest(csr, tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.TransactionID != pkcsReq.TransactionID {
+		t.Errorf("expected the transaction ID of the PKCSReq %s, got %s", pkcsReq.TransactionID, req.TransactionID)
+	}
+	msg := testParsePKIMessage(t, req.Raw)
+	if msg.MessageType != scep.CertPoll || len(msg.SenderNonce) == 0 {
+		t.Errorf("expected a CertPoll with a senderNonce, got %s", msg.MessageType)
+	}
+	if err := msg.DecryptPKIEnvelope(cacert, cakey); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(msg.CertPollMessage.RawIssuer, cacert.RawSubject) ||
+		!bytes.Equal(msg.CertPollMessage.RawSubject, csr.RawSubject) {
+		t.Errorf("expected the names of the CA and of the CSR, got %+v", msg.CertPollMessage)
+	}
+}
+
+func FuzzParsePKIMessage(f *testing.F) {
+	for _, path := range []string{"testdata/PKCSReq.der", "testdata/CertRep.der"} {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+	cacert, cakey := loadCACredentials(f)
+	clientcert, clientkey := loadClientCredentials(f)
+	// a FAILURE with a failInfo outside of RFC 8894
+	req, err := scep.ParsePKIMessage(loadTestFile(f, "testdata/PKCSReq.der"))
+	if err != nil {
+		f.Fatal(err)
+	}
+	failure, err := req.Fail(cacert, cakey, scep.FailInfo("7"))
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(failure.Raw)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, err := scep.ParsePKIMessage(data)
+		if err != nil {
+			return
+		}
+		switch msg.MessageType {
+		case scep.CertRep:
+			if msg.PKIStatus == scep.FAILURE {
+				_ = (&scep.FailInfoError{MessageType: scep.PKCSReq, FailInfo: msg.FailInfo}).Error()
+			}
+			msg.DecryptPKIEnvelope(clientcert, clientkey)
+		default:
+			msg.DecryptPKIEnvelope(cacert, cakey)
+		}
+	})
+}
+
+func FuzzCACerts(f *testing.F) {
+	cacert, _ := loadCACredentials(f)
+	clientcert, _ := loadClientCredentials(f)
+	deg, err := scep.DegenerateCertificates([]*x509.Certificate{cacert, clientcert})
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(deg)
+	f.Add(cacert.Raw)
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		certs, err := scep.CACerts(data)
+		var streamed int
+		streamErr := scep.ReadCACerts(bytes.NewReader(data), func(*x509.Certificate) error {
+			streamed++
+			return nil
+		})
+		if err == nil && streamErr == nil && streamed != len(certs) {
+			t.Errorf("CACerts returned %d certificates, ReadCACerts %d", len(certs), streamed)
+		}
+		if trimmed := scep.TrimTrailingData(data); len(trimmed) > len(data) {
+			t.Errorf("TrimTrailingData grew %d bytes to %d", len(data), len(trimmed))
+		}
+	})
+}
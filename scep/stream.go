@@ -0,0 +1,238 @@
+package scep
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// maxCertSize limits the size of a single certificate read by ReadCACerts.
+const maxCertSize = 1 << 18
+
+var oidSignedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+
+// ReadCACerts decodes a degenerate PKCS#7 certificates structure from r,
+// calling fn for each certificate in order. Only one certificate is held
+// in memory at a time, which keeps memory bounded for deep chains.
+// Reading stops at the end of the certificates, the remainder of r is not
+// consumed. If fn returns an error, reading stops and the error is returned.
+func ReadCACerts(r io.Reader, fn func(*x509.Certificate) error) error {
+	br := bufio.NewReader(r)
+
+	// ContentInfo ::= SEQUENCE { contentType, [0] EXPLICIT content }
+	if _, err := expectHeader(br, asn1.ClassUniversal, asn1.TagSequence); err != nil {
+		return err
+	}
+	h, err := expectHeader(br, asn1.ClassUniversal, asn1.TagOID)
+	if err != nil {
+		return err
+	}
+	if h.length < 0 || h.length > 64 {
+		return errors.New("scep: invalid PKCS#7 content type")
+	}
+	oidBytes := make([]byte, h.length)
+	if _, err := io.ReadFull(br, oidBytes); err != nil {
+		return err
+	}
+	var contentType asn1.ObjectIdentifier
+	if _, err := asn1.Unmarshal(append(h.raw, oidBytes...), &contentType); err != nil {
+		return fmt.Errorf("scep: parse PKCS#7 content type: %w", err)
+	}
+	if !contentType.Equal(oidSignedData) {
+		return fmt.Errorf("scep: PKIMessage content type %s is not signedData", contentType)
+	}
+	if _, err := expectHeader(br, asn1.ClassContextSpecific, 0); err != nil {
+		return err
+	}
+
+	// SignedData ::= SEQUENCE { version, digestAlgorithms,
+	//   contentInfo, [0] IMPLICIT certificates OPTIONAL, ... }
+	if _, err := expectHeader(br, asn1.ClassUniversal, asn1.TagSequence); err != nil {
+		return err
+	}
+	for _, tag := range []int{asn1.TagInteger, asn1.TagSet, asn1.TagSequence} {
+		h, err := expectHeader(br, asn1.ClassUniversal, tag)
+		if err != nil {
+			return err
+		}
+		if err := skipContent(br, h); err != nil {
+			return err
+		}
+	}
+	h, err = readHeader(br)
+	if err != nil {
+		return err
+	}
+	if h.class != asn1.ClassContextSpecific || h.tag != 0 {
+		// no certificates
+		return nil
+	}
+
+	remaining := h.length
+	for remaining != 0 {
+		ch, err := readHeader(br)
+		if err != nil {
+			return err
+		}
+		if h.length < 0 && ch.isEndOfContents() {
+			return nil
+		}
+		if ch.class != asn1.ClassUniversal || ch.tag != asn1.TagSequence || ch.length < 0 {
+			return errors.New("scep: malformed certificate in PKCS#7 structure")
+		}
+		if ch.length > maxCertSize {
+			return fmt.Errorf("scep: certificate of %d bytes exceeds limit", ch.length)
+		}
+		der := make([]byte, len(ch.raw)+ch.length)
+		copy(der, ch.raw)
+		if _, err := io.ReadFull(br, der[len(ch.raw):]); err != nil {
+			return err
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return err
+		}
+		if err := fn(cert); err != nil {
+			return err
+		}
+		if remaining > 0 {
+			remaining -= len(der)
+			if remaining < 0 {
+				return errors.New("scep: certificate exceeds PKCS#7 certificates length")
+			}
+		}
+	}
+	return nil
+}
+
+// derHeader is the identifier and length octets of a BER element.
+type derHeader struct {
+	class       int
+	tag         int
+	constructed bool
+	length      int // -1 for the indefinite length form
+	raw         []byte
+}
+
+func (h derHeader) isEndOfContents() bool {
+	return h.class == asn1.ClassUniversal && h.tag == 0 && !h.constructed && h.length == 0
+}
+
+func readHeader(r *bufio.Reader) (derHeader, error) {
+	var h derHeader
+	b, err := r.ReadByte()
+	if err != nil {
+		return h, err
+	}
+	h.raw = append(h.raw, b)
+	h.class = int(b >> 6)
+	h.constructed = b&0x20 != 0
+	h.tag = int(b & 0x1f)
+	if h.tag == 0x1f {
+		// high tag number form
+		h.tag = 0
+		for {
+			b, err := r.ReadByte()
+			if err != nil {
+				return h, err
+			}
+			h.raw = append(h.raw, b)
+			h.tag = h.tag<<7 | int(b&0x7f)
+			if h.tag > 1<<24 {
+				return h, errors.New("scep: ASN.1 tag too large")
+			}
+			if b&0x80 == 0 {
+				break
+			}
+		}
+	}
+
+	b, err = r.ReadByte()
+	if err != nil {
+		return h, err
+	}
+	h.raw = append(h.raw, b)
+	switch {
+	case b < 0x80:
+		h.length = int(b)
+	case b == 0x80:
+		if !h.constructed {
+			return h, errors.New("scep: indefinite length on primitive ASN.1 element")
+		}
+		h.length = -1
+	default:
+		n := int(b & 0x7f)
+		if n > 4 {
+			return h, errors.New("scep: ASN.1 length too large")
+		}
+		for i := 0; i < n; i++ {
+			b, err := r.ReadByte()
+			if err != nil {
+				return h, err
+			}
+			h.raw = append(h.raw, b)
+			h.length = h.length<<8 | int(b)
+		}
+		if h.length < 0 || h.length > maxPayloadLength {
+			return h, errors.New("scep: ASN.1 length too large")
+		}
+	}
+	return h, nil
+}
+
+// maxPayloadLength bounds any single length read by readHeader.
+const maxPayloadLength = 1 << 30
+
+func expectHeader(r *bufio.Reader, class, tag int) (derHeader, error) {
+	h, err := readHeader(r)
+	if err != nil {
+		return h, err
+	}
+	if h.class != class || h.tag != tag {
+		return h, fmt.Errorf("scep: unexpected ASN.1 element (class %d, tag %d) in PKCS#7 structure", h.class, h.tag)
+	}
+	return h, nil
+}
+
+// skipContent discards the contents of the element with header h.
+func skipContent(r *bufio.Reader, h derHeader) error {
+	if h.length >= 0 {
+		_, err := io.CopyN(ioutil.Discard, r, int64(h.length))
+		return err
+	}
+	for {
+		ch, err := readHeader(r)
+		if err != nil {
+			return err
+		}
+		if ch.isEndOfContents() {
+			return nil
+		}
+		if err := skipContent(r, ch); err != nil {
+			return err
+		}
+	}
+}
+
+// TrimTrailingData returns data up to the end of the BER or DER element
+// it starts with, dropping bytes some servers append to a response, such
+// as a newline or an HTML footer. data is returned unchanged if it does
+// not start with a complete element.
+func TrimTrailingData(data []byte) []byte {
+	br := bytes.NewReader(data)
+	r := bufio.NewReader(br)
+	h, err := readHeader(r)
+	if err != nil {
+		return data
+	}
+	if err := skipContent(r, h); err != nil {
+		return data
+	}
+	end := len(data) - br.Len() - r.Buffered()
+	return data[:end]
+}
@@ -0,0 +1,192 @@
+package scepserver
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+
+	"scepclient/scep"
+)
+
+// transactionTTL is how long the requests of a transaction are
+// counted after its last request.
+const transactionTTL = time.Hour
+
+// LogHandler logs an access record of every request served by next,
+// with its SCEP operation, status, byte counts, duration, also in
+// milliseconds as duration_ms, and client IP. For
+// PKIOperation requests, it adds the transaction ID and message type of
+// the request, the pkiStatus of the response, and the attempt number,
+// which counts the requests of the transaction, so that retries and
+// polling of one enrollment are correlated across requests. The
+// transaction ID is also set on the request context, see TransactionID.
+//
+// Wrap it with LimitHandler, rather than the other way around, so that
+// rejected requests are not read, and the requester of a ClientIPHeader
+// is logged.
+func LogHandler(next http.Handler, logger *slog.Logger) http.Handler {
+	return &logHandler{
+		next:         next,
+		logger:       logger,
+		transactions: make(map[string]*transactionLog),
+	}
+}
+
+type logHandler struct {
+	next   http.Handler
+	logger *slog.Logger
+
+	mtx          sync.Mutex
+	transactions map[string]*transactionLog
+	lastSweep    time.Time
+}
+
+// transactionLog tracks the requests of a transaction.
+type transactionLog struct {
+	attempts int
+	first    time.Time
+	last     time.Time
+}
+
+func (h *logHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	begin := time.Now()
+	op := r.URL.Query().Get("operation")
+	if op == "" {
+		switch base := path.Base(r.URL.Path); base {
+		case estCACerts, estSimpleEnroll, estSimpleReenroll:
+			op = base
+		}
+	}
+	remote, ok := Requester(r.Context())
+	if !ok {
+		remote = r.RemoteAddr
+	}
+	clientIP := remote
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		clientIP = host
+	}
+	attrs := []interface{}{
+		"method", r.Method,
+		"path", r.URL.Path,
+		"operation", op,
+		"remote", remote,
+		"client_ip", clientIP,
+	}
+	rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+	if op == pkiOperation {
+		if msg := h.peekMessage(r); msg != nil {
+			id := string(msg.TransactionID)
+			attempt, since := h.attempt(id, begin)
+			attrs = append(attrs,
+				"transaction_id", id,
+				"message_type", msg.MessageType,
+				"attempt", attempt,
+			)
+			if attempt > 1 {
+				attrs = append(attrs, "since_first_attempt", since)
+			}
+			r = r.WithContext(WithTransactionID(r.Context(), id))
+		}
+		rec.keep = true
+	}
+	h.next.ServeHTTP(rec, r)
+	attrs = append(attrs, "status", rec.status)
+	if r.ContentLength >= 0 {
+		attrs = append(attrs, "bytes_in", r.ContentLength)
+	}
+	duration := time.Since(begin)
+	attrs = append(attrs,
+		"bytes_out", rec.written,
+		"duration", duration,
+		"duration_ms", float64(duration.Microseconds())/1000,
+	)
+	if rec.keep && rec.status == http.StatusOK {
+		if resp, err := scep.ParsePKIMessage(rec.body.Bytes()); err == nil {
+			attrs = append(attrs, "pki_status", resp.PKIStatus)
+		}
+	}
+	h.logger.InfoContext(r.Context(), "scep server request", attrs...)
+}
+
+// peekMessage parses the PKIOperation message of r, without consuming
+// the body. It returns nil for messages which are malformed or larger
+// than the maximum payload size.
+func (h *logHandler) peekMessage(r *http.Request) *scep.PKIMessage {
+	var data []byte
+	switch r.Method {
+	case http.MethodGet:
+		var err error
+		if data, err = decodeMessage(r.URL.Query().Get("message")); err != nil {
+			return nil
+		}
+	case http.MethodPost:
+		var err error
+		data, err = ioutil.ReadAll(io.LimitReader(r.Body, maxPayloadSize+1))
+		// the handler reads the body as sent, and enforces the limits
+		r.Body = readCloser{io.MultiReader(bytes.NewReader(data), r.Body), r.Body}
+		if err != nil || len(data) > maxPayloadSize {
+			return nil
+		}
+	default:
+		return nil
+	}
+	msg, err := scep.ParsePKIMessage(data)
+	if err != nil {
+		return nil
+	}
+	return msg
+}
+
+// attempt counts a request of transaction id at now, and returns its
+// number and the time since the first request, forgetting transactions
+// idle for transactionTTL once per sweepInterval to bound memory use.
+func (h *logHandler) attempt(id string, now time.Time) (int, time.Duration) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	if now.Sub(h.lastSweep) > sweepInterval {
+		for tid, t := range h.transactions {
+			if now.Sub(t.last) > transactionTTL {
+				delete(h.transactions, tid)
+			}
+		}
+		h.lastSweep = now
+	}
+	t, ok := h.transactions[id]
+	if !ok {
+		t = &transactionLog{first: now}
+		h.transactions[id] = t
+	}
+	t.attempts++
+	t.last = now
+	return t.attempts, now.Sub(t.first)
+}
+
+// responseRecorder records the status and size of a response,
+// and keeps its body if keep is set.
+type responseRecorder struct {
+	http.ResponseWriter
+	status  int
+	written int64
+	keep    bool
+	body    bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(p []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(p)
+	r.written += int64(n)
+	if r.keep && r.body.Len() < maxPayloadSize {
+		r.body.Write(p[:n])
+	}
+	return n, err
+}
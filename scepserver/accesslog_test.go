@@ -0,0 +1,134 @@
+package scepserver
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"scepclient/scep"
+)
+
+func TestLogHandler(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: tmpl.Subject}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := scep.NewCSRRequest(csr, &scep.PKIMessage{
+		MessageType: scep.PKCSReq,
+		Recipients:  []*x509.Certificate{cert},
+		SignerKey:   key,
+		SignerCert:  cert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the next handler gets the whole message, and answers pending
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id, _ := TransactionID(r.Context()); id != string(msg.TransactionID) {
+			t.Errorf("expected the transaction ID %s on the context, got %q", msg.TransactionID, id)
+		}
+		if r.Method == http.MethodPost {
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil || !bytes.Equal(body, msg.Raw) {
+				t.Error("expected the handler to read the whole message")
+			}
+		}
+		resp, err := msg.Pending(cert, key)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		w.Write(resp.Raw)
+	})
+	var buf bytes.Buffer
+	h := LogHandler(next, slog.New(slog.NewJSONHandler(&buf, nil)))
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodPost, "/?operation=PKIOperation", bytes.NewReader(msg.Raw)),
+		httptest.NewRequest(http.MethodGet, "/?operation=PKIOperation&message="+url.QueryEscape(base64.StdEncoding.EncodeToString(msg.Raw)), nil),
+	} {
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	dec := json.NewDecoder(&buf)
+	for i := 1; i <= 2; i++ {
+		var record struct {
+			Operation     string   `json:"operation"`
+			Status        int      `json:"status"`
+			TransactionID string   `json:"transaction_id"`
+			MessageType   string   `json:"message_type"`
+			Attempt       int      `json:"attempt"`
+			SinceFirst    *int64   `json:"since_first_attempt"`
+			PKIStatus     string   `json:"pki_status"`
+			BytesOut      float64  `json:"bytes_out"`
+			ClientIP      string   `json:"client_ip"`
+			DurationMS    *float64 `json:"duration_ms"`
+		}
+		if err := dec.Decode(&record); err != nil {
+			t.Fatal(err)
+		}
+		if record.Operation != pkiOperation || record.Status != http.StatusOK || record.BytesOut == 0 || record.DurationMS == nil {
+			t.Errorf("request %d: unexpected record %+v", i, record)
+		}
+		if record.TransactionID != string(msg.TransactionID) || record.MessageType != string(scep.PKCSReq) {
+			t.Errorf("request %d: expected the transaction of the message, got %+v", i, record)
+		}
+		if record.Attempt != i || (i > 1) != (record.SinceFirst != nil) {
+			t.Errorf("request %d: expected attempt %d, got %+v", i, i, record)
+		}
+		if record.ClientIP != "192.0.2.1" {
+			t.Errorf("request %d: expected the client IP of the request, got %q", i, record.ClientIP)
+		}
+		if record.PKIStatus != string(scep.PENDING) {
+			t.Errorf("request %d: expected the pkiStatus of the response, got %q", i, record.PKIStatus)
+		}
+	}
+}
+
+func TestLogHandlerSweep(t *testing.T) {
+	h := LogHandler(http.NotFoundHandler(), slog.Default()).(*logHandler)
+	now := time.Now()
+	h.attempt("old", now)
+	h.attempt("recent", now.Add(transactionTTL))
+	if n, _ := h.attempt("recent", now.Add(transactionTTL+2*sweepInterval)); n != 2 {
+		t.Errorf("expected the second attempt of a recent transaction, got %d", n)
+	}
+	if _, ok := h.transactions["old"]; ok {
+		t.Error("expected the idle transaction to be forgotten")
+	}
+}
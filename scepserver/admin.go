@@ -0,0 +1,363 @@
+package scepserver
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"scepclient/clock"
+)
+
+// CertificateLister is implemented by depots
+// which can list the certificates they hold.
+type CertificateLister interface {
+	// ListCertificates returns the issued certificates.
+	ListCertificates() ([]*x509.Certificate, error)
+}
+
+// RevocationReasons are the CRL reason codes by their names in
+// RFC 5280, section 5.3.1.
+var RevocationReasons = map[string]int{
+	"unspecified":          0,
+	"keyCompromise":        1,
+	"cACompromise":         2,
+	"affiliationChanged":   3,
+	"superseded":           4,
+	"cessationOfOperation": 5,
+	"certificateHold":      6,
+	"removeFromCRL":        8,
+	"privilegeWithdrawn":   9,
+	"aACompromise":         10,
+}
+
+// revocationReason returns the name of the CRL reason code reason.
+func revocationReason(reason int) string {
+	for name, code := range RevocationReasons {
+		if code == reason {
+			return name
+		}
+	}
+	return fmt.Sprint(reason)
+}
+
+// AdminConfig configures NewAdminHandler.
+type AdminConfig struct {
+	// Token authenticates the requests as bearer token.
+	// All requests are rejected if it is empty.
+	Token string
+
+	// Certificates lists the issued certificates, usually the depot.
+	// They are not listed if it is nil.
+	Certificates CertificateLister
+
+	// Revocations revokes the issued certificates, usually the
+	// depot. They can't be revoked if it is nil.
+	Revocations Revocations
+
+	// Pending tracks the pending transactions of the Service.
+	// They are not listed if it is nil.
+	Pending *PendingTransactions
+
+	// Auditor records the revocations.
+	// They are not recorded if it is nil.
+	Auditor Auditor
+
+	// Clock tells the status of the certificates and the time of
+	// revocations. The system clock is used if it is nil.
+	Clock clock.Clock
+}
+
+// AdminCertificate is an issued certificate listed by NewAdminHandler.
+type AdminCertificate struct {
+	// Serial is the serial number in hexadecimal.
+	Serial         string    `json:"serial"`
+	Subject        string    `json:"subject"`
+	CommonName     string    `json:"common_name,omitempty"`
+	DNSNames       []string  `json:"dns_names,omitempty"`
+	EmailAddresses []string  `json:"email_addresses,omitempty"`
+	IPAddresses    []string  `json:"ip_addresses,omitempty"`
+	NotBefore      time.Time `json:"not_before"`
+	NotAfter       time.Time `json:"not_after"`
+
+	// Status is valid, expired or revoked.
+	Status           string     `json:"status"`
+	RevokedAt        *time.Time `json:"revoked_at,omitempty"`
+	RevocationReason string     `json:"revocation_reason,omitempty"`
+
+	// Certificate is the PEM encoded certificate.
+	Certificate string `json:"certificate"`
+}
+
+// certificateFilter selects the certificates listed by NewAdminHandler.
+// Its zero value selects all certificates.
+type certificateFilter struct {
+	commonName                  string
+	serial                      *big.Int
+	status                      string
+	issuedAfter, issuedBefore   time.Time
+	expiresAfter, expiresBefore time.Time
+}
+
+// parseCertificateFilter parses the filter of the query q.
+func parseCertificateFilter(q url.Values) (*certificateFilter, error) {
+	f := &certificateFilter{commonName: q.Get("cn"), status: q.Get("status")}
+	if _, err := path.Match(f.commonName, ""); err != nil {
+		return nil, fmt.Errorf("invalid cn pattern %q", f.commonName)
+	}
+	switch f.status {
+	case "", "valid", "expired", "revoked":
+	default:
+		return nil, fmt.Errorf("invalid status %q, expected valid, expired or revoked", f.status)
+	}
+	if s := q.Get("serial"); s != "" {
+		var err error
+		if f.serial, err = parseSerial(s); err != nil {
+			return nil, err
+		}
+	}
+	for name, t := range map[string]*time.Time{
+		"issued_after":   &f.issuedAfter,
+		"issued_before":  &f.issuedBefore,
+		"expires_after":  &f.expiresAfter,
+		"expires_before": &f.expiresBefore,
+	} {
+		if s := q.Get(name); s != "" {
+			var err error
+			if *t, err = time.Parse(time.RFC3339, s); err != nil {
+				return nil, fmt.Errorf("invalid %s %q, expected an RFC 3339 time", name, s)
+			}
+		}
+	}
+	return f, nil
+}
+
+// match reports whether the filter selects crt.
+func (f *certificateFilter) match(crt *AdminCertificate, serial *big.Int) bool {
+	if f.commonName != "" {
+		if ok, _ := path.Match(f.commonName, crt.CommonName); !ok {
+			return false
+		}
+	}
+	switch {
+	case f.serial != nil && f.serial.Cmp(serial) != 0,
+		f.status != "" && f.status != crt.Status,
+		!f.issuedAfter.IsZero() && !crt.NotBefore.After(f.issuedAfter),
+		!f.issuedBefore.IsZero() && !crt.NotBefore.Before(f.issuedBefore),
+		!f.expiresAfter.IsZero() && !crt.NotAfter.After(f.expiresAfter),
+		!f.expiresBefore.IsZero() && !crt.NotAfter.Before(f.expiresBefore):
+		return false
+	}
+	return true
+}
+
+// parseSerial parses a hexadecimal serial number, optionally
+// prefixed with 0x or with colon separated bytes.
+func parseSerial(s string) (*big.Int, error) {
+	serial, ok := new(big.Int).SetString(strings.TrimPrefix(strings.ReplaceAll(s, ":", ""), "0x"), 16)
+	if !ok {
+		return nil, fmt.Errorf("invalid serial number %q, expected a hex serial number", s)
+	}
+	return serial, nil
+}
+
+// NewAdminHandler serves an API administering the certificates issued
+// by the CA, with JSON responses, on any path ending with:
+//
+//	certificates
+//	    GET the issued certificates as AdminCertificates, filtered by
+//	    the query parameters cn, a path.Match pattern of the common
+//	    name, serial, in hex, status, and issued_after, issued_before,
+//	    expires_after and expires_before, RFC 3339 times
+//	certificates/<serial>/revoke
+//	    POST revokes the certificate with the hex serial number, for the
+//	    reason form value, a name of RevocationReasons, listing it in
+//	    the CRL
+//	pending
+//	    GET the PendingTransactions
+//
+// Clients authenticate with config.Token as bearer token, as with
+// NewChallengeHandler.
+func NewAdminHandler(config AdminConfig) http.Handler {
+	h := &adminHandler{config: config, clock: clock.Or(config.Clock)}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !bearerAuthorized(r, config.Token) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="scep admin"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		segments := strings.Split(strings.TrimSuffix(r.URL.Path, "/"), "/")
+		n := len(segments)
+		switch {
+		case segments[n-1] == "certificates":
+			if allowMethod(w, r, http.MethodGet) {
+				h.certificates(w, r)
+			}
+		case n >= 3 && segments[n-3] == "certificates" && segments[n-1] == "revoke":
+			if allowMethod(w, r, http.MethodPost) {
+				h.revoke(w, r, segments[n-2])
+			}
+		case segments[n-1] == "pending":
+			if allowMethod(w, r, http.MethodGet) {
+				h.pending(w, r)
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+type adminHandler struct {
+	config AdminConfig
+	clock  clock.Clock
+}
+
+// allowMethod reports whether r uses method,
+// and responds with an error if it doesn't.
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	return false
+}
+
+func (h *adminHandler) certificates(w http.ResponseWriter, r *http.Request) {
+	if h.config.Certificates == nil {
+		http.Error(w, "the depot can't list certificates", http.StatusNotImplemented)
+		return
+	}
+	filter, err := parseCertificateFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	certs, err := h.config.Certificates.ListCertificates()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	revoked := make(map[string]x509.RevocationListEntry)
+	if h.config.Revocations != nil {
+		entries, err := h.config.Revocations.Revoked()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, entry := range entries {
+			revoked[entry.SerialNumber.Text(16)] = entry
+		}
+	}
+	sort.Slice(certs, func(i, j int) bool {
+		if !certs[i].NotBefore.Equal(certs[j].NotBefore) {
+			return certs[i].NotBefore.Before(certs[j].NotBefore)
+		}
+		return certs[i].SerialNumber.Cmp(certs[j].SerialNumber) < 0
+	})
+	now := h.clock.Now()
+	list := []*AdminCertificate{}
+	for _, crt := range certs {
+		c := &AdminCertificate{
+			Serial:         crt.SerialNumber.Text(16),
+			Subject:        crt.Subject.String(),
+			CommonName:     crt.Subject.CommonName,
+			DNSNames:       crt.DNSNames,
+			EmailAddresses: crt.EmailAddresses,
+			NotBefore:      crt.NotBefore,
+			NotAfter:       crt.NotAfter,
+			Status:         "valid",
+			Certificate:    string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: crt.Raw})),
+		}
+		for _, ip := range crt.IPAddresses {
+			c.IPAddresses = append(c.IPAddresses, ip.String())
+		}
+		if entry, ok := revoked[c.Serial]; ok {
+			c.Status = "revoked"
+			c.RevokedAt = &entry.RevocationTime
+			c.RevocationReason = revocationReason(entry.ReasonCode)
+		} else if now.After(crt.NotAfter) {
+			c.Status = "expired"
+		}
+		if filter.match(c, crt.SerialNumber) {
+			list = append(list, c)
+		}
+	}
+	writeJSON(w, list)
+}
+
+func (h *adminHandler) revoke(w http.ResponseWriter, r *http.Request, s string) {
+	if h.config.Revocations == nil {
+		http.Error(w, "the depot can't revoke certificates", http.StatusNotImplemented)
+		return
+	}
+	serial, err := parseSerial(s)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	name := r.FormValue("reason")
+	if name == "" {
+		name = "unspecified"
+	}
+	reason, ok := RevocationReasons[name]
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown revocation reason %q", name), http.StatusBadRequest)
+		return
+	}
+	now := h.clock.Now()
+	if err := h.config.Revocations.Revoke(serial, reason, now); errors.Is(err, ErrUnknownCertificate) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if h.config.Auditor != nil {
+		requester, ok := Requester(r.Context())
+		if !ok {
+			requester = r.RemoteAddr
+		}
+		ev := &AuditEvent{
+			Time:        now,
+			Outcome:     AuditRevoked,
+			MessageType: "revoke",
+			Requester:   requester,
+			Serial:      serial.Text(16),
+			Reason:      name,
+		}
+		if err := h.config.Auditor.Audit(r.Context(), ev); err != nil {
+			http.Error(w, fmt.Sprintf("revoked, but failed to record the audit event: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *adminHandler) pending(w http.ResponseWriter, r *http.Request) {
+	list := []PendingTransaction{}
+	if h.config.Pending != nil {
+		list = h.config.Pending.List()
+	}
+	writeJSON(w, list)
+}
+
+// writeJSON responds with v encoded as JSON.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(append(data, '\n'))
+}
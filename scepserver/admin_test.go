@@ -0,0 +1,148 @@
+package scepserver
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"scepclient/clock"
+)
+
+// adminDepot holds certificates and their revocations in memory.
+type adminDepot struct {
+	certs   []*x509.Certificate
+	revoked []x509.RevocationListEntry
+}
+
+func (d *adminDepot) ListCertificates() ([]*x509.Certificate, error) { return d.certs, nil }
+
+func (d *adminDepot) Revoke(serial *big.Int, reason int, at time.Time) error {
+	for _, crt := range d.certs {
+		if crt.SerialNumber.Cmp(serial) == 0 {
+			d.revoked = append(d.revoked, x509.RevocationListEntry{SerialNumber: serial, ReasonCode: reason, RevocationTime: at})
+			return nil
+		}
+	}
+	return ErrUnknownCertificate
+}
+
+func (d *adminDepot) Revoked() ([]x509.RevocationListEntry, error) { return d.revoked, nil }
+
+func TestAdminHandler(t *testing.T) {
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	depot := &adminDepot{}
+	for i, cn := range []string{"device-1", "device-2", "printer"} {
+		depot.certs = append(depot.certs, &x509.Certificate{
+			Raw:          []byte("certificate"),
+			SerialNumber: big.NewInt(int64(0x2a + i)),
+			Subject:      pkix.Name{CommonName: cn},
+			NotBefore:    now.AddDate(0, -i, 0),
+			NotAfter:     now.AddDate(0, 3-2*i, 0),
+		})
+	}
+	var events []*AuditEvent
+	h := NewAdminHandler(AdminConfig{
+		Token:        "s3cret",
+		Certificates: depot,
+		Revocations:  depot,
+		Pending:      NewPendingTransactions(time.Hour, nil),
+		Auditor: AuditorFunc(func(ctx context.Context, ev *AuditEvent) error {
+			events = append(events, ev)
+			return nil
+		}),
+		Clock: clock.NewFake(now),
+	})
+	do := func(method, target string, form url.Values) *httptest.ResponseRecorder {
+		var req *http.Request
+		if form != nil {
+			req = httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		} else {
+			req = httptest.NewRequest(method, target, nil)
+		}
+		req.Header.Set("Authorization", "Bearer s3cret")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	list := func(query string) []string {
+		t.Helper()
+		rec := do(http.MethodGet, "/admin/certificates?"+query, nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("list %q: expected status 200, got %d: %s", query, rec.Code, rec.Body)
+		}
+		var certs []AdminCertificate
+		if err := json.Unmarshal(rec.Body.Bytes(), &certs); err != nil {
+			t.Fatal(err)
+		}
+		var listed []string
+		for _, crt := range certs {
+			listed = append(listed, fmt.Sprintf("%s %s %s", crt.Serial, crt.CommonName, crt.Status))
+		}
+		return listed
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/certificates", nil)
+	req.Header.Set("Authorization", "Bearer wrong")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected status 401 with a wrong token, got %d", rec.Code)
+	}
+
+	for query, want := range map[string]string{
+		// oldest first
+		"":                                    "2c printer expired,2b device-2 valid,2a device-1 valid",
+		"cn=device-*":                         "2b device-2 valid,2a device-1 valid",
+		"serial=2A":                           "2a device-1 valid",
+		"status=expired":                      "2c printer expired",
+		"expires_before=2026-03-01T00:00:00Z": "2c printer expired,2b device-2 valid",
+		"issued_after=2025-12-15T00:00:00Z":   "2a device-1 valid",
+	} {
+		if got := strings.Join(list(query), ","); got != want {
+			t.Errorf("list %q: expected %q, got %q", query, want, got)
+		}
+	}
+	for _, query := range []string{"cn=[", "status=unknown", "serial=xyz", "expires_before=tomorrow"} {
+		if rec := do(http.MethodGet, "/admin/certificates?"+query, nil); rec.Code != http.StatusBadRequest {
+			t.Errorf("list %q: expected status 400, got %d", query, rec.Code)
+		}
+	}
+
+	if rec := do(http.MethodPost, "/admin/certificates/2b/revoke", url.Values{"reason": {"keyCompromise"}}); rec.Code != http.StatusNoContent {
+		t.Fatalf("expected status 204 revoking a certificate, got %d: %s", rec.Code, rec.Body)
+	}
+	if got := list("status=revoked"); len(got) != 1 || got[0] != "2b device-2 revoked" {
+		t.Errorf("expected the revoked certificate, got %q", got)
+	}
+	if len(events) != 1 || events[0].Outcome != AuditRevoked || events[0].Serial != "2b" || events[0].Reason != "keyCompromise" {
+		t.Errorf("expected the revocation to be audited, got %+v", events)
+	}
+	for target, want := range map[string]int{
+		"/admin/certificates/ff/revoke":  http.StatusNotFound,
+		"/admin/certificates/xyz/revoke": http.StatusBadRequest,
+	} {
+		if rec := do(http.MethodPost, target, url.Values{}); rec.Code != want {
+			t.Errorf("%s: expected status %d, got %d", target, want, rec.Code)
+		}
+	}
+	if rec := do(http.MethodPost, "/admin/certificates/2a/revoke", url.Values{"reason": {"bored"}}); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for an unknown reason, got %d", rec.Code)
+	}
+	if rec := do(http.MethodGet, "/admin/certificates/2a/revoke", nil); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status 405 revoking with GET, got %d", rec.Code)
+	}
+
+	if rec := do(http.MethodGet, "/admin/pending", nil); rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != "[]" {
+		t.Errorf("expected no pending transactions, got %d: %s", rec.Code, rec.Body)
+	}
+}
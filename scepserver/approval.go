@@ -0,0 +1,98 @@
+package scepserver
+
+import (
+	"context"
+	"crypto/x509"
+	"time"
+
+	"scepclient/scep"
+)
+
+// Decision is the answer of an Approver.
+type Decision int
+
+const (
+	// Deny rejects the request with FAILURE and badRequest.
+	Deny Decision = iota
+	// Allow issues the requested certificate.
+	Allow
+	// Pending answers PENDING, so that the client polls again later,
+	// for example while the request awaits manual approval.
+	Pending
+)
+
+func (d Decision) String() string {
+	switch d {
+	case Deny:
+		return "deny"
+	case Allow:
+		return "allow"
+	case Pending:
+		return "pending"
+	default:
+		return "unknown"
+	}
+}
+
+// ApprovalRequest describes a certificate request to an Approver.
+type ApprovalRequest struct {
+	// TransactionID is empty for EST requests, and MessageType is
+	// PKCSReq for EST enrollments and RenewalReq for reenrollments.
+	TransactionID string
+	MessageType   scep.MessageType
+	CSR           *x509.CertificateRequest
+
+	// ChallengeValid reports whether the request carries a valid
+	// challenge password, or is otherwise authorized by a CSRVerifier,
+	// or the service requires none. One-time challenges are consumed
+	// by the first request of a transaction, whose validity is kept
+	// for the requests for the same key polling it after a Pending
+	// decision.
+	ChallengeValid bool
+
+	// Renewal reports whether the request is signed with a currently
+	// valid certificate issued by the CA, which authorizes it without
+	// a challenge password.
+	Renewal bool
+
+	// Signer is the certificate the request is signed with,
+	// self-signed for initial enrollments. For EST requests, it is
+	// the TLS client certificate, or nil without one.
+	Signer *x509.Certificate
+}
+
+// Approver decides whether a certificate request is issued.
+// Implementations must be safe for concurrent use.
+type Approver interface {
+	Approve(ctx context.Context, req *ApprovalRequest) (Decision, error)
+}
+
+// ApproverFunc adapts a function to the Approver interface.
+type ApproverFunc func(ctx context.Context, req *ApprovalRequest) (Decision, error)
+
+// Approve calls f.
+func (f ApproverFunc) Approve(ctx context.Context, req *ApprovalRequest) (Decision, error) {
+	return f(ctx, req)
+}
+
+// Policy restricts the certificates a Service issues.
+// Implementations must be safe for concurrent use.
+type Policy interface {
+	// Check returns an error describing why csr is not allowed, which
+	// is sent to the client as failInfoText, or nil if it is allowed.
+	Check(csr *x509.CertificateRequest) error
+
+	// MaxCertificateValidity caps the validity of the certificates
+	// issued with the CA key, if it is not zero.
+	MaxCertificateValidity() time.Duration
+}
+
+// RequesterPolicy is implemented by Policies which also restrict the
+// clients requesting certificates. The Service calls CheckRequester
+// instead of Check, with the requester of the request, as set with
+// WithRequester.
+type RequesterPolicy interface {
+	// CheckRequester returns an error describing why the client at the
+	// address requester may not request csr, or why csr is not allowed.
+	CheckRequester(requester string, csr *x509.CertificateRequest) error
+}
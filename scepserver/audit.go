@@ -0,0 +1,152 @@
+package scepserver
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// AuditOutcome is the outcome of a PKIOperation request.
+type AuditOutcome string
+
+// Outcomes recorded in audit events.
+const (
+	// AuditIssued records an issued certificate.
+	AuditIssued AuditOutcome = "issued"
+	// AuditDenied records a request answered with FAILURE.
+	AuditDenied AuditOutcome = "denied"
+	// AuditPending records a request answered with PENDING.
+	AuditPending AuditOutcome = "pending"
+	// AuditFailed records a request which could not be processed,
+	// such as an undecryptable message or a failing signer.
+	AuditFailed AuditOutcome = "failed"
+	// AuditRevoked records a certificate revoked with the API of
+	// NewAdminHandler.
+	AuditRevoked AuditOutcome = "revoked"
+)
+
+// AuditEvent records the outcome of a PKIOperation request, of
+// an EST enrollment, or of a revocation. Fields which are not known when the request
+// fails are empty.
+type AuditEvent struct {
+	Time          time.Time    `json:"time"`
+	Outcome       AuditOutcome `json:"outcome"`
+	TransactionID string       `json:"transaction_id,omitempty"`
+
+	// MessageType is the SCEP message type, or the EST
+	// operation, simpleenroll or simplereenroll.
+	MessageType string `json:"message_type,omitempty"`
+
+	// Requester is the client address, set with WithRequester.
+	Requester string `json:"requester,omitempty"`
+
+	// Signer is the subject of the certificate the request is signed
+	// with, and Renewal whether the CA issued it.
+	Signer  string `json:"signer,omitempty"`
+	Renewal bool   `json:"renewal,omitempty"`
+
+	// Subject, the SANs and Key summarize the CSR.
+	Subject        string   `json:"subject,omitempty"`
+	DNSNames       []string `json:"dns_names,omitempty"`
+	EmailAddresses []string `json:"email_addresses,omitempty"`
+	IPAddresses    []string `json:"ip_addresses,omitempty"`
+	URIs           []string `json:"uris,omitempty"`
+	Key            string   `json:"key,omitempty"`
+
+	// Serial is the hexadecimal serial number of the issued certificate.
+	Serial string `json:"serial,omitempty"`
+
+	// FailInfo is the SCEP failInfo of denied requests, and Reason
+	// explains denied and failed requests.
+	FailInfo string `json:"fail_info,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// Auditor records audit events.
+// Implementations must be safe for concurrent use.
+type Auditor interface {
+	Audit(ctx context.Context, ev *AuditEvent) error
+}
+
+// AuditorFunc adapts a function to the Auditor interface.
+type AuditorFunc func(ctx context.Context, ev *AuditEvent) error
+
+// Audit calls f.
+func (f AuditorFunc) Audit(ctx context.Context, ev *AuditEvent) error {
+	return f(ctx, ev)
+}
+
+// MultiAuditor records audit events with all auditors in turn,
+// stopping at the first which fails.
+func MultiAuditor(auditors ...Auditor) Auditor {
+	return AuditorFunc(func(ctx context.Context, ev *AuditEvent) error {
+		for _, a := range auditors {
+			if err := a.Audit(ctx, ev); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// NewJSONAuditor writes audit events to w as JSON lines.
+func NewJSONAuditor(w io.Writer) Auditor {
+	return &jsonAuditor{enc: json.NewEncoder(w)}
+}
+
+type jsonAuditor struct {
+	mtx sync.Mutex
+	enc *json.Encoder
+}
+
+func (a *jsonAuditor) Audit(ctx context.Context, ev *AuditEvent) error {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	return a.enc.Encode(ev)
+}
+
+type requesterKey struct{}
+
+// WithRequester returns a context carrying the address of the client
+// sending a request, which is recorded in audit events. NewHTTPHandler
+// sets it to the remote address of the request, unless it is already
+// set, as LimitHandler does with a ClientIPHeader.
+func WithRequester(ctx context.Context, addr string) context.Context {
+	return context.WithValue(ctx, requesterKey{}, addr)
+}
+
+// Requester returns the client address carried by ctx.
+func Requester(ctx context.Context) (string, bool) {
+	addr, ok := ctx.Value(requesterKey{}).(string)
+	return addr, ok
+}
+
+// describeCSR fills the CSR summary of ev.
+func (ev *AuditEvent) describeCSR(csr *x509.CertificateRequest) {
+	ev.Subject = csr.Subject.String()
+	ev.DNSNames = csr.DNSNames
+	ev.EmailAddresses = csr.EmailAddresses
+	for _, ip := range csr.IPAddresses {
+		ev.IPAddresses = append(ev.IPAddresses, ip.String())
+	}
+	for _, uri := range csr.URIs {
+		ev.URIs = append(ev.URIs, uri.String())
+	}
+	switch pub := csr.PublicKey.(type) {
+	case *rsa.PublicKey:
+		ev.Key = "RSA " + strconv.Itoa(pub.N.BitLen())
+	case *ecdsa.PublicKey:
+		ev.Key = "ECDSA " + pub.Curve.Params().Name
+	case ed25519.PublicKey:
+		ev.Key = "Ed25519"
+	default:
+		ev.Key = csr.PublicKeyAlgorithm.String()
+	}
+}
@@ -0,0 +1,37 @@
+package scepserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestJSONAuditor(t *testing.T) {
+	var buf bytes.Buffer
+	auditor := NewJSONAuditor(&buf)
+	events := []*AuditEvent{
+		{Time: time.Unix(0, 0).UTC(), Outcome: AuditIssued, TransactionID: "1", Serial: "2a"},
+		{Time: time.Unix(1, 0).UTC(), Outcome: AuditDenied, TransactionID: "2", FailInfo: "badRequest (2)"},
+	}
+	for _, ev := range events {
+		if err := auditor.Audit(context.Background(), ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	if len(lines) != len(events) {
+		t.Fatalf("expected %d lines, got %q", len(events), buf.String())
+	}
+	if want := `{"time":"1970-01-01T00:00:00Z","outcome":"issued","transaction_id":"1","serial":"2a"}`; string(lines[0]) != want {
+		t.Errorf("expected %s, got %s", want, lines[0])
+	}
+	var ev AuditEvent
+	if err := json.Unmarshal(lines[1], &ev); err != nil {
+		t.Fatal(err)
+	}
+	if ev.Outcome != AuditDenied || ev.FailInfo != "badRequest (2)" {
+		t.Errorf("unexpected event %+v", ev)
+	}
+}
@@ -0,0 +1,137 @@
+package scepserver
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"scepclient/clock"
+)
+
+// ChallengeStore issues one-time challenge passwords.
+// Implementations must be safe for concurrent use.
+type ChallengeStore interface {
+	// CreateChallenge returns a new random challenge password.
+	CreateChallenge() (string, error)
+
+	// HasChallenge reports whether pw was created by CreateChallenge,
+	// has neither been used nor expired yet, and consumes it.
+	HasChallenge(pw string) (bool, error)
+}
+
+// GenerateChallenge returns a random challenge password
+// of 32 hexadecimal digits.
+func GenerateChallenge() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// NewChallengeStore returns a ChallengeStore keeping its challenges in
+// memory, so that they are lost when the process exits. Challenges
+// expire after ttl, or never if it is zero. c measures their age;
+// the system clock is used if it is nil.
+func NewChallengeStore(ttl time.Duration, c clock.Clock) ChallengeStore {
+	return &memoryChallengeStore{
+		ttl:        ttl,
+		clock:      clock.Or(c),
+		challenges: make(map[string]time.Time),
+	}
+}
+
+type memoryChallengeStore struct {
+	ttl   time.Duration
+	clock clock.Clock
+
+	mtx        sync.Mutex
+	challenges map[string]time.Time
+}
+
+func (s *memoryChallengeStore) CreateChallenge() (string, error) {
+	pw, err := GenerateChallenge()
+	if err != nil {
+		return "", err
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	now := s.clock.Now()
+	// drop expired challenges, which are never used
+	for old, created := range s.challenges {
+		if s.expired(created, now) {
+			delete(s.challenges, old)
+		}
+	}
+	s.challenges[pw] = now
+	return pw, nil
+}
+
+func (s *memoryChallengeStore) HasChallenge(pw string) (bool, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	created, ok := s.challenges[pw]
+	if !ok {
+		return false, nil
+	}
+	delete(s.challenges, pw)
+	return !s.expired(created, s.clock.Now()), nil
+}
+
+func (s *memoryChallengeStore) expired(created, now time.Time) bool {
+	return s.ttl > 0 && now.Sub(created) > s.ttl
+}
+
+func (s *memoryChallengeStore) PruneChallenges() (int, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	now := s.clock.Now()
+	var n int
+	for pw, created := range s.challenges {
+		if s.expired(created, now) {
+			delete(s.challenges, pw)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// NewChallengeHandler responds to GET requests with a new one-time
+// challenge password of store. Clients must authenticate with token
+// as bearer token, in an "Authorization: Bearer <token>" header;
+// all requests are rejected if token is empty.
+func NewChallengeHandler(store ChallengeStore, token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !bearerAuthorized(r, token) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="scep challenge"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		pw, err := store.CreateChallenge()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write([]byte(pw))
+	})
+}
+
+// bearerAuthorized reports whether r carries token as bearer token,
+// in an "Authorization: Bearer <token>" header. No request is
+// authorized if token is empty.
+func bearerAuthorized(r *http.Request, token string) bool {
+	auth := r.Header.Get("Authorization")
+	const prefix = "Bearer "
+	return token != "" && len(auth) >= len(prefix) && strings.EqualFold(auth[:len(prefix)], prefix) &&
+		subtle.ConstantTimeCompare([]byte(auth[len(prefix):]), []byte(token)) == 1
+}
@@ -0,0 +1,70 @@
+package scepserver
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"scepclient/clock"
+)
+
+func TestChallengeStore(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	store := NewChallengeStore(time.Hour, clk)
+
+	pw, err := store.CreateChallenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []bool{true, false} {
+		if ok, _ := store.HasChallenge(pw); ok != want {
+			t.Errorf("use %d: expected HasChallenge to return %v", i+1, want)
+		}
+	}
+
+	pw, err = store.CreateChallenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clk.Advance(time.Hour + time.Second)
+	if ok, _ := store.HasChallenge(pw); ok {
+		t.Error("expected an expired challenge to be rejected")
+	}
+}
+
+func TestChallengeHandler(t *testing.T) {
+	store := NewChallengeStore(0, nil)
+	tests := []struct {
+		name   string
+		token  string
+		auth   string
+		status int
+	}{
+		{"valid token", "secret", "Bearer secret", http.StatusOK},
+		{"wrong token", "secret", "Bearer other", http.StatusUnauthorized},
+		{"no token", "secret", "", http.StatusUnauthorized},
+		{"no token configured", "", "Bearer ", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/challenge", nil)
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			rec := httptest.NewRecorder()
+			NewChallengeHandler(store, tt.token).ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Fatalf("expected status %d, got %d", tt.status, rec.Code)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			pw, _ := ioutil.ReadAll(rec.Body)
+			if ok, _ := store.HasChallenge(string(pw)); !ok {
+				t.Errorf("expected the challenge %q to be valid", pw)
+			}
+		})
+	}
+}
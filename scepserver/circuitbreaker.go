@@ -0,0 +1,176 @@
+package scepserver
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"scepclient/clock"
+)
+
+// ErrCircuitOpen is returned without contacting the server
+// while the circuit breaker is open.
+var ErrCircuitOpen = errors.New("scep: circuit breaker open")
+
+// CircuitState is the state of a circuit breaker.
+type CircuitState int
+
+const (
+	// CircuitClosed lets all requests through.
+	CircuitClosed CircuitState = iota
+	// CircuitOpen rejects all requests with ErrCircuitOpen.
+	CircuitOpen
+	// CircuitHalfOpen lets a single probe request through,
+	// which decides whether the circuit closes or opens again.
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// CircuitBreakerConfig configures CircuitBreakerMiddleware.
+type CircuitBreakerConfig struct {
+	// FailureThreshold is the number of consecutive
+	// failures after which the circuit opens.
+	FailureThreshold int
+
+	// OpenTimeout is how long the circuit stays open
+	// before a half-open probe is let through.
+	OpenTimeout time.Duration
+
+	// OnStateChange, if set, is called on every state change,
+	// for example to report half-open probes. It is called with
+	// the breaker locked and must not send requests itself.
+	OnStateChange func(from, to CircuitState)
+
+	// Clock measures OpenTimeout.
+	// The system clock is used if it is nil.
+	Clock clock.Clock
+}
+
+// CircuitBreakerMiddleware stops sending requests to a server after
+// repeated failures. Transport errors and HTTP 5xx responses count as
+// failures; other HTTP errors, such as a 403 for a bad challenge, are
+// answers from a healthy server and don't. Neither do 503 responses
+// with a Retry-After header, which announce a maintenance window.
+func CircuitBreakerMiddleware(config CircuitBreakerConfig) Middleware {
+	return func(next Transport) Transport {
+		return &circuitBreaker{next: next, config: config}
+	}
+}
+
+type circuitBreaker struct {
+	next   Transport
+	config CircuitBreakerConfig
+
+	mtx      sync.Mutex
+	state    CircuitState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func (cb *circuitBreaker) SendGet(ctx context.Context, req SCEPRequest) (SCEPResponse, error) {
+	if err := cb.allow(); err != nil {
+		return SCEPResponse{}, err
+	}
+	resp, err := cb.next.SendGet(ctx, req)
+	cb.done(err)
+	return resp, err
+}
+
+func (cb *circuitBreaker) SendPost(ctx context.Context, req SCEPRequest) (SCEPResponse, error) {
+	if err := cb.allow(); err != nil {
+		return SCEPResponse{}, err
+	}
+	resp, err := cb.next.SendPost(ctx, req)
+	cb.done(err)
+	return resp, err
+}
+
+func (cb *circuitBreaker) StreamGet(ctx context.Context, req SCEPRequest) (io.ReadCloser, SCEPResponse, error) {
+	if err := cb.allow(); err != nil {
+		return nil, SCEPResponse{}, err
+	}
+	body, resp, err := StreamGet(ctx, cb.next, req)
+	cb.done(err)
+	return body, resp, err
+}
+
+// allow reports whether a request may be sent.
+func (cb *circuitBreaker) allow() error {
+	cb.mtx.Lock()
+	defer cb.mtx.Unlock()
+	switch cb.state {
+	case CircuitOpen:
+		if clock.Or(cb.config.Clock).Now().Sub(cb.openedAt) < cb.config.OpenTimeout {
+			return ErrCircuitOpen
+		}
+		cb.setState(CircuitHalfOpen)
+		cb.probing = true
+		return nil
+	case CircuitHalfOpen:
+		if cb.probing {
+			return ErrCircuitOpen
+		}
+		cb.probing = true
+		return nil
+	default:
+		return nil
+	}
+}
+
+// done records the outcome of a request.
+func (cb *circuitBreaker) done(err error) {
+	cb.mtx.Lock()
+	defer cb.mtx.Unlock()
+	cb.probing = false
+	if !isServerFailure(err) {
+		cb.failures = 0
+		if cb.state != CircuitClosed {
+			cb.setState(CircuitClosed)
+		}
+		return
+	}
+	cb.failures++
+	if cb.state == CircuitHalfOpen || cb.failures >= cb.config.FailureThreshold {
+		cb.openedAt = clock.Or(cb.config.Clock).Now()
+		if cb.state != CircuitOpen {
+			cb.setState(CircuitOpen)
+		}
+	}
+}
+
+func (cb *circuitBreaker) setState(state CircuitState) {
+	from := cb.state
+	cb.state = state
+	if cb.config.OnStateChange != nil {
+		cb.config.OnStateChange(from, state)
+	}
+}
+
+func isServerFailure(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		if _, ok := MaintenanceDelay(err); ok {
+			return false
+		}
+		return httpErr.StatusCode >= 500
+	}
+	return true
+}
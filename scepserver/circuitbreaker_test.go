@@ -0,0 +1,61 @@
+package scepserver
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"scepclient/clock"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	next := &countingTransport{failures: 3, err: &HTTPError{StatusCode: http.StatusBadGateway}}
+	clk := clock.NewFake(time.Now())
+	var transitions []CircuitState
+	transport := CircuitBreakerMiddleware(CircuitBreakerConfig{
+		FailureThreshold: 2,
+		OpenTimeout:      20 * time.Millisecond,
+		Clock:            clk,
+		OnStateChange: func(from, to CircuitState) {
+			transitions = append(transitions, to)
+		},
+	})(next)
+	ctx := context.Background()
+	req := SCEPRequest{Operation: getCACaps}
+
+	for i := 0; i < 2; i++ {
+		if _, err := transport.SendGet(ctx, req); err == nil {
+			t.Fatal("expected server failure")
+		}
+	}
+	if _, err := transport.SendGet(ctx, req); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected ErrCircuitOpen, got %v", err)
+	}
+	if next.calls != 2 {
+		t.Errorf("expected open circuit not to contact the server, got %d calls", next.calls)
+	}
+
+	// the half-open probe fails and opens the circuit again
+	clk.Advance(30 * time.Millisecond)
+	if _, err := transport.SendGet(ctx, req); err == nil || errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected failed probe, got %v", err)
+	}
+
+	// the next probe succeeds and closes the circuit
+	clk.Advance(30 * time.Millisecond)
+	if _, err := transport.SendGet(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []CircuitState{CircuitOpen, CircuitHalfOpen, CircuitOpen, CircuitHalfOpen, CircuitClosed}
+	if len(transitions) != len(want) {
+		t.Fatalf("expected transitions %v, got %v", want, transitions)
+	}
+	for i := range want {
+		if transitions[i] != want[i] {
+			t.Fatalf("expected transitions %v, got %v", want, transitions)
+		}
+	}
+}
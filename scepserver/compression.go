@@ -0,0 +1,67 @@
+package scepserver
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// acceptEncoding is sent unless compression is disabled. Setting it
+// disables the transparent gzip support of net/http, so that responses
+// are decoded by decodeContentEncoding in all cases, including proxies
+// compressing responses which were not requested compressed.
+const acceptEncoding = "gzip, deflate"
+
+// decodeContentEncoding replaces the body of a compressed response with
+// the decompressed body. The payload size limit applies to the
+// decompressed data, as it is enforced when reading the body.
+// The body is left open if it fails.
+func decodeContentEncoding(resp *http.Response) error {
+	var (
+		body io.Reader
+		err  error
+	)
+	switch strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding"))) {
+	case "", "identity":
+		return nil
+	case "gzip", "x-gzip":
+		body, err = gzip.NewReader(resp.Body)
+	case "deflate":
+		body, err = newDeflateReader(resp.Body)
+	default:
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body = readCloser{Reader: body, Closer: resp.Body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return nil
+}
+
+// newDeflateReader reads "deflate" content, which is zlib data according
+// to the HTTP specification, but raw deflate data from some servers.
+func newDeflateReader(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(2)
+	if err != nil {
+		return nil, err
+	}
+	// a zlib header uses compression method 8 and is a multiple of 31
+	if header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		return zlib.NewReader(br)
+	}
+	return flate.NewReader(br), nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,124 @@
+package scepserver
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCompressedResponses(t *testing.T) {
+	payload := bytes.Repeat([]byte("certificate "), 100)
+	compress := func(newWriter func(io.Writer) io.WriteCloser, data []byte) []byte {
+		var buf bytes.Buffer
+		w := newWriter(&buf)
+		w.Write(data)
+		w.Close()
+		return buf.Bytes()
+	}
+	gzipWriter := func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }
+	zlibWriter := func(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) }
+	flateWriter := func(w io.Writer) io.WriteCloser {
+		fw, _ := flate.NewWriter(w, flate.DefaultCompression)
+		return fw
+	}
+
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+		want     []byte
+		wantErr  error
+	}{
+		{"gzip", "gzip", compress(gzipWriter, payload), payload, nil},
+		{"zlib deflate", "deflate", compress(zlibWriter, payload), payload, nil},
+		{"raw deflate", "deflate", compress(flateWriter, payload), payload, nil},
+		{"identity", "", payload, payload, nil},
+		{"limit applies to decompressed data", "gzip", compress(gzipWriter, make([]byte, maxPayloadSize+1)), nil, ErrPayloadTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Accept-Encoding") != acceptEncoding {
+					t.Errorf("unexpected Accept-Encoding %q", r.Header.Get("Accept-Encoding"))
+				}
+				w.Header().Set("Content-Type", "application/x-pki-message")
+				if tt.encoding != "" {
+					w.Header().Set("Content-Encoding", tt.encoding)
+				}
+				w.Write(tt.body)
+			}))
+			defer srv.Close()
+
+			transport, err := NewHTTPTransport(srv.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := transport.SendPost(context.Background(), SCEPRequest{Operation: pkiOperation})
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("expected %v, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(resp.Data, tt.want) {
+				t.Errorf("unexpected payload of %d bytes", len(resp.Data))
+			}
+		})
+	}
+}
+
+// closeRecorder is a response body which records whether it is closed.
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestCorruptResponseClosed(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-pki-message")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write([]byte("not gzip"))
+	}))
+	defer srv.Close()
+
+	var body *closeRecorder
+	transport, err := NewHTTPTransport(srv.URL, WithRoundTripper(func(next http.RoundTripper) http.RoundTripper {
+		return roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			resp, err := next.RoundTrip(r)
+			if err != nil {
+				return nil, err
+			}
+			body = &closeRecorder{Reader: resp.Body}
+			resp.Body = body
+			return resp, nil
+		})
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := transport.SendPost(context.Background(), SCEPRequest{Operation: pkiOperation}); err == nil {
+		t.Fatal("expected an error decoding a corrupt gzip body")
+	}
+	if body == nil || !body.closed {
+		t.Error("body of the corrupt response not closed")
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
@@ -0,0 +1,46 @@
+package scepserver
+
+import (
+	"fmt"
+	"mime"
+)
+
+const nextCAHeader = "application/x-x509-next-ca-cert"
+
+// ContentTypeError is returned by a transport validating content types
+// when the Content-Type of a response does not match the operation,
+// for example for an HTML error page sent with status 200.
+type ContentTypeError struct {
+	Operation   string
+	ContentType string
+}
+
+func (e *ContentTypeError) Error() string {
+	return fmt.Sprintf("unexpected content type %q in %s response", e.ContentType, e.Operation)
+}
+
+// CheckContentType returns a *ContentTypeError if contentType
+// is not valid for a response to the SCEP operation op.
+func CheckContentType(op, contentType string) error {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return &ContentTypeError{Operation: op, ContentType: contentType}
+	}
+	var ok bool
+	switch op {
+	case getCACaps:
+		ok = mediaType == "text/plain"
+	case getCACert:
+		ok = mediaType == leafHeader || mediaType == certChainHeader
+	case getNextCACert:
+		ok = mediaType == nextCAHeader
+	case pkiOperation:
+		ok = mediaType == pkiOpHeader
+	default:
+		ok = true
+	}
+	if !ok {
+		return &ContentTypeError{Operation: op, ContentType: contentType}
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package scepserver
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+)
+
+type correlationKey struct{}
+
+// NewCorrelationID returns a random ID for correlating the
+// requests and log lines of one enrollment.
+func NewCorrelationID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// WithCorrelationID returns a context carrying the correlation ID id.
+// The logging middleware adds it to log lines, and the HTTP transport
+// sends it in the header set with WithRequestIDHeader.
+func WithCorrelationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationKey{}, id)
+}
+
+// CorrelationID returns the correlation ID carried by ctx.
+func CorrelationID(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(correlationKey{}).(string)
+	return id, ok
+}
+
+// CorrelationMiddleware sets the correlation ID id on requests which
+// don't carry one yet, including requests made with a background
+// context, such as fetching the capabilities for Supports.
+func CorrelationMiddleware(id string) Middleware {
+	return func(next Transport) Transport {
+		return &correlationTransport{next: next, id: id}
+	}
+}
+
+type correlationTransport struct {
+	next Transport
+	id   string
+}
+
+func (t *correlationTransport) context(ctx context.Context) context.Context {
+	if _, ok := CorrelationID(ctx); ok {
+		return ctx
+	}
+	return WithCorrelationID(ctx, t.id)
+}
+
+func (t *correlationTransport) SendGet(ctx context.Context, req SCEPRequest) (SCEPResponse, error) {
+	return t.next.SendGet(t.context(ctx), req)
+}
+
+func (t *correlationTransport) SendPost(ctx context.Context, req SCEPRequest) (SCEPResponse, error) {
+	return t.next.SendPost(t.context(ctx), req)
+}
+
+func (t *correlationTransport) StreamGet(ctx context.Context, req SCEPRequest) (io.ReadCloser, SCEPResponse, error) {
+	return StreamGet(t.context(ctx), t.next, req)
+}
@@ -0,0 +1,39 @@
+package scepserver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCorrelationID(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(r.Header.Get("X-Request-ID")))
+	}))
+	defer srv.Close()
+
+	transport, err := NewHTTPTransport(srv.URL, WithRequestIDHeader("X-Request-ID"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport = CorrelationMiddleware("default")(transport)
+
+	tests := []struct {
+		ctx  context.Context
+		want string
+	}{
+		{context.Background(), "default"},
+		{WithCorrelationID(context.Background(), "enrollment"), "enrollment"},
+	}
+	for _, tt := range tests {
+		resp, err := transport.SendGet(tt.ctx, SCEPRequest{Operation: getCACaps})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(resp.Data) != tt.want {
+			t.Errorf("expected X-Request-ID %q, got %q", tt.want, resp.Data)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package scepserver
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"math/big"
+	"net/http"
+	"time"
+)
+
+// ErrUnknownCertificate is returned when revoking a certificate
+// which is not in the depot.
+var ErrUnknownCertificate = errors.New("scep: unknown certificate")
+
+// Revocations tracks revoked certificates. The Service of NewService
+// lists the certificates revoked in its depot in its CRL, if the depot
+// implements it. Implementations must be safe for concurrent use.
+type Revocations interface {
+	// Revoke marks the issued certificate with serial as revoked at
+	// time at, for reason, a CRL reason code such as 1 for keyCompromise.
+	// It fails with ErrUnknownCertificate if the depot does not hold the
+	// certificate, and does nothing if it is already revoked.
+	Revoke(serial *big.Int, reason int, at time.Time) error
+
+	// Revoked returns the revoked certificates.
+	Revoked() ([]x509.RevocationListEntry, error)
+}
+
+// CRLSigner is implemented by the Service of NewService.
+type CRLSigner interface {
+	// CRL returns a DER encoded CRL listing the certificates revoked in
+	// the depot, signed by the CA or the issuer set with WithIssuer.
+	CRL(ctx context.Context) ([]byte, error)
+}
+
+// WithCRLValidity sets how long the CRLs of the service are valid,
+// and clients may cache them, one day by default.
+func WithCRLValidity(d time.Duration) ServiceOption {
+	return func(s *service) {
+		s.crlValidity = d
+	}
+}
+
+// WithCRLDistributionPoint adds url, where the CRL of the service is
+// served with NewCRLHandler, to the certificates issued with the CA key.
+func WithCRLDistributionPoint(url string) ServiceOption {
+	return func(s *service) {
+		s.crlURL = url
+	}
+}
+
+func (s *service) CRL(ctx context.Context) ([]byte, error) {
+	var entries []x509.RevocationListEntry
+	if revocations, ok := s.depot.(Revocations); ok {
+		var err error
+		if entries, err = revocations.Revoked(); err != nil {
+			return nil, err
+		}
+	}
+	now := s.clock.Now()
+	tmpl := &x509.RevocationList{
+		Number:                    s.crlNumber(now),
+		ThisUpdate:                now,
+		NextUpdate:                now.Add(s.crlValidity),
+		RevokedCertificateEntries: entries,
+	}
+	issuer, key := s.issuing()
+	return x509.CreateRevocationList(rand.Reader, tmpl, issuer, key)
+}
+
+// crlNumber returns the number of a CRL issued at now. CRL numbers must
+// strictly increase: the Unix time of now keeps them increasing across
+// restarts, and the last number plus one within the same second.
+func (s *service) crlNumber(now time.Time) *big.Int {
+	s.crlMtx.Lock()
+	defer s.crlMtx.Unlock()
+	s.lastCRL = max(s.lastCRL+1, now.Unix())
+	return big.NewInt(s.lastCRL)
+}
+
+// NewCRLHandler serves the current CRL of crl in DER encoding,
+// on any path.
+func NewCRLHandler(crl CRLSigner) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		data, err := crl.CRL(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/pkix-crl")
+		w.Write(data)
+	})
+}
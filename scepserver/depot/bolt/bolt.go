@@ -0,0 +1,385 @@
+// Package bolt implements a scepserver.Depot, ChallengeStore and
+// Revocations in a single bbolt database file.
+package bolt
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"go.etcd.io/bbolt"
+
+	"scepclient/clock"
+	"scepclient/scepserver"
+	"scepclient/scepserver/depot"
+)
+
+var (
+	caBucket           = []byte("ca")
+	certificatesBucket = []byte("certificates")
+	challengesBucket   = []byte("challenges")
+	revocationsBucket  = []byte("revocations")
+
+	caCertKey = []byte("certificate")
+	caKeyKey  = []byte("key")
+	serialKey = []byte("serial")
+)
+
+// Depot stores the CA, the issued certificates and their revocations,
+// the next serial number and the unused challenge passwords in a bbolt
+// database.
+// It is safe for concurrent use.
+type Depot struct {
+	db           *bbolt.DB
+	challengeTTL time.Duration
+	clock        clock.Clock
+}
+
+// Option configures a Depot.
+type Option func(*Depot)
+
+// WithChallengeTTL expires challenge passwords ttl after their creation.
+// They don't expire by default.
+func WithChallengeTTL(ttl time.Duration) Option {
+	return func(d *Depot) {
+		d.challengeTTL = ttl
+	}
+}
+
+// WithClock sets the clock measuring the age of challenge passwords.
+func WithClock(c clock.Clock) Option {
+	return func(d *Depot) {
+		d.clock = c
+	}
+}
+
+// Open opens the database at path, creating it if it does not exist.
+// It fails if another process holds the database open.
+func Open(path string, opts ...Option) (*Depot, error) {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range [][]byte{caBucket, certificatesBucket, challengesBucket, revocationsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	d := &Depot{db: db, clock: clock.System}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d, nil
+}
+
+// Close closes the database.
+func (d *Depot) Close() error {
+	return d.db.Close()
+}
+
+// CA returns the stored CA certificates and key, decrypting the key
+// with pass if it is encrypted.
+func (d *Depot) CA(pass []byte) ([]*x509.Certificate, *rsa.PrivateKey, error) {
+	var certPEM, keyPEM []byte
+	d.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(caBucket)
+		certPEM = append([]byte(nil), b.Get(caCertKey)...)
+		keyPEM = append([]byte(nil), b.Get(caKeyKey)...)
+		return nil
+	})
+	if len(certPEM) == 0 || len(keyPEM) == 0 {
+		return nil, nil, errors.New("depot has no CA, create one first")
+	}
+	certs, err := depot.DecodeCertificates(certPEM)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parse CA certificate: %w", err)
+	}
+	key, err := depot.DecodeKey(keyPEM, pass)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parse CA key: %w", err)
+	}
+	return certs, key, nil
+}
+
+// PutCA stores the CA certificate chain and key, encrypting the key
+// with pass if it is not empty.
+func (d *Depot) PutCA(certs []*x509.Certificate, key *rsa.PrivateKey, pass []byte) error {
+	keyPEM, err := depot.EncodeKey(key, pass)
+	if err != nil {
+		return err
+	}
+	return d.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(caBucket)
+		if err := b.Put(caCertKey, depot.EncodeCertificates(certs...)); err != nil {
+			return err
+		}
+		return b.Put(caKeyKey, keyPEM)
+	})
+}
+
+// CreateCA generates a self-signed CA certificate and key with the
+// given subject and validity, unless the depot already holds one.
+// The key is encrypted with pass, if it is not empty.
+func (d *Depot) CreateCA(pass []byte, subject pkix.Name, validity time.Duration) error {
+	var exists bool
+	d.db.View(func(tx *bbolt.Tx) error {
+		exists = tx.Bucket(caBucket).Get(caCertKey) != nil
+		return nil
+	})
+	if exists {
+		return nil
+	}
+	crt, key, err := depot.GenerateCA(subject, validity)
+	if err != nil {
+		return err
+	}
+	return d.PutCA([]*x509.Certificate{crt}, key, pass)
+}
+
+// Serial returns the stored serial number and stores its successor.
+// The first serial number is 2, as 1 is usually taken by the CA
+// certificate.
+func (d *Depot) Serial() (*big.Int, error) {
+	serial := big.NewInt(2)
+	err := d.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(caBucket)
+		if data := b.Get(serialKey); data != nil {
+			serial.SetBytes(data)
+		}
+		return b.Put(serialKey, new(big.Int).Add(serial, big.NewInt(1)).Bytes())
+	})
+	if err != nil {
+		return nil, err
+	}
+	return serial, nil
+}
+
+// Put stores crt under name and its serial number.
+func (d *Depot) Put(name string, crt *x509.Certificate) error {
+	return d.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(certificatesBucket).Put(certificateKey(name, crt.SerialNumber), crt.Raw)
+	})
+}
+
+// Certificates returns the certificates stored under name,
+// ordered by serial number.
+func (d *Depot) Certificates(name string) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	prefix := []byte(name + "\x00")
+	err := d.db.View(func(tx *bbolt.Tx) error {
+		c := tx.Bucket(certificatesBucket).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			crt, err := x509.ParseCertificate(v)
+			if err != nil {
+				return fmt.Errorf("parse certificate %q: %w", k, err)
+			}
+			certs = append(certs, crt)
+		}
+		return nil
+	})
+	return certs, err
+}
+
+// ListCertificates returns all stored certificates,
+// ordered by name and serial number.
+func (d *Depot) ListCertificates() ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	err := d.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(certificatesBucket).ForEach(func(k, v []byte) error {
+			crt, err := x509.ParseCertificate(v)
+			if err != nil {
+				return fmt.Errorf("parse certificate %q: %w", k, err)
+			}
+			certs = append(certs, crt)
+			return nil
+		})
+	})
+	return certs, err
+}
+
+// certificateKey returns the key of the certificate with the given
+// name and serial number. The serial number is zero padded, so that
+// the keys of a name sort by serial number.
+func certificateKey(name string, serial *big.Int) []byte {
+	return []byte(fmt.Sprintf("%s\x00%040x", name, serial))
+}
+
+// PruneCertificates deletes the certificates which expired before
+// before, with their revocations.
+func (d *Depot) PruneCertificates(before time.Time) (int, error) {
+	var n int
+	err := d.db.Update(func(tx *bbolt.Tx) error {
+		var expired [][]byte
+		err := tx.Bucket(certificatesBucket).ForEach(func(k, v []byte) error {
+			crt, err := x509.ParseCertificate(v)
+			if err != nil {
+				return fmt.Errorf("parse certificate %q: %w", k, err)
+			}
+			if crt.NotAfter.Before(before) {
+				expired = append(expired, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := tx.Bucket(certificatesBucket).Delete(k); err != nil {
+				return err
+			}
+			// the revocations are keyed by the serial number
+			// the certificate key ends with
+			serial := k[bytes.LastIndexByte(k, 0)+1:]
+			if err := tx.Bucket(revocationsBucket).Delete(serial); err != nil {
+				return err
+			}
+		}
+		n = len(expired)
+		return nil
+	})
+	return n, err
+}
+
+// Revoke marks the certificate with serial as revoked.
+func (d *Depot) Revoke(serial *big.Int, reason int, at time.Time) error {
+	if err := depot.CheckReason(reason); err != nil {
+		return err
+	}
+	revoked, err := at.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	key := []byte(fmt.Sprintf("%040x", serial))
+	return d.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(revocationsBucket)
+		if b.Get(key) != nil {
+			return nil
+		}
+		// the certificates are keyed by name first
+		suffix := append([]byte("\x00"), key...)
+		var found bool
+		c := tx.Bucket(certificatesBucket).Cursor()
+		for k, _ := c.First(); k != nil && !found; k, _ = c.Next() {
+			found = bytes.HasSuffix(k, suffix)
+		}
+		if !found {
+			return fmt.Errorf("revoke %s: %w", serial.Text(16), scepserver.ErrUnknownCertificate)
+		}
+		return b.Put(key, append([]byte{byte(reason)}, revoked...))
+	})
+}
+
+// Revoked returns the revoked certificates.
+func (d *Depot) Revoked() ([]x509.RevocationListEntry, error) {
+	var entries []x509.RevocationListEntry
+	err := d.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(revocationsBucket).ForEach(func(k, v []byte) error {
+			serial, ok := new(big.Int).SetString(string(k), 16)
+			if !ok || len(v) < 1 {
+				return fmt.Errorf("invalid revocation %q", k)
+			}
+			entry := x509.RevocationListEntry{SerialNumber: serial, ReasonCode: int(v[0])}
+			if err := entry.RevocationTime.UnmarshalBinary(v[1:]); err != nil {
+				return fmt.Errorf("invalid revocation %q: %w", k, err)
+			}
+			entries = append(entries, entry)
+			return nil
+		})
+	})
+	return entries, err
+}
+
+// CreateChallenge returns a new random challenge password,
+// valid until it is used or expires. It also deletes the
+// expired challenges.
+func (d *Depot) CreateChallenge() (string, error) {
+	pw, err := scepserver.GenerateChallenge()
+	if err != nil {
+		return "", err
+	}
+	now := d.clock.Now()
+	created, err := now.MarshalBinary()
+	if err != nil {
+		return "", err
+	}
+	err = d.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(challengesBucket)
+		if _, err := d.pruneChallenges(b, now); err != nil {
+			return err
+		}
+		return b.Put([]byte(pw), created)
+	})
+	if err != nil {
+		return "", err
+	}
+	return pw, nil
+}
+
+// PruneChallenges deletes the expired challenge passwords.
+func (d *Depot) PruneChallenges() (int, error) {
+	var n int
+	err := d.db.Update(func(tx *bbolt.Tx) error {
+		var err error
+		n, err = d.pruneChallenges(tx.Bucket(challengesBucket), d.clock.Now())
+		return err
+	})
+	return n, err
+}
+
+// pruneChallenges deletes the challenges of b expired at now.
+func (d *Depot) pruneChallenges(b *bbolt.Bucket, now time.Time) (int, error) {
+	var expired [][]byte
+	b.ForEach(func(k, v []byte) error {
+		if d.expired(v, now) {
+			expired = append(expired, k)
+		}
+		return nil
+	})
+	for _, k := range expired {
+		if err := b.Delete(k); err != nil {
+			return 0, err
+		}
+	}
+	return len(expired), nil
+}
+
+// HasChallenge reports whether pw is an unused challenge password
+// created by CreateChallenge which has not expired, and deletes it.
+func (d *Depot) HasChallenge(pw string) (bool, error) {
+	var valid bool
+	err := d.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(challengesBucket)
+		created := b.Get([]byte(pw))
+		if created == nil {
+			return nil
+		}
+		valid = !d.expired(created, d.clock.Now())
+		return b.Delete([]byte(pw))
+	})
+	return valid, err
+}
+
+// expired reports whether the challenge created at the
+// encoded time created has expired.
+func (d *Depot) expired(created []byte, now time.Time) bool {
+	if d.challengeTTL <= 0 {
+		return false
+	}
+	var t time.Time
+	if err := t.UnmarshalBinary(created); err != nil {
+		return true
+	}
+	return now.Sub(t) > d.challengeTTL
+}
@@ -0,0 +1,206 @@
+package bolt
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"scepclient/clock"
+	"scepclient/scepserver"
+)
+
+func openDepot(t *testing.T, opts ...Option) *Depot {
+	depot, err := Open(filepath.Join(t.TempDir(), "depot.db"), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { depot.Close() })
+	return depot
+}
+
+func TestCA(t *testing.T) {
+	depot := openDepot(t)
+	if _, _, err := depot.CA(nil); err == nil {
+		t.Error("expected an error without a CA")
+	}
+	if err := depot.CreateCA([]byte("secret"), pkix.Name{CommonName: "test CA"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	certs, key, err := depot.CA([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 1 || certs[0].Subject.CommonName != "test CA" {
+		t.Fatalf("unexpected CA certificates %v", certs)
+	}
+	if err := key.Validate(); err != nil {
+		t.Error(err)
+	}
+	if err := depot.CreateCA(nil, pkix.Name{CommonName: "other CA"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	again, _, err := depot.CA([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !again[0].Equal(certs[0]) {
+		t.Error("expected CreateCA to keep the existing CA")
+	}
+}
+
+func TestSerial(t *testing.T) {
+	depot := openDepot(t)
+	for want := int64(2); want < 5; want++ {
+		serial, err := depot.Serial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if serial.Int64() != want {
+			t.Errorf("expected serial %d, got %s", want, serial)
+		}
+	}
+}
+
+func TestCertificates(t *testing.T) {
+	depot := openDepot(t)
+	if err := depot.CreateCA(nil, pkix.Name{CommonName: "test CA"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	caCerts, _, err := depot.CA(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Put only stores the raw certificate under its serial number,
+	// so the CA certificate can stand in for issued ones
+	crt := *caCerts[0]
+	for _, serial := range []int64{0x100, 0x2} {
+		crt.SerialNumber = big.NewInt(serial)
+		if err := depot.Put("device", &crt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := depot.Put("device2", &crt); err != nil {
+		t.Fatal(err)
+	}
+	certs, err := depot.Certificates("device")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 2 {
+		t.Errorf("expected 2 certificates, got %d", len(certs))
+	}
+	var _ scepserver.CertificateLister = depot
+	if certs, err = depot.ListCertificates(); err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 3 {
+		t.Errorf("expected 3 certificates in total, got %d", len(certs))
+	}
+	if key := string(certificateKey("device", big.NewInt(0x2))); key >= string(certificateKey("device", big.NewInt(0x100))) {
+		t.Error("expected certificate keys to sort by serial number")
+	}
+}
+
+func TestChallenges(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	depot := openDepot(t, WithChallengeTTL(time.Hour), WithClock(clk))
+	pw, err := depot.CreateChallenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []bool{true, false} {
+		ok, err := depot.HasChallenge(pw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != want {
+			t.Errorf("use %d: expected HasChallenge to return %v", i+1, want)
+		}
+	}
+	if ok, _ := depot.HasChallenge("unknown"); ok {
+		t.Error("expected an unknown challenge to be rejected")
+	}
+
+	pw, err = depot.CreateChallenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clk.Advance(time.Hour + time.Second)
+	if ok, _ := depot.HasChallenge(pw); ok {
+		t.Error("expected an expired challenge to be rejected")
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	depot := openDepot(t)
+	crt := &x509.Certificate{Raw: []byte("certificate"), SerialNumber: big.NewInt(0x2a)}
+	if err := depot.Put("device", crt); err != nil {
+		t.Fatal(err)
+	}
+	at := time.Date(2025, 6, 7, 8, 9, 10, 0, time.UTC)
+	if err := depot.Revoke(big.NewInt(0x2a), 1, at); err != nil {
+		t.Fatal(err)
+	}
+	// revoking again keeps the first revocation
+	if err := depot.Revoke(big.NewInt(0x2a), 4, at.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := depot.Revoke(big.NewInt(0x2b), 0, at); !errors.Is(err, scepserver.ErrUnknownCertificate) {
+		t.Errorf("expected ErrUnknownCertificate, got %v", err)
+	}
+	revoked, err := depot.Revoked()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revoked) != 1 || revoked[0].SerialNumber.Int64() != 0x2a ||
+		!revoked[0].RevocationTime.Equal(at) || revoked[0].ReasonCode != 1 {
+		t.Errorf("unexpected revocations %+v", revoked)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	depot := openDepot(t, WithChallengeTTL(time.Hour), WithClock(clk))
+	var _ scepserver.CertificatePruner = depot
+	var _ scepserver.ChallengePruner = depot
+	if err := depot.CreateCA(nil, pkix.Name{CommonName: "test CA"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	caCerts, _, err := depot.CA(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crt := *caCerts[0]
+	crt.SerialNumber = big.NewInt(0x2a)
+	if err := depot.Put("device", &crt); err != nil {
+		t.Fatal(err)
+	}
+	if err := depot.Revoke(crt.SerialNumber, 1, clk.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := depot.PruneCertificates(crt.NotAfter); err != nil || n != 0 {
+		t.Errorf("expected no valid certificate to be pruned, got %d, %v", n, err)
+	}
+	if n, err := depot.PruneCertificates(crt.NotAfter.Add(time.Second)); err != nil || n != 1 {
+		t.Errorf("expected 1 pruned certificate, got %d, %v", n, err)
+	}
+	if certs, _ := depot.Certificates("device"); len(certs) != 0 {
+		t.Errorf("expected the expired certificate to be deleted, got %d certificates", len(certs))
+	}
+	if revoked, _ := depot.Revoked(); len(revoked) != 0 {
+		t.Errorf("expected its revocation to be deleted, got %+v", revoked)
+	}
+
+	if _, err := depot.CreateChallenge(); err != nil {
+		t.Fatal(err)
+	}
+	clk.Advance(time.Hour + time.Second)
+	if n, err := depot.PruneChallenges(); err != nil || n != 1 {
+		t.Errorf("expected 1 pruned challenge, got %d, %v", n, err)
+	}
+}
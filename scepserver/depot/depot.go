@@ -0,0 +1,126 @@
+// Package depot contains helpers shared by the scepserver.Depot
+// implementations in its subpackages.
+package depot
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// GenerateCA creates a self-signed CA certificate with serial number 1
+// and a new 4096 bit RSA key.
+func GenerateCA(subject pkix.Name, validity time.Duration) (*x509.Certificate, *rsa.PrivateKey, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 4096)
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               subject,
+		NotBefore:             now.Add(-10 * time.Minute),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	crt, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	return crt, key, nil
+}
+
+// EncodeCertificates returns certs as concatenated PEM blocks.
+func EncodeCertificates(certs ...*x509.Certificate) []byte {
+	var data []byte
+	for _, crt := range certs {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: crt.Raw})...)
+	}
+	return data
+}
+
+// DecodeCertificates parses the PEM encoded certificates in data,
+// skipping blocks of other types.
+func DecodeCertificates(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		crt, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, crt)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no certificate found")
+	}
+	return certs, nil
+}
+
+// EncodeKey returns key as a PEM block, encrypted with pass unless
+// it is empty.
+func EncodeKey(key *rsa.PrivateKey, pass []byte) ([]byte, error) {
+	block := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	if len(pass) > 0 {
+		var err error
+		//nolint:staticcheck // legacy PEM encryption is what OpenSSL's rsa -aes256 writes
+		block, err = x509.EncryptPEMBlock(rand.Reader, block.Type, block.Bytes, pass, x509.PEMCipherAES256)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return pem.EncodeToMemory(block), nil
+}
+
+// DecodeKey parses a PEM encoded PKCS #1 or PKCS #8 RSA key,
+// decrypting it with pass if it is encrypted.
+func DecodeKey(data, pass []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	der := block.Bytes
+	//nolint:staticcheck // see EncodeKey
+	if x509.IsEncryptedPEMBlock(block) {
+		var err error
+		der, err = x509.DecryptPEMBlock(block, pass)
+		if err != nil {
+			return nil, fmt.Errorf("decrypt key: %w", err)
+		}
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("CA key is not an RSA key")
+	}
+	return rsaKey, nil
+}
+
+// CheckReason returns an error if reason is not a CRL reason code
+// of RFC 5280, section 5.3.1.
+func CheckReason(reason int) error {
+	if reason < 0 || reason > 10 || reason == 7 {
+		return fmt.Errorf("invalid CRL reason code %d", reason)
+	}
+	return nil
+}
@@ -0,0 +1,595 @@
+// Package file implements a scepserver.Depot and scepserver.Revocations
+// storing the CA credentials and the issued certificates as PEM files
+// in a directory.
+//
+// The directory holds:
+//
+//	ca.pem      the CA certificate, followed by any intermediates
+//	ca.key      the CA private key, optionally encrypted
+//	serial      the next serial number, in hexadecimal
+//	serial.lock held while allocating a serial number
+//	index.txt   one line per issued certificate, in the format of
+//	            the OpenSSL CA index, which also records revocations
+//	index.lock  held while modifying the index
+//	<name>.<serial>.pem  the issued certificates
+//	transactions/<hash>  the serial number of the certificate issued in
+//	            the SCEP transaction whose ID has the SHA-256 hash <hash>
+//	transactions/<hash>.lock  held while processing the transaction
+package file
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"scepclient/scepserver"
+	"scepclient/scepserver/depot"
+)
+
+// Depot is a file based depot. It is safe for concurrent use, also by
+// several processes sharing the directory, for example over NFS, which
+// allocate serial numbers, modify the index and lock transactions with
+// exclusively created lock files.
+type Depot struct {
+	dir string
+	mtx sync.Mutex
+}
+
+// New returns a depot storing its files in dir, which is
+// created if it does not exist.
+func New(dir string) (*Depot, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Depot{dir: dir}, nil
+}
+
+func (d *Depot) path(name string) string {
+	return filepath.Join(d.dir, name)
+}
+
+// CA returns the CA certificates of ca.pem and the key of ca.key,
+// decrypting it with pass if it is encrypted.
+func (d *Depot) CA(pass []byte) ([]*x509.Certificate, *rsa.PrivateKey, error) {
+	certPEM, err := ioutil.ReadFile(d.path("ca.pem"))
+	if err != nil {
+		return nil, nil, err
+	}
+	certs, err := depot.DecodeCertificates(certPEM)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parse ca.pem: %w", err)
+	}
+	keyPEM, err := ioutil.ReadFile(d.path("ca.key"))
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := depot.DecodeKey(keyPEM, pass)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parse ca.key: %w", err)
+	}
+	return certs, key, nil
+}
+
+// Serial returns the serial number stored in the serial file,
+// and stores its successor. Without a serial file, it starts at 2,
+// as 1 is usually taken by the CA certificate.
+func (d *Depot) Serial() (*big.Int, error) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	unlock, err := d.lock("serial.lock")
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	serial := big.NewInt(2)
+	data, err := ioutil.ReadFile(d.path("serial"))
+	switch {
+	case err == nil:
+		if _, ok := serial.SetString(strings.TrimSpace(string(data)), 16); !ok {
+			return nil, fmt.Errorf("invalid serial file %q", data)
+		}
+	case !os.IsNotExist(err):
+		return nil, err
+	}
+	next := new(big.Int).Add(serial, big.NewInt(1))
+	if err := writeFile(d.path("serial"), []byte(next.Text(16)+"\n"), 0644); err != nil {
+		return nil, err
+	}
+	return serial, nil
+}
+
+const (
+	// lockTimeout is how long to wait for a lock file.
+	lockTimeout = 10 * time.Second
+
+	// staleLock is the age of lock files left behind by crashed
+	// processes. Locks are held for milliseconds.
+	staleLock = time.Minute
+)
+
+// lock creates the lock file name, waiting while another process
+// holds it, and returns a function removing it.
+func (d *Depot) lock(name string) (func(), error) {
+	path := d.path(name)
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(path) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > staleLock {
+			os.Remove(path)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timeout waiting for %s", path)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+var unsafeChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// Put writes crt to <name>.<serial>.pem and adds it to the index.
+func (d *Depot) Put(name string, crt *x509.Certificate) error {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	name = unsafeChars.ReplaceAllString(name, "_")
+	if name == "" {
+		name = "certificate"
+	}
+	filename := fmt.Sprintf("%s.%s.pem", name, crt.SerialNumber.Text(16))
+	if err := writeFile(d.path(filename), depot.EncodeCertificates(crt), 0644); err != nil {
+		return err
+	}
+
+	unlock, err := d.lock("index.lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	f, err := os.OpenFile(d.path("index.txt"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = fmt.Fprintf(f, "V\t%s\t\t%s\tunknown\t%s\n",
+		crt.NotAfter.UTC().Format(indexTime),
+		strings.ToUpper(crt.SerialNumber.Text(16)),
+		opensslSubject(crt.Subject))
+	return err
+}
+
+// indexTime is the format of the times in the index.
+const indexTime = "060102150405Z"
+
+// reasons are the names of the CRL reason codes in the index.
+var reasons = []string{
+	0:  "unspecified",
+	1:  "keyCompromise",
+	2:  "CACompromise",
+	3:  "affiliationChanged",
+	4:  "superseded",
+	5:  "cessationOfOperation",
+	6:  "certificateHold",
+	8:  "removeFromCRL",
+	9:  "privilegeWithdrawn",
+	10: "AACompromise",
+}
+
+// Revoke marks the certificate with serial as revoked in the index.
+func (d *Depot) Revoke(serial *big.Int, reason int, at time.Time) error {
+	if err := depot.CheckReason(reason); err != nil {
+		return err
+	}
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	unlock, err := d.lock("index.lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	data, err := ioutil.ReadFile(d.path("index.txt"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	lines := strings.SplitAfter(string(data), "\n")
+	for i, line := range lines {
+		fields := strings.Split(strings.TrimSuffix(line, "\n"), "\t")
+		if len(fields) != 6 {
+			continue
+		}
+		if n, ok := new(big.Int).SetString(fields[3], 16); !ok || n.Cmp(serial) != 0 {
+			continue
+		}
+		if fields[0] == "R" {
+			return nil
+		}
+		fields[0] = "R"
+		fields[2] = at.UTC().Format(indexTime)
+		if reason != 0 {
+			fields[2] += "," + reasons[reason]
+		}
+		lines[i] = strings.Join(fields, "\t") + "\n"
+		return writeFile(d.path("index.txt"), []byte(strings.Join(lines, "")), 0644)
+	}
+	return fmt.Errorf("revoke %s: %w", serial.Text(16), scepserver.ErrUnknownCertificate)
+}
+
+// PruneCertificates deletes the certificate files, their lines in the
+// index and their transactions, of the certificates which expired
+// before before.
+func (d *Depot) PruneCertificates(before time.Time) (int, error) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	unlock, err := d.lock("index.lock")
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+	data, err := ioutil.ReadFile(d.path("index.txt"))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	entries, err := os.ReadDir(d.dir)
+	if err != nil {
+		return 0, err
+	}
+	var (
+		kept   []string
+		n      int
+		pruned = make(map[string]bool)
+	)
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		fields := strings.Split(strings.TrimSuffix(line, "\n"), "\t")
+		if len(fields) != 6 {
+			kept = append(kept, line)
+			continue
+		}
+		notAfter, err := time.Parse(indexTime, fields[1])
+		if err != nil || !notAfter.Before(before) {
+			kept = append(kept, line)
+			continue
+		}
+		serial := strings.ToLower(fields[3])
+		for _, name := range certificateFiles(entries, serial) {
+			if err := os.Remove(d.path(name)); err != nil && !os.IsNotExist(err) {
+				return n, err
+			}
+		}
+		pruned[serial] = true
+		n++
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	if err := writeFile(d.path("index.txt"), []byte(strings.Join(kept, "")), 0644); err != nil {
+		return n, err
+	}
+	return n, d.pruneTransactions(pruned)
+}
+
+// pruneTransactions deletes the transactions
+// of the certificates with the pruned serials.
+func (d *Depot) pruneTransactions(pruned map[string]bool) error {
+	entries, err := os.ReadDir(d.path("transactions"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".lock") {
+			continue
+		}
+		path := filepath.Join(d.path("transactions"), entry.Name())
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if pruned[strings.TrimSpace(string(data))] {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// certificateFiles returns the names of the certificate files of
+// the serial number serial, in lower case hexadecimal, in entries.
+func certificateFiles(entries []os.DirEntry, serial string) []string {
+	var names []string
+	suffix := "." + serial + ".pem"
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), suffix) {
+			names = append(names, entry.Name())
+		}
+	}
+	return names
+}
+
+// transactionPath returns the path of the file recording the
+// transaction id, which is named by its hash, as transaction IDs
+// may hold any characters.
+func (d *Depot) transactionPath(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return filepath.Join(d.path("transactions"), hex.EncodeToString(sum[:]))
+}
+
+// LockTransaction creates the lock file of the transaction id, holding
+// the end of lease, and returns the certificate recorded for it, if any.
+// Expired lock files of crashed processes are removed.
+func (d *Depot) LockTransaction(id string, lease time.Duration) (*x509.Certificate, error) {
+	if err := os.MkdirAll(d.path("transactions"), 0755); err != nil {
+		return nil, err
+	}
+	path := d.transactionPath(id)
+	for removed := false; ; removed = true {
+		f, err := os.OpenFile(path+".lock", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			_, err = f.WriteString(time.Now().Add(lease).Format(time.RFC3339Nano))
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				os.Remove(path + ".lock")
+				return nil, err
+			}
+			break
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if removed || !lockExpired(path+".lock") {
+			return nil, scepserver.ErrTransactionInProgress
+		}
+		os.Remove(path + ".lock")
+	}
+	crt, err := d.transactionCertificate(path)
+	if err != nil {
+		os.Remove(path + ".lock")
+		return nil, err
+	}
+	return crt, nil
+}
+
+// lockExpired reports whether the lease of the transaction lock file
+// path has ended. A lock file without lease, which a process crashed
+// while creating, expires like a stale lock.
+func lockExpired(path string) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	until, err := time.Parse(time.RFC3339Nano, string(data))
+	if err != nil {
+		return time.Since(info.ModTime()) > staleLock
+	}
+	return time.Now().After(until)
+}
+
+// transactionCertificate returns the certificate recorded in the
+// transaction file path, or nil if there is none.
+func (d *Depot) transactionCertificate(path string) (*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(d.dir)
+	if err != nil {
+		return nil, err
+	}
+	names := certificateFiles(entries, strings.TrimSpace(string(data)))
+	if len(names) == 0 {
+		// pruned
+		return nil, nil
+	}
+	certPEM, err := ioutil.ReadFile(d.path(names[0]))
+	if err != nil {
+		return nil, err
+	}
+	certs, err := depot.DecodeCertificates(certPEM)
+	if err != nil {
+		return nil, fmt.Errorf("parse certificate %s: %w", names[0], err)
+	}
+	return certs[0], nil
+}
+
+// UnlockTransaction records the serial number of crt in the file of
+// the transaction id, unless crt is nil, and removes its lock file.
+func (d *Depot) UnlockTransaction(id string, crt *x509.Certificate) error {
+	path := d.transactionPath(id)
+	if crt != nil {
+		if err := writeFile(path, []byte(crt.SerialNumber.Text(16)+"\n"), 0644); err != nil {
+			return err
+		}
+	}
+	err := os.Remove(path + ".lock")
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Revoked returns the certificates marked as revoked in the index.
+func (d *Depot) Revoked() ([]x509.RevocationListEntry, error) {
+	d.mtx.Lock()
+	data, err := ioutil.ReadFile(d.path("index.txt"))
+	d.mtx.Unlock()
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []x509.RevocationListEntry
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 6 || fields[0] != "R" {
+			continue
+		}
+		entry, err := parseRevocation(fields[2], fields[3])
+		if err != nil {
+			return nil, fmt.Errorf("parse index line %q: %w", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// ListCertificates returns the certificates of the index, read from
+// their certificate files, in the order they were issued.
+func (d *Depot) ListCertificates() ([]*x509.Certificate, error) {
+	d.mtx.Lock()
+	data, err := ioutil.ReadFile(d.path("index.txt"))
+	d.mtx.Unlock()
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(d.dir)
+	if err != nil {
+		return nil, err
+	}
+	var certs []*x509.Certificate
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 6 {
+			continue
+		}
+		names := certificateFiles(entries, strings.ToLower(fields[3]))
+		if len(names) == 0 {
+			// pruned by another process since the index was read
+			continue
+		}
+		certPEM, err := ioutil.ReadFile(d.path(names[0]))
+		if err != nil {
+			return nil, err
+		}
+		crts, err := depot.DecodeCertificates(certPEM)
+		if err != nil {
+			return nil, fmt.Errorf("parse certificate %s: %w", names[0], err)
+		}
+		certs = append(certs, crts[0])
+	}
+	return certs, nil
+}
+
+// parseRevocation parses the revocation date, reason and
+// serial number of a revoked certificate in the index.
+func parseRevocation(revocation, serial string) (x509.RevocationListEntry, error) {
+	var entry x509.RevocationListEntry
+	date, reason, _ := strings.Cut(revocation, ",")
+	at, err := time.Parse(indexTime, date)
+	if err != nil {
+		return entry, err
+	}
+	entry.RevocationTime = at
+	if reason != "" {
+		entry.ReasonCode = -1
+		for code, name := range reasons {
+			if name != "" && name == reason {
+				entry.ReasonCode = code
+			}
+		}
+		if entry.ReasonCode < 0 {
+			return entry, fmt.Errorf("unknown revocation reason %q", reason)
+		}
+	}
+	var ok bool
+	if entry.SerialNumber, ok = new(big.Int).SetString(serial, 16); !ok {
+		return entry, errors.New("invalid serial number")
+	}
+	return entry, nil
+}
+
+// opensslSubject formats name like OpenSSL does in its index,
+// as /C=US/O=Example/CN=name.
+func opensslSubject(name pkix.Name) string {
+	var buf bytes.Buffer
+	for _, rdn := range name.ToRDNSequence() {
+		for _, atv := range rdn {
+			key := atv.Type.String()
+			switch {
+			case atv.Type.Equal([]int{2, 5, 4, 3}):
+				key = "CN"
+			case atv.Type.Equal([]int{2, 5, 4, 6}):
+				key = "C"
+			case atv.Type.Equal([]int{2, 5, 4, 7}):
+				key = "L"
+			case atv.Type.Equal([]int{2, 5, 4, 8}):
+				key = "ST"
+			case atv.Type.Equal([]int{2, 5, 4, 10}):
+				key = "O"
+			case atv.Type.Equal([]int{2, 5, 4, 11}):
+				key = "OU"
+			}
+			fmt.Fprintf(&buf, "/%s=%v", key, atv.Value)
+		}
+	}
+	return buf.String()
+}
+
+// CreateCA generates a self-signed CA certificate and key with the
+// given subject and validity, unless the depot already holds one.
+// The key is encrypted with pass, if it is not empty.
+func (d *Depot) CreateCA(pass []byte, subject pkix.Name, validity time.Duration) error {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if _, err := os.Stat(d.path("ca.pem")); err == nil {
+		return nil
+	}
+	crt, key, err := depot.GenerateCA(subject, validity)
+	if err != nil {
+		return err
+	}
+	keyPEM, err := depot.EncodeKey(key, pass)
+	if err != nil {
+		return err
+	}
+	if err := writeFile(d.path("ca.key"), keyPEM, 0600); err != nil {
+		return err
+	}
+	return writeFile(d.path("ca.pem"), depot.EncodeCertificates(crt), 0644)
+}
+
+// writeFile writes data to a temporary file renamed to path,
+// so that readers never see a partially written file.
+func writeFile(path string, data []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
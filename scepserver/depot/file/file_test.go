@@ -0,0 +1,377 @@
+package file
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"scepclient/scepserver"
+)
+
+func TestCreateCA(t *testing.T) {
+	depot, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject := pkix.Name{CommonName: "test CA", Organization: []string{"scepclient"}}
+	if err := depot.CreateCA([]byte("secret"), subject, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	certs, key, err := depot.CA([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 1 || certs[0].Subject.CommonName != "test CA" || !certs[0].IsCA {
+		t.Fatalf("unexpected CA certificates %v", certs)
+	}
+	if err := key.Validate(); err != nil {
+		t.Error(err)
+	}
+	if _, _, err := depot.CA([]byte("wrong")); err == nil {
+		t.Error("expected an error decrypting the key with the wrong password")
+	}
+
+	// an existing CA is kept
+	if err := depot.CreateCA(nil, pkix.Name{CommonName: "other CA"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	again, _, err := depot.CA([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !again[0].Equal(certs[0]) {
+		t.Error("expected CreateCA to keep the existing CA")
+	}
+}
+
+func TestSerial(t *testing.T) {
+	depot, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for want := int64(2); want < 5; want++ {
+		serial, err := depot.Serial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if serial.Int64() != want {
+			t.Errorf("expected serial %d, got %s", want, serial)
+		}
+	}
+}
+
+func TestSerialShared(t *testing.T) {
+	// depots sharing a directory stand in for separate processes
+	dir := t.TempDir()
+	var (
+		mtx     sync.Mutex
+		serials = make(map[string]bool)
+		wg      sync.WaitGroup
+	)
+	for i := 0; i < 4; i++ {
+		depot, err := New(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				serial, err := depot.Serial()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				mtx.Lock()
+				if serials[serial.String()] {
+					t.Errorf("serial %s allocated twice", serial)
+				}
+				serials[serial.String()] = true
+				mtx.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// a lock left behind by a crashed process is broken
+	lock := filepath.Join(dir, "serial.lock")
+	if err := ioutil.WriteFile(lock, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * staleLock)
+	if err := os.Chtimes(lock, old, old); err != nil {
+		t.Fatal(err)
+	}
+	depot, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serial, err := depot.Serial(); err != nil || serial.Int64() != 102 {
+		t.Errorf("expected serial 102 after breaking the stale lock, got %v, %v", serial, err)
+	}
+}
+
+func TestPut(t *testing.T) {
+	dir := t.TempDir()
+	depot, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crt := &x509.Certificate{
+		Raw:          []byte("certificate"),
+		SerialNumber: big.NewInt(0x2a),
+		Subject:      pkix.Name{CommonName: "../device 1", Country: []string{"US"}},
+		NotAfter:     time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+	if err := depot.Put(crt.Subject.CommonName, crt); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadFile(filepath.Join(dir, ".._device_1.2a.pem")); err != nil {
+		t.Error(err)
+	}
+	index, err := ioutil.ReadFile(filepath.Join(dir, "index.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "V\t300102030405Z\t\t2A\tunknown\t/C=US/CN=../device 1\n"
+	if string(index) != want {
+		t.Errorf("expected index %q, got %q", want, index)
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	dir := t.TempDir()
+	depot, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, serial := range []int64{0x2a, 0x2b} {
+		crt := &x509.Certificate{
+			Raw:          []byte("certificate"),
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: "device"},
+			NotAfter:     time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC),
+		}
+		if err := depot.Put("device", crt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	at := time.Date(2025, 6, 7, 8, 9, 10, 0, time.UTC)
+	if err := depot.Revoke(big.NewInt(0x2b), 1, at); err != nil {
+		t.Fatal(err)
+	}
+	// revoking again keeps the first revocation
+	if err := depot.Revoke(big.NewInt(0x2b), 4, at.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := depot.Revoke(big.NewInt(0x2c), 0, at); !errors.Is(err, scepserver.ErrUnknownCertificate) {
+		t.Errorf("expected ErrUnknownCertificate, got %v", err)
+	}
+
+	index, err := ioutil.ReadFile(filepath.Join(dir, "index.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "V\t300102030405Z\t\t2A\tunknown\t/CN=device\n" +
+		"R\t300102030405Z\t250607080910Z,keyCompromise\t2B\tunknown\t/CN=device\n"
+	if string(index) != want {
+		t.Errorf("expected index %q, got %q", want, index)
+	}
+	revoked, err := depot.Revoked()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revoked) != 1 || revoked[0].SerialNumber.Int64() != 0x2b ||
+		!revoked[0].RevocationTime.Equal(at) || revoked[0].ReasonCode != 1 {
+		t.Errorf("unexpected revocations %+v", revoked)
+	}
+}
+
+func TestPruneCertificates(t *testing.T) {
+	dir := t.TempDir()
+	depot, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var _ scepserver.CertificatePruner = depot
+	for serial, notAfter := range map[int64]time.Time{
+		0x2a: time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC),
+		0x2b: time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC),
+	} {
+		crt := &x509.Certificate{
+			Raw:          []byte("certificate"),
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: "device"},
+			NotAfter:     notAfter,
+		}
+		if err := depot.Put("device", crt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n, err := depot.PruneCertificates(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("expected 1 pruned certificate, got %d", n)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "device.2a.pem")); !os.IsNotExist(err) {
+		t.Errorf("expected the expired certificate file to be deleted, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "device.2b.pem")); err != nil {
+		t.Errorf("expected the valid certificate file to be kept: %v", err)
+	}
+	index, err := ioutil.ReadFile(filepath.Join(dir, "index.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "V\t300102030405Z\t\t2B\tunknown\t/CN=device\n"
+	if string(index) != want {
+		t.Errorf("expected index %q, got %q", want, index)
+	}
+}
+
+func TestListCertificates(t *testing.T) {
+	depot, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var _ scepserver.CertificateLister = depot
+	if certs, err := depot.ListCertificates(); err != nil || len(certs) != 0 {
+		t.Fatalf("expected no certificates in a new depot, got %v, %v", certs, err)
+	}
+	if err := depot.CreateCA(nil, pkix.Name{CommonName: "test CA"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	caCerts, _, err := depot.CA(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the CA certificate stands in for issued ones
+	for _, serial := range []int64{0x2a, 0x2b} {
+		crt := *caCerts[0]
+		crt.SerialNumber = big.NewInt(serial)
+		if err := depot.Put("device", &crt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	certs, err := depot.ListCertificates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the certificate files hold the raw certificate
+	if len(certs) != 2 || !certs[0].Equal(caCerts[0]) {
+		t.Errorf("expected the 2 issued certificates, got %v", certs)
+	}
+}
+
+func TestPutShared(t *testing.T) {
+	// depots sharing a directory stand in for separate processes
+	dir := t.TempDir()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		depot, err := New(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				crt := &x509.Certificate{
+					Raw:          []byte("certificate"),
+					SerialNumber: big.NewInt(int64(i*10 + j + 2)),
+					NotAfter:     time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC),
+				}
+				if err := depot.Put("device", crt); err != nil {
+					t.Error(err)
+					return
+				}
+				if j%2 == 0 {
+					if err := depot.Revoke(crt.SerialNumber, 0, time.Now()); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	depot, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked, err := depot.Revoked()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revoked) != 20 {
+		t.Errorf("expected 20 revocations, got %d", len(revoked))
+	}
+}
+
+func TestTransactions(t *testing.T) {
+	dir := t.TempDir()
+	// depots sharing a directory stand in for separate processes
+	var depots []*Depot
+	for i := 0; i < 2; i++ {
+		depot, err := New(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		depots = append(depots, depot)
+	}
+	var _ scepserver.TransactionLocker = depots[0]
+	if err := depots[0].CreateCA(nil, pkix.Name{CommonName: "test CA"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	caCerts, _, err := depots[0].CA(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the CA certificate stands in for an issued one
+	crt := caCerts[0]
+
+	if issued, err := depots[0].LockTransaction("tx/1", time.Minute); err != nil || issued != nil {
+		t.Fatalf("expected to lock a new transaction, got %v, %v", issued, err)
+	}
+	if _, err := depots[1].LockTransaction("tx/1", time.Minute); !errors.Is(err, scepserver.ErrTransactionInProgress) {
+		t.Errorf("expected ErrTransactionInProgress, got %v", err)
+	}
+	if err := depots[0].Put("device", crt); err != nil {
+		t.Fatal(err)
+	}
+	if err := depots[0].UnlockTransaction("tx/1", crt); err != nil {
+		t.Fatal(err)
+	}
+	issued, err := depots[1].LockTransaction("tx/1", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if issued == nil || !issued.Equal(crt) {
+		t.Errorf("expected the certificate issued in the transaction, got %v", issued)
+	}
+
+	// the lock of a crashed process expires
+	if _, err := depots[0].LockTransaction("tx/2", -time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := depots[1].LockTransaction("tx/2", time.Minute); err != nil {
+		t.Errorf("expected the expired lock to be taken over, got %v", err)
+	}
+
+	// pruning the certificate forgets the transaction
+	if _, err := depots[0].PruneCertificates(crt.NotAfter.Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(depots[0].transactionPath("tx/1")); !os.IsNotExist(err) {
+		t.Errorf("expected the transaction to be deleted, got %v", err)
+	}
+}
@@ -0,0 +1,586 @@
+// Package sql implements a scepserver.Depot, ChallengeStore, Revocations,
+// TransactionLocker and Auditor in a PostgreSQL, MySQL or SQLite database,
+// so that several server instances can share the CA, the issued
+// certificates and their revocations, the serial number sequence, the
+// challenge passwords, the SCEP transactions and the audit log.
+//
+// The package does not import any driver: register one, for example
+// github.com/lib/pq or github.com/go-sql-driver/mysql, in the program
+// using it.
+package sql
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	"scepclient/clock"
+	"scepclient/scepserver"
+	"scepclient/scepserver/depot"
+)
+
+// Dialect is the SQL dialect of a database.
+type Dialect int
+
+// Supported dialects.
+const (
+	Postgres Dialect = iota
+	MySQL
+	SQLite
+)
+
+// DialectOf returns the dialect of the databases of the
+// registered driver named driverName.
+func DialectOf(driverName string) (Dialect, error) {
+	switch driverName {
+	case "postgres", "pgx":
+		return Postgres, nil
+	case "mysql":
+		return MySQL, nil
+	case "sqlite", "sqlite3":
+		return SQLite, nil
+	}
+	return 0, fmt.Errorf("unsupported database driver %q", driverName)
+}
+
+// blob returns the column type of binary data.
+func (d Dialect) blob() string {
+	switch d {
+	case Postgres:
+		return "BYTEA"
+	case MySQL:
+		return "LONGBLOB"
+	default:
+		return "BLOB"
+	}
+}
+
+// autoID returns the column definition of an auto-incremented
+// primary key.
+func (d Dialect) autoID() string {
+	switch d {
+	case Postgres:
+		return "BIGSERIAL PRIMARY KEY"
+	case MySQL:
+		return "BIGINT AUTO_INCREMENT PRIMARY KEY"
+	default:
+		return "INTEGER PRIMARY KEY AUTOINCREMENT"
+	}
+}
+
+// rebind replaces the ? placeholders of query with the
+// numbered placeholders of PostgreSQL.
+func (d Dialect) rebind(query string) string {
+	if d != Postgres {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// migrations create and update the schema. They are applied in order,
+// and the number of applied migrations is recorded in
+// scep_schema_migrations. Only append to this list.
+var migrations = []func(d Dialect) string{
+	func(d Dialect) string {
+		return `CREATE TABLE scep_ca (
+			id INTEGER PRIMARY KEY,
+			certificates TEXT NOT NULL,
+			private_key TEXT NOT NULL
+		)`
+	},
+	func(d Dialect) string {
+		return `CREATE TABLE scep_serial (
+			id INTEGER PRIMARY KEY,
+			next_serial BIGINT NOT NULL
+		)`
+	},
+	func(d Dialect) string {
+		return `INSERT INTO scep_serial (id, next_serial) VALUES (1, 2)`
+	},
+	func(d Dialect) string {
+		return `CREATE TABLE scep_certificates (
+			serial VARCHAR(64) PRIMARY KEY,
+			name VARCHAR(255) NOT NULL,
+			not_after BIGINT NOT NULL,
+			certificate ` + d.blob() + ` NOT NULL
+		)`
+	},
+	func(d Dialect) string {
+		return `CREATE INDEX scep_certificates_name ON scep_certificates (name)`
+	},
+	func(d Dialect) string {
+		return `CREATE TABLE scep_challenges (
+			challenge VARCHAR(64) PRIMARY KEY,
+			created_at BIGINT NOT NULL
+		)`
+	},
+	func(d Dialect) string {
+		return `CREATE TABLE scep_audit (
+			id ` + d.autoID() + `,
+			time BIGINT NOT NULL,
+			outcome VARCHAR(16) NOT NULL,
+			transaction_id VARCHAR(255) NOT NULL,
+			requester VARCHAR(255) NOT NULL,
+			subject TEXT NOT NULL,
+			serial VARCHAR(64) NOT NULL,
+			event TEXT NOT NULL
+		)`
+	},
+	func(d Dialect) string {
+		return `CREATE TABLE scep_revocations (
+			serial VARCHAR(64) PRIMARY KEY,
+			revoked_at BIGINT NOT NULL,
+			reason INTEGER NOT NULL
+		)`
+	},
+	func(d Dialect) string {
+		return `CREATE TABLE scep_transactions (
+			transaction_id VARCHAR(255) PRIMARY KEY,
+			locked_until BIGINT NOT NULL,
+			serial VARCHAR(64) NOT NULL
+		)`
+	},
+}
+
+// Depot stores the CA credentials and issued certificates in
+// a database. It is safe for concurrent use, also by several
+// processes sharing the database.
+type Depot struct {
+	db           *sql.DB
+	dialect      Dialect
+	challengeTTL time.Duration
+	clock        clock.Clock
+}
+
+// Option configures a Depot.
+type Option func(*Depot)
+
+// WithChallengeTTL expires challenge passwords ttl after their creation.
+// They don't expire by default.
+func WithChallengeTTL(ttl time.Duration) Option {
+	return func(d *Depot) {
+		d.challengeTTL = ttl
+	}
+}
+
+// WithClock sets the clock measuring the age of challenge passwords.
+func WithClock(c clock.Clock) Option {
+	return func(d *Depot) {
+		d.clock = c
+	}
+}
+
+// Open opens the database with the registered driver driverName,
+// and migrates its schema. See New.
+func Open(driverName, dataSourceName string, opts ...Option) (*Depot, error) {
+	dialect, err := DialectOf(driverName)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open(driverName, dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	d, err := New(db, dialect, opts...)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// New returns a depot storing its data in db, after applying the
+// schema migrations it is missing. Instances starting at the same
+// time on a new database may fail to migrate it; restart them.
+func New(db *sql.DB, dialect Dialect, opts ...Option) (*Depot, error) {
+	d := &Depot{db: db, dialect: dialect, clock: clock.System}
+	for _, opt := range opts {
+		opt(d)
+	}
+	if err := d.migrate(context.Background()); err != nil {
+		return nil, fmt.Errorf("migrate depot schema: %w", err)
+	}
+	return d, nil
+}
+
+// Close closes the database.
+func (d *Depot) Close() error {
+	return d.db.Close()
+}
+
+// Ping checks that the database is reachable, for the health checks
+// of the server.
+func (d *Depot) Ping(ctx context.Context) error {
+	return d.db.PingContext(ctx)
+}
+
+func (d *Depot) migrate(ctx context.Context) error {
+	_, err := d.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS scep_schema_migrations (
+		version INTEGER PRIMARY KEY
+	)`)
+	if err != nil {
+		return err
+	}
+	var applied int
+	err = d.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM scep_schema_migrations`).Scan(&applied)
+	if err != nil {
+		return err
+	}
+	for version := applied; version < len(migrations); version++ {
+		err := d.tx(ctx, func(tx *sql.Tx) error {
+			if _, err := tx.ExecContext(ctx, migrations[version](d.dialect)); err != nil {
+				return err
+			}
+			_, err := tx.ExecContext(ctx, d.dialect.rebind(`INSERT INTO scep_schema_migrations (version) VALUES (?)`), version+1)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d: %w", version+1, err)
+		}
+	}
+	return nil
+}
+
+// tx runs fn in a transaction, which is committed if fn succeeds.
+func (d *Depot) tx(ctx context.Context, fn func(*sql.Tx) error) error {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// CA returns the stored CA certificates and key, decrypting the key
+// with pass if it is encrypted.
+func (d *Depot) CA(pass []byte) ([]*x509.Certificate, *rsa.PrivateKey, error) {
+	var certPEM, keyPEM string
+	err := d.db.QueryRow(`SELECT certificates, private_key FROM scep_ca WHERE id = 1`).Scan(&certPEM, &keyPEM)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil, errors.New("depot has no CA, create one first")
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	certs, err := depot.DecodeCertificates([]byte(certPEM))
+	if err != nil {
+		return nil, nil, fmt.Errorf("parse CA certificate: %w", err)
+	}
+	key, err := depot.DecodeKey([]byte(keyPEM), pass)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parse CA key: %w", err)
+	}
+	return certs, key, nil
+}
+
+// PutCA stores the CA certificate chain and key, encrypting the key
+// with pass if it is not empty. It fails if the depot already has a CA.
+func (d *Depot) PutCA(certs []*x509.Certificate, key *rsa.PrivateKey, pass []byte) error {
+	keyPEM, err := depot.EncodeKey(key, pass)
+	if err != nil {
+		return err
+	}
+	_, err = d.db.Exec(d.dialect.rebind(`INSERT INTO scep_ca (id, certificates, private_key) VALUES (1, ?, ?)`),
+		string(depot.EncodeCertificates(certs...)), string(keyPEM))
+	return err
+}
+
+// CreateCA generates a self-signed CA certificate and key with the
+// given subject and validity, unless the depot already holds one.
+// The key is encrypted with pass, if it is not empty.
+func (d *Depot) CreateCA(pass []byte, subject pkix.Name, validity time.Duration) error {
+	var n int
+	if err := d.db.QueryRow(`SELECT COUNT(*) FROM scep_ca`).Scan(&n); err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+	crt, key, err := depot.GenerateCA(subject, validity)
+	if err != nil {
+		return err
+	}
+	return d.PutCA([]*x509.Certificate{crt}, key, pass)
+}
+
+// Serial allocates the next serial number. The update locks the
+// sequence row, so concurrent allocations by several instances
+// never return the same number.
+func (d *Depot) Serial() (*big.Int, error) {
+	var serial int64
+	err := d.tx(context.Background(), func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`UPDATE scep_serial SET next_serial = next_serial + 1 WHERE id = 1`); err != nil {
+			return err
+		}
+		return tx.QueryRow(`SELECT next_serial FROM scep_serial WHERE id = 1`).Scan(&serial)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return big.NewInt(serial - 1), nil
+}
+
+// Put stores crt under name.
+func (d *Depot) Put(name string, crt *x509.Certificate) error {
+	_, err := d.db.Exec(d.dialect.rebind(`INSERT INTO scep_certificates (serial, name, not_after, certificate) VALUES (?, ?, ?, ?)`),
+		crt.SerialNumber.Text(16), name, crt.NotAfter.Unix(), crt.Raw)
+	return err
+}
+
+// Certificates returns the certificates stored under name.
+func (d *Depot) Certificates(name string) ([]*x509.Certificate, error) {
+	rows, err := d.db.Query(d.dialect.rebind(`SELECT certificate FROM scep_certificates WHERE name = ?`), name)
+	if err != nil {
+		return nil, err
+	}
+	return scanCertificates(rows)
+}
+
+// ListCertificates returns all stored certificates.
+func (d *Depot) ListCertificates() ([]*x509.Certificate, error) {
+	rows, err := d.db.Query(`SELECT certificate FROM scep_certificates`)
+	if err != nil {
+		return nil, err
+	}
+	return scanCertificates(rows)
+}
+
+// scanCertificates parses the DER encoded certificates of rows,
+// and closes them.
+func scanCertificates(rows *sql.Rows) ([]*x509.Certificate, error) {
+	defer rows.Close()
+	var certs []*x509.Certificate
+	for rows.Next() {
+		var der []byte
+		if err := rows.Scan(&der); err != nil {
+			return nil, err
+		}
+		crt, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, crt)
+	}
+	return certs, rows.Err()
+}
+
+// PruneCertificates deletes the certificates which expired before
+// before, with their revocations and transactions, and the transactions
+// without certificate which are not locked.
+func (d *Depot) PruneCertificates(before time.Time) (int, error) {
+	var n int64
+	err := d.tx(context.Background(), func(tx *sql.Tx) error {
+		for _, table := range []string{"scep_revocations", "scep_transactions"} {
+			_, err := tx.Exec(d.dialect.rebind(`DELETE FROM `+table+` WHERE serial IN
+				(SELECT serial FROM scep_certificates WHERE not_after < ?)`), before.Unix())
+			if err != nil {
+				return err
+			}
+		}
+		// and the transactions without certificate
+		_, err := tx.Exec(d.dialect.rebind(`DELETE FROM scep_transactions WHERE serial = '' AND locked_until < ?`), before.UnixMilli())
+		if err != nil {
+			return err
+		}
+		res, err := tx.Exec(d.dialect.rebind(`DELETE FROM scep_certificates WHERE not_after < ?`), before.Unix())
+		if err != nil {
+			return err
+		}
+		n, err = res.RowsAffected()
+		return err
+	})
+	return int(n), err
+}
+
+// LockTransaction locks the transaction id for lease, and returns the
+// certificate recorded for it, if any. The lock is a row of its own,
+// which only one instance inserts or takes over once it expired.
+func (d *Depot) LockTransaction(id string, lease time.Duration) (*x509.Certificate, error) {
+	now := d.clock.Now()
+	res, err := d.db.Exec(d.dialect.rebind(`UPDATE scep_transactions SET locked_until = ? WHERE transaction_id = ? AND locked_until < ?`),
+		now.Add(lease).UnixMilli(), id, now.UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		_, err := d.db.Exec(d.dialect.rebind(`INSERT INTO scep_transactions (transaction_id, locked_until, serial) VALUES (?, ?, '')`),
+			id, now.Add(lease).UnixMilli())
+		if err != nil {
+			// the row exists, and is locked
+			var n int
+			if d.db.QueryRow(d.dialect.rebind(`SELECT COUNT(*) FROM scep_transactions WHERE transaction_id = ?`), id).Scan(&n) == nil && n > 0 {
+				return nil, scepserver.ErrTransactionInProgress
+			}
+			return nil, err
+		}
+		return nil, nil
+	}
+	var der []byte
+	err = d.db.QueryRow(d.dialect.rebind(`SELECT c.certificate FROM scep_transactions t
+		JOIN scep_certificates c ON c.serial = t.serial WHERE t.transaction_id = ?`), id).Scan(&der)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	var crt *x509.Certificate
+	if err == nil {
+		crt, err = x509.ParseCertificate(der)
+	}
+	if err != nil {
+		d.UnlockTransaction(id, nil)
+		return nil, err
+	}
+	return crt, nil
+}
+
+// UnlockTransaction unlocks the transaction id, recording the serial
+// number of crt, unless it is nil.
+func (d *Depot) UnlockTransaction(id string, crt *x509.Certificate) error {
+	if crt == nil {
+		_, err := d.db.Exec(d.dialect.rebind(`UPDATE scep_transactions SET locked_until = 0 WHERE transaction_id = ?`), id)
+		return err
+	}
+	_, err := d.db.Exec(d.dialect.rebind(`UPDATE scep_transactions SET locked_until = 0, serial = ? WHERE transaction_id = ?`),
+		crt.SerialNumber.Text(16), id)
+	return err
+}
+
+// Revoke marks the certificate with serial as revoked.
+func (d *Depot) Revoke(serial *big.Int, reason int, at time.Time) error {
+	if err := depot.CheckReason(reason); err != nil {
+		return err
+	}
+	key := serial.Text(16)
+	return d.tx(context.Background(), func(tx *sql.Tx) error {
+		var n int
+		err := tx.QueryRow(d.dialect.rebind(`SELECT COUNT(*) FROM scep_certificates WHERE serial = ?`), key).Scan(&n)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return fmt.Errorf("revoke %s: %w", key, scepserver.ErrUnknownCertificate)
+		}
+		err = tx.QueryRow(d.dialect.rebind(`SELECT COUNT(*) FROM scep_revocations WHERE serial = ?`), key).Scan(&n)
+		if err != nil || n > 0 {
+			return err
+		}
+		_, err = tx.Exec(d.dialect.rebind(`INSERT INTO scep_revocations (serial, revoked_at, reason) VALUES (?, ?, ?)`),
+			key, at.Unix(), reason)
+		return err
+	})
+}
+
+// Revoked returns the revoked certificates.
+func (d *Depot) Revoked() ([]x509.RevocationListEntry, error) {
+	rows, err := d.db.Query(`SELECT serial, revoked_at, reason FROM scep_revocations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []x509.RevocationListEntry
+	for rows.Next() {
+		var (
+			serial    string
+			revokedAt int64
+			entry     x509.RevocationListEntry
+		)
+		if err := rows.Scan(&serial, &revokedAt, &entry.ReasonCode); err != nil {
+			return nil, err
+		}
+		var ok bool
+		if entry.SerialNumber, ok = new(big.Int).SetString(serial, 16); !ok {
+			return nil, fmt.Errorf("invalid serial number %q", serial)
+		}
+		entry.RevocationTime = time.Unix(revokedAt, 0)
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// CreateChallenge returns a new random challenge password,
+// valid until it is used or expires. It also deletes the
+// expired challenges.
+func (d *Depot) CreateChallenge() (string, error) {
+	pw, err := scepserver.GenerateChallenge()
+	if err != nil {
+		return "", err
+	}
+	now := d.clock.Now()
+	if d.challengeTTL > 0 {
+		_, err := d.db.Exec(d.dialect.rebind(`DELETE FROM scep_challenges WHERE created_at < ?`), now.Add(-d.challengeTTL).Unix())
+		if err != nil {
+			return "", err
+		}
+	}
+	_, err = d.db.Exec(d.dialect.rebind(`INSERT INTO scep_challenges (challenge, created_at) VALUES (?, ?)`), pw, now.Unix())
+	if err != nil {
+		return "", err
+	}
+	return pw, nil
+}
+
+// PruneChallenges deletes the expired challenge passwords.
+func (d *Depot) PruneChallenges() (int, error) {
+	if d.challengeTTL <= 0 {
+		return 0, nil
+	}
+	res, err := d.db.Exec(d.dialect.rebind(`DELETE FROM scep_challenges WHERE created_at < ?`), d.clock.Now().Add(-d.challengeTTL).Unix())
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// HasChallenge reports whether pw is an unused challenge password
+// created by CreateChallenge which has not expired, and deletes it.
+// Deleting it is atomic, so that a challenge is only accepted once
+// when several instances share the database.
+func (d *Depot) HasChallenge(pw string) (bool, error) {
+	var notBefore int64
+	if d.challengeTTL > 0 {
+		notBefore = d.clock.Now().Add(-d.challengeTTL).Unix()
+	}
+	res, err := d.db.Exec(d.dialect.rebind(`DELETE FROM scep_challenges WHERE challenge = ? AND created_at >= ?`), pw, notBefore)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// Audit records ev in the scep_audit table, with the main fields in
+// columns of their own and the whole event as JSON in the event column,
+// so that the depot can serve as a scepserver.Auditor.
+func (d *Depot) Audit(ctx context.Context, ev *scepserver.AuditEvent) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	_, err = d.db.ExecContext(ctx, d.dialect.rebind(`INSERT INTO scep_audit (time, outcome, transaction_id, requester, subject, serial, event) VALUES (?, ?, ?, ?, ?, ?, ?)`),
+		ev.Time.Unix(), string(ev.Outcome), ev.TransactionID, ev.Requester, ev.Subject, ev.Serial, string(data))
+	return err
+}
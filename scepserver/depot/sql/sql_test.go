@@ -0,0 +1,334 @@
+package sql
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	_ "modernc.org/sqlite"
+
+	"scepclient/clock"
+	"scepclient/scepserver"
+)
+
+func openDepot(t *testing.T) (*Depot, string) {
+	dsn := "file:" + filepath.Join(t.TempDir(), "depot.db") + "?_pragma=busy_timeout(10000)"
+	d, err := Open("sqlite", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d, dsn
+}
+
+func TestMigrate(t *testing.T) {
+	_, dsn := openDepot(t)
+	// reopening applies no migration twice
+	d, err := Open("sqlite", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	var applied int
+	if err := d.db.QueryRow(`SELECT COUNT(*) FROM scep_schema_migrations`).Scan(&applied); err != nil {
+		t.Fatal(err)
+	}
+	if applied != len(migrations) {
+		t.Errorf("expected %d migrations, got %d", len(migrations), applied)
+	}
+}
+
+func TestRebind(t *testing.T) {
+	query := `INSERT INTO t (a, b) VALUES (?, ?)`
+	if got, want := Postgres.rebind(query), `INSERT INTO t (a, b) VALUES ($1, $2)`; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+	if got := MySQL.rebind(query); got != query {
+		t.Errorf("expected MySQL query to be unchanged, got %q", got)
+	}
+}
+
+func TestCA(t *testing.T) {
+	d, _ := openDepot(t)
+	if _, _, err := d.CA(nil); err == nil {
+		t.Error("expected an error without a CA")
+	}
+	for _, cn := range []string{"test CA", "other CA"} {
+		if err := d.CreateCA([]byte("secret"), pkix.Name{CommonName: cn}, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+	certs, key, err := d.CA([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 1 || certs[0].Subject.CommonName != "test CA" {
+		t.Fatalf("expected CreateCA to keep the first CA, got %v", certs)
+	}
+	if err := key.Validate(); err != nil {
+		t.Error(err)
+	}
+
+	crt := *certs[0]
+	for _, serial := range []int64{2, 3} {
+		crt.SerialNumber = big.NewInt(serial)
+		if err := d.Put("device", &crt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Put("device", &crt); err == nil {
+		t.Error("expected storing a serial number twice to fail")
+	}
+	stored, err := d.Certificates("device")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 2 {
+		t.Errorf("expected 2 certificates, got %d", len(stored))
+	}
+}
+
+func TestSerialConcurrent(t *testing.T) {
+	d, _ := openDepot(t)
+	const n = 20
+	var (
+		wg      sync.WaitGroup
+		mtx     sync.Mutex
+		serials = make(map[int64]bool)
+	)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serial, err := d.Serial()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mtx.Lock()
+			serials[serial.Int64()] = true
+			mtx.Unlock()
+		}()
+	}
+	wg.Wait()
+	for want := int64(2); want < n+2; want++ {
+		if !serials[want] {
+			t.Errorf("serial %d was not allocated", want)
+		}
+	}
+}
+
+func TestChallenges(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	dsn := "file:" + filepath.Join(t.TempDir(), "depot.db")
+	d, err := Open("sqlite", dsn, WithChallengeTTL(time.Hour), WithClock(clk))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	pw, err := d.CreateChallenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []bool{true, false} {
+		ok, err := d.HasChallenge(pw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != want {
+			t.Errorf("use %d: expected HasChallenge to return %v", i+1, want)
+		}
+	}
+
+	pw, err = d.CreateChallenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clk.Advance(time.Hour + time.Second)
+	if ok, _ := d.HasChallenge(pw); ok {
+		t.Error("expected an expired challenge to be rejected")
+	}
+
+	if _, err := d.CreateChallenge(); err != nil {
+		t.Fatal(err)
+	}
+	clk.Advance(time.Hour + time.Second)
+	if n, err := d.PruneChallenges(); err != nil || n != 1 {
+		t.Errorf("expected 1 pruned challenge, got %d, %v", n, err)
+	}
+}
+
+func TestAudit(t *testing.T) {
+	d, _ := openDepot(t)
+	var _ scepserver.Auditor = d
+	events := []*scepserver.AuditEvent{
+		{Time: time.Now(), Outcome: scepserver.AuditIssued, TransactionID: "1", Subject: "CN=device", Serial: "2"},
+		{Time: time.Now(), Outcome: scepserver.AuditDenied, TransactionID: "2", Requester: "192.0.2.1", Reason: "wrong challenge password"},
+	}
+	for _, ev := range events {
+		if err := d.Audit(context.Background(), ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rows, err := d.db.Query(`SELECT outcome, transaction_id, requester, serial FROM scep_audit ORDER BY id`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var got []scepserver.AuditEvent
+	for rows.Next() {
+		var ev scepserver.AuditEvent
+		if err := rows.Scan(&ev.Outcome, &ev.TransactionID, &ev.Requester, &ev.Serial); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, ev)
+	}
+	if len(got) != 2 || got[0].Serial != "2" || got[1].Outcome != scepserver.AuditDenied || got[1].Requester != "192.0.2.1" {
+		t.Errorf("unexpected audit rows %+v", got)
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	d, _ := openDepot(t)
+	crt := &x509.Certificate{Raw: []byte("certificate"), SerialNumber: big.NewInt(0x2a)}
+	if err := d.Put("device", crt); err != nil {
+		t.Fatal(err)
+	}
+	at := time.Date(2025, 6, 7, 8, 9, 10, 0, time.UTC)
+	if err := d.Revoke(big.NewInt(0x2a), 1, at); err != nil {
+		t.Fatal(err)
+	}
+	// revoking again keeps the first revocation
+	if err := d.Revoke(big.NewInt(0x2a), 4, at.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Revoke(big.NewInt(0x2b), 0, at); !errors.Is(err, scepserver.ErrUnknownCertificate) {
+		t.Errorf("expected ErrUnknownCertificate, got %v", err)
+	}
+	revoked, err := d.Revoked()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revoked) != 1 || revoked[0].SerialNumber.Int64() != 0x2a ||
+		!revoked[0].RevocationTime.Equal(at) || revoked[0].ReasonCode != 1 {
+		t.Errorf("unexpected revocations %+v", revoked)
+	}
+}
+
+func TestListCertificates(t *testing.T) {
+	d, _ := openDepot(t)
+	var _ scepserver.CertificateLister = d
+	if err := d.CreateCA(nil, pkix.Name{CommonName: "test CA"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	caCerts, _, err := d.CA(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Put stores the raw certificate under its serial number,
+	// so the CA certificate can stand in for issued ones
+	for i, serial := range []int64{0x2a, 0x2b} {
+		crt := *caCerts[0]
+		crt.SerialNumber = big.NewInt(serial)
+		if err := d.Put(fmt.Sprintf("device%d", i), &crt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	certs, err := d.ListCertificates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 2 {
+		t.Errorf("expected 2 certificates, got %d", len(certs))
+	}
+}
+
+func TestPrune(t *testing.T) {
+	d, _ := openDepot(t)
+	var _ scepserver.CertificatePruner = d
+	now := time.Now()
+	for serial, notAfter := range map[int64]time.Time{0x2a: now.Add(-time.Hour), 0x2b: now.Add(time.Hour)} {
+		crt := &x509.Certificate{Raw: []byte("certificate"), SerialNumber: big.NewInt(serial), NotAfter: notAfter}
+		if err := d.Put("device", crt); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Revoke(big.NewInt(serial), 1, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n, err := d.PruneCertificates(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("expected 1 pruned certificate, got %d", n)
+	}
+	revoked, err := d.Revoked()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revoked) != 1 || revoked[0].SerialNumber.Int64() != 0x2b {
+		t.Errorf("expected the revocation of the valid certificate only, got %+v", revoked)
+	}
+}
+
+func TestTransactions(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	_, dsn := openDepot(t)
+	// depots sharing the database stand in for separate instances
+	var depots []*Depot
+	for i := 0; i < 2; i++ {
+		d, err := Open("sqlite", dsn, WithClock(clk))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer d.Close()
+		depots = append(depots, d)
+	}
+	var _ scepserver.TransactionLocker = depots[0]
+	if err := depots[0].CreateCA(nil, pkix.Name{CommonName: "test CA"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	caCerts, _, err := depots[0].CA(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Put only stores the raw certificate under its serial number,
+	// so the CA certificate can stand in for an issued one
+	crt := *caCerts[0]
+	crt.SerialNumber = big.NewInt(0x2a)
+
+	if issued, err := depots[0].LockTransaction("tx1", time.Minute); err != nil || issued != nil {
+		t.Fatalf("expected to lock a new transaction, got %v, %v", issued, err)
+	}
+	if _, err := depots[1].LockTransaction("tx1", time.Minute); !errors.Is(err, scepserver.ErrTransactionInProgress) {
+		t.Errorf("expected ErrTransactionInProgress, got %v", err)
+	}
+	if err := depots[0].Put("device", &crt); err != nil {
+		t.Fatal(err)
+	}
+	if err := depots[0].UnlockTransaction("tx1", &crt); err != nil {
+		t.Fatal(err)
+	}
+	issued, err := depots[1].LockTransaction("tx1", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if issued == nil || !issued.Equal(caCerts[0]) {
+		t.Errorf("expected the certificate issued in the transaction, got %v", issued)
+	}
+
+	// the lock of a crashed instance expires
+	clk.Advance(time.Minute + time.Second)
+	if _, err := depots[0].LockTransaction("tx1", time.Minute); err != nil {
+		t.Errorf("expected the expired lock to be taken over, got %v", err)
+	}
+}
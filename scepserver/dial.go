@@ -0,0 +1,40 @@
+package scepserver
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// dialer connects the HTTP transport to the server.
+type dialer struct {
+	net.Dialer
+
+	// hosts maps host:port addresses to the
+	// addresses connected to instead.
+	hosts map[string]string
+
+	// network replaces "tcp" to restrict connections
+	// to IPv4 ("tcp4") or IPv6 ("tcp6").
+	network string
+}
+
+func newDialer() *dialer {
+	// same defaults as http.DefaultTransport
+	return &dialer{
+		Dialer: net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		},
+	}
+}
+
+func (d *dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if override, ok := d.hosts[addr]; ok {
+		addr = override
+	}
+	if d.network != "" && network == "tcp" {
+		network = d.network
+	}
+	return d.Dialer.DialContext(ctx, network, addr)
+}
@@ -0,0 +1,231 @@
+package scepserver
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestWithResolve(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(r.Host))
+	}))
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(u.Host)
+	host := net.JoinHostPort("scep.invalid", port)
+
+	transport, err := NewHTTPTransport("http://"+host, WithResolve(host, "127.0.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := transport.SendGet(context.Background(), SCEPRequest{Operation: getCACaps})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp.Data) != host {
+		t.Errorf("expected Host %s, got %s", host, resp.Data)
+	}
+}
+
+// dualStackResolver resolves every name to 127.0.0.1 and ::1.
+func dualStackResolver() *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			client, server := net.Pipe()
+			go answerDNS(server)
+			return client, nil
+		},
+	}
+}
+
+// answerDNS answers the A and AAAA queries of conn, framed as over TCP.
+func answerDNS(conn net.Conn) {
+	defer conn.Close()
+	for {
+		var n uint16
+		if err := binary.Read(conn, binary.BigEndian, &n); err != nil {
+			return
+		}
+		query := make([]byte, n)
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+		var p dnsmessage.Parser
+		h, err := p.Start(query)
+		if err != nil {
+			return
+		}
+		q, err := p.Question()
+		if err != nil {
+			return
+		}
+		b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: h.ID, Response: true, Authoritative: true})
+		b.StartQuestions()
+		b.Question(q)
+		b.StartAnswers()
+		rh := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 60}
+		switch q.Type {
+		case dnsmessage.TypeA:
+			b.AResource(rh, dnsmessage.AResource{A: [4]byte{127, 0, 0, 1}})
+		case dnsmessage.TypeAAAA:
+			b.AAAAResource(rh, dnsmessage.AAAAResource{AAAA: [16]byte{15: 1}})
+		}
+		msg, err := b.Finish()
+		if err != nil {
+			return
+		}
+		binary.Write(conn, binary.BigEndian, uint16(len(msg)))
+		conn.Write(msg)
+	}
+}
+
+type dialAttempt struct {
+	network string
+	at      time.Time
+}
+
+// recordDials returns an option recording the connection attempts of
+// the transport. If stallFirst is set, the first attempt hangs until
+// it is canceled, like one over a broken route.
+func recordDials(stallFirst bool) (HTTPOption, func() []dialAttempt) {
+	var (
+		mtx      sync.Mutex
+		attempts []dialAttempt
+	)
+	opt := func(t *httpTransport) {
+		t.dialer.ControlContext = func(ctx context.Context, network, address string, _ syscall.RawConn) error {
+			mtx.Lock()
+			attempts = append(attempts, dialAttempt{network, time.Now()})
+			first := len(attempts) == 1
+			mtx.Unlock()
+			if stallFirst && first {
+				<-ctx.Done()
+				return ctx.Err()
+			}
+			return nil
+		}
+	}
+	return opt, func() []dialAttempt {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return append([]dialAttempt(nil), attempts...)
+	}
+}
+
+// dualStackURL returns the URL of the server under a name resolved by
+// dualStackResolver, which only accepts connections over IPv4.
+func dualStackURL(t *testing.T, srv *httptest.Server) string {
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(u.Host)
+	return "http://" + net.JoinHostPort("scep.test", port)
+}
+
+func TestWithNetwork(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("POSTPKIOperation"))
+	}))
+	defer srv.Close()
+
+	for _, tt := range []struct {
+		network string
+		ok      bool
+	}{
+		{"tcp4", true},
+		{"tcp6", false},
+	} {
+		t.Run(tt.network, func(t *testing.T) {
+			record, attempts := recordDials(false)
+			transport, err := NewHTTPTransport(dualStackURL(t, srv),
+				WithResolver(dualStackResolver()),
+				WithNetwork(tt.network),
+				record,
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = transport.SendGet(context.Background(), SCEPRequest{Operation: getCACaps})
+			if ok := err == nil; ok != tt.ok {
+				t.Errorf("expected success %v, got error %v", tt.ok, err)
+			}
+			got := attempts()
+			if len(got) == 0 {
+				t.Fatal("expected a connection attempt")
+			}
+			for _, a := range got {
+				if a.network != tt.network {
+					t.Errorf("expected only %s connections, got %s", tt.network, a.network)
+				}
+			}
+		})
+	}
+}
+
+func TestWithFallbackDelay(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("POSTPKIOperation"))
+	}))
+	defer srv.Close()
+
+	const delay = 50 * time.Millisecond
+	record, attempts := recordDials(true)
+	transport, err := NewHTTPTransport(dualStackURL(t, srv),
+		WithResolver(dualStackResolver()),
+		WithFallbackDelay(delay),
+		record,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := transport.SendGet(ctx, SCEPRequest{Operation: getCACaps}); err != nil {
+		t.Fatal(err)
+	}
+	got := attempts()
+	if len(got) != 2 || got[0].network == got[1].network {
+		t.Fatalf("expected one attempt per address family, got %v", got)
+	}
+	if waited := got[1].at.Sub(got[0].at); waited < delay {
+		t.Errorf("expected the fallback after %v, got %v", delay, waited)
+	}
+
+	// without the fallback, the stalled family is tried alone
+	record, attempts = recordDials(true)
+	transport, err = NewHTTPTransport(dualStackURL(t, srv),
+		WithResolver(dualStackResolver()),
+		WithFallbackDelay(-1),
+		record,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if _, err := transport.SendGet(ctx, SCEPRequest{Operation: getCACaps}); err == nil {
+		t.Error("expected the request to time out without the fallback")
+	}
+	if got := attempts(); len(got) != 1 {
+		t.Errorf("expected a single attempt, got %v", got)
+	}
+}
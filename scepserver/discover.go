@@ -0,0 +1,74 @@
+package scepserver
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+)
+
+// ErrNoEndpoint is returned by Discover when no SCEP endpoint was found.
+var ErrNoEndpoint = errors.New("scep: no SCEP endpoint found")
+
+// capability matches a line of a GetCACaps response.
+var capability = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9.-]*$`)
+
+// Discover probes the KnownPaths on the host of instance, over HTTPS and
+// HTTP unless instance specifies a scheme, and returns the URL of the
+// first one answering GetCACaps with a valid capabilities list, along
+// with the capabilities. To tell SCEP servers from other web pages,
+// the response must have the text/plain content type. opts configure
+// the transport of the probes.
+func Discover(ctx context.Context, instance string, opts ...HTTPOption) (*url.URL, []byte, error) {
+	u, err := ParseServerURL(instance)
+	if err != nil {
+		return nil, nil, err
+	}
+	schemes := []string{"https", "http"}
+	if hasScheme(instance) {
+		schemes = []string{u.Scheme}
+	}
+	opts = append(opts[:len(opts):len(opts)], WithoutPathRewrite(), WithStrictContentType(true))
+
+	var errs []string
+	for _, scheme := range schemes {
+		for _, path := range KnownPaths {
+			candidate := &url.URL{Scheme: scheme, Host: u.Host, Path: path}
+			t, err := NewHTTPTransport(candidate.String(), opts...)
+			if err != nil {
+				return nil, nil, err
+			}
+			resp, err := t.SendGet(ctx, SCEPRequest{Operation: getCACaps})
+			if err == nil && !validCaps(resp.Data) {
+				err = errors.New("invalid capabilities")
+			}
+			if err == nil {
+				return candidate, resp.Data, nil
+			}
+			if ctx.Err() != nil {
+				return nil, nil, ctx.Err()
+			}
+			errs = append(errs, candidate.String()+": "+err.Error())
+		}
+	}
+	return nil, nil, fmt.Errorf("on %s, tried %q: %w", u.Host, errs, ErrNoEndpoint)
+}
+
+func hasScheme(instance string) bool {
+	u, err := url.Parse(instance)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https")
+}
+
+// validCaps reports whether caps is a list of capabilities,
+// one per line. An empty list is valid.
+func validCaps(caps []byte) bool {
+	for _, line := range bytes.Split(caps, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) > 0 && !capability.Match(line) {
+			return false
+		}
+	}
+	return true
+}
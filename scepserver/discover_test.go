@@ -0,0 +1,41 @@
+package scepserver
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDiscover(t *testing.T) {
+	mux := http.NewServeMux()
+	// a catch-all HTML page, as served by many web servers
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<html><body>Welcome</body></html>"))
+	})
+	mux.HandleFunc("/certsrv/mscep/mscep.dll", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("POSTPKIOperation\r\nSHA-256\r\nAES\r\n"))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	u, caps, err := Discover(context.Background(), srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := srv.URL + "/certsrv/mscep/mscep.dll"; u.String() != want {
+		t.Errorf("expected %s, got %s", want, u)
+	}
+	if string(caps) != "POSTPKIOperation\r\nSHA-256\r\nAES\r\n" {
+		t.Errorf("unexpected capabilities %q", caps)
+	}
+
+	empty := httptest.NewServer(http.NotFoundHandler())
+	defer empty.Close()
+	if _, _, err := Discover(context.Background(), empty.URL); !errors.Is(err, ErrNoEndpoint) {
+		t.Errorf("expected ErrNoEndpoint, got %v", err)
+	}
+}
@@ -0,0 +1,186 @@
+package scepserver
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Errors returned by the SCEP transport. Use errors.Is to test for them,
+// as they are usually wrapped with the failing operation.
+var (
+	// ErrNotSupported is returned for operations or HTTP methods
+	// which are not supported.
+	ErrNotSupported = errors.New("scep: operation not supported")
+
+	// ErrPayloadTooLarge is returned when a message exceeds the
+	// maximum payload size.
+	ErrPayloadTooLarge = errors.New("scep: payload too large")
+)
+
+// OpError records the operation, server URL and transaction ID
+// of a failed SCEP request. The HTTP transport wraps all errors in it,
+// and errors.Is and errors.As see through it to the cause.
+type OpError struct {
+	// Op is the SCEP operation, for example "PKIOperation".
+	Op string
+
+	// URL is the server URL, without credentials.
+	URL string
+
+	// TransactionID is the transaction ID carried by the request
+	// context, set with WithTransactionID. It is empty for
+	// operations which are not part of a transaction.
+	TransactionID string
+
+	Err error
+}
+
+func (e *OpError) Error() string {
+	msg := "scep: " + e.Op
+	if e.URL != "" {
+		msg += " " + e.URL
+	}
+	if e.TransactionID != "" {
+		msg += " (transaction " + e.TransactionID + ")"
+	}
+	return msg + ": " + e.Err.Error()
+}
+
+func (e *OpError) Unwrap() error { return e.Err }
+
+type transactionIDKey struct{}
+
+// WithTransactionID returns a context carrying the SCEP transaction ID id,
+// which is added to errors of requests made with it.
+func WithTransactionID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, transactionIDKey{}, id)
+}
+
+// TransactionID returns the SCEP transaction ID carried by ctx.
+func TransactionID(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(transactionIDKey{}).(string)
+	return id, ok
+}
+
+// maxErrorBodySize is the number of bytes of an error response body
+// kept in an HTTPError.
+const maxErrorBodySize = 4096
+
+// HTTPError is returned when the SCEP server responds
+// with an HTTP error status.
+type HTTPError struct {
+	StatusCode int
+	Status     string
+	Header     http.Header
+
+	// Body holds the beginning of the response body,
+	// which usually contains the server's error message.
+	Body []byte
+}
+
+func newHTTPError(r *http.Response) *HTTPError {
+	body, _ := ioutil.ReadAll(io.LimitReader(r.Body, maxErrorBodySize))
+	return &HTTPError{
+		StatusCode: r.StatusCode,
+		Status:     r.Status,
+		Header:     r.Header,
+		Body:       body,
+	}
+}
+
+func (e *HTTPError) Error() string {
+	msg := e.Message()
+	if hint := e.Hint(); hint != "" {
+		msg += " (" + hint + ")"
+	}
+	return fmt.Sprintf("http request failed with status %s, msg: %s", e.Status, msg)
+}
+
+var (
+	htmlTitle = regexp.MustCompile(`(?is)<title>(.*?)</title>`)
+	htmlTag   = regexp.MustCompile(`(?s)<[^>]*>`)
+	spaces    = regexp.MustCompile(`\s+`)
+)
+
+// Message returns the error message of the body. For HTML error pages,
+// as sent by IIS, it is the page title rather than the markup.
+func (e *HTTPError) Message() string {
+	body := string(e.Body)
+	if m := htmlTitle.FindStringSubmatch(body); m != nil {
+		body = m[1]
+	} else if strings.Contains(e.Header.Get("Content-Type"), "html") {
+		body = htmlTag.ReplaceAllString(body, " ")
+	}
+	return strings.TrimSpace(spaces.ReplaceAllString(html.UnescapeString(body), " "))
+}
+
+// IsIIS reports whether the error was sent by Microsoft IIS,
+// which hosts NDES.
+func (e *HTTPError) IsIIS() bool {
+	return strings.Contains(e.Header.Get("Server"), "Microsoft-IIS") ||
+		bytes.Contains(e.Body, []byte("Internet Information Services"))
+}
+
+// Hint returns the likely cause of common NDES and IIS
+// error responses, or an empty string.
+func (e *HTTPError) Hint() string {
+	switch {
+	case e.StatusCode == http.StatusUnauthorized:
+		return "the server requires authentication"
+	case e.StatusCode == http.StatusForbidden && e.IsIIS():
+		return "access denied, check the challenge password and the NDES permissions"
+	case e.StatusCode == http.StatusRequestURITooLong,
+		e.StatusCode == http.StatusNotFound && bytes.Contains(e.Body, []byte("404.15")),
+		e.StatusCode == http.StatusNotFound && bytes.Contains(e.Body, []byte("404.14")):
+		return "the request URL is too long, the server may require POST for PKIOperation"
+	case e.StatusCode == http.StatusInternalServerError && bytes.Contains(e.Body, []byte("Network Device Enrollment Service")):
+		return "the Network Device Enrollment Service is misconfigured or not running"
+	case e.StatusCode == http.StatusServiceUnavailable && e.IsIIS():
+		return "the IIS application pool may be stopped"
+	}
+	return ""
+}
+
+// readLimited reads r, failing with ErrPayloadTooLarge
+// instead of truncating when more than limit bytes are available.
+// On read errors, it returns the data read before the error.
+func readLimited(r io.Reader, limit int64) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return data, err
+	}
+	if int64(len(data)) > limit {
+		return nil, ErrPayloadTooLarge
+	}
+	return data, nil
+}
+
+// limitedReadCloser fails with ErrPayloadTooLarge once
+// more than remaining bytes have been read.
+type limitedReadCloser struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (l *limitedReadCloser) Read(p []byte) (int, error) {
+	if l.remaining < 0 {
+		return 0, ErrPayloadTooLarge
+	}
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.ReadCloser.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return n - 1, ErrPayloadTooLarge
+	}
+	return n, err
+}
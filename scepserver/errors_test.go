@@ -0,0 +1,101 @@
+package scepserver
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestHTTPError(t *testing.T) {
+	iis := http.Header{
+		"Server":       []string{"Microsoft-IIS/10.0"},
+		"Content-Type": []string{"text/html"},
+	}
+	tests := []struct {
+		name        string
+		err         *HTTPError
+		wantMessage string
+		wantHint    string
+	}{
+		{
+			name: "IIS access denied",
+			err: &HTTPError{
+				StatusCode: http.StatusForbidden,
+				Header:     iis,
+				Body:       []byte("<html><head><title>403 - Forbidden: Access is denied.</title></head><body>...</body></html>"),
+			},
+			wantMessage: "403 - Forbidden: Access is denied.",
+			wantHint:    "challenge password",
+		},
+		{
+			name: "IIS query string too long",
+			err: &HTTPError{
+				StatusCode: http.StatusNotFound,
+				Header:     iis,
+				Body:       []byte("<h3>HTTP Error 404.15 - Not Found</h3>\n<h4>The request filtering module is configured to deny a request where the query string is too long.</h4>"),
+			},
+			wantMessage: "HTTP Error 404.15 - Not Found The request filtering module",
+			wantHint:    "POST",
+		},
+		{
+			name: "plain text",
+			err: &HTTPError{
+				StatusCode: http.StatusBadRequest,
+				Header:     http.Header{"Content-Type": []string{"text/plain"}},
+				Body:       []byte("missing operation\n"),
+			},
+			wantMessage: "missing operation",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if msg := tt.err.Message(); !strings.HasPrefix(msg, tt.wantMessage) {
+				t.Errorf("expected message %q, got %q", tt.wantMessage, msg)
+			}
+			hint := tt.err.Hint()
+			if (tt.wantHint == "") != (hint == "") || !strings.Contains(hint, tt.wantHint) {
+				t.Errorf("expected hint containing %q, got %q", tt.wantHint, hint)
+			}
+		})
+	}
+}
+
+func TestOpError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "denied", http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+	u.User = url.UserPassword("user", "secret")
+	transport, err := NewHTTPTransport(u.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := WithTransactionID(context.Background(), "abc123")
+	_, err = transport.SendPost(ctx, SCEPRequest{Operation: pkiOperation, Message: []byte("msg")})
+
+	var opErr *OpError
+	if !errors.As(err, &opErr) {
+		t.Fatalf("expected an OpError, got %v", err)
+	}
+	if opErr.Op != pkiOperation || opErr.TransactionID != "abc123" {
+		t.Errorf("unexpected operation context %+v", opErr)
+	}
+	if strings.Contains(opErr.URL, "secret") || !strings.Contains(opErr.URL, u.Host) {
+		t.Errorf("unexpected URL %q", opErr.URL)
+	}
+	var httpErr *HTTPError
+	if !errors.As(err, &httpErr) || httpErr.StatusCode != http.StatusForbidden {
+		t.Errorf("expected the HTTPError to be wrapped, got %v", err)
+	}
+	for _, want := range []string{pkiOperation, "abc123", "403"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q in error %q", want, err)
+		}
+	}
+}
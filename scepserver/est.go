@@ -0,0 +1,246 @@
+package scepserver
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"scepclient/crypto/x509util"
+	"scepclient/scep"
+)
+
+// ESTService issues certificates to EST (RFC 7030) clients.
+// It is implemented by the Service of NewService, which applies
+// the same policy, profiles, challenge and approver as to SCEP requests.
+type ESTService interface {
+	// ESTCACerts returns the certificates served by GetCACert.
+	ESTCACerts(ctx context.Context) ([]*x509.Certificate, error)
+
+	// ESTEnroll issues the certificate requested by req. It fails with
+	// ErrPending while the request awaits approval, and with an
+	// *ESTError if it is rejected.
+	ESTEnroll(ctx context.Context, req *ESTRequest) (*x509.Certificate, error)
+}
+
+// ESTRequest is a simpleenroll or simplereenroll request.
+type ESTRequest struct {
+	CSR *x509.CertificateRequest
+
+	// Password is the password of HTTP basic authentication, which is
+	// checked as challenge password. The challenge password of the CSR
+	// is used if it is empty.
+	Password string
+
+	// Certificate is the TLS client certificate, if any. A certificate
+	// issued by the CA authorizes the request like a SCEP renewal.
+	Certificate *x509.Certificate
+
+	// Reenroll is set for simplereenroll requests,
+	// which require such a certificate.
+	Reenroll bool
+}
+
+// ESTError rejects an EST request with an HTTP status
+// and a text explaining the rejection, if any.
+type ESTError struct {
+	StatusCode int
+	Text       string
+}
+
+func (e *ESTError) Error() string {
+	if e.Text == "" {
+		return "est: " + http.StatusText(e.StatusCode)
+	}
+	return "est: " + e.Text
+}
+
+// EST operations served by NewESTHandler.
+const (
+	estCACerts        = "cacerts"
+	estSimpleEnroll   = "simpleenroll"
+	estSimpleReenroll = "simplereenroll"
+)
+
+// estCertsHeader is the content type of EST certificate responses.
+const estCertsHeader = "application/pkcs7-mime; smime-type=certs-only"
+
+// estRetryAfter is the Retry-After sent with pending EST requests, in seconds.
+const estRetryAfter = "60"
+
+func (s *service) ESTCACerts(ctx context.Context) ([]*x509.Certificate, error) {
+	return s.authority().certs, nil
+}
+
+func (s *service) ESTEnroll(ctx context.Context, req *ESTRequest) (*x509.Certificate, error) {
+	ev := &AuditEvent{MessageType: estSimpleEnroll}
+	if req.Reenroll {
+		ev.MessageType = estSimpleReenroll
+	}
+	ev.Requester, _ = Requester(ctx)
+	crt, err := s.estEnroll(ctx, req, ev)
+	var d *denial
+	failure := err
+	if errors.Is(err, ErrPending) || errors.As(err, &d) {
+		failure = nil
+	}
+	if auditErr := s.audit(ctx, ev, failure); auditErr != nil && failure == nil {
+		return nil, auditErr
+	}
+	if d != nil {
+		status := http.StatusForbidden
+		switch {
+		case d.unauthorized:
+			status = http.StatusUnauthorized
+		case d.info == scep.BadRequest || d.info == scep.BadMessageCheck:
+			status = http.StatusBadRequest
+		}
+		return nil, &ESTError{StatusCode: status, Text: d.text}
+	}
+	return crt, err
+}
+
+func (s *service) estEnroll(ctx context.Context, req *ESTRequest, ev *AuditEvent) (*x509.Certificate, error) {
+	logger := s.logger.With("operation", ev.MessageType)
+	var msgType scep.MessageType = scep.PKCSReq
+	if req.Reenroll {
+		msgType = scep.RenewalReq
+		issued := false
+		if req.Certificate != nil {
+			var err error
+			if issued, err = s.issued(req.Certificate); err != nil {
+				return nil, err
+			}
+		}
+		if !issued {
+			logger.Info("rejected reenrollment without a certificate issued by the CA")
+			d := newDenial(ev, scep.BadRequest, "reenrollment requires a client certificate issued by the CA", true)
+			d.unauthorized = true
+			return nil, d
+		}
+	}
+	if req.Certificate != nil {
+		ev.Signer = req.Certificate.Subject.String()
+	}
+	challenge := req.Password
+	if challenge == "" {
+		var err error
+		if challenge, err = x509util.ParseChallengePassword(req.CSR.Raw); err != nil {
+			return nil, newDenial(ev, scep.BadRequest, "parse challenge password: "+err.Error(), true)
+		}
+	}
+	return s.enroll(ctx, &enrollRequest{
+		messageType: msgType,
+		csr:         req.CSR,
+		challenge:   challenge,
+		signer:      req.Certificate,
+	}, ev, logger)
+}
+
+// NewESTHandler serves the EST operations cacerts, simpleenroll and
+// simplereenroll of svc, on any path ending with the operation, such as
+// /.well-known/est/simpleenroll. Clients authenticate with a challenge
+// password, as password of HTTP basic authentication or in the CSR,
+// or with a TLS client certificate issued by the CA.
+func NewESTHandler(svc ESTService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if _, ok := Requester(ctx); !ok {
+			ctx = WithRequester(ctx, r.RemoteAddr)
+		}
+		op := path.Base(r.URL.Path)
+		switch op {
+		case estCACerts:
+			if r.Method != http.MethodGet && r.Method != http.MethodHead {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			certs, err := svc.ESTCACerts(ctx)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			writeESTCerts(w, certs)
+		case estSimpleEnroll, estSimpleReenroll:
+			if r.Method != http.MethodPost {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			csr, err := readESTCSR(r)
+			var maxBytesErr *http.MaxBytesError
+			if errors.Is(err, ErrPayloadTooLarge) || errors.As(err, &maxBytesErr) {
+				http.Error(w, "request too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			req := &ESTRequest{CSR: csr, Reenroll: op == estSimpleReenroll}
+			_, req.Password, _ = r.BasicAuth()
+			if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+				req.Certificate = r.TLS.PeerCertificates[0]
+			}
+			crt, err := svc.ESTEnroll(ctx, req)
+			var estErr *ESTError
+			switch {
+			case errors.Is(err, ErrPending):
+				w.Header().Set("Retry-After", estRetryAfter)
+				w.WriteHeader(http.StatusAccepted)
+			case errors.As(err, &estErr):
+				if estErr.StatusCode == http.StatusUnauthorized {
+					w.Header().Set("WWW-Authenticate", `Basic realm="EST"`)
+				}
+				text := estErr.Text
+				if text == "" {
+					text = http.StatusText(estErr.StatusCode)
+				}
+				http.Error(w, text, estErr.StatusCode)
+			case err != nil:
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			default:
+				writeESTCerts(w, []*x509.Certificate{crt})
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+// readESTCSR reads the base64 encoded PKCS #10 CSR of an enrollment request.
+func readESTCSR(r *http.Request) (*x509.CertificateRequest, error) {
+	if ct := r.Header.Get("Content-Type"); ct != "" && !strings.HasPrefix(ct, "application/pkcs10") {
+		return nil, fmt.Errorf("est: unexpected content type %q", ct)
+	}
+	data, err := readLimited(r.Body, maxPayloadSize)
+	if err != nil {
+		return nil, err
+	}
+	// base64 lines are wrapped, as in MIME
+	der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(data)), ""))
+	if err != nil {
+		return nil, errors.New("est: CSR is not base64 encoded")
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return nil, fmt.Errorf("est: parse CSR: %w", err)
+	}
+	return csr, nil
+}
+
+// writeESTCerts writes certs as base64 encoded
+// PKCS #7 certs-only response.
+func writeESTCerts(w http.ResponseWriter, certs []*x509.Certificate) {
+	data, err := scep.DegenerateCertificates(certs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", estCertsHeader)
+	w.Header().Set("Content-Transfer-Encoding", "base64")
+	w.Write([]byte(base64.StdEncoding.EncodeToString(data)))
+}
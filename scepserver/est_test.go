@@ -0,0 +1,173 @@
+package scepserver_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"scepclient/scep"
+	"scepclient/scepserver"
+	"scepclient/scepserver/depot/file"
+)
+
+// estPost posts a CSR for key to the EST operation op of server,
+// and returns the status and the issued certificate, if any.
+func estPost(t *testing.T, client *http.Client, url, op, password string, key *rsa.PrivateKey) (int, *x509.Certificate) {
+	t.Helper()
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: "device"},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest(http.MethodPost, url+"/.well-known/est/"+op, strings.NewReader(base64.StdEncoding.EncodeToString(der)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/pkcs10")
+	if password != "" {
+		req.SetBasicAuth("device", password)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode == http.StatusUnauthorized && resp.Header.Get("WWW-Authenticate") == "" {
+		t.Error("expected a WWW-Authenticate header")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, nil
+	}
+	certs := estCerts(t, resp.Header, body)
+	return resp.StatusCode, certs[0]
+}
+
+func estCerts(t *testing.T, header http.Header, body []byte) []*x509.Certificate {
+	t.Helper()
+	if ct := header.Get("Content-Type"); !strings.HasPrefix(ct, "application/pkcs7-mime") {
+		t.Errorf("unexpected content type %q", ct)
+	}
+	data, err := base64.StdEncoding.DecodeString(string(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs, err := scep.CACerts(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certs
+}
+
+func TestESTHandler(t *testing.T) {
+	depot, err := file.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := depot.CreateCA(nil, pkix.Name{CommonName: "test CA"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	var events []*scepserver.AuditEvent
+	auditor := scepserver.AuditorFunc(func(ctx context.Context, ev *scepserver.AuditEvent) error {
+		events = append(events, ev)
+		return nil
+	})
+	svc, err := scepserver.NewService(depot,
+		scepserver.WithChallengePassword("secret"),
+		scepserver.WithAuditor(auditor),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/.well-known/est/", scepserver.NewESTHandler(svc.(scepserver.ESTService)))
+	server := httptest.NewUnstartedServer(mux)
+	server.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	server.StartTLS()
+	defer server.Close()
+	client := server.Client()
+
+	resp, err := client.Get(server.URL + "/.well-known/est/cacerts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	caCerts := estCerts(t, resp.Header, body)
+	if len(caCerts) != 1 || caCerts[0].Subject.CommonName != "test CA" {
+		t.Fatalf("expected the CA certificate, got %d certificates", len(caCerts))
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := estPost(t, client, server.URL, "simpleenroll", "", key); status != http.StatusUnauthorized {
+		t.Errorf("expected 401 without a password, got %d", status)
+	}
+	if status, _ := estPost(t, client, server.URL, "simpleenroll", "wrong", key); status != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a wrong password, got %d", status)
+	}
+	status, crt := estPost(t, client, server.URL, "simpleenroll", "secret", key)
+	if status != http.StatusOK {
+		t.Fatalf("expected 200, got %d", status)
+	}
+	if err := crt.CheckSignatureFrom(caCerts[0]); err != nil {
+		t.Errorf("expected a certificate issued by the CA: %v", err)
+	}
+	if status, _ := estPost(t, client, server.URL, "simplereenroll", "secret", key); status != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a reenrollment without client certificate, got %d", status)
+	}
+
+	// reenroll with the issued certificate as TLS client certificate
+	transport := client.Transport.(*http.Transport).Clone()
+	transport.TLSClientConfig.Certificates = []tls.Certificate{{Certificate: [][]byte{crt.Raw}, PrivateKey: key}}
+	tlsClient := &http.Client{Transport: transport}
+	if status, _ := estPost(t, tlsClient, server.URL, "simplereenroll", "", key); status != http.StatusOK {
+		t.Errorf("expected a reenrollment with the client certificate, got %d", status)
+	}
+
+	// but not once the certificate is revoked
+	if err := depot.Revoke(crt.SerialNumber, 1, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := estPost(t, tlsClient, server.URL, "simplereenroll", "", key); status != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a reenrollment with a revoked certificate, got %d", status)
+	}
+
+	// requests awaiting approval are answered with 202
+	approver := scepserver.ApproverFunc(func(ctx context.Context, req *scepserver.ApprovalRequest) (scepserver.Decision, error) {
+		return scepserver.Pending, nil
+	})
+	pendingSvc, err := scepserver.NewService(depot, scepserver.WithApprover(approver), scepserver.WithAuditor(auditor))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux.Handle("/pending/.well-known/est/", scepserver.NewESTHandler(pendingSvc.(scepserver.ESTService)))
+	if status, _ := estPost(t, client, server.URL+"/pending", "simpleenroll", "", key); status != http.StatusAccepted {
+		t.Errorf("expected 202 for a pending request, got %d", status)
+	}
+
+	var outcomes []string
+	for _, ev := range events {
+		outcomes = append(outcomes, ev.MessageType+" "+string(ev.Outcome))
+	}
+	want := "simpleenroll denied, simpleenroll denied, simpleenroll issued, simplereenroll denied, simplereenroll issued, simplereenroll denied, simpleenroll pending"
+	if got := strings.Join(outcomes, ", "); got != want {
+		t.Errorf("expected audit events %s, got %s", want, got)
+	}
+}
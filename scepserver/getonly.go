@@ -0,0 +1,31 @@
+package scepserver
+
+import (
+	"context"
+	"io"
+)
+
+// GETOnlyMiddleware sends the requests the client would POST with GET,
+// for proxies which advertise POSTPKIOperation, the capability of the
+// CA behind them, but only forward GET requests.
+func GETOnlyMiddleware() Middleware {
+	return func(next Transport) Transport {
+		return getOnlyTransport{next: next}
+	}
+}
+
+type getOnlyTransport struct {
+	next Transport
+}
+
+func (t getOnlyTransport) SendGet(ctx context.Context, req SCEPRequest) (SCEPResponse, error) {
+	return t.next.SendGet(ctx, req)
+}
+
+func (t getOnlyTransport) SendPost(ctx context.Context, req SCEPRequest) (SCEPResponse, error) {
+	return t.next.SendGet(ctx, req)
+}
+
+func (t getOnlyTransport) StreamGet(ctx context.Context, req SCEPRequest) (io.ReadCloser, SCEPResponse, error) {
+	return StreamGet(ctx, t.next, req)
+}
@@ -0,0 +1,61 @@
+package scepserver
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// NewHTTPHandler serves the SCEP operations of svc over HTTP,
+// on any path, as a SCEP server does on /cgi-bin/pkiclient.exe.
+// PKIOperation messages are accepted with GET and POST.
+func NewHTTPHandler(svc Service) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if _, ok := Requester(ctx); !ok {
+			ctx = WithRequester(ctx, r.RemoteAddr)
+		}
+		op := r.URL.Query().Get("operation")
+		resp := SCEPResponse{operation: op}
+		switch op {
+		case getCACaps:
+			resp.Data, resp.Err = svc.GetCACaps(ctx)
+		case getCACert:
+			resp.Data, resp.CACertNum, resp.Err = svc.GetCACert(ctx)
+		case pkiOperation:
+			msg, err := message(r)
+			var maxBytesErr *http.MaxBytesError
+			if errors.Is(err, ErrPayloadTooLarge) || errors.As(err, &maxBytesErr) {
+				http.Error(w, "message too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			resp.Data, resp.Err = svc.PKIOperation(ctx, msg)
+		case getNextCACert:
+			resp.Data, resp.Err = svc.GetNextCACert(ctx)
+		default:
+			http.Error(w, "unknown or missing operation", http.StatusBadRequest)
+			return
+		}
+		encodeSCEPResponse(ctx, w, resp)
+	})
+}
+
+// decodeMessage decodes the base64 message parameter of a GET request.
+// Clients use both the standard and the URL alphabet, and some don't
+// escape '+', which arrives as a space.
+func decodeMessage(msg string) ([]byte, error) {
+	msg = strings.Replace(msg, " ", "+", -1)
+	data, err := base64.StdEncoding.DecodeString(msg)
+	if err != nil {
+		data, err = base64.URLEncoding.DecodeString(msg)
+	}
+	if err != nil {
+		return nil, errors.New("scep: message parameter is not base64 encoded")
+	}
+	return data, nil
+}
@@ -0,0 +1,262 @@
+// Package har records the HTTP exchanges of a SCEP client in the HTTP
+// Archive (HAR) format, to attach to interoperability bug reports.
+//
+// Credentials in the Authorization, Proxy-Authorization, Cookie and
+// Set-Cookie headers, in the headers passed to Recorder.Redact, and in
+// the URL, are redacted. SCEP messages are
+// recorded in full; the challenge password they may contain is
+// encrypted for the CA.
+package har
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxBodySize is the number of bytes of a body which are recorded.
+const maxBodySize = 4 << 20
+
+const redacted = "REDACTED"
+
+var sensitiveHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+	"Set-Cookie":          true,
+}
+
+// Recorder records HTTP exchanges. It is safe for concurrent use.
+type Recorder struct {
+	mtx     sync.Mutex
+	entries []entry
+	redact  map[string]bool
+}
+
+// Redact redacts the values of the headers names as well, such as API
+// keys and other credentials set as custom headers.
+func (rec *Recorder) Redact(names ...string) {
+	rec.mtx.Lock()
+	defer rec.mtx.Unlock()
+	if rec.redact == nil {
+		rec.redact = make(map[string]bool)
+	}
+	for _, name := range names {
+		rec.redact[http.CanonicalHeaderKey(name)] = true
+	}
+}
+
+func (rec *Recorder) sensitive(name string) bool {
+	name = http.CanonicalHeaderKey(name)
+	return sensitiveHeaders[name] || rec.redact[name]
+}
+
+// Wrap returns a RoundTripper recording the exchanges of next.
+// Use it with scepserver.WithRoundTripper.
+func (rec *Recorder) Wrap(next http.RoundTripper) http.RoundTripper {
+	return &roundTripper{next: next, rec: rec}
+}
+
+// WriteTo writes the recorded exchanges to w as a HAR document.
+func (rec *Recorder) WriteTo(w io.Writer) (int64, error) {
+	rec.mtx.Lock()
+	doc := document{Log: log{
+		Version: "1.2",
+		Creator: creator{Name: "scepclient", Version: "1"},
+		Entries: append([]entry{}, rec.entries...),
+	}}
+	rec.mtx.Unlock()
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(data)
+	return int64(n), err
+}
+
+// WriteFile writes the recorded exchanges to the file at path.
+func (rec *Recorder) WriteFile(path string) error {
+	var buf bytes.Buffer
+	if _, err := rec.WriteTo(&buf); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, buf.Bytes(), 0600)
+}
+
+type roundTripper struct {
+	next http.RoundTripper
+	rec  *Recorder
+}
+
+func (rt *roundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	var reqBody []byte
+	if r.GetBody != nil {
+		if body, err := r.GetBody(); err == nil {
+			reqBody, _ = ioutil.ReadAll(io.LimitReader(body, maxBodySize))
+			body.Close()
+		}
+	}
+	start := time.Now()
+	resp, err := rt.next.RoundTrip(r)
+
+	rt.rec.mtx.Lock()
+	defer rt.rec.mtx.Unlock()
+	e := entry{
+		StartedDateTime: start.Format(time.RFC3339Nano),
+		Request:         newRequest(r, reqBody, rt.rec.sensitive),
+		Cache:           struct{}{},
+	}
+	if err != nil {
+		e.Comment = err.Error()
+		e.Response = response{Headers: []nameValue{}, Cookies: []nameValue{}, HeadersSize: -1, BodySize: -1}
+	} else {
+		// record the beginning of the body and hand the
+		// complete body on to the caller
+		respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxBodySize))
+		resp.Body = readCloser{Reader: io.MultiReader(bytes.NewReader(respBody), resp.Body), Closer: resp.Body}
+		e.Response = newResponse(resp, respBody, rt.rec.sensitive)
+	}
+	elapsed := float64(time.Since(start)) / float64(time.Millisecond)
+	e.Time = elapsed
+	e.Timings = timings{Send: 0, Wait: elapsed, Receive: 0}
+
+	rt.rec.entries = append(rt.rec.entries, e)
+	return resp, err
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func newRequest(r *http.Request, body []byte, sensitive func(string) bool) request {
+	u := *r.URL
+	u.User = nil
+	req := request{
+		Method:      r.Method,
+		URL:         u.String(),
+		HTTPVersion: r.Proto,
+		Headers:     headers(r.Header, sensitive),
+		QueryString: []nameValue{},
+		Cookies:     []nameValue{},
+		HeadersSize: -1,
+		BodySize:    len(body),
+	}
+	for name, values := range u.Query() {
+		for _, value := range values {
+			req.QueryString = append(req.QueryString, nameValue{Name: name, Value: value})
+		}
+	}
+	if len(body) > 0 {
+		req.PostData = &postData{
+			MimeType: r.Header.Get("Content-Type"),
+			Text:     base64.StdEncoding.EncodeToString(body),
+			Encoding: "base64",
+		}
+	}
+	return req
+}
+
+func newResponse(resp *http.Response, body []byte, sensitive func(string) bool) response {
+	return response{
+		Status:      resp.StatusCode,
+		StatusText:  http.StatusText(resp.StatusCode),
+		HTTPVersion: resp.Proto,
+		Headers:     headers(resp.Header, sensitive),
+		Cookies:     []nameValue{},
+		Content: content{
+			Size:     len(body),
+			MimeType: resp.Header.Get("Content-Type"),
+			Text:     base64.StdEncoding.EncodeToString(body),
+			Encoding: "base64",
+		},
+		RedirectURL: resp.Header.Get("Location"),
+		HeadersSize: -1,
+		BodySize:    len(body),
+	}
+}
+
+func headers(h http.Header, sensitive func(string) bool) []nameValue {
+	list := []nameValue{}
+	for name, values := range h {
+		for _, value := range values {
+			if sensitive(name) {
+				value = redacted
+			}
+			list = append(list, nameValue{Name: name, Value: value})
+		}
+	}
+	return list
+}
+
+// The HAR 1.2 format, see http://www.softwareishard.com/blog/har-12-spec/.
+type (
+	document struct {
+		Log log `json:"log"`
+	}
+	log struct {
+		Version string  `json:"version"`
+		Creator creator `json:"creator"`
+		Entries []entry `json:"entries"`
+	}
+	creator struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	}
+	entry struct {
+		StartedDateTime string   `json:"startedDateTime"`
+		Time            float64  `json:"time"`
+		Request         request  `json:"request"`
+		Response        response `json:"response"`
+		Cache           struct{} `json:"cache"`
+		Timings         timings  `json:"timings"`
+		Comment         string   `json:"comment,omitempty"`
+	}
+	request struct {
+		Method      string      `json:"method"`
+		URL         string      `json:"url"`
+		HTTPVersion string      `json:"httpVersion"`
+		Headers     []nameValue `json:"headers"`
+		QueryString []nameValue `json:"queryString"`
+		Cookies     []nameValue `json:"cookies"`
+		PostData    *postData   `json:"postData,omitempty"`
+		HeadersSize int         `json:"headersSize"`
+		BodySize    int         `json:"bodySize"`
+	}
+	response struct {
+		Status      int         `json:"status"`
+		StatusText  string      `json:"statusText"`
+		HTTPVersion string      `json:"httpVersion"`
+		Headers     []nameValue `json:"headers"`
+		Cookies     []nameValue `json:"cookies"`
+		Content     content     `json:"content"`
+		RedirectURL string      `json:"redirectURL"`
+		HeadersSize int         `json:"headersSize"`
+		BodySize    int         `json:"bodySize"`
+	}
+	nameValue struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	}
+	postData struct {
+		MimeType string `json:"mimeType"`
+		Text     string `json:"text"`
+		Encoding string `json:"encoding,omitempty"`
+	}
+	content struct {
+		Size     int    `json:"size"`
+		MimeType string `json:"mimeType"`
+		Text     string `json:"text,omitempty"`
+		Encoding string `json:"encoding,omitempty"`
+	}
+	timings struct {
+		Send    float64 `json:"send"`
+		Wait    float64 `json:"wait"`
+		Receive float64 `json:"receive"`
+	}
+)
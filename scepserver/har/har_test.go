@@ -0,0 +1,67 @@
+package har
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"scepclient/scepserver"
+)
+
+func TestRecorder(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-pki-message")
+		w.Write([]byte("certrep"))
+	}))
+	defer srv.Close()
+
+	var rec Recorder
+	rec.Redact("x-api-key", "X-Tenant-Token")
+	transport, err := scepserver.NewHTTPTransport(srv.URL,
+		scepserver.WithBasicAuth("user", "secret"),
+		scepserver.WithHeader("X-API-Key", "api-secret"),
+		scepserver.WithHeader("X-Tenant-Token", "tenant-secret"),
+		scepserver.WithHeader("X-Tenant", "acme"),
+		scepserver.WithRoundTripper(rec.Wrap),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := transport.SendPost(context.Background(), scepserver.SCEPRequest{Operation: "PKIOperation", Message: []byte("pkcsreq")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp.Data) != "certrep" {
+		t.Errorf("expected the response body to be passed on, got %q", resp.Data)
+	}
+
+	var buf bytes.Buffer
+	if _, err := rec.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(buf.Bytes(), []byte("dXNlcjpzZWNyZXQ=")) {
+		t.Error("expected the Authorization header to be redacted")
+	}
+	for _, secret := range []string{"api-secret", "tenant-secret"} {
+		if bytes.Contains(buf.Bytes(), []byte(secret)) {
+			t.Errorf("expected the header with %s to be redacted", secret)
+		}
+	}
+	if !bytes.Contains(buf.Bytes(), []byte(`"acme"`)) {
+		t.Error("expected headers not marked to be recorded")
+	}
+	var doc document
+	if err := json.Unmarshal(buf.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.Log.Entries) != 1 {
+		t.Fatalf("expected 1 entry, got %d", len(doc.Log.Entries))
+	}
+	e := doc.Log.Entries[0]
+	if e.Request.Method != "POST" || e.Request.PostData == nil || e.Response.Status != http.StatusOK {
+		t.Errorf("unexpected entry %+v", e)
+	}
+}
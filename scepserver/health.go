@@ -0,0 +1,66 @@
+package scepserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Pinger is implemented by depots backed by a remote database,
+// which may become unreachable while the server runs.
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// HealthChecker is implemented by the Service of NewService.
+type HealthChecker interface {
+	// Health returns an error if the service cannot issue certificates,
+	// because its CA certificate is not valid or its depot is unreachable.
+	Health(ctx context.Context) error
+}
+
+// HealthCheckerFunc adapts a function to the HealthChecker interface.
+type HealthCheckerFunc func(ctx context.Context) error
+
+// Health calls f.
+func (f HealthCheckerFunc) Health(ctx context.Context) error {
+	return f(ctx)
+}
+
+func (s *service) Health(ctx context.Context) error {
+	ca := s.authority().certs[0]
+	now := s.clock.Now()
+	if now.Before(ca.NotBefore) {
+		return errors.New("CA certificate is not valid yet")
+	}
+	if now.After(ca.NotAfter) {
+		return errors.New("CA certificate has expired")
+	}
+	if pinger, ok := s.depot.(Pinger); ok {
+		if err := pinger.Ping(ctx); err != nil {
+			return fmt.Errorf("depot: %w", err)
+		}
+	}
+	return nil
+}
+
+// NewHealthHandler answers health checks of load balancers and
+// orchestrators on any path, with 200 if health reports no error,
+// and 503 and the error otherwise.
+func NewHealthHandler(health HealthChecker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		if err := health.Health(r.Context()); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte("ok\n"))
+	})
+}
@@ -0,0 +1,52 @@
+package scepserver
+
+import (
+	"context"
+	"net/http"
+)
+
+// Hooks are callbacks around the HTTP requests of the transport, for
+// signing gateways, custom authentication, logging or caching without
+// replacing EncodeSCEPRequest and DecodeSCEPResponse. For hooks which
+// don't need the HTTP messages, a Middleware is usually simpler.
+type Hooks struct {
+	// BeforeRequest is called with the encoded request of the SCEP
+	// request req, just before it is sent. It may modify the request,
+	// for example to add a signature header. Returning an error aborts
+	// the request.
+	BeforeRequest func(ctx context.Context, req SCEPRequest, r *http.Request) error
+
+	// AfterResponse is called with the response to req before it is
+	// decoded. It may inspect or replace the response body. Returning
+	// an error discards the response.
+	AfterResponse func(ctx context.Context, req SCEPRequest, resp *http.Response) error
+}
+
+// hookChain calls the hooks registered with WithHooks. BeforeRequest
+// hooks are called in order, AfterResponse hooks in reverse order,
+// so that the first hooks are the outermost.
+type hookChain []Hooks
+
+func (c hookChain) before(ctx context.Context, req SCEPRequest, r *http.Request) error {
+	for _, h := range c {
+		if h.BeforeRequest == nil {
+			continue
+		}
+		if err := h.BeforeRequest(ctx, req, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c hookChain) after(ctx context.Context, req SCEPRequest, resp *http.Response) error {
+	for i := len(c) - 1; i >= 0; i-- {
+		if c[i].AfterResponse == nil {
+			continue
+		}
+		if err := c[i].AfterResponse(ctx, req, resp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
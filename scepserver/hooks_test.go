@@ -0,0 +1,47 @@
+package scepserver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestHooks(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(r.Header.Get("X-Signature")))
+	}))
+	defer srv.Close()
+
+	var calls []string
+	hook := func(name string) Hooks {
+		return Hooks{
+			BeforeRequest: func(ctx context.Context, req SCEPRequest, r *http.Request) error {
+				calls = append(calls, "before "+name)
+				r.Header.Set("X-Signature", name+":"+req.Operation)
+				return nil
+			},
+			AfterResponse: func(ctx context.Context, req SCEPRequest, resp *http.Response) error {
+				calls = append(calls, "after "+name)
+				return nil
+			},
+		}
+	}
+	transport, err := NewHTTPTransport(srv.URL, WithHooks(hook("outer")), WithHooks(hook("inner")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := transport.SendGet(context.Background(), SCEPRequest{Operation: getCACaps})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp.Data) != "inner:GetCACaps" {
+		t.Errorf("unexpected signature %q", resp.Data)
+	}
+	want := []string{"before outer", "before inner", "after inner", "after outer"}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("expected calls %v, got %v", want, calls)
+	}
+}
@@ -0,0 +1,251 @@
+package scepserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"time"
+)
+
+// HTTPOption configures the HTTP transport.
+type HTTPOption func(*httpTransport)
+
+// WithHTTPClient sets the http.Client used to send requests.
+// Options configuring the connection, such as WithRoundTripper,
+// have no effect when a client is provided.
+func WithHTTPClient(client *http.Client) HTTPOption {
+	return func(t *httpTransport) {
+		t.client = client
+	}
+}
+
+// WithRoundTripper wraps the http.RoundTripper of the transport, for
+// example to add an authentication scheme. Wrappers are applied in
+// order, so the last one is the outermost.
+func WithRoundTripper(wrap func(http.RoundTripper) http.RoundTripper) HTTPOption {
+	return func(t *httpTransport) {
+		t.wrappers = append(t.wrappers, wrap)
+	}
+}
+
+// WithUserAgent sets the User-Agent header of all requests.
+func WithUserAgent(userAgent string) HTTPOption {
+	return func(t *httpTransport) {
+		t.header.Set("User-Agent", userAgent)
+	}
+}
+
+// WithHeader adds a header to all requests, for example an
+// API key required by a SCEP gateway.
+func WithHeader(key, value string) HTTPOption {
+	return func(t *httpTransport) {
+		t.header.Add(key, value)
+	}
+}
+
+// WithBasicAuth authenticates all requests with HTTP Basic authentication,
+// as required by some RA front-ends protecting the SCEP path.
+func WithBasicAuth(username, password string) HTTPOption {
+	return func(t *httpTransport) {
+		t.username = username
+		t.password = password
+	}
+}
+
+// WithTLSConfig sets the TLS configuration of the connection, for example
+// to trust a private root CA. It replaces the configuration set by earlier
+// options, so use it before the other TLS options.
+func WithTLSConfig(config *tls.Config) HTTPOption {
+	return func(t *httpTransport) {
+		t.base.TLSClientConfig = config.Clone()
+	}
+}
+
+// WithRootCAs verifies the certificates of HTTPS servers with the
+// roots of pool, instead of the system roots, for example with the
+// root of a private CA serving SCEP itself.
+func WithRootCAs(pool *x509.CertPool) HTTPOption {
+	return func(t *httpTransport) {
+		t.tlsConfig().RootCAs = pool
+	}
+}
+
+// WithClientCertificate presents cert to HTTPS servers requesting a client
+// certificate, such as reverse proxies requiring mutual TLS in front of the
+// SCEP server. For renewals this can be the certificate issued by the CA.
+func WithClientCertificate(cert tls.Certificate) HTTPOption {
+	return func(t *httpTransport) {
+		config := t.tlsConfig()
+		config.Certificates = append(config.Certificates, cert)
+	}
+}
+
+// WithTLSVersions sets the minimum and maximum TLS versions, such as
+// tls.VersionTLS12, for example to disable TLS 1.0 and 1.1 or to allow
+// them for old appliances. Zero keeps the default of the crypto/tls
+// package.
+func WithTLSVersions(min, max uint16) HTTPOption {
+	return func(t *httpTransport) {
+		config := t.tlsConfig()
+		config.MinVersion = min
+		config.MaxVersion = max
+	}
+}
+
+// WithCipherSuites restricts the TLS 1.0-1.2 cipher suites offered to
+// the server. TLS 1.3 cipher suites are not configurable.
+func WithCipherSuites(ids ...uint16) HTTPOption {
+	return func(t *httpTransport) {
+		t.tlsConfig().CipherSuites = ids
+	}
+}
+
+// WithHTTP2 enables or disables HTTP/2 for HTTPS servers.
+// It is enabled by default.
+func WithHTTP2(enabled bool) HTTPOption {
+	return func(t *httpTransport) {
+		t.base.ForceAttemptHTTP2 = enabled
+		if !enabled {
+			// a non-nil, empty map disables HTTP/2
+			t.base.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+			// once http.DefaultTransport was used, its clone still
+			// offers h2 to servers, which then expect HTTP/2
+			if config := t.base.TLSClientConfig; config != nil {
+				var protos []string
+				for _, proto := range config.NextProtos {
+					if proto != "h2" {
+						protos = append(protos, proto)
+					}
+				}
+				config.NextProtos = protos
+			}
+		} else {
+			t.base.TLSNextProto = nil
+		}
+	}
+}
+
+// WithIdleConnections sets how many idle connections are kept open per
+// host, and for how long, so that poll loops reuse connections instead
+// of completing a new TLS handshake for every GetCertInitial request.
+// An idleTimeout of zero keeps idle connections open indefinitely.
+func WithIdleConnections(maxPerHost int, idleTimeout time.Duration) HTTPOption {
+	return func(t *httpTransport) {
+		t.base.MaxIdleConnsPerHost = maxPerHost
+		t.base.IdleConnTimeout = idleTimeout
+	}
+}
+
+// WithKeepAlive sets the interval of TCP keep-alive probes on
+// connections to the server. A negative interval disables them.
+func WithKeepAlive(interval time.Duration) HTTPOption {
+	return func(t *httpTransport) {
+		t.dialer.KeepAlive = interval
+	}
+}
+
+// WithResolver sets the resolver used to look up the server,
+// for example one querying a specific DNS server.
+func WithResolver(resolver *net.Resolver) HTTPOption {
+	return func(t *httpTransport) {
+		t.dialer.Resolver = resolver
+	}
+}
+
+// WithResolve connects to addr whenever a connection to hostport is made,
+// like curl's --resolve, for example to reach the CA before DNS is set up
+// or in split-horizon networks. If addr has no port, the port of hostport
+// is used. TLS still verifies the server certificate for hostport.
+func WithResolve(hostport, addr string) HTTPOption {
+	return func(t *httpTransport) {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			if _, port, err := net.SplitHostPort(hostport); err == nil {
+				addr = net.JoinHostPort(addr, port)
+			}
+		}
+		if t.dialer.hosts == nil {
+			t.dialer.hosts = make(map[string]string)
+		}
+		t.dialer.hosts[hostport] = addr
+	}
+}
+
+// WithRedirectPolicy sets the redirects followed by the transport,
+// replacing DefaultRedirectPolicy.
+func WithRedirectPolicy(policy RedirectPolicy) HTTPOption {
+	return func(t *httpTransport) {
+		t.redirect = policy
+	}
+}
+
+// WithStrictContentType rejects responses whose Content-Type does not
+// match the operation with a *ContentTypeError. By default the transport
+// is lenient and accepts any content type, as some CAs don't comply.
+func WithStrictContentType(strict bool) HTTPOption {
+	return func(t *httpTransport) {
+		t.strictContentType = strict
+	}
+}
+
+// WithHooks adds hooks called around every HTTP request.
+// It can be used more than once to build a chain of hooks.
+func WithHooks(hooks Hooks) HTTPOption {
+	return func(t *httpTransport) {
+		t.hooks = append(t.hooks, hooks)
+	}
+}
+
+// WithNetwork restricts connections to IPv4 with "tcp4" or to IPv6 with
+// "tcp6", for networks which are IPv6-only or have broken IPv6 routes
+// to the CA. The default "tcp" uses both.
+func WithNetwork(network string) HTTPOption {
+	return func(t *httpTransport) {
+		t.dialer.network = network
+	}
+}
+
+// WithFallbackDelay sets how long a dual-stack connection attempt waits
+// for the preferred address family before trying the other one in
+// parallel (Happy Eyeballs, RFC 6555). The default is 300ms; a negative
+// delay disables the fallback.
+func WithFallbackDelay(delay time.Duration) HTTPOption {
+	return func(t *httpTransport) {
+		t.dialer.FallbackDelay = delay
+	}
+}
+
+// WithRequestIDHeader sends the correlation ID of each request,
+// if any, in the header name, for example X-Request-ID.
+func WithRequestIDHeader(name string) HTTPOption {
+	return func(t *httpTransport) {
+		t.requestIDHeader = name
+	}
+}
+
+// WithCompression enables or disables requesting compressed responses.
+// It is enabled by default. Compressed responses are decoded either way,
+// as some reverse proxies compress them regardless.
+func WithCompression(enabled bool) HTTPOption {
+	return func(t *httpTransport) {
+		t.noCompression = !enabled
+		t.base.DisableCompression = !enabled
+	}
+}
+
+// WithoutPathRewrite sends requests to the server URL exactly
+// as given, instead of completing it with ExpandServerURL.
+func WithoutPathRewrite() HTTPOption {
+	return func(t *httpTransport) {
+		t.noPathRewrite = true
+	}
+}
+
+// WithStandardBase64 encodes the message of GET requests in standard
+// base64, escaped in the query, as RFC 8894 specifies, instead of the
+// URL-safe alphabet most servers also accept.
+func WithStandardBase64() HTTPOption {
+	return func(t *httpTransport) {
+		t.stdBase64 = true
+	}
+}
@@ -0,0 +1,64 @@
+package scepserver
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestWithKeepAlive(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("POSTPKIOperation"))
+	}))
+	defer srv.Close()
+
+	// sockopt returns the socket option of the connection of a request
+	sockopt := func(t *testing.T, transport Transport, level, opt int) int {
+		var conn net.Conn
+		ctx := httptrace.WithClientTrace(context.Background(), &httptrace.ClientTrace{
+			GotConn: func(info httptrace.GotConnInfo) { conn = info.Conn },
+		})
+		if _, err := transport.SendGet(ctx, SCEPRequest{Operation: getCACaps}); err != nil {
+			t.Fatal(err)
+		}
+		raw, err := conn.(*net.TCPConn).SyscallConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var value int
+		if err := raw.Control(func(fd uintptr) {
+			value, err = syscall.GetsockoptInt(int(fd), level, opt)
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return value
+	}
+
+	transport, err := NewHTTPTransport(srv.URL, WithKeepAlive(42*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if on := sockopt(t, transport, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE); on != 1 {
+		t.Error("expected keep-alive probes to be enabled")
+	}
+	if idle := sockopt(t, transport, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE); idle != 42 {
+		t.Errorf("expected probes after 42s, got %ds", idle)
+	}
+
+	disabled, err := NewHTTPTransport(srv.URL, WithKeepAlive(-1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if on := sockopt(t, disabled, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE); on != 0 {
+		t.Error("expected keep-alive probes to be disabled")
+	}
+}
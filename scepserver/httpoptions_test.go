@@ -0,0 +1,257 @@
+package scepserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// tlsServer starts an HTTPS server for 127.0.0.1 with the TLS
+// configuration changed by configure, and returns it with the
+// pool of its root.
+func tlsServer(t *testing.T, handler http.Handler, configure func(*tls.Config)) (*httptest.Server, *x509.CertPool) {
+	ca, key := testTLSCA(t)
+	cert, err := NewServerCertificate(ca, key, []string{"127.0.0.1"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(handler)
+	// failed handshakes are expected
+	srv.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{*cert}}
+	if configure != nil {
+		configure(srv.TLS)
+	}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	return srv, roots
+}
+
+func TestWithClientCertificate(t *testing.T) {
+	peers := make(chan []*x509.Certificate, 1)
+	srv, roots := tlsServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peers <- r.TLS.PeerCertificates
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("POSTPKIOperation"))
+	}), func(config *tls.Config) {
+		config.ClientAuth = tls.RequireAnyClientCert
+	})
+
+	ca, key := testTLSCA(t)
+	cert, err := NewServerCertificate(ca, key, []string{"agent.example.com"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport, err := NewHTTPTransport(srv.URL, WithRootCAs(roots), WithClientCertificate(*cert))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := transport.SendGet(context.Background(), SCEPRequest{Operation: getCACaps}); err != nil {
+		t.Fatal(err)
+	}
+	if peer := <-peers; len(peer) == 0 || !bytes.Equal(peer[0].Raw, cert.Certificate[0]) {
+		t.Errorf("expected the server to receive the client certificate, got %d certificates", len(peer))
+	}
+
+	// the handshake fails without one
+	plain, err := NewHTTPTransport(srv.URL, WithRootCAs(roots))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := plain.SendGet(context.Background(), SCEPRequest{Operation: getCACaps}); err == nil {
+		t.Error("expected the request without a client certificate to fail")
+	}
+}
+
+func TestWithHTTP2(t *testing.T) {
+	srv, roots := tlsServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(r.Proto))
+	}), func(config *tls.Config) {
+		config.NextProtos = []string{"h2", "http/1.1"}
+	})
+	// sets up HTTP/2 on http.DefaultTransport, as its first use would
+	http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+
+	for _, tt := range []struct {
+		name string
+		opts []HTTPOption
+		want string
+	}{
+		{"default", nil, "HTTP/2.0"},
+		{"enabled", []HTTPOption{WithHTTP2(true)}, "HTTP/2.0"},
+		{"disabled", []HTTPOption{WithHTTP2(false)}, "HTTP/1.1"},
+		{"enabled again", []HTTPOption{WithHTTP2(false), WithHTTP2(true)}, "HTTP/2.0"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			transport, err := NewHTTPTransport(srv.URL, append([]HTTPOption{WithRootCAs(roots)}, tt.opts...)...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := transport.SendGet(context.Background(), SCEPRequest{Operation: getCACaps})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(resp.Data) != tt.want {
+				t.Errorf("expected %s, got %s", tt.want, resp.Data)
+			}
+		})
+	}
+}
+
+func TestWithIdleConnections(t *testing.T) {
+	var (
+		mtx   sync.Mutex
+		conns int
+	)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("POSTPKIOperation"))
+	}))
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mtx.Lock()
+			conns++
+			mtx.Unlock()
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	for _, tt := range []struct {
+		name        string
+		idleTimeout time.Duration
+		want        int
+	}{
+		{"reused", time.Minute, 1},
+		{"expired", 10 * time.Millisecond, 2},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mtx.Lock()
+			conns = 0
+			mtx.Unlock()
+			var reused []bool
+			transport, err := NewHTTPTransport(srv.URL,
+				WithIdleConnections(1, tt.idleTimeout),
+				WithTrace(func(info TraceInfo) { reused = append(reused, info.Reused) }),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 2; i++ {
+				if i > 0 {
+					time.Sleep(100 * time.Millisecond)
+				}
+				if _, err := transport.SendGet(context.Background(), SCEPRequest{Operation: getCACaps}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			mtx.Lock()
+			defer mtx.Unlock()
+			if conns != tt.want {
+				t.Errorf("expected %d connections, got %d", tt.want, conns)
+			}
+			if want := []bool{false, tt.want == 1}; !reflect.DeepEqual(reused, want) {
+				t.Errorf("expected reused %v, got %v", want, reused)
+			}
+		})
+	}
+}
+
+// connectionState answers with the TLS version and
+// cipher suite of the connection.
+var connectionState = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(tls.VersionName(r.TLS.Version) + " " + tls.CipherSuiteName(r.TLS.CipherSuite)))
+})
+
+func TestWithTLSVersions(t *testing.T) {
+	tls13, roots13 := tlsServer(t, connectionState, func(config *tls.Config) {
+		config.MinVersion = tls.VersionTLS13
+	})
+	tls11, roots11 := tlsServer(t, connectionState, func(config *tls.Config) {
+		config.MinVersion = tls.VersionTLS10
+		config.MaxVersion = tls.VersionTLS11
+	})
+
+	for _, tt := range []struct {
+		name     string
+		srv      *httptest.Server
+		roots    *x509.CertPool
+		min, max uint16
+		want     string // the negotiated version, empty if the handshake fails
+	}{
+		{"TLS 1.3 server", tls13, roots13, 0, 0, "TLS 1.3"},
+		{"TLS 1.3 server, at most TLS 1.2", tls13, roots13, 0, tls.VersionTLS12, ""},
+		{"TLS 1.1 server", tls11, roots11, 0, 0, ""},
+		{"TLS 1.1 server, at least TLS 1.0", tls11, roots11, tls.VersionTLS10, 0, "TLS 1.1"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			transport, err := NewHTTPTransport(tt.srv.URL, WithRootCAs(tt.roots), WithTLSVersions(tt.min, tt.max))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := transport.SendGet(context.Background(), SCEPRequest{Operation: getCACaps})
+			if tt.want == "" {
+				if err == nil {
+					t.Errorf("expected the handshake to fail, got %s", resp.Data)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(string(resp.Data), tt.want+" ") {
+				t.Errorf("expected %s, got %s", tt.want, resp.Data)
+			}
+		})
+	}
+}
+
+func TestWithCipherSuites(t *testing.T) {
+	srv, roots := tlsServer(t, connectionState, func(config *tls.Config) {
+		config.MaxVersion = tls.VersionTLS12
+	})
+
+	for _, suite := range []uint16{
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+	} {
+		name := tls.CipherSuiteName(suite)
+		t.Run(name, func(t *testing.T) {
+			transport, err := NewHTTPTransport(srv.URL, WithRootCAs(roots), WithCipherSuites(suite))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := transport.SendGet(context.Background(), SCEPRequest{Operation: getCACaps})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := "TLS 1.2 " + name; string(resp.Data) != want {
+				t.Errorf("expected %s, got %s", want, resp.Data)
+			}
+		})
+	}
+
+	// RSA suites cannot be used with the ECDSA certificate of the server
+	transport, err := NewHTTPTransport(srv.URL, WithRootCAs(roots), WithCipherSuites(tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := transport.SendGet(context.Background(), SCEPRequest{Operation: getCACaps}); err == nil {
+		t.Error("expected the handshake to fail without a common cipher suite")
+	}
+}
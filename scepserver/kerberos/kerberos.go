@@ -0,0 +1,105 @@
+// Package kerberos adds Kerberos (SPNEGO) authentication to the SCEP HTTP
+// transport, for endpoints in Active Directory environments or behind
+// reverse proxies requiring Negotiate authentication.
+package kerberos
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/credentials"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+
+	"scepclient/scepserver"
+)
+
+// Config selects the Kerberos credentials used to authenticate.
+// Either Keytab with Username and Realm, or CCache must be set.
+type Config struct {
+	// Krb5Conf is the path of the krb5.conf file.
+	// Defaults to /etc/krb5.conf.
+	Krb5Conf string
+
+	// Keytab is the path of a keytab holding the key of Username@Realm.
+	Keytab   string
+	Username string
+	Realm    string
+
+	// CCache is the path of a credentials cache, for example
+	// one obtained with kinit.
+	CCache string
+
+	// SPN is the service principal of the SCEP server.
+	// Defaults to HTTP/<host of the request>.
+	SPN string
+}
+
+// NewClient logs in to the Kerberos realm with the configured credentials.
+func NewClient(c Config) (*client.Client, error) {
+	path := c.Krb5Conf
+	if path == "" {
+		path = "/etc/krb5.conf"
+	}
+	krb5conf, err := config.Load(path)
+	if err != nil {
+		return nil, fmt.Errorf("kerberos: load krb5.conf: %w", err)
+	}
+	switch {
+	case c.Keytab != "":
+		kt, err := keytab.Load(c.Keytab)
+		if err != nil {
+			return nil, fmt.Errorf("kerberos: load keytab: %w", err)
+		}
+		cl := client.NewWithKeytab(c.Username, c.Realm, kt, krb5conf, client.DisablePAFXFAST(true))
+		if err := cl.Login(); err != nil {
+			return nil, fmt.Errorf("kerberos: login with keytab: %w", err)
+		}
+		return cl, nil
+	case c.CCache != "":
+		ccache, err := credentials.LoadCCache(c.CCache)
+		if err != nil {
+			return nil, fmt.Errorf("kerberos: load credentials cache: %w", err)
+		}
+		cl, err := client.NewFromCCache(ccache, krb5conf, client.DisablePAFXFAST(true))
+		if err != nil {
+			return nil, fmt.Errorf("kerberos: use credentials cache: %w", err)
+		}
+		return cl, nil
+	default:
+		return nil, errors.New("kerberos: a keytab or credentials cache is required")
+	}
+}
+
+// Options returns HTTP transport options which authenticate
+// every request with a SPNEGO token for the configured SPN.
+func Options(c Config) ([]scepserver.HTTPOption, error) {
+	cl, err := NewClient(c)
+	if err != nil {
+		return nil, err
+	}
+	return []scepserver.HTTPOption{
+		scepserver.WithRoundTripper(func(next http.RoundTripper) http.RoundTripper {
+			return &roundTripper{next: next, client: cl, spn: c.SPN}
+		}),
+	}, nil
+}
+
+type roundTripper struct {
+	next   http.RoundTripper
+	client *client.Client
+	spn    string
+}
+
+func (rt *roundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	// SetSPNEGOHeader modifies the request, which a
+	// RoundTripper must not do to the caller's request.
+	r = r.Clone(r.Context())
+	if err := spnego.SetSPNEGOHeader(rt.client, r, rt.spn); err != nil {
+		return nil, fmt.Errorf("kerberos: set SPNEGO header: %w", err)
+	}
+	return rt.next.RoundTrip(r)
+}
@@ -0,0 +1,200 @@
+package kerberos
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jcmturner/goidentity/v6"
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+	"github.com/jcmturner/gokrb5/v8/types"
+
+	"scepclient/scepserver"
+)
+
+const (
+	realm = "EXAMPLE.COM"
+	spn   = "HTTP/scep.example.com"
+)
+
+const krb5Conf = `[libdefaults]
+  default_realm = EXAMPLE.COM
+[realms]
+  EXAMPLE.COM = {
+    kdc = 127.0.0.1:88
+  }
+`
+
+// ccacheWriter writes a version 4 credentials cache.
+type ccacheWriter struct{ bytes.Buffer }
+
+func (w *ccacheWriter) uint32(v uint32) { binary.Write(w, binary.BigEndian, v) }
+
+func (w *ccacheWriter) data(b []byte) {
+	w.uint32(uint32(len(b)))
+	w.Write(b)
+}
+
+func (w *ccacheWriter) principal(pn types.PrincipalName) {
+	w.uint32(uint32(pn.NameType))
+	w.uint32(uint32(len(pn.NameString)))
+	w.data([]byte(realm))
+	for _, s := range pn.NameString {
+		w.data([]byte(s))
+	}
+}
+
+// writeCCache writes the krb5.conf and a credentials cache of user
+// holding a TGT and a ticket for spn, issued with the keys of kt,
+// as kinit and a first request to the server would.
+func writeCCache(t *testing.T, kt *keytab.Keytab, user string) Config {
+	dir := t.TempDir()
+	cname := types.NewPrincipalName(nametype.KRB_NT_PRINCIPAL, user)
+	now := time.Now().Truncate(time.Second)
+
+	var w ccacheWriter
+	w.Write([]byte{5, 4, 0, 0}) // version 4, without header fields
+	w.principal(cname)
+	for _, sname := range []types.PrincipalName{
+		types.NewPrincipalName(nametype.KRB_NT_SRV_INST, "krbtgt/"+realm),
+		types.NewPrincipalName(nametype.KRB_NT_SRV_HST, spn),
+	} {
+		tkt, key, err := messages.NewTicket(cname, realm, sname, realm, types.NewKrbFlags(), kt,
+			etypeID.AES256_CTS_HMAC_SHA1_96, 1, now, now.Add(-time.Minute), now.Add(time.Hour), now.Add(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw, err := tkt.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.principal(cname)
+		w.principal(sname)
+		binary.Write(&w, binary.BigEndian, uint16(key.KeyType))
+		w.data(key.KeyValue)
+		for _, ts := range []time.Time{now, now.Add(-time.Minute), now.Add(time.Hour), now.Add(time.Hour)} {
+			w.uint32(uint32(ts.Unix()))
+		}
+		w.WriteByte(0) // not a session key ticket
+		w.uint32(0)    // flags
+		w.uint32(0)    // addresses
+		w.uint32(0)    // authorization data
+		w.data(raw)    // ticket
+		w.data(nil)    // second ticket
+	}
+
+	c := Config{
+		Krb5Conf: filepath.Join(dir, "krb5.conf"),
+		CCache:   filepath.Join(dir, "ccache"),
+		SPN:      spn,
+	}
+	if err := os.WriteFile(c.Krb5Conf, []byte(krb5Conf), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(c.CCache, w.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// serviceKeytab returns the keys of the KDC and of the SCEP server.
+func serviceKeytab(t *testing.T) *keytab.Keytab {
+	kt := keytab.New()
+	for _, princ := range []string{"krbtgt/" + realm, spn} {
+		if err := kt.AddEntry(princ, realm, "secret", time.Now(), 1, etypeID.AES256_CTS_HMAC_SHA1_96); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return kt
+}
+
+func TestOptions(t *testing.T) {
+	kt := serviceKeytab(t)
+	users := make(chan string, 1)
+	srv := httptest.NewServer(spnego.SPNEGOKRB5Authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		users <- goidentity.FromHTTPRequestContext(r).UserName()
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("POSTPKIOperation"))
+	}), kt))
+	defer srv.Close()
+
+	opts, err := Options(writeCCache(t, kt, "scep-agent"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport, err := scepserver.NewHTTPTransport(srv.URL, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := transport.SendGet(context.Background(), scepserver.SCEPRequest{Operation: "GetCACaps"}); err != nil {
+		t.Fatal(err)
+	}
+	if user := <-users; user != "scep-agent" {
+		t.Errorf("expected the server to authenticate scep-agent, got %q", user)
+	}
+}
+
+func TestRoundTripperClonesRequest(t *testing.T) {
+	kt := serviceKeytab(t)
+	cl, err := NewClient(writeCCache(t, kt, "scep-agent"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sent *http.Request
+	rt := &roundTripper{
+		next: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			sent = r
+			return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+		}),
+		client: cl,
+		spn:    spn,
+	}
+	req := httptest.NewRequest(http.MethodGet, "http://scep.example.com/cgi-bin/pkiclient.exe", nil)
+	if _, err := rt.RoundTrip(req); err != nil {
+		t.Fatal(err)
+	}
+	if auth := sent.Header.Get("Authorization"); !strings.HasPrefix(auth, "Negotiate ") {
+		t.Errorf("expected a Negotiate token, got %q", auth)
+	}
+	if auth := req.Header.Get("Authorization"); auth != "" {
+		t.Errorf("expected the caller's request to be left unchanged, got Authorization %q", auth)
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func TestNewClientErrors(t *testing.T) {
+	dir := t.TempDir()
+	conf := filepath.Join(dir, "krb5.conf")
+	if err := os.WriteFile(conf, []byte(krb5Conf), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name string
+		c    Config
+	}{
+		{"no credentials", Config{Krb5Conf: conf}},
+		{"missing krb5.conf", Config{Krb5Conf: filepath.Join(dir, "missing"), CCache: filepath.Join(dir, "ccache")}},
+		{"missing keytab", Config{Krb5Conf: conf, Keytab: filepath.Join(dir, "missing"), Username: "scep-agent", Realm: realm}},
+		{"missing credentials cache", Config{Krb5Conf: conf, CCache: filepath.Join(dir, "missing")}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Options(tt.c); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
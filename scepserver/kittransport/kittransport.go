@@ -0,0 +1,66 @@
+// Package kittransport provides a go-kit based SCEP client transport,
+// for applications which want to reuse go-kit client options and
+// endpoint middlewares. The default transport in package scepserver
+// only depends on net/http.
+package kittransport
+
+import (
+	"context"
+
+	"github.com/go-kit/kit/endpoint"
+	httptransport "github.com/go-kit/kit/transport/http"
+
+	"scepclient/scepserver"
+)
+
+// NewTransport creates a Transport for the SCEP server at instance,
+// using go-kit HTTP clients.
+func NewTransport(instance string, options ...httptransport.ClientOption) (scepserver.Transport, error) {
+	tgt, err := scepserver.ParseServerURL(instance)
+	if err != nil {
+		return nil, err
+	}
+
+	return EndpointTransport(
+		httptransport.NewClient(
+			"GET",
+			tgt,
+			scepserver.EncodeSCEPRequest,
+			scepserver.DecodeSCEPResponse,
+			options...).Endpoint(),
+		httptransport.NewClient(
+			"POST",
+			tgt,
+			scepserver.EncodeSCEPRequest,
+			scepserver.DecodeSCEPResponse,
+			options...).Endpoint(),
+	), nil
+}
+
+// EndpointTransport creates a Transport from a pair of go-kit endpoints,
+// which must accept a scepserver.SCEPRequest and return a
+// scepserver.SCEPResponse.
+func EndpointTransport(get, post endpoint.Endpoint) scepserver.Transport {
+	return &endpointTransport{get: get, post: post}
+}
+
+type endpointTransport struct {
+	get  endpoint.Endpoint
+	post endpoint.Endpoint
+}
+
+func (t *endpointTransport) SendGet(ctx context.Context, req scepserver.SCEPRequest) (scepserver.SCEPResponse, error) {
+	return send(ctx, t.get, req)
+}
+
+func (t *endpointTransport) SendPost(ctx context.Context, req scepserver.SCEPRequest) (scepserver.SCEPResponse, error) {
+	return send(ctx, t.post, req)
+}
+
+func send(ctx context.Context, e endpoint.Endpoint, req scepserver.SCEPRequest) (scepserver.SCEPResponse, error) {
+	response, err := e(ctx, req)
+	if err != nil {
+		return scepserver.SCEPResponse{}, err
+	}
+	return response.(scepserver.SCEPResponse), nil
+}
@@ -0,0 +1,120 @@
+package kms
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"scepclient/cloudauth"
+)
+
+// AWSConfig selects an asymmetric AWS KMS key with
+// the SIGN_VERIFY key usage.
+type AWSConfig struct {
+	// KeyID is the key ID, ARN or alias of the key.
+	KeyID string
+
+	// Region is the AWS region of the key.
+	Region string
+
+	// AccessKeyID, SecretAccessKey and SessionToken are the AWS
+	// credentials, which need the kms:GetPublicKey and kms:Sign
+	// permissions. SessionToken is only set for temporary credentials.
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+
+	// Endpoint is the URL of the KMS API,
+	// https://kms.<Region>.amazonaws.com by default.
+	Endpoint string
+
+	// Client sends the requests to AWS KMS.
+	// http.DefaultClient is used if it is nil.
+	Client *http.Client
+}
+
+// NewAWS returns a crypto.Signer signing with an AWS KMS key.
+// It fetches the public key of the key with ctx.
+func NewAWS(ctx context.Context, config AWSConfig) (crypto.Signer, error) {
+	if config.KeyID == "" || config.Region == "" {
+		return nil, errors.New("kms: AWS key ID and region are required")
+	}
+	if config.AccessKeyID == "" || config.SecretAccessKey == "" {
+		return nil, errors.New("kms: AWS credentials are required")
+	}
+	if config.Endpoint == "" {
+		config.Endpoint = "https://kms." + config.Region + ".amazonaws.com"
+	}
+	k := &awsKey{config: config}
+	var resp struct {
+		PublicKey []byte
+	}
+	if err := k.call(ctx, "GetPublicKey", map[string]string{"KeyId": config.KeyID}, &resp); err != nil {
+		return nil, fmt.Errorf("kms: get public key of %s: %w", config.KeyID, err)
+	}
+	pub, err := x509.ParsePKIXPublicKey(resp.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("kms: parse public key of %s: %w", config.KeyID, err)
+	}
+	var algorithm string
+	switch pub.(type) {
+	case *rsa.PublicKey:
+		algorithm = "RSASSA_PKCS1_V1_5_SHA_"
+	case *ecdsa.PublicKey:
+		algorithm = "ECDSA_SHA_"
+	default:
+		return nil, fmt.Errorf("kms: unsupported public key type %T", pub)
+	}
+	return &signer{
+		public: pub,
+		sign: func(ctx context.Context, digest []byte, hash crypto.Hash) ([]byte, error) {
+			req := struct {
+				KeyId            string
+				Message          []byte
+				MessageType      string
+				SigningAlgorithm string
+			}{config.KeyID, digest, "DIGEST", algorithm + hashBits(hash)}
+			var resp struct {
+				Signature []byte
+			}
+			if err := k.call(ctx, "Sign", req, &resp); err != nil {
+				return nil, fmt.Errorf("kms: sign with %s: %w", config.KeyID, err)
+			}
+			// ECDSA signatures are DER encoded already
+			return resp.Signature, nil
+		},
+	}, nil
+}
+
+type awsKey struct {
+	config AWSConfig
+}
+
+// call calls the action of the KMS JSON API,
+// signing the request with AWS Signature Version 4.
+func (k *awsKey) call(ctx context.Context, action string, in, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, k.config.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService."+action)
+	cloudauth.SignV4(req, body, time.Now(), k.config.Region, "kms", cloudauth.AWSCredentials{
+		AccessKeyID:     k.config.AccessKeyID,
+		SecretAccessKey: k.config.SecretAccessKey,
+		SessionToken:    k.config.SessionToken,
+	})
+	return do(k.config.Client, req, out)
+}
@@ -0,0 +1,156 @@
+package kms
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"scepclient/cloudauth"
+)
+
+// AzureConfig selects an RSA or EC key of Azure Key Vault
+// or Managed HSM with the sign operation.
+type AzureConfig struct {
+	// KeyURL is the URL of the key, https://<vault>.vault.azure.net/keys/<name>,
+	// optionally followed by the version. Without one, the current
+	// version when NewAzure is called is used.
+	KeyURL string
+
+	// Token authenticates the requests, for the resource
+	// https://vault.azure.net. It needs the keys/get and keys/sign
+	// permissions. If it is nil, the tokens of the managed identity
+	// of the instance are fetched from the instance metadata service.
+	Token TokenSource
+
+	// Client sends the requests to Key Vault.
+	// http.DefaultClient is used if it is nil.
+	Client *http.Client
+}
+
+const azureAPIVersion = "7.4"
+
+// jsonWebKey is the public part of a Key Vault key.
+type jsonWebKey struct {
+	KID   string `json:"kid"`
+	KTY   string `json:"kty"`
+	N     string `json:"n"`
+	E     string `json:"e"`
+	Curve string `json:"crv"`
+	X     string `json:"x"`
+	Y     string `json:"y"`
+}
+
+// NewAzure returns a crypto.Signer signing with an Azure Key Vault
+// key. It fetches the public key of the key with ctx.
+func NewAzure(ctx context.Context, config AzureConfig) (crypto.Signer, error) {
+	if config.KeyURL == "" {
+		return nil, errors.New("kms: Azure Key Vault key URL is required")
+	}
+	if config.Token == nil {
+		config.Token = cloudauth.AzureManagedIdentity(config.Client, "https://vault.azure.net", "")
+	}
+	call := func(ctx context.Context, method, keyURL, operation string, in, out interface{}) error {
+		token, err := config.Token(ctx)
+		if err != nil {
+			return err
+		}
+		u := strings.TrimSuffix(keyURL, "/") + operation + "?api-version=" + url.QueryEscape(azureAPIVersion)
+		return doJSON(ctx, config.Client, method, u, http.Header{"Authorization": []string{"Bearer " + token}}, in, out)
+	}
+
+	var resp struct {
+		Key jsonWebKey `json:"key"`
+	}
+	if err := call(ctx, http.MethodGet, config.KeyURL, "", nil, &resp); err != nil {
+		return nil, fmt.Errorf("kms: get key %s: %w", config.KeyURL, err)
+	}
+	pub, algorithm, err := resp.Key.public()
+	if err != nil {
+		return nil, fmt.Errorf("kms: key %s: %w", config.KeyURL, err)
+	}
+	// sign with the version fetched, even if the key is rotated
+	kid := resp.Key.KID
+	if kid == "" {
+		kid = config.KeyURL
+	}
+	return &signer{
+		public: pub,
+		sign: func(ctx context.Context, digest []byte, hash crypto.Hash) ([]byte, error) {
+			req := map[string]string{
+				"alg":   algorithm + hashBits(hash),
+				"value": base64.RawURLEncoding.EncodeToString(digest),
+			}
+			var resp struct {
+				Value string `json:"value"`
+			}
+			if err := call(ctx, http.MethodPost, kid, "/sign", req, &resp); err != nil {
+				return nil, fmt.Errorf("kms: sign with %s: %w", kid, err)
+			}
+			sig, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(resp.Value, "="))
+			if err != nil {
+				return nil, fmt.Errorf("kms: decode signature of %s: %w", kid, err)
+			}
+			if _, ok := pub.(*ecdsa.PublicKey); ok {
+				// Key Vault returns r and s concatenated, as JWS does
+				half := len(sig) / 2
+				return asn1.Marshal(struct{ R, S *big.Int }{
+					new(big.Int).SetBytes(sig[:half]),
+					new(big.Int).SetBytes(sig[half:]),
+				})
+			}
+			return sig, nil
+		},
+	}, nil
+}
+
+// public returns the public key and the JWS algorithm
+// name of the key, without the hash size.
+func (k jsonWebKey) public() (crypto.PublicKey, string, error) {
+	switch strings.TrimSuffix(k.KTY, "-HSM") {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, "", err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, "", err
+		}
+		pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		return pub, "RS", nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, "", fmt.Errorf("unsupported curve %q", k.Curve)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, "", err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, "", err
+		}
+		pub := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		return pub, "ES", nil
+	default:
+		return nil, "", fmt.Errorf("unsupported key type %q", k.KTY)
+	}
+}
@@ -0,0 +1,94 @@
+package kms
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"scepclient/cloudauth"
+)
+
+// GCPConfig selects a Google Cloud KMS key version with
+// the ASYMMETRIC_SIGN purpose.
+type GCPConfig struct {
+	// Name is the resource name of the key version,
+	// projects/*/locations/*/keyRings/*/cryptoKeys/*/cryptoKeyVersions/*.
+	Name string
+
+	// Token authenticates the requests. It needs the
+	// cloudkms.cryptoKeyVersions.viewPublicKey and useToSign
+	// permissions. If it is nil, the tokens of the service
+	// account of the instance are fetched from the metadata server.
+	Token TokenSource
+
+	// Endpoint is the URL of the Cloud KMS API,
+	// https://cloudkms.googleapis.com by default.
+	Endpoint string
+
+	// Client sends the requests to Cloud KMS.
+	// http.DefaultClient is used if it is nil.
+	Client *http.Client
+}
+
+// NewGCP returns a crypto.Signer signing with a Google Cloud KMS key
+// version. It fetches the public key of the key version with ctx.
+func NewGCP(ctx context.Context, config GCPConfig) (crypto.Signer, error) {
+	if config.Name == "" {
+		return nil, errors.New("kms: Google Cloud KMS key version is required")
+	}
+	if config.Endpoint == "" {
+		config.Endpoint = "https://cloudkms.googleapis.com"
+	}
+	if config.Token == nil {
+		config.Token = cloudauth.GCPMetadataToken(config.Client)
+	}
+	url := strings.TrimSuffix(config.Endpoint, "/") + "/v1/" + config.Name
+	call := func(ctx context.Context, method, url string, in, out interface{}) error {
+		token, err := config.Token(ctx)
+		if err != nil {
+			return err
+		}
+		return doJSON(ctx, config.Client, method, url, http.Header{"Authorization": []string{"Bearer " + token}}, in, out)
+	}
+
+	var key struct {
+		PEM       string `json:"pem"`
+		Algorithm string `json:"algorithm"`
+	}
+	if err := call(ctx, http.MethodGet, url+"/publicKey", nil, &key); err != nil {
+		return nil, fmt.Errorf("kms: get public key of %s: %w", config.Name, err)
+	}
+	block, _ := pem.Decode([]byte(key.PEM))
+	if block == nil {
+		return nil, fmt.Errorf("kms: no PEM encoded public key for %s", config.Name)
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("kms: parse public key of %s: %w", config.Name, err)
+	}
+	// the algorithm, and its hash, are fixed by the key version
+	if strings.Contains(key.Algorithm, "_PSS_") {
+		return nil, fmt.Errorf("kms: unsupported algorithm %s of %s", key.Algorithm, config.Name)
+	}
+	return &signer{
+		public: pub,
+		sign: func(ctx context.Context, digest []byte, hash crypto.Hash) ([]byte, error) {
+			req := map[string]map[string][]byte{
+				"digest": {"sha" + hashBits(hash): digest},
+			}
+			var resp struct {
+				Signature []byte `json:"signature"`
+			}
+			if err := call(ctx, http.MethodPost, url+":asymmetricSign", req, &resp); err != nil {
+				return nil, fmt.Errorf("kms: sign with %s: %w", config.Name, err)
+			}
+			// ECDSA signatures are DER encoded already
+			return resp.Signature, nil
+		},
+	}, nil
+}
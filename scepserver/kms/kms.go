@@ -0,0 +1,196 @@
+// Package kms adapts signing keys held by cloud key management services
+// to crypto.Signer, so that a SCEP server issues certificates and CRLs
+// without ever holding the CA key, see scepserver.WithIssuer. It talks
+// to the REST APIs of AWS KMS, Google Cloud KMS and Azure Key Vault.
+//
+// Only the issuing key can be kept in a KMS. Clients encrypt their
+// requests to the RA certificate of the depot with RSA PKCS #1 v1.5,
+// which AWS and Google Cloud KMS keys cannot decrypt, so the RA key
+// stays in the depot.
+package kms
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"scepclient/cloudauth"
+)
+
+// signTimeout bounds a signing request, as crypto.Signer
+// does not take a context.
+const signTimeout = 30 * time.Second
+
+// signer implements crypto.Signer with a remote signing operation.
+type signer struct {
+	public crypto.PublicKey
+	sign   func(ctx context.Context, digest []byte, hash crypto.Hash) ([]byte, error)
+}
+
+func (s *signer) Public() crypto.PublicKey {
+	return s.public
+}
+
+// Sign signs digest, which must have been computed with the hash of opts,
+// with RSA PKCS #1 v1.5 or ECDSA, depending on the key.
+func (s *signer) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if _, ok := opts.(*rsa.PSSOptions); ok {
+		return nil, errors.New("kms: RSA-PSS signatures are not supported")
+	}
+	hash := opts.HashFunc()
+	switch hash {
+	case crypto.SHA256, crypto.SHA384, crypto.SHA512:
+	default:
+		return nil, fmt.Errorf("kms: unsupported hash %v", hash)
+	}
+	if len(digest) != hash.Size() {
+		return nil, errors.New("kms: digest length does not match the hash")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), signTimeout)
+	defer cancel()
+	return s.sign(ctx, digest, hash)
+}
+
+// hashBits returns the output size of hash in bits,
+// as used in the algorithm names of the KMS APIs.
+func hashBits(hash crypto.Hash) string {
+	return strconv.Itoa(hash.Size() * 8)
+}
+
+// Open returns the signer for the key identified by uri, with the
+// credentials of the environment:
+//
+//	awskms:<key ARN>      AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN
+//	gcpkms:<key version>  GOOGLE_OAUTH_ACCESS_TOKEN, or the metadata server
+//	azurekv:<key URL>     AZURE_ACCESS_TOKEN, or the managed identity
+//
+// The key version of Google Cloud KMS is the resource name
+// projects/*/locations/*/keyRings/*/cryptoKeys/*/cryptoKeyVersions/*,
+// and the key URL of Azure Key Vault is https://<vault>.vault.azure.net/keys/<name>[/<version>].
+func Open(ctx context.Context, uri string, client *http.Client) (crypto.Signer, error) {
+	scheme, key, ok := strings.Cut(uri, ":")
+	if !ok || key == "" {
+		return nil, fmt.Errorf("kms: invalid key URI %q", uri)
+	}
+	switch scheme {
+	case "awskms":
+		region := os.Getenv("AWS_REGION")
+		if parts := strings.Split(key, ":"); len(parts) > 3 && parts[0] == "arn" {
+			region = parts[3]
+		}
+		if region == "" {
+			region = os.Getenv("AWS_DEFAULT_REGION")
+		}
+		return NewAWS(ctx, AWSConfig{
+			KeyID:           key,
+			Region:          region,
+			AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+			Client:          client,
+		})
+	case "gcpkms":
+		config := GCPConfig{Name: key, Client: client}
+		if token := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"); token != "" {
+			config.Token = StaticToken(token)
+		}
+		return NewGCP(ctx, config)
+	case "azurekv":
+		config := AzureConfig{KeyURL: key, Client: client}
+		if token := os.Getenv("AZURE_ACCESS_TOKEN"); token != "" {
+			config.Token = StaticToken(token)
+		}
+		return NewAzure(ctx, config)
+	default:
+		return nil, fmt.Errorf("kms: unknown key URI scheme %q, expected awskms, gcpkms or azurekv", scheme)
+	}
+}
+
+// TokenSource returns an OAuth 2.0 access token
+// for Google Cloud or Azure.
+type TokenSource = cloudauth.TokenSource
+
+// StaticToken returns a TokenSource returning token, which
+// the caller must replace before it expires.
+func StaticToken(token string) TokenSource {
+	return cloudauth.StaticToken(token)
+}
+
+// maxResponseSize limits the responses read from a KMS.
+const maxResponseSize = 1 << 20
+
+// doJSON sends in as JSON body, unless it is nil, and decodes the response into out.
+func doJSON(ctx context.Context, client *http.Client, method, url string, header http.Header, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return do(client, req, out)
+}
+
+// do sends req and decodes the JSON response into out,
+// turning error responses into errors.
+func do(client *http.Client, req *http.Request, out interface{}) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", resp.Status, errorMessage(data))
+	}
+	return json.Unmarshal(data, out)
+}
+
+// errorMessage returns the message of an error response of
+// AWS, Google Cloud or Azure, or the body if it has none.
+func errorMessage(body []byte) string {
+	// AWS sends a message, or a Message, the others an error object
+	var e struct {
+		Message string `json:"message"`
+		Error   struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(body, &e) == nil {
+		if e.Error.Message != "" {
+			return e.Error.Message
+		}
+		if e.Message != "" {
+			return e.Message
+		}
+	}
+	return strings.TrimSpace(string(body))
+}
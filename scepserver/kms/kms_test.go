@@ -0,0 +1,228 @@
+package kms
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// checkSigner issues a self-signed certificate with signer
+// and verifies its signature.
+func checkSigner(t *testing.T, signer crypto.Signer) {
+	t.Helper()
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "KMS CA"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, signer.Public(), signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crt, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := crt.CheckSignatureFrom(crt); err != nil {
+		t.Errorf("invalid signature: %v", err)
+	}
+}
+
+// signDigest signs digest like a KMS, with ECDSA signatures DER encoded.
+func signDigest(t *testing.T, key crypto.Signer, digest []byte, hash crypto.Hash) []byte {
+	sig, err := key.Sign(rand.Reader, digest, hash)
+	if err != nil {
+		t.Error(err)
+	}
+	return sig
+}
+
+func TestAWS(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKID/") || !strings.Contains(auth, "/eu-west-1/kms/aws4_request") {
+			t.Errorf("unexpected authorization %q", auth)
+		}
+		if r.Header.Get("X-Amz-Security-Token") != "session" {
+			t.Error("expected the session token")
+		}
+		var req struct {
+			KeyId            string
+			Message          []byte
+			SigningAlgorithm string
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+			return
+		}
+		if req.KeyId != "alias/scep" {
+			t.Errorf("unexpected key ID %q", req.KeyId)
+		}
+		switch target := r.Header.Get("X-Amz-Target"); target {
+		case "TrentService.GetPublicKey":
+			json.NewEncoder(w).Encode(map[string][]byte{"PublicKey": pub})
+		case "TrentService.Sign":
+			if req.SigningAlgorithm != "RSASSA_PKCS1_V1_5_SHA_256" {
+				t.Errorf("unexpected algorithm %s", req.SigningAlgorithm)
+			}
+			json.NewEncoder(w).Encode(map[string][]byte{"Signature": signDigest(t, key, req.Message, crypto.SHA256)})
+		default:
+			t.Errorf("unexpected target %s", target)
+		}
+	}))
+	defer server.Close()
+
+	signer, err := NewAWS(context.Background(), AWSConfig{
+		KeyID:           "alias/scep",
+		Region:          "eu-west-1",
+		AccessKeyID:     "AKID",
+		SecretAccessKey: "secret",
+		SessionToken:    "session",
+		Endpoint:        server.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSigner(t, signer)
+}
+
+func TestGCP(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	const name = "projects/p/locations/global/keyRings/scep/cryptoKeys/ca/cryptoKeyVersions/1"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if auth := r.Header.Get("Authorization"); auth != "Bearer token" {
+			t.Errorf("unexpected authorization %q", auth)
+		}
+		switch r.URL.Path {
+		case "/v1/" + name + "/publicKey":
+			json.NewEncoder(w).Encode(map[string]string{
+				"pem":       string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub})),
+				"algorithm": "EC_SIGN_P256_SHA256",
+			})
+		case "/v1/" + name + ":asymmetricSign":
+			var req struct {
+				Digest struct {
+					SHA256 []byte `json:"sha256"`
+				} `json:"digest"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				t.Error(err)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string][]byte{"signature": signDigest(t, key, req.Digest.SHA256, crypto.SHA256)})
+		default:
+			http.Error(w, `{"error": {"message": "not found"}}`, http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	signer, err := NewGCP(context.Background(), GCPConfig{Name: name, Token: StaticToken("token"), Endpoint: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSigner(t, signer)
+
+	_, err = NewGCP(context.Background(), GCPConfig{Name: "projects/other", Token: StaticToken("token"), Endpoint: server.URL})
+	if err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("expected the error message of the API, got %v", err)
+	}
+}
+
+func TestAzure(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if auth := r.Header.Get("Authorization"); auth != "Bearer token" {
+			t.Errorf("unexpected authorization %q", auth)
+		}
+		if v := r.URL.Query().Get("api-version"); v != azureAPIVersion {
+			t.Errorf("unexpected API version %q", v)
+		}
+		switch r.URL.Path {
+		case "/keys/ca":
+			json.NewEncoder(w).Encode(map[string]jsonWebKey{"key": {
+				KID:   server.URL + "/keys/ca/v1",
+				KTY:   "EC-HSM",
+				Curve: "P-384",
+				X:     base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 48))),
+				Y:     base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 48))),
+			}})
+		case "/keys/ca/v1/sign":
+			var req struct {
+				Alg   string `json:"alg"`
+				Value string `json:"value"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				t.Error(err)
+				return
+			}
+			if req.Alg != "ES384" {
+				t.Errorf("unexpected algorithm %s", req.Alg)
+			}
+			digest, _ := base64.RawURLEncoding.DecodeString(req.Value)
+			r, s, err := ecdsa.Sign(rand.Reader, key, digest)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			sig := append(r.FillBytes(make([]byte, 48)), s.FillBytes(make([]byte, 48))...)
+			json.NewEncoder(w).Encode(map[string]string{"value": base64.RawURLEncoding.EncodeToString(sig)})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	signer, err := NewAzure(context.Background(), AzureConfig{KeyURL: server.URL + "/keys/ca", Token: StaticToken("token")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSigner(t, signer)
+}
+
+func TestOpen(t *testing.T) {
+	for _, name := range []string{"AWS_REGION", "AWS_DEFAULT_REGION", "AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY"} {
+		t.Setenv(name, "")
+	}
+	for _, uri := range []string{"", "awskms", "pkcs11:token=ca", "awskms:alias/scep"} {
+		if _, err := Open(context.Background(), uri, nil); err == nil {
+			t.Errorf("expected an error for %q", uri)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package scepserver
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"scepclient/clock"
+)
+
+// HandlerLimits configures LimitHandler.
+type HandlerLimits struct {
+	// Rate and Burst limit all requests to Rate per second on
+	// average, with bursts of up to Burst requests. A Rate of zero
+	// or less does not limit them.
+	Rate  float64
+	Burst int
+
+	// PerIPRate and PerIPBurst limit the requests of each client
+	// IP address in the same way.
+	PerIPRate  float64
+	PerIPBurst int
+
+	// ClientIPHeader names a header carrying the client IP address,
+	// such as X-Forwarded-For, set by a trusted reverse proxy. The last
+	// address of the header is used, as it was added by the proxy.
+	// The address of the connection is used if it is empty. It is also
+	// the requester recorded in audit events, see WithRequester.
+	ClientIPHeader string
+
+	// MaxPayload limits the size of request messages by operation,
+	// for example {"PKIOperation": 64 << 10}, which applies to both
+	// POST bodies and GET query strings. Messages of other operations
+	// are only bounded by the 2 MiB limit of POST bodies and by the
+	// MaxHeaderBytes of the http.Server.
+	MaxPayload map[string]int64
+
+	// Clock measures the rates.
+	// The system clock is used if it is nil.
+	Clock clock.Clock
+}
+
+// LimitHandler protects next, usually created with NewHTTPHandler,
+// against clients sending too many or too large requests. Requests
+// exceeding a rate limit are rejected with 429 Too Many Requests and
+// a Retry-After header, which scepclient honors. Oversized messages
+// are rejected with 413 or 414.
+//
+// Protection against slow clients, such as slowloris attacks, belongs
+// to the http.Server: set its ReadHeaderTimeout, ReadTimeout,
+// WriteTimeout, IdleTimeout and MaxHeaderBytes.
+func LimitHandler(next http.Handler, limits HandlerLimits) http.Handler {
+	clk := clock.Or(limits.Clock)
+	h := &limitHandler{
+		next:   next,
+		limits: limits,
+		clock:  clk,
+		perIP:  make(map[string]*tokenBucket),
+	}
+	if limits.Rate > 0 {
+		h.global = newTokenBucket(limits.Rate, limits.Burst, clk.Now())
+	}
+	return h
+}
+
+// sweepInterval is how often idle per-IP buckets are forgotten.
+const sweepInterval = time.Minute
+
+type limitHandler struct {
+	next   http.Handler
+	limits HandlerLimits
+	clock  clock.Clock
+	global *tokenBucket
+
+	mtx       sync.Mutex
+	perIP     map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func (h *limitHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	now := h.clock.Now()
+	if h.limits.PerIPRate > 0 {
+		if wait, ok := h.bucket(h.clientIP(r), now).take(now); !ok {
+			tooManyRequests(w, wait)
+			return
+		}
+	}
+	if h.global != nil {
+		if wait, ok := h.global.take(now); !ok {
+			tooManyRequests(w, wait)
+			return
+		}
+	}
+
+	if limit, ok := h.limits.MaxPayload[r.URL.Query().Get("operation")]; ok {
+		switch r.Method {
+		case http.MethodGet:
+			if int64(len(r.URL.RawQuery)) > limit {
+				http.Error(w, "request URI too long", http.StatusRequestURITooLong)
+				return
+			}
+		case http.MethodPost:
+			if r.ContentLength > limit {
+				http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+		}
+	}
+	if h.limits.ClientIPHeader != "" {
+		r = r.WithContext(WithRequester(r.Context(), h.clientIP(r)))
+	}
+	h.next.ServeHTTP(w, r)
+}
+
+// bucket returns the token bucket of ip, forgetting the buckets of
+// idle clients once per sweepInterval to bound memory use.
+func (h *limitHandler) bucket(ip string, now time.Time) *tokenBucket {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	if now.Sub(h.lastSweep) > sweepInterval {
+		for addr, b := range h.perIP {
+			if b.full(now) {
+				delete(h.perIP, addr)
+			}
+		}
+		h.lastSweep = now
+	}
+	b, ok := h.perIP[ip]
+	if !ok {
+		b = newTokenBucket(h.limits.PerIPRate, h.limits.PerIPBurst, now)
+		h.perIP[ip] = b
+	}
+	return b
+}
+
+func (h *limitHandler) clientIP(r *http.Request) string {
+	if h.limits.ClientIPHeader != "" {
+		if value := r.Header.Get(h.limits.ClientIPHeader); value != "" {
+			addrs := strings.Split(value, ",")
+			return strings.TrimSpace(addrs[len(addrs)-1])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func tooManyRequests(w http.ResponseWriter, wait time.Duration) {
+	seconds := int((wait + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, "too many requests", http.StatusTooManyRequests)
+}
@@ -0,0 +1,112 @@
+package scepserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"scepclient/clock"
+)
+
+func TestLimitHandlerRates(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	h := LimitHandler(next, HandlerLimits{
+		Rate:       10,
+		Burst:      3,
+		PerIPRate:  1,
+		PerIPBurst: 2,
+		Clock:      clk,
+	})
+	send := func(addr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/?operation=GetCACaps", nil)
+		req.RemoteAddr = addr + ":1234"
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		if rec := send("192.0.2.1"); rec.Code != want {
+			t.Errorf("request %d: expected status %d, got %d", i+1, want, rec.Code)
+		}
+	}
+	// the per-IP limit does not apply to other clients, the global one does
+	if rec := send("192.0.2.2"); rec.Code != http.StatusOK {
+		t.Errorf("expected another client to pass, got %d", rec.Code)
+	}
+	rec := send("192.0.2.3")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("expected the global limit to apply, got %d", rec.Code)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("expected Retry-After 1, got %q", got)
+	}
+
+	clk.Advance(time.Second)
+	if rec := send("192.0.2.1"); rec.Code != http.StatusOK {
+		t.Errorf("expected the limit to recover, got %d", rec.Code)
+	}
+}
+
+func TestLimitHandlerSweep(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	h := LimitHandler(next, HandlerLimits{PerIPRate: 1, PerIPBurst: 1, Clock: clk}).(*limitHandler)
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2"} {
+		h.bucket(ip, clk.Now()).take(clk.Now())
+	}
+	clk.Advance(2 * sweepInterval)
+	h.bucket("192.0.2.3", clk.Now())
+	if n := len(h.perIP); n != 1 {
+		t.Errorf("expected idle clients to be forgotten, %d buckets left", n)
+	}
+}
+
+func TestLimitHandlerPayload(t *testing.T) {
+	h := LimitHandler(NewHTTPHandler(nil), HandlerLimits{
+		MaxPayload: map[string]int64{pkiOperation: 16},
+	})
+	tests := []struct {
+		name   string
+		req    *http.Request
+		status int
+	}{
+		{"POST", httptest.NewRequest(http.MethodPost, "/?operation=PKIOperation", strings.NewReader(strings.Repeat("a", 17))), http.StatusRequestEntityTooLarge},
+		{"GET", httptest.NewRequest(http.MethodGet, "/?operation=PKIOperation&message="+strings.Repeat("a", 17), nil), http.StatusRequestURITooLong},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, tt.req)
+			if rec.Code != tt.status {
+				t.Errorf("expected status %d, got %d", tt.status, rec.Code)
+			}
+		})
+	}
+
+	// without a Content-Length, the body is cut off while reading it
+	req := httptest.NewRequest(http.MethodPost, "/?operation=PKIOperation", strings.NewReader(strings.Repeat("a", 17)))
+	req.ContentLength = -1
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected status 413 for a chunked body, got %d", rec.Code)
+	}
+}
+
+func TestLimitHandlerRequester(t *testing.T) {
+	var requester string
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requester, _ = Requester(r.Context())
+	})
+	h := LimitHandler(next, HandlerLimits{ClientIPHeader: "X-Forwarded-For"})
+	req := httptest.NewRequest(http.MethodGet, "/?operation=GetCACaps", nil)
+	req.Header.Set("X-Forwarded-For", "198.51.100.7, 192.0.2.1")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if requester != "192.0.2.1" {
+		t.Errorf("expected the requester from the header, got %q", requester)
+	}
+}
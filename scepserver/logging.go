@@ -0,0 +1,84 @@
+package scepserver
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"time"
+)
+
+// LoggingMiddleware logs every request sent over the transport
+// with its operation, duration, status and byte counts.
+func LoggingMiddleware(logger *slog.Logger) Middleware {
+	return func(next Transport) Transport {
+		return &loggingTransport{next: next, logger: logger}
+	}
+}
+
+type loggingTransport struct {
+	next   Transport
+	logger *slog.Logger
+}
+
+// loggerFor adds the correlation and transaction IDs of ctx, if any,
+// to the logger.
+func (t *loggingTransport) loggerFor(ctx context.Context) *slog.Logger {
+	logger := t.logger
+	if id, ok := CorrelationID(ctx); ok {
+		logger = logger.With("correlation_id", id)
+	}
+	if id, ok := TransactionID(ctx); ok {
+		logger = logger.With("transaction_id", id)
+	}
+	return logger
+}
+
+func (t *loggingTransport) SendGet(ctx context.Context, req SCEPRequest) (SCEPResponse, error) {
+	return t.log(ctx, "GET", req, t.next.SendGet)
+}
+
+func (t *loggingTransport) SendPost(ctx context.Context, req SCEPRequest) (SCEPResponse, error) {
+	return t.log(ctx, "POST", req, t.next.SendPost)
+}
+
+func (t *loggingTransport) StreamGet(ctx context.Context, req SCEPRequest) (io.ReadCloser, SCEPResponse, error) {
+	body, resp, err := StreamGet(ctx, t.next, req)
+	if err != nil {
+		t.loggerFor(ctx).InfoContext(ctx, "scep request failed", "operation", req.Operation, "method", "GET", "err", err)
+		return nil, resp, err
+	}
+	t.loggerFor(ctx).DebugContext(ctx, "scep streaming request", "operation", req.Operation, "method", "GET", "status", resp.StatusCode)
+	return body, resp, nil
+}
+
+func (t *loggingTransport) log(
+	ctx context.Context,
+	method string,
+	req SCEPRequest,
+	send func(context.Context, SCEPRequest) (SCEPResponse, error),
+) (SCEPResponse, error) {
+	begin := time.Now()
+	resp, err := send(ctx, req)
+	attrs := []interface{}{
+		"operation", req.Operation,
+		"method", method,
+		"duration", time.Since(begin),
+		"bytes_sent", len(req.Message),
+		"bytes_received", len(resp.Data),
+	}
+	status := resp.StatusCode
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		status = httpErr.StatusCode
+	}
+	if status != 0 {
+		attrs = append(attrs, "status", status)
+	}
+	if err != nil {
+		t.loggerFor(ctx).InfoContext(ctx, "scep request failed", append(attrs, "err", err)...)
+		return resp, err
+	}
+	t.loggerFor(ctx).DebugContext(ctx, "scep request", attrs...)
+	return resp, nil
+}
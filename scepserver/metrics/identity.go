@@ -0,0 +1,114 @@
+package metrics
+
+import (
+	"crypto/x509"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"scepclient/clock"
+)
+
+// Identities exports the certificates kept enrolled by a daemon, one
+// identity each, for dashboards and alerts on fleets of clients.
+type Identities struct {
+	clock clock.Clock
+
+	expiry      *prometheus.Desc
+	lastRenewal *prometheus.Desc
+	lastStatus  *prometheus.Desc
+
+	mtx        sync.Mutex
+	identities map[string]*identity
+}
+
+type identity struct {
+	cert        *x509.Certificate
+	lastRenewal float64
+	lastStatus  string
+}
+
+// NewIdentities creates the collector of the identities and registers
+// it with reg. The seconds until expiry are computed at every scrape
+// with c, or with the system clock if c is nil.
+func NewIdentities(reg prometheus.Registerer, c clock.Clock) (*Identities, error) {
+	m := &Identities{
+		clock: clock.Or(c),
+		expiry: prometheus.NewDesc("scep_certificate_expiry_seconds",
+			"Seconds until the certificate of the identity expires, negative once it has expired.",
+			[]string{"identity"}, nil),
+		lastRenewal: prometheus.NewDesc("scep_certificate_last_renewal_timestamp_seconds",
+			"Time of the last successful enrollment or renewal of the identity.",
+			[]string{"identity"}, nil),
+		lastStatus: prometheus.NewDesc("scep_certificate_last_pki_status",
+			"The pkiStatus of the last request of the identity, SUCCESS, FAILURE or PENDING, or error if it failed without one; always 1.",
+			[]string{"identity", "pki_status"}, nil),
+		identities: make(map[string]*identity),
+	}
+	if err := reg.Register(m); err != nil {
+		return nil, fmt.Errorf("register SCEP identity metrics: %w", err)
+	}
+	return m, nil
+}
+
+// Certificate records the current certificate of the identity.
+func (m *Identities) Certificate(name string, cert *x509.Certificate) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.get(name).cert = cert
+}
+
+// Status records the pkiStatus of the last request of the identity, as
+// labeled by NewServer: SUCCESS, FAILURE, PENDING or error. SUCCESS also
+// records the time of the renewal.
+func (m *Identities) Status(name, status string) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	id := m.get(name)
+	id.lastStatus = status
+	if status == "SUCCESS" {
+		id.lastRenewal = float64(m.clock.Now().UnixNano()) / 1e9
+	}
+}
+
+func (m *Identities) get(name string) *identity {
+	id, ok := m.identities[name]
+	if !ok {
+		id = new(identity)
+		m.identities[name] = id
+	}
+	return id
+}
+
+// Describe implements prometheus.Collector.
+func (m *Identities) Describe(ch chan<- *prometheus.Desc) {
+	ch <- m.expiry
+	ch <- m.lastRenewal
+	ch <- m.lastStatus
+}
+
+// Collect implements prometheus.Collector.
+func (m *Identities) Collect(ch chan<- prometheus.Metric) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	names := make([]string, 0, len(m.identities))
+	for name := range m.identities {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	now := m.clock.Now()
+	for _, name := range names {
+		id := m.identities[name]
+		if id.cert != nil {
+			ch <- prometheus.MustNewConstMetric(m.expiry, prometheus.GaugeValue, id.cert.NotAfter.Sub(now).Seconds(), name)
+		}
+		if id.lastRenewal != 0 {
+			ch <- prometheus.MustNewConstMetric(m.lastRenewal, prometheus.GaugeValue, id.lastRenewal, name)
+		}
+		if id.lastStatus != "" {
+			ch <- prometheus.MustNewConstMetric(m.lastStatus, prometheus.GaugeValue, 1, name, id.lastStatus)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package metrics
+
+import (
+	"crypto/x509"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"scepclient/clock"
+)
+
+func TestIdentities(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	c := clock.NewFake(now)
+	reg := prometheus.NewRegistry()
+	m, err := NewIdentities(reg, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.Certificate("/etc/scep/web.pem", &x509.Certificate{NotAfter: now.Add(time.Hour)})
+	m.Status("/etc/scep/web.pem", "SUCCESS")
+	m.Status("/etc/scep/vpn.pem", "PENDING")
+	c.Advance(time.Minute)
+
+	expected := `
+# HELP scep_certificate_expiry_seconds Seconds until the certificate of the identity expires, negative once it has expired.
+# TYPE scep_certificate_expiry_seconds gauge
+scep_certificate_expiry_seconds{identity="/etc/scep/web.pem"} 3540
+# HELP scep_certificate_last_pki_status The pkiStatus of the last request of the identity, SUCCESS, FAILURE or PENDING, or error if it failed without one; always 1.
+# TYPE scep_certificate_last_pki_status gauge
+scep_certificate_last_pki_status{identity="/etc/scep/vpn.pem",pki_status="PENDING"} 1
+scep_certificate_last_pki_status{identity="/etc/scep/web.pem",pki_status="SUCCESS"} 1
+# HELP scep_certificate_last_renewal_timestamp_seconds Time of the last successful enrollment or renewal of the identity.
+# TYPE scep_certificate_last_renewal_timestamp_seconds gauge
+scep_certificate_last_renewal_timestamp_seconds{identity="/etc/scep/web.pem"} 1.7e+09
+`
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+
+	// a failed renewal keeps the time of the last one
+	m.Status("/etc/scep/web.pem", "FAILURE")
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP scep_certificate_last_renewal_timestamp_seconds Time of the last successful enrollment or renewal of the identity.
+# TYPE scep_certificate_last_renewal_timestamp_seconds gauge
+scep_certificate_last_renewal_timestamp_seconds{identity="/etc/scep/web.pem"} 1.7e+09
+`), "scep_certificate_last_renewal_timestamp_seconds"); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,178 @@
+// Package metrics instruments SCEP clients with Prometheus metrics.
+package metrics
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"scepclient/scepserver"
+)
+
+// Metrics holds the Prometheus collectors of a SCEP client.
+type Metrics struct {
+	requests     *prometheus.CounterVec
+	duration     *prometheus.HistogramVec
+	bytes        *prometheus.CounterVec
+	pendingPolls prometheus.Counter
+	renewalLead  prometheus.Gauge
+
+	connections  *prometheus.CounterVec
+	connectPhase *prometheus.HistogramVec
+}
+
+// New creates the collectors and registers them with reg.
+func New(reg prometheus.Registerer) (*Metrics, error) {
+	m := &Metrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "scep",
+			Name:      "requests_total",
+			Help:      "SCEP requests by operation and status, which is ok, the HTTP status code, or error.",
+		}, []string{"operation", "status"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "scep",
+			Name:      "request_duration_seconds",
+			Help:      "Duration of SCEP requests by operation.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"operation"}),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "scep",
+			Name:      "bytes_total",
+			Help:      "SCEP message bytes by operation and direction, sent or received.",
+		}, []string{"operation", "direction"}),
+		pendingPolls: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "scep",
+			Name:      "pending_polls_total",
+			Help:      "PKIOperation requests answered with a PENDING status.",
+		}),
+		renewalLead: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "scep",
+			Name:      "renewal_lead_time_seconds",
+			Help:      "Remaining validity of the certificate at the last renewal.",
+		}),
+		connections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "scep",
+			Name:      "connections_total",
+			Help:      "Connections used by HTTP requests, by whether they were reused.",
+		}, []string{"reused"}),
+		connectPhase: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "scep",
+			Name:      "connect_phase_duration_seconds",
+			Help:      "Duration of establishing new connections by phase, which is dns, connect or tls.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"phase"}),
+	}
+	for _, c := range []prometheus.Collector{m.requests, m.duration, m.bytes, m.pendingPolls, m.renewalLead, m.connections, m.connectPhase} {
+		if err := reg.Register(c); err != nil {
+			return nil, fmt.Errorf("register SCEP metrics: %w", err)
+		}
+	}
+	return m, nil
+}
+
+// Middleware returns a transport middleware recording request
+// counts, durations and sizes.
+func (m *Metrics) Middleware() scepserver.Middleware {
+	return func(next scepserver.Transport) scepserver.Transport {
+		return &transport{next: next, m: m}
+	}
+}
+
+// PendingPoll records a PENDING response to a PKIOperation.
+func (m *Metrics) PendingPoll() {
+	m.pendingPolls.Inc()
+}
+
+// Renewal records the remaining validity of cert when it is renewed.
+func (m *Metrics) Renewal(cert *x509.Certificate) {
+	m.renewalLead.Set(time.Until(cert.NotAfter).Seconds())
+}
+
+// ObserveTrace records the connection statistics of a request.
+// Use it with scepserver.WithTrace.
+func (m *Metrics) ObserveTrace(info scepserver.TraceInfo) {
+	m.connections.WithLabelValues(strconv.FormatBool(info.Reused)).Inc()
+	if info.DNSLookup > 0 {
+		m.connectPhase.WithLabelValues("dns").Observe(info.DNSLookup.Seconds())
+	}
+	if info.Connect > 0 {
+		m.connectPhase.WithLabelValues("connect").Observe(info.Connect.Seconds())
+	}
+	if info.TLSHandshake > 0 {
+		m.connectPhase.WithLabelValues("tls").Observe(info.TLSHandshake.Seconds())
+	}
+}
+
+func (m *Metrics) observe(ctx context.Context, op string, start time.Time, sent int, err error) {
+	duration := m.duration.WithLabelValues(op)
+	if id, ok := scepserver.CorrelationID(ctx); ok {
+		// an exemplar links the observation to the enrollment's logs
+		// without making the correlation ID a high cardinality label
+		duration.(prometheus.ExemplarObserver).ObserveWithExemplar(time.Since(start).Seconds(), prometheus.Labels{"correlation_id": id})
+	} else {
+		duration.Observe(time.Since(start).Seconds())
+	}
+	m.requests.WithLabelValues(op, status(err)).Inc()
+	m.bytes.WithLabelValues(op, "sent").Add(float64(sent))
+}
+
+func status(err error) string {
+	if err == nil {
+		return "ok"
+	}
+	var httpErr *scepserver.HTTPError
+	if errors.As(err, &httpErr) {
+		return strconv.Itoa(httpErr.StatusCode)
+	}
+	return "error"
+}
+
+type transport struct {
+	next scepserver.Transport
+	m    *Metrics
+}
+
+func (t *transport) SendGet(ctx context.Context, req scepserver.SCEPRequest) (scepserver.SCEPResponse, error) {
+	start := time.Now()
+	resp, err := t.next.SendGet(ctx, req)
+	t.m.observe(ctx, req.Operation, start, len(req.Message), err)
+	t.m.bytes.WithLabelValues(req.Operation, "received").Add(float64(len(resp.Data)))
+	return resp, err
+}
+
+func (t *transport) SendPost(ctx context.Context, req scepserver.SCEPRequest) (scepserver.SCEPResponse, error) {
+	start := time.Now()
+	resp, err := t.next.SendPost(ctx, req)
+	t.m.observe(ctx, req.Operation, start, len(req.Message), err)
+	t.m.bytes.WithLabelValues(req.Operation, "received").Add(float64(len(resp.Data)))
+	return resp, err
+}
+
+func (t *transport) StreamGet(ctx context.Context, req scepserver.SCEPRequest) (io.ReadCloser, scepserver.SCEPResponse, error) {
+	start := time.Now()
+	body, resp, err := scepserver.StreamGet(ctx, t.next, req)
+	t.m.observe(ctx, req.Operation, start, len(req.Message), err)
+	if err != nil {
+		return nil, resp, err
+	}
+	received := t.m.bytes.WithLabelValues(req.Operation, "received")
+	return &countingReader{ReadCloser: body, counter: received}, resp, nil
+}
+
+// countingReader counts the bytes of a streamed response as they are read.
+type countingReader struct {
+	io.ReadCloser
+	counter prometheus.Counter
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.counter.Add(float64(n))
+	return n, err
+}
@@ -0,0 +1,197 @@
+package metrics
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"fmt"
+	"math/big"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"scepclient/scepserver"
+)
+
+// ServerMetrics holds the Prometheus collectors of a SCEP server.
+type ServerMetrics struct {
+	requests      *prometheus.CounterVec
+	issued        *prometheus.CounterVec
+	depotDuration *prometheus.HistogramVec
+	depotErrors   *prometheus.CounterVec
+	challenges    *prometheus.CounterVec
+}
+
+// NewServer creates the collectors of a SCEP server and registers
+// them with reg. Record certificate requests by passing it to
+// scepserver.WithAuditor, and instrument the depot and challenge
+// store with Depot and ChallengeStore.
+func NewServer(reg prometheus.Registerer) (*ServerMetrics, error) {
+	m := &ServerMetrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "scep",
+			Subsystem: "server",
+			Name:      "requests_total",
+			Help:      "Certificate requests by message type and the pkiStatus and failInfo of the response; requests failing without a response have the status error.",
+		}, []string{"message_type", "pki_status", "fail_info"}),
+		issued: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "scep",
+			Subsystem: "server",
+			Name:      "certificates_issued_total",
+			Help:      "Issued certificates, by whether they renew a certificate of the CA.",
+		}, []string{"renewal"}),
+		depotDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "scep",
+			Subsystem: "server",
+			Name:      "depot_duration_seconds",
+			Help:      "Duration of depot operations.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"operation"}),
+		depotErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "scep",
+			Subsystem: "server",
+			Name:      "depot_errors_total",
+			Help:      "Failed depot operations.",
+		}, []string{"operation"}),
+		challenges: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "scep",
+			Subsystem: "server",
+			Name:      "challenges_total",
+			Help:      "One-time challenge passwords by result, which is created, valid, invalid or error.",
+		}, []string{"result"}),
+	}
+	for _, c := range []prometheus.Collector{m.requests, m.issued, m.depotDuration, m.depotErrors, m.challenges} {
+		if err := reg.Register(c); err != nil {
+			return nil, fmt.Errorf("register SCEP server metrics: %w", err)
+		}
+	}
+	return m, nil
+}
+
+// Audit counts the request of ev. It implements scepserver.Auditor,
+// and never fails. Revocations are not counted.
+func (m *ServerMetrics) Audit(ctx context.Context, ev *scepserver.AuditEvent) error {
+	status := "error"
+	switch ev.Outcome {
+	case scepserver.AuditRevoked:
+		return nil
+	case scepserver.AuditIssued:
+		status = "SUCCESS"
+		m.issued.WithLabelValues(strconv.FormatBool(ev.Renewal)).Inc()
+	case scepserver.AuditPending:
+		status = "PENDING"
+	case scepserver.AuditDenied:
+		status = "FAILURE"
+	}
+	m.requests.WithLabelValues(ev.MessageType, status, ev.FailInfo).Inc()
+	return nil
+}
+
+// Depot returns d, recording the duration and errors of its
+// operations. The returned depot revokes certificates if d does.
+func (m *ServerMetrics) Depot(d scepserver.Depot) scepserver.Depot {
+	md := &depot{next: d, m: m}
+	if r, ok := d.(scepserver.Revocations); ok {
+		return &revocationDepot{depot: md, revocations: r}
+	}
+	return md
+}
+
+// ChallengeStore returns store, counting the challenge
+// passwords it creates and checks.
+func (m *ServerMetrics) ChallengeStore(store scepserver.ChallengeStore) scepserver.ChallengeStore {
+	return &challengeStore{next: store, m: m}
+}
+
+func (m *ServerMetrics) observeDepot(op string, start time.Time, err error) {
+	m.depotDuration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+	if err != nil {
+		m.depotErrors.WithLabelValues(op).Inc()
+	}
+}
+
+type depot struct {
+	next scepserver.Depot
+	m    *ServerMetrics
+}
+
+func (d *depot) CA(pass []byte) ([]*x509.Certificate, *rsa.PrivateKey, error) {
+	start := time.Now()
+	certs, key, err := d.next.CA(pass)
+	d.m.observeDepot("ca", start, err)
+	return certs, key, err
+}
+
+func (d *depot) Serial() (*big.Int, error) {
+	start := time.Now()
+	serial, err := d.next.Serial()
+	d.m.observeDepot("serial", start, err)
+	return serial, err
+}
+
+func (d *depot) Put(name string, crt *x509.Certificate) error {
+	start := time.Now()
+	err := d.next.Put(name, crt)
+	d.m.observeDepot("put", start, err)
+	return err
+}
+
+// Ping passes health checks through to depots which implement them.
+func (d *depot) Ping(ctx context.Context) error {
+	pinger, ok := d.next.(scepserver.Pinger)
+	if !ok {
+		return nil
+	}
+	start := time.Now()
+	err := pinger.Ping(ctx)
+	d.m.observeDepot("ping", start, err)
+	return err
+}
+
+type revocationDepot struct {
+	*depot
+	revocations scepserver.Revocations
+}
+
+func (d *revocationDepot) Revoke(serial *big.Int, reason int, at time.Time) error {
+	start := time.Now()
+	err := d.revocations.Revoke(serial, reason, at)
+	d.m.observeDepot("revoke", start, err)
+	return err
+}
+
+func (d *revocationDepot) Revoked() ([]x509.RevocationListEntry, error) {
+	start := time.Now()
+	entries, err := d.revocations.Revoked()
+	d.m.observeDepot("revoked", start, err)
+	return entries, err
+}
+
+type challengeStore struct {
+	next scepserver.ChallengeStore
+	m    *ServerMetrics
+}
+
+func (s *challengeStore) CreateChallenge() (string, error) {
+	pw, err := s.next.CreateChallenge()
+	if err != nil {
+		s.m.challenges.WithLabelValues("error").Inc()
+		return pw, err
+	}
+	s.m.challenges.WithLabelValues("created").Inc()
+	return pw, nil
+}
+
+func (s *challengeStore) HasChallenge(pw string) (bool, error) {
+	ok, err := s.next.HasChallenge(pw)
+	switch {
+	case err != nil:
+		s.m.challenges.WithLabelValues("error").Inc()
+	case ok:
+		s.m.challenges.WithLabelValues("valid").Inc()
+	default:
+		s.m.challenges.WithLabelValues("invalid").Inc()
+	}
+	return ok, err
+}
@@ -0,0 +1,91 @@
+package metrics
+
+import (
+	"context"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"scepclient/scepserver"
+	"scepclient/scepserver/depot/file"
+)
+
+func TestServerMetrics(t *testing.T) {
+	m, err := NewServer(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	events := []*scepserver.AuditEvent{
+		{MessageType: "PKCSReq", Outcome: scepserver.AuditIssued},
+		{MessageType: "RenewalReq", Outcome: scepserver.AuditIssued, Renewal: true},
+		{MessageType: "PKCSReq", Outcome: scepserver.AuditDenied, FailInfo: "badRequest"},
+		{MessageType: "PKCSReq", Outcome: scepserver.AuditPending},
+		{MessageType: "PKCSReq", Outcome: scepserver.AuditFailed},
+	}
+	for _, ev := range events {
+		if err := m.Audit(ctx, ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := testutil.ToFloat64(m.issued.WithLabelValues("false")); n != 1 {
+		t.Errorf("expected 1 issued certificate, got %v", n)
+	}
+	for _, labels := range [][]string{
+		{"PKCSReq", "SUCCESS", ""},
+		{"PKCSReq", "FAILURE", "badRequest"},
+		{"PKCSReq", "PENDING", ""},
+		{"PKCSReq", "error", ""},
+	} {
+		if n := testutil.ToFloat64(m.requests.WithLabelValues(labels...)); n != 1 {
+			t.Errorf("expected 1 request with %v, got %v", labels, n)
+		}
+	}
+
+	fileDepot, err := file.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fileDepot.CreateCA(nil, pkix.Name{CommonName: "test CA"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	depot := m.Depot(fileDepot)
+	if _, _, err := depot.CA(nil); err != nil {
+		t.Fatal(err)
+	}
+	revocations, ok := depot.(scepserver.Revocations)
+	if !ok {
+		t.Fatal("expected the instrumented depot to keep revoking certificates")
+	}
+	if err := revocations.Revoke(big.NewInt(42), 0, time.Now()); !errors.Is(err, scepserver.ErrUnknownCertificate) {
+		t.Errorf("expected ErrUnknownCertificate, got %v", err)
+	}
+	if n := testutil.CollectAndCount(m.depotDuration); n != 2 {
+		t.Errorf("expected durations of 2 depot operations, got %d", n)
+	}
+	if n := testutil.ToFloat64(m.depotErrors.WithLabelValues("revoke")); n != 1 {
+		t.Errorf("expected 1 failed revocation, got %v", n)
+	}
+
+	store := m.ChallengeStore(scepserver.NewChallengeStore(0, nil))
+	pw, err := store.CreateChallenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := store.HasChallenge(pw); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for result, want := range map[string]float64{"created": 1, "valid": 1, "invalid": 1} {
+		if n := testutil.ToFloat64(m.challenges.WithLabelValues(result)); n != want {
+			t.Errorf("expected %v %s challenges, got %v", want, result, n)
+		}
+	}
+}
@@ -0,0 +1,25 @@
+// Package ntlm adds NTLM authentication to the SCEP HTTP transport,
+// for NDES servers behind Windows Integrated Authentication.
+package ntlm
+
+import (
+	"net/http"
+
+	"github.com/Azure/go-ntlmssp"
+
+	"scepclient/scepserver"
+)
+
+// Options returns HTTP transport options which authenticate with
+// NTLM (or Negotiate falling back to NTLM) when the server asks for it.
+// The username may include the domain, as DOMAIN\user or user@domain.
+func Options(username, password string) []scepserver.HTTPOption {
+	return []scepserver.HTTPOption{
+		// the negotiator converts basic authentication credentials
+		// to an NTLM handshake when the server offers NTLM.
+		scepserver.WithBasicAuth(username, password),
+		scepserver.WithRoundTripper(func(next http.RoundTripper) http.RoundTripper {
+			return ntlmssp.Negotiator{RoundTripper: next}
+		}),
+	}
+}
@@ -0,0 +1,118 @@
+package ntlm
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"unicode/utf16"
+
+	"scepclient/scepserver"
+)
+
+// challenge is an NTLM CHALLENGE message without target name or
+// target information, negotiating unicode and NTLM.
+func challenge() []byte {
+	msg := make([]byte, 48)
+	copy(msg, "NTLMSSP\x00")
+	binary.LittleEndian.PutUint32(msg[8:], 2)
+	binary.LittleEndian.PutUint32(msg[12:], 48<<16) // empty target name at offset 48
+	binary.LittleEndian.PutUint32(msg[20:], 0x1|0x200)
+	copy(msg[24:32], "chllenge")
+	binary.LittleEndian.PutUint32(msg[44:], 48) // empty target info at offset 48
+	return msg
+}
+
+// field returns the UTF-16 string of the payload field at off of an
+// NTLM AUTHENTICATE message.
+func field(msg []byte, off int) string {
+	if len(msg) < off+8 {
+		return ""
+	}
+	n := int(binary.LittleEndian.Uint16(msg[off:]))
+	start := int(binary.LittleEndian.Uint32(msg[off+4:]))
+	if start+n > len(msg) {
+		return ""
+	}
+	u := make([]uint16, n/2)
+	for i := range u {
+		u[i] = binary.LittleEndian.Uint16(msg[start+2*i:])
+	}
+	return string(utf16.Decode(u))
+}
+
+func TestOptions(t *testing.T) {
+	var (
+		mtx    sync.Mutex
+		steps  []string
+		bodies []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mtx.Lock()
+		defer mtx.Unlock()
+		bodies = append(bodies, string(body))
+
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "NTLM ")
+		if !ok {
+			steps = append(steps, "anonymous")
+			w.Header().Set("WWW-Authenticate", "NTLM")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		msg, err := base64.StdEncoding.DecodeString(token)
+		if err != nil || len(msg) < 12 || !bytes.HasPrefix(msg, []byte("NTLMSSP\x00")) {
+			t.Errorf("expected an NTLM message, got %q", token)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch typ := binary.LittleEndian.Uint32(msg[8:]); typ {
+		case 1:
+			steps = append(steps, "negotiate")
+			w.Header().Set("WWW-Authenticate", "NTLM "+base64.StdEncoding.EncodeToString(challenge()))
+			w.WriteHeader(http.StatusUnauthorized)
+		case 3:
+			steps = append(steps, "authenticate "+field(msg, 28)+`\`+field(msg, 36))
+			w.Header().Set("Content-Type", "application/x-pki-message")
+			w.Write([]byte("certrep"))
+		default:
+			t.Errorf("unexpected NTLM message type %d", typ)
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+
+	transport, err := scepserver.NewHTTPTransport(srv.URL, Options(`CORP\ra-operator`, "password")...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := transport.SendPost(context.Background(), scepserver.SCEPRequest{
+		Operation: "PKIOperation",
+		Message:   []byte("pkcsreq"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp.Data) != "certrep" {
+		t.Errorf("expected the response of the authenticated request, got %q", resp.Data)
+	}
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	want := []string{"anonymous", "negotiate", `authenticate CORP\ra-operator`}
+	if strings.Join(steps, ",") != strings.Join(want, ",") {
+		t.Errorf("expected the handshake %q, got %q", want, steps)
+	}
+	// the message is resent with every step of the handshake
+	for i, body := range bodies {
+		if body != "pkcsreq" {
+			t.Errorf("request %d: expected the PKIOperation message, got %q", i, body)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package scepserver
+
+import (
+	"net/url"
+	"strings"
+)
+
+// DefaultPath is the path of SCEP servers which don't document
+// their own, used for server URLs without a path.
+const DefaultPath = "/cgi-bin/pkiclient.exe"
+
+// KnownPaths are the paths SCEP servers are commonly found at:
+// the traditional default, Microsoft NDES, and the short path of
+// many other CA products.
+var KnownPaths = []string{
+	DefaultPath,
+	"/certsrv/mscep/mscep.dll",
+	"/scep",
+}
+
+// ExpandServerURL completes the path of a SCEP server URL. A URL
+// without a path gets DefaultPath, and the NDES directory
+// /certsrv/mscep gets the mscep.dll its requests go to. Other
+// paths are returned unchanged.
+func ExpandServerURL(u *url.URL) *url.URL {
+	expanded := *u
+	switch strings.ToLower(strings.TrimSuffix(u.Path, "/")) {
+	case "":
+		expanded.Path = DefaultPath
+	case "/certsrv/mscep":
+		expanded.Path = strings.TrimSuffix(u.Path, "/") + "/mscep.dll"
+	default:
+		return u
+	}
+	expanded.RawPath = ""
+	return &expanded
+}
@@ -0,0 +1,114 @@
+package scepserver
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"scepclient/clock"
+)
+
+// PendingTransaction is a SCEP transaction whose last request was
+// answered with PENDING.
+type PendingTransaction struct {
+	TransactionID string    `json:"transaction_id"`
+	MessageType   string    `json:"message_type,omitempty"`
+	Requester     string    `json:"requester,omitempty"`
+	Subject       string    `json:"subject,omitempty"`
+	DNSNames      []string  `json:"dns_names,omitempty"`
+	Reason        string    `json:"reason,omitempty"`
+	FirstSeen     time.Time `json:"first_seen"`
+	LastSeen      time.Time `json:"last_seen"`
+	Attempts      int       `json:"attempts"`
+}
+
+// PendingTransactions is an Auditor keeping track of the SCEP
+// transactions answered with PENDING, for example while an approver
+// decides, until a certificate is issued or denied in the transaction,
+// or none of its requests was received for the ttl passed to
+// NewPendingTransactions.
+//
+// It only knows the requests of the Service it audits: instances
+// sharing a depot each track the transactions they answered.
+type PendingTransactions struct {
+	ttl   time.Duration
+	clock clock.Clock
+
+	mtx     sync.Mutex
+	pending map[string]*PendingTransaction
+}
+
+// NewPendingTransactions returns PendingTransactions forgetting the
+// transactions without request for ttl, measured by c; the system
+// clock is used if it is nil.
+func NewPendingTransactions(ttl time.Duration, c clock.Clock) *PendingTransactions {
+	return &PendingTransactions{
+		ttl:     ttl,
+		clock:   clock.Or(c),
+		pending: make(map[string]*PendingTransaction),
+	}
+}
+
+// Audit records the transaction of ev as pending, or forgets it when
+// it was answered otherwise. It never fails.
+func (p *PendingTransactions) Audit(ctx context.Context, ev *AuditEvent) error {
+	if ev.TransactionID == "" {
+		// EST enrollments have no transaction to poll
+		return nil
+	}
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.expire()
+	if ev.Outcome != AuditPending {
+		// failed requests may be retried
+		if ev.Outcome == AuditIssued || ev.Outcome == AuditDenied {
+			delete(p.pending, ev.TransactionID)
+		}
+		return nil
+	}
+	tx, ok := p.pending[ev.TransactionID]
+	if !ok {
+		tx = &PendingTransaction{TransactionID: ev.TransactionID, FirstSeen: ev.Time}
+		p.pending[ev.TransactionID] = tx
+	}
+	tx.MessageType = ev.MessageType
+	tx.Requester = ev.Requester
+	if ev.Subject != "" {
+		// polls carry no CSR
+		tx.Subject = ev.Subject
+		tx.DNSNames = ev.DNSNames
+	}
+	tx.Reason = ev.Reason
+	tx.LastSeen = ev.Time
+	tx.Attempts++
+	return nil
+}
+
+// expire deletes the transactions idle for longer than the ttl.
+func (p *PendingTransactions) expire() {
+	now := p.clock.Now()
+	for id, tx := range p.pending {
+		if now.Sub(tx.LastSeen) > p.ttl {
+			delete(p.pending, id)
+		}
+	}
+}
+
+// List returns the pending transactions, oldest first.
+func (p *PendingTransactions) List() []PendingTransaction {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.expire()
+	list := make([]PendingTransaction, 0, len(p.pending))
+	for _, tx := range p.pending {
+		list = append(list, *tx)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].FirstSeen.Equal(list[j].FirstSeen) {
+			return list[i].FirstSeen.Before(list[j].FirstSeen)
+		}
+		return list[i].TransactionID < list[j].TransactionID
+	})
+	return list
+}
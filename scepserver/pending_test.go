@@ -0,0 +1,45 @@
+package scepserver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"scepclient/clock"
+)
+
+func TestPendingTransactions(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	pending := NewPendingTransactions(time.Hour, clk)
+	audit := func(id string, outcome AuditOutcome, subject string) {
+		ev := &AuditEvent{Time: clk.Now(), Outcome: outcome, TransactionID: id, Subject: subject, Reason: "awaiting approval"}
+		if err := pending.Audit(context.Background(), ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	audit("tx1", AuditPending, "CN=device-1")
+	clk.Advance(time.Minute)
+	audit("tx2", AuditPending, "CN=device-2")
+	audit("tx3", AuditPending, "CN=device-3")
+	// a poll, without CSR
+	audit("tx1", AuditPending, "")
+	// failed requests keep their transaction pending
+	audit("tx2", AuditFailed, "")
+	audit("tx3", AuditIssued, "CN=device-3")
+
+	list := pending.List()
+	if len(list) != 2 || list[0].TransactionID != "tx1" || list[1].TransactionID != "tx2" {
+		t.Fatalf("expected transactions tx1 and tx2 to be pending, got %+v", list)
+	}
+	if tx := list[0]; tx.Attempts != 2 || tx.Subject != "CN=device-1" || tx.LastSeen.Sub(tx.FirstSeen) != time.Minute {
+		t.Errorf("unexpected pending transaction %+v", tx)
+	}
+
+	// transactions without requests are forgotten
+	clk.Advance(30 * time.Minute)
+	audit("tx2", AuditPending, "")
+	clk.Advance(31 * time.Minute)
+	if list := pending.List(); len(list) != 1 || list[0].TransactionID != "tx2" {
+		t.Errorf("expected the idle transaction tx1 to be forgotten, got %+v", list)
+	}
+}
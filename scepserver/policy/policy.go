@@ -0,0 +1,357 @@
+// Package policy implements a declarative scepserver.Policy, restricting
+// the keys, subjects and subject alternative names of the certificates
+// a SCEP server issues, and the addresses of the clients requesting
+// them.
+//
+// Policies are usually loaded from JSON:
+//
+//	{
+//	  "key_algorithms": ["RSA", "ECDSA"],
+//	  "min_rsa_key_size": 2048,
+//	  "ecdsa_curves": ["P-256", "P-384"],
+//	  "common_name": "^[a-z0-9-]+$",
+//	  "dns_domains": ["devices.example.com"],
+//	  "max_validity": "2160h"
+//	}
+//
+// or, limiting who may obtain certificates from an exposed endpoint:
+//
+//	{
+//	  "common_name_patterns": ["device-*", "printer-*"],
+//	  "deny_common_name_patterns": ["device-test*"],
+//	  "deny_dns_domains": ["corp.example.com"],
+//	  "requester_ips": ["10.0.0.0/8", "192.0.2.7"],
+//	  "deny_requester_ips": ["10.66.0.0/16"]
+//	}
+//
+// Deny rules take precedence over the allowed patterns and ranges.
+package policy
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Policy restricts certificate requests. The zero Policy allows all.
+type Policy struct {
+	// KeyAlgorithms lists the allowed public key algorithms:
+	// "RSA", "ECDSA" and "Ed25519". All are allowed if it is empty.
+	KeyAlgorithms []string `json:"key_algorithms,omitempty"`
+
+	// MinRSAKeySize and MaxRSAKeySize bound the size of RSA keys
+	// in bits, if they are not zero.
+	MinRSAKeySize int `json:"min_rsa_key_size,omitempty"`
+	MaxRSAKeySize int `json:"max_rsa_key_size,omitempty"`
+
+	// ECDSACurves lists the allowed curves, such as "P-256".
+	// All are allowed if it is empty.
+	ECDSACurves []string `json:"ecdsa_curves,omitempty"`
+
+	// Subject and CommonName are regular expressions the subject,
+	// as formatted by pkix.Name.String, and its common name must
+	// match, if they are not empty.
+	Subject    string `json:"subject,omitempty"`
+	CommonName string `json:"common_name,omitempty"`
+
+	// DNSDomains lists the domains DNS names must be equal to, or
+	// a subdomain of. EmailDomains does the same for the domains of
+	// email addresses. Requests without such names always pass.
+	DNSDomains   []string `json:"dns_domains,omitempty"`
+	EmailDomains []string `json:"email_domains,omitempty"`
+
+	// DenyIPAddresses and DenyURIs reject requests for IP address
+	// and URI subject alternative names.
+	DenyIPAddresses bool `json:"deny_ip_addresses,omitempty"`
+	DenyURIs        bool `json:"deny_uris,omitempty"`
+
+	// CommonNamePatterns lists shell patterns, as of path.Match, one
+	// of which the common name must match, such as "device-*", if it
+	// is not empty. Common names matching a pattern of
+	// DenyCommonNamePatterns are rejected.
+	CommonNamePatterns     []string `json:"common_name_patterns,omitempty"`
+	DenyCommonNamePatterns []string `json:"deny_common_name_patterns,omitempty"`
+
+	// DenyDNSDomains rejects requests for DNS names equal to,
+	// or a subdomain of, one of its domains.
+	DenyDNSDomains []string `json:"deny_dns_domains,omitempty"`
+
+	// RequesterIPs lists the IP addresses and CIDR ranges, such as
+	// "10.0.0.0/8", one of which the client address must be in, if it
+	// is not empty. Clients in a range of DenyRequesterIPs are
+	// rejected. They are checked by CheckRequester.
+	RequesterIPs     []string `json:"requester_ips,omitempty"`
+	DenyRequesterIPs []string `json:"deny_requester_ips,omitempty"`
+
+	// MaxValidity caps the validity of issued certificates,
+	// if it is not zero.
+	MaxValidity Duration `json:"max_validity,omitempty"`
+
+	subject        *regexp.Regexp
+	commonName     *regexp.Regexp
+	requesters     []*net.IPNet
+	denyRequesters []*net.IPNet
+}
+
+// Duration is a time.Duration encoded in JSON as a string
+// such as "720h".
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Load reads a JSON policy from the file at path.
+func Load(path string) (*Policy, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+// Parse parses a JSON policy. Unknown fields are rejected, so that
+// misspelled restrictions are not silently ignored.
+func Parse(data []byte) (*Policy, error) {
+	var p Policy
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&p); err != nil {
+		return nil, fmt.Errorf("parse policy: %w", err)
+	}
+	if err := p.Compile(); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// Compile validates p and compiles its regular expressions. It must be
+// called before Check on a Policy which was not created by Parse.
+func (p *Policy) Compile() error {
+	for _, alg := range p.KeyAlgorithms {
+		switch alg {
+		case "RSA", "ECDSA", "Ed25519":
+		default:
+			return fmt.Errorf("policy: unknown key algorithm %q", alg)
+		}
+	}
+	var err error
+	if p.subject, err = compile(p.Subject); err != nil {
+		return fmt.Errorf("policy: subject: %w", err)
+	}
+	if p.commonName, err = compile(p.CommonName); err != nil {
+		return fmt.Errorf("policy: common_name: %w", err)
+	}
+	for _, patterns := range [][]string{p.CommonNamePatterns, p.DenyCommonNamePatterns} {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("policy: common name pattern %q: %w", pattern, err)
+			}
+		}
+	}
+	if p.requesters, err = parseRanges(p.RequesterIPs); err != nil {
+		return fmt.Errorf("policy: requester_ips: %w", err)
+	}
+	if p.denyRequesters, err = parseRanges(p.DenyRequesterIPs); err != nil {
+		return fmt.Errorf("policy: deny_requester_ips: %w", err)
+	}
+	return nil
+}
+
+// parseRanges parses IP addresses and CIDR ranges.
+func parseRanges(ranges []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, r := range ranges {
+		if !strings.Contains(r, "/") {
+			ip := net.ParseIP(r)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", r)
+			}
+			bits := 8 * len(ip)
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(r)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func compile(expr string) (*regexp.Regexp, error) {
+	if expr == "" {
+		return nil, nil
+	}
+	return regexp.Compile(expr)
+}
+
+// Check returns an error describing the first violation of p by csr,
+// which the server sends to the client as failInfoText.
+func (p *Policy) Check(csr *x509.CertificateRequest) error {
+	if err := p.checkKey(csr.PublicKey); err != nil {
+		return err
+	}
+	if p.subject != nil && !p.subject.MatchString(csr.Subject.String()) {
+		return fmt.Errorf("subject %q is not allowed", csr.Subject)
+	}
+	if p.commonName != nil && !p.commonName.MatchString(csr.Subject.CommonName) {
+		return fmt.Errorf("common name %q is not allowed", csr.Subject.CommonName)
+	}
+	if matchAny(p.DenyCommonNamePatterns, csr.Subject.CommonName) ||
+		len(p.CommonNamePatterns) > 0 && !matchAny(p.CommonNamePatterns, csr.Subject.CommonName) {
+		return fmt.Errorf("common name %q is not allowed", csr.Subject.CommonName)
+	}
+	for _, name := range csr.DNSNames {
+		if inDomains(name, p.DenyDNSDomains) {
+			return fmt.Errorf("DNS name %q is in a denied domain", name)
+		}
+	}
+	if len(p.DNSDomains) > 0 {
+		for _, name := range csr.DNSNames {
+			if !inDomains(name, p.DNSDomains) {
+				return fmt.Errorf("DNS name %q is not in a permitted domain", name)
+			}
+		}
+	}
+	if len(p.EmailDomains) > 0 {
+		for _, addr := range csr.EmailAddresses {
+			i := strings.LastIndex(addr, "@")
+			if i < 0 || !inDomains(addr[i+1:], p.EmailDomains) {
+				return fmt.Errorf("email address %q is not in a permitted domain", addr)
+			}
+		}
+	}
+	if p.DenyIPAddresses && len(csr.IPAddresses) > 0 {
+		return errors.New("IP address subject alternative names are not allowed")
+	}
+	if p.DenyURIs && len(csr.URIs) > 0 {
+		return errors.New("URI subject alternative names are not allowed")
+	}
+	return nil
+}
+
+// CheckRequester checks the address of the client requesting csr, as
+// formatted by net.JoinHostPort or without port, against RequesterIPs
+// and DenyRequesterIPs, before checking csr with Check. Clients with
+// an unknown address are rejected if p restricts them.
+func (p *Policy) CheckRequester(requester string, csr *x509.CertificateRequest) error {
+	if len(p.requesters) > 0 || len(p.denyRequesters) > 0 {
+		host := requester
+		if h, _, err := net.SplitHostPort(requester); err == nil {
+			host = h
+		}
+		ip := net.ParseIP(host)
+		switch {
+		case ip == nil:
+			return fmt.Errorf("requester address %q is unknown", requester)
+		case inRanges(ip, p.denyRequesters),
+			len(p.requesters) > 0 && !inRanges(ip, p.requesters):
+			return fmt.Errorf("requester %s is not allowed", ip)
+		}
+	}
+	return p.Check(csr)
+}
+
+func (p *Policy) checkKey(pub interface{}) error {
+	var alg string
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		alg = "RSA"
+		size := key.N.BitLen()
+		if p.MinRSAKeySize > 0 && size < p.MinRSAKeySize {
+			return fmt.Errorf("RSA key size %d is below the minimum of %d", size, p.MinRSAKeySize)
+		}
+		if p.MaxRSAKeySize > 0 && size > p.MaxRSAKeySize {
+			return fmt.Errorf("RSA key size %d is above the maximum of %d", size, p.MaxRSAKeySize)
+		}
+	case *ecdsa.PublicKey:
+		alg = "ECDSA"
+		if curve := key.Curve.Params().Name; len(p.ECDSACurves) > 0 && !contains(p.ECDSACurves, curve) {
+			return fmt.Errorf("ECDSA curve %s is not allowed", curve)
+		}
+	case ed25519.PublicKey:
+		alg = "Ed25519"
+	default:
+		return fmt.Errorf("public key type %T is not supported", pub)
+	}
+	if len(p.KeyAlgorithms) > 0 && !contains(p.KeyAlgorithms, alg) {
+		return fmt.Errorf("%s keys are not allowed", alg)
+	}
+	return nil
+}
+
+// MaxCertificateValidity returns MaxValidity, for the SCEP server
+// to cap the validity of the certificates it issues.
+func (p *Policy) MaxCertificateValidity() time.Duration {
+	return time.Duration(p.MaxValidity)
+}
+
+// inDomains reports whether name is one of domains or a subdomain.
+func inDomains(name string, domains []string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for _, domain := range domains {
+		domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+		if name == domain || strings.HasSuffix(name, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// inRanges reports whether ip is in one of nets.
+func inRanges(ip net.IP, nets []*net.IPNet) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchAny reports whether name matches one of patterns.
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
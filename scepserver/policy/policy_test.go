@@ -0,0 +1,149 @@
+package policy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCheck(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := Parse([]byte(`{
+		"key_algorithms": ["RSA", "ECDSA"],
+		"min_rsa_key_size": 2048,
+		"ecdsa_curves": ["P-256"],
+		"common_name": "^device-[0-9]+$",
+		"dns_domains": ["devices.example.com"],
+		"email_domains": ["example.com"],
+		"deny_ip_addresses": true,
+		"max_validity": "720h"
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.MaxCertificateValidity() != 720*time.Hour {
+		t.Errorf("expected a max validity of 720h, got %s", p.MaxCertificateValidity())
+	}
+
+	okKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok := x509.CertificateRequest{
+		Subject:        pkix.Name{CommonName: "device-1"},
+		DNSNames:       []string{"a.devices.example.com", "DEVICES.example.com."},
+		EmailAddresses: []string{"admin@example.com"},
+	}
+	tests := []struct {
+		name   string
+		key    interface{}
+		modify func(*x509.CertificateRequest)
+		ok     bool
+	}{
+		{"allowed", okKey, func(*x509.CertificateRequest) {}, true},
+		{"small RSA key", rsaKey, func(*x509.CertificateRequest) {}, false},
+		{"curve", ecKey, func(*x509.CertificateRequest) {}, false},
+		{"common name", okKey, func(r *x509.CertificateRequest) { r.Subject.CommonName = "laptop" }, false},
+		{"DNS domain", okKey, func(r *x509.CertificateRequest) { r.DNSNames = []string{"evildevices.example.com"} }, false},
+		{"email domain", okKey, func(r *x509.CertificateRequest) { r.EmailAddresses = []string{"a@example.org"} }, false},
+		{"IP address", okKey, func(r *x509.CertificateRequest) { r.IPAddresses = []net.IP{net.IPv4(10, 0, 0, 1)} }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl := ok
+			tt.modify(&tmpl)
+			der, err := x509.CreateCertificateRequest(rand.Reader, &tmpl, tt.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			csr, err := x509.ParseCertificateRequest(der)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = p.Check(csr)
+			if (err == nil) != tt.ok {
+				t.Errorf("expected ok=%v, got %v", tt.ok, err)
+			}
+		})
+	}
+}
+
+func TestCheckRequester(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := Parse([]byte(`{
+		"common_name_patterns": ["device-*", "printer-*"],
+		"deny_common_name_patterns": ["device-test*"],
+		"deny_dns_domains": ["corp.example.com"],
+		"requester_ips": ["10.0.0.0/8", "2001:db8::/32", "192.0.2.7"],
+		"deny_requester_ips": ["10.66.0.0/16"]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		requester string
+		cn        string
+		dnsNames  []string
+		ok        bool
+	}{
+		{"allowed", "10.1.2.3:51234", "device-1", []string{"device-1.example.com"}, true},
+		{"IPv6", "[2001:db8::1]:443", "printer-2", nil, true},
+		{"single address", "192.0.2.7", "device-1", nil, true},
+		{"requester outside the ranges", "192.0.2.8:443", "device-1", nil, false},
+		{"denied requester", "10.66.0.1:443", "device-1", nil, false},
+		{"unknown requester", "", "device-1", nil, false},
+		{"common name matching no pattern", "10.1.2.3:443", "laptop-1", nil, false},
+		{"denied common name", "10.1.2.3:443", "device-test-1", nil, false},
+		{"denied DNS domain", "10.1.2.3:443", "device-1", []string{"a.CORP.example.com"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl := &x509.CertificateRequest{Subject: pkix.Name{CommonName: tt.cn}, DNSNames: tt.dnsNames}
+			der, err := x509.CreateCertificateRequest(rand.Reader, tmpl, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			csr, err := x509.ParseCertificateRequest(der)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = p.CheckRequester(tt.requester, csr)
+			if (err == nil) != tt.ok {
+				t.Errorf("expected ok=%v, got %v", tt.ok, err)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, data := range []string{
+		`{"key_algoritms": ["RSA"]}`,
+		`{"key_algorithms": ["DSA"]}`,
+		`{"common_name": "("}`,
+		`{"max_validity": "a year"}`,
+		`{"common_name_patterns": ["device-["]}`,
+		`{"requester_ips": ["10.0.0.0/33"]}`,
+		`{"deny_requester_ips": ["localhost"]}`,
+	} {
+		if _, err := Parse([]byte(data)); err == nil {
+			t.Errorf("expected an error parsing %s", data)
+		}
+	}
+}
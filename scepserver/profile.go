@@ -0,0 +1,116 @@
+package scepserver
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/asn1"
+	"time"
+)
+
+// Profile shapes the certificates issued with the CA key, so that one
+// service can issue certificates of different kinds, for example for
+// Wi-Fi and VPN clients.
+type Profile struct {
+	// Name identifies the profile in logs.
+	Name string
+
+	// ChallengePassword, if set, authorizes requests of the profile
+	// like the password of WithChallengePassword.
+	ChallengePassword string
+
+	// Validity is the validity period of the certificates,
+	// or that of WithCertificateValidity if it is zero.
+	Validity time.Duration
+
+	// KeyUsage and ExtKeyUsage replace the default usages, digital
+	// signature and key encipherment for client authentication, if
+	// either is set. UnknownExtKeyUsage adds extended key usages
+	// unknown to crypto/x509, such as IKE intermediate for VPNs.
+	KeyUsage           x509.KeyUsage
+	ExtKeyUsage        []x509.ExtKeyUsage
+	UnknownExtKeyUsage []asn1.ObjectIdentifier
+
+	// CopyDNSNames, CopyEmailAddresses, CopyIPAddresses and CopyURIs
+	// select the subject alternative names copied from the CSR.
+	CopyDNSNames       bool
+	CopyEmailAddresses bool
+	CopyIPAddresses    bool
+	CopyURIs           bool
+
+	// CommonNameAsDNSName adds the common name of the subject as DNS
+	// name, for clients expecting it there rather than in the subject.
+	CommonNameAsDNSName bool
+}
+
+// ProfileRequest is a certificate request selecting a profile.
+type ProfileRequest struct {
+	CSR               *x509.CertificateRequest
+	ChallengePassword string
+}
+
+// ProfileSelector selects the profile of certificate requests.
+// Implementations must be safe for concurrent use.
+type ProfileSelector interface {
+	// SelectProfile returns the profile of req, or nil for the default
+	// certificate, or an error explaining why no profile applies, which
+	// is sent to the client as failInfoText.
+	SelectProfile(req *ProfileRequest) (*Profile, error)
+}
+
+// WithProfiles issues certificates shaped by the profiles selector
+// selects. Custom signers set with WithSigner find the profile of a
+// request with RequestProfile.
+func WithProfiles(selector ProfileSelector) ServiceOption {
+	return func(s *service) {
+		s.profiles = selector
+	}
+}
+
+type profileKey struct{}
+
+// withProfile returns a context carrying profile.
+func withProfile(ctx context.Context, profile *Profile) context.Context {
+	return context.WithValue(ctx, profileKey{}, profile)
+}
+
+// RequestProfile returns the profile selected for the request
+// being signed, carried by ctx.
+func RequestProfile(ctx context.Context) (*Profile, bool) {
+	profile, ok := ctx.Value(profileKey{}).(*Profile)
+	return profile, ok && profile != nil
+}
+
+// apply shapes tmpl, the certificate issued for csr, with the usages
+// and subject alternative names of p. Sign applies the validity.
+func (p *Profile) apply(tmpl *x509.Certificate, csr *x509.CertificateRequest) {
+	if p.KeyUsage != 0 || len(p.ExtKeyUsage) > 0 || len(p.UnknownExtKeyUsage) > 0 {
+		tmpl.KeyUsage = p.KeyUsage
+		tmpl.ExtKeyUsage = p.ExtKeyUsage
+		tmpl.UnknownExtKeyUsage = p.UnknownExtKeyUsage
+	}
+	tmpl.DNSNames, tmpl.EmailAddresses, tmpl.IPAddresses, tmpl.URIs = nil, nil, nil, nil
+	if p.CopyDNSNames {
+		tmpl.DNSNames = csr.DNSNames
+	}
+	if p.CopyEmailAddresses {
+		tmpl.EmailAddresses = csr.EmailAddresses
+	}
+	if p.CopyIPAddresses {
+		tmpl.IPAddresses = csr.IPAddresses
+	}
+	if p.CopyURIs {
+		tmpl.URIs = csr.URIs
+	}
+	if cn := csr.Subject.CommonName; p.CommonNameAsDNSName && cn != "" && !contains(tmpl.DNSNames, cn) {
+		tmpl.DNSNames = append(append([]string(nil), tmpl.DNSNames...), cn)
+	}
+}
+
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
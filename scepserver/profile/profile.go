@@ -0,0 +1,278 @@
+// Package profile implements a scepserver.ProfileSelector, issuing
+// certificates of different shapes from one SCEP server, selected by
+// the challenge password or attributes of the CSR.
+//
+// Profiles are usually loaded from JSON. The first profile matching a
+// request applies; a profile without match criteria matches all:
+//
+//	{
+//	  "profiles": [
+//	    {
+//	      "name": "wifi",
+//	      "match": {"challenge": "wifi-secret"},
+//	      "validity": "2160h",
+//	      "key_usage": ["digital_signature"],
+//	      "ext_key_usage": ["client_auth"],
+//	      "copy_sans": ["email"]
+//	    },
+//	    {
+//	      "name": "vpn",
+//	      "match": {"template": "VPN"},
+//	      "ext_key_usage": ["client_auth", "1.3.6.1.5.5.8.2.2"],
+//	      "copy_sans": ["dns"],
+//	      "common_name_as_dns_name": true
+//	    }
+//	  ]
+//	}
+package profile
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"scepclient/scepserver"
+	"scepclient/scepserver/policy"
+)
+
+// Profiles selects the first profile matching a request.
+type Profiles struct {
+	Profiles []Profile `json:"profiles"`
+}
+
+// Profile is an issuance profile and the requests it applies to.
+type Profile struct {
+	Name  string `json:"name"`
+	Match Match  `json:"match"`
+
+	// Validity is the validity period of the certificates,
+	// that of the server if it is zero.
+	Validity policy.Duration `json:"validity,omitempty"`
+
+	// KeyUsage lists key usages such as "digital_signature" and
+	// "key_encipherment". ExtKeyUsage lists extended key usages such
+	// as "client_auth" and "server_auth", or their dotted OIDs. The
+	// server defaults apply if both are empty.
+	KeyUsage    []string `json:"key_usage,omitempty"`
+	ExtKeyUsage []string `json:"ext_key_usage,omitempty"`
+
+	// CopySANs lists the subject alternative names copied from the
+	// CSR: "dns", "email", "ip" and "uri". All are copied if it is
+	// absent, none if it is empty.
+	CopySANs []string `json:"copy_sans"`
+
+	// CommonNameAsDNSName adds the common name as DNS name.
+	CommonNameAsDNSName bool `json:"common_name_as_dns_name,omitempty"`
+
+	profile *scepserver.Profile
+	subject *regexp.Regexp
+}
+
+// Match selects the requests of a profile. All criteria which are set
+// must match.
+type Match struct {
+	// Challenge is a challenge password selecting the profile. It
+	// authorizes requests like the static challenge of the server.
+	Challenge string `json:"challenge,omitempty"`
+
+	// Subject is a regular expression the subject of the CSR,
+	// as formatted by pkix.Name.String, must match.
+	Subject string `json:"subject,omitempty"`
+
+	// Template is the certificate template name requested in the
+	// CSR with the Microsoft extension 1.3.6.1.4.1.311.20.2.
+	Template string `json:"template,omitempty"`
+}
+
+// Load reads JSON profiles from the file at path.
+func Load(path string) (*Profiles, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+// Parse parses JSON profiles. Unknown fields are rejected, so that
+// misspelled settings are not silently ignored.
+func Parse(data []byte) (*Profiles, error) {
+	var p Profiles
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&p); err != nil {
+		return nil, fmt.Errorf("parse profiles: %w", err)
+	}
+	if err := p.Compile(); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// Compile validates the profiles and compiles them. It must be called
+// before SelectProfile on Profiles which were not created by Parse.
+func (p *Profiles) Compile() error {
+	if len(p.Profiles) == 0 {
+		return errors.New("profile: no profiles")
+	}
+	for i := range p.Profiles {
+		if err := p.Profiles[i].compile(); err != nil {
+			return fmt.Errorf("profile %q: %w", p.Profiles[i].Name, err)
+		}
+	}
+	return nil
+}
+
+func (p *Profile) compile() error {
+	if p.Name == "" {
+		return errors.New("missing name")
+	}
+	profile := &scepserver.Profile{
+		Name:                p.Name,
+		ChallengePassword:   p.Match.Challenge,
+		Validity:            time.Duration(p.Validity),
+		CommonNameAsDNSName: p.CommonNameAsDNSName,
+	}
+	for _, name := range p.KeyUsage {
+		usage, ok := keyUsages[name]
+		if !ok {
+			return fmt.Errorf("unknown key usage %q", name)
+		}
+		profile.KeyUsage |= usage
+	}
+	for _, name := range p.ExtKeyUsage {
+		if usage, ok := extKeyUsages[name]; ok {
+			profile.ExtKeyUsage = append(profile.ExtKeyUsage, usage)
+			continue
+		}
+		oid, err := parseOID(name)
+		if err != nil {
+			return fmt.Errorf("unknown extended key usage %q", name)
+		}
+		profile.UnknownExtKeyUsage = append(profile.UnknownExtKeyUsage, oid)
+	}
+	if p.CopySANs == nil {
+		p.CopySANs = []string{"dns", "email", "ip", "uri"}
+	}
+	for _, san := range p.CopySANs {
+		switch san {
+		case "dns":
+			profile.CopyDNSNames = true
+		case "email":
+			profile.CopyEmailAddresses = true
+		case "ip":
+			profile.CopyIPAddresses = true
+		case "uri":
+			profile.CopyURIs = true
+		default:
+			return fmt.Errorf("unknown subject alternative name type %q", san)
+		}
+	}
+	if p.Match.Subject != "" {
+		var err error
+		if p.subject, err = regexp.Compile(p.Match.Subject); err != nil {
+			return fmt.Errorf("match subject: %w", err)
+		}
+	}
+	p.profile = profile
+	return nil
+}
+
+// SelectProfile returns the first profile matching req.
+func (p *Profiles) SelectProfile(req *scepserver.ProfileRequest) (*scepserver.Profile, error) {
+	for i := range p.Profiles {
+		if p.Profiles[i].matches(req) {
+			return p.Profiles[i].profile, nil
+		}
+	}
+	return nil, errors.New("no certificate profile matches the request")
+}
+
+func (p *Profile) matches(req *scepserver.ProfileRequest) bool {
+	m := p.Match
+	if m.Challenge != "" && subtle.ConstantTimeCompare([]byte(req.ChallengePassword), []byte(m.Challenge)) != 1 {
+		return false
+	}
+	if p.subject != nil && !p.subject.MatchString(req.CSR.Subject.String()) {
+		return false
+	}
+	if m.Template != "" && !strings.EqualFold(Template(req.CSR), m.Template) {
+		return false
+	}
+	return true
+}
+
+// oidTemplateName is the Microsoft certificate template name extension.
+var oidTemplateName = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 20, 2}
+
+// Template returns the certificate template name requested by csr,
+// or an empty string.
+func Template(csr *x509.CertificateRequest) string {
+	for _, ext := range csr.Extensions {
+		if !ext.Id.Equal(oidTemplateName) {
+			continue
+		}
+		var value asn1.RawValue
+		if _, err := asn1.Unmarshal(ext.Value, &value); err != nil {
+			return ""
+		}
+		if value.Tag == asn1.TagBMPString {
+			if len(value.Bytes)%2 != 0 {
+				return ""
+			}
+			units := make([]uint16, len(value.Bytes)/2)
+			for i := range units {
+				units[i] = uint16(value.Bytes[2*i])<<8 | uint16(value.Bytes[2*i+1])
+			}
+			return string(utf16.Decode(units))
+		}
+		return string(value.Bytes)
+	}
+	return ""
+}
+
+var keyUsages = map[string]x509.KeyUsage{
+	"digital_signature":  x509.KeyUsageDigitalSignature,
+	"content_commitment": x509.KeyUsageContentCommitment,
+	"key_encipherment":   x509.KeyUsageKeyEncipherment,
+	"data_encipherment":  x509.KeyUsageDataEncipherment,
+	"key_agreement":      x509.KeyUsageKeyAgreement,
+}
+
+var extKeyUsages = map[string]x509.ExtKeyUsage{
+	"any":              x509.ExtKeyUsageAny,
+	"server_auth":      x509.ExtKeyUsageServerAuth,
+	"client_auth":      x509.ExtKeyUsageClientAuth,
+	"code_signing":     x509.ExtKeyUsageCodeSigning,
+	"email_protection": x509.ExtKeyUsageEmailProtection,
+	"ipsec_end_system": x509.ExtKeyUsageIPSECEndSystem,
+	"ipsec_tunnel":     x509.ExtKeyUsageIPSECTunnel,
+	"ipsec_user":       x509.ExtKeyUsageIPSECUser,
+	"time_stamping":    x509.ExtKeyUsageTimeStamping,
+	"ocsp_signing":     x509.ExtKeyUsageOCSPSigning,
+}
+
+func parseOID(s string) (asn1.ObjectIdentifier, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) < 2 {
+		return nil, errors.New("not an OID")
+	}
+	oid := make(asn1.ObjectIdentifier, len(parts))
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, errors.New("not an OID")
+		}
+		oid[i] = n
+	}
+	return oid, nil
+}
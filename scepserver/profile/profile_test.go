@@ -0,0 +1,120 @@
+package profile
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"testing"
+	"time"
+	"unicode/utf16"
+
+	"scepclient/scepserver"
+)
+
+// templateExtension returns the template name extension of name,
+// encoded as a BMPString like Windows clients do.
+func templateExtension(t *testing.T, name string) pkix.Extension {
+	var bmp []byte
+	for _, u := range utf16.Encode([]rune(name)) {
+		bmp = append(bmp, byte(u>>8), byte(u))
+	}
+	value, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagBMPString, Bytes: bmp})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pkix.Extension{Id: oidTemplateName, Value: value}
+}
+
+func TestSelectProfile(t *testing.T) {
+	p, err := Parse([]byte(`{
+		"profiles": [
+			{
+				"name": "wifi",
+				"match": {"challenge": "wifi-secret"},
+				"validity": "720h",
+				"key_usage": ["digital_signature"],
+				"ext_key_usage": ["client_auth"],
+				"copy_sans": ["email"]
+			},
+			{
+				"name": "vpn",
+				"match": {"template": "VPN"},
+				"ext_key_usage": ["client_auth", "1.3.6.1.5.5.8.2.2"],
+				"copy_sans": [],
+				"common_name_as_dns_name": true
+			},
+			{
+				"name": "servers",
+				"match": {"subject": "OU=servers"}
+			}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		csr       *x509.CertificateRequest
+		challenge string
+		want      string
+	}{
+		{"challenge", &x509.CertificateRequest{}, "wifi-secret", "wifi"},
+		{"template", &x509.CertificateRequest{Extensions: []pkix.Extension{templateExtension(t, "vpn")}}, "", "vpn"},
+		{"subject", &x509.CertificateRequest{Subject: pkix.Name{CommonName: "db", OrganizationalUnit: []string{"servers"}}}, "", "servers"},
+		{"no match", &x509.CertificateRequest{Subject: pkix.Name{CommonName: "laptop"}}, "wrong", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			profile, err := p.SelectProfile(&scepserver.ProfileRequest{CSR: tt.csr, ChallengePassword: tt.challenge})
+			if tt.want == "" {
+				if err == nil {
+					t.Errorf("expected no profile to match, got %q", profile.Name)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if profile.Name != tt.want {
+				t.Errorf("expected profile %q, got %q", tt.want, profile.Name)
+			}
+		})
+	}
+
+	wifi := p.Profiles[0].profile
+	if wifi.ChallengePassword != "wifi-secret" || wifi.Validity != 720*time.Hour || wifi.KeyUsage != x509.KeyUsageDigitalSignature {
+		t.Errorf("unexpected wifi profile %+v", wifi)
+	}
+	if !wifi.CopyEmailAddresses || wifi.CopyDNSNames {
+		t.Errorf("expected the wifi profile to copy only email addresses, got %+v", wifi)
+	}
+	vpn := p.Profiles[1].profile
+	if len(vpn.UnknownExtKeyUsage) != 1 || !vpn.UnknownExtKeyUsage[0].Equal(asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 8, 2, 2}) {
+		t.Errorf("expected the IKE intermediate usage, got %v", vpn.UnknownExtKeyUsage)
+	}
+	if vpn.CopyDNSNames || !vpn.CommonNameAsDNSName {
+		t.Errorf("expected the vpn profile to copy no SANs, got %+v", vpn)
+	}
+	servers := p.Profiles[2].profile
+	if !servers.CopyDNSNames || !servers.CopyEmailAddresses || !servers.CopyIPAddresses || !servers.CopyURIs {
+		t.Errorf("expected the servers profile to copy all SANs, got %+v", servers)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, data := range []string{
+		`{"profiles": []}`,
+		`{"profiles": [{"match": {}}]}`,
+		`{"profiles": [{"name": "a", "key_usage": ["signing"]}]}`,
+		`{"profiles": [{"name": "a", "ext_key_usage": ["vpn"]}]}`,
+		`{"profiles": [{"name": "a", "copy_sans": ["upn"]}]}`,
+		`{"profiles": [{"name": "a", "match": {"subject": "("}}]}`,
+		`{"profiles": [{"name": "a", "validity": "1 year"}]}`,
+		`{"profiles": [{"name": "a", "valid": "24h"}]}`,
+	} {
+		if _, err := Parse([]byte(data)); err == nil {
+			t.Errorf("expected an error parsing %s", data)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package scepserver
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// Limiter blocks until a request may proceed, or the context is done.
+// A *rate.Limiter from golang.org/x/time/rate satisfies this interface.
+type Limiter interface {
+	Wait(ctx context.Context) error
+}
+
+// NewTokenBucket returns a Limiter which allows rate requests per second
+// on average, with bursts of up to burst requests. A rate of zero or less
+// does not limit requests.
+func NewTokenBucket(rate float64, burst int) Limiter {
+	return newTokenBucket(rate, burst, time.Now())
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   now,
+	}
+}
+
+type tokenBucket struct {
+	rate  float64
+	burst float64
+
+	mtx    sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens accumulated since the last call.
+// It must be called with b.mtx held.
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// take takes a token if one is available. Otherwise it returns how
+// long it takes for one to become available, without taking it.
+func (b *tokenBucket) take(now time.Time) (time.Duration, bool) {
+	if b.rate <= 0 {
+		return 0, true
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.refill(now)
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / b.rate * float64(time.Second)), false
+	}
+	b.tokens--
+	return 0, true
+}
+
+// full reports whether the bucket has refilled completely,
+// so that forgetting it does not change the limit.
+func (b *tokenBucket) full(now time.Time) bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.refill(now)
+	return b.tokens >= b.burst
+}
+
+func (b *tokenBucket) Wait(ctx context.Context) error {
+	if b.rate <= 0 {
+		return nil
+	}
+	b.mtx.Lock()
+	b.refill(time.Now())
+	// reserve a token, waiting for it if the bucket is empty
+	b.tokens--
+	wait := time.Duration(-b.tokens / b.rate * float64(time.Second))
+	b.mtx.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		// return the reserved token
+		b.mtx.Lock()
+		b.tokens++
+		b.mtx.Unlock()
+		return ctx.Err()
+	}
+}
+
+// RateLimitMiddleware delays requests to keep them within limits, so that
+// bulk enrollments and poll loops don't overload small servers. limiter
+// applies to all requests and may be nil. The limiters in perOperation
+// apply in addition to requests of the operation they are keyed by,
+// for example "PKIOperation".
+func RateLimitMiddleware(limiter Limiter, perOperation map[string]Limiter) Middleware {
+	return func(next Transport) Transport {
+		return &rateLimitTransport{next: next, limiter: limiter, perOperation: perOperation}
+	}
+}
+
+type rateLimitTransport struct {
+	next         Transport
+	limiter      Limiter
+	perOperation map[string]Limiter
+}
+
+func (t *rateLimitTransport) wait(ctx context.Context, op string) error {
+	if t.limiter != nil {
+		if err := t.limiter.Wait(ctx); err != nil {
+			return err
+		}
+	}
+	if l, ok := t.perOperation[op]; ok {
+		return l.Wait(ctx)
+	}
+	return nil
+}
+
+func (t *rateLimitTransport) SendGet(ctx context.Context, req SCEPRequest) (SCEPResponse, error) {
+	if err := t.wait(ctx, req.Operation); err != nil {
+		return SCEPResponse{}, err
+	}
+	return t.next.SendGet(ctx, req)
+}
+
+func (t *rateLimitTransport) SendPost(ctx context.Context, req SCEPRequest) (SCEPResponse, error) {
+	if err := t.wait(ctx, req.Operation); err != nil {
+		return SCEPResponse{}, err
+	}
+	return t.next.SendPost(ctx, req)
+}
+
+func (t *rateLimitTransport) StreamGet(ctx context.Context, req SCEPRequest) (io.ReadCloser, SCEPResponse, error) {
+	if err := t.wait(ctx, req.Operation); err != nil {
+		return nil, SCEPResponse{}, err
+	}
+	return StreamGet(ctx, t.next, req)
+}
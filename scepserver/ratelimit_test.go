@@ -0,0 +1,103 @@
+package scepserver
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(10, 2, now)
+	for i := 0; i < 2; i++ {
+		if _, ok := b.take(now); !ok {
+			t.Fatalf("expected request %d of the burst to pass", i+1)
+		}
+	}
+	wait, ok := b.take(now)
+	if ok || wait != 100*time.Millisecond {
+		t.Fatalf("expected to wait 100ms once the burst is used, got %v %v", wait, ok)
+	}
+	if _, ok := b.take(now.Add(100 * time.Millisecond)); !ok {
+		t.Error("expected a token after 100ms at 10 requests per second")
+	}
+	if b.full(now.Add(150 * time.Millisecond)) {
+		t.Error("expected the bucket not to be full after 150ms")
+	}
+	if !b.full(now.Add(time.Second)) {
+		t.Error("expected the bucket to refill up to the burst")
+	}
+
+	unlimited := newTokenBucket(0, 1, now)
+	for i := 0; i < 100; i++ {
+		if _, ok := unlimited.take(now); !ok {
+			t.Fatal("expected a rate of zero not to limit requests")
+		}
+	}
+}
+
+func TestTokenBucketWait(t *testing.T) {
+	b := NewTokenBucket(1, 1)
+	if err := b.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := b.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the wait for the next token to be canceled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("expected the wait to end with the context, took %v", elapsed)
+	}
+	// the canceled wait returned its token
+	if tokens := b.(*tokenBucket).tokens; tokens < -0.1 {
+		t.Errorf("expected the reserved token to be returned, got %v tokens", tokens)
+	}
+}
+
+// countingLimiter counts the requests it lets through,
+// or fails them with err.
+type countingLimiter struct {
+	waits int
+	err   error
+}
+
+func (l *countingLimiter) Wait(ctx context.Context) error {
+	l.waits++
+	return l.err
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	all := &countingLimiter{}
+	pki := &countingLimiter{}
+	next := &countingTransport{}
+	transport := RateLimitMiddleware(all, map[string]Limiter{pkiOperation: pki})(next)
+
+	ctx := context.Background()
+	if _, err := transport.SendGet(ctx, SCEPRequest{Operation: getCACert}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := transport.SendPost(ctx, SCEPRequest{Operation: pkiOperation}); err != nil {
+		t.Fatal(err)
+	}
+	if all.waits != 2 || pki.waits != 1 {
+		t.Errorf("expected 2 requests limited in total and 1 PKIOperation, got %d and %d", all.waits, pki.waits)
+	}
+
+	// requests the limiter fails are not sent
+	pki.err = context.Canceled
+	if _, err := transport.SendPost(ctx, SCEPRequest{Operation: pkiOperation}); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the error of the limiter, got %v", err)
+	}
+	if next.calls != 2 {
+		t.Errorf("expected 2 requests sent, got %d", next.calls)
+	}
+
+	// without a global limiter
+	transport = RateLimitMiddleware(nil, map[string]Limiter{pkiOperation: pki})(next)
+	if _, err := transport.SendGet(ctx, SCEPRequest{Operation: getCACaps}); err != nil {
+		t.Fatal(err)
+	}
+}
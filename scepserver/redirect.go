@@ -0,0 +1,56 @@
+package scepserver
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// ErrRedirect is returned when the server redirects a
+// request in a way the RedirectPolicy does not allow.
+var ErrRedirect = errors.New("scep: redirect not allowed")
+
+// RedirectPolicy configures which redirects the HTTP transport follows.
+// SCEP gateways often redirect /cgi-bin/pkiclient.exe to a vendor-specific
+// path.
+//
+// A POST request redirected with 301, 302 or 303 is never followed, as
+// the client would resend it as a GET without the PKI message.
+type RedirectPolicy struct {
+	// MaxRedirects is the maximum number of redirects
+	// followed per request. Zero follows none.
+	MaxRedirects int
+
+	// SameHost restricts redirects to the host of the server URL.
+	SameHost bool
+
+	// PreservePOST follows 307 and 308 redirects of POST
+	// requests, sending the PKI message to the new location.
+	PreservePOST bool
+}
+
+// DefaultRedirectPolicy follows up to 10 redirects to any host.
+var DefaultRedirectPolicy = RedirectPolicy{
+	MaxRedirects: 10,
+	PreservePOST: true,
+}
+
+// checkRedirect implements http.Client.CheckRedirect.
+func (p RedirectPolicy) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) > p.MaxRedirects {
+		return fmt.Errorf("stopped after %d redirects: %w", p.MaxRedirects, ErrRedirect)
+	}
+	first, prev := via[0], via[len(via)-1]
+	if p.SameHost && req.URL.Host != first.URL.Host {
+		return fmt.Errorf("redirect to other host %s: %w", req.URL.Host, ErrRedirect)
+	}
+	if prev.Method == "POST" {
+		if req.Method != "POST" {
+			return fmt.Errorf("POST redirected with status %d: %w", req.Response.StatusCode, ErrRedirect)
+		}
+		if !p.PreservePOST {
+			return fmt.Errorf("POST redirected to %s: %w", req.URL, ErrRedirect)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package scepserver
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRedirectPolicy(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cgi-bin/pkiclient.exe", func(w http.ResponseWriter, r *http.Request) {
+		code := http.StatusFound
+		if r.Method == "POST" {
+			code = http.StatusTemporaryRedirect
+		}
+		if r.URL.Query().Get("status") == "303" {
+			code = http.StatusSeeOther
+		}
+		http.Redirect(w, r, "/scep?"+r.URL.RawQuery, code)
+	})
+	mux.HandleFunc("/scep", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(r.Method))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	tests := []struct {
+		name     string
+		policy   RedirectPolicy
+		method   string
+		status   string
+		wantData string
+	}{
+		{"GET followed", DefaultRedirectPolicy, "GET", "", "GET"},
+		{"POST 307 followed", DefaultRedirectPolicy, "POST", "", "POST"},
+		{"POST 303 refused", DefaultRedirectPolicy, "POST", "303", ""},
+		{"POST 307 not preserved", RedirectPolicy{MaxRedirects: 10}, "POST", "", ""},
+		{"redirects disabled", RedirectPolicy{}, "GET", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport, err := NewHTTPTransport(srv.URL+"/cgi-bin/pkiclient.exe", WithRedirectPolicy(tt.policy))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := SCEPRequest{Operation: getCACaps, Message: []byte("message")}
+			if tt.status != "" {
+				transport.(*httpTransport).tgt.RawQuery = "status=" + tt.status
+			}
+			var resp SCEPResponse
+			if tt.method == "POST" {
+				resp, err = transport.SendPost(context.Background(), req)
+			} else {
+				resp, err = transport.SendGet(context.Background(), req)
+			}
+			if tt.wantData == "" {
+				if !errors.Is(err, ErrRedirect) {
+					t.Errorf("expected ErrRedirect, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(resp.Data) != tt.wantData {
+				t.Errorf("expected %s, got %s", tt.wantData, resp.Data)
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package scepserver
+
+import (
+	"context"
+	"crypto/x509"
+	"sync"
+	"time"
+)
+
+// Reloader is implemented by configuration which can be reloaded
+// while the server runs, for example when it receives SIGHUP.
+type Reloader interface {
+	// Reload reloads the configuration. If it fails,
+	// the current configuration is kept.
+	Reload() error
+}
+
+// ReloadingPolicy is a Policy, and a RequesterPolicy, delegating to
+// the Policy returned by a load function, which Reload calls again.
+// Requests being checked while it reloads are checked with either.
+type ReloadingPolicy struct {
+	load func() (Policy, error)
+
+	mtx    sync.RWMutex
+	policy Policy
+}
+
+// NewReloadingPolicy returns a ReloadingPolicy with the Policy of load.
+func NewReloadingPolicy(load func() (Policy, error)) (*ReloadingPolicy, error) {
+	policy, err := load()
+	if err != nil {
+		return nil, err
+	}
+	return &ReloadingPolicy{load: load, policy: policy}, nil
+}
+
+// Reload replaces the policy with a new one of the load function,
+// unless it fails.
+func (p *ReloadingPolicy) Reload() error {
+	policy, err := p.load()
+	if err != nil {
+		return err
+	}
+	p.mtx.Lock()
+	p.policy = policy
+	p.mtx.Unlock()
+	return nil
+}
+
+func (p *ReloadingPolicy) current() Policy {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+	return p.policy
+}
+
+// Check checks csr with the current policy.
+func (p *ReloadingPolicy) Check(csr *x509.CertificateRequest) error {
+	return p.current().Check(csr)
+}
+
+// CheckRequester checks the requester and csr with the current policy,
+// or only csr if it is not a RequesterPolicy.
+func (p *ReloadingPolicy) CheckRequester(requester string, csr *x509.CertificateRequest) error {
+	policy := p.current()
+	if rp, ok := policy.(RequesterPolicy); ok {
+		return rp.CheckRequester(requester, csr)
+	}
+	return policy.Check(csr)
+}
+
+// MaxCertificateValidity returns the one of the current policy.
+func (p *ReloadingPolicy) MaxCertificateValidity() time.Duration {
+	return p.current().MaxCertificateValidity()
+}
+
+// ReloadingProfiles is a ProfileSelector delegating to the one
+// returned by a load function, which Reload calls again.
+type ReloadingProfiles struct {
+	load func() (ProfileSelector, error)
+
+	mtx      sync.RWMutex
+	profiles ProfileSelector
+}
+
+// NewReloadingProfiles returns ReloadingProfiles with the
+// ProfileSelector of load.
+func NewReloadingProfiles(load func() (ProfileSelector, error)) (*ReloadingProfiles, error) {
+	profiles, err := load()
+	if err != nil {
+		return nil, err
+	}
+	return &ReloadingProfiles{load: load, profiles: profiles}, nil
+}
+
+// Reload replaces the profiles with new ones of the load function,
+// unless it fails.
+func (p *ReloadingProfiles) Reload() error {
+	profiles, err := p.load()
+	if err != nil {
+		return err
+	}
+	p.mtx.Lock()
+	p.profiles = profiles
+	p.mtx.Unlock()
+	return nil
+}
+
+// SelectProfile selects the profile of req with the current profiles.
+func (p *ReloadingProfiles) SelectProfile(req *ProfileRequest) (*Profile, error) {
+	p.mtx.RLock()
+	profiles := p.profiles
+	p.mtx.RUnlock()
+	return profiles.SelectProfile(req)
+}
+
+// ReloadingVerifier is a CSRVerifier delegating to the one returned
+// by a load function, which Reload calls again, for example to read
+// a static challenge password from a file.
+type ReloadingVerifier struct {
+	load func() (CSRVerifier, error)
+
+	mtx      sync.RWMutex
+	verifier CSRVerifier
+}
+
+// NewReloadingVerifier returns a ReloadingVerifier with the
+// CSRVerifier of load.
+func NewReloadingVerifier(load func() (CSRVerifier, error)) (*ReloadingVerifier, error) {
+	verifier, err := load()
+	if err != nil {
+		return nil, err
+	}
+	return &ReloadingVerifier{load: load, verifier: verifier}, nil
+}
+
+// Reload replaces the verifier with a new one of the load function,
+// unless it fails.
+func (v *ReloadingVerifier) Reload() error {
+	verifier, err := v.load()
+	if err != nil {
+		return err
+	}
+	v.mtx.Lock()
+	v.verifier = verifier
+	v.mtx.Unlock()
+	return nil
+}
+
+// VerifyCSR verifies csr with the current verifier.
+func (v *ReloadingVerifier) VerifyCSR(ctx context.Context, csr *x509.CertificateRequest, challenge string) (string, error) {
+	v.mtx.RLock()
+	verifier := v.verifier
+	v.mtx.RUnlock()
+	return verifier.VerifyCSR(ctx, csr, challenge)
+}
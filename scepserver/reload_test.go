@@ -0,0 +1,150 @@
+package scepserver
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// cnPolicy allows one common name from one requester.
+type cnPolicy struct {
+	cn, requester string
+	max           time.Duration
+}
+
+func (p cnPolicy) Check(csr *x509.CertificateRequest) error {
+	if csr.Subject.CommonName != p.cn {
+		return fmt.Errorf("common name %s is not allowed", csr.Subject.CommonName)
+	}
+	return nil
+}
+
+func (p cnPolicy) CheckRequester(requester string, csr *x509.CertificateRequest) error {
+	if requester != p.requester {
+		return fmt.Errorf("requester %s is not allowed", requester)
+	}
+	return p.Check(csr)
+}
+
+func (p cnPolicy) MaxCertificateValidity() time.Duration { return p.max }
+
+func TestReloadingPolicy(t *testing.T) {
+	next := cnPolicy{cn: "old", requester: "192.0.2.1", max: time.Hour}
+	var loadErr error
+	p, err := NewReloadingPolicy(func() (Policy, error) { return next, loadErr })
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr := func(cn string) *x509.CertificateRequest {
+		return &x509.CertificateRequest{Subject: pkix.Name{CommonName: cn}}
+	}
+	if err := p.CheckRequester("192.0.2.1", csr("old")); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.CheckRequester("192.0.2.2", csr("old")); err == nil {
+		t.Error("expected the requester to be checked")
+	}
+
+	next = cnPolicy{cn: "new", requester: "192.0.2.1", max: 2 * time.Hour}
+	if err := p.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Check(csr("old")); err == nil {
+		t.Error("expected the reloaded policy to deny the old common name")
+	}
+	if err := p.Check(csr("new")); err != nil {
+		t.Errorf("expected the reloaded policy to allow the new common name, got %v", err)
+	}
+	if max := p.MaxCertificateValidity(); max != 2*time.Hour {
+		t.Errorf("expected the validity of the reloaded policy, got %s", max)
+	}
+
+	// a failed reload keeps the current policy
+	next, loadErr = cnPolicy{cn: "broken"}, errors.New("invalid policy")
+	if err := p.Reload(); err == nil {
+		t.Fatal("expected the reload to fail")
+	}
+	if err := p.Check(csr("new")); err != nil {
+		t.Errorf("expected the current policy to be kept, got %v", err)
+	}
+}
+
+// fixedProfile selects its profile for all requests.
+type fixedProfile struct{ profile *Profile }
+
+func (p fixedProfile) SelectProfile(*ProfileRequest) (*Profile, error) { return p.profile, nil }
+
+func TestReloadingProfiles(t *testing.T) {
+	name := "wifi"
+	p, err := NewReloadingProfiles(func() (ProfileSelector, error) {
+		if name == "" {
+			return nil, errors.New("no profiles")
+		}
+		return fixedProfile{&Profile{Name: name}}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name, want string
+		fails      bool
+	}{
+		{"vpn", "vpn", false},
+		{"", "vpn", true},
+	} {
+		name = tt.name
+		if err := p.Reload(); (err != nil) != tt.fails {
+			t.Fatalf("reload %q: unexpected error %v", tt.name, err)
+		}
+		profile, err := p.SelectProfile(&ProfileRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if profile.Name != tt.want {
+			t.Errorf("reload %q: expected profile %s, got %s", tt.name, tt.want, profile.Name)
+		}
+	}
+}
+
+func TestReloadingVerifier(t *testing.T) {
+	pw := "old"
+	v, err := NewReloadingVerifier(func() (CSRVerifier, error) {
+		if pw == "" {
+			return nil, errors.New("no challenge password")
+		}
+		return StaticChallenge(pw), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	verify := func(challenge string) string {
+		t.Helper()
+		reason, err := v.VerifyCSR(ctx, &x509.CertificateRequest{}, challenge)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return reason
+	}
+	if reason := verify("old"); reason != "" {
+		t.Errorf("expected the old password to be allowed, got %q", reason)
+	}
+	pw = "new"
+	if err := v.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if verify("old") == "" || verify("new") != "" {
+		t.Error("expected only the reloaded password to be allowed")
+	}
+	pw = ""
+	if err := v.Reload(); err == nil {
+		t.Fatal("expected the reload to fail")
+	}
+	if reason := verify("new"); reason != "" {
+		t.Errorf("expected the current password to be kept, got %q", reason)
+	}
+}
@@ -0,0 +1,93 @@
+package scepserver
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// RenewalPolicy restricts renewal requests, which are signed with
+// a currently valid certificate issued by the CA.
+type RenewalPolicy struct {
+	// Window is how long before the expiry of the signing certificate
+	// renewals are allowed. Zero allows them at any time.
+	Window time.Duration
+
+	// SameIdentity requires the CSR of a renewal to request the subject
+	// and subject alternative names of the signing certificate.
+	SameIdentity bool
+}
+
+// WithRenewalPolicy rejects renewal requests violating policy with
+// FAILURE, badRequest and a failInfoText explaining the violation, even
+// if they carry a valid challenge password.
+func WithRenewalPolicy(policy RenewalPolicy) ServiceOption {
+	return func(s *service) {
+		s.renewal = policy
+	}
+}
+
+// check returns an error if the renewal of crt with csr at now
+// violates p.
+func (p RenewalPolicy) check(crt *x509.Certificate, csr *x509.CertificateRequest, now time.Time) error {
+	if p.Window > 0 {
+		if from := crt.NotAfter.Add(-p.Window); now.Before(from) {
+			return fmt.Errorf("renewal too early, certificate %s can be renewed from %s",
+				crt.SerialNumber.Text(16), from.UTC().Format(time.RFC3339))
+		}
+	}
+	if p.SameIdentity {
+		return sameIdentity(crt, csr)
+	}
+	return nil
+}
+
+// sameIdentity returns an error if csr requests another subject or
+// other subject alternative names than crt holds, ignoring their order.
+func sameIdentity(crt *x509.Certificate, csr *x509.CertificateRequest) error {
+	if got, want := csr.Subject.String(), crt.Subject.String(); got != want {
+		return fmt.Errorf("renewal subject %q does not match %q", got, want)
+	}
+	if !sameStrings(csr.DNSNames, crt.DNSNames) ||
+		!sameStrings(csr.EmailAddresses, crt.EmailAddresses) ||
+		!sameStrings(ipStrings(csr.IPAddresses), ipStrings(crt.IPAddresses)) ||
+		!sameStrings(uriStrings(csr.URIs), uriStrings(crt.URIs)) {
+		return fmt.Errorf("renewal subject alternative names do not match those of certificate %s", crt.SerialNumber.Text(16))
+	}
+	return nil
+}
+
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]string(nil), a...)
+	b = append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func ipStrings(ips []net.IP) []string {
+	s := make([]string, len(ips))
+	for i, ip := range ips {
+		s[i] = ip.String()
+	}
+	return s
+}
+
+func uriStrings(uris []*url.URL) []string {
+	s := make([]string, len(uris))
+	for i, uri := range uris {
+		s[i] = uri.String()
+	}
+	return s
+}
@@ -0,0 +1,50 @@
+package scepserver
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRenewalPolicy(t *testing.T) {
+	now := time.Now()
+	crt := &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		Subject:      pkix.Name{CommonName: "device"},
+		DNSNames:     []string{"a.example.com", "b.example.com"},
+		IPAddresses:  []net.IP{net.ParseIP("192.0.2.1")},
+		NotAfter:     now.Add(time.Hour),
+	}
+	csr := func(cn string, dnsNames ...string) *x509.CertificateRequest {
+		return &x509.CertificateRequest{
+			Subject:     pkix.Name{CommonName: cn},
+			DNSNames:    dnsNames,
+			IPAddresses: []net.IP{net.ParseIP("192.0.2.1")},
+		}
+	}
+	tests := []struct {
+		name    string
+		policy  RenewalPolicy
+		csr     *x509.CertificateRequest
+		wantErr bool
+	}{
+		{"no policy", RenewalPolicy{}, csr("other"), false},
+		{"in window", RenewalPolicy{Window: 2 * time.Hour}, csr("device"), false},
+		{"too early", RenewalPolicy{Window: 30 * time.Minute}, csr("device"), true},
+		{"same identity", RenewalPolicy{SameIdentity: true}, csr("device", "b.example.com", "a.example.com"), false},
+		{"other subject", RenewalPolicy{SameIdentity: true}, csr("other", "a.example.com", "b.example.com"), true},
+		{"other SANs", RenewalPolicy{SameIdentity: true}, csr("device", "a.example.com", "c.example.com"), true},
+		{"missing SAN", RenewalPolicy{SameIdentity: true}, csr("device", "a.example.com"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.check(crt, tt.csr, now)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("unexpected error %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,223 @@
+package scepserver
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"scepclient/clock"
+)
+
+// RetryPolicy configures RetryMiddleware.
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts per request,
+	// including the first one.
+	MaxAttempts int
+
+	// BaseDelay is the delay before the first retry. It doubles
+	// with every attempt, up to MaxDelay, and is randomized by jitter.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+
+	// RetryPKIOperation enables retries of PKIOperation requests,
+	// including those answered during maintenance. They are not retried
+	// by default, because a request which reached the server may
+	// already have started a transaction.
+	RetryPKIOperation bool
+
+	// MaxMaintenanceWait is the total time to wait for a server in
+	// maintenance, which responds with 503 and a Retry-After header.
+	// These responses are retried after exactly the requested delay,
+	// regardless of MaxDelay, and don't count as attempts until the
+	// wait would exceed MaxMaintenanceWait. Zero treats them like any
+	// other transient failure.
+	MaxMaintenanceWait time.Duration
+
+	// Clock is used to wait between attempts.
+	// The system clock is used if it is nil.
+	Clock clock.Clock
+}
+
+// DefaultRetryPolicy retries transient failures up to three times,
+// except for PKIOperation, and waits up to 30 minutes for a server
+// in maintenance.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:        4,
+	BaseDelay:          500 * time.Millisecond,
+	MaxDelay:           30 * time.Second,
+	MaxMaintenanceWait: 30 * time.Minute,
+}
+
+// RetryMiddleware retries requests which failed with a transient error,
+// using capped exponential backoff with jitter. A Retry-After header sent
+// by the server overrides the computed delay, capped at MaxDelay.
+func RetryMiddleware(policy RetryPolicy) Middleware {
+	return func(next Transport) Transport {
+		return &retryTransport{next: next, policy: policy}
+	}
+}
+
+type retryTransport struct {
+	next   Transport
+	policy RetryPolicy
+}
+
+func (t *retryTransport) SendGet(ctx context.Context, req SCEPRequest) (SCEPResponse, error) {
+	var resp SCEPResponse
+	err := t.retry(ctx, req, func() (err error) {
+		resp, err = t.next.SendGet(ctx, req)
+		return err
+	})
+	return resp, err
+}
+
+func (t *retryTransport) SendPost(ctx context.Context, req SCEPRequest) (SCEPResponse, error) {
+	var resp SCEPResponse
+	err := t.retry(ctx, req, func() (err error) {
+		resp, err = t.next.SendPost(ctx, req)
+		return err
+	})
+	return resp, err
+}
+
+func (t *retryTransport) StreamGet(ctx context.Context, req SCEPRequest) (io.ReadCloser, SCEPResponse, error) {
+	var (
+		body io.ReadCloser
+		resp SCEPResponse
+	)
+	err := t.retry(ctx, req, func() (err error) {
+		body, resp, err = StreamGet(ctx, t.next, req)
+		return err
+	})
+	return body, resp, err
+}
+
+func (t *retryTransport) retry(ctx context.Context, req SCEPRequest, send func() error) error {
+	attempts := t.policy.MaxAttempts
+	replay := req.Operation != pkiOperation || t.policy.RetryPKIOperation
+	if !replay {
+		attempts = 1
+	}
+	var (
+		err        error
+		maintained time.Duration
+	)
+	for attempt := 0; ; attempt++ {
+		err = send()
+		if err == nil {
+			return nil
+		}
+		if d, ok := t.policy.MaintenanceWait(err, maintained); ok && replay {
+			// a server in maintenance is not failing: wait as requested
+			// without using up an attempt
+			maintained += d
+			attempt--
+			if !t.sleep(ctx, d) {
+				return err
+			}
+			continue
+		}
+		if attempt+1 >= attempts || !Retryable(err) {
+			return err
+		}
+		if !t.sleep(ctx, t.policy.delay(attempt, err)) {
+			return err
+		}
+	}
+}
+
+// sleep waits for d, returning false if ctx is done first.
+func (t *retryTransport) sleep(ctx context.Context, d time.Duration) bool {
+	return clock.Or(t.policy.Clock).Sleep(ctx, d) == nil
+}
+
+// MaintenanceWait returns the delay before retrying a request which
+// failed with err, a 503 response with a Retry-After header, once the
+// maintenance of the server was waited for already. It returns false
+// if err is no such response, or if waiting would exceed
+// MaxMaintenanceWait.
+func (p RetryPolicy) MaintenanceWait(err error, waited time.Duration) (time.Duration, bool) {
+	d, ok := MaintenanceDelay(err)
+	if !ok || d <= 0 || waited+d > p.MaxMaintenanceWait {
+		return 0, false
+	}
+	return d, true
+}
+
+// delay returns the backoff before retrying after the given attempt.
+func (p RetryPolicy) delay(attempt int, err error) time.Duration {
+	if d, ok := RetryAfter(err); ok {
+		if p.MaxDelay > 0 && d > p.MaxDelay {
+			return p.MaxDelay
+		}
+		return d
+	}
+	d := p.BaseDelay << uint(attempt)
+	if d <= 0 || (p.MaxDelay > 0 && d > p.MaxDelay) {
+		d = p.MaxDelay
+	}
+	// jitter between half and the full delay
+	if half := int64(d / 2); half > 0 {
+		d = time.Duration(half + rand.Int63n(half))
+	}
+	return d
+}
+
+// Retryable reports whether err is a transient failure worth retrying:
+// a refused connection, a timeout, or an HTTP 429, 502, 503 or 504 status.
+func Retryable(err error) bool {
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		switch httpErr.StatusCode {
+		case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// MaintenanceDelay reports whether err is a 503 response with a
+// Retry-After header, which servers send during maintenance windows,
+// and returns the requested delay.
+func MaintenanceDelay(err error) (time.Duration, bool) {
+	var httpErr *HTTPError
+	if !errors.As(err, &httpErr) || httpErr.StatusCode != http.StatusServiceUnavailable {
+		return 0, false
+	}
+	return RetryAfter(err)
+}
+
+// RetryAfter returns the delay requested by the Retry-After header
+// of an HTTPError, given either in seconds or as an HTTP date.
+func RetryAfter(err error) (time.Duration, bool) {
+	var httpErr *HTTPError
+	if !errors.As(err, &httpErr) || httpErr.Header == nil {
+		return 0, false
+	}
+	value := httpErr.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		d := time.Until(date)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return 0, false
+}
@@ -0,0 +1,158 @@
+package scepserver
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"scepclient/clock"
+)
+
+// countingTransport fails the first failures requests with err.
+type countingTransport struct {
+	failures int
+	err      error
+	calls    int
+}
+
+func (t *countingTransport) SendGet(ctx context.Context, req SCEPRequest) (SCEPResponse, error) {
+	t.calls++
+	if t.calls <= t.failures {
+		return SCEPResponse{}, t.err
+	}
+	return SCEPResponse{Data: []byte("ok")}, nil
+}
+
+func (t *countingTransport) SendPost(ctx context.Context, req SCEPRequest) (SCEPResponse, error) {
+	return t.SendGet(ctx, req)
+}
+
+func TestRetryMiddleware(t *testing.T) {
+	unavailable := &HTTPError{
+		StatusCode: http.StatusServiceUnavailable,
+		Header:     http.Header{"Retry-After": []string{"0"}},
+	}
+	policy := RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond}
+
+	tests := []struct {
+		name      string
+		err       error
+		failures  int
+		operation string
+		wantCalls int
+		wantErr   bool
+	}{
+		{"transient then success", unavailable, 2, getCACert, 3, false},
+		{"attempts exhausted", unavailable, 5, getCACert, 3, true},
+		{"permanent error", &HTTPError{StatusCode: http.StatusForbidden}, 5, getCACert, 1, true},
+		{"rate limited", &HTTPError{StatusCode: http.StatusTooManyRequests}, 1, getCACert, 2, false},
+		{"PKIOperation not retried", unavailable, 1, pkiOperation, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := &countingTransport{failures: tt.failures, err: tt.err}
+			transport := RetryMiddleware(policy)(next)
+			_, err := transport.SendGet(context.Background(), SCEPRequest{Operation: tt.operation})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("unexpected error %v", err)
+			}
+			if next.calls != tt.wantCalls {
+				t.Errorf("expected %d calls, got %d", tt.wantCalls, next.calls)
+			}
+		})
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	err := &HTTPError{
+		StatusCode: http.StatusServiceUnavailable,
+		Header:     http.Header{"Retry-After": []string{"120"}},
+	}
+	d, ok := RetryAfter(err)
+	if !ok || d != 2*time.Minute {
+		t.Errorf("expected 2m, got %s (%v)", d, ok)
+	}
+	if d := DefaultRetryPolicy.delay(0, err); d != DefaultRetryPolicy.MaxDelay {
+		t.Errorf("expected Retry-After to be capped at %s, got %s", DefaultRetryPolicy.MaxDelay, d)
+	}
+}
+
+func TestRetryMiddlewareMaintenance(t *testing.T) {
+	maintenance := &HTTPError{
+		StatusCode: http.StatusServiceUnavailable,
+		Header:     http.Header{"Retry-After": []string{"1"}},
+	}
+	clk := clock.NewAutoFake(time.Now())
+	policy := RetryPolicy{MaxAttempts: 1, MaxMaintenanceWait: 2 * time.Second, Clock: clk}
+
+	next := &countingTransport{failures: 2, err: maintenance}
+	transport := RetryMiddleware(policy)(next)
+	start := clk.Now()
+	if _, err := transport.SendGet(context.Background(), SCEPRequest{Operation: getCACert}); err != nil {
+		t.Fatalf("expected maintenance to be waited out, got %v", err)
+	}
+	if elapsed := clk.Now().Sub(start); elapsed < 2*time.Second {
+		t.Errorf("expected to wait the requested 2s, waited %s", elapsed)
+	}
+
+	// PKIOperation requests are only replayed with RetryPKIOperation
+	next = &countingTransport{failures: 2, err: maintenance}
+	transport = RetryMiddleware(policy)(next)
+	if _, err := transport.SendGet(context.Background(), SCEPRequest{Operation: pkiOperation}); err == nil || next.calls != 1 {
+		t.Errorf("expected the PKIOperation not to be replayed, got %d calls and %v", next.calls, err)
+	}
+	policy.RetryPKIOperation = true
+	next = &countingTransport{failures: 2, err: maintenance}
+	transport = RetryMiddleware(policy)(next)
+	if _, err := transport.SendGet(context.Background(), SCEPRequest{Operation: pkiOperation}); err != nil || next.calls != 3 {
+		t.Errorf("expected the PKIOperation to wait out maintenance, got %d calls and %v", next.calls, err)
+	}
+	policy.RetryPKIOperation = false
+
+	policy.MaxMaintenanceWait = time.Second
+	next = &countingTransport{failures: 3, err: maintenance}
+	transport = RetryMiddleware(policy)(next)
+	if _, err := transport.SendGet(context.Background(), SCEPRequest{Operation: getCACert}); err == nil {
+		t.Error("expected an error after exceeding MaxMaintenanceWait")
+	}
+	if next.calls != 2 {
+		t.Errorf("expected 2 calls, got %d", next.calls)
+	}
+}
+
+func TestRetryPolicyMaintenanceWait(t *testing.T) {
+	maintenance := &HTTPError{
+		StatusCode: http.StatusServiceUnavailable,
+		Header:     http.Header{"Retry-After": []string{"60"}},
+	}
+	policy := RetryPolicy{MaxMaintenanceWait: 2 * time.Minute}
+	if d, ok := policy.MaintenanceWait(maintenance, time.Minute); !ok || d != time.Minute {
+		t.Errorf("expected to wait 1m, got %s (%v)", d, ok)
+	}
+	if _, ok := policy.MaintenanceWait(maintenance, 90*time.Second); ok {
+		t.Error("expected the wait to be capped at MaxMaintenanceWait")
+	}
+	if _, ok := policy.MaintenanceWait(&HTTPError{StatusCode: http.StatusServiceUnavailable}, 0); ok {
+		t.Error("expected a 503 without Retry-After not to be waited for")
+	}
+
+	// the wait ends with ctx, with the clock stopped
+	clk := clock.NewFake(time.Now())
+	policy.Clock = clk
+	ctx, cancel := context.WithCancel(context.Background())
+	next := &countingTransport{failures: 2, err: maintenance}
+	done := make(chan error, 1)
+	go func() {
+		_, err := RetryMiddleware(policy)(next).SendGet(ctx, SCEPRequest{Operation: getCACert})
+		done <- err
+	}()
+	for clk.Sleepers() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-done; !errors.Is(err, maintenance) || next.calls != 1 {
+		t.Errorf("expected the maintenance error after 1 call, got %d calls and %v", next.calls, err)
+	}
+}
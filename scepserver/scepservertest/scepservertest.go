@@ -0,0 +1,298 @@
+// Package scepservertest provides an in-memory SCEP CA for integration
+// tests. Its Service implements scepserver.Service with an ephemeral CA,
+// scripted pkiStatus sequences, delays and malformed responses, and
+// NewServer serves it over HTTP, so that the complete client workflow
+// can be tested without a live CA.
+package scepservertest
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"scepclient/clock"
+	"scepclient/scep"
+	"scepclient/scepserver"
+)
+
+var _ scepserver.Service = (*Service)(nil)
+
+// Service is a SCEP CA backed by an ephemeral CA certificate and key.
+// PKIOperation requests are answered with the scripted pkiStatus
+// sequence, and issued certificates are signed by the CA.
+// It is safe for concurrent use.
+type Service struct {
+	caCert   *x509.Certificate
+	caKey    *rsa.PrivateKey
+	caps     []string
+	validity time.Duration
+	clock    clock.Clock
+	delays   map[string]time.Duration
+	manglers map[string]Mangler
+
+	mtx      sync.Mutex
+	statuses []scep.PKIStatus
+	failInfo scep.FailInfo
+	serial   int64
+	requests []*scep.PKIMessage
+}
+
+// Option configures a Service.
+type Option func(*Service)
+
+// WithCA uses the provided CA certificate and key instead of generating them.
+func WithCA(cert *x509.Certificate, key *rsa.PrivateKey) Option {
+	return func(s *Service) {
+		s.caCert = cert
+		s.caKey = key
+	}
+}
+
+// WithCapabilities sets the capabilities returned by GetCACaps.
+func WithCapabilities(caps ...string) Option {
+	return func(s *Service) {
+		s.caps = caps
+	}
+}
+
+// WithStatuses scripts the pkiStatus of the responses to successive
+// PKIOperation requests. Once the script is exhausted, every request
+// succeeds.
+func WithStatuses(statuses ...scep.PKIStatus) Option {
+	return func(s *Service) {
+		s.statuses = statuses
+	}
+}
+
+// WithFailInfo sets the failInfo returned with a FAILURE pkiStatus.
+// BadRequest is used by default.
+func WithFailInfo(info scep.FailInfo) Option {
+	return func(s *Service) {
+		s.failInfo = info
+	}
+}
+
+// WithValidity sets the validity period of issued certificates,
+// one year by default.
+func WithValidity(d time.Duration) Option {
+	return func(s *Service) {
+		s.validity = d
+	}
+}
+
+// WithClock sets the clock used for delays and the validity
+// of issued certificates.
+func WithClock(c clock.Clock) Option {
+	return func(s *Service) {
+		s.clock = c
+	}
+}
+
+// WithDelay delays the responses to operation, for example
+// "PKIOperation", by d, to simulate slow servers.
+func WithDelay(operation string, d time.Duration) Option {
+	return func(s *Service) {
+		s.delays[operation] = d
+	}
+}
+
+// Mangler modifies a response before it is sent,
+// to simulate noncompliant or broken servers.
+type Mangler func(data []byte) []byte
+
+// Manglers for common kinds of malformed responses.
+var (
+	// Truncate cuts the response in half.
+	Truncate Mangler = func(data []byte) []byte {
+		return data[:len(data)/2]
+	}
+
+	// AppendTrailingData appends a line break, as some servers do.
+	AppendTrailingData Mangler = func(data []byte) []byte {
+		return append(data, "\r\n"...)
+	}
+
+	// Garbage replaces the response with random bytes of the same length.
+	Garbage Mangler = func(data []byte) []byte {
+		garbage := make([]byte, len(data))
+		rand.Read(garbage)
+		return garbage
+	}
+)
+
+// WithMangler applies m to the responses to operation.
+func WithMangler(operation string, m Mangler) Option {
+	return func(s *Service) {
+		s.manglers[operation] = m
+	}
+}
+
+// New creates a Service. Unless WithCA is used, a new
+// CA certificate and key are generated.
+func New(opts ...Option) (*Service, error) {
+	s := &Service{
+		caps:     []string{"POSTPKIOperation", "SHA-256", "AES"},
+		failInfo: scep.BadRequest,
+		validity: 365 * 24 * time.Hour,
+		clock:    clock.System,
+		delays:   make(map[string]time.Duration),
+		manglers: make(map[string]Mangler),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.caCert == nil {
+		cert, key, err := NewCA()
+		if err != nil {
+			return nil, err
+		}
+		s.caCert, s.caKey = cert, key
+	}
+	return s, nil
+}
+
+// NewCA generates a self-signed CA certificate and key,
+// suitable for signing CertRep messages.
+func NewCA() (*x509.Certificate, *rsa.PrivateKey, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{
+			CommonName:   "scepservertest CA",
+			Organization: []string{"scepservertest"},
+		},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+// CACert returns the certificate of the CA.
+func (s *Service) CACert() *x509.Certificate {
+	return s.caCert
+}
+
+// Requests returns the decrypted PKIOperation requests
+// received so far, in order.
+func (s *Service) Requests() []*scep.PKIMessage {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return append([]*scep.PKIMessage(nil), s.requests...)
+}
+
+// respond applies the delay and mangler configured for operation.
+func (s *Service) respond(ctx context.Context, operation string, data []byte) ([]byte, error) {
+	if d := s.delays[operation]; d > 0 {
+		if err := s.clock.Sleep(ctx, d); err != nil {
+			return nil, err
+		}
+	}
+	if m := s.manglers[operation]; m != nil {
+		data = m(append([]byte(nil), data...))
+	}
+	return data, nil
+}
+
+// GetCACaps returns the configured capabilities.
+func (s *Service) GetCACaps(ctx context.Context) ([]byte, error) {
+	return s.respond(ctx, "GetCACaps", []byte(strings.Join(s.caps, "\n")))
+}
+
+// GetCACert returns the DER encoded certificate of the CA.
+func (s *Service) GetCACert(ctx context.Context) ([]byte, int, error) {
+	data, err := s.respond(ctx, "GetCACert", s.caCert.Raw)
+	return data, 1, err
+}
+
+// GetNextCACert is not supported by the CA.
+func (s *Service) GetNextCACert(ctx context.Context) ([]byte, error) {
+	return nil, scepserver.ErrNotSupported
+}
+
+// PKIOperation decrypts the request and answers it with the next
+// scripted pkiStatus.
+func (s *Service) PKIOperation(ctx context.Context, data []byte) ([]byte, error) {
+	msg, err := scep.ParsePKIMessage(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := msg.DecryptPKIEnvelope(s.caCert, s.caKey); err != nil {
+		return nil, err
+	}
+
+	s.mtx.Lock()
+	s.requests = append(s.requests, msg)
+	status := scep.PKIStatus(scep.SUCCESS)
+	if len(s.statuses) > 0 {
+		status = s.statuses[0]
+		s.statuses = s.statuses[1:]
+	}
+	s.serial++
+	serial := s.serial
+	failInfo := s.failInfo
+	s.mtx.Unlock()
+
+	var resp *scep.PKIMessage
+	switch status {
+	case scep.FAILURE:
+		resp, err = msg.Fail(s.caCert, s.caKey, failInfo)
+	case scep.PENDING:
+		resp, err = msg.Pending(s.caCert, s.caKey)
+	default:
+		now := s.clock.Now()
+		csr := msg.CSRReqMessage.CSR
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(serial + 1),
+			Subject:      csr.Subject,
+			NotBefore:    now.Add(-time.Minute),
+			NotAfter:     now.Add(s.validity),
+			KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}
+		resp, err = msg.SignCSR(s.caCert, s.caKey, tmpl)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.respond(ctx, "PKIOperation", resp.Raw)
+}
+
+// Server is a Service served over HTTP.
+type Server struct {
+	*httptest.Server
+	Service *Service
+}
+
+// NewServer starts an HTTP server for a new Service.
+// The caller must close it when finished.
+func NewServer(opts ...Option) (*Server, error) {
+	svc, err := New(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{
+		Server:  httptest.NewServer(scepserver.NewHTTPHandler(svc)),
+		Service: svc,
+	}, nil
+}
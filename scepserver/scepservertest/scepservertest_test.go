@@ -0,0 +1,197 @@
+package scepservertest_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net/http"
+	"testing"
+	"time"
+
+	scepclient "scepclient/client"
+	"scepclient/clock"
+	"scepclient/scep"
+	"scepclient/scepserver"
+	"scepclient/scepserver/scepservertest"
+)
+
+func TestServerEnrollment(t *testing.T) {
+	tests := []struct {
+		name string
+		caps []string
+	}{
+		{"POST", []string{"POSTPKIOperation", "SHA-256"}},
+		{"GET", []string{"SHA-256"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, err := scepservertest.NewServer(
+				scepservertest.WithCapabilities(tt.caps...),
+				scepservertest.WithStatuses(scep.PENDING, scep.SUCCESS),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer server.Close()
+			client, err := scepclient.New(server.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx := context.Background()
+
+			caCertDER, _, err := client.GetCACert(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			caCert, err := x509.ParseCertificate(caCertDER)
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg, key, signer := newRequest(t, caCert)
+
+			want := []scep.PKIStatus{scep.PENDING, scep.SUCCESS}
+			var resp *scep.PKIMessage
+			for _, status := range want {
+				respBytes, err := client.PKIOperation(ctx, msg.Raw)
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp, err = scep.ParsePKIMessage(respBytes)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if resp.PKIStatus != status {
+					t.Fatalf("expected pkiStatus %s, got %s", status, resp.PKIStatus)
+				}
+			}
+			if err := resp.DecryptPKIEnvelope(signer, key); err != nil {
+				t.Fatal(err)
+			}
+			if err := resp.CertRepMessage.Certificate.CheckSignatureFrom(caCert); err != nil {
+				t.Error(err)
+			}
+			if n := len(server.Service.Requests()); n != len(want) {
+				t.Errorf("expected %d requests, got %d", len(want), n)
+			}
+		})
+	}
+}
+
+func TestServerMalformedResponses(t *testing.T) {
+	server, err := scepservertest.NewServer(
+		scepservertest.WithMangler("GetCACert", scepservertest.Truncate),
+		scepservertest.WithMangler("PKIOperation", scepservertest.AppendTrailingData),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client, err := scepclient.New(server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	caCertDER, _, err := client.GetCACert(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := x509.ParseCertificate(caCertDER); err == nil {
+		t.Error("expected truncated CA certificate not to parse")
+	}
+
+	// trailing data after a PKIMessage is tolerated by the client
+	msg, _, _ := newRequest(t, server.Service.CACert())
+	respBytes, err := client.PKIOperation(ctx, msg.Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := scep.ParsePKIMessage(respBytes); err != nil {
+		t.Errorf("expected trailing data to be trimmed, got %v", err)
+	}
+}
+
+func TestServerDelay(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	server, err := scepservertest.NewServer(
+		scepservertest.WithClock(clk),
+		scepservertest.WithDelay("GetCACaps", time.Hour),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client, err := scepclient.New(server.URL, nil, scepclient.WithTimeouts(50*time.Millisecond, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.GetCACaps(context.Background()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the delayed request to time out, got %v", err)
+	}
+	if _, _, err := client.GetCACert(context.Background()); err != nil {
+		t.Errorf("expected GetCACert not to be delayed, got %v", err)
+	}
+}
+
+func TestServerGetNextCACert(t *testing.T) {
+	server, err := scepservertest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client, err := scepclient.New(server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.GetNextCACert(context.Background())
+	var httpErr *scepserver.HTTPError
+	if !errors.As(err, &httpErr) || httpErr.StatusCode != http.StatusNotImplemented {
+		t.Errorf("expected HTTP 501, got %v", err)
+	}
+}
+
+// newRequest creates a PKCSReq message for a new key, encrypted to caCert.
+func newRequest(t *testing.T, caCert *x509.Certificate) (*scep.PKIMessage, *rsa.PrivateKey, *x509.Certificate) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: "scepservertest"},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "SCEP SIGNER"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	signerDER, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := x509.ParseCertificate(signerDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := scep.NewCSRRequest(csr, &scep.PKIMessage{
+		MessageType: scep.PKCSReq,
+		Recipients:  []*x509.Certificate{caCert},
+		SignerKey:   key,
+		SignerCert:  signer,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg, key, signer
+}
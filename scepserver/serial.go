@@ -0,0 +1,70 @@
+package scepserver
+
+import (
+	"crypto/rand"
+	"errors"
+	"math/big"
+)
+
+// SerialSource allocates the serial numbers of issued certificates.
+// Depots are sequential serial sources. Implementations must be safe
+// for concurrent use.
+type SerialSource interface {
+	Serial() (*big.Int, error)
+}
+
+// WithSerials allocates the serial numbers of certificates issued with
+// the CA key from serials instead of the depot.
+func WithSerials(serials SerialSource) ServiceOption {
+	return func(s *service) {
+		s.serials = serials
+	}
+}
+
+// maxRandomSerial bounds random serial numbers to 159 bits, which
+// keeps them positive and within the 20 octets allowed by RFC 5280.
+var maxRandomSerial = new(big.Int).Lsh(big.NewInt(1), 159)
+
+// RandomSerials returns a SerialSource of random 159-bit serial
+// numbers, as required by CA policies demanding unpredictable serials,
+// and unique without coordination between instances.
+func RandomSerials() SerialSource {
+	return randomSerials{}
+}
+
+type randomSerials struct{}
+
+func (randomSerials) Serial() (*big.Int, error) {
+	for {
+		serial, err := rand.Int(rand.Reader, maxRandomSerial)
+		if err != nil {
+			return nil, err
+		}
+		if serial.Sign() > 0 {
+			return serial, nil
+		}
+	}
+}
+
+// PrefixSerials returns a SerialSource prefixing the serial numbers of
+// next, which must be below 2^64, with the site prefix. Instances with
+// separate depots and distinct prefixes never issue the same serial.
+func PrefixSerials(prefix uint32, next SerialSource) SerialSource {
+	return &prefixSerials{prefix: new(big.Int).Lsh(big.NewInt(int64(prefix)), 64), next: next}
+}
+
+type prefixSerials struct {
+	prefix *big.Int
+	next   SerialSource
+}
+
+func (p *prefixSerials) Serial() (*big.Int, error) {
+	serial, err := p.next.Serial()
+	if err != nil {
+		return nil, err
+	}
+	if serial.Sign() < 0 || serial.BitLen() > 64 {
+		return nil, errors.New("scep: serial number exceeds the 64 bits below the site prefix")
+	}
+	return new(big.Int).Or(serial, p.prefix), nil
+}
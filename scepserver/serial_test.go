@@ -0,0 +1,56 @@
+package scepserver
+
+import (
+	"math/big"
+	"testing"
+)
+
+type counter struct{ n int64 }
+
+func (c *counter) Serial() (*big.Int, error) {
+	c.n++
+	return big.NewInt(c.n), nil
+}
+
+func TestRandomSerials(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		serial, err := RandomSerials().Serial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if serial.Sign() <= 0 || serial.BitLen() > 159 {
+			t.Fatalf("serial %x is not a positive 159-bit number", serial)
+		}
+		if seen[serial.String()] {
+			t.Fatalf("serial %x allocated twice", serial)
+		}
+		seen[serial.String()] = true
+	}
+}
+
+func TestPrefixSerials(t *testing.T) {
+	site1 := PrefixSerials(1, &counter{})
+	site2 := PrefixSerials(2, &counter{})
+	for _, tt := range []struct {
+		serials SerialSource
+		want    string
+	}{
+		{site1, "10000000000000001"},
+		{site1, "10000000000000002"},
+		{site2, "20000000000000001"},
+	} {
+		serial, err := tt.serials.Serial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := serial.Text(16); got != tt.want {
+			t.Errorf("expected serial %s, got %s", tt.want, got)
+		}
+	}
+
+	overflow := PrefixSerials(1, &counter{n: -2})
+	if _, err := overflow.Serial(); err == nil {
+		t.Error("expected an error for a negative serial number")
+	}
+}
@@ -0,0 +1,778 @@
+package scepserver
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/subtle"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"scepclient/clock"
+	"scepclient/scep"
+)
+
+// Depot stores the CA credentials and the certificates it issues.
+// Implementations must be safe for concurrent use.
+type Depot interface {
+	// CA returns the CA certificate chain, starting with the signing
+	// certificate, and its private key, decrypted with pass if needed.
+	CA(pass []byte) ([]*x509.Certificate, *rsa.PrivateKey, error)
+
+	// Serial returns a new serial number for the next certificate.
+	Serial() (*big.Int, error)
+
+	// Put stores an issued certificate.
+	Put(name string, crt *x509.Certificate) error
+}
+
+// ErrPending is returned by a Signer whose CA has not decided on a
+// request yet. The service answers PENDING, and clients resend the
+// request until the CA issues or rejects it.
+var ErrPending = errors.New("scep: certificate request pending")
+
+// Signer issues the certificate requested by a CSR, in place of the
+// CA key of the depot. It returns ErrPending while its CA is deciding,
+// and a *scep.FailInfoError, which the service relays to the client,
+// if the CA rejected the request. Implementations must be safe for
+// concurrent use.
+type Signer interface {
+	Sign(ctx context.Context, csr *x509.CertificateRequest) (*x509.Certificate, error)
+}
+
+// DefaultCapabilities are the capabilities announced by NewService.
+var DefaultCapabilities = []byte("Renewal\nSHA-1\nSHA-256\nAES\nDES3\nSCEPStandard\nPOSTPKIOperation")
+
+// ServiceOption configures the Service created by NewService.
+type ServiceOption func(*service)
+
+// WithCAPassword sets the password the CA key is encrypted with.
+func WithCAPassword(pass []byte) ServiceOption {
+	return func(s *service) {
+		s.caPass = pass
+	}
+}
+
+// WithChallengePassword requires requests to carry the challenge
+// password pw. Renewal requests signed with a valid certificate
+// issued by the CA don't need it.
+func WithChallengePassword(pw string) ServiceOption {
+	return func(s *service) {
+		s.challenge = pw
+	}
+}
+
+// WithChallengeStore requires requests to carry a one-time challenge
+// password issued by store, or the WithChallengePassword password if
+// both are set. Renewal requests signed with a valid certificate issued
+// by the CA don't need one.
+func WithChallengeStore(store ChallengeStore) ServiceOption {
+	return func(s *service) {
+		s.challenges = store
+	}
+}
+
+// WithSigner issues certificates with signer instead of the CA key of
+// the depot, which then only signs and decrypts SCEP messages as a
+// registration authority. Its chain should end with the CA of signer,
+// so that clients can verify the certificates they receive.
+func WithSigner(signer Signer) ServiceOption {
+	return func(s *service) {
+		s.signer = signer
+	}
+}
+
+// WithIssuer signs certificates and CRLs with key, whose certificate
+// chain is certs, instead of with the CA key of the depot. The key may
+// be held by a KMS or HSM, as it is only used through crypto.Signer.
+// The depot CA then only signs and decrypts SCEP messages as a
+// registration authority, and GetCACert serves certs after it.
+// The issuer is not replaced by a CA set with WithNextCA.
+func WithIssuer(certs []*x509.Certificate, key crypto.Signer) ServiceOption {
+	return func(s *service) {
+		s.issuer = &issuer{certs: certs, key: key}
+	}
+}
+
+// WithApprover asks approver before issuing a certificate. Its decision
+// is final, replacing the challenge check: it learns whether the
+// challenge was valid from ApprovalRequest.ChallengeValid. Clients
+// resend requests answered with Pending, or poll them with CertPoll,
+// and approver is asked again.
+func WithApprover(approver Approver) ServiceOption {
+	return func(s *service) {
+		s.approver = approver
+	}
+}
+
+// WithPolicy rejects requests violating policy with FAILURE,
+// badRequest and a failInfoText explaining the violation. It is
+// checked before asking the approver set with WithApprover. If policy
+// is a RequesterPolicy, it also restricts the requesters.
+func WithPolicy(policy Policy) ServiceOption {
+	return func(s *service) {
+		s.policy = policy
+	}
+}
+
+// WithAuditor records the outcome of every PKIOperation request with
+// auditor. If it fails to record an event, the request fails too, so
+// that no certificate is handed out without an audit record.
+func WithAuditor(auditor Auditor) ServiceOption {
+	return func(s *service) {
+		s.auditor = auditor
+	}
+}
+
+// WithNextCA configures the successor of the CA of the depot, with
+// its certificate chain and key. Until activation, GetNextCACert
+// serves the chain signed by the current CA, so that clients can
+// prepare for the rollover. From activation on, the successor signs
+// certificates and SCEP messages, and GetCACert serves its chain.
+// Certificates issued by either CA authorize renewals.
+func WithNextCA(certs []*x509.Certificate, key *rsa.PrivateKey, activation time.Time) ServiceOption {
+	return func(s *service) {
+		s.next = &authority{certs: certs, key: key}
+		s.nextActivation = activation
+	}
+}
+
+// WithCAChain appends chain to the certificates of the depot CA served
+// by GetCACert, for example the issuing CA and root of a Signer set with
+// WithSigner after the RA certificate of the depot. Certificates the
+// depot already serves are skipped. Include the root to let clients
+// bootstrap trust from the response, or leave it out to have them rely
+// on a root they already trust.
+func WithCAChain(chain []*x509.Certificate) ServiceOption {
+	return func(s *service) {
+		s.chain = chain
+	}
+}
+
+// WithCertificateValidity sets the validity period of certificates
+// issued with the CA key, one year by default.
+func WithCertificateValidity(d time.Duration) ServiceOption {
+	return func(s *service) {
+		s.validity = d
+	}
+}
+
+// WithServiceLogger logs issued and rejected requests.
+func WithServiceLogger(logger *slog.Logger) ServiceOption {
+	return func(s *service) {
+		s.logger = logger
+	}
+}
+
+// WithServiceClock sets the clock used for the validity
+// of issued certificates.
+func WithServiceClock(c clock.Clock) ServiceOption {
+	return func(s *service) {
+		s.clock = c
+	}
+}
+
+// NewService creates a SCEP CA which signs every valid request with the
+// CA credentials of depot, and stores the certificates it issues there.
+// Serve it with NewHTTPHandler.
+func NewService(depot Depot, opts ...ServiceOption) (Service, error) {
+	s := &service{
+		depot:       depot,
+		validity:    365 * 24 * time.Hour,
+		crlValidity: 24 * time.Hour,
+		clock:       clock.System,
+		logger:      slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.verifier = s.csrVerifier()
+	if s.signer == nil {
+		s.signer = s
+	}
+	if s.serials == nil {
+		s.serials = depot
+	}
+	certs, key, err := depot.CA(s.caPass)
+	if err != nil {
+		return nil, err
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("scep: depot has no CA certificate")
+	}
+	if s.issuer != nil {
+		if len(s.issuer.certs) == 0 || s.issuer.key == nil {
+			return nil, errors.New("scep: issuer needs a certificate and key")
+		}
+		pub, ok := s.issuer.key.Public().(interface{ Equal(crypto.PublicKey) bool })
+		if !ok || !pub.Equal(s.issuer.certs[0].PublicKey) {
+			return nil, errors.New("scep: issuer key does not match its certificate")
+		}
+		s.chain = append(append([]*x509.Certificate{}, s.issuer.certs...), s.chain...)
+	}
+	for _, crt := range s.chain {
+		if !containsCertificate(certs, crt) {
+			certs = append(certs, crt)
+		}
+	}
+	s.ca = &authority{certs: certs, key: key}
+	if s.next != nil && (len(s.next.certs) == 0 || s.next.key == nil) {
+		return nil, errors.New("scep: next CA needs a certificate and key")
+	}
+	return s, nil
+}
+
+// authority is the certificate chain and key of a CA.
+type authority struct {
+	certs []*x509.Certificate
+	key   *rsa.PrivateKey
+}
+
+// issuer is the certificate chain and key signing certificates and
+// CRLs, if they are not signed by the CA.
+type issuer struct {
+	certs []*x509.Certificate
+	key   crypto.Signer
+}
+
+type service struct {
+	depot        Depot
+	caPass       []byte
+	ca           *authority
+	issuer       *issuer
+	chain        []*x509.Certificate
+	challenge    string
+	challenges   ChallengeStore
+	verifiers    []CSRVerifier
+	verifier     CSRVerifier
+	signer       Signer
+	transactions TransactionLocker
+	serials      SerialSource
+	approver     Approver
+	policy       Policy
+	profiles     ProfileSelector
+	renewal      RenewalPolicy
+	auditor      Auditor
+	validity     time.Duration
+	clock        clock.Clock
+
+	crlValidity time.Duration
+	crlURL      string
+	crlMtx      sync.Mutex
+	lastCRL     int64
+	awaiting    awaiting
+	logger      *slog.Logger
+
+	next           *authority
+	nextActivation time.Time
+	rollover       sync.Once
+}
+
+func containsCertificate(certs []*x509.Certificate, crt *x509.Certificate) bool {
+	for _, c := range certs {
+		if c.Equal(crt) {
+			return true
+		}
+	}
+	return false
+}
+
+// issuing returns the certificate and key signing certificates
+// and CRLs: those of the issuer, or of the CA in use.
+func (s *service) issuing() (*x509.Certificate, crypto.Signer) {
+	if s.issuer != nil {
+		return s.issuer.certs[0], s.issuer.key
+	}
+	ca := s.authority()
+	return ca.certs[0], ca.key
+}
+
+// authority returns the CA in use, which is the next CA from
+// its activation on.
+func (s *service) authority() *authority {
+	if s.next == nil || s.clock.Now().Before(s.nextActivation) {
+		return s.ca
+	}
+	s.rollover.Do(func() {
+		s.logger.Info("switched to the next CA", "subject", s.next.certs[0].Subject.String())
+	})
+	return s.next
+}
+
+// GetCACaps returns DefaultCapabilities, and GetNextCACert
+// while a next CA awaits activation.
+func (s *service) GetCACaps(ctx context.Context) ([]byte, error) {
+	if s.next != nil && s.authority() != s.next {
+		return append(append([]byte(nil), DefaultCapabilities...), "\nGetNextCACert"...), nil
+	}
+	return DefaultCapabilities, nil
+}
+
+func (s *service) GetCACert(ctx context.Context) ([]byte, int, error) {
+	ca := s.authority()
+	if len(ca.certs) == 1 {
+		return ca.certs[0].Raw, 1, nil
+	}
+	data, err := scep.DegenerateCertificates(ca.certs)
+	return data, len(ca.certs), err
+}
+
+// GetNextCACert returns the chain of the next CA, signed by the current
+// one, until the next CA is activated.
+func (s *service) GetNextCACert(ctx context.Context) ([]byte, error) {
+	ca := s.authority()
+	if s.next == nil || ca == s.next {
+		return nil, ErrNotSupported
+	}
+	return scep.NextCACertificates(s.next.certs, ca.certs[0], ca.key)
+}
+
+func (s *service) PKIOperation(ctx context.Context, data []byte) ([]byte, error) {
+	ev := &AuditEvent{}
+	ev.Requester, _ = Requester(ctx)
+	resp, err := s.pkiOperation(ctx, data, ev)
+	if auditErr := s.audit(ctx, ev, err); auditErr != nil && err == nil {
+		return nil, auditErr
+	}
+	return resp, err
+}
+
+// audit records ev with the auditor, as failed with err if it is set,
+// unless ev has no outcome. It logs and returns recording failures.
+func (s *service) audit(ctx context.Context, ev *AuditEvent, err error) error {
+	if s.auditor == nil || (err == nil && ev.Outcome == "") {
+		return nil
+	}
+	ev.Time = s.clock.Now()
+	if err != nil {
+		ev.Outcome, ev.Reason = AuditFailed, err.Error()
+	}
+	if auditErr := s.auditor.Audit(ctx, ev); auditErr != nil {
+		s.logger.Error("failed to record audit event", "transaction_id", ev.TransactionID, "err", auditErr)
+		return fmt.Errorf("scep: audit: %w", auditErr)
+	}
+	return nil
+}
+
+// pkiOperation answers a PKIOperation request, recording its outcome
+// in ev unless it fails with an error. GetCRL requests answered with
+// the CRL have no outcome, and are not audited.
+func (s *service) pkiOperation(ctx context.Context, data []byte, ev *AuditEvent) ([]byte, error) {
+	msg, err := scep.ParsePKIMessage(data, scep.WithLogger(s.logger))
+	if err != nil {
+		return nil, err
+	}
+	ev.TransactionID = string(msg.TransactionID)
+	ev.MessageType = strings.TrimSpace(msg.MessageType.String())
+	logger := s.logger.With("transaction_id", msg.TransactionID, "message_type", msg.MessageType)
+	switch msg.MessageType {
+	case scep.PKCSReq, scep.UpdateReq, scep.RenewalReq, scep.GetCRL, scep.CertPoll:
+	default:
+		// a CertRep, the only other message type parsed, has no request
+		logger.Info("rejected request of an unsupported message type")
+		return nil, fmt.Errorf("%s message: %w", ev.MessageType, ErrNotSupported)
+	}
+	ca := s.authority()
+	if err := msg.DecryptPKIEnvelope(ca.certs[0], ca.key); err != nil {
+		return nil, err
+	}
+
+	sender, err := msg.Verify()
+	if err != nil {
+		logger.Info("rejected request with invalid signature", "err", err)
+		return s.deny(msg, ev, scep.BadMessageCheck, "invalid signature: "+err.Error())
+	}
+	ev.Signer = sender.Subject.String()
+	if msg.MessageType == scep.GetCRL {
+		return s.getCRL(ctx, msg)
+	}
+	var crt *x509.Certificate
+	if msg.MessageType == scep.CertPoll {
+		crt, err = s.poll(ctx, string(msg.TransactionID), sender, ev, logger)
+	} else {
+		crt, err = s.enroll(ctx, &enrollRequest{
+			transactionID: string(msg.TransactionID),
+			messageType:   msg.MessageType,
+			csr:           msg.CSRReqMessage.CSR,
+			challenge:     msg.CSRReqMessage.ChallengePassword,
+			signer:        sender,
+		}, ev, logger)
+	}
+	var d *denial
+	switch {
+	case errors.Is(err, ErrPending):
+		return s.pending(msg)
+	case errors.As(err, &d):
+		return s.failWithText(msg, d.info, d.text)
+	case err != nil:
+		return nil, err
+	}
+	certRep, err := msg.Success(ca.certs[0], ca.key, crt)
+	if err != nil {
+		return nil, err
+	}
+	return certRep.Raw, nil
+}
+
+// enrollRequest is a certificate request of a SCEP or EST client.
+type enrollRequest struct {
+	transactionID string
+	messageType   scep.MessageType
+	csr           *x509.CertificateRequest
+	challenge     string
+
+	// signer is the certificate the client authenticated with, which
+	// authorizes renewals if the CA issued it. It is nil for EST clients
+	// without a TLS client certificate.
+	signer *x509.Certificate
+}
+
+// denial is returned by enroll for rejected requests.
+type denial struct {
+	info scep.FailInfo
+
+	// text explains the denial to the client, if it may know.
+	text string
+
+	// unauthorized is set for requests without valid credentials.
+	unauthorized bool
+}
+
+func (d *denial) Error() string {
+	if d.text == "" {
+		return d.info.String()
+	}
+	return d.info.String() + ": " + d.text
+}
+
+// newDenial returns the denial of a request with info, recording it
+// and its reason in ev. The reason is sent to the client if text is set.
+func newDenial(ev *AuditEvent, info scep.FailInfo, reason string, text bool) *denial {
+	ev.Outcome, ev.FailInfo, ev.Reason = AuditDenied, info.String(), reason
+	d := &denial{info: info}
+	if text {
+		d.text = reason
+	}
+	return d
+}
+
+// enroll checks req against the policy, profiles, challenge and approver,
+// issues its certificate and stores it in the depot. Rejected requests
+// fail with a *denial, and undecided ones with ErrPending. The outcome
+// is recorded in ev.
+func (s *service) enroll(ctx context.Context, req *enrollRequest, ev *AuditEvent, logger *slog.Logger) (*x509.Certificate, error) {
+	ev.describeCSR(req.csr)
+	if err := req.csr.CheckSignature(); err != nil {
+		logger.Info("rejected request with invalid CSR signature", "err", err)
+		return nil, newDenial(ev, scep.BadMessageCheck, "invalid CSR signature: "+err.Error(), false)
+	}
+	unlock, issued, err := s.lockTransaction(req, logger)
+	switch {
+	case errors.Is(err, ErrTransactionInProgress):
+		logger.Info("request of a transaction in progress")
+		ev.Outcome, ev.Reason = AuditPending, "transaction in progress"
+		return nil, ErrPending
+	case err != nil:
+		return nil, err
+	case issued != nil:
+		unlock(nil)
+		logger.Info("resent the certificate issued in the transaction", "serial", issued.SerialNumber.Text(16))
+		ev.Outcome, ev.Serial = AuditIssued, issued.SerialNumber.Text(16)
+		return issued, nil
+	}
+	crt, err := s.issue(ctx, req, ev, logger)
+	unlock(crt)
+	return crt, err
+}
+
+// poll answers a CertPoll request of the transaction id, signed with
+// sender. The request of the transaction answered with PENDING for the
+// key of sender is processed again, or the certificate issued in the
+// transaction for it is returned, if the service has a
+// TransactionLocker. Polls of other transactions are denied.
+func (s *service) poll(ctx context.Context, id string, sender *x509.Certificate, ev *AuditEvent, logger *slog.Logger) (*x509.Certificate, error) {
+	if r, ok := s.awaiting.get(id, sender.PublicKey, s.clock.Now()); ok {
+		req := r.req
+		return s.enroll(ctx, &req, ev, logger)
+	}
+	if s.transactions != nil {
+		issued, err := s.transactions.LockTransaction(id, transactionLease)
+		switch {
+		case errors.Is(err, ErrTransactionInProgress):
+			logger.Info("poll of a transaction in progress")
+			ev.Outcome, ev.Reason = AuditPending, "transaction in progress"
+			return nil, ErrPending
+		case err != nil:
+			return nil, err
+		}
+		if err := s.transactions.UnlockTransaction(id, nil); err != nil {
+			logger.Error("failed to unlock the transaction", "err", err)
+		}
+		if issued != nil && sameKey(issued.PublicKey, sender.PublicKey) {
+			logger.Info("resent the certificate issued in the transaction", "serial", issued.SerialNumber.Text(16))
+			ev.Outcome, ev.Serial = AuditIssued, issued.SerialNumber.Text(16)
+			return issued, nil
+		}
+	}
+	logger.Info("rejected poll of an unknown transaction")
+	return nil, newDenial(ev, scep.BadCertID, "no pending request in the transaction", true)
+}
+
+// issue issues the certificate of req for enroll.
+func (s *service) issue(ctx context.Context, req *enrollRequest, ev *AuditEvent, logger *slog.Logger) (*x509.Certificate, error) {
+	csr := req.csr
+	if s.policy != nil {
+		var err error
+		if p, ok := s.policy.(RequesterPolicy); ok {
+			requester, _ := Requester(ctx)
+			err = p.CheckRequester(requester, csr)
+		} else {
+			err = s.policy.Check(csr)
+		}
+		if err != nil {
+			logger.Info("rejected request violating the policy", "err", err)
+			return nil, newDenial(ev, scep.BadRequest, err.Error(), true)
+		}
+	}
+	var (
+		profile *Profile
+		err     error
+	)
+	if s.profiles != nil {
+		profile, err = s.profiles.SelectProfile(&ProfileRequest{
+			CSR:               csr,
+			ChallengePassword: req.challenge,
+		})
+		if err != nil {
+			logger.Info("rejected request matching no profile", "err", err)
+			return nil, newDenial(ev, scep.BadRequest, err.Error(), true)
+		}
+		if profile != nil {
+			logger = logger.With("profile", profile.Name)
+			ctx = withProfile(ctx, profile)
+		}
+	}
+	challengeFailure, err := s.verify(ctx, csr, req.challenge)
+	if err != nil {
+		return nil, err
+	}
+	if profile != nil && profile.ChallengePassword != "" &&
+		subtle.ConstantTimeCompare([]byte(req.challenge), []byte(profile.ChallengePassword)) == 1 {
+		challengeFailure = ""
+	}
+	challengeValid := challengeFailure == "" || s.awaiting.authorized(req, s.clock.Now())
+	renewal := false
+	if req.signer != nil {
+		if renewal, err = s.issued(req.signer); err != nil {
+			return nil, err
+		}
+	}
+	ev.Renewal = renewal
+	if renewal {
+		if err := s.renewal.check(req.signer, csr, s.clock.Now()); err != nil {
+			logger.Info("rejected renewal violating the renewal policy", "err", err)
+			return nil, newDenial(ev, scep.BadRequest, err.Error(), true)
+		}
+	}
+	ok := challengeValid || renewal
+	if s.approver != nil {
+		decision, err := s.approver.Approve(ctx, &ApprovalRequest{
+			TransactionID:  req.transactionID,
+			MessageType:    req.messageType,
+			CSR:            csr,
+			ChallengeValid: challengeValid,
+			Renewal:        renewal,
+			Signer:         req.signer,
+		})
+		if err != nil {
+			return nil, err
+		}
+		logger.Info("request approval", "decision", decision, "challenge_valid", challengeValid, "renewal", renewal)
+		switch decision {
+		case Allow:
+			ok = true
+		case Pending:
+			s.awaiting.add(req, challengeValid, s.clock.Now())
+			ev.Outcome, ev.Reason = AuditPending, "awaiting approval"
+			return nil, ErrPending
+		default:
+			s.awaiting.remove(req.transactionID)
+			return nil, newDenial(ev, scep.BadRequest, "denied by the approver", false)
+		}
+	}
+	if !ok {
+		logger.Info("rejected request without a valid challenge password", "reason", challengeFailure)
+		d := newDenial(ev, scep.BadRequest, challengeFailure, true)
+		d.unauthorized = true
+		return nil, d
+	}
+	crt, err := s.signer.Sign(ctx, csr)
+	var failure *scep.FailInfoError
+	switch {
+	case errors.Is(err, ErrPending):
+		s.awaiting.add(req, challengeValid, s.clock.Now())
+		logger.Info("request pending at the CA")
+		ev.Outcome, ev.Reason = AuditPending, "pending at the CA"
+		return nil, ErrPending
+	case errors.As(err, &failure):
+		s.awaiting.remove(req.transactionID)
+		logger.Info("request rejected by the CA", "fail_info", failure.FailInfo, "text", failure.Text)
+		return nil, newDenial(ev, failure.FailInfo, failure.Text, true)
+	case err != nil:
+		return nil, err
+	}
+	s.awaiting.remove(req.transactionID)
+	if err := s.depot.Put(crt.Subject.CommonName, crt); err != nil {
+		return nil, err
+	}
+	logger.Info("issued certificate", "subject", crt.Subject.String(), "serial", crt.SerialNumber.Text(16))
+	ev.Outcome, ev.Serial = AuditIssued, crt.SerialNumber.Text(16)
+	return crt, nil
+}
+
+// Sign issues a certificate for csr with the CA key.
+func (s *service) Sign(ctx context.Context, csr *x509.CertificateRequest) (*x509.Certificate, error) {
+	serial, err := s.serials.Serial()
+	if err != nil {
+		return nil, err
+	}
+	validity := s.validity
+	profile, hasProfile := RequestProfile(ctx)
+	if hasProfile && profile.Validity > 0 {
+		validity = profile.Validity
+	}
+	if s.policy != nil {
+		if max := s.policy.MaxCertificateValidity(); max > 0 && max < validity {
+			validity = max
+		}
+	}
+	now := s.clock.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:   serial,
+		Subject:        csr.Subject,
+		NotBefore:      now.Add(-10 * time.Minute),
+		NotAfter:       now.Add(validity),
+		KeyUsage:       x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		DNSNames:       csr.DNSNames,
+		EmailAddresses: csr.EmailAddresses,
+		IPAddresses:    csr.IPAddresses,
+		URIs:           csr.URIs,
+	}
+	if hasProfile {
+		profile.apply(tmpl, csr)
+	}
+	if s.crlURL != "" {
+		tmpl.CRLDistributionPoints = []string{s.crlURL}
+	}
+	parent, key := s.issuing()
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, csr.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+// getCRL answers a GetCRL request with the CRL of the CA,
+// if it asks for the CRL of the CA or its successor.
+func (s *service) getCRL(ctx context.Context, msg *scep.PKIMessage) ([]byte, error) {
+	issuer := msg.GetCRLMessage.RawIssuer
+	if !bytes.Equal(issuer, s.ca.certs[0].RawSubject) &&
+		(s.next == nil || !bytes.Equal(issuer, s.next.certs[0].RawSubject)) &&
+		(s.issuer == nil || !bytes.Equal(issuer, s.issuer.certs[0].RawSubject)) {
+		return s.fail(msg, scep.BadCertID)
+	}
+	crl, err := s.CRL(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ca := s.authority()
+	certRep, err := msg.SuccessCRL(ca.certs[0], ca.key, crl)
+	if err != nil {
+		return nil, err
+	}
+	return certRep.Raw, nil
+}
+
+// verify returns why csr, with the challenge password pw, is not
+// authorized by the verifiers of the service, as failInfoText for the
+// client, or an empty string if it is or they authorize all requests.
+func (s *service) verify(ctx context.Context, csr *x509.CertificateRequest, pw string) (string, error) {
+	if s.verifier == nil {
+		return "", nil
+	}
+	return s.verifier.VerifyCSR(ctx, csr, pw)
+}
+
+// issued reports whether crt is a currently valid certificate issued
+// by the CA, its successor or the issuer, and not revoked in the depot,
+// which authorizes the renewal requests it signs. Renewals may be
+// RenewalReq or PKCSReq messages, as many clients, scepclient included,
+// renew with the latter.
+func (s *service) issued(crt *x509.Certificate) (bool, error) {
+	now := s.clock.Now()
+	if now.Before(crt.NotBefore) || now.After(crt.NotAfter) {
+		return false, nil
+	}
+	if crt.CheckSignatureFrom(s.ca.certs[0]) != nil &&
+		(s.issuer == nil || crt.CheckSignatureFrom(s.issuer.certs[0]) != nil) &&
+		(s.next == nil || crt.CheckSignatureFrom(s.next.certs[0]) != nil) {
+		return false, nil
+	}
+	revocations, ok := s.depot.(Revocations)
+	if !ok {
+		return true, nil
+	}
+	revoked, err := revocations.Revoked()
+	if err != nil {
+		return false, err
+	}
+	for _, entry := range revoked {
+		if entry.SerialNumber.Cmp(crt.SerialNumber) == 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// pending answers msg with a PENDING CertRep.
+func (s *service) pending(msg *scep.PKIMessage) ([]byte, error) {
+	ca := s.authority()
+	certRep, err := msg.Pending(ca.certs[0], ca.key)
+	if err != nil {
+		return nil, err
+	}
+	return certRep.Raw, nil
+}
+
+// deny answers msg with a FAILURE CertRep,
+// recording the denial and its reason in ev.
+func (s *service) deny(msg *scep.PKIMessage, ev *AuditEvent, info scep.FailInfo, reason string) ([]byte, error) {
+	ev.Outcome, ev.FailInfo, ev.Reason = AuditDenied, info.String(), reason
+	return s.fail(msg, info)
+}
+
+// fail answers msg with a FAILURE CertRep.
+func (s *service) fail(msg *scep.PKIMessage, info scep.FailInfo) ([]byte, error) {
+	return s.failWithText(msg, info, "")
+}
+
+// failWithText answers msg with a FAILURE CertRep explaining
+// the failure with text.
+func (s *service) failWithText(msg *scep.PKIMessage, info scep.FailInfo, text string) ([]byte, error) {
+	ca := s.authority()
+	certRep, err := msg.FailWithText(ca.certs[0], ca.key, info, text)
+	if err != nil {
+		return nil, err
+	}
+	return certRep.Raw, nil
+}
@@ -0,0 +1,1373 @@
+package scepserver_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	scepclient "scepclient/client"
+	"scepclient/clock"
+	"scepclient/crypto/x509util"
+	"scepclient/scep"
+	"scepclient/scepserver"
+	"scepclient/scepserver/depot"
+	"scepclient/scepserver/depot/bolt"
+	"scepclient/scepserver/depot/file"
+	"scepclient/scepserver/policy"
+	"scepclient/scepserver/profile"
+)
+
+func TestService(t *testing.T) {
+	depot, err := file.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := depot.CreateCA(nil, pkix.Name{CommonName: "test CA"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	svc, err := scepserver.NewService(depot, scepserver.WithChallengePassword("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(scepserver.NewHTTPHandler(svc))
+	defer server.Close()
+	client, err := scepclient.New(server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert := getCACert(t, client)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	selfSigned := selfSign(t, key)
+	send := func(msgType scep.MessageType, challenge string, signer *x509.Certificate) *scep.PKIMessage {
+		return enroll(t, client, caCert, key, msgType, challenge, signer)
+	}
+
+	for challenge, want := range map[string]string{
+		"wrong": "wrong challenge password",
+		"":      "challenge password required",
+	} {
+		resp := send(scep.PKCSReq, challenge, selfSigned)
+		if resp.PKIStatus != scep.FAILURE || resp.FailInfo != scep.BadRequest {
+			t.Fatalf("expected FAILURE badRequest for challenge %q, got %s %s", challenge, resp.PKIStatus, resp.FailInfo)
+		}
+		if resp.FailInfoText != want {
+			t.Errorf("expected failInfoText %q for challenge %q, got %q", want, challenge, resp.FailInfoText)
+		}
+	}
+
+	resp := send(scep.PKCSReq, "secret", selfSigned)
+	if resp.PKIStatus != scep.SUCCESS {
+		t.Fatalf("expected SUCCESS, got %s %s", resp.PKIStatus, resp.FailInfo)
+	}
+	issued := resp.CertRepMessage.Certificate
+	if err := issued.CheckSignatureFrom(caCert); err != nil {
+		t.Fatal(err)
+	}
+
+	// renewals signed with an issued certificate don't need the challenge,
+	// others do
+	resp = send(scep.RenewalReq, "", selfSigned)
+	if resp.PKIStatus != scep.FAILURE {
+		t.Errorf("expected a renewal signed with an unknown certificate to fail, got %s", resp.PKIStatus)
+	}
+	resp = send(scep.RenewalReq, "", issued)
+	if resp.PKIStatus != scep.SUCCESS {
+		t.Fatalf("expected the renewal to succeed, got %s %s", resp.PKIStatus, resp.FailInfo)
+	}
+	if resp.CertRepMessage.Certificate.SerialNumber.Cmp(issued.SerialNumber) == 0 {
+		t.Error("expected the renewed certificate to have a new serial number")
+	}
+}
+
+func TestServiceChallengeStore(t *testing.T) {
+	depot, err := bolt.Open(filepath.Join(t.TempDir(), "depot.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer depot.Close()
+	if err := depot.CreateCA(nil, pkix.Name{CommonName: "test CA"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	svc, err := scepserver.NewService(depot, scepserver.WithChallengeStore(depot))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/challenge", scepserver.NewChallengeHandler(depot, "token"))
+	mux.Handle("/scep", scepserver.NewHTTPHandler(svc))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	client, err := scepclient.New(server.URL+"/scep", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert := getCACert(t, client)
+
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/challenge", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer token")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenge, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := selfSign(t, key)
+	for i, want := range []scep.PKIStatus{scep.SUCCESS, scep.FAILURE} {
+		msg := enroll(t, client, caCert, key, scep.PKCSReq, string(challenge), signer)
+		if msg.PKIStatus != want {
+			t.Errorf("use %d of the challenge: expected %s, got %s", i+1, want, msg.PKIStatus)
+		}
+		if want == scep.FAILURE && !strings.Contains(msg.FailInfoText, "already used") {
+			t.Errorf("expected the failInfoText to explain the rejection, got %q", msg.FailInfoText)
+		}
+	}
+}
+
+// signerFunc adapts a function to scepserver.Signer.
+type signerFunc func(ctx context.Context, csr *x509.CertificateRequest) (*x509.Certificate, error)
+
+func (f signerFunc) Sign(ctx context.Context, csr *x509.CertificateRequest) (*x509.Certificate, error) {
+	return f(ctx, csr)
+}
+
+func TestServiceSigner(t *testing.T) {
+	depot, err := file.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := depot.CreateCA(nil, pkix.Name{CommonName: "RA"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	issuerKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := selfSign(t, issuerKey)
+	signer := signerFunc(func(ctx context.Context, csr *x509.CertificateRequest) (*x509.Certificate, error) {
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(42),
+			Subject:      csr.Subject,
+			NotBefore:    time.Now(),
+			NotAfter:     time.Now().Add(time.Hour),
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, issuer, csr.PublicKey, issuerKey)
+		if err != nil {
+			return nil, err
+		}
+		return x509.ParseCertificate(der)
+	})
+	svc, err := scepserver.NewService(depot, scepserver.WithSigner(signer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(scepserver.NewHTTPHandler(svc))
+	defer server.Close()
+	client, err := scepclient.New(server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := enroll(t, client, getCACert(t, client), key, scep.PKCSReq, "", selfSign(t, key))
+	if resp.PKIStatus != scep.SUCCESS {
+		t.Fatalf("expected SUCCESS, got %s %s", resp.PKIStatus, resp.FailInfo)
+	}
+	crt := resp.CertRepMessage.Certificate
+	if err := issuer.CheckSignature(crt.SignatureAlgorithm, crt.RawTBSCertificate, crt.Signature); err != nil {
+		t.Errorf("expected the certificate to be issued by the signer: %v", err)
+	}
+}
+
+func TestServiceSignerOutcomes(t *testing.T) {
+	depot, err := file.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := depot.CreateCA(nil, pkix.Name{CommonName: "RA"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	var signErr error
+	signer := signerFunc(func(ctx context.Context, csr *x509.CertificateRequest) (*x509.Certificate, error) {
+		return nil, signErr
+	})
+	svc, err := scepserver.NewService(depot, scepserver.WithSigner(signer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(scepserver.NewHTTPHandler(svc))
+	defer server.Close()
+	client, err := scepclient.New(server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert := getCACert(t, client)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signErr = scepserver.ErrPending
+	resp := enroll(t, client, caCert, key, scep.PKCSReq, "", selfSign(t, key))
+	if resp.PKIStatus != scep.PENDING {
+		t.Errorf("expected PENDING, got %s", resp.PKIStatus)
+	}
+	signErr = &scep.FailInfoError{FailInfo: scep.BadCertID, Text: "unknown profile"}
+	resp = enroll(t, client, caCert, key, scep.PKCSReq, "", selfSign(t, key))
+	if resp.PKIStatus != scep.FAILURE || resp.FailInfo != scep.BadCertID || resp.FailInfoText != "unknown profile" {
+		t.Errorf("expected the failure of the signer, got %s %s %q", resp.PKIStatus, resp.FailInfo, resp.FailInfoText)
+	}
+}
+
+func TestServiceSignerPendingChallengeStore(t *testing.T) {
+	depot, err := file.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := depot.CreateCA(nil, pkix.Name{CommonName: "RA"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	challenges := scepserver.NewChallengeStore(0, nil)
+	// the upstream CA issues the certificate on the second request
+	var svc scepserver.Service
+	var signs int
+	signer := signerFunc(func(ctx context.Context, csr *x509.CertificateRequest) (*x509.Certificate, error) {
+		if signs++; signs == 1 {
+			return nil, scepserver.ErrPending
+		}
+		return svc.(scepserver.Signer).Sign(ctx, csr)
+	})
+	svc, err = scepserver.NewService(depot,
+		scepserver.WithChallengeStore(challenges),
+		scepserver.WithSigner(signer),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(scepserver.NewHTTPHandler(svc))
+	defer server.Close()
+	client, err := scepclient.New(server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert := getCACert(t, client)
+	challenge, err := challenges.CreateChallenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signerCert := selfSign(t, key)
+	for _, want := range []scep.PKIStatus{scep.PENDING, scep.SUCCESS} {
+		resp := enroll(t, client, caCert, key, scep.PKCSReq, challenge, signerCert)
+		if resp.PKIStatus != want {
+			t.Fatalf("expected %s, got %s %s %q", want, resp.PKIStatus, resp.FailInfo, resp.FailInfoText)
+		}
+	}
+	if signs != 2 {
+		t.Errorf("expected the resent request to reach the signer, got %d requests", signs)
+	}
+}
+
+func TestServiceTransactions(t *testing.T) {
+	dir := t.TempDir()
+	// services with depots sharing a directory stand in for instances
+	var (
+		depots  []*file.Depot
+		clients []scepclient.Client
+	)
+	for i := 0; i < 2; i++ {
+		depot, err := file.New(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := depot.CreateCA(nil, pkix.Name{CommonName: "test CA"}, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+		svc, err := scepserver.NewService(depot, scepserver.WithTransactionLocker(depot))
+		if err != nil {
+			t.Fatal(err)
+		}
+		server := httptest.NewServer(scepserver.NewHTTPHandler(svc))
+		defer server.Close()
+		client, err := scepclient.New(server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		depots, clients = append(depots, depot), append(clients, client)
+	}
+	caCert := getCACert(t, clients[0])
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := selfSign(t, key)
+	send := func(client scepclient.Client, msg *scep.PKIMessage, signer *x509.Certificate) *scep.PKIMessage {
+		t.Helper()
+		respBytes, err := client.PKIOperation(context.Background(), msg.Raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := scep.ParsePKIMessage(respBytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.PKIStatus == scep.SUCCESS {
+			if err := resp.DecryptPKIEnvelope(signer, key); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp
+	}
+
+	// a request resent to another instance gets the same certificate
+	msg := csrRequest(t, caCert, key, scep.PKCSReq, "", signer)
+	var serials []string
+	for _, client := range clients {
+		resp := send(client, msg, signer)
+		if resp.PKIStatus != scep.SUCCESS {
+			t.Fatalf("expected SUCCESS, got %s %s", resp.PKIStatus, resp.FailInfo)
+		}
+		serials = append(serials, resp.CertRepMessage.Certificate.SerialNumber.Text(16))
+	}
+	if serials[0] != serials[1] {
+		t.Errorf("expected one certificate for the transaction, got serials %v", serials)
+	}
+	issued := send(clients[0], msg, signer).CertRepMessage.Certificate
+
+	// a renewal signed with the certificate of the transaction,
+	// which has the same ID for the same key, gets a new one
+	resp := send(clients[1], csrRequest(t, caCert, key, scep.RenewalReq, "", issued), issued)
+	if resp.PKIStatus != scep.SUCCESS {
+		t.Fatalf("expected SUCCESS, got %s %s", resp.PKIStatus, resp.FailInfo)
+	}
+	if resp.CertRepMessage.Certificate.Equal(issued) {
+		t.Error("expected the renewal to issue a new certificate")
+	}
+
+	// requests of a transaction another instance processes are pending
+	msg = csrRequest(t, caCert, key, scep.PKCSReq, "", signer)
+	if _, err := depots[0].LockTransaction(string(msg.TransactionID), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if resp := send(clients[1], msg, signer); resp.PKIStatus != scep.PENDING {
+		t.Errorf("expected PENDING for a locked transaction, got %s", resp.PKIStatus)
+	}
+}
+
+func TestServiceIssuer(t *testing.T) {
+	depot, err := file.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := depot.CreateCA(nil, pkix.Name{CommonName: "RA"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	// any crypto.Signer issues certificates, such as a KMS key
+	issuerKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "issuing CA"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, issuerKey.Public(), issuerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := scepserver.NewService(depot, scepserver.WithIssuer([]*x509.Certificate{issuer}, otherKey)); err == nil {
+		t.Error("expected an error for a key not matching the issuer certificate")
+	}
+
+	svc, err := scepserver.NewService(depot, scepserver.WithIssuer([]*x509.Certificate{issuer}, issuerKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(scepserver.NewHTTPHandler(svc))
+	defer server.Close()
+	client, err := scepclient.New(server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCerts, _, err := client.GetCACert(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs, err := scep.CACerts(caCerts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 2 || !certs[1].Equal(issuer) {
+		t.Fatalf("expected the RA and issuer certificates, got %d certificates", len(certs))
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := enroll(t, client, certs[0], key, scep.PKCSReq, "", selfSign(t, key))
+	if resp.PKIStatus != scep.SUCCESS {
+		t.Fatalf("expected SUCCESS, got %s %s", resp.PKIStatus, resp.FailInfo)
+	}
+	crt := resp.CertRepMessage.Certificate
+	if err := crt.CheckSignatureFrom(issuer); err != nil {
+		t.Errorf("expected the certificate to be issued by the issuer: %v", err)
+	}
+	// certificates of the issuer authorize renewals
+	resp = enroll(t, client, certs[0], key, scep.RenewalReq, "", crt)
+	if resp.PKIStatus != scep.SUCCESS {
+		t.Errorf("expected the renewal to succeed, got %s %s", resp.PKIStatus, resp.FailInfo)
+	}
+
+	crlDER, err := svc.(scepserver.CRLSigner).CRL(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	crl, err := x509.ParseRevocationList(crlDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := crl.CheckSignatureFrom(issuer); err != nil {
+		t.Errorf("expected the CRL to be signed by the issuer: %v", err)
+	}
+}
+
+func TestServiceApprover(t *testing.T) {
+	depot, err := file.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := depot.CreateCA(nil, pkix.Name{CommonName: "test CA"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	var decisions []scepserver.Decision
+	approver := scepserver.ApproverFunc(func(ctx context.Context, req *scepserver.ApprovalRequest) (scepserver.Decision, error) {
+		if req.ChallengeValid || req.Renewal {
+			t.Errorf("expected an invalid challenge, got %+v", req)
+		}
+		decision := decisions[0]
+		decisions = decisions[1:]
+		return decision, nil
+	})
+	svc, err := scepserver.NewService(depot,
+		scepserver.WithChallengePassword("secret"),
+		scepserver.WithApprover(approver),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(scepserver.NewHTTPHandler(svc))
+	defer server.Close()
+	client, err := scepclient.New(server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert := getCACert(t, client)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := selfSign(t, key)
+
+	// the approver overrides the wrong challenge
+	decisions = []scepserver.Decision{scepserver.Pending, scepserver.Allow, scepserver.Deny}
+	for _, want := range []scep.PKIStatus{scep.PENDING, scep.SUCCESS, scep.FAILURE} {
+		resp := enroll(t, client, caCert, key, scep.PKCSReq, "wrong", signer)
+		if resp.PKIStatus != want {
+			t.Errorf("expected %s, got %s", want, resp.PKIStatus)
+		}
+	}
+}
+
+func TestServiceApproverChallengeStore(t *testing.T) {
+	depot, err := file.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := depot.CreateCA(nil, pkix.Name{CommonName: "test CA"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	var polls int
+	approver := scepserver.ApproverFunc(func(ctx context.Context, req *scepserver.ApprovalRequest) (scepserver.Decision, error) {
+		if !req.ChallengeValid {
+			return scepserver.Deny, nil
+		}
+		if polls++; polls < 3 {
+			return scepserver.Pending, nil
+		}
+		return scepserver.Allow, nil
+	})
+	challenges := scepserver.NewChallengeStore(0, nil)
+	svc, err := scepserver.NewService(depot,
+		scepserver.WithChallengeStore(challenges),
+		scepserver.WithApprover(approver),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(scepserver.NewHTTPHandler(svc))
+	defer server.Close()
+	client, err := scepclient.New(server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert := getCACert(t, client)
+	challenge, err := challenges.CreateChallenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := selfSign(t, key)
+
+	// the one-time challenge keeps authorizing the resent request
+	for _, want := range []scep.PKIStatus{scep.PENDING, scep.PENDING, scep.SUCCESS} {
+		resp := enroll(t, client, caCert, key, scep.PKCSReq, challenge, signer)
+		if resp.PKIStatus != want {
+			t.Fatalf("expected %s, got %s %s", want, resp.PKIStatus, resp.FailInfo)
+		}
+	}
+
+	// but not the requests for other keys
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp := enroll(t, client, caCert, otherKey, scep.PKCSReq, challenge, selfSign(t, otherKey)); resp.PKIStatus != scep.FAILURE {
+		t.Errorf("expected FAILURE reusing the challenge for another key, got %s", resp.PKIStatus)
+	}
+}
+
+func TestServiceCertPoll(t *testing.T) {
+	depot, err := file.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := depot.CreateCA(nil, pkix.Name{CommonName: "test CA"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	decisions := []scepserver.Decision{scepserver.Pending, scepserver.Pending, scepserver.Allow}
+	approver := scepserver.ApproverFunc(func(ctx context.Context, req *scepserver.ApprovalRequest) (scepserver.Decision, error) {
+		if !req.ChallengeValid {
+			t.Errorf("expected the challenge of the first request to be valid, got %+v", req)
+		}
+		decision := decisions[0]
+		decisions = decisions[1:]
+		return decision, nil
+	})
+	challenges := scepserver.NewChallengeStore(0, nil)
+	svc, err := scepserver.NewService(depot,
+		scepserver.WithChallengeStore(challenges),
+		scepserver.WithApprover(approver),
+		scepserver.WithTransactionLocker(depot),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(scepserver.NewHTTPHandler(svc))
+	defer server.Close()
+	client, err := scepclient.New(server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert := getCACert(t, client)
+	challenge, err := challenges.CreateChallenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := selfSign(t, key)
+	msg := csrRequest(t, caCert, key, scep.PKCSReq, challenge, signer)
+	poll := func() *scep.PKIMessage {
+		t.Helper()
+		req, err := scep.NewCertPollRequest(msg.CSRReqMessage.CSR, &scep.PKIMessage{
+			Recipients: []*x509.Certificate{caCert},
+			SignerKey:  key,
+			SignerCert: signer,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		respBytes, err := client.PKIOperation(context.Background(), req.Raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := scep.ParsePKIMessage(respBytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.PKIStatus == scep.SUCCESS {
+			if err := resp.DecryptPKIEnvelope(signer, key); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp
+	}
+
+	if resp := poll(); resp.PKIStatus != scep.FAILURE || resp.FailInfo != scep.BadCertID {
+		t.Errorf("expected FAILURE badCertID polling an unknown transaction, got %s %s", resp.PKIStatus, resp.FailInfo)
+	}
+	respBytes, err := client.PKIOperation(context.Background(), msg.Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := scep.ParsePKIMessage(respBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.PKIStatus != scep.PENDING {
+		t.Fatalf("expected PENDING, got %s %s", resp.PKIStatus, resp.FailInfo)
+	}
+	if resp := poll(); resp.PKIStatus != scep.PENDING {
+		t.Fatalf("expected PENDING polling while the approver decides, got %s %s", resp.PKIStatus, resp.FailInfo)
+	}
+	resp = poll()
+	if resp.PKIStatus != scep.SUCCESS {
+		t.Fatalf("expected SUCCESS once approved, got %s %s %q", resp.PKIStatus, resp.FailInfo, resp.FailInfoText)
+	}
+	issued := resp.CertRepMessage.Certificate
+	if !issued.PublicKey.(*rsa.PublicKey).Equal(&key.PublicKey) {
+		t.Error("expected the certificate for the key of the request")
+	}
+
+	// polling again gets the certificate issued in the transaction
+	resp = poll()
+	if resp.PKIStatus != scep.SUCCESS || !resp.CertRepMessage.Certificate.Equal(issued) {
+		t.Errorf("expected the issued certificate, got %s %s", resp.PKIStatus, resp.FailInfo)
+	}
+	if len(decisions) != 0 {
+		t.Errorf("expected every request to be approved, %d decisions left", len(decisions))
+	}
+}
+
+func TestServicePolicy(t *testing.T) {
+	depot, err := file.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := depot.CreateCA(nil, pkix.Name{CommonName: "test CA"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	for data, want := range map[string]string{
+		`{"common_name": "^laptop$"}`: `common name "device" is not allowed`,
+		// the test server listens on the loopback address
+		`{"deny_requester_ips": ["127.0.0.0/8", "::1"]}`: `requester 127.0.0.1 is not allowed`,
+	} {
+		p, err := policy.Parse([]byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		svc, err := scepserver.NewService(depot, scepserver.WithPolicy(p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		server := httptest.NewServer(scepserver.NewHTTPHandler(svc))
+		defer server.Close()
+		client, err := scepclient.New(server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := enroll(t, client, getCACert(t, client), key, scep.PKCSReq, "", selfSign(t, key))
+		if resp.PKIStatus != scep.FAILURE || resp.FailInfo != scep.BadRequest {
+			t.Fatalf("%s: expected FAILURE badRequest, got %s %s", data, resp.PKIStatus, resp.FailInfo)
+		}
+		if resp.FailInfoText != want {
+			t.Errorf("%s: expected failInfoText %q, got %q", data, want, resp.FailInfoText)
+		}
+	}
+}
+
+func getCACert(t *testing.T, client scepclient.Client) *x509.Certificate {
+	caCertDER, _, err := client.GetCACert(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(caCertDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return caCert
+}
+
+func TestServiceProfiles(t *testing.T) {
+	depot, err := file.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := depot.CreateCA(nil, pkix.Name{CommonName: "test CA"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	p, err := profile.Parse([]byte(`{
+		"profiles": [
+			{
+				"name": "vpn",
+				"match": {"challenge": "vpn-secret"},
+				"validity": "24h",
+				"ext_key_usage": ["client_auth", "1.3.6.1.5.5.8.2.2"],
+				"copy_sans": [],
+				"common_name_as_dns_name": true
+			},
+			{"name": "default", "match": {"subject": "CN=device"}}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc, err := scepserver.NewService(depot,
+		scepserver.WithChallengePassword("secret"),
+		scepserver.WithProfiles(p),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(scepserver.NewHTTPHandler(svc))
+	defer server.Close()
+	client, err := scepclient.New(server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert := getCACert(t, client)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the profile challenge authorizes the request and selects the profile
+	resp := enroll(t, client, caCert, key, scep.PKCSReq, "vpn-secret", selfSign(t, key))
+	if resp.PKIStatus != scep.SUCCESS {
+		t.Fatalf("expected SUCCESS, got %s %s %s", resp.PKIStatus, resp.FailInfo, resp.FailInfoText)
+	}
+	crt := resp.CertRepMessage.Certificate
+	if validity := crt.NotAfter.Sub(crt.NotBefore); validity > 25*time.Hour {
+		t.Errorf("expected the 24h validity of the profile, got %s", validity)
+	}
+	if len(crt.UnknownExtKeyUsage) != 1 || len(crt.DNSNames) != 1 || crt.DNSNames[0] != "device" {
+		t.Errorf("expected the usages and SANs of the profile, got %v %v", crt.UnknownExtKeyUsage, crt.DNSNames)
+	}
+
+	// other requests get the default profile
+	resp = enroll(t, client, caCert, key, scep.PKCSReq, "secret", selfSign(t, key))
+	if resp.PKIStatus != scep.SUCCESS {
+		t.Fatalf("expected SUCCESS, got %s %s %s", resp.PKIStatus, resp.FailInfo, resp.FailInfoText)
+	}
+	if crt := resp.CertRepMessage.Certificate; len(crt.UnknownExtKeyUsage) != 0 || crt.NotAfter.Sub(crt.NotBefore) < 24*time.Hour*364 {
+		t.Errorf("expected the default certificate, got %v valid until %s", crt.UnknownExtKeyUsage, crt.NotAfter)
+	}
+}
+
+func TestServiceRenewalPolicy(t *testing.T) {
+	depot, err := file.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := depot.CreateCA(nil, pkix.Name{CommonName: "test CA"}, 24*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	clk := clock.NewFake(time.Now())
+	svc, err := scepserver.NewService(depot,
+		scepserver.WithChallengePassword("secret"),
+		scepserver.WithCertificateValidity(time.Hour),
+		scepserver.WithRenewalPolicy(scepserver.RenewalPolicy{Window: 15 * time.Minute, SameIdentity: true}),
+		scepserver.WithServiceClock(clk),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(scepserver.NewHTTPHandler(svc))
+	defer server.Close()
+	client, err := scepclient.New(server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert := getCACert(t, client)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := enroll(t, client, caCert, key, scep.PKCSReq, "secret", selfSign(t, key))
+	if resp.PKIStatus != scep.SUCCESS {
+		t.Fatalf("expected SUCCESS, got %s %s", resp.PKIStatus, resp.FailInfo)
+	}
+	issued := resp.CertRepMessage.Certificate
+
+	// too early, even with the challenge
+	resp = enroll(t, client, caCert, key, scep.RenewalReq, "secret", issued)
+	if resp.PKIStatus != scep.FAILURE || resp.FailInfo != scep.BadRequest {
+		t.Fatalf("expected FAILURE badRequest for an early renewal, got %s %s", resp.PKIStatus, resp.FailInfo)
+	}
+	if !strings.Contains(resp.FailInfoText, "renewal too early") {
+		t.Errorf("expected the failInfoText to explain the rejection, got %q", resp.FailInfoText)
+	}
+
+	clk.Advance(50 * time.Minute)
+	resp = enroll(t, client, caCert, key, scep.RenewalReq, "", issued)
+	if resp.PKIStatus != scep.SUCCESS {
+		t.Fatalf("expected the renewal in the window to succeed, got %s %s", resp.PKIStatus, resp.FailInfo)
+	}
+}
+
+func TestServiceNextCA(t *testing.T) {
+	fileDepot, err := file.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fileDepot.CreateCA(nil, pkix.Name{CommonName: "test CA"}, 24*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	nextCA, nextKey, err := depot.GenerateCA(pkix.Name{CommonName: "next CA"}, 48*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clk := clock.NewFake(time.Now())
+	svc, err := scepserver.NewService(fileDepot,
+		scepserver.WithNextCA([]*x509.Certificate{nextCA}, nextKey, clk.Now().Add(time.Hour)),
+		scepserver.WithServiceClock(clk),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(scepserver.NewHTTPHandler(svc))
+	defer server.Close()
+	client, err := scepclient.New(server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caps, err := client.GetCACaps(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(caps, []byte("GetNextCACert")) {
+		t.Errorf("expected the GetNextCACert capability, got %q", caps)
+	}
+	caCert := getCACert(t, client)
+	data, err := client.GetNextCACert(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, err := scep.NextCACerts(data, caCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(next) != 1 || !next[0].Equal(nextCA) {
+		t.Fatal("expected the next CA certificate")
+	}
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := enroll(t, client, caCert, key, scep.PKCSReq, "", selfSign(t, key))
+	if resp.PKIStatus != scep.SUCCESS {
+		t.Fatalf("expected SUCCESS, got %s %s", resp.PKIStatus, resp.FailInfo)
+	}
+	issued := resp.CertRepMessage.Certificate
+
+	// the next CA takes over at activation
+	clk.Advance(time.Hour)
+	if got := getCACert(t, client); !got.Equal(nextCA) {
+		t.Fatalf("expected GetCACert to return the next CA, got %s", got.Subject)
+	}
+	if _, err := client.GetNextCACert(context.Background()); err == nil {
+		t.Error("expected no next CA after the rollover")
+	}
+	resp = enroll(t, client, nextCA, key, scep.RenewalReq, "", issued)
+	if resp.PKIStatus != scep.SUCCESS {
+		t.Fatalf("expected the renewal of a certificate of the previous CA to succeed, got %s %s", resp.PKIStatus, resp.FailInfo)
+	}
+	if err := resp.CertRepMessage.Certificate.CheckSignatureFrom(nextCA); err != nil {
+		t.Errorf("expected the renewed certificate to be issued by the next CA: %v", err)
+	}
+}
+
+func TestServiceCAChain(t *testing.T) {
+	fileDepot, err := file.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fileDepot.CreateCA(nil, pkix.Name{CommonName: "RA"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	ra, _, err := fileDepot.CA(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuing, _, err := depot.GenerateCA(pkix.Name{CommonName: "issuing CA"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, _, err := depot.GenerateCA(pkix.Name{CommonName: "root CA"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the RA certificate is already served, and not repeated
+	svc, err := scepserver.NewService(fileDepot, scepserver.WithCAChain([]*x509.Certificate{ra[0], issuing, root}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	scepserver.NewHTTPHandler(svc).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?operation=GetCACert", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != "application/x-x509-ca-ra-cert" {
+		t.Errorf("expected the content type of a chain, got %q", ct)
+	}
+	certs, err := scep.CACerts(rec.Body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, crt := range certs {
+		names = append(names, crt.Subject.CommonName)
+	}
+	if got := strings.Join(names, ", "); got != "RA, issuing CA, root CA" {
+		t.Errorf("expected the RA, issuing and root CA, got %s", got)
+	}
+}
+
+func TestServiceCRL(t *testing.T) {
+	depot, err := file.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := depot.CreateCA(nil, pkix.Name{CommonName: "test CA"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	svc, err := scepserver.NewService(depot, scepserver.WithCRLDistributionPoint("http://scep.example.com/crl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/", scepserver.NewHTTPHandler(svc))
+	mux.Handle("/crl", scepserver.NewCRLHandler(svc.(scepserver.CRLSigner)))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	client, err := scepclient.New(server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert := getCACert(t, client)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := enroll(t, client, caCert, key, scep.PKCSReq, "", selfSign(t, key))
+	if resp.PKIStatus != scep.SUCCESS {
+		t.Fatalf("expected SUCCESS, got %s %s", resp.PKIStatus, resp.FailInfo)
+	}
+	issued := resp.CertRepMessage.Certificate
+	if len(issued.CRLDistributionPoints) != 1 || issued.CRLDistributionPoints[0] != "http://scep.example.com/crl" {
+		t.Errorf("expected the CRL distribution point, got %v", issued.CRLDistributionPoints)
+	}
+	if err := depot.Revoke(issued.SerialNumber, 1, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	httpResp, err := http.Get(server.URL + "/crl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := ioutil.ReadAll(httpResp.Body)
+	httpResp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := httpResp.Header.Get("Content-Type"); ct != "application/pkix-crl" {
+		t.Errorf("expected Content-Type application/pkix-crl, got %q", ct)
+	}
+	crl, err := x509.ParseRevocationList(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := crl.CheckSignatureFrom(caCert); err != nil {
+		t.Error(err)
+	}
+	if len(crl.RevokedCertificateEntries) != 1 || crl.RevokedCertificateEntries[0].SerialNumber.Cmp(issued.SerialNumber) != 0 {
+		t.Errorf("expected the revoked certificate in the CRL, got %+v", crl.RevokedCertificateEntries)
+	}
+
+	// the same CRL with the GetCRL operation
+	msg, err := scep.NewGetCRLRequest(issued, &scep.PKIMessage{
+		Recipients: []*x509.Certificate{caCert},
+		SignerKey:  key,
+		SignerCert: issued,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	respBytes, err := client.PKIOperation(context.Background(), msg.Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = scep.ParsePKIMessage(respBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.PKIStatus != scep.SUCCESS {
+		t.Fatalf("expected SUCCESS, got %s %s", resp.PKIStatus, resp.FailInfo)
+	}
+	if err := resp.DecryptPKIEnvelope(issued, key); err != nil {
+		t.Fatal(err)
+	}
+	if resp.CRL == nil || len(resp.CRL.RevokedCertificateEntries) != 1 {
+		t.Errorf("expected the CRL with the revoked certificate, got %+v", resp.CRL)
+	}
+}
+
+func TestServiceCRLNumber(t *testing.T) {
+	depot, err := file.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := depot.CreateCA(nil, pkix.Name{CommonName: "test CA"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	clk := clock.NewFake(time.Now())
+	svc, err := scepserver.NewService(depot, scepserver.WithServiceClock(clk))
+	if err != nil {
+		t.Fatal(err)
+	}
+	crlNumber := func() *big.Int {
+		der, err := svc.(scepserver.CRLSigner).CRL(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		crl, err := x509.ParseRevocationList(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return crl.Number
+	}
+	// several CRLs within one second, then a later one
+	last := crlNumber()
+	for _, advance := range []time.Duration{0, 0, time.Millisecond, time.Minute} {
+		clk.Advance(advance)
+		number := crlNumber()
+		if number.Cmp(last) <= 0 {
+			t.Fatalf("expected CRL numbers to increase, got %v after %v", number, last)
+		}
+		last = number
+	}
+	if last.Int64() < clk.Now().Unix() {
+		t.Errorf("expected the CRL number to follow the time, got %v", last)
+	}
+}
+
+func TestServiceRevokedRenewal(t *testing.T) {
+	depot, err := file.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := depot.CreateCA(nil, pkix.Name{CommonName: "test CA"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	svc, err := scepserver.NewService(depot, scepserver.WithChallengePassword("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(scepserver.NewHTTPHandler(svc))
+	defer server.Close()
+	client, err := scepclient.New(server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert := getCACert(t, client)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := enroll(t, client, caCert, key, scep.PKCSReq, "secret", selfSign(t, key))
+	if resp.PKIStatus != scep.SUCCESS {
+		t.Fatalf("expected SUCCESS, got %s %s", resp.PKIStatus, resp.FailInfo)
+	}
+	issued := resp.CertRepMessage.Certificate
+	if err := depot.Revoke(issued.SerialNumber, 1, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	// a revoked certificate no longer authorizes renewals
+	resp = enroll(t, client, caCert, key, scep.RenewalReq, "", issued)
+	if resp.PKIStatus != scep.FAILURE {
+		t.Fatalf("expected FAILURE renewing with a revoked certificate, got %s", resp.PKIStatus)
+	}
+	resp = enroll(t, client, caCert, key, scep.RenewalReq, "secret", issued)
+	if resp.PKIStatus != scep.SUCCESS {
+		t.Errorf("expected SUCCESS with the challenge, got %s %s", resp.PKIStatus, resp.FailInfo)
+	}
+}
+
+// pingDepot is a depot whose health check fails with err.
+type pingDepot struct {
+	*file.Depot
+	err error
+}
+
+func (d *pingDepot) Ping(ctx context.Context) error { return d.err }
+
+func TestServiceHealth(t *testing.T) {
+	fileDepot, err := file.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fileDepot.CreateCA(nil, pkix.Name{CommonName: "test CA"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	depot := &pingDepot{Depot: fileDepot}
+	clk := clock.NewFake(time.Now())
+	svc, err := scepserver.NewService(depot, scepserver.WithServiceClock(clk))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := scepserver.NewHealthHandler(svc.(scepserver.HealthChecker))
+	check := func(want int) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		if rec.Code != want {
+			t.Errorf("expected status %d, got %d: %s", want, rec.Code, rec.Body)
+		}
+	}
+	check(http.StatusOK)
+	depot.err = errors.New("connection refused")
+	check(http.StatusServiceUnavailable)
+	depot.err = nil
+	clk.Advance(2 * time.Hour)
+	check(http.StatusServiceUnavailable)
+}
+
+func TestServiceUnsupportedMessageTypes(t *testing.T) {
+	depot, err := file.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := depot.CreateCA(nil, pkix.Name{CommonName: "test CA"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	certs, caKey, err := depot.CA(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert := certs[0]
+	svc, err := scepserver.NewService(depot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// a CertRep decrypts with the key of the CA if it is encrypted to it,
+	// but holds no CSR
+	req, err := scep.ParsePKIMessage(csrRequest(t, caCert, caKey, scep.PKCSReq, "", caCert).Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := req.DecryptPKIEnvelope(caCert, caKey); err != nil {
+		t.Fatal(err)
+	}
+	certRep, err := req.Success(caCert, caKey, caCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.PKIOperation(ctx, certRep.Raw); !errors.Is(err, scepserver.ErrNotSupported) {
+		t.Errorf("expected a CertRep to be unsupported, got %v", err)
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	getCert := csrRequest(t, caCert, key, scep.GetCert, "", selfSign(t, key))
+	if _, err := svc.PKIOperation(ctx, getCert.Raw); err == nil {
+		t.Error("expected a GetCert request to fail")
+	}
+}
+
+func TestServiceAuditor(t *testing.T) {
+	depot, err := file.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := depot.CreateCA(nil, pkix.Name{CommonName: "test CA"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	var (
+		events  []*scepserver.AuditEvent
+		failing bool
+	)
+	auditor := scepserver.AuditorFunc(func(ctx context.Context, ev *scepserver.AuditEvent) error {
+		if failing {
+			return errors.New("disk full")
+		}
+		events = append(events, ev)
+		return nil
+	})
+	svc, err := scepserver.NewService(depot,
+		scepserver.WithChallengePassword("secret"),
+		scepserver.WithAuditor(auditor),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(scepserver.NewHTTPHandler(svc))
+	defer server.Close()
+	client, err := scepclient.New(server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert := getCACert(t, client)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := selfSign(t, key)
+
+	resp := enroll(t, client, caCert, key, scep.PKCSReq, "secret", signer)
+	enroll(t, client, caCert, key, scep.PKCSReq, "wrong", signer)
+	if len(events) != 2 {
+		t.Fatalf("expected 2 audit events, got %d", len(events))
+	}
+
+	issued := events[0]
+	if issued.Outcome != scepserver.AuditIssued {
+		t.Errorf("expected outcome issued, got %s", issued.Outcome)
+	}
+	crt := resp.CertRepMessage.Certificate
+	if want := crt.SerialNumber.Text(16); issued.Serial != want {
+		t.Errorf("expected serial %s, got %s", want, issued.Serial)
+	}
+	if issued.TransactionID == "" || issued.MessageType != "PKCSReq (19)" {
+		t.Errorf("expected the transaction ID and message type, got %+v", issued)
+	}
+	if issued.Subject != "CN=device" || issued.Signer != "CN=SCEP SIGNER" || issued.Key != "RSA 2048" {
+		t.Errorf("expected the CSR summary, got %+v", issued)
+	}
+	if host, _, _ := net.SplitHostPort(issued.Requester); host != "127.0.0.1" {
+		t.Errorf("expected requester 127.0.0.1, got %q", issued.Requester)
+	}
+
+	denied := events[1]
+	if denied.Outcome != scepserver.AuditDenied || denied.FailInfo != "badRequest (2)" || denied.Serial != "" {
+		t.Errorf("expected a denial with badRequest, got %+v", denied)
+	}
+
+	// requests fail rather than go unaudited
+	failing = true
+	msg := csrRequest(t, caCert, key, scep.PKCSReq, "secret", signer)
+	if _, err := client.PKIOperation(context.Background(), msg.Raw); err == nil {
+		t.Error("expected the request to fail when it can't be audited")
+	}
+}
+
+// enroll sends a request of msgType for key with challenge, signed with signer,
+// and returns the decrypted response.
+func enroll(t *testing.T, client scepclient.Client, caCert *x509.Certificate, key *rsa.PrivateKey, msgType scep.MessageType, challenge string, signer *x509.Certificate) *scep.PKIMessage {
+	msg := csrRequest(t, caCert, key, msgType, challenge, signer)
+	respBytes, err := client.PKIOperation(context.Background(), msg.Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := scep.ParsePKIMessage(respBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.PKIStatus == scep.SUCCESS {
+		if err := resp.DecryptPKIEnvelope(signer, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp
+}
+
+func csrRequest(t *testing.T, caCert *x509.Certificate, key *rsa.PrivateKey, msgType scep.MessageType, challenge string, signer *x509.Certificate) *scep.PKIMessage {
+	csrDER, err := x509util.CreateCertificateRequest(rand.Reader, &x509util.CertificateRequest{
+		CertificateRequest: x509.CertificateRequest{Subject: pkix.Name{CommonName: "device"}},
+		ChallengePassword:  challenge,
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := scep.NewCSRRequest(csr, &scep.PKIMessage{
+		MessageType: msgType,
+		Recipients:  []*x509.Certificate{caCert},
+		SignerKey:   key,
+		SignerCert:  signer,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func selfSign(t *testing.T, key *rsa.PrivateKey) *x509.Certificate {
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "SCEP SIGNER"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crt, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return crt
+}
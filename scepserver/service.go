@@ -4,17 +4,15 @@ import (
 	"bytes"
 	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
-	"github.com/go-kit/kit/endpoint"
-	httptransport "github.com/go-kit/kit/transport/http"
-	"github.com/pkg/errors"
 	"io"
 	"io/ioutil"
-	"log"
+	"mime"
 	"net/http"
-	"net/url"
-	"strings"
 	"sync"
+
+	"scepclient/scep"
 )
 // Service is the interface for all supported SCEP server operations.
 type Service interface {
@@ -61,14 +59,41 @@ type SCEPResponse struct {
 	CACertNum int
 	Data      []byte
 	Err       error
+
+	// StatusCode is the HTTP status of the response,
+	// if it was received over HTTP.
+	StatusCode int
 }
 
+// Endpoint is a single SCEP client operation. It has the same
+// signature as a go-kit endpoint.Endpoint, which can be converted to it.
+type Endpoint func(ctx context.Context, request interface{}) (response interface{}, err error)
+
+// Endpoints implements the SCEP client operations on top of a GET and a
+// POST endpoint. They are safe for concurrent use: the capabilities cache
+// is the only state shared between calls.
 type Endpoints struct {
-	GetEndpoint  endpoint.Endpoint
-	PostEndpoint endpoint.Endpoint
+	GetEndpoint  Endpoint
+	PostEndpoint Endpoint
 
-	mtx          sync.RWMutex
+	// stream sends GET requests returning the body unbuffered,
+	// set if the endpoints were created from a Transport.
+	stream func(ctx context.Context, req SCEPRequest) (io.ReadCloser, SCEPResponse, error)
+
+	// capabilities cache, guarded by mtx.
+	// capsCall is set while a GetCACaps request is in flight,
+	// so that concurrent callers of Supports share one request.
+	mtx          sync.Mutex
 	capabilities []byte
+	capsFetched  bool
+	capsCall     *capsCall
+}
+
+// capsCall is an in-flight or completed GetCACaps request.
+type capsCall struct {
+	done chan struct{}
+	caps []byte
+	err  error
 }
 
 // SCEPRequest is a SCEP server request.
@@ -77,6 +102,7 @@ type SCEPRequest struct {
 	Message   []byte
 }
 
+// GetCACaps requests the server capabilities and updates the cache used by Supports.
 func (e *Endpoints) GetCACaps(ctx context.Context) ([]byte, error) {
 	request := SCEPRequest{Operation: getCACaps}
 	response, err := e.GetEndpoint(ctx, request)
@@ -85,23 +111,71 @@ func (e *Endpoints) GetCACaps(ctx context.Context) ([]byte, error) {
 	}
 	resp := response.(SCEPResponse)
 
-	e.mtx.Lock()
-	e.capabilities = resp.Data
-	e.mtx.Unlock()
+	if resp.Err == nil {
+		e.mtx.Lock()
+		// copied, so that callers may modify the returned data
+		e.capabilities = append([]byte(nil), resp.Data...)
+		e.capsFetched = true
+		e.mtx.Unlock()
+	}
 
 	return resp.Data, resp.Err
 }
 
+// Supports reports whether the server advertises the capability cap.
+// The capabilities are fetched on first use and cached. A failed fetch is
+// not cached, and cap is reported as unsupported.
 func (e *Endpoints) Supports(cap string) bool {
-	e.mtx.RLock()
-	defer e.mtx.RUnlock()
+	caps, err := e.cachedCaps(context.Background())
+	if err != nil {
+		return false
+	}
+	return bytes.Contains(caps, []byte(cap))
+}
 
-	if len(e.capabilities) == 0 {
-		e.mtx.RUnlock()
-		e.GetCACaps(context.Background())
-		e.mtx.RLock()
+// cachedCaps returns the cached capabilities, fetching them if needed.
+func (e *Endpoints) cachedCaps(ctx context.Context) ([]byte, error) {
+	e.mtx.Lock()
+	if e.capsFetched {
+		caps := e.capabilities
+		e.mtx.Unlock()
+		return caps, nil
+	}
+	if call := e.capsCall; call != nil {
+		e.mtx.Unlock()
+		<-call.done
+		return call.caps, call.err
 	}
-	return bytes.Contains(e.capabilities, []byte(cap))
+	call := &capsCall{done: make(chan struct{})}
+	e.capsCall = call
+	e.mtx.Unlock()
+
+	call.caps, call.err = e.GetCACaps(ctx)
+
+	e.mtx.Lock()
+	e.capsCall = nil
+	e.mtx.Unlock()
+	close(call.done)
+
+	return call.caps, call.err
+}
+
+// GetCACertReader is like GetCACert, but returns the response body as a
+// stream, so that large certificate chains need not be buffered in memory.
+// The caller must close the returned reader.
+func (e *Endpoints) GetCACertReader(ctx context.Context) (io.ReadCloser, int, error) {
+	if e.stream == nil {
+		data, num, err := e.GetCACert(ctx)
+		if err != nil {
+			return nil, 0, err
+		}
+		return ioutil.NopCloser(bytes.NewReader(data)), num, nil
+	}
+	body, resp, err := e.stream(ctx, SCEPRequest{Operation: getCACert})
+	if err != nil {
+		return nil, 0, err
+	}
+	return body, resp.CACertNum, nil
 }
 
 func (e *Endpoints) GetCACert(ctx context.Context) ([]byte, int, error) {
@@ -111,11 +185,11 @@ func (e *Endpoints) GetCACert(ctx context.Context) ([]byte, int, error) {
 		return nil, 0, err
 	}
 	resp := response.(SCEPResponse)
-	return resp.Data, resp.CACertNum, resp.Err
+	return trimTrailingData(resp.Data), resp.CACertNum, resp.Err
 }
 
 func (e *Endpoints) PKIOperation(ctx context.Context, msg []byte) ([]byte, error) {
-	var ee endpoint.Endpoint
+	var ee Endpoint
 	if e.Supports("POSTPKIOperation") || e.Supports("SCEPStandard") {
 		ee = e.PostEndpoint
 	} else {
@@ -128,11 +202,20 @@ func (e *Endpoints) PKIOperation(ctx context.Context, msg []byte) ([]byte, error
 		return nil, err
 	}
 	resp := response.(SCEPResponse)
-	return resp.Data, resp.Err
+	return trimTrailingData(resp.Data), resp.Err
+}
+
+// trimTrailingData drops bytes appended to a DER response by some
+// servers. See scep.TrimTrailingData.
+func trimTrailingData(data []byte) []byte {
+	if len(data) == 0 {
+		return data
+	}
+	return scep.TrimTrailingData(data)
 }
 
 func (e *Endpoints) GetNextCACert(ctx context.Context) ([]byte, error) {
-	var request SCEPRequest
+	request := SCEPRequest{Operation: getNextCACert}
 	response, err := e.GetEndpoint(ctx, request)
 	if err != nil {
 		return nil, err
@@ -162,35 +245,48 @@ func EncodeSCEPRequest(ctx context.Context, r *http.Request, request interface{}
 		u.RawQuery = params.Encode()
 		rr, err := http.NewRequest("POST", u.String(), body)
 		if err != nil {
-			// return errors.Wrapf(err, "creating new POST request for %s", req.Operation)
-			log.Fatal(" creating new POST request for %s", req.Operation)
+			return fmt.Errorf("creating new POST request for %s: %w", req.Operation, err)
 		}
 		*r = *rr
 		return nil
 	default:
-		return fmt.Errorf("scep: %s method not supported", r.Method)
+		return fmt.Errorf("%s method: %w", r.Method, ErrNotSupported)
 	}
 }
 
 // DecodeSCEPResponse decodes a SCEP response
 func DecodeSCEPResponse(ctx context.Context, r *http.Response) (interface{}, error) {
-	if r.StatusCode != http.StatusOK && r.StatusCode >= 400 {
-		body, _ := ioutil.ReadAll(io.LimitReader(r.Body, 4096))
-		return nil, fmt.Errorf("http request failed with status %s, msg: %s",
-			r.Status,
-			string(body),
-		)
+	defer r.Body.Close()
+	resp, err := decodeSCEPResponseHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	data, err := readLimited(r.Body, maxPayloadSize)
+	if errors.Is(err, io.ErrUnexpectedEOF) && len(data) > 0 {
+		// the server closed the connection before sending as many
+		// bytes as its Content-Length claimed. Let the decoding of
+		// the payload decide whether it is complete.
+		err = nil
 	}
-	data, err := ioutil.ReadAll(io.LimitReader(r.Body, maxPayloadSize))
 	if err != nil {
 		return nil, err
 	}
-	defer r.Body.Close()
+	resp.Data = data
+	return resp, nil
+}
+
+// decodeSCEPResponseHeader checks the status of a SCEP response
+// and decodes the fields which do not depend on the body.
+func decodeSCEPResponseHeader(r *http.Response) (SCEPResponse, error) {
+	if r.StatusCode != http.StatusOK && r.StatusCode >= 400 {
+		return SCEPResponse{}, newHTTPError(r)
+	}
 	resp := SCEPResponse{
-		Data: data,
+		StatusCode: r.StatusCode,
 	}
-	header := r.Header.Get("Content-Type")
-	if header == certChainHeader {
+	// tolerate parameters such as a charset, which some CAs add
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == certChainHeader {
 		// we only set it to two to indicate a cert chain.
 		// the actual number of certs will be in the payload.
 		resp.CACertNum = 2
@@ -202,7 +298,11 @@ func DecodeSCEPResponse(ctx context.Context, r *http.Response) (interface{}, err
 func encodeSCEPResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
 	resp := response.(SCEPResponse)
 	if resp.Err != nil {
-		http.Error(w, resp.Err.Error(), http.StatusInternalServerError)
+		status := http.StatusInternalServerError
+		if errors.Is(resp.Err, ErrNotSupported) {
+			status = http.StatusNotImplemented
+		}
+		http.Error(w, resp.Err.Error(), status)
 		return nil
 	}
 	w.Header().Set("Content-Type", contentHeader(resp.operation, resp.CACertNum))
@@ -219,6 +319,8 @@ func contentHeader(op string, certNum int) string {
 		return leafHeader
 	case "PKIOperation":
 		return pkiOpHeader
+	case "GetNextCACert":
+		return nextCAHeader
 	default:
 		return "text/plain"
 	}
@@ -228,42 +330,20 @@ func contentHeader(op string, certNum int) string {
 func message(r *http.Request) ([]byte, error) {
 	switch r.Method {
 	case "GET":
-		var msg string
-		q := r.URL.Query()
-		if _, ok := q["message"]; ok {
-			msg = q.Get("message")
-		}
-		return []byte(msg), nil
+		return decodeMessage(r.URL.Query().Get("message"))
 	case "POST":
-		return ioutil.ReadAll(io.LimitReader(r.Body, maxPayloadSize))
+		return readLimited(r.Body, maxPayloadSize)
 	default:
-		return nil, errors.New("method not supported")
+		return nil, fmt.Errorf("%s method: %w", r.Method, ErrNotSupported)
 	}
 }
 
+// MakeClientEndpoints creates client endpoints for the SCEP server at
+// instance, using the HTTP transport.
 func MakeClientEndpoints(instance string) (*Endpoints, error) {
-	if !strings.HasPrefix(instance, "http") {
-		instance = "http://" + instance
-	}
-	tgt, err := url.Parse(instance)
+	t, err := NewHTTPTransport(instance)
 	if err != nil {
 		return nil, err
 	}
-
-	options := []httptransport.ClientOption{}
-
-	return &Endpoints{
-		GetEndpoint: httptransport.NewClient(
-			"GET",
-			tgt,
-			EncodeSCEPRequest,
-			DecodeSCEPResponse,
-			options...).Endpoint(),
-		PostEndpoint: httptransport.NewClient(
-			"POST",
-			tgt,
-			EncodeSCEPRequest,
-			DecodeSCEPResponse,
-			options...).Endpoint(),
-	}, nil
+	return MakeTransportEndpoints(t), nil
 }
@@ -0,0 +1,377 @@
+package scepserver
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"scepclient/scep"
+)
+
+func TestDecodeSCEPResponseHTTPError(t *testing.T) {
+	resp := &http.Response{
+		StatusCode: http.StatusForbidden,
+		Status:     "403 Forbidden",
+		Body:       ioutil.NopCloser(bytes.NewBufferString("challenge required")),
+	}
+	_, err := DecodeSCEPResponse(context.Background(), resp)
+	var httpErr *HTTPError
+	if !errors.As(err, &httpErr) {
+		t.Fatalf("expected *HTTPError, got %v", err)
+	}
+	if httpErr.StatusCode != http.StatusForbidden {
+		t.Errorf("expected status %d, got %d", http.StatusForbidden, httpErr.StatusCode)
+	}
+	if string(httpErr.Body) != "challenge required" {
+		t.Errorf("unexpected body %q", httpErr.Body)
+	}
+}
+
+func TestDecodeSCEPResponsePayloadTooLarge(t *testing.T) {
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(bytes.NewReader(make([]byte, maxPayloadSize+1))),
+	}
+	_, err := DecodeSCEPResponse(context.Background(), resp)
+	if !errors.Is(err, ErrPayloadTooLarge) {
+		t.Fatalf("expected ErrPayloadTooLarge, got %v", err)
+	}
+}
+
+func TestDecodeSCEPResponseClosesBody(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   []byte
+	}{
+		{"HTTP error", http.StatusForbidden, []byte("challenge required")},
+		{"payload too large", http.StatusOK, make([]byte, maxPayloadSize+1)},
+		{"success", http.StatusOK, []byte("certificate")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := &closeRecorder{Reader: bytes.NewReader(tt.body)}
+			resp := &http.Response{StatusCode: tt.status, Status: http.StatusText(tt.status), Body: body}
+			DecodeSCEPResponse(context.Background(), resp)
+			if !body.closed {
+				t.Error("body not closed")
+			}
+		})
+	}
+}
+
+func TestEncodeSCEPRequestMethodNotSupported(t *testing.T) {
+	r := &http.Request{Method: "PUT", URL: &url.URL{Path: "/scep"}}
+	err := EncodeSCEPRequest(context.Background(), r, SCEPRequest{Operation: getCACert})
+	if !errors.Is(err, ErrNotSupported) {
+		t.Fatalf("expected ErrNotSupported, got %v", err)
+	}
+}
+
+func TestSupportsConcurrent(t *testing.T) {
+	var fetches int32
+	e := &Endpoints{
+		GetEndpoint: func(ctx context.Context, request interface{}) (interface{}, error) {
+			atomic.AddInt32(&fetches, 1)
+			time.Sleep(10 * time.Millisecond)
+			return SCEPResponse{Data: []byte("POSTPKIOperation\nSHA-256\n")}, nil
+		},
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if !e.Supports("SHA-256") {
+				t.Error("expected SHA-256 to be supported")
+			}
+			if e.Supports("AES") {
+				t.Error("expected AES to be unsupported")
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Errorf("expected exactly one GetCACaps request, got %d", n)
+	}
+}
+
+func TestSupportsRetriesFailedFetch(t *testing.T) {
+	var fetches int32
+	e := &Endpoints{
+		GetEndpoint: func(ctx context.Context, request interface{}) (interface{}, error) {
+			if atomic.AddInt32(&fetches, 1) == 1 {
+				return nil, errors.New("connection refused")
+			}
+			return SCEPResponse{Data: []byte("SHA-256")}, nil
+		},
+	}
+	if e.Supports("SHA-256") {
+		t.Error("expected capability to be unsupported after failed fetch")
+	}
+	if !e.Supports("SHA-256") {
+		t.Error("expected capability to be supported after successful fetch")
+	}
+	e.Supports("SHA-256")
+	if n := atomic.LoadInt32(&fetches); n != 2 {
+		t.Errorf("expected two GetCACaps requests, got %d", n)
+	}
+}
+
+func TestCheckContentType(t *testing.T) {
+	tests := []struct {
+		op          string
+		contentType string
+		ok          bool
+	}{
+		{getCACaps, "text/plain", true},
+		{getCACaps, "text/plain; charset=utf-8", true},
+		{getCACert, leafHeader, true},
+		{getCACert, certChainHeader, true},
+		{getCACert, pkiOpHeader, false},
+		{pkiOperation, pkiOpHeader, true},
+		{pkiOperation, "text/html; charset=utf-8", false},
+		{pkiOperation, "", false},
+		{getNextCACert, nextCAHeader, true},
+	}
+	for _, tt := range tests {
+		err := CheckContentType(tt.op, tt.contentType)
+		var ctErr *ContentTypeError
+		if tt.ok != (err == nil) || (err != nil && !errors.As(err, &ctErr)) {
+			t.Errorf("%s with %q: unexpected error %v", tt.op, tt.contentType, err)
+		}
+	}
+}
+
+// rawServer answers every request with the raw HTTP response
+// built by respond, then closes the connection.
+func rawServer(t *testing.T, respond func() []byte) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			if _, err := http.ReadRequest(bufio.NewReader(conn)); err == nil {
+				conn.Write(respond())
+			}
+			conn.Close()
+		}
+	}()
+	return "http://" + ln.Addr().String()
+}
+
+func TestDecodeNoncompliantFraming(t *testing.T) {
+	der := selfSignedCertificate(t)
+	chunked := func(data []byte) []byte {
+		var buf bytes.Buffer
+		for len(data) > 0 {
+			n := len(data)
+			if n > 100 {
+				n = 100
+			}
+			fmt.Fprintf(&buf, "%x\r\n%s\r\n", n, data[:n])
+			data = data[n:]
+		}
+		buf.WriteString("0\r\n\r\n")
+		return buf.Bytes()
+	}
+
+	tests := []struct {
+		name     string
+		response []byte
+	}{
+		{
+			// the body ends when the connection is closed
+			name:     "no Content-Length",
+			response: append([]byte("HTTP/1.1 200 OK\r\nContent-Type: application/x-x509-ca-cert\r\nConnection: close\r\n\r\n"), der...),
+		},
+		{
+			name:     "chunked",
+			response: append([]byte("HTTP/1.1 200 OK\r\nContent-Type: application/x-x509-ca-cert\r\nTransfer-Encoding: chunked\r\n\r\n"), chunked(der)...),
+		},
+		{
+			name:     "Content-Length too large",
+			response: append([]byte(fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Type: application/x-x509-ca-cert\r\nContent-Length: %d\r\n\r\n", len(der)+2)), der...),
+		},
+		{
+			name: "trailing garbage",
+			response: append(
+				[]byte(fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Type: application/x-x509-ca-cert\r\nContent-Length: %d\r\n\r\n", len(der)+17)),
+				append(append([]byte{}, der...), "\r\n<html></html>\r\n"...)...,
+			),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			url := rawServer(t, func() []byte { return tt.response })
+			endpoints, err := MakeClientEndpoints(url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, _, err := endpoints.GetCACert(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, der) {
+				t.Errorf("expected the %d byte certificate, got %d bytes", len(der), len(data))
+			}
+		})
+	}
+}
+
+func TestDecodeServerResponses(t *testing.T) {
+	tests := []struct {
+		file  string
+		certs int
+	}{
+		{"ndes-getcacert.http", 3},
+		{"ejbca-getcacert.http", 1},
+		{"ejbca-pkioperation.http", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			response, err := ioutil.ReadFile(filepath.Join("testdata", tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			endpoints, err := MakeClientEndpoints(rawServer(t, func() []byte { return response }))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.certs == 0 {
+				data, err := endpoints.PKIOperation(context.Background(), []byte("pkcsreq"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				msg, err := scep.ParsePKIMessage(data)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if msg.MessageType != scep.CertRep {
+					t.Errorf("expected a CertRep, got %s", msg.MessageType)
+				}
+				return
+			}
+			data, num, err := endpoints.GetCACert(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			certs := 1
+			if num > 1 {
+				certs = 0
+				err = scep.ReadCACerts(bytes.NewReader(data), func(*x509.Certificate) error {
+					certs++
+					return nil
+				})
+			} else {
+				_, err = x509.ParseCertificate(data)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if certs != tt.certs {
+				t.Errorf("expected %d certificates, got %d", tt.certs, certs)
+			}
+		})
+	}
+}
+
+func selfSignedCertificate(t testing.TB) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "SCEP CA"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func TestExpandServerURL(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"http://ca.example.com", "http://ca.example.com/cgi-bin/pkiclient.exe"},
+		{"http://ca.example.com/", "http://ca.example.com/cgi-bin/pkiclient.exe"},
+		{"https://ndes.example.com/certsrv/mscep/", "https://ndes.example.com/certsrv/mscep/mscep.dll"},
+		{"https://ndes.example.com/CertSrv/mscep", "https://ndes.example.com/CertSrv/mscep/mscep.dll"},
+		{"https://ndes.example.com/certsrv/mscep/mscep.dll", "https://ndes.example.com/certsrv/mscep/mscep.dll"},
+		{"http://ca.example.com/ejbca/publicweb/apply/scep/pkiclient.exe", "http://ca.example.com/ejbca/publicweb/apply/scep/pkiclient.exe"},
+		{"http://ca.example.com/scep", "http://ca.example.com/scep"},
+	}
+	for _, tt := range tests {
+		u, err := ParseServerURL(tt.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := ExpandServerURL(u).String(); got != tt.want {
+			t.Errorf("ExpandServerURL(%s) = %s, expected %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func FuzzDecodeSCEPResponse(f *testing.F) {
+	cert := selfSignedCertificate(f)
+	f.Add(http.StatusOK, "application/x-x509-ca-cert", "", cert)
+	f.Add(http.StatusOK, "application/x-x509-ca-ra-cert; charset=binary", "identity", append(cert, "\r\n"...))
+	f.Add(http.StatusOK, "application/x-pki-message", "gzip", []byte{0x1f, 0x8b, 0x08, 0x00})
+	f.Add(http.StatusServiceUnavailable, "text/html", "deflate", []byte("<html><title>Service Unavailable</title></html>"))
+
+	f.Fuzz(func(t *testing.T, status int, contentType, contentEncoding string, body []byte) {
+		resp := &http.Response{
+			StatusCode: status,
+			Header: http.Header{
+				"Content-Type":     []string{contentType},
+				"Content-Encoding": []string{contentEncoding},
+			},
+			Body: ioutil.NopCloser(bytes.NewReader(body)),
+		}
+		if err := decodeContentEncoding(resp); err != nil {
+			return
+		}
+		response, err := DecodeSCEPResponse(context.Background(), resp)
+		if err != nil {
+			_ = err.Error()
+			return
+		}
+		data := response.(SCEPResponse).Data
+		if len(data) > maxPayloadSize {
+			t.Fatalf("decoded %d bytes, more than the maximum payload size", len(data))
+		}
+		if trimmed := trimTrailingData(data); len(trimmed) > len(data) {
+			t.Fatalf("trimming grew %d bytes to %d", len(data), len(trimmed))
+		}
+	})
+}
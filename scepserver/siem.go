@@ -0,0 +1,225 @@
+package scepserver
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// auditNames and auditSeverities describe the outcomes of audit events
+// to SIEMs, with the severities of CEF, from 0 to 10.
+var (
+	auditNames = map[AuditOutcome]string{
+		AuditIssued:  "Certificate issued",
+		AuditDenied:  "Certificate request denied",
+		AuditPending: "Certificate request pending",
+		AuditFailed:  "Certificate request failed",
+		AuditRevoked: "Certificate revoked",
+	}
+	auditSeverities = map[AuditOutcome]int{
+		AuditIssued:  3,
+		AuditPending: 3,
+		AuditRevoked: 5,
+		AuditDenied:  6,
+		AuditFailed:  7,
+	}
+)
+
+// NewCEFAuditor writes audit events to w in the Common Event Format of
+// ArcSight, one line each, with the device product scepclient of the
+// given version. Write them to syslog with NewSyslogWriter.
+func NewCEFAuditor(w io.Writer, version string) Auditor {
+	return &siemAuditor{w: w, format: func(ev *AuditEvent) string {
+		header := strings.NewReplacer(`\`, `\\`, "|", `\|`)
+		value := strings.NewReplacer(`\`, `\\`, "=", `\=`, "\r", `\r`, "\n", `\n`)
+		var ext []string
+		add := func(key, v string) {
+			if v != "" {
+				ext = append(ext, key+"="+value.Replace(v))
+			}
+		}
+		add("rt", strconv.FormatInt(ev.Time.UnixMilli(), 10))
+		add("act", string(ev.Outcome))
+		add("externalId", ev.TransactionID)
+		add("src", requesterHost(ev.Requester))
+		add("suser", ev.Signer)
+		add("duser", ev.Subject)
+		add("reason", ev.Reason)
+		for i, cs := range [][2]string{
+			{"messageType", ev.MessageType},
+			{"serial", ev.Serial},
+			{"failInfo", ev.FailInfo},
+			{"key", ev.Key},
+			{"dnsNames", strings.Join(ev.DNSNames, ",")},
+			{"renewal", boolString(ev.Renewal)},
+		} {
+			if cs[1] != "" {
+				n := strconv.Itoa(i + 1)
+				add("cs"+n+"Label", cs[0])
+				add("cs"+n, cs[1])
+			}
+		}
+		return fmt.Sprintf("CEF:0|scepclient|scepclient|%s|%s|%s|%d|%s",
+			header.Replace(version), header.Replace(string(ev.Outcome)),
+			header.Replace(auditNames[ev.Outcome]), auditSeverities[ev.Outcome],
+			strings.Join(ext, " "))
+	}}
+}
+
+// NewLEEFAuditor writes audit events to w in the Log Event Extended
+// Format of QRadar, version 1.0, one line each, with the product
+// scepclient of the given version.
+func NewLEEFAuditor(w io.Writer, version string) Auditor {
+	return &siemAuditor{w: w, format: func(ev *AuditEvent) string {
+		header := strings.NewReplacer("|", " ", "\t", " ", "\r", " ", "\n", " ")
+		value := strings.NewReplacer("\t", " ", "\r", " ", "\n", " ")
+		attrs := []string{
+			"devTime=" + ev.Time.UTC().Format("Jan 02 2006 15:04:05.000 MST"),
+			"devTimeFormat=MMM dd yyyy HH:mm:ss.SSS z",
+			"cat=" + string(ev.Outcome),
+			"sev=" + strconv.Itoa(auditSeverities[ev.Outcome]),
+		}
+		for _, attr := range [][2]string{
+			{"src", requesterHost(ev.Requester)},
+			{"usrName", ev.Signer},
+			{"identSrc", ev.Subject},
+			{"transactionId", ev.TransactionID},
+			{"messageType", ev.MessageType},
+			{"serial", ev.Serial},
+			{"failInfo", ev.FailInfo},
+			{"reason", ev.Reason},
+			{"key", ev.Key},
+			{"dnsNames", strings.Join(ev.DNSNames, ",")},
+			{"renewal", boolString(ev.Renewal)},
+		} {
+			if attr[1] != "" {
+				attrs = append(attrs, attr[0]+"="+value.Replace(attr[1]))
+			}
+		}
+		return fmt.Sprintf("LEEF:1.0|scepclient|scepclient|%s|%s|%s",
+			header.Replace(version), header.Replace(string(ev.Outcome)), strings.Join(attrs, "\t"))
+	}}
+}
+
+// requesterHost returns the address of the requester without its port.
+func requesterHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+func boolString(b bool) string {
+	if b {
+		return "true"
+	}
+	return ""
+}
+
+type siemAuditor struct {
+	format func(ev *AuditEvent) string
+
+	mtx sync.Mutex
+	w   io.Writer
+}
+
+func (a *siemAuditor) Audit(ctx context.Context, ev *AuditEvent) error {
+	line := a.format(ev) + "\n"
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	_, err := io.WriteString(a.w, line)
+	return err
+}
+
+// syslogSockets are the sockets of the local syslog daemon.
+var syslogSockets = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+// NewSyslogWriter returns a writer sending every write as a message of
+// the security facility, authpriv, to the syslog daemon at addr, in the
+// format of RFC 5424 with the application name tag. The network is udp,
+// tcp, where messages end with a newline, or unix, and the local daemon
+// is used if addr is empty. Failed writes reconnect once.
+func NewSyslogWriter(network, addr, tag string) (io.WriteCloser, error) {
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "-"
+	}
+	w := &syslogWriter{network: network, addr: addr, tag: tag, hostname: hostname}
+	if err := w.connect(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+type syslogWriter struct {
+	network, addr string
+	tag, hostname string
+	mtx           sync.Mutex
+	conn          net.Conn
+}
+
+func (w *syslogWriter) connect() error {
+	if w.conn != nil {
+		w.conn.Close()
+		w.conn = nil
+	}
+	if w.addr != "" {
+		conn, err := net.Dial(w.network, w.addr)
+		if err != nil {
+			return err
+		}
+		w.conn = conn
+		return nil
+	}
+	var err error
+	for _, path := range syslogSockets {
+		for _, network := range []string{"unixgram", "unix"} {
+			var conn net.Conn
+			if conn, err = net.Dial(network, path); err == nil {
+				w.network, w.conn = network, conn
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("connecting to the local syslog daemon: %w", err)
+}
+
+// Write sends p, without its trailing newline, as one message.
+func (w *syslogWriter) Write(p []byte) (int, error) {
+	// authpriv (10) with the severity info (6)
+	msg := fmt.Sprintf("<%d>1 %s %s %s %d - - %s", 10*8+6,
+		time.Now().UTC().Format(time.RFC3339Nano), w.hostname, w.tag, os.Getpid(),
+		strings.TrimRight(string(p), "\n"))
+	if w.network == "tcp" || w.network == "tcp4" || w.network == "tcp6" {
+		msg += "\n"
+	}
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if w.conn != nil {
+		if _, err := io.WriteString(w.conn, msg); err == nil {
+			return len(p), nil
+		}
+	}
+	if err := w.connect(); err != nil {
+		return 0, err
+	}
+	if _, err := io.WriteString(w.conn, msg); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *syslogWriter) Close() error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if w.conn == nil {
+		return nil
+	}
+	return w.conn.Close()
+}
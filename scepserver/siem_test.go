@@ -0,0 +1,93 @@
+package scepserver
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCEFAuditor(t *testing.T) {
+	var buf bytes.Buffer
+	auditor := NewCEFAuditor(&buf, "1.2|3")
+	ev := &AuditEvent{
+		Time:          time.Unix(1, 0),
+		Outcome:       AuditDenied,
+		TransactionID: "42",
+		MessageType:   "PKCSReq",
+		Requester:     "192.0.2.1:5000",
+		Subject:       "CN=a=b\\c",
+		FailInfo:      "badRequest (2)",
+		Reason:        "bad\nchallenge",
+	}
+	if err := auditor.Audit(context.Background(), ev); err != nil {
+		t.Fatal(err)
+	}
+	want := `CEF:0|scepclient|scepclient|1.2\|3|denied|Certificate request denied|6|rt=1000 act=denied externalId=42 src=192.0.2.1 duser=CN\=a\=b\\c reason=bad\nchallenge cs1Label=messageType cs1=PKCSReq cs3Label=failInfo cs3=badRequest (2)` + "\n"
+	if got := buf.String(); got != want {
+		t.Errorf("expected\n%s\ngot\n%s", want, got)
+	}
+}
+
+func TestLEEFAuditor(t *testing.T) {
+	var buf bytes.Buffer
+	auditor := NewLEEFAuditor(&buf, "1.2")
+	ev := &AuditEvent{
+		Time:          time.Unix(1, 0),
+		Outcome:       AuditIssued,
+		TransactionID: "42",
+		MessageType:   "RenewalReq",
+		Subject:       "CN=device",
+		Serial:        "2a",
+		Renewal:       true,
+	}
+	if err := auditor.Audit(context.Background(), ev); err != nil {
+		t.Fatal(err)
+	}
+	want := "LEEF:1.0|scepclient|scepclient|1.2|issued|" + strings.Join([]string{
+		"devTime=Jan 01 1970 00:00:01.000 UTC",
+		"devTimeFormat=MMM dd yyyy HH:mm:ss.SSS z",
+		"cat=issued",
+		"sev=3",
+		"identSrc=CN=device",
+		"transactionId=42",
+		"messageType=RenewalReq",
+		"serial=2a",
+		"renewal=true",
+	}, "\t") + "\n"
+	if got := buf.String(); got != want {
+		t.Errorf("expected\n%q\ngot\n%q", want, got)
+	}
+}
+
+func TestSyslogWriter(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	w, err := NewSyslogWriter("udp", conn.LocalAddr().String(), "scepclient")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if err := NewCEFAuditor(w, "1").Audit(context.Background(), &AuditEvent{Time: time.Unix(1, 0), Outcome: AuditIssued}); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := string(buf[:n])
+	if !strings.HasPrefix(msg, "<86>1 ") || !strings.Contains(msg, " scepclient ") {
+		t.Errorf("unexpected syslog header in %q", msg)
+	}
+	if !strings.HasSuffix(msg, " - - CEF:0|scepclient|scepclient|1|issued|Certificate issued|3|rt=1000 act=issued") {
+		t.Errorf("unexpected syslog message %q", msg)
+	}
+}
@@ -0,0 +1,103 @@
+package scepserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	"scepclient/clock"
+)
+
+// CertificatePruner is implemented by depots which can
+// delete the certificates they issued.
+type CertificatePruner interface {
+	// PruneCertificates deletes the certificates which expired before
+	// before, with their revocations, and returns how many it deleted.
+	// Expired certificates may be removed from the CRL, see RFC 5280,
+	// section 3.3.
+	PruneCertificates(before time.Time) (int, error)
+}
+
+// ChallengePruner is implemented by challenge stores
+// which can delete their expired challenge passwords.
+type ChallengePruner interface {
+	// PruneChallenges deletes the expired challenge passwords,
+	// and returns how many it deleted.
+	PruneChallenges() (int, error)
+}
+
+// SweepConfig configures Sweep and RunSweeper.
+//
+// Used challenge passwords are deleted when they are used, and the
+// Service keeps no state for pending requests, which clients resend
+// in full, so expired certificates and challenges are all a depot
+// accumulates.
+type SweepConfig struct {
+	// Certificates holds the issued certificates,
+	// which are not pruned if it is nil.
+	Certificates CertificatePruner
+
+	// CertificateRetention is how long certificates are kept after
+	// they expired, for audits and investigations.
+	CertificateRetention time.Duration
+
+	// Challenges holds the challenge passwords,
+	// which are not pruned if it is nil.
+	Challenges ChallengePruner
+
+	// Interval is the time between the sweeps of RunSweeper.
+	Interval time.Duration
+
+	// Logger logs the pruned records and failed sweeps.
+	// They are not logged if it is nil.
+	Logger *slog.Logger
+
+	// Clock tells the time of the sweeps.
+	// The system clock is used if it is nil.
+	Clock clock.Clock
+}
+
+// Sweep prunes the expired certificates and challenges of config once.
+func Sweep(config SweepConfig) error {
+	logger := config.Logger
+	if logger == nil {
+		logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	var errs []error
+	if config.Certificates != nil {
+		before := clock.Or(config.Clock).Now().Add(-config.CertificateRetention)
+		n, err := config.Certificates.PruneCertificates(before)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("prune certificates: %w", err))
+		} else if n > 0 {
+			logger.Info("pruned expired certificates", "count", n, "expired_before", before)
+		}
+	}
+	if config.Challenges != nil {
+		n, err := config.Challenges.PruneChallenges()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("prune challenges: %w", err))
+		} else if n > 0 {
+			logger.Info("pruned expired challenge passwords", "count", n)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// RunSweeper runs Sweep every config.Interval, starting immediately,
+// until ctx is done. Failed sweeps are logged and retried at the next
+// interval.
+func RunSweeper(ctx context.Context, config SweepConfig) {
+	clk := clock.Or(config.Clock)
+	for {
+		if err := Sweep(config); err != nil && config.Logger != nil {
+			config.Logger.Error("depot sweep failed", "err", err)
+		}
+		if err := clk.Sleep(ctx, config.Interval); err != nil {
+			return
+		}
+	}
+}
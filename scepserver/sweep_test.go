@@ -0,0 +1,65 @@
+package scepserver
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"scepclient/clock"
+)
+
+type pruneFunc func(before time.Time) (int, error)
+
+func (f pruneFunc) PruneCertificates(before time.Time) (int, error) { return f(before) }
+
+func TestSweep(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	store := NewChallengeStore(time.Hour, clk)
+	for i := 0; i < 2; i++ {
+		if _, err := store.CreateChallenge(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	clk.Advance(time.Hour + time.Second)
+	var pruned time.Time
+	config := SweepConfig{
+		Certificates: pruneFunc(func(before time.Time) (int, error) {
+			pruned = before
+			return 0, errors.New("depot unavailable")
+		}),
+		CertificateRetention: 24 * time.Hour,
+		Challenges:           store.(ChallengePruner),
+		Clock:                clk,
+	}
+	if err := Sweep(config); err == nil {
+		t.Error("expected the failure to prune certificates")
+	}
+	if want := clk.Now().Add(-24 * time.Hour); !pruned.Equal(want) {
+		t.Errorf("expected certificates expired before %v to be pruned, got %v", want, pruned)
+	}
+	// the challenges are pruned despite the failure
+	if n := len(store.(*memoryChallengeStore).challenges); n != 0 {
+		t.Errorf("expected the expired challenges to be pruned, %d left", n)
+	}
+}
+
+func TestRunSweeper(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var sweeps int
+	config := SweepConfig{
+		Certificates: pruneFunc(func(before time.Time) (int, error) {
+			if sweeps++; sweeps == 3 {
+				cancel()
+			}
+			return 1, nil
+		}),
+		Interval: time.Hour,
+		Clock:    clock.NewAutoFake(time.Now()),
+	}
+	RunSweeper(ctx, config)
+	if sweeps != 3 {
+		t.Errorf("expected 3 sweeps before the context was canceled, got %d", sweeps)
+	}
+}
@@ -0,0 +1,69 @@
+package scepserver
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// TimeoutMiddleware bounds the duration of each request with a deadline
+// derived from the caller's context, which still applies as a whole.
+// timeout applies to all requests, unless perOperation holds a timeout
+// for the operation, for example a longer one for PKIOperation on busy
+// CAs. A timeout of zero or less does not set a deadline.
+func TimeoutMiddleware(timeout time.Duration, perOperation map[string]time.Duration) Middleware {
+	return func(next Transport) Transport {
+		return &timeoutTransport{next: next, timeout: timeout, perOperation: perOperation}
+	}
+}
+
+type timeoutTransport struct {
+	next         Transport
+	timeout      time.Duration
+	perOperation map[string]time.Duration
+}
+
+func (t *timeoutTransport) context(ctx context.Context, op string) (context.Context, context.CancelFunc) {
+	timeout := t.timeout
+	if d, ok := t.perOperation[op]; ok {
+		timeout = d
+	}
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+func (t *timeoutTransport) SendGet(ctx context.Context, req SCEPRequest) (SCEPResponse, error) {
+	ctx, cancel := t.context(ctx, req.Operation)
+	defer cancel()
+	return t.next.SendGet(ctx, req)
+}
+
+func (t *timeoutTransport) SendPost(ctx context.Context, req SCEPRequest) (SCEPResponse, error) {
+	ctx, cancel := t.context(ctx, req.Operation)
+	defer cancel()
+	return t.next.SendPost(ctx, req)
+}
+
+// StreamGet applies the deadline to reading the body as well.
+func (t *timeoutTransport) StreamGet(ctx context.Context, req SCEPRequest) (io.ReadCloser, SCEPResponse, error) {
+	ctx, cancel := t.context(ctx, req.Operation)
+	body, resp, err := StreamGet(ctx, t.next, req)
+	if err != nil {
+		cancel()
+		return nil, resp, err
+	}
+	return &cancelReadCloser{ReadCloser: body, cancel: cancel}, resp, nil
+}
+
+// cancelReadCloser cancels the context of a request when its body is closed.
+type cancelReadCloser struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelReadCloser) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
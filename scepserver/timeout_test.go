@@ -0,0 +1,40 @@
+package scepserver
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// blockingTransport blocks until the context of a request is done.
+type blockingTransport struct{}
+
+func (blockingTransport) SendGet(ctx context.Context, req SCEPRequest) (SCEPResponse, error) {
+	<-ctx.Done()
+	return SCEPResponse{}, ctx.Err()
+}
+
+func (t blockingTransport) SendPost(ctx context.Context, req SCEPRequest) (SCEPResponse, error) {
+	return t.SendGet(ctx, req)
+}
+
+func TestTimeoutMiddleware(t *testing.T) {
+	transport := TimeoutMiddleware(time.Millisecond, map[string]time.Duration{
+		pkiOperation: 50 * time.Millisecond,
+	})(blockingTransport{})
+
+	for op, want := range map[string]time.Duration{
+		getCACaps:    time.Millisecond,
+		pkiOperation: 50 * time.Millisecond,
+	} {
+		start := time.Now()
+		_, err := transport.SendPost(context.Background(), SCEPRequest{Operation: op})
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("%s: expected context.DeadlineExceeded, got %v", op, err)
+		}
+		if elapsed := time.Since(start); elapsed < want {
+			t.Errorf("%s: timed out after %s, expected at least %s", op, elapsed, want)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package scepserver
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// NewServerCertificate issues a TLS server certificate for hosts,
+// which are DNS names or IP addresses, with a new ECDSA key. It is
+// signed by the CA certificate ca with key, and valid for validity,
+// but not beyond ca.
+// The returned certificate includes ca, so that clients trusting the
+// root of ca can verify it.
+func NewServerCertificate(ca *x509.Certificate, key crypto.Signer, hosts []string, validity time.Duration) (*tls.Certificate, error) {
+	if len(hosts) == 0 {
+		return nil, errors.New("scep: server certificate needs a host name")
+	}
+	serverKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	notAfter := now.Add(validity)
+	if notAfter.After(ca.NotAfter) {
+		notAfter = ca.NotAfter
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: hosts[0]},
+		NotBefore:    now.Add(-10 * time.Minute),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, serverKey.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{der, ca.Raw},
+		PrivateKey:  serverKey,
+		Leaf:        leaf,
+	}, nil
+}
+
+// CertificateReloader serves the TLS certificate of a certificate and
+// a key file in PEM format, and reloads them when they change, so that
+// a renewed server certificate is used without a restart. Use its
+// GetCertificate method in a tls.Config.
+type CertificateReloader struct {
+	certFile, keyFile string
+	logger            *slog.Logger
+
+	// checkInterval is the minimum time between
+	// checks of the modification times of the files.
+	checkInterval time.Duration
+
+	mtx     sync.Mutex
+	cert    *tls.Certificate
+	loaded  time.Time // modification time of the loaded files
+	checked time.Time
+}
+
+// NewCertificateReloader loads the certificate of certFile and keyFile.
+// Reload failures are logged with logger, if it is not nil, and the
+// previous certificate is served until the files are fixed.
+func NewCertificateReloader(certFile, keyFile string, logger *slog.Logger) (*CertificateReloader, error) {
+	if logger == nil {
+		logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	r := &CertificateReloader{
+		certFile:      certFile,
+		keyFile:       keyFile,
+		logger:        logger,
+		checkInterval: 5 * time.Second,
+	}
+	modTime, err := r.modTime()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.load(modTime); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate returns the current certificate,
+// reloading it first if the files changed.
+func (r *CertificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if now := time.Now(); now.Sub(r.checked) >= r.checkInterval {
+		r.checked = now
+		modTime, err := r.modTime()
+		if err != nil {
+			r.logger.Error("failed to check the TLS certificate files", "err", err)
+		} else if !modTime.Equal(r.loaded) {
+			if err := r.load(modTime); err != nil {
+				r.logger.Error("failed to reload the TLS certificate", "cert", r.certFile, "err", err)
+			} else {
+				r.logger.Info("reloaded the TLS certificate", "cert", r.certFile)
+			}
+		}
+	}
+	return r.cert, nil
+}
+
+// Reload reloads the files, even if they did not change, and keeps
+// the previous certificate if they can't be loaded.
+func (r *CertificateReloader) Reload() error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	modTime, err := r.modTime()
+	if err != nil {
+		return err
+	}
+	return r.load(modTime)
+}
+
+// load loads the files, which were last modified at modTime.
+func (r *CertificateReloader) load(modTime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.cert, r.loaded = &cert, modTime
+	return nil
+}
+
+// modTime returns the latest modification time of the files.
+func (r *CertificateReloader) modTime() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
@@ -0,0 +1,144 @@
+package scepserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testTLSCA(t *testing.T) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ca, key
+}
+
+func TestNewServerCertificate(t *testing.T) {
+	ca, key := testTLSCA(t)
+	cert, err := NewServerCertificate(ca, key, []string{"scep.example.com", "127.0.0.1"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	for _, host := range []string{"scep.example.com", "127.0.0.1"} {
+		_, err := cert.Leaf.Verify(x509.VerifyOptions{
+			DNSName:   host,
+			Roots:     roots,
+			KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		})
+		if err != nil {
+			t.Errorf("verify for %s: %v", host, err)
+		}
+	}
+	if len(cert.Certificate) != 2 {
+		t.Errorf("expected the CA certificate in the chain, got %d certificates", len(cert.Certificate))
+	}
+}
+
+func TestCertificateReloader(t *testing.T) {
+	ca, key := testTLSCA(t)
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.pem"), filepath.Join(dir, "tls.key")
+	write := func(host string, modTime time.Time) {
+		cert, err := NewServerCertificate(ca, key, []string{host}, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyDER, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+		keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+		for name, data := range map[string][]byte{certFile: certPEM, keyFile: keyPEM} {
+			if err := ioutil.WriteFile(name, data, 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(name, modTime, modTime); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	host := func(r *CertificateReloader) string {
+		cert, err := r.GetCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf.Subject.CommonName
+	}
+
+	now := time.Now()
+	write("old.example.com", now.Add(-time.Hour))
+	r, err := NewCertificateReloader(certFile, keyFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.checkInterval = 0
+	if got := host(r); got != "old.example.com" {
+		t.Errorf("expected the old certificate, got %s", got)
+	}
+
+	write("new.example.com", now)
+	if got := host(r); got != "new.example.com" {
+		t.Errorf("expected the reloaded certificate, got %s", got)
+	}
+
+	// a broken file keeps the previous certificate
+	if err := ioutil.WriteFile(keyFile, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(keyFile, now.Add(time.Hour), now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if got := host(r); got != "new.example.com" {
+		t.Errorf("expected the previous certificate, got %s", got)
+	}
+	if err := r.Reload(); err == nil {
+		t.Error("expected reloading the broken file to fail")
+	}
+	if got := host(r); got != "new.example.com" {
+		t.Errorf("expected the previous certificate after a failed reload, got %s", got)
+	}
+
+	// Reload reloads unchanged modification times
+	write("forced.example.com", now.Add(time.Hour))
+	r.checkInterval = time.Hour
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := host(r); got != "forced.example.com" {
+		t.Errorf("expected the reloaded certificate, got %s", got)
+	}
+}
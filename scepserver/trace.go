@@ -0,0 +1,149 @@
+package scepserver
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// TraceInfo describes the connection used by one HTTP request, to
+// diagnose slow enrollments. Durations are zero for phases which did
+// not happen, such as DNS lookups on a reused connection.
+type TraceInfo struct {
+	Operation string
+
+	// Reused is true if the request was sent on an existing connection.
+	Reused bool
+
+	DNSLookup    time.Duration
+	Connect      time.Duration
+	TLSHandshake time.Duration
+
+	// FirstByte is the time from the start of the request
+	// to the first byte of the response.
+	FirstByte time.Duration
+}
+
+// WithTrace calls observe with the TraceInfo of every request, after the
+// response headers were received or the request failed. ConnStats.Observe
+// and metrics.Metrics.ObserveTrace are suitable observers.
+func WithTrace(observe func(TraceInfo)) HTTPOption {
+	return func(t *httpTransport) {
+		t.traceObservers = append(t.traceObservers, observe)
+	}
+}
+
+// requestTrace records the TraceInfo of a request.
+type requestTrace struct {
+	mtx   sync.Mutex
+	info  TraceInfo
+	start time.Time
+
+	dnsStart, connectStart, tlsStart time.Time
+}
+
+func newRequestTrace(ctx context.Context, op string) (context.Context, *requestTrace) {
+	rt := &requestTrace{info: TraceInfo{Operation: op}, start: time.Now()}
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			rt.mtx.Lock()
+			rt.info.Reused = info.Reused
+			rt.mtx.Unlock()
+		},
+		DNSStart: func(httptrace.DNSStartInfo) {
+			rt.mtx.Lock()
+			rt.dnsStart = time.Now()
+			rt.mtx.Unlock()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			rt.mtx.Lock()
+			rt.info.DNSLookup = time.Since(rt.dnsStart)
+			rt.mtx.Unlock()
+		},
+		ConnectStart: func(network, addr string) {
+			rt.mtx.Lock()
+			rt.connectStart = time.Now()
+			rt.mtx.Unlock()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			rt.mtx.Lock()
+			rt.info.Connect = time.Since(rt.connectStart)
+			rt.mtx.Unlock()
+		},
+		TLSHandshakeStart: func() {
+			rt.mtx.Lock()
+			rt.tlsStart = time.Now()
+			rt.mtx.Unlock()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			rt.mtx.Lock()
+			rt.info.TLSHandshake = time.Since(rt.tlsStart)
+			rt.mtx.Unlock()
+		},
+		GotFirstResponseByte: func() {
+			rt.mtx.Lock()
+			rt.info.FirstByte = time.Since(rt.start)
+			rt.mtx.Unlock()
+		},
+	})
+	return ctx, rt
+}
+
+func (rt *requestTrace) done(observers []func(TraceInfo)) {
+	rt.mtx.Lock()
+	info := rt.info
+	rt.mtx.Unlock()
+	for _, observe := range observers {
+		observe(info)
+	}
+}
+
+// ConnStats aggregates the TraceInfo of requests.
+// It is safe for concurrent use.
+type ConnStats struct {
+	mtx   sync.Mutex
+	stats ConnStatsSnapshot
+}
+
+// ConnStatsSnapshot holds the statistics collected by ConnStats.
+type ConnStatsSnapshot struct {
+	Requests      int
+	ReusedConns   int
+	NewConns      int
+	DNSLookups    int
+	TLSHandshakes int
+
+	DNSLookupTime    time.Duration
+	ConnectTime      time.Duration
+	TLSHandshakeTime time.Duration
+}
+
+// Observe adds the TraceInfo of a request to the statistics.
+func (s *ConnStats) Observe(info TraceInfo) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.stats.Requests++
+	if info.Reused {
+		s.stats.ReusedConns++
+	} else {
+		s.stats.NewConns++
+	}
+	if info.DNSLookup > 0 {
+		s.stats.DNSLookups++
+		s.stats.DNSLookupTime += info.DNSLookup
+	}
+	s.stats.ConnectTime += info.Connect
+	if info.TLSHandshake > 0 {
+		s.stats.TLSHandshakes++
+		s.stats.TLSHandshakeTime += info.TLSHandshake
+	}
+}
+
+// Snapshot returns the current statistics.
+func (s *ConnStats) Snapshot() ConnStatsSnapshot {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.stats
+}
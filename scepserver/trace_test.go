@@ -0,0 +1,31 @@
+package scepserver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestConnStats(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("POSTPKIOperation"))
+	}))
+	defer srv.Close()
+
+	var stats ConnStats
+	transport, err := NewHTTPTransport(srv.URL, WithTrace(stats.Observe))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := transport.SendGet(context.Background(), SCEPRequest{Operation: getCACaps}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	snapshot := stats.Snapshot()
+	if snapshot.Requests != 3 || snapshot.NewConns != 1 || snapshot.ReusedConns != 2 {
+		t.Errorf("expected 1 new and 2 reused connections, got %+v", snapshot)
+	}
+}
@@ -0,0 +1,144 @@
+// Package tracing creates OpenTelemetry spans for SCEP operations
+// and propagates the trace context to the SCEP server.
+package tracing
+
+import (
+	"context"
+	"io"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	"scepclient/scep"
+	"scepclient/scepserver"
+)
+
+const instrumentationName = "scepclient/scepserver/tracing"
+
+// Span attributes of SCEP operations.
+const (
+	OperationKey     = attribute.Key("scep.operation")
+	MessageTypeKey   = attribute.Key("scep.message_type")
+	TransactionIDKey = attribute.Key("scep.transaction_id")
+	PKIStatusKey     = attribute.Key("scep.pki_status")
+	StatusCodeKey    = attribute.Key("http.response.status_code")
+)
+
+// Tracer creates the spans of a SCEP client.
+type Tracer struct {
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+}
+
+// New creates a Tracer using tp and propagator.
+// If they are nil, the global ones of the otel package are used.
+func New(tp trace.TracerProvider, propagator propagation.TextMapPropagator) *Tracer {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	if propagator == nil {
+		propagator = otel.GetTextMapPropagator()
+	}
+	return &Tracer{
+		tracer:     tp.Tracer(instrumentationName),
+		propagator: propagator,
+	}
+}
+
+// Middleware returns a transport middleware creating a span for every
+// SCEP request. PKIOperation spans carry the transaction ID of the
+// request and the pkiStatus of the response.
+func (t *Tracer) Middleware() scepserver.Middleware {
+	return func(next scepserver.Transport) scepserver.Transport {
+		return &transport{next: next, t: t}
+	}
+}
+
+// Hooks returns HTTP transport hooks which send the
+// trace context to the server in the request headers.
+func (t *Tracer) Hooks() scepserver.Hooks {
+	return scepserver.Hooks{
+		BeforeRequest: func(ctx context.Context, req scepserver.SCEPRequest, r *http.Request) error {
+			t.propagator.Inject(ctx, propagation.HeaderCarrier(r.Header))
+			return nil
+		},
+	}
+}
+
+// StartEnrollment starts the span of an enrollment, which becomes the
+// parent of the spans of its requests. The caller must end the span,
+// after adding the attributes of the final response with SetMessage.
+func (t *Tracer) StartEnrollment(ctx context.Context) (context.Context, trace.Span) {
+	return t.tracer.Start(ctx, "SCEP enrollment", trace.WithSpanKind(trace.SpanKindClient))
+}
+
+// SetMessage adds the attributes of a PKI message to span.
+func SetMessage(span trace.Span, msg *scep.PKIMessage) {
+	span.SetAttributes(
+		MessageTypeKey.String(msg.MessageType.String()),
+		TransactionIDKey.String(string(msg.TransactionID)),
+	)
+	if msg.MessageType == scep.CertRep && msg.CertRepMessage != nil {
+		span.SetAttributes(PKIStatusKey.String(msg.PKIStatus.String()))
+	}
+}
+
+type transport struct {
+	next scepserver.Transport
+	t    *Tracer
+}
+
+func (t *transport) start(ctx context.Context, req scepserver.SCEPRequest) (context.Context, trace.Span) {
+	ctx, span := t.t.tracer.Start(ctx, "SCEP "+req.Operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(OperationKey.String(req.Operation)),
+	)
+	if len(req.Message) > 0 {
+		if msg, err := scep.ParsePKIMessage(req.Message); err == nil {
+			SetMessage(span, msg)
+		}
+	}
+	return ctx, span
+}
+
+func (t *transport) end(span trace.Span, req scepserver.SCEPRequest, resp scepserver.SCEPResponse, err error) {
+	defer span.End()
+	if resp.StatusCode != 0 {
+		span.SetAttributes(StatusCodeKey.Int(resp.StatusCode))
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return
+	}
+	if req.Operation == "PKIOperation" {
+		if msg, err := scep.ParsePKIMessage(resp.Data); err == nil && msg.CertRepMessage != nil {
+			span.SetAttributes(PKIStatusKey.String(msg.PKIStatus.String()))
+		}
+	}
+}
+
+func (t *transport) SendGet(ctx context.Context, req scepserver.SCEPRequest) (scepserver.SCEPResponse, error) {
+	ctx, span := t.start(ctx, req)
+	resp, err := t.next.SendGet(ctx, req)
+	t.end(span, req, resp, err)
+	return resp, err
+}
+
+func (t *transport) SendPost(ctx context.Context, req scepserver.SCEPRequest) (scepserver.SCEPResponse, error) {
+	ctx, span := t.start(ctx, req)
+	resp, err := t.next.SendPost(ctx, req)
+	t.end(span, req, resp, err)
+	return resp, err
+}
+
+func (t *transport) StreamGet(ctx context.Context, req scepserver.SCEPRequest) (io.ReadCloser, scepserver.SCEPResponse, error) {
+	ctx, span := t.start(ctx, req)
+	body, resp, err := scepserver.StreamGet(ctx, t.next, req)
+	t.end(span, req, resp, err)
+	return body, resp, err
+}
@@ -0,0 +1,54 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"scepclient/scepserver"
+)
+
+func TestTracer(t *testing.T) {
+	var traceparent string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("Traceparent")
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("POSTPKIOperation\nSHA-256"))
+	}))
+	defer srv.Close()
+
+	recorder := tracetest.NewSpanRecorder()
+	tracer := New(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)), propagation.TraceContext{})
+	transport, err := scepserver.NewHTTPTransport(srv.URL, scepserver.WithHooks(tracer.Hooks()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport = tracer.Middleware()(transport)
+
+	ctx, enrollment := tracer.StartEnrollment(context.Background())
+	if _, err := transport.SendGet(ctx, scepserver.SCEPRequest{Operation: "GetCACaps"}); err != nil {
+		t.Fatal(err)
+	}
+	enrollment.End()
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(spans))
+	}
+	span := spans[0]
+	if span.Name() != "SCEP GetCACaps" {
+		t.Errorf("unexpected span name %q", span.Name())
+	}
+	if span.Parent().SpanID() != enrollment.SpanContext().SpanID() {
+		t.Error("expected the request span to be a child of the enrollment span")
+	}
+	want := "00-" + span.SpanContext().TraceID().String() + "-" + span.SpanContext().SpanID().String() + "-01"
+	if traceparent != want {
+		t.Errorf("expected traceparent %q, got %q", want, traceparent)
+	}
+}
@@ -0,0 +1,170 @@
+package scepserver
+
+import (
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// ErrTransactionInProgress is returned by LockTransaction while another
+// request of the transaction is being processed.
+var ErrTransactionInProgress = errors.New("scep: transaction in progress")
+
+// TransactionLocker is implemented by depots shared by several server
+// instances, so that a request which a client resends, for example
+// after a timeout, is answered with the certificate issued for its
+// first attempt by any instance, rather than with a second one.
+// Implementations must be safe for concurrent use.
+type TransactionLocker interface {
+	// LockTransaction locks the SCEP transaction id for lease, after
+	// which the lock expires, so that crashed instances don't block the
+	// transaction. It returns the certificate issued in the transaction
+	// before, if any, and fails with ErrTransactionInProgress if the
+	// transaction is locked.
+	LockTransaction(id string, lease time.Duration) (*x509.Certificate, error)
+
+	// UnlockTransaction unlocks the transaction id, and records crt
+	// as the certificate issued in it, unless crt is nil.
+	UnlockTransaction(id string, crt *x509.Certificate) error
+}
+
+const (
+	// transactionLease is how long the Service locks a transaction,
+	// which covers the approver and the Signer of slow CAs.
+	transactionLease = 5 * time.Minute
+
+	// resendWindow is how long after its issuance a certificate is
+	// sent again to requests of its transaction.
+	resendWindow = time.Hour
+
+	// awaitingTTL is how long the requests of a transaction answered
+	// with PENDING are remembered, which covers manual approvals.
+	awaitingTTL = 7 * 24 * time.Hour
+)
+
+// WithTransactionLocker locks the transaction of every SCEP enrollment
+// request with locker, usually the depot, while processing it. Requests
+// of a locked transaction are answered with PENDING, so that the client
+// resends them later, and requests of a transaction in which a
+// certificate was issued for the same key in the last hour are answered
+// with it, unless they are renewals signed with it.
+//
+// As clients usually derive the transaction ID from their key, a client
+// reusing its key for a new request within the hour gets its current
+// certificate.
+func WithTransactionLocker(locker TransactionLocker) ServiceOption {
+	return func(s *service) {
+		s.transactions = locker
+	}
+}
+
+// lockTransaction locks the transaction of req, if the service has a
+// TransactionLocker, and returns a function unlocking it with the
+// certificate issued in it, and the certificate previously issued for
+// the key of the CSR in the transaction, if any.
+func (s *service) lockTransaction(req *enrollRequest, logger *slog.Logger) (func(*x509.Certificate), *x509.Certificate, error) {
+	if s.transactions == nil || req.transactionID == "" {
+		return func(*x509.Certificate) {}, nil, nil
+	}
+	issued, err := s.transactions.LockTransaction(req.transactionID, transactionLease)
+	if err != nil {
+		return nil, nil, err
+	}
+	unlock := func(crt *x509.Certificate) {
+		if err := s.transactions.UnlockTransaction(req.transactionID, crt); err != nil {
+			logger.Error("failed to unlock the transaction", "err", err)
+		}
+	}
+	if issued != nil && !s.resent(req, issued) {
+		issued = nil
+	}
+	return unlock, issued, nil
+}
+
+// resent reports whether req resends the request of the certificate
+// issued in its transaction, rather than starting a new one.
+func (s *service) resent(req *enrollRequest, issued *x509.Certificate) bool {
+	switch {
+	case !sameKey(req.csr.PublicKey, issued.PublicKey):
+		// a transaction ID reused for another key
+		return false
+	case req.signer != nil && req.signer.Equal(issued):
+		// a renewal of the issued certificate with the same key
+		return false
+	}
+	return s.clock.Now().Sub(issued.NotBefore) <= resendWindow
+}
+
+// sameKey reports whether a and b are the same public key.
+func sameKey(a, b crypto.PublicKey) bool {
+	key, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && key.Equal(b)
+}
+
+// awaiting remembers the requests of the transactions answered with
+// PENDING, so that their one-time challenge passwords, which the first
+// request consumes, keep authorizing the requests polling them. Like
+// PendingTransactions, instances sharing a depot each remember the
+// requests they answered. The zero value is ready to use.
+type awaiting struct {
+	mtx      sync.Mutex
+	requests map[string]*awaitingRequest
+}
+
+type awaitingRequest struct {
+	req            enrollRequest
+	challengeValid bool
+	since          time.Time
+}
+
+// add remembers req, answered with PENDING at now, unless it has no
+// transaction ID. A valid challenge password of an earlier request
+// of the transaction is kept.
+func (a *awaiting) add(req *enrollRequest, challengeValid bool, now time.Time) {
+	if req.transactionID == "" {
+		return
+	}
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	for id, r := range a.requests {
+		if now.Sub(r.since) > awaitingTTL {
+			delete(a.requests, id)
+		}
+	}
+	if a.requests == nil {
+		a.requests = make(map[string]*awaitingRequest)
+	}
+	if r, ok := a.requests[req.transactionID]; ok && sameKey(r.req.csr.PublicKey, req.csr.PublicKey) {
+		challengeValid = challengeValid || r.challengeValid
+	}
+	a.requests[req.transactionID] = &awaitingRequest{req: *req, challengeValid: challengeValid, since: now}
+}
+
+// get returns the request of the transaction id remembered at most
+// awaitingTTL before now, if it is for key.
+func (a *awaiting) get(id string, key crypto.PublicKey, now time.Time) (*awaitingRequest, bool) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	r, ok := a.requests[id]
+	if !ok || now.Sub(r.since) > awaitingTTL || !sameKey(r.req.csr.PublicKey, key) {
+		return nil, false
+	}
+	return r, true
+}
+
+// authorized reports whether an earlier request of the transaction of
+// req, for the same key, carried a valid challenge password.
+func (a *awaiting) authorized(req *enrollRequest, now time.Time) bool {
+	r, ok := a.get(req.transactionID, req.csr.PublicKey, now)
+	return ok && r.challengeValid
+}
+
+// remove forgets the transaction id once it is decided.
+func (a *awaiting) remove(id string) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	delete(a.requests, id)
+}
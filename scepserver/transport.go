@@ -0,0 +1,268 @@
+package scepserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Transport carries SCEP requests to a server and returns the responses.
+//
+// HTTP is the only carrier defined by SCEP, but the client does not depend
+// on it: unix sockets, in-process test servers or store-and-forward files
+// for air-gapped CAs can be plugged in with MakeTransportEndpoints.
+//
+// Transports must be safe for concurrent use, as a single Client sends
+// the requests of parallel enrollments over the same Transport.
+type Transport interface {
+	// SendGet delivers a request using GET semantics, where the
+	// message (if any) is part of the request URL.
+	SendGet(ctx context.Context, req SCEPRequest) (SCEPResponse, error)
+
+	// SendPost delivers a request using POST semantics, where the
+	// message is sent as the request body.
+	SendPost(ctx context.Context, req SCEPRequest) (SCEPResponse, error)
+}
+
+// Streamer is implemented by transports which can return the body of a
+// GET response as a stream instead of buffering it in SCEPResponse.Data.
+type Streamer interface {
+	StreamGet(ctx context.Context, req SCEPRequest) (io.ReadCloser, SCEPResponse, error)
+}
+
+// StreamGet sends a GET request over t and returns the response body as a
+// stream. If t does not implement Streamer, the buffered response is returned.
+func StreamGet(ctx context.Context, t Transport, req SCEPRequest) (io.ReadCloser, SCEPResponse, error) {
+	if s, ok := t.(Streamer); ok {
+		return s.StreamGet(ctx, req)
+	}
+	resp, err := t.SendGet(ctx, req)
+	if err != nil {
+		return nil, resp, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(resp.Data)), resp, nil
+}
+
+// Middleware wraps a Transport to add behavior such as logging.
+// The returned Transport must be safe for concurrent use.
+type Middleware func(Transport) Transport
+
+// MakeTransportEndpoints creates client endpoints which deliver
+// all requests using the provided Transport.
+func MakeTransportEndpoints(t Transport) *Endpoints {
+	return &Endpoints{
+		GetEndpoint: func(ctx context.Context, request interface{}) (interface{}, error) {
+			return t.SendGet(ctx, request.(SCEPRequest))
+		},
+		PostEndpoint: func(ctx context.Context, request interface{}) (interface{}, error) {
+			return t.SendPost(ctx, request.(SCEPRequest))
+		},
+		stream: func(ctx context.Context, req SCEPRequest) (io.ReadCloser, SCEPResponse, error) {
+			return StreamGet(ctx, t, req)
+		},
+	}
+}
+
+// httpTransport is the default Transport, speaking the SCEP HTTP binding
+// using only net/http.
+type httpTransport struct {
+	tgt    *url.URL
+	client *http.Client
+	header http.Header
+
+	username string
+	password string
+	redirect RedirectPolicy
+
+	strictContentType bool
+	hooks             hookChain
+	requestIDHeader   string
+	traceObservers    []func(TraceInfo)
+	noCompression     bool
+	noPathRewrite     bool
+	stdBase64         bool
+
+	// base, dialer and wrappers build the http.Client,
+	// unless one was provided with WithHTTPClient.
+	base     *http.Transport
+	dialer   *dialer
+	wrappers []func(http.RoundTripper) http.RoundTripper
+}
+
+// NewHTTPTransport creates a Transport for the SCEP server at instance.
+// The http scheme is assumed if instance does not specify one, and the
+// path is completed with ExpandServerURL unless WithoutPathRewrite is
+// used, so that a bare hostname works.
+func NewHTTPTransport(instance string, opts ...HTTPOption) (Transport, error) {
+	tgt, err := ParseServerURL(instance)
+	if err != nil {
+		return nil, err
+	}
+	t := &httpTransport{
+		tgt:      tgt,
+		header:   make(http.Header),
+		base:     http.DefaultTransport.(*http.Transport).Clone(),
+		dialer:   newDialer(),
+		redirect: DefaultRedirectPolicy,
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	if !t.noPathRewrite {
+		t.tgt = ExpandServerURL(t.tgt)
+	}
+	if t.client == nil {
+		t.base.DialContext = t.dialer.DialContext
+		var rt http.RoundTripper = t.base
+		for _, wrap := range t.wrappers {
+			rt = wrap(rt)
+		}
+		t.client = &http.Client{
+			Transport:     rt,
+			CheckRedirect: t.redirect.checkRedirect,
+		}
+	}
+	return t, nil
+}
+
+// tlsConfig returns the TLS configuration of the
+// connection, creating it if needed.
+func (t *httpTransport) tlsConfig() *tls.Config {
+	if t.base.TLSClientConfig == nil {
+		t.base.TLSClientConfig = &tls.Config{}
+	}
+	return t.base.TLSClientConfig
+}
+
+// ParseServerURL parses the URL of a SCEP server.
+// The http scheme is assumed if instance does not specify one.
+func ParseServerURL(instance string) (*url.URL, error) {
+	if !strings.HasPrefix(instance, "http") {
+		instance = "http://" + instance
+	}
+	return url.Parse(instance)
+}
+
+func (t *httpTransport) SendGet(ctx context.Context, req SCEPRequest) (SCEPResponse, error) {
+	resp, err := t.do(ctx, "GET", req)
+	return resp, t.opError(ctx, req, err)
+}
+
+func (t *httpTransport) SendPost(ctx context.Context, req SCEPRequest) (SCEPResponse, error) {
+	resp, err := t.do(ctx, "POST", req)
+	return resp, t.opError(ctx, req, err)
+}
+
+// StreamGet sends a GET request and returns the response body unbuffered.
+// Reading more than the maximum payload size fails with ErrPayloadTooLarge.
+func (t *httpTransport) StreamGet(ctx context.Context, req SCEPRequest) (io.ReadCloser, SCEPResponse, error) {
+	resp, err := t.roundTrip(ctx, "GET", req)
+	if err != nil {
+		return nil, SCEPResponse{}, t.opError(ctx, req, err)
+	}
+	response, err := decodeSCEPResponseHeader(resp)
+	if err == nil {
+		err = t.checkContentType(req, resp)
+	}
+	if err != nil {
+		resp.Body.Close()
+		return nil, SCEPResponse{}, t.opError(ctx, req, err)
+	}
+	body := &limitedReadCloser{ReadCloser: resp.Body, remaining: maxPayloadSize}
+	return body, response, nil
+}
+
+func (t *httpTransport) roundTrip(ctx context.Context, method string, req SCEPRequest) (*http.Response, error) {
+	r, err := http.NewRequest(method, t.tgt.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := EncodeSCEPRequest(ctx, r, req); err != nil {
+		return nil, err
+	}
+	if t.stdBase64 && method == "GET" && len(req.Message) > 0 {
+		params := r.URL.Query()
+		params.Set("message", base64.StdEncoding.EncodeToString(req.Message))
+		r.URL.RawQuery = params.Encode()
+	}
+	if !t.noCompression {
+		r.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	for key, values := range t.header {
+		// copied, as hooks may modify the headers of concurrent requests
+		r.Header[key] = append([]string(nil), values...)
+	}
+	if t.username != "" {
+		r.SetBasicAuth(t.username, t.password)
+	}
+	if id, ok := CorrelationID(ctx); ok && t.requestIDHeader != "" {
+		r.Header.Set(t.requestIDHeader, id)
+	}
+	if len(t.traceObservers) > 0 {
+		var trace *requestTrace
+		ctx, trace = newRequestTrace(ctx, req.Operation)
+		defer trace.done(t.traceObservers)
+	}
+	r = r.WithContext(ctx)
+	if err := t.hooks.before(ctx, req, r); err != nil {
+		return nil, err
+	}
+	resp, err := t.client.Do(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := decodeContentEncoding(resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	if err := t.hooks.after(ctx, req, resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (t *httpTransport) do(ctx context.Context, method string, req SCEPRequest) (SCEPResponse, error) {
+	resp, err := t.roundTrip(ctx, method, req)
+	if err != nil {
+		return SCEPResponse{}, err
+	}
+	defer drainAndClose(resp.Body)
+	response, err := DecodeSCEPResponse(ctx, resp)
+	if err != nil {
+		return SCEPResponse{}, err
+	}
+	if err := t.checkContentType(req, resp); err != nil {
+		return SCEPResponse{}, err
+	}
+	return response.(SCEPResponse), nil
+}
+
+// opError wraps a non-nil err with the operation context of req.
+func (t *httpTransport) opError(ctx context.Context, req SCEPRequest, err error) error {
+	if err == nil {
+		return nil
+	}
+	id, _ := TransactionID(ctx)
+	return &OpError{Op: req.Operation, URL: t.tgt.Redacted(), TransactionID: id, Err: err}
+}
+
+func (t *httpTransport) checkContentType(req SCEPRequest, resp *http.Response) error {
+	if !t.strictContentType {
+		return nil
+	}
+	return CheckContentType(req.Operation, resp.Header.Get("Content-Type"))
+}
+
+// drainAndClose reads what is left of a response body before closing
+// it, which lets the connection be reused for the next request.
+func drainAndClose(body io.ReadCloser) {
+	io.Copy(ioutil.Discard, io.LimitReader(body, maxPayloadSize))
+	body.Close()
+}
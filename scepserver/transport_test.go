@@ -0,0 +1,108 @@
+package scepserver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// recordingServer returns the URL of a server recording the
+// headers of the requests it receives.
+func recordingServer(t *testing.T) (string, func() []http.Header) {
+	var (
+		mtx     sync.Mutex
+		headers []http.Header
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		headers = append(headers, r.Header.Clone())
+		mtx.Unlock()
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("POSTPKIOperation"))
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL, func() []http.Header {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return headers
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	url, headers := recordingServer(t)
+	hooks := Hooks{BeforeRequest: func(ctx context.Context, req SCEPRequest, r *http.Request) error {
+		// must not change the headers of later requests
+		r.Header.Add("X-Tenant", "hooked")
+		return nil
+	}}
+	transport, err := NewHTTPTransport(url,
+		WithUserAgent("fleet-agent/2.1"),
+		WithHeader("X-API-Key", "key"),
+		WithHeader("X-Tenant", "acme"),
+		WithHeader("X-Tenant", "emea"),
+		WithHooks(hooks),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := transport.SendGet(context.Background(), SCEPRequest{Operation: getCACaps}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(headers()); n != 2 {
+		t.Fatalf("expected 2 requests, got %d", n)
+	}
+	for i, h := range headers() {
+		if ua := h.Get("User-Agent"); ua != "fleet-agent/2.1" {
+			t.Errorf("request %d: expected the User-Agent, got %q", i, ua)
+		}
+		if key := h.Get("X-API-Key"); key != "key" {
+			t.Errorf("request %d: expected the X-API-Key header, got %q", i, key)
+		}
+		if want := []string{"acme", "emea", "hooked"}; !reflect.DeepEqual(h.Values("X-Tenant"), want) {
+			t.Errorf("request %d: expected X-Tenant %v, got %v", i, want, h.Values("X-Tenant"))
+		}
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	url, headers := recordingServer(t)
+	transport, err := NewHTTPTransport(url, WithBasicAuth("ra-operator", "pass:word"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if _, err := transport.SendGet(ctx, SCEPRequest{Operation: getCACaps}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := transport.SendPost(ctx, SCEPRequest{Operation: pkiOperation, Message: []byte("pkcsreq")}); err != nil {
+		t.Fatal(err)
+	}
+
+	plain, err := NewHTTPTransport(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := plain.SendGet(ctx, SCEPRequest{Operation: getCACaps}); err != nil {
+		t.Fatal(err)
+	}
+
+	recorded := headers()
+	if len(recorded) != 3 {
+		t.Fatalf("expected 3 requests, got %d", len(recorded))
+	}
+	for i, h := range recorded[:2] {
+		r := &http.Request{Header: h}
+		user, password, ok := r.BasicAuth()
+		if !ok || user != "ra-operator" || password != "pass:word" {
+			t.Errorf("request %d: expected the Basic credentials, got %q", i, h.Get("Authorization"))
+		}
+	}
+	if auth := recorded[2].Get("Authorization"); auth != "" {
+		t.Errorf("expected no Authorization header without credentials, got %q", auth)
+	}
+}
@@ -0,0 +1,97 @@
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"scepclient/scep"
+	"scepclient/scepserver"
+)
+
+// RESTConfig configures a RESTSigner.
+type RESTConfig struct {
+	// URL receives the CSRs.
+	URL string
+
+	// Token, if set, is sent as bearer token.
+	Token string
+
+	// Client sends the requests.
+	// http.DefaultClient is used if it is nil.
+	Client *http.Client
+}
+
+// RESTSigner is a scepserver.Signer posting CSRs to the REST API of a
+// CA. It sends the CSR in PEM encoding with the content type
+// application/pkcs10, and expects the certificate in the response body,
+// in PEM or DER encoding, followed by any intermediates which it
+// ignores. The CA answers 202 Accepted while a request is pending, and
+// a 4xx status with an error message if it rejects a request.
+type RESTSigner struct {
+	config RESTConfig
+}
+
+// NewRESTSigner returns a RESTSigner using config.
+func NewRESTSigner(config RESTConfig) (*RESTSigner, error) {
+	if config.URL == "" {
+		return nil, errors.New("upstream: URL is required")
+	}
+	if config.Client == nil {
+		config.Client = http.DefaultClient
+	}
+	return &RESTSigner{config: config}, nil
+}
+
+// Sign posts csr to the CA and returns the certificate it issued.
+func (s *RESTSigner) Sign(ctx context.Context, csr *x509.CertificateRequest) (*x509.Certificate, error) {
+	body := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr.Raw})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/pkcs10")
+	req.Header.Set("Accept", "application/pem-certificate-chain, application/pkix-cert")
+	if s.config.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.config.Token)
+	}
+	resp, err := s.config.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("upstream: %w", err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("upstream: %w", err)
+	}
+	switch {
+	case resp.StatusCode == http.StatusAccepted:
+		return nil, scepserver.ErrPending
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		// the CA rejected the request, tell the client why
+		return nil, &scep.FailInfoError{MessageType: scep.PKCSReq, FailInfo: scep.BadRequest, Text: strings.TrimSpace(string(data))}
+	case resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated:
+		return nil, fmt.Errorf("upstream: sign request failed with status %s", resp.Status)
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		if block.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("upstream: response contains a %s instead of a certificate", block.Type)
+		}
+		data = block.Bytes
+	}
+	certs, err := x509.ParseCertificates(data)
+	if err != nil {
+		return nil, fmt.Errorf("upstream: parse certificate: %w", err)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("upstream: response contains no certificate")
+	}
+	return certs[0], nil
+}
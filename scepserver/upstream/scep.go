@@ -0,0 +1,114 @@
+// Package upstream forwards the certificate requests a SCEP server
+// approved to an upstream CA, turning the server into a registration
+// authority: it validates challenges and enforces policies locally,
+// and relays the certificates the upstream CA issues to its clients.
+package upstream
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"fmt"
+
+	"github.com/fullsailor/pkcs7"
+
+	scepclient "scepclient/client"
+	"scepclient/scep"
+	"scepclient/scepserver"
+)
+
+// SCEPConfig configures a SCEPSigner.
+type SCEPConfig struct {
+	// Client sends the requests to the upstream SCEP server.
+	Client scepclient.Client
+
+	// Cert and Key are the RA credentials signing the forwarded
+	// requests and decrypting the responses. As the RA cannot add its
+	// own challenge password to the CSRs of clients, the upstream
+	// server must authorize requests signed with Cert.
+	Cert *x509.Certificate
+	Key  *rsa.PrivateKey
+}
+
+// SCEPSigner is a scepserver.Signer forwarding CSRs to an upstream
+// SCEP server with PKCSReq messages.
+type SCEPSigner struct {
+	config SCEPConfig
+}
+
+// NewSCEPSigner returns a SCEPSigner using config.
+func NewSCEPSigner(config SCEPConfig) (*SCEPSigner, error) {
+	if config.Client == nil || config.Cert == nil || config.Key == nil {
+		return nil, errors.New("upstream: client, certificate and key are required")
+	}
+	return &SCEPSigner{config: config}, nil
+}
+
+// Sign forwards csr to the upstream server and returns the certificate
+// it issued. A PENDING response returns scepserver.ErrPending: the
+// transaction ID derives from the key of csr, so the upstream server
+// takes the request the client resends as a poll. A FAILURE response
+// returns a *scep.FailInfoError.
+func (s *SCEPSigner) Sign(ctx context.Context, csr *x509.CertificateRequest) (*x509.Certificate, error) {
+	recipients, err := s.recipients(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &scep.PKIMessage{
+		MessageType: scep.PKCSReq,
+		Recipients:  recipients,
+		SignerKey:   s.config.Key,
+		SignerCert:  s.config.Cert,
+	}
+	if s.config.Client.Supports("AES") || s.config.Client.Supports("SCEPStandard") {
+		tmpl.SCEPEncryptionAlgorithm = pkcs7.EncryptionAlgorithmAES128GCM
+	}
+	msg, err := scep.NewCSRRequest(csr, tmpl)
+	if err != nil {
+		return nil, fmt.Errorf("upstream: create request: %w", err)
+	}
+	ctx = scepserver.WithTransactionID(ctx, string(msg.TransactionID))
+	respData, err := s.config.Client.PKIOperation(ctx, msg.Raw)
+	if err != nil {
+		return nil, fmt.Errorf("upstream: %w", err)
+	}
+	resp, err := scep.ParsePKIMessage(respData)
+	if err != nil {
+		return nil, fmt.Errorf("upstream: parse response: %w", err)
+	}
+	switch resp.PKIStatus {
+	case scep.FAILURE:
+		return nil, &scep.FailInfoError{MessageType: scep.PKCSReq, FailInfo: resp.FailInfo, Text: resp.FailInfoText}
+	case scep.PENDING:
+		return nil, scepserver.ErrPending
+	}
+	if err := resp.DecryptPKIEnvelope(s.config.Cert, s.config.Key); err != nil {
+		return nil, fmt.Errorf("upstream: decrypt response: %w", err)
+	}
+	if resp.CertRepMessage.Certificate == nil {
+		return nil, errors.New("upstream: response contains no certificate")
+	}
+	return resp.CertRepMessage.Certificate, nil
+}
+
+// recipients returns the certificates to encrypt requests to.
+func (s *SCEPSigner) recipients(ctx context.Context) ([]*x509.Certificate, error) {
+	data, num, err := s.config.Client.GetCACert(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("upstream: %w", err)
+	}
+	var certs []*x509.Certificate
+	if num > 1 {
+		certs, err = scep.CACerts(data)
+	} else {
+		certs, err = x509.ParseCertificates(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("upstream: parse CA certificates: %w", err)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("upstream: server returned no CA certificate")
+	}
+	return scepclient.Recipients(certs), nil
+}
@@ -0,0 +1,186 @@
+package upstream
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	scepclient "scepclient/client"
+	"scepclient/scep"
+	"scepclient/scepserver"
+	"scepclient/scepserver/depot"
+	"scepclient/scepserver/depot/file"
+)
+
+func newCSR(t *testing.T, cn string) *x509.CertificateRequest {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: cn}}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return csr
+}
+
+func TestSCEPSigner(t *testing.T) {
+	upstreamDepot, err := file.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := upstreamDepot.CreateCA(nil, pkix.Name{CommonName: "upstream CA"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	caCerts, caKey, err := upstreamDepot.CA(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the upstream CA decides by common name
+	approver := scepserver.ApproverFunc(func(ctx context.Context, req *scepserver.ApprovalRequest) (scepserver.Decision, error) {
+		switch req.CSR.Subject.CommonName {
+		case "pending":
+			return scepserver.Pending, nil
+		case "denied":
+			return scepserver.Deny, nil
+		}
+		return scepserver.Allow, nil
+	})
+	svc, err := scepserver.NewService(upstreamDepot, scepserver.WithApprover(approver))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(scepserver.NewHTTPHandler(svc))
+	defer server.Close()
+	client, err := scepclient.New(server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the RA credentials are issued by the upstream CA
+	raKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(100),
+		Subject:      pkix.Name{CommonName: "RA"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+	}, caCerts[0], &raKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raCert, err := x509.ParseCertificate(raDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := NewSCEPSigner(SCEPConfig{Client: client, Cert: raCert, Key: raKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	crt, err := signer.Sign(ctx, newCSR(t, "device"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if crt.Subject.CommonName != "device" {
+		t.Errorf("expected a certificate for device, got %s", crt.Subject)
+	}
+	if err := crt.CheckSignatureFrom(caCerts[0]); err != nil {
+		t.Errorf("expected the certificate to be issued by the upstream CA: %v", err)
+	}
+
+	if _, err := signer.Sign(ctx, newCSR(t, "pending")); !errors.Is(err, scepserver.ErrPending) {
+		t.Errorf("expected ErrPending, got %v", err)
+	}
+	var failure *scep.FailInfoError
+	if _, err := signer.Sign(ctx, newCSR(t, "denied")); !errors.As(err, &failure) || failure.FailInfo != scep.BadRequest {
+		t.Errorf("expected a badRequest failure, got %v", err)
+	}
+}
+
+func TestRESTSigner(t *testing.T) {
+	caCert, caKey, err := depot.GenerateCA(pkix.Name{CommonName: "REST CA"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if ct := r.Header.Get("Content-Type"); ct != "application/pkcs10" {
+			t.Errorf("unexpected content type %q", ct)
+		}
+		data, _ := ioutil.ReadAll(r.Body)
+		block, _ := pem.Decode(data)
+		if block == nil {
+			t.Error("expected a PEM encoded CSR")
+			return
+		}
+		csr, err := x509.ParseCertificateRequest(block.Bytes)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		switch csr.Subject.CommonName {
+		case "pending":
+			w.WriteHeader(http.StatusAccepted)
+			return
+		case "denied":
+			http.Error(w, "common name not allowed", http.StatusForbidden)
+			return
+		}
+		der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+			SerialNumber: big.NewInt(42),
+			Subject:      csr.Subject,
+			NotBefore:    time.Now(),
+			NotAfter:     time.Now().Add(time.Hour),
+		}, caCert, csr.PublicKey, caKey)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+		pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: caCert.Raw})
+	}))
+	defer server.Close()
+
+	signer, err := NewRESTSigner(RESTConfig{URL: server.URL, Token: "token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	crt, err := signer.Sign(ctx, newCSR(t, "device"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := crt.CheckSignatureFrom(caCert); err != nil || crt.Subject.CommonName != "device" {
+		t.Errorf("expected a certificate for device issued by the CA, got %s: %v", crt.Subject, err)
+	}
+	if _, err := signer.Sign(ctx, newCSR(t, "pending")); !errors.Is(err, scepserver.ErrPending) {
+		t.Errorf("expected ErrPending, got %v", err)
+	}
+	var failure *scep.FailInfoError
+	if _, err := signer.Sign(ctx, newCSR(t, "denied")); !errors.As(err, &failure) || failure.Text != "common name not allowed" {
+		t.Errorf("expected the rejection to be relayed, got %v", err)
+	}
+}
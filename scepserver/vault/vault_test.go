@@ -0,0 +1,114 @@
+package vault
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"scepclient/scepserver/depot"
+)
+
+// fakeVault signs CSRs posted to /v1/pki/sign/device with a local CA.
+func fakeVault(t *testing.T) (*httptest.Server, *x509.Certificate) {
+	caCert, caKey, err := depot.GenerateCA(pkix.Name{CommonName: "vault CA"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+		if r.URL.Path != "/v1/pki/sign/device" {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[]}`))
+			return
+		}
+		var req signRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+			return
+		}
+		if req.AltNames != "device.example.com" || req.TTL != "3600s" {
+			t.Errorf("unexpected request %+v", req)
+		}
+		block, _ := pem.Decode([]byte(req.CSR))
+		csr, err := x509.ParseCertificateRequest(block.Bytes)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(42),
+			Subject:      pkix.Name{CommonName: req.CommonName},
+			DNSNames:     strings.Split(req.AltNames, ","),
+			NotBefore:    time.Now(),
+			NotAfter:     time.Now().Add(time.Hour),
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, caCert, csr.PublicKey, caKey)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		var resp signResponse
+		resp.Data.Certificate = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+		json.NewEncoder(w).Encode(resp)
+	}))
+	return server, caCert
+}
+
+func TestSigner(t *testing.T) {
+	server, caCert := fakeVault(t)
+	defer server.Close()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: "device"},
+		DNSNames: []string{"device.example.com"},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := NewSigner(Config{Address: server.URL, Token: "token", Role: "device", TTL: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	crt, err := signer.Sign(context.Background(), csr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := crt.CheckSignatureFrom(caCert); err != nil {
+		t.Error(err)
+	}
+	if crt.Subject.CommonName != "device" || crt.SerialNumber.Int64() != 42 {
+		t.Errorf("unexpected certificate %s %s", crt.Subject, crt.SerialNumber)
+	}
+
+	signer, err = NewSigner(Config{Address: server.URL, Token: "wrong", Role: "device"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = signer.Sign(context.Background(), csr)
+	if err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Errorf("expected the Vault error message, got %v", err)
+	}
+}
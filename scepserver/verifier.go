@@ -0,0 +1,169 @@
+package scepserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// CSRVerifier verifies that a certificate request is authorized,
+// usually by its challenge password. The Service of NewService asks
+// its verifiers, see WithCSRVerifier, before issuing a certificate;
+// clients may ask one before sending their request.
+// Implementations must be safe for concurrent use.
+type CSRVerifier interface {
+	// VerifyCSR returns an empty reason if csr, sent with the challenge
+	// password challenge, is authorized, or else why it is not, which
+	// the Service sends to the client as failInfoText. It fails if it
+	// can't decide.
+	VerifyCSR(ctx context.Context, csr *x509.CertificateRequest, challenge string) (reason string, err error)
+}
+
+// CSRVerifierFunc adapts a function to the CSRVerifier interface.
+type CSRVerifierFunc func(ctx context.Context, csr *x509.CertificateRequest, challenge string) (string, error)
+
+// VerifyCSR calls f.
+func (f CSRVerifierFunc) VerifyCSR(ctx context.Context, csr *x509.CertificateRequest, challenge string) (string, error) {
+	return f(ctx, csr, challenge)
+}
+
+// StaticChallenge authorizes requests with the challenge password pw,
+// shared by all clients.
+func StaticChallenge(pw string) CSRVerifier {
+	return CSRVerifierFunc(func(ctx context.Context, csr *x509.CertificateRequest, challenge string) (string, error) {
+		switch {
+		case challenge == "":
+			return "challenge password required", nil
+		case subtle.ConstantTimeCompare([]byte(challenge), []byte(pw)) != 1:
+			return "wrong challenge password", nil
+		}
+		return "", nil
+	})
+}
+
+// DynamicChallenge authorizes requests with a one-time challenge
+// password of store, which it consumes.
+func DynamicChallenge(store ChallengeStore) CSRVerifier {
+	return CSRVerifierFunc(func(ctx context.Context, csr *x509.CertificateRequest, challenge string) (string, error) {
+		if challenge == "" {
+			return "challenge password required", nil
+		}
+		ok, err := store.HasChallenge(challenge)
+		if err != nil || ok {
+			return "", err
+		}
+		// don't tell guesses from reused or expired challenges
+		return "challenge password unknown, already used or expired", nil
+	})
+}
+
+// AnyCSRVerifier authorizes the requests one of verifiers authorizes,
+// asking them in turn until one does. The reason of the last one is
+// returned for requests none authorizes.
+func AnyCSRVerifier(verifiers ...CSRVerifier) CSRVerifier {
+	return CSRVerifierFunc(func(ctx context.Context, csr *x509.CertificateRequest, challenge string) (string, error) {
+		var reason string
+		for _, v := range verifiers {
+			var err error
+			if reason, err = v.VerifyCSR(ctx, csr, challenge); err != nil || reason == "" {
+				return reason, err
+			}
+		}
+		return reason, nil
+	})
+}
+
+// CommandVerifier authorizes requests with an external command, which
+// receives the PEM encoded CSR on its standard input, and in its
+// environment the challenge password as SCEP_CHALLENGE_PASSWORD, the
+// subject of the CSR as SCEP_SUBJECT, and the requester address, see
+// WithRequester, as SCEP_REQUESTER.
+//
+// The command authorizes the request by exiting with status 0, and
+// rejects it with status 1, with the first line of its standard output
+// as reason. Other statuses fail the verification.
+type CommandVerifier struct {
+	// Path and Args are the command and its arguments.
+	Path string
+	Args []string
+
+	// Timeout bounds the run time of the command, if it is not zero.
+	Timeout time.Duration
+}
+
+// maxReason caps the length of the reasons of CommandVerifier.
+const maxReason = 256
+
+// VerifyCSR runs the command for csr.
+func (v *CommandVerifier) VerifyCSR(ctx context.Context, csr *x509.CertificateRequest, challenge string) (string, error) {
+	if v.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, v.Timeout)
+		defer cancel()
+	}
+	requester, _ := Requester(ctx)
+	cmd := exec.CommandContext(ctx, v.Path, v.Args...)
+	cmd.Stdin = bytes.NewReader(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr.Raw}))
+	cmd.Env = append(os.Environ(),
+		"SCEP_CHALLENGE_PASSWORD="+challenge,
+		"SCEP_SUBJECT="+csr.Subject.String(),
+		"SCEP_REQUESTER="+requester,
+	)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	// don't wait for children of a killed command holding its output
+	cmd.WaitDelay = time.Second
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return "", nil
+	case errors.As(err, &exitErr) && exitErr.ExitCode() == 1:
+		reason, _, _ := strings.Cut(strings.TrimSpace(stdout.String()), "\n")
+		if len(reason) > maxReason {
+			reason = reason[:maxReason]
+		}
+		if reason == "" {
+			reason = "rejected by the verification command"
+		}
+		return reason, nil
+	}
+	return "", fmt.Errorf("verification command %s: %w: %s", v.Path, err, strings.TrimSpace(stderr.String()))
+}
+
+// WithCSRVerifier also authorizes the requests verifier authorizes,
+// besides those with the password of WithChallengePassword or a
+// challenge of WithChallengeStore. It may be set several times.
+// Renewal requests signed with a valid certificate issued by the CA
+// need no verifier's authorization.
+func WithCSRVerifier(verifier CSRVerifier) ServiceOption {
+	return func(s *service) {
+		s.verifiers = append(s.verifiers, verifier)
+	}
+}
+
+// csrVerifier returns the verifier of the challenge passwords and
+// verifiers of the service, or nil if it authorizes all requests.
+// The static password is checked before consuming a one-time one.
+func (s *service) csrVerifier() CSRVerifier {
+	var verifiers []CSRVerifier
+	if s.challenge != "" {
+		verifiers = append(verifiers, StaticChallenge(s.challenge))
+	}
+	if s.challenges != nil {
+		verifiers = append(verifiers, DynamicChallenge(s.challenges))
+	}
+	verifiers = append(verifiers, s.verifiers...)
+	if len(verifiers) == 0 {
+		return nil
+	}
+	return AnyCSRVerifier(verifiers...)
+}
@@ -0,0 +1,101 @@
+package scepserver
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAnyCSRVerifier(t *testing.T) {
+	store := NewChallengeStore(time.Hour, nil)
+	pw, err := store.CreateChallenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := AnyCSRVerifier(StaticChallenge("static"), DynamicChallenge(store))
+	ctx := context.Background()
+	for _, tt := range []struct {
+		challenge, reason string
+	}{
+		{"", "challenge password required"},
+		{"static", ""},
+		{pw, ""},
+		// one-time challenges are consumed
+		{pw, "challenge password unknown, already used or expired"},
+		{"guess", "challenge password unknown, already used or expired"},
+	} {
+		reason, err := v.VerifyCSR(ctx, &x509.CertificateRequest{}, tt.challenge)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reason != tt.reason {
+			t.Errorf("challenge %q: expected reason %q, got %q", tt.challenge, tt.reason, reason)
+		}
+	}
+	if reason, _ := StaticChallenge("static").VerifyCSR(ctx, &x509.CertificateRequest{}, "guess"); reason != "wrong challenge password" {
+		t.Errorf("expected a wrong challenge password, got %q", reason)
+	}
+}
+
+func TestCommandVerifier(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("no shell to run the verification command")
+	}
+	script := filepath.Join(t.TempDir(), "verify.sh")
+	err = os.WriteFile(script, []byte(`
+grep -q "BEGIN CERTIFICATE REQUEST" || exit 2
+case "$SCEP_CHALLENGE_PASSWORD" in
+secret) exit 0 ;;
+crash) exit 2 ;;
+sleep) sleep 10 ;;
+'') exit 1 ;;
+*) echo "unknown challenge for $SCEP_SUBJECT from $SCEP_REQUESTER"; exit 1 ;;
+esac
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: "device"}}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := &CommandVerifier{Path: sh, Args: []string{script}, Timeout: time.Second}
+	ctx := WithRequester(context.Background(), "192.0.2.1")
+	for challenge, want := range map[string]string{
+		"secret": "",
+		"guess":  "unknown challenge for CN=device from 192.0.2.1",
+		"":       "rejected by the verification command",
+	} {
+		reason, err := v.VerifyCSR(ctx, csr, challenge)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reason != want {
+			t.Errorf("challenge %q: expected reason %q, got %q", challenge, want, reason)
+		}
+	}
+	// timeouts and other statuses fail the verification
+	if _, err := v.VerifyCSR(ctx, csr, "sleep"); err == nil {
+		t.Error("expected the timeout to fail the verification")
+	}
+	if _, err := v.VerifyCSR(ctx, csr, "crash"); err == nil {
+		t.Error("expected exit status 2 to fail the verification")
+	}
+}
@@ -0,0 +1,165 @@
+// Package webhook implements a scepserver.Approver asking an HTTP
+// endpoint, such as an external policy engine or a manual approval
+// queue, whether to issue a certificate.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"scepclient/scepserver"
+)
+
+// SignatureHeader carries the HMAC-SHA256 of the request body,
+// as "sha256=<hex>", when a secret is configured.
+const SignatureHeader = "X-SCEP-Signature"
+
+// Config configures the webhook.
+type Config struct {
+	// URL receives the requests as JSON POST requests.
+	URL string
+
+	// Secret, if set, signs the requests in the SignatureHeader,
+	// so that the webhook can verify their origin.
+	Secret []byte
+
+	// Client sends the requests.
+	// http.DefaultClient is used if it is nil.
+	Client *http.Client
+}
+
+// Request is the JSON body posted to the webhook.
+type Request struct {
+	TransactionID  string   `json:"transaction_id"`
+	MessageType    string   `json:"message_type"`
+	Subject        string   `json:"subject"`
+	CommonName     string   `json:"common_name"`
+	DNSNames       []string `json:"dns_names,omitempty"`
+	EmailAddresses []string `json:"email_addresses,omitempty"`
+	IPAddresses    []string `json:"ip_addresses,omitempty"`
+	URIs           []string `json:"uris,omitempty"`
+	KeyAlgorithm   string   `json:"key_algorithm"`
+	KeySize        int      `json:"key_size,omitempty"`
+	ChallengeValid bool     `json:"challenge_valid"`
+	Renewal        bool     `json:"renewal"`
+
+	// CSR is the PEM encoded certificate request.
+	CSR string `json:"csr"`
+}
+
+// Response is the JSON body the webhook responds with.
+type Response struct {
+	// Decision is "allow", "deny" or "pending".
+	Decision string `json:"decision"`
+
+	// Reason is logged by the server.
+	Reason string `json:"reason,omitempty"`
+}
+
+// Approver posts every certificate request to a webhook.
+type Approver struct {
+	config Config
+}
+
+// New returns an Approver using config.
+func New(config Config) (*Approver, error) {
+	if config.URL == "" {
+		return nil, errors.New("webhook: URL is required")
+	}
+	if config.Client == nil {
+		config.Client = http.DefaultClient
+	}
+	return &Approver{config: config}, nil
+}
+
+// Approve posts req to the webhook and returns its decision. Errors,
+// responses other than 200 and unknown decisions fail the request
+// rather than deny it, so that the client can try again.
+func (a *Approver) Approve(ctx context.Context, req *scepserver.ApprovalRequest) (scepserver.Decision, error) {
+	body, err := json.Marshal(NewRequest(req))
+	if err != nil {
+		return scepserver.Deny, err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, a.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return scepserver.Deny, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if len(a.config.Secret) > 0 {
+		httpReq.Header.Set(SignatureHeader, Sign(a.config.Secret, body))
+	}
+	httpResp, err := a.config.Client.Do(httpReq)
+	if err != nil {
+		return scepserver.Deny, fmt.Errorf("webhook: %w", err)
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return scepserver.Deny, fmt.Errorf("webhook: request failed with status %s", httpResp.Status)
+	}
+	var resp Response
+	if err := json.NewDecoder(io.LimitReader(httpResp.Body, 1<<16)).Decode(&resp); err != nil {
+		return scepserver.Deny, fmt.Errorf("webhook: decode response: %w", err)
+	}
+	io.Copy(ioutil.Discard, httpResp.Body)
+	switch resp.Decision {
+	case "allow":
+		return scepserver.Allow, nil
+	case "deny":
+		return scepserver.Deny, nil
+	case "pending":
+		return scepserver.Pending, nil
+	}
+	return scepserver.Deny, fmt.Errorf("webhook: unknown decision %q", resp.Decision)
+}
+
+// NewRequest returns the webhook request describing req.
+func NewRequest(req *scepserver.ApprovalRequest) *Request {
+	csr := req.CSR
+	r := &Request{
+		TransactionID:  req.TransactionID,
+		MessageType:    req.MessageType.String(),
+		Subject:        csr.Subject.String(),
+		CommonName:     csr.Subject.CommonName,
+		DNSNames:       csr.DNSNames,
+		EmailAddresses: csr.EmailAddresses,
+		KeyAlgorithm:   csr.PublicKeyAlgorithm.String(),
+		ChallengeValid: req.ChallengeValid,
+		Renewal:        req.Renewal,
+		CSR:            string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr.Raw})),
+	}
+	for _, ip := range csr.IPAddresses {
+		r.IPAddresses = append(r.IPAddresses, ip.String())
+	}
+	for _, u := range csr.URIs {
+		r.URIs = append(r.URIs, u.String())
+	}
+	switch key := csr.PublicKey.(type) {
+	case *rsa.PublicKey:
+		r.KeySize = key.N.BitLen()
+	case *ecdsa.PublicKey:
+		r.KeySize = key.Curve.Params().BitSize
+	case ed25519.PublicKey:
+		r.KeySize = 256
+	}
+	return r
+}
+
+// Sign returns the SignatureHeader value of body signed with secret.
+func Sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,91 @@
+package webhook
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"scepclient/scep"
+	"scepclient/scepserver"
+)
+
+func TestApprover(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: "device"},
+		DNSNames: []string{"device.example.com"},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := []byte("secret")
+
+	var decision string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if got, want := r.Header.Get(SignatureHeader), Sign(secret, body); got != want {
+			t.Errorf("expected signature %q, got %q", want, got)
+		}
+		var req Request
+		if err := json.Unmarshal(body, &req); err != nil {
+			t.Error(err)
+		}
+		if req.CommonName != "device" || req.KeyAlgorithm != "ECDSA" || req.KeySize != 256 ||
+			len(req.DNSNames) != 1 || !req.ChallengeValid || req.TransactionID != "tid" {
+			t.Errorf("unexpected request %+v", req)
+		}
+		if decision == "" {
+			http.Error(w, "policy engine unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(Response{Decision: decision})
+	}))
+	defer server.Close()
+
+	approver, err := New(Config{URL: server.URL, Secret: secret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &scepserver.ApprovalRequest{
+		TransactionID:  "tid",
+		MessageType:    scep.PKCSReq,
+		CSR:            csr,
+		ChallengeValid: true,
+	}
+	tests := []struct {
+		decision string
+		want     scepserver.Decision
+		wantErr  bool
+	}{
+		{"allow", scepserver.Allow, false},
+		{"deny", scepserver.Deny, false},
+		{"pending", scepserver.Pending, false},
+		{"maybe", scepserver.Deny, true},
+		{"", scepserver.Deny, true},
+	}
+	for _, tt := range tests {
+		decision = tt.decision
+		got, err := approver.Approve(context.Background(), req)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: unexpected error %v", tt.decision, err)
+		}
+		if got != tt.want {
+			t.Errorf("%q: expected %s, got %s", tt.decision, tt.want, got)
+		}
+	}
+}